@@ -0,0 +1,95 @@
+package chatlib
+
+import (
+	"regexp"
+	"strings"
+)
+
+const DefaultCommandPrefix = "!"
+
+// Nicker is implemented by APIs that know the name the bot is addressed by.
+type Nicker interface {
+	Nick() string
+}
+
+// WithCommandPrefix sets the prefix commands are written with, "!" by
+// default. Messages addressed to the bot get the prefix added so that
+// "freyabot: ping", "@freyabot ping" and a private "ping" all match the same
+// action as "!ping".
+func WithCommandPrefix(prefix string) Option {
+	return func(h *Handler) error {
+		h.commandPrefix = prefix
+		return nil
+	}
+}
+
+// RegisterCommand registers an action for a chat command written as the
+// command prefix followed by verb, with the rest of the text matched against
+// args. The arguments are available as the pattern's subgroups.
+func RegisterCommand(verb, args, example, help string, fn ActionFunc, roles ...string) Option {
+	return func(h *Handler) error {
+		pattern := "^" + regexp.QuoteMeta(h.commandPrefix+verb) + `$`
+		if args != "" {
+			pattern = "^" + regexp.QuoteMeta(h.commandPrefix+verb) + `\s+` + args + `$`
+		}
+		return RegisterAction(CommandMessage, pattern, example, help, fn, roles...)(h)
+	}
+}
+
+// addressing checks whether msg is addressed to the bot, either privately or
+// by nick, and if so strips the nick and makes sure the text starts with the
+// command prefix. Commands written with prefix, the one set for the channel,
+// are rewritten to the global prefix the actions are registered with. It
+// reports whether the text must not be taken as a command because it uses the
+// global prefix where another one is set.
+func (h *Handler) addressing(msg *Message, prefix string) bool {
+	if msg.Nick == "" || msg.Command != CommandMessage {
+		return false
+	}
+	text := msg.Text
+	api, _ := h.apiFor(msg)
+	if n, ok := api.(Nicker); ok && n.Nick() != "" {
+		if rest, ok := stripAddress(text, n.Nick()); ok {
+			msg.Addressed = true
+			text = rest
+		}
+	}
+	if msg.Private {
+		msg.Addressed = true
+	}
+	ignore := false
+	switch {
+	case prefix != "" && strings.HasPrefix(text, prefix):
+		text = h.commandPrefix + strings.TrimPrefix(text, prefix)
+	case msg.Addressed:
+		if h.commandPrefix != "" && !strings.HasPrefix(text, h.commandPrefix) {
+			text = h.commandPrefix + text
+		}
+	case prefix != h.commandPrefix && h.commandPrefix != "" && strings.HasPrefix(text, h.commandPrefix):
+		ignore = true
+	}
+	msg.Text = text
+	return ignore
+}
+
+// stripAddress removes a leading "nick:", "nick," or "@nick" from text.
+func stripAddress(text, nick string) (string, bool) {
+	candidate := strings.TrimPrefix(text, "@")
+	if len(candidate) < len(nick) || !strings.EqualFold(candidate[:len(nick)], nick) {
+		return text, false
+	}
+	rest := candidate[len(nick):]
+	switch {
+	case strings.HasPrefix(rest, ":"), strings.HasPrefix(rest, ","):
+		rest = rest[1:]
+	case len(candidate) != len(text) && strings.HasPrefix(rest, " "):
+		// "@nick text" doesn't need punctuation
+	default:
+		return text, false
+	}
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return text, false
+	}
+	return rest, true
+}
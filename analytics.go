@@ -0,0 +1,350 @@
+package chatlib
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultAnalyticsRetention is how many days of usage are kept by default.
+const DefaultAnalyticsRetention = 90
+
+// analyticsFlushInterval is how often the usage of the day is saved.
+const analyticsFlushInterval = time.Minute
+
+// analyticsDaysKey is where the days usage is kept for are listed in the
+// Store, so those past the retention can be deleted.
+const analyticsDaysKey = "analytics/days"
+
+// analyticsKey is where the usage of a day is kept in the Store.
+func analyticsKey(day string) string {
+	return "analytics/" + day
+}
+
+// ActionUsage is how much an action was used on a day.
+type ActionUsage struct {
+	Module string `json:"module,omitempty"`
+	Action string `json:"action"`
+	Uses   int    `json:"uses"`
+	// Users is how many different users used the action. It is approximate
+	// across restarts, since who used it isn't kept.
+	Users int `json:"users"`
+}
+
+// UsageTrend is how much an action was used over a number of days.
+type UsageTrend struct {
+	Module string `json:"module,omitempty"`
+	Action string `json:"action"`
+	// Daily are the uses on each day, oldest first, ending today.
+	Daily []int `json:"daily"`
+	Uses  int   `json:"uses"`
+	// PeakUsers is the most different users of the action in a day.
+	PeakUsers int `json:"peak-users"`
+}
+
+type usageKey struct {
+	module string
+	action string
+}
+
+// usageCount counts the uses of an action in a day. seen holds the users
+// already counted, by a hash salted for the day, and is never saved.
+type usageCount struct {
+	uses  int
+	users int
+	seen  map[uint64]struct{}
+}
+
+// analytics aggregates the usage of actions by day, in UTC, without keeping
+// who used them or what they said.
+type analytics struct {
+	mu        sync.Mutex
+	retention int
+	day       string
+	salt      []byte
+	// days are the counts not saved yet, and those of the current day.
+	days  map[string]map[usageKey]*usageCount
+	dirty bool
+	// flushMu is held while saving, loaded tells whether the usage saved by
+	// an earlier run today was added to the counts yet.
+	flushMu sync.Mutex
+	loaded  bool
+}
+
+// WithAnalytics counts how much each action is used a day, and by how many
+// users, keeping the counts for retention days so maintainers can tell which
+// modules are used. Nothing about the users or their messages is kept: users
+// are told apart by a hash salted anew every day and kept in memory only.
+// Counts stay in the Store and are read with UsageTrends.
+func WithAnalytics(retention int) Option {
+	return func(h *Handler) error {
+		if retention <= 0 {
+			return errors.Wrapf(ErrInvalidConfig, "invalid analytics retention: %d days", retention)
+		}
+		h.analytics = &analytics{retention: retention, days: make(map[string]map[usageKey]*usageCount)}
+		return WithTask("analytics", h.runAnalytics)(h)
+	}
+}
+
+// counted reports whether uses of the action are counted: commands and
+// actions with an example, which are the ones users run on purpose.
+func (h *Handler) counted(action *Action) bool {
+	return action.example != "" || h.isCommand(action)
+}
+
+// countUsage counts a use of the action by the sender of msg.
+func (h *Handler) countUsage(action *Action, msg *Message) {
+	if h.analytics == nil || !h.counted(action) {
+		return
+	}
+	h.analytics.count(usageKey{action.module, actionName(action)}, msg.API, msg.Nick, time.Now())
+}
+
+// today returns the counts of the day of now, moving on from the previous
+// day if it is over. a.mu is held.
+func (a *analytics) today(now time.Time) map[usageKey]*usageCount {
+	if day := now.UTC().Format(time.DateOnly); day != a.day {
+		// Users can't be told apart across days
+		for _, u := range a.days[a.day] {
+			u.seen = nil
+		}
+		a.day = day
+		a.salt = make([]byte, 32)
+		rand.Read(a.salt)
+	}
+	counts := a.days[a.day]
+	if counts == nil {
+		counts = make(map[usageKey]*usageCount)
+		a.days[a.day] = counts
+	}
+	return counts
+}
+
+func (a *analytics) count(k usageKey, api, nick string, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	counts := a.today(now)
+	u := counts[k]
+	if u == nil {
+		u = &usageCount{}
+		counts[k] = u
+	}
+	u.uses++
+	if nick != "" {
+		mac := hmac.New(sha256.New, a.salt)
+		mac.Write([]byte(strings.ToLower(api) + "\x00" + strings.ToLower(nick)))
+		user := binary.BigEndian.Uint64(mac.Sum(nil))
+		if u.seen == nil {
+			u.seen = make(map[uint64]struct{})
+		}
+		if _, ok := u.seen[user]; !ok {
+			u.seen[user] = struct{}{}
+			u.users++
+		}
+	}
+	a.dirty = true
+}
+
+// runAnalytics saves the counts regularly until the Handler stops.
+func (h *Handler) runAnalytics(c context.Context) error {
+	t := time.NewTicker(analyticsFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.Done():
+			return nil
+		case <-t.C:
+			if err := h.analytics.flush(c, h.store, time.Now()); err != nil {
+				log.Error().Err(err).Msg("error saving usage")
+			}
+		}
+	}
+}
+
+// load adds the usage of the day of now saved by an earlier run. a.flushMu
+// is held.
+func (a *analytics) load(c context.Context, store Store, now time.Time) error {
+	saved, err := loadUsage(c, store, now.UTC().Format(time.DateOnly))
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	counts := a.today(now)
+	for _, s := range saved {
+		k := usageKey{s.Module, s.Action}
+		if counts[k] == nil {
+			counts[k] = &usageCount{}
+		}
+		counts[k].uses += s.Uses
+		counts[k].users += s.Users
+	}
+	a.loaded = true
+	a.dirty = a.dirty || len(saved) > 0
+	return nil
+}
+
+func loadUsage(c context.Context, store Store, day string) ([]ActionUsage, error) {
+	b, err := store.Get(c, analyticsKey(day))
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithMessage(err, "error loading usage")
+	}
+	var usage []ActionUsage
+	if err := json.Unmarshal(b, &usage); err != nil {
+		return nil, errors.Wrapf(err, "invalid usage of %s in store", day)
+	}
+	return usage, nil
+}
+
+// flush saves the counts that changed, forgetting those of past days, and
+// deletes the usage of days past the retention. The usage saved by an
+// earlier run today is loaded first, so it adds up rather than being
+// overwritten.
+func (a *analytics) flush(c context.Context, store Store, now time.Time) error {
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+	if !a.loaded {
+		if err := a.load(c, store, now); err != nil {
+			return err
+		}
+	}
+	a.mu.Lock()
+	if !a.dirty {
+		a.mu.Unlock()
+		return nil
+	}
+	saves := make(map[string][]byte, len(a.days))
+	saved := make([]string, 0, len(a.days))
+	current := a.day
+	for day, counts := range a.days {
+		usage := make([]ActionUsage, 0, len(counts))
+		for k, u := range counts {
+			usage = append(usage, ActionUsage{Module: k.module, Action: k.action, Uses: u.uses, Users: u.users})
+		}
+		slices.SortFunc(usage, func(a, b ActionUsage) int {
+			return strings.Compare(a.Module+"\x00"+a.Action, b.Module+"\x00"+b.Action)
+		})
+		b, err := json.Marshal(usage)
+		if err != nil {
+			a.mu.Unlock()
+			return err
+		}
+		saves[day] = b
+		saved = append(saved, day)
+	}
+	a.dirty = false
+	a.mu.Unlock()
+
+	for day, b := range saves {
+		if err := store.Set(c, analyticsKey(day), b); err != nil {
+			a.mu.Lock()
+			a.dirty = true
+			a.mu.Unlock()
+			return errors.WithMessage(err, "error saving usage")
+		}
+	}
+	// Past days don't change anymore once saved
+	a.mu.Lock()
+	for _, day := range saved {
+		if day != current && day != a.day {
+			delete(a.days, day)
+		}
+	}
+	a.mu.Unlock()
+	return a.prune(c, store, saved, now)
+}
+
+// prune lists the days saved and deletes those past the retention.
+func (a *analytics) prune(c context.Context, store Store, saved []string, now time.Time) error {
+	var days []string
+	b, err := store.Get(c, analyticsDaysKey)
+	if err == nil {
+		if err := json.Unmarshal(b, &days); err != nil {
+			return errors.Wrap(err, "invalid usage days in store")
+		}
+	} else if !errors.Is(err, ErrNotFound) {
+		return errors.WithMessage(err, "error loading usage days")
+	}
+	oldest := now.UTC().AddDate(0, 0, 1-a.retention).Format(time.DateOnly)
+	days = append(days, saved...)
+	slices.Sort(days)
+	days = slices.Compact(days)
+	kept := days[:0]
+	for _, day := range days {
+		if day >= oldest {
+			kept = append(kept, day)
+		} else if err := store.Delete(c, analyticsKey(day)); err != nil {
+			return errors.WithMessage(err, "error deleting usage")
+		}
+	}
+	if b, err = json.Marshal(kept); err != nil {
+		return err
+	}
+	return errors.WithMessage(store.Set(c, analyticsDaysKey, b), "error saving usage days")
+}
+
+// UsageTrends returns how much each action was used over the last days days,
+// most used first. Actions that weren't used are included so they stand out.
+// It returns nil if analytics aren't enabled, see WithAnalytics.
+func (h *Handler) UsageTrends(c context.Context, days int) ([]UsageTrend, error) {
+	if h.analytics == nil {
+		return nil, nil
+	}
+	if days <= 0 || days > h.analytics.retention {
+		return nil, errors.Errorf("usage is kept for 1 to %d days, not %d", h.analytics.retention, days)
+	}
+	now := time.Now()
+	if err := h.analytics.flush(c, h.store, now); err != nil {
+		return nil, err
+	}
+	trends := make(map[usageKey]*UsageTrend)
+	trend := func(k usageKey) *UsageTrend {
+		t := trends[k]
+		if t == nil {
+			t = &UsageTrend{Module: k.module, Action: k.action, Daily: make([]int, days)}
+			trends[k] = t
+		}
+		return t
+	}
+	for _, action := range h.actions {
+		if h.counted(action) {
+			trend(usageKey{action.module, actionName(action)})
+		}
+	}
+	for i := 0; i < days; i++ {
+		day := now.UTC().AddDate(0, 0, i+1-days).Format(time.DateOnly)
+		usage, err := loadUsage(c, h.store, day)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range usage {
+			t := trend(usageKey{u.Module, u.Action})
+			t.Daily[i] += u.Uses
+			t.Uses += u.Uses
+			t.PeakUsers = max(t.PeakUsers, u.Users)
+		}
+	}
+	sorted := make([]UsageTrend, 0, len(trends))
+	for _, t := range trends {
+		sorted = append(sorted, *t)
+	}
+	slices.SortFunc(sorted, func(a, b UsageTrend) int {
+		if a.Uses != b.Uses {
+			return b.Uses - a.Uses
+		}
+		return strings.Compare(a.Module+"\x00"+a.Action, b.Module+"\x00"+b.Action)
+	})
+	return sorted, nil
+}
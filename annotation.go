@@ -0,0 +1,76 @@
+package chatlib
+
+import (
+	"context"
+	"regexp"
+)
+
+// Middleware runs on every received message before actions are matched. It
+// is typically used to attach annotations that actions can read instead of
+// each one repeating the same work.
+type Middleware func(c context.Context, msg *Message) error
+
+// AnnotationKey names a typed annotation on a Message.
+type AnnotationKey[T any] struct {
+	name string
+}
+
+func NewAnnotationKey[T any](name string) AnnotationKey[T] {
+	return AnnotationKey[T]{name}
+}
+
+func (k AnnotationKey[T]) Name() string {
+	return k.name
+}
+
+// Get returns the annotation on msg and whether it was set.
+func (k AnnotationKey[T]) Get(msg *Message) (T, bool) {
+	v, ok := msg.annotations[k.name].(T)
+	return v, ok
+}
+
+// Set attaches the annotation to msg, replacing any previous value.
+func (k AnnotationKey[T]) Set(msg *Message, v T) {
+	if msg.annotations == nil {
+		msg.annotations = make(map[string]any)
+	}
+	msg.annotations[k.name] = v
+}
+
+// AnnotationURLs holds the URLs found in the message text.
+var AnnotationURLs = NewAnnotationKey[[]string]("urls")
+
+func WithMiddleware(mw Middleware) Option {
+	return func(h *Handler) error {
+		h.middlewares = append(h.middlewares, mw)
+		return nil
+	}
+}
+
+var urlRe = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// FindURLs returns the URLs in text.
+func FindURLs(text string) []string {
+	return urlRe.FindAllString(text, -1)
+}
+
+// URLMiddleware annotates messages with the URLs found in their text.
+func URLMiddleware(c context.Context, msg *Message) error {
+	if urls := FindURLs(msg.Text); len(urls) > 0 {
+		AnnotationURLs.Set(msg, urls)
+	}
+	return nil
+}
+
+// annotate runs the middlewares on msg in the order they were added. Errors
+// are returned after all middlewares have run so one failing enrichment does
+// not prevent the others.
+func (h *Handler) annotate(c context.Context, msg *Message) []error {
+	var errs []error
+	for _, mw := range h.middlewares {
+		if err := mw(c, msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,106 @@
+package chatlib
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// CommandFunc is called with the parsed flags of a command registered with
+// RegisterFlagCommand. Positional arguments are in fs.Args().
+type CommandFunc func(c context.Context, fs *pflag.FlagSet, msg *Message) error
+
+// SplitArgs splits text into arguments the way a shell would: whitespace
+// separates arguments, single and double quotes group them and a backslash
+// escapes the next character outside single quotes.
+func SplitArgs(text string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range text {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// RegisterFlagCommand registers a chat command whose arguments are parsed
+// like a command line, e.g. "!deploy --env prod --force 'my service'". The
+// flags function defines the flags on a fresh FlagSet for every call. If the
+// arguments don't parse, the sender is told the usage and fn isn't called.
+func RegisterFlagCommand(verb, example, help string, flags func(fs *pflag.FlagSet), fn CommandFunc, roles ...string) Option {
+	return func(h *Handler) error {
+		pattern := "^" + regexp.QuoteMeta(h.commandPrefix+verb) + `(?:\s+(.*))?$`
+		action := func(c context.Context, re *regexp.Regexp, msg *Message) error {
+			fs := pflag.NewFlagSet(verb, pflag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			if flags != nil {
+				flags(fs)
+			}
+			args, err := SplitArgs(re.FindStringSubmatch(msg.Text)[1])
+			if err == nil {
+				err = fs.Parse(args)
+			}
+			if err != nil {
+				return h.Reply(c, msg, "error: "+err.Error()+"; usage: "+usage(example, fs))
+			}
+			return fn(c, fs, msg)
+		}
+		return RegisterAction(CommandMessage, pattern, example, help, action, roles...)(h)
+	}
+}
+
+// usage returns the example followed by a one line summary of the flags.
+func usage(example string, fs *pflag.FlagSet) string {
+	var flags []string
+	fs.VisitAll(func(f *pflag.Flag) {
+		s := "--" + f.Name
+		if t := f.Value.Type(); t != "bool" {
+			s += " " + t
+		}
+		flags = append(flags, s)
+	})
+	if len(flags) == 0 {
+		return example
+	}
+	return example + " [" + strings.Join(flags, "] [") + "]"
+}
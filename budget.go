@@ -0,0 +1,242 @@
+package chatlib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const DefaultBudgetStrikes = 3
+
+// ActionBudget limits what a single run of an action may use. A zero limit is
+// not enforced. An action that goes over any limit Strikes times is disabled
+// until the configuration is reloaded.
+type ActionBudget struct {
+	WallTime time.Duration
+	// CPUTime is measured for the whole process while the action runs, so it
+	// includes whatever else the bot was doing at the time. Actions run one at
+	// a time so this is usually close enough to catch a busy loop. It is only
+	// enforced on unix systems, and not while other Handlers run in the same
+	// process, as in a Group, whose actions would count against it.
+	CPUTime  time.Duration
+	Messages int
+	Bytes    int
+	Strikes  int
+}
+
+// runningHandlers counts the Handlers started in the process, which share
+// the CPU time measured for actions.
+var runningHandlers atomic.Int32
+
+// budgets tracks budget violations per action.
+type budgets struct {
+	ActionBudget
+	// sharedOnce logs that the CPU time isn't enforced in a shared process.
+	sharedOnce sync.Once
+	mu         sync.Mutex
+	strikes    map[*Action]int
+	disabled   map[*Action]bool
+}
+
+// actionRun counts what an action sends while it runs. Actions may send from
+// goroutines of their own so the counters are atomic.
+type actionRun struct {
+	messages atomic.Int64
+	bytes    atomic.Int64
+}
+
+type actionRunKey struct{}
+
+// WithActionBudget enforces budget on every action.
+func WithActionBudget(budget ActionBudget) Option {
+	return func(h *Handler) error {
+		if budget.Strikes <= 0 {
+			budget.Strikes = DefaultBudgetStrikes
+		}
+		h.budgets = &budgets{
+			ActionBudget: budget,
+			strikes:      make(map[*Action]int),
+			disabled:     make(map[*Action]bool),
+		}
+		return WithReloader(func(c context.Context, h *Handler) error {
+			h.budgets.reset()
+			return nil
+		})(h)
+	}
+}
+
+// WithAdmins sets the admins, told when the bot disables a misbehaving
+// action and given every role. They are nicks, or accounts on networks that
+// track them, where users who aren't logged in are never admins whatever
+// their nick.
+func WithAdmins(nicks ...string) Option {
+	return func(h *Handler) error {
+		h.admins = append(h.admins, nicks...)
+		return nil
+	}
+}
+
+// IsAdmin reports whether name, a nick or account, is one of the admins.
+func (h *Handler) IsAdmin(nick string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, admin := range h.admins {
+		if strings.EqualFold(admin, nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// runAction runs the action, measuring it against the budget if there is one
+// and counting its use if analytics are enabled.
+func (h *Handler) runAction(c context.Context, action *Action, msg *Message) error {
+	c = context.WithValue(c, actionKey{}, action)
+	b := h.budgets
+	if b != nil && b.isDisabled(action) {
+		log.Debug().Str("action", actionName(action)).Msg("not running disabled action")
+		return nil
+	}
+	if !msg.Self {
+		h.countUsage(action, msg)
+	}
+	if b == nil {
+		return action.fn(c, action.re, msg)
+	}
+	run := &actionRun{}
+	var watchdog *time.Timer
+	if b.WallTime > 0 {
+		watchdog = time.AfterFunc(b.WallTime, func() {
+			log.Warn().Str("action", actionName(action)).Dur("budget", b.WallTime).Msg("action still running past its wall time budget")
+		})
+	}
+	measureCPU := b.CPUTime > 0
+	if measureCPU && runningHandlers.Load() > 1 {
+		measureCPU = false
+		b.sharedOnce.Do(func() {
+			log.Warn().Msg("other handlers run in this process, not enforcing the cpu time budget")
+		})
+	}
+	start, cpu := time.Now(), cpuTime()
+	err := action.fn(context.WithValue(c, actionRunKey{}, run), action.re, msg)
+	wall, cpu := time.Since(start), cpuTime()-cpu
+	if watchdog != nil {
+		watchdog.Stop()
+	}
+
+	var over []string
+	if b.WallTime > 0 && wall > b.WallTime {
+		over = append(over, fmt.Sprintf("wall time %s > %s", wall.Round(time.Millisecond), b.WallTime))
+	}
+	if measureCPU && cpu > b.CPUTime {
+		over = append(over, fmt.Sprintf("cpu time %s > %s", cpu.Round(time.Millisecond), b.CPUTime))
+	}
+	if n := run.messages.Load(); b.Messages > 0 && n > int64(b.Messages) {
+		over = append(over, fmt.Sprintf("%d messages > %d", n, b.Messages))
+	}
+	if n := run.bytes.Load(); b.Bytes > 0 && n > int64(b.Bytes) {
+		over = append(over, fmt.Sprintf("%d bytes > %d", n, b.Bytes))
+	}
+	if len(over) > 0 {
+		h.overBudget(c, action, msg, over)
+	}
+	return err
+}
+
+// overBudget gives the action a strike for going over the limits in over,
+// disabling it if it has had too many. Without an action budget it is only
+// logged.
+func (h *Handler) overBudget(c context.Context, action *Action, msg *Message, over []string) {
+	b := h.budgets
+	if b == nil {
+		log.Warn().Str("action", actionName(action)).Strs("over", over).Msg("action went over its limits")
+		return
+	}
+	strikes, disabled := b.strike(action)
+	log.Warn().Str("action", actionName(action)).Strs("over", over).Int("strikes", strikes).Msg("action went over budget")
+	if disabled {
+		log.Error().Str("action", actionName(action)).Msg("disabling action after repeated budget violations")
+		h.record(c, EventBudget, msg.API, "disabled %s after %d budget violations", actionName(action), strikes)
+		h.NotifyAdmins(c, msg.API, fmt.Sprintf("disabled %s after %d budget violations, last: %v. Reload the configuration to enable it again", actionName(action), strikes, over))
+	}
+}
+
+// countOutput records a message sent by the action running in c, if any.
+func countOutput(c context.Context, msg *Message) {
+	if run, ok := c.Value(actionRunKey{}).(*actionRun); ok {
+		run.messages.Add(1)
+		run.bytes.Add(int64(len(msg.Text)))
+	}
+}
+
+// NotifyAdmins sends a notice to each of the admins through the named API,
+// for things that need a person to look at them.
+func (h *Handler) NotifyAdmins(c context.Context, api, text string) {
+	h.mu.RLock()
+	admins := h.admins
+	h.mu.RUnlock()
+	for _, nick := range admins {
+		if err := h.Send(c, &Message{
+			Command:  CommandNotice,
+			Receiver: nick,
+			Text:     text,
+			API:      api,
+		}); err != nil {
+			log.Error().Err(err).Str("admin", nick).Msg("error notifying admin")
+		}
+	}
+}
+
+// strike records a budget violation and reports the number of violations so
+// far and whether the action was disabled as a result.
+func (b *budgets) strike(action *Action) (int, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.strikes[action]++
+	if b.strikes[action] >= b.Strikes && !b.disabled[action] {
+		b.disabled[action] = true
+		return b.strikes[action], true
+	}
+	return b.strikes[action], false
+}
+
+func (b *budgets) isDisabled(action *Action) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.disabled[action]
+}
+
+func (b *budgets) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.strikes = make(map[*Action]int)
+	b.disabled = make(map[*Action]bool)
+}
+
+// actionName names an action for logs by its example, falling back to its
+// pattern.
+func actionName(action *Action) string {
+	if action.example != "" {
+		return action.example
+	}
+	return action.re.String()
+}
+
+// DisabledActions returns the names of actions disabled for going over budget.
+func (h *Handler) DisabledActions() []string {
+	if h.budgets == nil {
+		return nil
+	}
+	h.budgets.mu.Lock()
+	defer h.budgets.mu.Unlock()
+	names := make([]string, 0, len(h.budgets.disabled))
+	for action := range h.budgets.disabled {
+		names = append(names, actionName(action))
+	}
+	return names
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package chatlib
+
+import "time"
+
+// cpuTime returns 0 where the CPU time of the process isn't available, so the
+// CPU time budget is never exceeded.
+func cpuTime() time.Duration {
+	return 0
+}
@@ -0,0 +1,289 @@
+package chatlib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ReplyFunc computes the lines an action replies with.
+type ReplyFunc func(c context.Context, re *regexp.Regexp, msg *Message) ([]string, error)
+
+// CacheSweepInterval is how often the Handler's Cache is swept of expired
+// entries.
+const CacheSweepInterval = 10 * time.Minute
+
+// Cache is a TTL cache kept in memory and backed by a Store, so cached
+// results survive restarts when the Store does.
+type Cache struct {
+	name  string
+	store Store
+	mu    sync.Mutex
+	mem   map[string]cacheEntry
+	// index holds when each entry in the store expires, so that Sweep finds
+	// them without listing the store, including those of earlier runs. It is
+	// kept in the store too, and loaded on first use.
+	indexMu sync.Mutex
+	index   map[string]time.Time
+}
+
+type cacheEntry struct {
+	Value   []byte    `json:"value"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewCache returns a Cache whose entries are kept in store under
+// "cache/<name>/". store may be nil to only cache in memory.
+func NewCache(name string, store Store) *Cache {
+	return &Cache{
+		name:  name,
+		store: store,
+		mem:   make(map[string]cacheEntry),
+	}
+}
+
+func (ch *Cache) storeKey(key string) string {
+	return "cache/" + ch.name + "/" + key
+}
+
+func (ch *Cache) indexKey() string {
+	return "cache/" + ch.name
+}
+
+// updateIndex applies fn to the index and saves it.
+func (ch *Cache) updateIndex(c context.Context, fn func(index map[string]time.Time)) error {
+	ch.indexMu.Lock()
+	defer ch.indexMu.Unlock()
+	if ch.index == nil {
+		ch.index = make(map[string]time.Time)
+		bts, err := ch.store.Get(c, ch.indexKey())
+		if err == nil {
+			err = json.Unmarshal(bts, &ch.index)
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			ch.index = nil
+			return errors.Wrap(err, "cache: failed to load index")
+		}
+	}
+	fn(ch.index)
+	bts, err := json.Marshal(ch.index)
+	if err != nil {
+		return err
+	}
+	return ch.store.Set(c, ch.indexKey(), bts)
+}
+
+// Get returns the cached value for key if it exists and hasn't expired.
+func (ch *Cache) Get(c context.Context, key string) ([]byte, bool) {
+	ch.mu.Lock()
+	e, ok := ch.mem[key]
+	ch.mu.Unlock()
+	if !ok && ch.store != nil {
+		if bts, err := ch.store.Get(c, ch.storeKey(key)); err == nil && json.Unmarshal(bts, &e) == nil {
+			ok = true
+			ch.mu.Lock()
+			ch.mem[key] = e
+			ch.mu.Unlock()
+		}
+	}
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.Expires) {
+		ch.Delete(c, key)
+		return nil, false
+	}
+	return e.Value, true
+}
+
+// Set caches value under key for ttl.
+func (ch *Cache) Set(c context.Context, key string, value []byte, ttl time.Duration) error {
+	e := cacheEntry{Value: value, Expires: time.Now().Add(ttl)}
+	ch.mu.Lock()
+	ch.mem[key] = e
+	ch.mu.Unlock()
+	if ch.store == nil {
+		return nil
+	}
+	bts, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := ch.store.Set(c, ch.storeKey(key), bts); err != nil {
+		return err
+	}
+	return ch.updateIndex(c, func(index map[string]time.Time) {
+		index[key] = e.Expires
+	})
+}
+
+func (ch *Cache) Delete(c context.Context, key string) error {
+	ch.mu.Lock()
+	delete(ch.mem, key)
+	ch.mu.Unlock()
+	if ch.store == nil {
+		return nil
+	}
+	if err := ch.store.Delete(c, ch.storeKey(key)); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return ch.updateIndex(c, func(index map[string]time.Time) {
+		delete(index, key)
+	})
+}
+
+// Sweep removes the expired entries from memory and the store. Entries are
+// otherwise only removed when they are read after expiring.
+func (ch *Cache) Sweep(c context.Context) error {
+	now := time.Now()
+	ch.mu.Lock()
+	for key, e := range ch.mem {
+		if now.After(e.Expires) {
+			delete(ch.mem, key)
+		}
+	}
+	ch.mu.Unlock()
+	if ch.store == nil {
+		return nil
+	}
+	var expired []string
+	if err := ch.updateIndex(c, func(index map[string]time.Time) {
+		for key, expires := range index {
+			if now.After(expires) {
+				expired = append(expired, key)
+				delete(index, key)
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	for _, key := range expired {
+		if err := ch.store.Delete(c, ch.storeKey(key)); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// runCacheSweep sweeps the Handler's Cache every CacheSweepInterval.
+func (h *Handler) runCacheSweep(c context.Context) error {
+	t := time.NewTicker(CacheSweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.Done():
+			return nil
+		case <-t.C:
+			if err := h.cache.Sweep(c); err != nil {
+				log.Error().Err(err).Msg("error sweeping the cache")
+			}
+		}
+	}
+}
+
+// Do returns the cached value for key, or calls fn and caches its result for
+// ttl. Errors from fn are not cached.
+func (ch *Cache) Do(c context.Context, key string, ttl time.Duration, fn func() ([]byte, error)) ([]byte, error) {
+	if v, ok := ch.Get(c, key); ok {
+		return v, nil
+	}
+	v, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	return v, ch.Set(c, key, v, ttl)
+}
+
+// Cache returns the Handler's result cache, which is backed by its Store.
+func (h *Handler) Cache() *Cache {
+	return h.cache
+}
+
+// Replier turns a ReplyFunc into an ActionFunc that replies with its lines,
+// paginated if pagination is enabled.
+func Replier(fn ReplyFunc) ActionFunc {
+	return func(c context.Context, re *regexp.Regexp, msg *Message) error {
+		h := FromContext(c)
+		if h == nil {
+			return errors.New("replier: no handler in context")
+		}
+		lines, err := fn(c, re, msg)
+		if err != nil {
+			return err
+		}
+		return h.ReplyLines(c, msg, lines)
+	}
+}
+
+// CacheScope adds to the key WithCache caches replies under, for replies
+// that depend on more than the message.
+type CacheScope func(msg *Message) string
+
+var (
+	// CacheByChannel caches replies per channel, or per user in private.
+	CacheByChannel CacheScope = func(msg *Message) string {
+		return strings.ToLower(msg.ReplyTarget())
+	}
+	// CacheBySender caches replies per user.
+	CacheBySender CacheScope = func(msg *Message) string {
+		return strings.ToLower(msg.Nick)
+	}
+)
+
+// WithCache caches the lines returned by fn for ttl, keyed by the action, the
+// API and the message command and text, so repeated requests like "!weather
+// london" are answered without redoing the work. scopes add to the key.
+func WithCache(ttl time.Duration, fn ReplyFunc, scopes ...CacheScope) ReplyFunc {
+	return func(c context.Context, re *regexp.Regexp, msg *Message) ([]string, error) {
+		h := FromContext(c)
+		if h == nil {
+			return fn(c, re, msg)
+		}
+		var name string
+		if action, ok := c.Value(actionKey{}).(*Action); ok {
+			name = actionName(action)
+		}
+		parts := []string{name, msg.API, msg.Command, strings.ToLower(strings.TrimSpace(msg.Text))}
+		for _, scope := range scopes {
+			parts = append(parts, scope(msg))
+		}
+		// Hashed to keep store keys short and free of odd characters
+		sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+		key := hex.EncodeToString(sum[:])
+		bts, err := h.cache.Do(c, key, ttl, func() ([]byte, error) {
+			lines, err := fn(c, re, msg)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(lines)
+		})
+		if err != nil {
+			return nil, err
+		}
+		var lines []string
+		if err := json.Unmarshal(bts, &lines); err != nil {
+			return nil, err
+		}
+		return lines, nil
+	}
+}
+
+type handlerKey struct{}
+
+// actionKey holds the Action running in a context.
+type actionKey struct{}
+
+// FromContext returns the Handler running the action the context was passed
+// to, or nil.
+func FromContext(c context.Context) *Handler {
+	h, _ := c.Value(handlerKey{}).(*Handler)
+	return h
+}
@@ -0,0 +1,229 @@
+// Package calendar announces upcoming events from iCal subscriptions and
+// CalDAV calendars to channels, and answers "!agenda" queries.
+package calendar
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/gregseb/chatlib/remind"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultRefresh = 15 * time.Minute
+	// window is how far ahead events are fetched, enough for the agenda of
+	// the coming week and any lead time.
+	window = 8 * 24 * time.Hour
+)
+
+// Calendar caches the events of its sources and announces them ahead of
+// time.
+type Calendar struct {
+	sources []Source
+	zone    *time.Location
+	leads   []time.Duration
+	refresh time.Duration
+	now     func() time.Time
+
+	mu      sync.Mutex
+	events  []Event
+	from    time.Time
+	to      time.Time
+	fetched bool
+}
+
+// New returns a Calendar announcing events leads before they start. Times are
+// shown in zone unless the user has chosen their own.
+func New(sources []Source, zone *time.Location, leads []time.Duration, refresh time.Duration) *Calendar {
+	return &Calendar{
+		sources: sources,
+		zone:    zone,
+		leads:   leads,
+		refresh: refresh,
+		now:     time.Now,
+	}
+}
+
+// Refresh fetches the events of the coming days from every source. Sources
+// that fail keep nothing, the rest are still used.
+func (cal *Calendar) Refresh(c context.Context) error {
+	now := cal.now()
+	from, to := now.Add(-24*time.Hour), now.Add(window)
+	events, err := cal.fetch(c, from, to)
+	cal.mu.Lock()
+	cal.events, cal.from, cal.to, cal.fetched = events, from, to, true
+	cal.mu.Unlock()
+	return err
+}
+
+func (cal *Calendar) fetch(c context.Context, from, to time.Time) ([]Event, error) {
+	events := make([]Event, 0)
+	var failed error
+	for _, s := range cal.sources {
+		evs, err := s.Events(c, from, to)
+		if err != nil {
+			failed = err
+			continue
+		}
+		events = append(events, evs...)
+	}
+	return Expand(events, from, to), failed
+}
+
+// Between returns the events overlapping from to to, from the cache if it
+// covers them.
+func (cal *Calendar) Between(c context.Context, from, to time.Time) ([]Event, error) {
+	cal.mu.Lock()
+	cached := cal.fetched && !from.Before(cal.from) && !to.After(cal.to)
+	events := cal.events
+	cal.mu.Unlock()
+	if !cached {
+		return cal.fetch(c, from, to)
+	}
+	return Expand(events, from, to), nil
+}
+
+// Run refreshes the events every refresh and calls announce with the text of
+// each announcement as it falls due, until the context is cancelled.
+func (cal *Calendar) Run(c context.Context, announce func(c context.Context, text string) error) error {
+	if err := cal.Refresh(c); err != nil {
+		log.Error().Str("module", ModuleName).Err(err).Msg("error fetching calendar")
+	}
+	refresh := time.NewTicker(cal.refresh)
+	defer refresh.Stop()
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	last := cal.now()
+	for {
+		select {
+		case <-c.Done():
+			return c.Err()
+		case <-refresh.C:
+			if err := cal.Refresh(c); err != nil {
+				log.Error().Str("module", ModuleName).Err(err).Msg("error fetching calendar")
+			}
+		case <-tick.C:
+			now := cal.now()
+			for _, text := range cal.due(last, now) {
+				if err := announce(c, text); err != nil {
+					log.Error().Str("module", ModuleName).Err(err).Msg("error announcing event")
+				}
+			}
+			last = now
+		}
+	}
+}
+
+// due returns the announcements that fell due after last, up to now. All day
+// events are only shown in the agenda.
+func (cal *Calendar) due(last, now time.Time) []string {
+	cal.mu.Lock()
+	events := cal.events
+	cal.mu.Unlock()
+	texts := make([]string, 0)
+	for _, ev := range events {
+		if ev.AllDay {
+			continue
+		}
+		for _, lead := range cal.leads {
+			at := ev.Start.Add(-lead)
+			if at.After(last) && !at.After(now) {
+				texts = append(texts, cal.announcement(ev, lead))
+			}
+		}
+	}
+	return texts
+}
+
+func (cal *Calendar) announcement(ev Event, lead time.Duration) string {
+	text := ev.Summary + " is starting now"
+	if lead > 0 {
+		text = ev.Summary + " starts in " + strings.TrimSuffix(lead.String(), "0s") + ", at " + ev.Start.In(cal.zone).Format("15:04 MST")
+	}
+	if ev.Location != "" {
+		text += " (" + ev.Location + ")"
+	}
+	return text
+}
+
+// Agenda returns a line for each event on the day of day, written with f and
+// in its zone.
+func (cal *Calendar) Agenda(c context.Context, day time.Time, f chatlib.Formatter) ([]string, error) {
+	loc := f.Zone
+	day = day.In(loc)
+	from := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc)
+	to := from.AddDate(0, 0, 1)
+	events, err := cal.Between(c, from, to)
+	if err != nil && len(events) == 0 {
+		return nil, err
+	}
+	lines := make([]string, 0, len(events))
+	for _, ev := range events {
+		var line string
+		if ev.AllDay {
+			line = "all day: " + ev.Summary
+		} else {
+			line = f.FormatClock(ev.Start) + "-" + f.FormatClock(ev.End) + " " + ev.Summary
+		}
+		if ev.Location != "" {
+			line += " (" + ev.Location + ")"
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// WithCalendar announces events to targets, channels or nicks on the API
+// named api, and adds the !agenda action.
+func WithCalendar(cal *Calendar, api string, targets []string) chatlib.Option {
+	return func(h *chatlib.Handler) error {
+		announce := func(c context.Context, text string) error {
+			var failed error
+			for _, target := range targets {
+				if err := h.Send(c, &chatlib.Message{
+					Command:  chatlib.CommandMessage,
+					Receiver: target,
+					Text:     text,
+					API:      api,
+				}); err != nil {
+					failed = err
+				}
+			}
+			return failed
+		}
+		agenda := func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			f := h.Formatter(c, msg).In(h.Zone(c, msg, cal.zone))
+			loc := f.Zone
+			now := cal.now()
+			day := now
+			if parts := re.FindStringSubmatch(msg.Text); len(parts) > 1 {
+				t, rest, err := remind.Parse(parts[1], now, loc)
+				if err != nil || rest != "" {
+					return h.Reply(c, msg, `couldn't tell which day, try e.g. "today", "tomorrow", "friday" or "2023-11-05"`)
+				}
+				day = t
+			}
+			lines, err := cal.Agenda(c, day, f)
+			if err != nil {
+				return err
+			}
+			date := f.FormatDate(day)
+			if len(lines) == 0 {
+				return h.Reply(c, msg, "nothing on "+date)
+			}
+			return h.ReplyLines(c, msg, append([]string{date + ":"}, lines...))
+		}
+		return h.ApplyOptions(
+			chatlib.RegisterCommand("agenda", "", "!agenda", "list today's events", agenda),
+			chatlib.RegisterCommand("agenda", `(.+)`, "!agenda tomorrow", "list the events of a day", agenda),
+			chatlib.WithTask("calendar", func(c context.Context) error {
+				return cal.Run(c, announce)
+			}),
+		)
+	}
+}
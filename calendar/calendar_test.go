@@ -0,0 +1,136 @@
+package calendar
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gregseb/chatlib/httpc"
+)
+
+const testICal = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:standup\r\n" +
+	"SUMMARY:Standup\r\n" +
+	"LOCATION:Room 1\\, upstairs\r\n" +
+	"DTSTART;TZID=Europe/Berlin:20231023T100000\r\n" +
+	"DTEND;TZID=Europe/Berlin:20231023T101500\r\n" +
+	"RRULE:FREQ=WEEKLY;BYDAY=MO,WE\r\n" +
+	"EXDATE;TZID=Europe/Berlin:20231101T100000\r\n" +
+	"BEGIN:VALARM\r\n" +
+	"TRIGGER:-PT5M\r\n" +
+	"DESCRIPTION:ignored\r\n" +
+	"END:VALARM\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:standup\r\n" +
+	"RECURRENCE-ID;TZID=Europe/Berlin:20231106T100000\r\n" +
+	"SUMMARY:Standup (moved)\r\n" +
+	"DTSTART;TZID=Europe/Berlin:20231106T110000\r\n" +
+	"DURATION:PT15M\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:release\r\n" +
+	"SUMMARY:Release of a very long\r\n" +
+	" ly named thing\r\n" +
+	"DTSTART;VALUE=DATE:20231103\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestExpand(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := ParseICal(strings.NewReader(testICal), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+	from := time.Date(2023, 10, 30, 0, 0, 0, 0, berlin)
+	got := Expand(events, from, from.AddDate(0, 0, 8))
+	expected := []struct {
+		summary string
+		start   time.Time
+	}{
+		// The end of DST on the 29th doesn't move the wall clock time
+		{"Standup", time.Date(2023, 10, 30, 10, 0, 0, 0, berlin)},
+		{"Release of a very longly named thing", time.Date(2023, 11, 3, 0, 0, 0, 0, time.UTC)},
+		{"Standup (moved)", time.Date(2023, 11, 6, 11, 0, 0, 0, berlin)},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d occurrences, got %+v", len(expected), got)
+	}
+	for i, e := range expected {
+		if got[i].Summary != e.summary || !got[i].Start.Equal(e.start) {
+			t.Errorf("%d: expected %s at %s, got %s at %s", i, e.summary, e.start, got[i].Summary, got[i].Start)
+		}
+	}
+	if got[0].Location != "Room 1, upstairs" || got[0].End.Sub(got[0].Start) != 15*time.Minute {
+		t.Errorf("unexpected event: %+v", got[0])
+	}
+	if !got[1].AllDay || got[1].End.Sub(got[1].Start) != 24*time.Hour {
+		t.Errorf("expected an all day event, got %+v", got[1])
+	}
+	// Expanding occurrences again only filters them
+	if again := Expand(got, from, from.AddDate(0, 0, 8)); len(again) != len(got) {
+		t.Errorf("expected %d occurrences expanding again, got %d", len(got), len(again))
+	}
+}
+
+func TestCalDAV(t *testing.T) {
+	httpc.SetDefaultOptions(httpc.WithProxy(""))
+	defer httpc.SetDefaultOptions()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "REPORT" || r.Header.Get("Depth") != "1" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if user, pass, _ := r.BasicAuth(); user != "freyabot" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write([]byte(`<?xml version="1.0"?>
+<d:multistatus xmlns:d="DAV:" xmlns:cal="urn:ietf:params:xml:ns:caldav">
+  <d:response>
+    <d:href>/cal/standup.ics</d:href>
+    <d:propstat><d:prop><cal:calendar-data>` + testICal + `</cal:calendar-data></d:prop></d:propstat>
+  </d:response>
+</d:multistatus>`))
+	}))
+	defer server.Close()
+	s := &CalDAVSource{URL: server.URL, Username: "freyabot", Password: "secret", Zone: time.UTC}
+	from := time.Date(2023, 10, 30, 0, 0, 0, 0, time.UTC)
+	events, err := s.Events(context.Background(), from, from.AddDate(0, 0, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Errorf("expected 3 occurrences, got %+v", events)
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	start := time.Date(2023, 11, 6, 10, 0, 0, 0, time.UTC)
+	cal := New(nil, time.UTC, []time.Duration{15 * time.Minute, 0}, DefaultRefresh)
+	cal.events = []Event{
+		{Summary: "Standup", Location: "Room 1", Start: start, End: start.Add(15 * time.Minute)},
+		{Summary: "Holiday", Start: start.Truncate(24 * time.Hour), AllDay: true},
+	}
+	if texts := cal.due(start.Add(-16*time.Minute), start.Add(-15*time.Minute)); len(texts) != 1 || texts[0] != "Standup starts in 15m, at 10:00 UTC (Room 1)" {
+		t.Errorf("unexpected announcements: %q", texts)
+	}
+	if texts := cal.due(start.Add(-15*time.Minute), start.Add(-time.Minute)); len(texts) != 0 {
+		t.Errorf("expected no announcements, got %q", texts)
+	}
+	if texts := cal.due(start.Add(-time.Minute), start); len(texts) != 1 || texts[0] != "Standup is starting now (Room 1)" {
+		t.Errorf("unexpected announcements: %q", texts)
+	}
+}
@@ -0,0 +1,79 @@
+package calendar
+
+import (
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const ModuleName = "calendar"
+
+func init() {
+	chatlib.RegisterModule(chatlib.Module{
+		Name:  ModuleName,
+		Flags: Flags,
+		Init:  Init,
+	})
+}
+
+func Init() (*chatlib.Option, error) {
+	zoneName := viper.GetString(ModuleName + ".zone")
+	zone, err := time.LoadLocation(zoneName)
+	if err != nil {
+		return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "calendar: invalid zone: %s", zoneName)
+	}
+	username := viper.GetString(ModuleName + ".username")
+	password := viper.GetString(ModuleName + ".password")
+	sources := make([]Source, 0)
+	for _, u := range viper.GetStringSlice(ModuleName + ".ical-urls") {
+		sources = append(sources, &ICalSource{URL: u, Username: username, Password: password, Zone: zone})
+	}
+	for _, u := range viper.GetStringSlice(ModuleName + ".caldav-urls") {
+		sources = append(sources, &CalDAVSource{URL: u, Username: username, Password: password, Zone: zone})
+	}
+	if len(sources) == 0 {
+		log.Info().Msg("calendar disabled")
+		return nil, nil
+	}
+	leads := make([]time.Duration, 0)
+	for _, s := range viper.GetStringSlice(ModuleName + ".lead-times") {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "calendar: invalid lead time: %s", s)
+		}
+		leads = append(leads, d)
+	}
+	refresh := viper.GetDuration(ModuleName + ".refresh")
+	if refresh <= 0 {
+		return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "calendar: invalid refresh: %s", refresh)
+	}
+	targets := viper.GetStringSlice(ModuleName + ".channels")
+	log.Info().Str("module", ModuleName).Msgf("announcing events from %d calendars to %v", len(sources), targets)
+	opt := WithCalendar(New(sources, zone, leads, refresh), viper.GetString(ModuleName+".api"), targets)
+	return &opt, nil
+}
+
+func Flags(cmd *cobra.Command) {
+	// ICalURLs
+	cmd.Flags().StringSlice(ModuleName+"-ical-urls", []string{}, "iCal URLs to subscribe to. The calendar is disabled if there are none, and no CalDAV URLs")
+	// CalDAVURLs
+	cmd.Flags().StringSlice(ModuleName+"-caldav-urls", []string{}, "CalDAV calendar collection URLs to query")
+	// Username
+	cmd.Flags().String(ModuleName+"-username", "", "Username for calendars that need one")
+	// Password
+	cmd.Flags().String(ModuleName+"-password", "", "Password for calendars that need one")
+	// Channels
+	cmd.Flags().StringSlice(ModuleName+"-channels", []string{}, "Channels to announce upcoming events to")
+	// API
+	cmd.Flags().String(ModuleName+"-api", "", "API to announce through, needed if the bot has several")
+	// LeadTimes
+	cmd.Flags().StringSlice(ModuleName+"-lead-times", []string{"15m"}, "How long before events start to announce them, e.g. 1h,15m,0s")
+	// Refresh
+	cmd.Flags().Duration(ModuleName+"-refresh", DefaultRefresh, "How often calendars are fetched")
+	// Zone
+	cmd.Flags().String(ModuleName+"-zone", "UTC", "Time zone events are shown in, and for calendar times without one")
+}
@@ -0,0 +1,408 @@
+package calendar
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxOccurrences stops runaway expansion of rules that never end.
+const maxOccurrences = 10000
+
+// Event is one occurrence of a calendar event.
+type Event struct {
+	UID      string
+	Summary  string
+	Location string
+	Start    time.Time
+	End      time.Time
+	// AllDay events have a date but no time of day.
+	AllDay bool
+
+	rule         *rrule
+	exdates      map[int64]bool
+	recurrenceID time.Time
+}
+
+// rrule is the subset of RFC 5545 recurrence rules that is understood.
+type rrule struct {
+	freq     string
+	interval int
+	count    int
+	until    time.Time
+	byDay    []time.Weekday
+}
+
+// property is a content line such as DTSTART;TZID=Europe/Berlin:20231105T100000.
+type property struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// ParseICal reads the events in an iCalendar document. Times without a zone,
+// and zones that can't be loaded, are taken to be in loc. Recurring events
+// are returned once; see Expand.
+func ParseICal(r io.Reader, loc *time.Location) ([]Event, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "calendar: failed to read ical")
+	}
+	events := make([]Event, 0)
+	var ev *Event
+	depth := 0
+	for _, line := range lines {
+		p, ok := parseProperty(line)
+		if !ok {
+			continue
+		}
+		switch {
+		case p.name == "BEGIN" && p.value == "VEVENT":
+			ev = &Event{exdates: make(map[int64]bool)}
+			depth = 0
+		case ev == nil:
+		case p.name == "BEGIN":
+			// Nested components such as VALARM
+			depth++
+		case p.name == "END" && p.value == "VEVENT" && depth == 0:
+			if ev.End.IsZero() {
+				ev.End = ev.Start
+				if ev.AllDay {
+					ev.End = ev.Start.AddDate(0, 0, 1)
+				}
+			}
+			if !ev.Start.IsZero() {
+				events = append(events, *ev)
+			}
+			ev = nil
+		case p.name == "END":
+			depth--
+		case depth > 0:
+		default:
+			if err := ev.set(p, loc); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return events, nil
+}
+
+func (ev *Event) set(p property, loc *time.Location) error {
+	switch p.name {
+	case "UID":
+		ev.UID = p.value
+	case "SUMMARY":
+		ev.Summary = unescapeText(p.value)
+	case "LOCATION":
+		ev.Location = unescapeText(p.value)
+	case "DTSTART":
+		t, allDay, err := parseDateTime(p, loc)
+		if err != nil {
+			return err
+		}
+		ev.Start, ev.AllDay = t, allDay
+	case "DTEND":
+		t, _, err := parseDateTime(p, loc)
+		if err != nil {
+			return err
+		}
+		ev.End = t
+	case "DURATION":
+		d, err := parseDuration(p.value)
+		if err != nil {
+			return err
+		}
+		ev.End = ev.Start.Add(d)
+	case "RRULE":
+		ev.rule = parseRule(p.value, loc)
+	case "EXDATE":
+		for _, v := range strings.Split(p.value, ",") {
+			t, _, err := parseDateTime(property{name: p.name, params: p.params, value: v}, loc)
+			if err != nil {
+				return err
+			}
+			ev.exdates[t.Unix()] = true
+		}
+	case "RECURRENCE-ID":
+		t, _, err := parseDateTime(p, loc)
+		if err != nil {
+			return err
+		}
+		ev.recurrenceID = t
+	}
+	return nil
+}
+
+// unfold joins content lines continued on the next line with a leading space
+// or tab.
+func unfold(r io.Reader) ([]string, error) {
+	lines := make([]string, 0)
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, s.Err()
+}
+
+func parseProperty(line string) (property, bool) {
+	// The value starts at the first colon outside quoted parameter values
+	quoted := false
+	i := strings.IndexFunc(line, func(r rune) bool {
+		if r == '"' {
+			quoted = !quoted
+		}
+		return r == ':' && !quoted
+	})
+	if i < 0 {
+		return property{}, false
+	}
+	parts := strings.Split(line[:i], ";")
+	p := property{name: strings.ToUpper(parts[0]), params: make(map[string]string), value: line[i+1:]}
+	for _, param := range parts[1:] {
+		k, v, _ := strings.Cut(param, "=")
+		p.params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+	}
+	return p, true
+}
+
+func parseDateTime(p property, loc *time.Location) (time.Time, bool, error) {
+	v := p.value
+	if p.params["VALUE"] == "DATE" || len(v) == 8 {
+		t, err := time.ParseInLocation("20060102", v, loc)
+		return t, true, errors.Wrapf(err, "calendar: invalid %s", p.name)
+	}
+	if strings.HasSuffix(v, "Z") {
+		t, err := time.Parse("20060102T150405Z", v)
+		return t, false, errors.Wrapf(err, "calendar: invalid %s", p.name)
+	}
+	if tzid := p.params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", v, loc)
+	return t, false, errors.Wrapf(err, "calendar: invalid %s", p.name)
+}
+
+// parseDuration parses durations such as P1D, PT1H30M or -PT15M.
+func parseDuration(v string) (time.Duration, error) {
+	sign := time.Duration(1)
+	if strings.HasPrefix(v, "-") {
+		sign, v = -1, v[1:]
+	}
+	v = strings.TrimPrefix(v, "+")
+	if !strings.HasPrefix(v, "P") {
+		return 0, errors.Errorf("calendar: invalid duration: %s", v)
+	}
+	var d time.Duration
+	n := 0
+	for _, r := range v[1:] {
+		switch {
+		case r >= '0' && r <= '9':
+			n = n*10 + int(r-'0')
+			continue
+		case r == 'T':
+		case r == 'W':
+			d += time.Duration(n) * 7 * 24 * time.Hour
+		case r == 'D':
+			d += time.Duration(n) * 24 * time.Hour
+		case r == 'H':
+			d += time.Duration(n) * time.Hour
+		case r == 'M':
+			d += time.Duration(n) * time.Minute
+		case r == 'S':
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, errors.Errorf("calendar: invalid duration: %s", v)
+		}
+		n = 0
+	}
+	return sign * d, nil
+}
+
+// parseRule parses an RRULE. Rules using parts that aren't understood, such
+// as BYSETPOS or BYDAY outside weekly rules, return nil so the event is
+// shown once rather than on the wrong days.
+func parseRule(v string, loc *time.Location) *rrule {
+	rule := &rrule{interval: 1}
+	for _, part := range strings.Split(v, ";") {
+		k, val, _ := strings.Cut(part, "=")
+		switch strings.ToUpper(k) {
+		case "FREQ":
+			rule.freq = strings.ToUpper(val)
+		case "INTERVAL":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil
+			}
+			rule.interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil
+			}
+			rule.count = n
+		case "UNTIL":
+			t, _, err := parseDateTime(property{name: "UNTIL", value: val}, loc)
+			if err != nil {
+				return nil
+			}
+			rule.until = t
+		case "BYDAY":
+			for _, day := range strings.Split(val, ",") {
+				wd, ok := weekdays[strings.ToUpper(day)]
+				if !ok {
+					return nil
+				}
+				rule.byDay = append(rule.byDay, wd)
+			}
+		case "WKST":
+		default:
+			return nil
+		}
+	}
+	switch rule.freq {
+	case "DAILY", "MONTHLY", "YEARLY":
+		if len(rule.byDay) > 0 {
+			return nil
+		}
+	case "WEEKLY":
+	default:
+		return nil
+	}
+	return rule
+}
+
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+func unescapeText(v string) string {
+	r := strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+	return r.Replace(v)
+}
+
+// Expand returns the occurrences of events that overlap from to to, sorted
+// by start. Occurrences moved or changed by a RECURRENCE-ID override are
+// replaced by the override.
+func Expand(events []Event, from, to time.Time) []Event {
+	overridden := make(map[string]bool)
+	for _, ev := range events {
+		if !ev.recurrenceID.IsZero() {
+			overridden[ev.UID+"/"+strconv.FormatInt(ev.recurrenceID.Unix(), 10)] = true
+		}
+	}
+	out := make([]Event, 0)
+	add := func(ev Event) {
+		if (ev.End.After(from) && ev.Start.Before(to)) || ev.Start.Equal(from) {
+			out = append(out, ev)
+		}
+	}
+	for _, ev := range events {
+		if ev.rule == nil || !ev.recurrenceID.IsZero() {
+			add(ev)
+			continue
+		}
+		length := ev.End.Sub(ev.Start)
+		ev.rule.each(ev.Start, from.Add(-length), to, func(start time.Time) {
+			if ev.exdates[start.Unix()] || overridden[ev.UID+"/"+strconv.FormatInt(start.Unix(), 10)] {
+				return
+			}
+			occ := ev
+			occ.Start, occ.End = start, start.Add(length)
+			// Occurrences can be filtered with Expand again without repeating
+			occ.rule = nil
+			add(occ)
+		})
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Start.Before(out[j].Start)
+	})
+	return out
+}
+
+// each calls fn with every occurrence starting at start until to, the end of
+// the rule or maxOccurrences, whichever comes first. Occurrences long before
+// from may be skipped. Dates are stepped in start's location so occurrences
+// keep their wall clock time across DST.
+func (r *rrule) each(start, from, to time.Time, fn func(time.Time)) {
+	n := 0
+	emit := func(t time.Time) bool {
+		if t.Before(start) {
+			return true
+		}
+		if !t.Before(to) || (!r.until.IsZero() && t.After(r.until)) || (r.count > 0 && n >= r.count) {
+			return false
+		}
+		n++
+		fn(t)
+		return true
+	}
+	first := 0
+	if r.count == 0 && from.After(start) {
+		// Jump to the period before from rather than stepping through years
+		// of a long running rule
+		switch r.freq {
+		case "DAILY":
+			first = int(from.Sub(start)/(24*time.Hour))/r.interval - 1
+		case "WEEKLY":
+			first = int(from.Sub(start)/(7*24*time.Hour))/r.interval - 1
+		case "MONTHLY":
+			first = ((from.Year()-start.Year())*12+int(from.Month()-start.Month()))/r.interval - 1
+		case "YEARLY":
+			first = (from.Year()-start.Year())/r.interval - 1
+		}
+		first = max(first, 0)
+	}
+	for i := first; i < first+maxOccurrences; i++ {
+		switch r.freq {
+		case "DAILY":
+			if !emit(start.AddDate(0, 0, i*r.interval)) {
+				return
+			}
+		case "WEEKLY":
+			week := start.AddDate(0, 0, 7*i*r.interval)
+			if len(r.byDay) == 0 {
+				if !emit(week) {
+					return
+				}
+				continue
+			}
+			// Weeks start on Monday
+			monday := week.AddDate(0, 0, -(int(week.Weekday())+6)%7)
+			days := make([]time.Time, 0, len(r.byDay))
+			for _, wd := range r.byDay {
+				days = append(days, monday.AddDate(0, 0, (int(wd)+6)%7))
+			}
+			sort.Slice(days, func(a, b int) bool { return days[a].Before(days[b]) })
+			for _, d := range days {
+				if !emit(d) {
+					return
+				}
+			}
+		case "MONTHLY":
+			t := start.AddDate(0, i*r.interval, 0)
+			// Months without the day are skipped rather than rolled over
+			if t.Day() == start.Day() && !emit(t) {
+				return
+			}
+		case "YEARLY":
+			t := start.AddDate(i*r.interval, 0, 0)
+			if t.Day() == start.Day() && !emit(t) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package calendar
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gregseb/chatlib/httpc"
+	"github.com/pkg/errors"
+)
+
+// maxCalendarSize limits how much of a calendar is read.
+const maxCalendarSize = 10 << 20
+
+// Source is somewhere events come from.
+type Source interface {
+	// Events returns the occurrences of events overlapping from to to.
+	Events(c context.Context, from, to time.Time) ([]Event, error)
+}
+
+// ICalSource is an iCalendar file published at a URL, such as the secret
+// address of a Google or Nextcloud calendar.
+type ICalSource struct {
+	URL      string
+	Username string
+	Password string
+	// Zone is used for times the calendar gives without one.
+	Zone *time.Location
+}
+
+var _ Source = (*ICalSource)(nil)
+
+func (s *ICalSource) Events(c context.Context, from, to time.Time) ([]Event, error) {
+	req, err := http.NewRequestWithContext(c, http.MethodGet, webcal(s.URL), nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.Username != "" {
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+	resp, err := httpc.Default().Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "calendar: failed to fetch ical")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("calendar: failed to fetch ical: %s", resp.Status)
+	}
+	events, err := ParseICal(io.LimitReader(resp.Body, maxCalendarSize), s.Zone)
+	if err != nil {
+		return nil, err
+	}
+	return Expand(events, from, to), nil
+}
+
+// webcal rewrites webcal:// links, which calendar sites hand out for
+// subscribing, to the https URL behind them.
+func webcal(u string) string {
+	if rest, ok := strings.CutPrefix(u, "webcal://"); ok {
+		return "https://" + rest
+	}
+	return u
+}
+
+// CalDAVSource is a calendar collection on a CalDAV server, queried for the
+// events in the time range wanted.
+type CalDAVSource struct {
+	// URL is the calendar collection, e.g.
+	// https://cloud.example.com/remote.php/dav/calendars/freyabot/personal/
+	URL      string
+	Username string
+	Password string
+	Zone     *time.Location
+}
+
+var _ Source = (*CalDAVSource)(nil)
+
+const calendarQuery = `<?xml version="1.0" encoding="utf-8"?>
+<c:calendar-query xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">
+  <d:prop><c:calendar-data/></d:prop>
+  <c:filter>
+    <c:comp-filter name="VCALENDAR">
+      <c:comp-filter name="VEVENT">
+        <c:time-range start="%s" end="%s"/>
+      </c:comp-filter>
+    </c:comp-filter>
+  </c:filter>
+</c:calendar-query>`
+
+// multistatus is the part of a WebDAV multistatus response that holds the
+// calendar data.
+type multistatus struct {
+	Responses []struct {
+		CalendarData []string `xml:"propstat>prop>calendar-data"`
+	} `xml:"response"`
+}
+
+func (s *CalDAVSource) Events(c context.Context, from, to time.Time) ([]Event, error) {
+	const format = "20060102T150405Z"
+	body := fmt.Sprintf(calendarQuery, from.UTC().Format(format), to.UTC().Format(format))
+	req, err := http.NewRequestWithContext(c, "REPORT", s.URL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Depth", "1")
+	if s.Username != "" {
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+	resp, err := httpc.Default().Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "calendar: caldav query failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, errors.Errorf("calendar: caldav query failed: %s", resp.Status)
+	}
+	var ms multistatus
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxCalendarSize)).Decode(&ms); err != nil {
+		return nil, errors.Wrap(err, "calendar: invalid caldav response")
+	}
+	events := make([]Event, 0)
+	for _, r := range ms.Responses {
+		for _, data := range r.CalendarData {
+			evs, err := ParseICal(strings.NewReader(data), s.Zone)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, evs...)
+		}
+	}
+	return Expand(events, from, to), nil
+}
@@ -2,10 +2,13 @@ package chatlib
 
 import (
 	"context"
-	"os"
-	"os/signal"
+	"fmt"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 )
 
@@ -21,6 +24,69 @@ type Message struct {
 	Sender   string
 	Receiver string
 	Raw      string
+	// Params are the message's parameters for backends that have them, such
+	// as IRC. Receiver is the first and Text holds the rest.
+	Params []string
+	// Nick is the sender's name as it should be addressed, stripped of any
+	// backend specific decoration such as the IRC user@host suffix. It is
+	// empty when the message did not come from a user, e.g. server notices.
+	Nick string
+	// Private is set by the API when the message was sent directly to the bot
+	// rather than to a channel.
+	Private bool
+	// Time is when the server says the message was sent. It is zero if the
+	// server did not say.
+	Time time.Time
+	// Tags are the IRCv3 message tags the message was sent with, e.g. msgid,
+	// account or +draft/reply. It is nil if the message had none.
+	Tags map[string]string
+	// Replayed is set by the API when the message was sent before the current
+	// connection was made, e.g. bouncer playback or history backfill.
+	Replayed bool
+	// Self is set by the API when the message is the server's echo of one
+	// the bot sent, as it was delivered. Only actions registered with
+	// WithSelfMessages run for it, and commands in it are never executed.
+	Self bool
+	// Addressed is set when the message was sent privately to the bot or
+	// starts with the bot's nick. The nick is stripped from Text.
+	Addressed bool
+	// API is the name of the API the message was received from. Replies are
+	// sent back through it.
+	API string
+
+	annotations map[string]any
+}
+
+// IsPrivate reports whether the message was sent directly to the bot.
+func (m *Message) IsPrivate() bool {
+	return m.Private
+}
+
+// IsNotice reports whether the message is a notice, which must not be
+// answered automatically.
+func (m *Message) IsNotice() bool {
+	return m.Command == CommandNotice
+}
+
+// Channel returns the channel the message was sent to, or an empty string if
+// the message is private.
+func (m *Message) Channel() string {
+	if m.Private {
+		return ""
+	}
+	return m.Receiver
+}
+
+// ReplyTarget returns where a reply to the message should be sent: the
+// channel for channel messages and the sender for private messages.
+func (m *Message) ReplyTarget() string {
+	if !m.Private {
+		return m.Receiver
+	}
+	if m.Nick != "" {
+		return m.Nick
+	}
+	return m.Sender
 }
 
 type API interface {
@@ -39,27 +105,219 @@ type Action struct {
 	help    string
 	roles   []string
 	fn      ActionFunc
+	// api limits the action to messages from the named API if set.
+	api string
+	// module is the module that registered the action, if known.
+	module string
+	// self runs the action for the echo of the bot's own messages too.
+	self bool
 }
 
 type Option func(*Handler) error
 
-func WithAPI(api API) Option {
+// Replay policies decide what happens to commands in replayed messages.
+const (
+	// ReplaySkip logs replayed commands but does not execute them.
+	ReplaySkip = iota
+	// ReplayExecute executes replayed commands like any other.
+	ReplayExecute
+)
+
+// Namer is implemented by APIs that have a name of their own, e.g. to tell
+// several connections to the same kind of backend apart.
+type Namer interface {
+	Name() string
+}
+
+// Accounter is implemented by APIs that know which account a user is logged
+// in to, e.g. with IRC services. Accounts are safer to trust than names.
+type Accounter interface {
+	AccountOf(nick string) (string, bool)
+}
+
+// WithAPI adds an API to the Handler. A Handler may have several APIs and
+// receives messages from all of them. Actions registered by opts only run
+// for messages received from this API. The API is named by its Name method
+// if it has one, or by its position otherwise.
+func WithAPI(api API, opts ...Option) Option {
 	return func(h *Handler) error {
-		h.api = api
+		name := fmt.Sprintf("api%d", len(h.apis))
+		if n, ok := api.(Namer); ok {
+			name = n.Name()
+		}
+		for _, existing := range h.apis {
+			if existing.name == name {
+				return errors.WithMessagef(ErrInvalidConfig, "api registered twice: %s", name)
+			}
+		}
+		h.apis = append(h.apis, namedAPI{name, api, &sendLatency{}})
+		first := len(h.actions)
+		if err := h.ApplyOptions(opts...); err != nil {
+			return err
+		}
+		for _, action := range h.actions[first:] {
+			action.api = name
+		}
 		return nil
 	}
 }
 
+// WithSelfMessages makes the actions registered by opts also run for the
+// bot's own messages as the server echoed them back, see Message.Self. It is
+// meant for actions that log or bridge what was said, which should see what
+// was delivered rather than what the bot meant to send.
+func WithSelfMessages(opts ...Option) Option {
+	return func(h *Handler) error {
+		first := len(h.actions)
+		if err := h.ApplyOptions(opts...); err != nil {
+			return err
+		}
+		for _, action := range h.actions[first:] {
+			action.self = true
+		}
+		return nil
+	}
+}
+
+type namedAPI struct {
+	name    string
+	api     API
+	latency *sendLatency
+}
+
+// API returns the API with the given name, or nil.
+func (h *Handler) API(name string) API {
+	for _, na := range h.apis {
+		if na.name == name {
+			return na.api
+		}
+	}
+	return nil
+}
+
+// apiFor returns the API a message belongs to. Messages without an API are
+// sent through the only API if there is just one.
+func (h *Handler) apiFor(msg *Message) (API, error) {
+	if msg.API == "" {
+		if len(h.apis) == 1 {
+			return h.apis[0].api, nil
+		}
+		return nil, errors.New("message has no api and the handler has several")
+	}
+	if api := h.API(msg.API); api != nil {
+		return api, nil
+	}
+	return nil, errors.Errorf("unknown api: %s", msg.API)
+}
+
+// Send sends msg through the API named by msg.API, after applying the content
+// policy.
+func (h *Handler) Send(c context.Context, msg *Message) error {
+	api, msg, err := h.prepare(c, msg)
+	if err != nil {
+		return err
+	}
+	if h.withheld(c, api, msg) {
+		return nil
+	}
+	return h.sendMessage(c, api, msg)
+}
+
+// prepare returns the API msg is sent through and msg with mentions guarded
+// and the content policy applied.
+func (h *Handler) prepare(c context.Context, msg *Message) (API, *Message, error) {
+	api, err := h.apiFor(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg = h.guardMentions(api, msg)
+	msg, err = h.filterContent(c, msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	countOutput(c, msg)
+	return api, msg, nil
+}
+
+// WithChannelAllowlist restricts commands to messages sent to the given
+// channels, or sent privately by the given nicks. Targets prefixed with the
+// name of an API and a slash, e.g. libera/#chan, only apply to messages it
+// received, and the others to every API. An API without any allowed targets
+// permits everything not blocked. Actions that aren't commands still see
+// every message.
+func WithChannelAllowlist(targets ...string) Option {
+	return func(h *Handler) error {
+		h.allow = appendTargets(h.allow, targets)
+		return nil
+	}
+}
+
+// WithChannelBlocklist ignores commands in messages sent to the given
+// channels, or sent privately by the given nicks, named like those of
+// WithChannelAllowlist. The blocklist takes precedence over the allowlist.
+func WithChannelBlocklist(targets ...string) Option {
+	return func(h *Handler) error {
+		h.block = appendTargets(h.block, targets)
+		return nil
+	}
+}
+
+// appendTargets adds targets to list, keyed by the API they are prefixed
+// with, or by the empty string for every API.
+func appendTargets(list map[string]map[string]bool, targets []string) map[string]map[string]bool {
+	if list == nil {
+		list = make(map[string]map[string]bool)
+	}
+	for _, t := range targets {
+		api, target, ok := strings.Cut(strings.ToLower(t), "/")
+		if !ok {
+			api, target = "", api
+		}
+		if target == "" {
+			continue
+		}
+		if list[api] == nil {
+			list[api] = make(map[string]bool)
+		}
+		list[api][target] = true
+	}
+	return list
+}
+
+func WithReplayPolicy(policy int) Option {
+	return func(h *Handler) error {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.replayPolicy = policy
+		return nil
+	}
+}
+
+func (h *Handler) getReplayPolicy() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.replayPolicy
+}
+
+// SetChannelACL replaces the channel allowlist and blocklist. It is safe to
+// call while the Handler is running.
+func (h *Handler) SetChannelACL(allow, block []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.allow = appendTargets(nil, allow)
+	h.block = appendTargets(nil, block)
+}
+
 func RegisterAction(command, pattern, example, help string, fn ActionFunc, roles ...string) Option {
 	return func(h *Handler) error {
 		if h.actions == nil {
 			h.actions = make([]*Action, 0)
 		}
-		re, err := regexp.Compile(pattern)
+		re, err := compilePattern(pattern)
 		if err != nil {
 			return err
 		}
-		h.actions = append(h.actions, &Action{command, re, example, help, roles, fn})
+		h.actions = append(h.actions, &Action{Command: command, re: re, example: example, help: help, roles: roles, fn: fn})
 		return nil
 	}
 }
@@ -80,39 +338,137 @@ func (h *Handler) ApplyOptions(opts ...Option) error {
 }
 
 type Handler struct {
-	api     API
+	apis    []namedAPI
 	msg     chan *Message
 	actions []*Action
+	allow   map[string]map[string]bool
+	block   map[string]map[string]bool
+	store   Store
+
+	middlewares   []Middleware
+	contentRules  []ContentRule
+	commandPrefix string
+	pager         *pager
+	policies      map[string]*ContentPolicy
+	cache         *Cache
+	budgets       *budgets
+	admins        []string
+	journal       *Journal
+	journalSize   int
+	eventHooks    []EventHook
+	patternLimits PatternLimits
+	overrides     map[scope]Override
+	rates         commandRates
+	logMirror     *LogMirror
+	outbox        *Outbox
+	dryRun        bool
+	tasks         []namedTask
+	shortener     URLShortener
+	floors        floors
+	verifying     verifications
+	ruleStrikes   ruleStrikes
+	slowModes     slowModes
+	crossposts    crossposts
+	mailer        Mailer
+	moduleNames   []string
+	started       time.Time
+	analytics     *analytics
+
+	mu           sync.RWMutex
+	replayPolicy int
+	reloaders    []ReloadFunc
+	drainSeconds float64
+	// drainMu guards draining and the start of actions, so that none start
+	// once Drain waits for inflight.
+	drainMu  sync.Mutex
+	draining bool
+	inflight sync.WaitGroup
+
+	cancel        context.CancelFunc
+	controlSocket string
+	shutdownOnce  sync.Once
+	exitCode      int
+	confirmMu     sync.Mutex
+	confirms      map[string]time.Time
 }
 
 func New(opts ...Option) (*Handler, error) {
 	h := &Handler{
-		msg: make(chan *Message),
+		msg:           make(chan *Message),
+		drainSeconds:  DefaultDrainSeconds,
+		commandPrefix: DefaultCommandPrefix,
+		journalSize:   DefaultJournalSize,
+		patternLimits: DefaultPatternLimits,
+		rates:         make(commandRates),
 	}
 	if err := h.ApplyOptions(opts...); err != nil {
 		return nil, err
 	}
+	if err := h.checkPatterns(); err != nil {
+		return nil, err
+	}
+	if h.store == nil {
+		h.store = NewMemoryStore()
+	}
+	h.cache = NewCache("actions", h.store)
+	h.tasks = append(h.tasks, namedTask{"cache", h.runCacheSweep})
+	j, err := NewJournal(context.Background(), h.journalSize, h.store)
+	if err != nil {
+		log.Error().Err(err).Msg("error loading journal, starting a new one")
+		j = &Journal{size: h.journalSize, store: h.store}
+	}
+	h.journal = j
+	for _, na := range h.apis {
+		if su, ok := na.api.(StoreUser); ok {
+			su.UseStore(h.store)
+		}
+		if su, ok := na.api.(ShortenerUser); ok && h.shortener != nil {
+			su.UseURLShortener(storedShortener{h.shortener, h.store})
+		}
+		// Policies may be added when the configuration is reloaded
+		if fu, ok := na.api.(FilterUser); ok {
+			fu.UseOutboundFilter(h.filterContent)
+		}
+	}
+	h.startDryRun()
 	return h, nil
 }
 
 func (h *Handler) Start(ctx context.Context) error {
-	c, cancel := context.WithCancel(ctx)
+	if len(h.apis) == 0 {
+		return errors.WithMessage(ErrInvalidConfig, "no api configured")
+	}
+	runningHandlers.Add(1)
+	defer runningHandlers.Add(-1)
+	c, cancel := context.WithCancel(context.WithValue(ctx, handlerKey{}, h))
+	h.cancel = cancel
 	go h.actionLoop(c)
-	go h.receiveLoop(c)
-	if err := h.api.Start(c); err != nil {
-		cancel()
-		return err
+	for _, na := range h.apis {
+		go h.receiveLoop(c, na)
+	}
+	for _, na := range h.apis {
+		if err := na.api.Start(c); err != nil {
+			cancel()
+			return errors.Wrapf(err, "failed to start %s", na.name)
+		}
+		h.record(c, EventConnect, na.name, "started")
 	}
-	// Listen for SigInt
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, os.Interrupt)
-	go func() {
-		<-sigs
-		if err := h.api.Stop(c); err != nil {
-			log.Error().Err(err).Msg("error stopping api")
+	h.mu.Lock()
+	h.started = time.Now()
+	h.mu.Unlock()
+	if h.logMirror != nil {
+		go h.mirrorLogs(c)
+	}
+	for _, t := range h.tasks {
+		go h.runTask(c, t)
+	}
+	if h.controlSocket != "" {
+		if err := h.serveControlSocket(c); err != nil {
+			cancel()
+			return err
 		}
-		cancel()
-	}()
+	}
+	go h.handleSignals(c)
 	<-c.Done()
 	return nil
 }
@@ -126,23 +482,111 @@ func (h *Handler) actionLoop(c context.Context) error {
 			if msg == nil {
 				continue
 			}
+			if msg.Replayed && msg.Nick != "" && h.getReplayPolicy() == ReplaySkip {
+				log.Info().Str("sender", msg.Sender).Str("target", msg.ReplyTarget()).Time("sent", msg.Time).Str("text", msg.Text).Msg("not executing replayed message")
+				continue
+			}
+			if !h.startActions() {
+				log.Debug().Str("text", msg.Text).Msg("draining, not executing message")
+				continue
+			}
+			s := h.Settings(msg.API, msg.Channel())
+			ignoreCommands := msg.Self || h.addressing(msg, s.CommandPrefix)
+			if !ignoreCommands && h.Unverified(msg) {
+				log.Debug().Str("nick", msg.Nick).Str("channel", msg.Channel()).Msg("ignoring commands from unverified user")
+				ignoreCommands = true
+			}
+			if !ignoreCommands && !h.permitted(msg) {
+				log.Trace().Str("api", msg.API).Str("target", msg.ReplyTarget()).Msg("ignoring commands from unpermitted target")
+				ignoreCommands = true
+			}
+			for _, err := range h.annotate(c, msg) {
+				log.Error().Err(err).Msg("error in middleware")
+			}
+			rateChecked := false
 			for _, action := range h.actions {
-				if action.Command == msg.Command && action.re.MatchString(msg.Text) {
-					if err := action.fn(c, action.re, msg); err != nil {
+				if action.api != "" && action.api != msg.API || msg.Self && !action.self {
+					continue
+				}
+				if action.Command == msg.Command && h.matches(c, action, msg) {
+					if h.isCommand(action) {
+						if ignoreCommands {
+							continue
+						}
+						if !rateChecked {
+							rateChecked = true
+							if !h.rates.allow(scope{msg.API, strings.ToLower(msg.Channel())}, s.CommandRate, time.Now()) {
+								log.Debug().Str("target", msg.ReplyTarget()).Msg("not answering command, over the command rate")
+								ignoreCommands = true
+								continue
+							}
+						}
+					}
+					if !h.allowed(action, msg, s) {
+						continue
+					}
+					if err := h.runAction(c, action, msg); err != nil {
 						log.Error().Err(err).Msg("error in action")
+						h.record(c, EventActionFailure, msg.API, "%s: %s", actionName(action), err)
 					}
 				}
 			}
+			h.inflight.Done()
 		}
 	}
 }
 
-func (h *Handler) receiveLoop(c context.Context) {
+// startActions reports whether the actions matching a message may run,
+// counting them as in flight until inflight.Done is called if so. They may
+// not once the Handler is draining.
+func (h *Handler) startActions() bool {
+	h.drainMu.Lock()
+	defer h.drainMu.Unlock()
+	if h.draining {
+		return false
+	}
+	h.inflight.Add(1)
+	return true
+}
+
+// permitted reports whether commands in the message may be answered
+// according to the channel allowlist and blocklist of its API. Messages that
+// did not come from a user are always permitted.
+func (h *Handler) permitted(msg *Message) bool {
+	if msg.Nick == "" {
+		return true
+	}
+	api, target := strings.ToLower(msg.API), strings.ToLower(msg.ReplyTarget())
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.block[""][target] || h.block[api][target] {
+		return false
+	}
+	if len(h.allow[""])+len(h.allow[api]) > 0 && !h.allow[""][target] && !h.allow[api][target] {
+		return false
+	}
+	return true
+}
+
+// receiveLoop fans messages from one API in to the action loop, tagging them
+// with the API's name.
+func (h *Handler) receiveLoop(c context.Context, na namedAPI) {
 	for {
-		msg, err := h.api.ReceiveMessage(c)
+		msg, err := na.api.ReceiveMessage(c)
 		if err != nil {
-			log.Error().Err(err).Msg("error receiving message")
+			if c.Err() != nil {
+				return
+			}
+			log.Error().Str("api", na.name).Err(err).Msg("error receiving message")
+			h.record(c, EventError, na.name, "error receiving message: %s", err)
+		}
+		if msg != nil {
+			msg.API = na.name
+		}
+		select {
+		case <-c.Done():
+			return
+		case h.msg <- msg:
 		}
-		h.msg <- msg
 	}
 }
@@ -0,0 +1,1990 @@
+package chatlib_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/rs/zerolog"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// fakeAPI is an in-memory chatlib.API used to drive a Handler in tests.
+type fakeAPI struct {
+	name string
+	in   chan *chatlib.Message
+	out  chan *chatlib.Message
+}
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{
+		name: "fake",
+		in:   make(chan *chatlib.Message, 10),
+		out:  make(chan *chatlib.Message, 10),
+	}
+}
+
+func (f *fakeAPI) Name() string { return f.name }
+
+func (f *fakeAPI) SendMessage(c context.Context, msg *chatlib.Message) error {
+	f.out <- msg
+	return nil
+}
+
+func (f *fakeAPI) ReceiveMessage(c context.Context) (*chatlib.Message, error) {
+	select {
+	case <-c.Done():
+		return nil, c.Err()
+	case msg := <-f.in:
+		return msg, nil
+	}
+}
+
+func (f *fakeAPI) Start(c context.Context) error { return nil }
+
+func (f *fakeAPI) Nick() string { return "freyabot" }
+
+func (f *fakeAPI) Stop(c context.Context) error { return nil }
+
+// startHandler starts a Handler with the fake API and the given options and
+// returns a function that stops it.
+func startHandler(t *testing.T, api *fakeAPI, opts ...chatlib.Option) func() {
+	t.Helper()
+	h, err := chatlib.New(append([]chatlib.Option{chatlib.WithAPI(api)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, cancel := context.WithCancel(context.Background())
+	go h.Start(c)
+	return cancel
+}
+
+func TestMessageReplyTarget(t *testing.T) {
+	msg := &chatlib.Message{
+		Sender:   "foo!bar@baz",
+		Nick:     "foo",
+		Receiver: "#test",
+	}
+	if msg.IsPrivate() {
+		t.Fatal("expected channel message")
+	}
+	if msg.Channel() != "#test" {
+		t.Fatalf("expected channel #test, got %s", msg.Channel())
+	}
+	if msg.ReplyTarget() != "#test" {
+		t.Fatalf("expected reply target #test, got %s", msg.ReplyTarget())
+	}
+	msg.Receiver = "freyabot"
+	msg.Private = true
+	if msg.Channel() != "" {
+		t.Fatalf("expected no channel, got %s", msg.Channel())
+	}
+	if msg.ReplyTarget() != "foo" {
+		t.Fatalf("expected reply target foo, got %s", msg.ReplyTarget())
+	}
+}
+
+func TestChannelACL(t *testing.T) {
+	api := newFakeAPI()
+	called := make(chan string, 10)
+	seen := make(chan string, 10)
+	stop := startHandler(t, api,
+		chatlib.WithChannelAllowlist("#allowed", "#Blocked", "friend", "Fake/#local", "other/#elsewhere"),
+		chatlib.WithChannelBlocklist("#blocked", "fake/#local2", "other/#allowed"),
+		chatlib.RegisterCommand("ping", "", "!ping", "", func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			called <- msg.ReplyTarget()
+			return nil
+		}),
+		// Actions that aren't commands see every message
+		chatlib.RegisterAction("PRIVMSG", "", "", "", func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			seen <- msg.ReplyTarget()
+			return nil
+		}),
+	)
+	defer stop()
+
+	msgs := []*chatlib.Message{
+		{Command: "PRIVMSG", Nick: "foo", Receiver: "#other", Text: "!ping"},
+		{Command: "PRIVMSG", Nick: "foo", Receiver: "#blocked", Text: "!ping"},
+		{Command: "PRIVMSG", Nick: "stranger", Receiver: "freyabot", Private: true, Text: "!ping"},
+		{Command: "PRIVMSG", Nick: "foo", Receiver: "#elsewhere", Text: "!ping"},
+		{Command: "PRIVMSG", Nick: "foo", Receiver: "#ALLOWED", Text: "!ping"},
+		{Command: "PRIVMSG", Nick: "friend", Receiver: "freyabot", Private: true, Text: "!ping"},
+		{Command: "PRIVMSG", Nick: "foo", Receiver: "#local", Text: "!ping"},
+	}
+	for _, msg := range msgs {
+		api.in <- msg
+	}
+	for _, msg := range msgs {
+		select {
+		case got := <-seen:
+			if got != msg.ReplyTarget() {
+				t.Fatalf("expected %s to be seen, got %s", msg.ReplyTarget(), got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s to be seen", msg.ReplyTarget())
+		}
+	}
+	for _, exp := range []string{"#ALLOWED", "friend", "#local"} {
+		select {
+		case got := <-called:
+			if got != exp {
+				t.Fatalf("expected action for %s, got %s", exp, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for action for %s", exp)
+		}
+	}
+	select {
+	case got := <-called:
+		t.Fatalf("unexpected action for %s", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	c := context.Background()
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := chatlib.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(c, "foo"); !errors.Is(err, chatlib.ErrNotFound) {
+		t.Fatalf("expected not found error, got %+v", err)
+	}
+	if err := s.Set(c, "foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	// Reopen the store to check the value was persisted
+	s, err = chatlib.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.Get(c, "foo"); err != nil {
+		t.Fatal(err)
+	} else if string(v) != "bar" {
+		t.Fatalf("expected bar, got %s", v)
+	}
+
+	// Any bytes survive, not only UTF-8
+	binary := []byte{0xff, 0xfe, 0x00, 0x80, 'a'}
+	if err := s.Set(c, "binary", binary); err != nil {
+		t.Fatal(err)
+	}
+	s, err = chatlib.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.Get(c, "binary"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(v, binary) {
+		t.Fatalf("expected %x, got %x", binary, v)
+	}
+
+	// Stores written before values were kept as bytes are still read
+	old := filepath.Join(t.TempDir(), "old.json")
+	if err := os.WriteFile(old, []byte(`{"foo": "bar", "version": "1"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err = chatlib.NewFileStore(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, exp := range map[string]string{"foo": "bar", "version": "1"} {
+		if v, err := s.Get(c, k); err != nil || string(v) != exp {
+			t.Fatalf("expected %s for %s, got %q, %v", exp, k, v, err)
+		}
+	}
+}
+
+func TestReplayPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy int
+		exp    bool
+	}{
+		{chatlib.ReplaySkip, false},
+		{chatlib.ReplayExecute, true},
+	} {
+		api := newFakeAPI()
+		called := make(chan bool, 1)
+		stop := startHandler(t, api,
+			chatlib.WithReplayPolicy(tc.policy),
+			chatlib.RegisterAction("PRIVMSG", "!deploy", "!deploy", "", func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+				called <- true
+				return nil
+			}),
+		)
+		api.in <- &chatlib.Message{Command: "PRIVMSG", Nick: "foo", Receiver: "#test", Text: "!deploy", Replayed: true}
+		select {
+		case <-called:
+			if !tc.exp {
+				t.Fatalf("policy %d: expected replayed command not to execute", tc.policy)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if tc.exp {
+				t.Fatalf("policy %d: expected replayed command to execute", tc.policy)
+			}
+		}
+		stop()
+	}
+}
+
+func TestSelfMessages(t *testing.T) {
+	api := newFakeAPI()
+	called := make(chan string, 3)
+	record := func(name string) chatlib.ActionFunc {
+		return func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			called <- name
+			return nil
+		}
+	}
+	stop := startHandler(t, api,
+		chatlib.RegisterAction("PRIVMSG", "!deploy", "!deploy", "", record("command")),
+		chatlib.RegisterAction("PRIVMSG", ".*", "", "", record("action")),
+		chatlib.WithSelfMessages(
+			chatlib.RegisterAction("PRIVMSG", ".*", "", "", record("logger")),
+		),
+	)
+	defer stop()
+	api.in <- &chatlib.Message{Command: "PRIVMSG", Nick: "bot", Receiver: "#test", Text: "!deploy", Self: true}
+	select {
+	case name := <-called:
+		if name != "logger" {
+			t.Fatalf("expected only the action registered for self messages to run, got %s", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the logger to see the bot's own message")
+	}
+	select {
+	case name := <-called:
+		t.Fatalf("unexpected %s for the bot's own message", name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestControlSocketRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	h, err := chatlib.New(chatlib.WithAPI(newFakeAPI()), chatlib.WithControlSocket(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- h.Start(context.Background())
+	}()
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("expected only the owner to have access to the socket, got %v, %v", fi.Mode(), err)
+	}
+	if _, err := conn.Write([]byte("restart\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for handler to stop")
+	}
+	if h.ExitCode() != chatlib.ExitCodeRestart {
+		t.Fatalf("expected exit code %d, got %d", chatlib.ExitCodeRestart, h.ExitCode())
+	}
+}
+
+func TestControlSocketNotASocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("chat: {}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	h, err := chatlib.New(chatlib.WithAPI(newFakeAPI()), chatlib.WithControlSocket(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Start(context.Background()); !errors.Is(err, chatlib.ErrInvalidConfig) {
+		t.Fatalf("expected a file that isn't a socket to be refused, got %v", err)
+	}
+	if bts, err := os.ReadFile(path); err != nil || string(bts) != "chat: {}\n" {
+		t.Fatalf("expected the file to be left alone, got %q, %v", bts, err)
+	}
+}
+
+func TestLifecycleActionsAdminOnly(t *testing.T) {
+	api := newFakeAPI()
+	h, err := chatlib.New(chatlib.WithAPI(api), chatlib.WithAdmins("alice"), chatlib.WithLifecycleActions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- h.Start(context.Background())
+	}()
+	say := func(nick, text string) {
+		api.in <- &chatlib.Message{Command: chatlib.CommandMessage, Nick: nick, Receiver: "#test", Text: text}
+	}
+
+	// Non-admins are refused without being asked to confirm
+	say("mallory", "!shutdown")
+	say("mallory", "!shutdown confirm")
+	select {
+	case msg := <-api.out:
+		t.Fatalf("expected no reply to a non-admin, got %q", msg.Text)
+	case <-done:
+		t.Fatal("expected a non-admin not to shut down the bot")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	say("alice", "!shutdown")
+	select {
+	case msg := <-api.out:
+		if !strings.Contains(msg.Text, "confirm") {
+			t.Fatalf("expected to be asked to confirm, got %q", msg.Text)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected to be asked to confirm")
+	}
+	say("alice", "!shutdown confirm")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for handler to stop")
+	}
+}
+
+func TestGroup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	g, err := chatlib.NewGroup(chatlib.WithGroupControlSocket(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	builds := make(map[string]int)
+	for _, name := range []string{"one", "two"} {
+		name := name
+		if err := g.Add(name, func() (*chatlib.Handler, error) {
+			builds[name]++
+			return chatlib.New(chatlib.WithAPI(newFakeAPI()))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Add("one", nil); !errors.Is(err, chatlib.ErrInvalidConfig) {
+		t.Fatalf("expected a duplicate profile to be refused, got %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- g.Start(context.Background())
+	}()
+	command := func(line string) string {
+		t.Helper()
+		var conn net.Conn
+		var err error
+		for i := 0; i < 50; i++ {
+			if conn, err = net.Dial("unix", path); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		out, _ := io.ReadAll(conn)
+		return string(out)
+	}
+	waitFor := func(name, state string, restarts int) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			for _, s := range g.Status() {
+				if s.Name == name && s.State == state && s.Restarts == restarts {
+					return
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for %s to be %s: %+v", name, state, g.Status())
+	}
+	waitFor("one", chatlib.ProfileRunning, 0)
+	if out := command("one restart"); out != "ok\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+	waitFor("one", chatlib.ProfileRunning, 1)
+	if out := command("two shutdown"); out != "ok\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+	waitFor("two", chatlib.ProfileStopped, 0)
+	if out := command("two restart"); out != "error: profile two is stopped\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+	if out := command("status"); !strings.HasPrefix(out, "one running since") || !strings.Contains(out, "1 restarts\ntwo stopped since") {
+		t.Fatalf("unexpected status %q", out)
+	}
+	if out := command("two start"); out != "ok\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+	waitFor("two", chatlib.ProfileRunning, 0)
+	if builds["one"] != 2 || builds["two"] != 2 {
+		t.Fatalf("unexpected builds %v", builds)
+	}
+	if err := g.Shutdown(context.Background(), chatlib.ExitCodeShutdown); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the group to stop")
+	}
+}
+
+func TestCheckPluginABI(t *testing.T) {
+	if err := chatlib.CheckPluginABI("current", chatlib.PluginABIVersion); err != nil {
+		t.Fatal(err)
+	}
+	if err := chatlib.CheckPluginABI("old", chatlib.PluginABIVersion-1); !errors.Is(err, chatlib.ErrIncompatiblePlugin) {
+		t.Fatalf("expected incompatible plugin error, got %+v", err)
+	}
+}
+
+func TestMiddlewareAnnotations(t *testing.T) {
+	api := newFakeAPI()
+	urls := make(chan []string, 1)
+	stop := startHandler(t, api,
+		chatlib.WithMiddleware(chatlib.URLMiddleware),
+		chatlib.RegisterAction("PRIVMSG", "", "", "", func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			v, _ := chatlib.AnnotationURLs.Get(msg)
+			urls <- v
+			return nil
+		}),
+	)
+	defer stop()
+	api.in <- &chatlib.Message{Command: "PRIVMSG", Nick: "foo", Receiver: "#test", Text: "see https://example.com/a and http://example.org"}
+	select {
+	case got := <-urls:
+		if len(got) != 2 || got[0] != "https://example.com/a" || got[1] != "http://example.org" {
+			t.Fatalf("unexpected urls: %v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for action")
+	}
+}
+
+func TestAddressing(t *testing.T) {
+	api := newFakeAPI()
+	called := make(chan string, 10)
+	stop := startHandler(t, api,
+		chatlib.RegisterCommand("ping", "", "!ping", "", func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			called <- msg.Text
+			return nil
+		}),
+	)
+	defer stop()
+	for _, text := range []string{"!ping", "freyabot: ping", "@FreyaBot ping", "freyabot, !ping", "freyabot ping", "freyabotping"} {
+		api.in <- &chatlib.Message{Command: "PRIVMSG", Nick: "foo", Receiver: "#test", Text: text}
+	}
+	api.in <- &chatlib.Message{Command: "PRIVMSG", Nick: "foo", Receiver: "freyabot", Private: true, Text: "ping"}
+	for i := 0; i < 5; i++ {
+		select {
+		case got := <-called:
+			if got != "!ping" {
+				t.Fatalf("expected !ping, got %s", got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for action %d", i)
+		}
+	}
+	select {
+	case got := <-called:
+		t.Fatalf("unexpected action for %s", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	args, err := chatlib.SplitArgs(`--env prod --force 'my service' "a \"b\"" c\ d`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{"--env", "prod", "--force", "my service", `a "b"`, "c d"}
+	if strings.Join(args, "|") != strings.Join(exp, "|") {
+		t.Fatalf("expected %q, got %q", exp, args)
+	}
+	if _, err := chatlib.SplitArgs(`'unterminated`); err == nil {
+		t.Fatal("expected error for unterminated quote")
+	}
+}
+
+func TestPagination(t *testing.T) {
+	api := newFakeAPI()
+	var h *chatlib.Handler
+	stop := startHandler(t, api,
+		chatlib.WithPagination(2),
+		chatlib.RegisterCommand("list", "", "!list", "", func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			return h.ReplyLines(c, msg, []string{"1", "2", "3", "4", "5"})
+		}),
+		func(hh *chatlib.Handler) error {
+			h = hh
+			return nil
+		},
+	)
+	defer stop()
+	expect := func(texts ...string) {
+		t.Helper()
+		for _, exp := range texts {
+			select {
+			case msg := <-api.out:
+				if msg.Text != exp {
+					t.Fatalf("expected %q, got %q", exp, msg.Text)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for %q", exp)
+			}
+		}
+	}
+	api.in <- &chatlib.Message{Command: "PRIVMSG", Nick: "foo", Receiver: "#test", Text: "!list"}
+	expect("1", "2", "(3 more lines, say !more)")
+	api.in <- &chatlib.Message{Command: "PRIVMSG", Nick: "foo", Receiver: "#test", Text: "!more"}
+	expect("3", "4", "(1 more lines, say !more)")
+	api.in <- &chatlib.Message{Command: "PRIVMSG", Nick: "foo", Receiver: "#test", Text: "!more"}
+	expect("5")
+	api.in <- &chatlib.Message{Command: "PRIVMSG", Nick: "foo", Receiver: "#test", Text: "!more"}
+	expect("nothing more to show")
+}
+
+func TestWithCache(t *testing.T) {
+	api := newFakeAPI()
+	calls, senderCalls := 0, 0
+	stop := startHandler(t, api,
+		chatlib.RegisterCommand("weather", "(.*)", "!weather london", "", chatlib.Replier(chatlib.WithCache(time.Minute, func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) ([]string, error) {
+			calls++
+			return []string{"sunny in " + re.FindStringSubmatch(msg.Text)[1]}, nil
+		}))),
+		// Another action answering the same message has its own entries
+		chatlib.RegisterCommand("weather", "(.*)", "!weather paris", "", chatlib.Replier(chatlib.WithCache(time.Minute, func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) ([]string, error) {
+			senderCalls++
+			return []string{"asked by " + msg.Nick}, nil
+		}, chatlib.CacheBySender))),
+	)
+	defer stop()
+	for _, nick := range []string{"foo", "foo", "bar"} {
+		api.in <- &chatlib.Message{Command: "PRIVMSG", Nick: nick, Receiver: "#test", Text: "!weather london"}
+		for _, exp := range []string{"sunny in london", "asked by " + nick} {
+			select {
+			case msg := <-api.out:
+				if msg.Text != exp {
+					t.Fatalf("expected %q, got %q", exp, msg.Text)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for reply")
+			}
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+	if senderCalls != 2 {
+		t.Fatalf("expected 1 call per sender, got %d", senderCalls)
+	}
+}
+
+func TestCacheSweep(t *testing.T) {
+	c := context.Background()
+	store := chatlib.NewMemoryStore()
+	ch := chatlib.NewCache("test", store)
+	if err := ch.Set(c, "old", []byte("1"), -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Set(c, "new", []byte("2"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// Entries of an earlier run are swept too
+	ch = chatlib.NewCache("test", store)
+	if err := ch.Sweep(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(c, "cache/test/old"); !errors.Is(err, chatlib.ErrNotFound) {
+		t.Fatalf("expected the expired entry to be swept from the store, got %v", err)
+	}
+	if v, ok := ch.Get(c, "new"); !ok || string(v) != "2" {
+		t.Fatalf("expected the live entry to be kept, got %q", v)
+	}
+}
+
+func TestMultipleAPIs(t *testing.T) {
+	a, b := newFakeAPI(), newFakeAPI()
+	a.name, b.name = "a", "b"
+	var h *chatlib.Handler
+	scoped := make(chan string, 10)
+	reply := func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+		return h.Reply(c, msg, "pong from "+msg.API)
+	}
+	h, err := chatlib.New(
+		chatlib.WithAPI(a, chatlib.RegisterCommand("only-a", "", "", "", func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			scoped <- msg.API
+			return nil
+		})),
+		chatlib.WithAPI(b),
+		chatlib.RegisterCommand("ping", "", "", "", reply),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Start(c)
+
+	b.in <- &chatlib.Message{Command: "PRIVMSG", Nick: "foo", Receiver: "#test", Text: "!ping"}
+	select {
+	case msg := <-b.out:
+		if msg.Text != "pong from b" {
+			t.Fatalf("unexpected reply %q", msg.Text)
+		}
+	case <-a.out:
+		t.Fatal("reply sent through the wrong api")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for reply")
+	}
+	b.in <- &chatlib.Message{Command: "PRIVMSG", Nick: "foo", Receiver: "#test", Text: "!only-a"}
+	a.in <- &chatlib.Message{Command: "PRIVMSG", Nick: "foo", Receiver: "#test", Text: "!only-a"}
+	select {
+	case got := <-scoped:
+		if got != "a" {
+			t.Fatalf("scoped action ran for api %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for scoped action")
+	}
+	select {
+	case got := <-scoped:
+		t.Fatalf("unexpected scoped action for api %s", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	api := newFakeAPI()
+	api.name = "net"
+	ran := make(chan string, 20)
+	action := func(name string) chatlib.ActionFunc {
+		return func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			ran <- name + " " + msg.Receiver
+			return nil
+		}
+	}
+	dot, rate := ".", 2
+	h, err := chatlib.New(
+		chatlib.WithAPI(api),
+		chatlib.WithOverride("", "", chatlib.Override{Roles: map[string][]string{chatlib.RoleStaff: {"alice"}}}),
+		chatlib.WithOverride("NET", "", chatlib.Override{CommandPrefix: &dot}),
+		chatlib.WithOverride("", "#quiet", chatlib.Override{DisabledModules: []string{"fun"}}),
+		chatlib.WithOverride("net", "#Busy", chatlib.Override{CommandRate: &rate}),
+		chatlib.WithModule("fun", chatlib.RegisterCommand("joke", "", "", "", action("joke"))),
+		chatlib.RegisterCommand("op", "", "", "", action("op"), chatlib.RoleStaff),
+		chatlib.RegisterCommand("ping", "", "", "", action("ping")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := h.Settings("net", "#busy"); s.CommandPrefix != "." || s.CommandRate != 2 || len(s.Roles[chatlib.RoleStaff]) != 1 {
+		t.Fatalf("unexpected settings %+v", s)
+	}
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Start(c)
+	for _, m := range []struct{ nick, receiver, text string }{
+		{"bob", "#test", "!ping"},
+		{"bob", "#test", ".ping"},
+		{"bob", "#quiet", ".joke"},
+		{"bob", "#test", ".joke"},
+		{"bob", "#test", ".op"},
+		{"alice", "#test", ".op"},
+		{"bob", "#busy", ".ping"},
+		{"bob", "#busy", ".ping"},
+		{"bob", "#busy", ".ping"},
+	} {
+		api.in <- &chatlib.Message{Command: "PRIVMSG", Nick: m.nick, Receiver: m.receiver, Text: m.text, API: "net"}
+	}
+	for _, expected := range []string{"ping #test", "joke #test", "op #test", "ping #busy", "ping #busy"} {
+		select {
+		case got := <-ran:
+			if got != expected {
+				t.Fatalf("expected %q, got %q", expected, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+	select {
+	case got := <-ran:
+		t.Fatalf("unexpected action %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// accountAPI is a fakeAPI that knows the accounts of some nicks.
+type accountAPI struct {
+	*fakeAPI
+	accounts map[string]string
+}
+
+func (a *accountAPI) AccountOf(nick string) (string, bool) {
+	account, ok := a.accounts[nick]
+	return account, ok
+}
+
+func TestAdminRole(t *testing.T) {
+	// greg's nick is taken by mallory, logged in to another account
+	api := &accountAPI{fakeAPI: newFakeAPI(), accounts: map[string]string{"greg": "mallory", "greg_": "greg"}}
+	ran := make(chan string, 10)
+	h, err := chatlib.New(
+		chatlib.WithAPI(api),
+		chatlib.WithAdmins("greg", "alice"),
+		chatlib.WithLifecycleActions(),
+		chatlib.RegisterCommand("op", "", "!op", "", func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			ran <- msg.Nick
+			return nil
+		}, chatlib.RoleAdmin),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- h.Start(context.Background())
+	}()
+	say := func(nick, text string) {
+		api.in <- &chatlib.Message{Command: chatlib.CommandMessage, Nick: nick, Receiver: "#test", Text: text}
+	}
+
+	// Only admins are configured, no roles, and admin actions are still
+	// refused to everyone else, whether they use an admin's nick or not. alice
+	// isn't logged in, so her nick alone isn't enough
+	for _, nick := range []string{"bob", "greg", "alice"} {
+		say(nick, "!op")
+		say(nick, "!shutdown")
+		say(nick, "!shutdown confirm")
+	}
+	select {
+	case nick := <-ran:
+		t.Fatalf("expected the admin action to be refused, ran for %s", nick)
+	case msg := <-api.out:
+		t.Fatalf("expected no reply to a non-admin, got %q", msg.Text)
+	case <-done:
+		t.Fatal("expected a non-admin not to shut down the bot")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Admins are known by account
+	say("greg_", "!op")
+	select {
+	case nick := <-ran:
+		if nick != "greg_" {
+			t.Fatalf("expected the action to run for greg_, ran for %s", nick)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the action to run for greg_")
+	}
+	say("greg_", "!shutdown")
+	<-api.out
+	say("greg_", "!shutdown confirm")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for handler to stop")
+	}
+}
+
+func TestContentPolicy(t *testing.T) {
+	mask, err := chatlib.NewContentPolicy(chatlib.PolicyMask, chatlib.DefaultPatternLimits, "bad(word)?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := chatlib.NewContentPolicy(chatlib.PolicyBlock, chatlib.DefaultPatternLimits, "bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The limits given are those checked
+	long := strings.Repeat("a", 65)
+	if _, err := chatlib.NewContentPolicy(chatlib.PolicyMask, chatlib.DefaultPatternLimits, long); err != nil {
+		t.Fatalf("expected a pattern within the limits, got %v", err)
+	}
+	if _, err := chatlib.NewContentPolicy(chatlib.PolicyMask, chatlib.PatternLimits{MaxLength: 64}, long); !errors.Is(err, chatlib.ErrInvalidPattern) {
+		t.Fatalf("expected a pattern over the limits to be refused, got %v", err)
+	}
+	api := newFakeAPI()
+	h, err := chatlib.New(
+		chatlib.WithAPI(api),
+		chatlib.WithContentPolicy("", mask),
+		chatlib.WithContentPolicy("#Kids", block),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := context.Background()
+	if err := h.Send(c, &chatlib.Message{Command: "PRIVMSG", Receiver: "#test", Text: "a BADWORD here"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-api.out; msg.Text != "a ******* here" {
+		t.Fatalf("expected masked text, got %q", msg.Text)
+	}
+	if err := h.Send(c, &chatlib.Message{Command: "PRIVMSG", Receiver: "#kids", Text: "a bad thing"}); !errors.Is(err, chatlib.ErrBlockedContent) {
+		t.Fatalf("expected blocked content error, got %+v", err)
+	}
+}
+
+func TestActionBudget(t *testing.T) {
+	api := newFakeAPI()
+	var h *chatlib.Handler
+	runs := 0
+	h, err := chatlib.New(
+		chatlib.WithAPI(api),
+		chatlib.WithAdmins("admin"),
+		chatlib.WithActionBudget(chatlib.ActionBudget{Messages: 1, Strikes: 2}),
+		chatlib.RegisterCommand("spam", "", "!spam", "", func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			runs++
+			h.Reply(c, msg, "one")
+			return h.Reply(c, msg, "two")
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Start(c)
+	for i := 0; i < 3; i++ {
+		api.in <- &chatlib.Message{Command: "PRIVMSG", Nick: "foo", Receiver: "#test", Text: "!spam"}
+	}
+	var notice *chatlib.Message
+	timeout := time.After(time.Second)
+	for notice == nil {
+		select {
+		case msg := <-api.out:
+			if msg.Receiver == "admin" {
+				notice = msg
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for admin notice")
+		}
+	}
+	if notice.Command != "NOTICE" || !strings.Contains(notice.Text, "!spam") {
+		t.Fatalf("unexpected admin notice %+v", notice)
+	}
+	// Let the third message go through the action loop
+	api.in <- &chatlib.Message{Command: "PRIVMSG", Nick: "foo", Receiver: "#test", Text: "!nothing"}
+	time.Sleep(50 * time.Millisecond)
+	if runs != 2 {
+		t.Fatalf("expected the action to run twice before being disabled, ran %d times", runs)
+	}
+	if disabled := h.DisabledActions(); len(disabled) != 1 || disabled[0] != "!spam" {
+		t.Fatalf("unexpected disabled actions %v", disabled)
+	}
+}
+
+func TestPatternLimits(t *testing.T) {
+	limits := chatlib.PatternLimits{MaxLength: 64, MaxComplexity: 500, MatchTime: time.Second}
+	for _, tc := range []struct {
+		pattern string
+		err     string
+	}{
+		{`^!roll (\d+)d(\d+)$`, ""},
+		{`^!roll (\d+`, "missing closing )"},
+		{strings.Repeat("a", 65), "65 bytes long"},
+		{`(?:[a-z]{20}){40}`, "too complex"},
+	} {
+		_, err := chatlib.CompilePattern(tc.pattern, limits)
+		if tc.err == "" && err != nil {
+			t.Errorf("%q: unexpected error %v", tc.pattern, err)
+		}
+		if tc.err != "" && (!errors.Is(err, chatlib.ErrInvalidPattern) || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%q: expected an error containing %q, got %v", tc.pattern, tc.err, err)
+		}
+	}
+	_, err := chatlib.New(
+		chatlib.WithPatternLimits(limits),
+		chatlib.RegisterAction("PRIVMSG", `(?:[a-z]{20}){40}`, "!slow", "", func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			return nil
+		}),
+	)
+	if !errors.Is(err, chatlib.ErrInvalidPattern) || !strings.Contains(err.Error(), "!slow") {
+		t.Errorf("expected the action's pattern to be refused, got %v", err)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	c := context.Background()
+	store := chatlib.NewMemoryStore()
+	j, err := chatlib.NewJournal(c, 2, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"one", "two", "three"} {
+		j.Record(c, chatlib.EventError, "fake", text)
+	}
+	// A new journal on the same store picks up where the last one left off
+	j, err = chatlib.NewJournal(c, 2, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := j.Since(time.Now().Add(-time.Minute))
+	if len(events) != 2 || events[0].Text != "two" || events[1].Text != "three" {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	if events := j.Since(time.Now()); len(events) != 0 {
+		t.Fatalf("expected no events, got %+v", events)
+	}
+}
+
+func TestLogMirror(t *testing.T) {
+	api := newFakeAPI()
+	m, err := chatlib.NewLogMirror(zerolog.WarnLevel, "", []string{"#ops"}, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := startHandler(t, api, chatlib.WithLogMirror(m))
+	defer stop()
+	logger := zerolog.New(m)
+	logger.Info().Msg("not mirrored")
+	logger.Error().Str("api", "fake").Err(errors.New("connection reset")).Msg("error reading message")
+	logger.Error().Str("api", "fake").Err(errors.New("connection reset")).Msg("error reading message")
+	logger.Warn().Msg("lag is high")
+	logger.Warn().Msg("over the rate limit")
+	for _, expected := range []string{"[error] fake: error reading message: connection reset", "[warn] lag is high"} {
+		select {
+		case msg := <-api.out:
+			if msg.Receiver != "#ops" || msg.Command != "NOTICE" || msg.Text != expected {
+				t.Fatalf("expected notice %q to #ops, got %+v", expected, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+	select {
+	case msg := <-api.out:
+		t.Fatalf("unexpected message %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// receiptAPI is a fakeAPI whose messages are confirmed with delivery
+// receipts.
+type receiptAPI struct {
+	*fakeAPI
+	sends    int
+	receipts chan chatlib.DeliveryReceipt
+	ids      chan string
+}
+
+func (r *receiptAPI) SendTracked(c context.Context, msg *chatlib.Message) (string, error) {
+	r.sends++
+	id := "event" + string(rune('0'+r.sends))
+	r.out <- msg
+	r.ids <- id
+	return id, nil
+}
+
+func (r *receiptAPI) Receipts() <-chan chatlib.DeliveryReceipt { return r.receipts }
+
+func TestOutbox(t *testing.T) {
+	api := &receiptAPI{
+		fakeAPI:  newFakeAPI(),
+		receipts: make(chan chatlib.DeliveryReceipt),
+		ids:      make(chan string, 10),
+	}
+	h, err := chatlib.New(chatlib.WithAPI(api), chatlib.WithOutbox(time.Minute, 200*time.Millisecond, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Start(c)
+
+	id, err := h.SendReliable(c, &chatlib.Message{Command: chatlib.CommandMessage, Receiver: "#ops", Text: "disk full"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a receipt the message is sent again
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-api.out:
+			if msg.Receiver != "#ops" || msg.Text != "disk full" {
+				t.Fatalf("unexpected message %+v", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for send %d", i+1)
+		}
+	}
+	// A receipt for the first send is enough
+	first := <-api.ids
+	api.receipts <- chatlib.DeliveryReceipt{ID: first, State: chatlib.DeliveryRead}
+	api.receipts <- chatlib.DeliveryReceipt{ID: <-api.ids, State: chatlib.DeliveryDelivered}
+	deadline := time.Now().Add(time.Second)
+	for {
+		e, ok := h.Outbox().Status(id)
+		if !ok {
+			t.Fatalf("no outbox entry %s", id)
+		}
+		if e.State == chatlib.DeliveryRead {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected message to be read, got %+v", e)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case msg := <-api.out:
+		t.Fatalf("unexpected resend %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if e, _ := h.Outbox().Status(id); e.State != chatlib.DeliveryRead {
+		t.Fatalf("read receipt was downgraded: %+v", e)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	api := newFakeAPI()
+	h, err := chatlib.New(chatlib.WithAPI(api), chatlib.WithDryRun())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := context.Background()
+	if err := h.Send(c, &chatlib.Message{Command: chatlib.CommandMessage, Receiver: "#test", Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-api.out:
+		t.Fatalf("unexpected message %+v", msg)
+	default:
+	}
+	events := h.Journal().Since(time.Now().Add(-time.Minute))
+	if len(events) != 1 || events[0].Kind != chatlib.EventDryRun || events[0].Text != "would send PRIVMSG to #test: hello" {
+		t.Fatalf("unexpected events %+v", events)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	defer viper.Reset()
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.String("chat-command-prefix", "!", "")
+	flags.Int("chat-page-lines", 5, "")
+	flags.Duration("chat-pattern-match-time", time.Millisecond, "")
+
+	viper.Set("chat.command-prefix", ".")
+	viper.Set("chat.networks.libera.command-rate", 5)
+	viper.Set("chat.pattern-match-time", "5ms")
+	if err := chatlib.ValidateConfig(flags, []string{chatlib.ConfigName}); err != nil {
+		t.Fatalf("unexpected error for valid config: %v", err)
+	}
+	// A section with all of its keys commented out is empty, not unknown
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader("status:\n  #listen: \":8091\"\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := chatlib.ValidateConfig(flags, []string{chatlib.ConfigName, "status"}); err != nil {
+		t.Fatalf("unexpected error for an empty section: %v", err)
+	}
+	viper.ReadConfig(strings.NewReader(""))
+
+	viper.Set("chat.comand-prefix", ".")
+	viper.Set("chat.page-lines", "lots")
+	viper.Set("chat.pattern-match-time", 5)
+	viper.Set("chat.networks.libera.comand-rate", 5)
+	viper.Set("caht.nick", "bot")
+	err := chatlib.ValidateConfig(flags, []string{chatlib.ConfigName})
+	if !errors.Is(err, chatlib.ErrInvalidConfig) {
+		t.Fatalf("expected invalid config, got %v", err)
+	}
+	for _, want := range []string{
+		"config has 5 problems",
+		"unknown key chat.comand-prefix, did you mean chat.command-prefix?",
+		"chat.page-lines: expected a whole number, got lots",
+		"chat.pattern-match-time: expected a duration with a unit, e.g. 5s, got 5",
+		"did you mean chat.networks.libera.command-rate?",
+		"unknown key caht.nick, did you mean chat.nick?",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	defer viper.Reset()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte("chat:\n  replay-policy: skip\n  journal-size: 10\n  command-prefix: \"!\"\n"+config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("  admins: [alice]\n")
+	viper.SetConfigFile(path)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	opt, err := chatlib.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := newFakeAPI()
+	h, err := chatlib.New(chatlib.WithAPI(api), *opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := context.Background()
+
+	write("  admins: [bob]\n  command-rate: 3\n  roles:\n    staff: [carol]\n  banned-patterns: [bad]\n  channels:\n    \"#kids\":\n      no-links: true\n")
+	if err := h.Reload(c); err != nil {
+		t.Fatal(err)
+	}
+	if h.IsAdmin("alice") || !h.IsAdmin("bob") {
+		t.Error("expected the admins to be reloaded")
+	}
+	s := h.Settings("fake", "#kids")
+	if s.CommandRate != 3 || !s.NoLinks || !slices.Equal(s.Roles[chatlib.RoleStaff], []string{"carol"}) {
+		t.Errorf("expected the settings to be reloaded, got %+v", s)
+	}
+	if err := h.Send(c, &chatlib.Message{Command: chatlib.CommandMessage, Receiver: "#test", Text: "bad"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-api.out; msg.Text != "***" {
+		t.Errorf("expected the banned patterns to be reloaded, got %q", msg.Text)
+	}
+
+	// Nothing is applied from an invalid config
+	write("  admins: [dave]\n  command-rate: -1\n")
+	if err := h.Reload(c); !errors.Is(err, chatlib.ErrInvalidConfig) {
+		t.Fatalf("expected invalid config, got %v", err)
+	}
+	if !h.IsAdmin("bob") || h.IsAdmin("dave") {
+		t.Error("expected the admins of an invalid config not to be applied")
+	}
+}
+
+func TestConfigReference(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.String("chat-command-prefix", "!", "Prefix of | commands")
+	flags.StringSlice("chat-admins", []string{}, "Admins")
+	flags.Bool("chat-secret", false, "")
+	flags.MarkHidden("chat-secret")
+	flags.Int("log-level", 1, "Log level")
+
+	sections := chatlib.ConfigReference(flags, []string{chatlib.ConfigName, "log"})
+	if len(sections) != 2 || sections[0].Name != chatlib.ConfigName || sections[1].Name != "log" {
+		t.Fatalf("expected the chat and log sections, got %+v", sections)
+	}
+	expected := []chatlib.ConfigKey{
+		{Key: "chat.admins", Type: "stringSlice", Description: "Admins"},
+		{Key: "chat.command-prefix", Type: "string", Default: "!", Description: "Prefix of | commands"},
+	}
+	if !reflect.DeepEqual(sections[0].Keys, expected) {
+		t.Errorf("expected keys %+v, got %+v", expected, sections[0].Keys)
+	}
+	if len(sections[0].Patterns) == 0 {
+		t.Error("expected the chat keys that aren't flags")
+	}
+
+	var sb strings.Builder
+	if err := chatlib.WriteConfigMarkdown(&sb, sections); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"## chat\n",
+		"| `chat.command-prefix` | string | `!` | Prefix of \\| commands |\n",
+		"| `chat.admins` | list of strings |  | Admins |\n",
+		"- `chat.networks.*.command-prefix`\n",
+		"| `log.level` | whole number | `1` | Log level |\n",
+	} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("expected %q in\n%s", want, sb.String())
+		}
+	}
+}
+
+func TestReplyNotice(t *testing.T) {
+	api := newFakeAPI()
+	on := true
+	h, err := chatlib.New(chatlib.WithAPI(api), chatlib.WithOverride("", "#polite", chatlib.Override{ReplyNotice: &on}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := context.Background()
+	for _, tc := range []struct {
+		receiver string
+		command  string
+	}{
+		{"#chan", chatlib.CommandMessage},
+		{"#polite", chatlib.CommandNotice},
+	} {
+		msg := &chatlib.Message{Command: chatlib.CommandMessage, Receiver: tc.receiver, Nick: "alice", API: "fake"}
+		if err := h.Reply(c, msg, "hi"); err != nil {
+			t.Fatal(err)
+		}
+		if reply := <-api.out; reply.Command != tc.command || reply.Receiver != tc.receiver {
+			t.Errorf("%s: expected %s, got %+v", tc.receiver, tc.command, reply)
+		}
+		if err := h.ReplyNotice(c, msg, "hi"); err != nil {
+			t.Fatal(err)
+		}
+		if reply := <-api.out; !reply.IsNotice() {
+			t.Errorf("%s: expected a notice, got %+v", tc.receiver, reply)
+		}
+	}
+}
+
+// shortenerAPI is a fakeAPI that is handed the Handler's URLShortener.
+type shortenerAPI struct {
+	*fakeAPI
+	shortener chatlib.URLShortener
+}
+
+func (s *shortenerAPI) UseURLShortener(sh chatlib.URLShortener) { s.shortener = sh }
+
+type prefixShortener struct{}
+
+func (prefixShortener) Shorten(c context.Context, url string) (string, error) {
+	if len(url) < 20 {
+		return url, nil
+	}
+	return "https://sho.rt/" + url[len(url)-3:], nil
+}
+
+func TestURLShortener(t *testing.T) {
+	c := context.Background()
+	api := &shortenerAPI{fakeAPI: newFakeAPI()}
+	h, err := chatlib.New(chatlib.WithAPI(api), chatlib.WithURLShortener(prefixShortener{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if api.shortener == nil {
+		t.Fatal("expected the API to be handed the shortener")
+	}
+	short, err := api.shortener.Shorten(c, "https://example.com/long/abc")
+	if err != nil || short != "https://sho.rt/abc" {
+		t.Fatalf("unexpected short URL %q %v", short, err)
+	}
+	if url, err := h.ExpandURL(c, short); err != nil || url != "https://example.com/long/abc" {
+		t.Errorf("expected the original to be kept, got %q %v", url, err)
+	}
+	if _, err := api.shortener.Shorten(c, "https://x.io"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.ExpandURL(c, "https://x.io"); !errors.Is(err, chatlib.ErrNotFound) {
+		t.Errorf("expected unshortened URLs not to be kept, got %v", err)
+	}
+	if urls := chatlib.FindURLs("see https://a.example/x and http://b.example"); len(urls) != 2 {
+		t.Errorf("unexpected URLs %v", urls)
+	}
+}
+
+// memberAPI is a fakeAPI that knows who is in its channels.
+type memberAPI struct {
+	*fakeAPI
+	members map[string][]string
+}
+
+func (m *memberAPI) MemberNicks(channel string) []string { return m.members[channel] }
+
+func TestMentionGuard(t *testing.T) {
+	api := &memberAPI{fakeAPI: newFakeAPI(), members: map[string][]string{
+		"#chan":  {"alice", "Bob", "carol", "[dave]"},
+		"#dots":  {"alice", "bob", "carol"},
+		"#loose": {"alice", "bob", "carol"},
+	}}
+	limit, loose, dot := 2, 0, "."
+	h, err := chatlib.New(chatlib.WithAPI(api),
+		chatlib.WithOverride("", "", chatlib.Override{MentionLimit: &limit}),
+		chatlib.WithOverride("", "#dots", chatlib.Override{MentionBreak: &dot}),
+		chatlib.WithOverride("", "#loose", chatlib.Override{MentionLimit: &loose}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := context.Background()
+	for _, tc := range []struct {
+		receiver string
+		text     string
+		expected string
+	}{
+		{"#chan", "alice and bob, hi", "alice and bob, hi"},
+		{"#chan", "alice alice bob", "alice alice bob"},
+		{"#chan", "here: alice, BOB, [dave] and carolina", "here: a​lice, B​OB, [​dave] and carolina"},
+		{"#dots", "alice bob carol", "a.lice b.ob c.arol"},
+		{"#loose", "alice bob carol", "alice bob carol"},
+		{"alice", "alice bob carol", "alice bob carol"},
+	} {
+		if err := h.Send(c, &chatlib.Message{Command: chatlib.CommandMessage, Receiver: tc.receiver, Text: tc.text}); err != nil {
+			t.Fatal(err)
+		}
+		if msg := <-api.out; msg.Text != tc.expected {
+			t.Errorf("%s %q: expected %q, got %q", tc.receiver, tc.text, tc.expected, msg.Text)
+		}
+	}
+}
+
+func TestFormatter(t *testing.T) {
+	de, nl, utc, berlin := "de", "nl", "UTC", "Europe/Berlin"
+	h, err := chatlib.New(chatlib.WithAPI(newFakeAPI()),
+		chatlib.WithOverride("", "", chatlib.Override{TimeZone: &utc}),
+		chatlib.WithOverride("", "#de", chatlib.Override{Locale: &de, TimeZone: &berlin}),
+		chatlib.WithOverride("fake", "", chatlib.Override{Locale: &nl}),
+		chatlib.WithOverride("other", "", chatlib.Override{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := context.Background()
+	if err := h.Store().Set(c, chatlib.PrefKey("fake", "Bob", chatlib.PrefLocale), []byte("en-US")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Store().Set(c, chatlib.PrefKey("fake", "bob", chatlib.PrefTimeZone), []byte("America/New_York")); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2023, 3, 14, 17, 5, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		api      string
+		receiver string
+		nick     string
+		time     string
+		number   string
+		duration string
+	}{
+		{"other", "#chan", "alice", "Tue 14 Mar 17:05 UTC", "-1,234,567.89", "1 day and 2 hours"},
+		{"fake", "#chan", "alice", "di 14 mrt 17:05 UTC", "-1.234.567,89", "1 dag en 2 uur"},
+		{"fake", "#de", "alice", "Di 14. Mär 18:05 CET", "-1.234.567,89", "1 Tag und 2 Stunden"},
+		{"fake", "#de", "bob", "Tue Mar 14 1:05 PM EDT", "-1,234,567.89", "1 day and 2 hours"},
+	} {
+		msg := &chatlib.Message{Command: chatlib.CommandMessage, Receiver: tc.receiver, Nick: tc.nick, API: tc.api}
+		f := h.Formatter(c, msg)
+		if s := f.FormatTime(at); s != tc.time {
+			t.Errorf("%s %s %s: expected time %q, got %q", tc.api, tc.receiver, tc.nick, tc.time, s)
+		}
+		if s := f.FormatNumber(-1234567.891, 2); s != tc.number {
+			t.Errorf("%s %s %s: expected number %q, got %q", tc.api, tc.receiver, tc.nick, tc.number, s)
+		}
+		if s := f.FormatDuration(26*time.Hour + 59*time.Second); s != tc.duration {
+			t.Errorf("%s %s %s: expected duration %q, got %q", tc.api, tc.receiver, tc.nick, tc.duration, s)
+		}
+	}
+	en, _ := chatlib.LookupLocale("en")
+	f := chatlib.Formatter{Locale: en}
+	for d, expected := range map[time.Duration]string{
+		0:                               "0 seconds",
+		time.Second:                     "1 second",
+		-90 * time.Second:               "1 minute and 30 seconds",
+		2*time.Hour + 30*time.Minute:    "2 hours and 30 minutes",
+		1000*24*time.Hour + time.Minute: "1,000 days",
+	} {
+		if s := f.FormatDuration(d); s != expected {
+			t.Errorf("%s: expected %q, got %q", d, expected, s)
+		}
+	}
+	if l, ok := chatlib.LookupLocale("de_AT"); !ok || l.Tag != "de" {
+		t.Errorf("expected de_AT to fall back to de, got %q %v", l.Tag, ok)
+	}
+	if _, ok := chatlib.LookupLocale("xx"); ok {
+		t.Error("expected xx to be unknown")
+	}
+}
+
+func TestFloor(t *testing.T) {
+	h, err := chatlib.New(chatlib.WithAPI(newFakeAPI()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := context.Background()
+	started := make(chan string, 3)
+	game := func(name string) func(c context.Context) {
+		return func(c context.Context) {
+			started <- name
+			<-c.Done()
+		}
+	}
+	if pos, _ := h.ClaimFloor(c, "fake", "#games", "quiz", time.Hour, game("quiz")); pos != 0 {
+		t.Errorf("expected quiz to start, got position %d", pos)
+	}
+	pos, releaseDuel := h.ClaimFloor(c, "fake", "#Games", "duel", 50*time.Millisecond, game("duel"))
+	if pos != 1 {
+		t.Errorf("expected duel to wait, got position %d", pos)
+	}
+	if pos, _ := h.ClaimFloor(c, "fake", "#games", "trivia", time.Hour, game("trivia")); pos != 2 {
+		t.Errorf("expected trivia to wait, got position %d", pos)
+	}
+	if pos, _ := h.ClaimFloor(c, "fake", "#other", "duel", time.Hour, game("other")); pos != 0 {
+		t.Errorf("expected the other channel to be free, got position %d", pos)
+	}
+	if got := []string{<-started, <-started}; !reflect.DeepEqual(got, []string{"quiz", "other"}) && !reflect.DeepEqual(got, []string{"other", "quiz"}) {
+		t.Errorf("expected quiz and other to start, got %v", got)
+	}
+	if holder, waiting := h.FloorHolder("fake", "#games"); holder != "quiz" || !reflect.DeepEqual(waiting, []string{"duel", "trivia"}) {
+		t.Errorf("expected quiz holding, duel and trivia waiting, got %s %v", holder, waiting)
+	}
+
+	// Withdrawing a waiting claim lets the next one move up
+	releaseDuel()
+	releaseDuel()
+	if holder, waiting := h.FloorHolder("fake", "#games"); holder != "quiz" || !reflect.DeepEqual(waiting, []string{"trivia"}) {
+		t.Errorf("expected quiz holding, trivia waiting, got %s %v", holder, waiting)
+	}
+	select {
+	case name := <-started:
+		t.Errorf("expected nothing to start, got %s", name)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// A game that returns releases the floor
+	h.ClaimFloor(c, "fake", "#quick", "quick", time.Hour, func(c context.Context) {})
+	pos, _ = h.ClaimFloor(c, "fake", "#quick", "slow", 20*time.Millisecond, game("slow"))
+	if name := <-started; name != "slow" {
+		t.Errorf("expected slow to start after quick, got %s (position %d)", name, pos)
+	}
+	// And so does running out of time
+	for i := 0; ; i++ {
+		if holder, _ := h.FloorHolder("fake", "#quick"); holder == "" {
+			break
+		}
+		if i == 100 {
+			t.Fatal("expected slow to be released after its hold")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// kickAPI is a fakeAPI that can remove users from channels.
+type kickAPI struct {
+	*fakeAPI
+	kicked chan string
+}
+
+func (k *kickAPI) Kick(c context.Context, channel, nick, reason string) error {
+	k.kicked <- channel + " " + nick
+	return nil
+}
+
+// fakeMailer keeps the bodies of the mail it is asked to send.
+type fakeMailer struct {
+	bodies chan string
+}
+
+func (m *fakeMailer) SendMail(c context.Context, to, subject, body string) error {
+	m.bodies <- to + ": " + body
+	return nil
+}
+
+func TestVerify(t *testing.T) {
+	api := &kickAPI{fakeAPI: newFakeAPI(), kicked: make(chan string, 1)}
+	mailer := &fakeMailer{bodies: make(chan string, 1)}
+	question, email, colour, green, timeout := chatlib.VerifyByQuestion, chatlib.VerifyByEmail, "What colour is the flag?", "green", 1
+	h, err := chatlib.New(chatlib.WithAPI(api),
+		chatlib.WithVerification(),
+		chatlib.WithMailer(mailer),
+		chatlib.WithOverride("", "#members", chatlib.Override{Verify: &question, VerifyQuestion: &colour, VerifyAnswer: &green}),
+		chatlib.WithOverride("", "#mail", chatlib.Override{Verify: &email}),
+		chatlib.WithOverride("", "#timed", chatlib.Override{Verify: &question, VerifyQuestion: &colour, VerifyAnswer: &green, VerifyTimeout: &timeout}),
+		chatlib.RegisterCommand("ping", "", "!ping", "", func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			return chatlib.FromContext(c).Reply(c, msg, "pong")
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Start(c)
+
+	join := func(nick, channel string) {
+		api.in <- &chatlib.Message{Command: "JOIN", Nick: nick, Receiver: channel}
+	}
+	say := func(nick, receiver, text string) {
+		api.in <- &chatlib.Message{Command: chatlib.CommandMessage, Nick: nick, Receiver: receiver, Text: text, Private: !strings.HasPrefix(receiver, "#")}
+	}
+	expect := func(receiver, text string) {
+		t.Helper()
+		select {
+		case msg := <-api.out:
+			if msg.Receiver != receiver || !strings.Contains(msg.Text, text) {
+				t.Errorf("expected %q to %s, got %q to %s", text, receiver, msg.Text, msg.Receiver)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %q to %s, got nothing", text, receiver)
+		}
+	}
+
+	join("alice", "#members")
+	expect("alice", colour)
+	// Commands from unverified users are ignored, bob's is answered
+	say("alice", "#members", "!ping")
+	say("bob", "#members", "!ping")
+	expect("#members", "pong")
+	say("alice", "freyabot", "!verify red")
+	expect("alice", "not the answer for #members")
+	say("alice", "freyabot", "!verify Green")
+	expect("alice", "you can talk in #members")
+	say("alice", "#members", "!ping")
+	expect("#members", "pong")
+	// Verified users aren't asked again
+	join("alice", "#members")
+	say("alice", "#members", "!ping")
+	expect("#members", "pong")
+
+	// A nick change doesn't escape the challenge
+	join("carol", "#mail")
+	expect("carol", "email address")
+	api.in <- &chatlib.Message{Command: "NICK", Nick: "carol", Receiver: "carol2"}
+	say("carol2", "#mail", "!ping")
+	say("bob", "#mail", "!ping")
+	expect("#mail", "pong")
+	say("carol2", "freyabot", "!verify not@an@address")
+	expect("carol2", "isn't an email address")
+	say("carol2", "freyabot", "!verify carol@example.com")
+	expect("carol2", "mailed a code for #mail")
+	body := <-mailer.bodies
+	code := regexp.MustCompile(`\d{6}`).FindString(body)
+	if !strings.HasPrefix(body, "carol@example.com: ") || code == "" {
+		t.Fatalf("expected a code mailed to carol, got %q", body)
+	}
+	say("carol2", "freyabot", "!verify "+code)
+	expect("carol2", "you can talk in #mail")
+
+	// Users who don't verify in time are removed
+	join("dave", "#timed")
+	expect("dave", "within 1 second")
+	select {
+	case kicked := <-api.kicked:
+		if kicked != "#timed dave" {
+			t.Errorf("expected dave to be removed from #timed, got %s", kicked)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("expected dave to be removed")
+	}
+}
+
+func TestModeration(t *testing.T) {
+	api := &kickAPI{fakeAPI: newFakeAPI(), kicked: make(chan string, 1)}
+	yes, short, kick, escalate := true, 10, chatlib.RuleKick, chatlib.RuleEscalate
+	h, err := chatlib.New(chatlib.WithAPI(api),
+		chatlib.WithModeration(),
+		chatlib.WithOverride("", "#links", chatlib.Override{LinksOnly: &yes, RuleExempt: []string{chatlib.RoleStaff}, Roles: map[string][]string{chatlib.RoleStaff: {"carol"}}}),
+		chatlib.WithOverride("", "#art", chatlib.Override{NoMedia: &yes, RuleAction: &escalate}),
+		chatlib.WithOverride("", "#short", chatlib.Override{MaxLineLength: &short, RuleAction: &kick}),
+		chatlib.WithContentRule(func(s chatlib.Settings, msg *chatlib.Message) string {
+			if s.MaxLineLength > 0 && strings.ToUpper(msg.Text) == msg.Text {
+				return "no shouting"
+			}
+			return ""
+		}),
+		chatlib.RegisterCommand("ping", "", "!ping", "", func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			return chatlib.FromContext(c).Reply(c, msg, "pong")
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Start(c)
+
+	say := func(nick, channel, text string) {
+		api.in <- &chatlib.Message{Command: chatlib.CommandMessage, Nick: nick, Receiver: channel, Text: text}
+	}
+	expect := func(receiver, text string) {
+		t.Helper()
+		select {
+		case msg := <-api.out:
+			if msg.Receiver != receiver || !strings.Contains(msg.Text, text) {
+				t.Errorf("expected %q to %s, got %q to %s", text, receiver, msg.Text, msg.Receiver)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %q to %s, got nothing", text, receiver)
+		}
+	}
+	expectKick := func(expected string) {
+		t.Helper()
+		select {
+		case kicked := <-api.kicked:
+			if kicked != expected {
+				t.Errorf("expected %s to be removed, got %s", expected, kicked)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s to be removed", expected)
+		}
+	}
+
+	say("alice", "#links", "hello")
+	expect("alice", "only links")
+	say("alice", "#links", "see https://example.com/post")
+	// Staff are exempt
+	say("carol", "#links", "hello")
+	say("bob", "#chan", "!ping")
+	expect("#chan", "pong")
+
+	for i := 1; i < chatlib.RuleStrikes; i++ {
+		say("bob", "#art", "look https://i.imgur.com/cat.png")
+		expect("bob", fmt.Sprintf("warning %d of %d", i, chatlib.RuleStrikes-1))
+	}
+	say("bob", "#art", "and https://www.youtube.com/watch?v=x")
+	expectKick("#art bob")
+	say("bob", "#art", "https://example.com/page.html is fine")
+
+	say("dave", "#short", "short")
+	say("dave", "#short", "far too long for here")
+	expectKick("#short dave")
+	// Rules added by other packages are enforced like the built in ones
+	say("erin", "#short", "HEY")
+	expectKick("#short erin")
+	say("erin", "#chan", "HEY")
+
+	for _, tc := range []struct {
+		s    chatlib.Settings
+		text string
+		ok   bool
+	}{
+		{chatlib.Settings{NoLinks: true}, "no links here", true},
+		{chatlib.Settings{NoLinks: true}, "see http://example.com", false},
+		{chatlib.Settings{NoMedia: true}, "https://example.com/song.MP3", false},
+		{chatlib.Settings{NoMedia: true}, "https://notyoutube.com/watch", true},
+		{chatlib.Settings{MaxLineLength: 3}, "äöü", true},
+	} {
+		if broken := chatlib.BrokenRule(tc.s, tc.text); (broken == "") != tc.ok {
+			t.Errorf("%+v %q: expected ok %v, got %q", tc.s, tc.text, tc.ok, broken)
+		}
+	}
+}
+
+func TestCrosspost(t *testing.T) {
+	api := &kickAPI{fakeAPI: newFakeAPI(), kicked: make(chan string, 1)}
+	yes, kick := true, chatlib.RuleKick
+	h, err := chatlib.New(chatlib.WithAPI(api),
+		chatlib.WithAdmins("admin"),
+		chatlib.WithModeration(),
+		chatlib.WithCrosspostDetection(3, time.Minute),
+		chatlib.WithOverride("", "#rules", chatlib.Override{NoCrosspost: &yes, RuleAction: &kick}),
+		chatlib.RegisterCommand("ping", "", "!ping", "", func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			return chatlib.FromContext(c).Reply(c, msg, "pong")
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Start(c)
+
+	say := func(nick, channel, text string) {
+		api.in <- &chatlib.Message{Command: chatlib.CommandMessage, Nick: nick, Receiver: channel, Text: text}
+	}
+	expect := func(receiver, text string) {
+		t.Helper()
+		select {
+		case msg := <-api.out:
+			if msg.Receiver != receiver || !strings.Contains(msg.Text, text) {
+				t.Errorf("expected %q to %s, got %q to %s", text, receiver, msg.Text, msg.Receiver)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %q to %s, got nothing", text, receiver)
+		}
+	}
+
+	// Short messages and different users aren't crossposts
+	for _, channel := range []string{"#a", "#b", "#c"} {
+		say("alice", channel, "hello all")
+	}
+	say("bob", "#a", "Buy cheap followers at spam.example")
+	say("carol", "#b", "buy cheap followers at spam.example")
+	say("bob", "#b", "buy  CHEAP followers at spam.example")
+	say("bob", "#chan", "!ping")
+	expect("#chan", "pong")
+
+	say("bob", "#rules", "buy cheap followers at spam.example")
+	expect("admin", "bob posted the same message in #a, #b, #rules within 1m0s")
+	select {
+	case kicked := <-api.kicked:
+		if kicked != "#rules bob" {
+			t.Errorf("expected bob to be removed, got %s", kicked)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected bob to be removed")
+	}
+	// The admins are told once
+	say("bob", "#d", "buy cheap followers at spam.example")
+	say("bob", "#chan", "!ping")
+	expect("#chan", "pong")
+
+	if err := chatlib.WithCrosspostDetection(1, time.Minute)(h); err == nil {
+		t.Error("expected a crosspost to need several channels")
+	}
+}
+
+func TestSlowMode(t *testing.T) {
+	api := &kickAPI{fakeAPI: newFakeAPI(), kicked: make(chan string, 1)}
+	slow, escalate := 60, chatlib.RuleEscalate
+	store := chatlib.NewMemoryStore()
+	h, err := chatlib.New(chatlib.WithAPI(api),
+		chatlib.WithStore(store),
+		chatlib.WithAdmins("admin"),
+		chatlib.WithModeration(),
+		chatlib.WithOverride("", "#slow", chatlib.Override{SlowMode: &slow, RuleAction: &escalate}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Start(c)
+
+	say := func(nick, channel, text string) {
+		api.in <- &chatlib.Message{Command: chatlib.CommandMessage, Nick: nick, Receiver: channel, Text: text}
+	}
+	expect := func(receiver, text string) {
+		t.Helper()
+		select {
+		case msg := <-api.out:
+			if msg.Receiver != receiver || !strings.Contains(msg.Text, text) {
+				t.Errorf("expected %q to %s, got %q to %s", text, receiver, msg.Text, msg.Receiver)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %q to %s, got nothing", text, receiver)
+		}
+	}
+
+	say("bob", "#slow", "first")
+	say("alice", "#slow", "hi")
+	for i := 1; i < chatlib.RuleStrikes; i++ {
+		say("bob", "#slow", "again")
+		expect("bob", fmt.Sprintf("slow mode, one message every 1 minute, wait 1 minute (warning %d of %d)", i, chatlib.RuleStrikes-1))
+	}
+	say("bob", "#slow", "and again")
+	select {
+	case kicked := <-api.kicked:
+		if kicked != "#slow bob" {
+			t.Errorf("expected bob to be removed, got %s", kicked)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected bob to be removed")
+	}
+	// Admins are exempt, and the setting applies until changed
+	say("admin", "#slow", "!slowmode")
+	expect("#slow", "on, one message every 1 minute")
+	say("admin", "#slow", "!slowmode off")
+	expect("#slow", "off")
+	say("alice", "#slow", "now")
+	say("alice", "#slow", "I can talk")
+	say("admin", "#chan", "!slowmode on")
+	expect("#chan", fmt.Sprintf("every %d seconds", chatlib.DefaultSlowMode))
+	say("admin", "#chan", "!slowmode 7200")
+	expect("#chan", "at most 1 hour")
+	say("carol", "#chan", "hello")
+	say("carol", "#chan", "hello?")
+	expect("carol", "wait")
+
+	// What !slowmode sets outlives the Handler
+	if b, err := store.Get(c, "slowmode/fake/#slow"); err != nil || string(b) != "0" {
+		t.Errorf("expected slow mode to be stored off, got %q, %v", b, err)
+	}
+	if interval, err := h.SlowMode(c, "fake", "#CHAN"); err != nil || interval != chatlib.DefaultSlowMode*time.Second {
+		t.Errorf("expected the default interval, got %v, %v", interval, err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	api := newFakeAPI()
+	var h *chatlib.Handler
+	h, err := chatlib.New(
+		chatlib.WithAPI(api),
+		chatlib.WithAdmins("admin"),
+		chatlib.WithActionBudget(chatlib.ActionBudget{Messages: 1, Strikes: 1}),
+		chatlib.WithModule("quiet", chatlib.RegisterCommand("hi", "", "!hi", "", func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			return h.Reply(c, msg, "hi")
+		})),
+		chatlib.WithModule("spammy", chatlib.RegisterCommand("spam", "", "!spam", "", func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			h.Reply(c, msg, "one")
+			return h.Reply(c, msg, "two")
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := h.Status(); !s.Started.IsZero() || len(s.Networks) != 1 || s.Networks[0].Ready {
+		t.Fatalf("expected a stopped status, got %+v", s)
+	}
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Start(c)
+	api.in <- &chatlib.Message{Command: "PRIVMSG", Nick: "foo", Receiver: "#test", Text: "!spam"}
+	timeout := time.After(time.Second)
+	for notified := false; !notified; {
+		select {
+		case msg := <-api.out:
+			notified = msg.Receiver == "admin"
+		case <-timeout:
+			t.Fatal("timed out waiting for admin notice")
+		}
+	}
+	s := h.Status()
+	if s.Started.IsZero() || len(s.Networks) != 1 || s.Networks[0].Name != "fake" || !s.Networks[0].Ready {
+		t.Fatalf("unexpected networks in %+v", s)
+	}
+	if len(s.Modules) != 2 || s.Modules[0].Name != "quiet" || !s.Modules[0].Healthy {
+		t.Fatalf("expected quiet to be healthy, got %+v", s.Modules)
+	}
+	if m := s.Modules[1]; m.Name != "spammy" || m.Healthy || len(m.DisabledActions) != 1 || m.DisabledActions[0] != "!spam" {
+		t.Fatalf("expected spammy's action to be disabled, got %+v", m)
+	}
+}
+
+func TestAnalytics(t *testing.T) {
+	store := chatlib.NewMemoryStore()
+	run := func(messages ...[2]string) (*chatlib.Handler, context.CancelFunc) {
+		api := newFakeAPI()
+		var h *chatlib.Handler
+		reply := func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			return h.Reply(c, msg, "ok")
+		}
+		h, err := chatlib.New(chatlib.WithAPI(api),
+			chatlib.WithStore(store),
+			chatlib.WithAnalytics(30),
+			chatlib.WithModule("fun", chatlib.RegisterCommand("joke", "", "!joke", "", reply)),
+			chatlib.WithModule("fun", chatlib.RegisterCommand("pun", "", "!pun", "", reply)),
+			chatlib.RegisterAction(chatlib.CommandMessage, "", "", "", func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+				return nil
+			}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, cancel := context.WithCancel(context.Background())
+		go h.Start(c)
+		for _, m := range messages {
+			api.in <- &chatlib.Message{Command: chatlib.CommandMessage, Nick: m[0], Receiver: "#test", Text: m[1], API: "net"}
+			select {
+			case <-api.out:
+			case <-time.After(time.Second):
+				t.Fatalf("expected a reply to %s", m[1])
+			}
+		}
+		return h, cancel
+	}
+
+	h, cancel := run([2]string{"bob", "!joke"}, [2]string{"bob", "!joke"}, [2]string{"alice", "!joke"})
+	trends, err := h.UsageTrends(context.Background(), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trends) != 2 {
+		t.Fatalf("expected the commands to be counted and nothing else, got %+v", trends)
+	}
+	if joke := trends[0]; joke.Module != "fun" || joke.Action != "!joke" || joke.Uses != 3 || joke.PeakUsers != 2 || len(joke.Daily) != 7 || joke.Daily[6] != 3 {
+		t.Errorf("unexpected usage of !joke %+v", joke)
+	}
+	if pun := trends[1]; pun.Action != "!pun" || pun.Uses != 0 {
+		t.Errorf("expected !pun to be shown unused, got %+v", pun)
+	}
+	if err := h.Shutdown(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	b, err := store.Get(context.Background(), "analytics/"+time.Now().UTC().Format(time.DateOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "bob") || strings.Contains(string(b), "#test") || !strings.Contains(string(b), `"uses":3`) {
+		t.Errorf("unexpected usage saved %s", b)
+	}
+
+	// Usage saved earlier in the day adds up after a restart
+	h, cancel = run([2]string{"bob", "!joke"})
+	defer cancel()
+	if trends, err = h.UsageTrends(context.Background(), 1); err != nil || trends[0].Uses != 4 {
+		t.Fatalf("expected the usage to add up, got %+v, %v", trends, err)
+	}
+	if _, err := h.UsageTrends(context.Background(), 31); err == nil {
+		t.Error("expected usage past the retention to be refused")
+	}
+}
+
+// slowAPI takes delay to send, with outgoing messages always queued.
+type slowAPI struct {
+	*fakeAPI
+	delay    time.Duration
+	outgoing int
+}
+
+func (s *slowAPI) SendMessage(c context.Context, msg *chatlib.Message) error {
+	time.Sleep(s.delay)
+	return s.fakeAPI.SendMessage(c, msg)
+}
+
+func (s *slowAPI) Queued() (int, int) {
+	return len(s.in), s.outgoing
+}
+
+func TestPressure(t *testing.T) {
+	api := &slowAPI{fakeAPI: newFakeAPI(), delay: 20 * time.Millisecond, outgoing: chatlib.HighPressureQueue}
+	pressures := make(chan chatlib.Pressure, 1)
+	var h *chatlib.Handler
+	h, err := chatlib.New(chatlib.WithAPI(api),
+		chatlib.RegisterCommand("feed", "", "!feed", "", func(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+			if err := h.Reply(c, msg, "item"); err != nil {
+				return err
+			}
+			pressures <- chatlib.PressureFrom(c, msg.API)
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := chatlib.PressureFrom(context.Background(), "fake"); p != (chatlib.Pressure{}) {
+		t.Errorf("expected no pressure outside of a Handler, got %+v", p)
+	}
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Start(c)
+	api.in <- &chatlib.Message{Command: chatlib.CommandMessage, Nick: "bob", Receiver: "#test", Text: "!feed"}
+	select {
+	case p := <-pressures:
+		if p.Outgoing != chatlib.HighPressureQueue || p.SendLatency < api.delay || !p.High() || p.Backlog() < 10*api.delay {
+			t.Errorf("unexpected pressure %+v", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the action to run")
+	}
+	api.outgoing = 0
+	if p := h.Pressure(""); p.High() || p.SendLatency < api.delay {
+		t.Errorf("expected the send latency alone to be low pressure, got %+v", p)
+	}
+}
@@ -0,0 +1,549 @@
+package chatlib
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const ConfigName = "chat"
+
+// Module is an integration, such as a chat backend, that can be compiled into
+// a bot and configured from flags and config files. Modules register
+// themselves from an init function so bots can choose which to include with
+// blank imports and build tags.
+type Module struct {
+	// Name is used as the flag and config prefix.
+	Name string
+	// Flags may be nil, e.g. for plugins loaded after flags are parsed.
+	Flags func(cmd *cobra.Command)
+	// Init returns a nil Option if the module is disabled.
+	Init func() (*Option, error)
+	// ConfigKeys are the module's config keys that aren't flags, relative to
+	// Name, where * matches any name, e.g. "sources.*.secret". Other keys
+	// that aren't flags are refused by ValidateConfig.
+	ConfigKeys []string
+}
+
+var modules []Module
+
+// RegisterModule makes a module available to Modules. It panics if a module
+// with the same name is already registered.
+func RegisterModule(m Module) {
+	if err := registerModule(m); err != nil {
+		panic(err)
+	}
+}
+
+func registerModule(m Module) error {
+	for _, existing := range modules {
+		if existing.Name == m.Name {
+			return errors.Errorf("chatlib: module registered twice: %s", m.Name)
+		}
+	}
+	modules = append(modules, m)
+	return nil
+}
+
+// Modules returns the registered modules in registration order.
+func Modules() []Module {
+	return append([]Module(nil), modules...)
+}
+
+func Init() (*Option, error) {
+	allow := viper.GetStringSlice(ConfigName + ".allow")
+	block := viper.GetStringSlice(ConfigName + ".block")
+	if len(allow) > 0 {
+		log.Info().Msgf("accepting commands only from: %v", allow)
+	}
+	if len(block) > 0 {
+		log.Info().Msgf("ignoring commands from: %v", block)
+	}
+	var store Store
+	if path := viper.GetString(ConfigName + ".store"); path != "" {
+		fs, err := NewFileStore(path)
+		if err != nil {
+			return nil, errors.Wrapf(fmt.Errorf("%s: %w", ErrInvalidConfig, err), "chat: failed to open store: %s", path)
+		}
+		log.Info().Msgf("using store: %s", path)
+		store = fs
+	} else {
+		log.Warn().Msg("no store configured, runtime state will be lost on restart")
+		store = NewMemoryStore()
+	}
+	var replayPolicy int
+	switch viper.GetString(ConfigName + ".replay-policy") {
+	case "skip":
+		replayPolicy = ReplaySkip
+	case "execute":
+		replayPolicy = ReplayExecute
+	default:
+		return nil, errors.Wrapf(ErrInvalidConfig, "chat: invalid replay policy: %s", viper.GetString(ConfigName+".replay-policy"))
+	}
+	log.Info().Msgf("replay policy: %s", viper.GetString(ConfigName+".replay-policy"))
+	limits := patternLimits()
+	policies, err := contentPolicies(limits)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := loadOverrides()
+	if err != nil {
+		return nil, err
+	}
+	opt := CombineOptions(
+		// The prefix must be set before any commands are registered
+		WithCommandPrefix(viper.GetString(ConfigName+".command-prefix")),
+		WithChannelAllowlist(allow...),
+		WithChannelBlocklist(block...),
+		WithStore(store),
+		WithReplayPolicy(replayPolicy),
+		WithLifecycleActions(),
+		WithJournalSize(viper.GetInt(ConfigName+".journal-size")),
+		WithEventsAction(),
+		WithLocaleAction(),
+		WithFloorActions(),
+		WithVerification(),
+		WithModeration(),
+		WithDrainPeriod(viper.GetFloat64(ConfigName+".drain-period")),
+		WithReloader(reloader(viper.ConfigFileUsed())),
+		policies,
+		WithMiddleware(URLMiddleware),
+	)
+	for sc, o := range overrides {
+		opt = CombineOptions(opt, WithOverride(sc.network, sc.channel, o))
+	}
+	if lines := viper.GetInt(ConfigName + ".page-lines"); lines > 0 {
+		opt = CombineOptions(opt, WithPagination(lines))
+	}
+	if admins := viper.GetStringSlice(ConfigName + ".admins"); len(admins) > 0 {
+		opt = CombineOptions(opt, WithAdmins(admins...))
+	}
+	if channels := viper.GetInt(ConfigName + ".crosspost-channels"); channels > 0 {
+		opt = CombineOptions(opt, WithCrosspostDetection(channels, viper.GetDuration(ConfigName+".crosspost-window")))
+	}
+	opt = CombineOptions(opt, WithPatternLimits(limits))
+	if budget := actionBudget(); budget != (ActionBudget{}) {
+		log.Info().Msgf("action budget: %+v", budget)
+		opt = CombineOptions(opt, WithActionBudget(budget))
+	}
+	if address := viper.GetString(ConfigName + ".smtp-address"); address != "" {
+		log.Info().Msgf("sending mail through %s", address)
+		opt = CombineOptions(opt, WithMailer(&SMTPMailer{
+			Address:  address,
+			From:     viper.GetString(ConfigName + ".smtp-from"),
+			Username: viper.GetString(ConfigName + ".smtp-username"),
+			Password: viper.GetString(ConfigName + ".smtp-password"),
+		}))
+	}
+	if path := viper.GetString(ConfigName + ".control-socket"); path != "" {
+		opt = CombineOptions(opt, WithControlSocket(path))
+	}
+	if viper.GetBool(ConfigName + ".dry-run") {
+		opt = CombineOptions(opt, WithDryRun())
+	}
+	if viper.GetBool(ConfigName + ".analytics") {
+		log.Info().Msgf("analytics: keeping usage for %d days", viper.GetInt(ConfigName+".analytics-retention"))
+		opt = CombineOptions(opt, WithAnalytics(viper.GetInt(ConfigName+".analytics-retention")))
+	}
+	if viper.GetBool(ConfigName + ".outbox") {
+		retry := viper.GetDuration(ConfigName + ".outbox-retry")
+		ackTimeout := viper.GetDuration(ConfigName + ".outbox-ack-timeout")
+		attempts := viper.GetInt(ConfigName + ".outbox-attempts")
+		log.Info().Msgf("outbox: retry every %s, ack timeout %s, %d attempts", retry, ackTimeout, attempts)
+		opt = CombineOptions(opt, WithOutbox(retry, ackTimeout, attempts))
+	}
+	return &opt, nil
+}
+
+// InitLogMirror returns a LogMirror configured from the log-mirror settings,
+// or nil if no targets are set. The caller adds it to the logger's writers
+// and to the Handler with WithLogMirror.
+func InitLogMirror() (*LogMirror, error) {
+	targets := viper.GetStringSlice(ConfigName + ".log-mirror-targets")
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	level, err := zerolog.ParseLevel(viper.GetString(ConfigName + ".log-mirror-level"))
+	if err != nil {
+		return nil, errors.Wrapf(fmt.Errorf("%s: %w", ErrInvalidConfig, err), "chat: invalid log mirror level: %s", viper.GetString(ConfigName+".log-mirror-level"))
+	}
+	m, err := NewLogMirror(level, viper.GetString(ConfigName+".log-mirror-api"), targets, viper.GetInt(ConfigName+".log-mirror-rate"), viper.GetDuration(ConfigName+".log-mirror-dedupe"))
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Msgf("mirroring %s logs to: %v", level, targets)
+	return m, nil
+}
+
+func Flags(cmd *cobra.Command) {
+	// CommandPrefix
+	cmd.Flags().String(ConfigName+"-command-prefix", DefaultCommandPrefix, "Prefix commands are written with. Messages addressed to the bot by nick work without it")
+	// CommandRate
+	cmd.Flags().Int(ConfigName+"-command-rate", 0, "Most commands answered per minute in a channel. 0 is unlimited. Can be overridden per network and channel")
+	// ReplyNotice
+	cmd.Flags().Bool(ConfigName+"-reply-notice", false, "Reply with notices instead of messages, as many networks expect of bots. Can be overridden per network and channel")
+	// MentionLimit
+	cmd.Flags().Int(ConfigName+"-mention-limit", 5, "Most members of a channel a message may name before their nicks are broken up so they aren't highlighted. 0 is unlimited. Can be overridden per network and channel")
+	// MentionBreak
+	cmd.Flags().String(ConfigName+"-mention-break", "", "Put after the first character of nicks broken up, a zero width space if empty. Can be overridden per network and channel")
+	// Locale
+	cmd.Flags().String(ConfigName+"-locale", DefaultLocale, "Locale times and numbers are written in for users who haven't chosen one with !locale, e.g. de or en-us. Can be overridden per network and channel")
+	// TimeZone
+	cmd.Flags().String(ConfigName+"-time-zone", "", "Time zone, e.g. Europe/Berlin, times are shown in for users who haven't chosen one with !timezone, the system's if empty. Can be overridden per network and channel")
+	// DisabledModules
+	cmd.Flags().StringSlice(ConfigName+"-disabled-modules", []string{}, "Modules whose commands and actions don't run. Can be overridden per network and channel")
+	// Allow
+	cmd.Flags().StringSlice(ConfigName+"-allow", []string{}, "Channels and nicks to accept commands from, prefixed with an API name and a slash, e.g. irc/#chan, to apply to that API only. If empty, commands are accepted from everywhere not blocked")
+	// Block
+	cmd.Flags().StringSlice(ConfigName+"-block", []string{}, "Channels and nicks to ignore commands from, named like those of allow")
+	// ReplayPolicy
+	cmd.Flags().String(ConfigName+"-replay-policy", "skip", "What to do with commands replayed by a bouncer or history backfill, one of: skip, execute")
+	// PageLines
+	cmd.Flags().Int(ConfigName+"-page-lines", DefaultPageLines, "Lines of a long reply sent at once, the rest is sent with !more. 0 disables pagination")
+	// BannedPatterns
+	cmd.Flags().StringSlice(ConfigName+"-banned-patterns", []string{}, "Regular expressions the bot must never say. Per channel policies can be set in the config file")
+	// BannedAction
+	cmd.Flags().String(ConfigName+"-banned-action", "mask", "What to do with outgoing messages matching a banned pattern, one of: mask, block")
+	// Plugins
+	cmd.Flags().StringSlice(ConfigName+"-plugins", []string{}, "Go plugins to load modules from. Plugin modules are configured from the config file only")
+	// LogMirrorTargets
+	cmd.Flags().StringSlice(ConfigName+"-log-mirror-targets", []string{}, "Channels and nicks to send warnings and errors from the log to. Disabled if empty")
+	// LogMirrorAPI
+	cmd.Flags().String(ConfigName+"-log-mirror-api", "", "API to send mirrored log events through. Required if there are several")
+	// LogMirrorLevel
+	cmd.Flags().String(ConfigName+"-log-mirror-level", "warn", "Lowest log level mirrored to chat, one of: warn, error, fatal")
+	// LogMirrorRate
+	cmd.Flags().Int(ConfigName+"-log-mirror-rate", DefaultLogMirrorPerMinute, "Most log events mirrored to chat a minute")
+	// LogMirrorDedupe
+	cmd.Flags().Duration(ConfigName+"-log-mirror-dedupe", DefaultLogMirrorDedupe, "How long repeats of a mirrored log event are held back")
+	// JournalSize
+	cmd.Flags().Int(ConfigName+"-journal-size", DefaultJournalSize, "Number of events such as connects, errors and reloads kept for !events")
+	// Admins
+	cmd.Flags().StringSlice(ConfigName+"-admins", []string{}, "Nicks, or accounts on networks where users log in, of the admins, told when the bot disables a misbehaving action and given every role. Users not logged in are never admins on those networks")
+	// CrosspostChannels
+	cmd.Flags().Int(ConfigName+"-crosspost-channels", 0, "Channels a user must post the same message in within the crosspost window for the admins to be told. 0 disables crosspost detection")
+	// CrosspostWindow
+	cmd.Flags().Duration(ConfigName+"-crosspost-window", DefaultCrosspostWindow, "How long a message counts towards a crosspost")
+	// ActionWallTime
+	cmd.Flags().Duration(ConfigName+"-action-wall-time", 0, "Longest a single run of an action may take. 0 disables the limit")
+	// ActionCPUTime
+	cmd.Flags().Duration(ConfigName+"-action-cpu-time", 0, "Most CPU time a single run of an action may use, on unix systems when no other bot runs in the process. 0 disables the limit")
+	// ActionMessages
+	cmd.Flags().Int(ConfigName+"-action-messages", 0, "Most messages a single run of an action may send. 0 disables the limit")
+	// ActionBytes
+	cmd.Flags().Int(ConfigName+"-action-bytes", 0, "Most bytes of text a single run of an action may send. 0 disables the limit")
+	// ActionStrikes
+	cmd.Flags().Int(ConfigName+"-action-strikes", DefaultBudgetStrikes, "Times an action may go over budget before it is disabled until the next reload")
+	// PatternMaxLength
+	cmd.Flags().Int(ConfigName+"-pattern-max-length", DefaultPatternMaxLength, "Longest action pattern accepted, in bytes. 0 disables the limit")
+	// PatternMaxComplexity
+	cmd.Flags().Int(ConfigName+"-pattern-max-complexity", DefaultPatternMaxComplexity, "Most instructions an action pattern may compile to. 0 disables the limit")
+	// PatternMatchTime
+	cmd.Flags().Duration(ConfigName+"-pattern-match-time", DefaultPatternMatchTime, "Longest an action pattern may take to match a message, counted as a budget violation. 0 disables the limit")
+	// Outbox
+	cmd.Flags().Bool(ConfigName+"-outbox", false, "Keep messages sent with SendReliable in the store and retry them until they are delivered")
+	// OutboxRetry
+	cmd.Flags().Duration(ConfigName+"-outbox-retry", DefaultOutboxRetry, "How long to wait before retrying an outbox message that failed to send")
+	// OutboxAckTimeout
+	cmd.Flags().Duration(ConfigName+"-outbox-ack-timeout", DefaultOutboxAckTimeout, "How long to wait for a delivery receipt before resending, for APIs that send them")
+	// OutboxAttempts
+	cmd.Flags().Int(ConfigName+"-outbox-attempts", DefaultOutboxMaxAttempts, "Sends of an outbox message before giving up on it and telling the admins")
+	// Analytics
+	cmd.Flags().Bool(ConfigName+"-analytics", false, "Count how much each command is used a day and by how many users, without keeping who or what they said")
+	// AnalyticsRetention
+	cmd.Flags().Int(ConfigName+"-analytics-retention", DefaultAnalyticsRetention, "Days of usage kept by analytics")
+	// SMTPAddress
+	cmd.Flags().String(ConfigName+"-smtp-address", "", "host:port of the SMTP server mail, such as verification codes, is sent through. Mail is disabled if empty")
+	// SMTPFrom
+	cmd.Flags().String(ConfigName+"-smtp-from", "", "Address mail is sent from")
+	// SMTPUsername
+	cmd.Flags().String(ConfigName+"-smtp-username", "", "Username to log in to the SMTP server with, if it needs one")
+	// SMTPPassword
+	cmd.Flags().String(ConfigName+"-smtp-password", "", "Password to log in to the SMTP server with")
+	// ControlSocket
+	cmd.Flags().String(ConfigName+"-control-socket", "", "Path to a unix socket accepting shutdown and restart commands. Disabled if empty")
+	// DrainPeriod
+	cmd.Flags().Int(ConfigName+"-drain-period", DefaultDrainSeconds, "Seconds to wait for running actions to finish when stopped with SIGTERM")
+	// Store
+	cmd.Flags().String(ConfigName+"-store", "", "Path to a file to keep runtime state in, such as channels joined with !join. If empty, state is lost on restart")
+}
+
+// contentPolicies builds the default content policy from banned-patterns and
+// banned-action and per channel policies from the channel-policies map, e.g.
+//
+//	chat:
+//	  channel-policies:
+//	    "#kids":
+//	      banned-patterns: ["heck"]
+//	      banned-action: block
+//
+// The patterns are checked against limits, the pattern limits of the config.
+func contentPolicies(limits PatternLimits) (Option, error) {
+	opts := make([]Option, 0)
+	build := func(channel, key string) error {
+		patterns := viper.GetStringSlice(key + ".banned-patterns")
+		if len(patterns) == 0 {
+			return nil
+		}
+		var action int
+		switch viper.GetString(key + ".banned-action") {
+		case "", "mask":
+			action = PolicyMask
+		case "block":
+			action = PolicyBlock
+		default:
+			return errors.Wrapf(ErrInvalidConfig, "chat: invalid banned action: %s", viper.GetString(key+".banned-action"))
+		}
+		p, err := NewContentPolicy(action, limits, patterns...)
+		if err != nil {
+			return errors.Wrapf(fmt.Errorf("%s: %w", ErrInvalidConfig, err), "chat: invalid content policy for %q", channel)
+		}
+		log.Info().Msgf("content policy for %q: %d banned patterns", channel, len(patterns))
+		opts = append(opts, WithContentPolicy(channel, p))
+		return nil
+	}
+	if err := build("", ConfigName); err != nil {
+		return nil, err
+	}
+	for channel := range viper.GetStringMap(ConfigName + ".channel-policies") {
+		if err := build(channel, ConfigName+".channel-policies."+channel); err != nil {
+			return nil, err
+		}
+	}
+	return CombineOptions(opts...), nil
+}
+
+// loadOverrides reads the settings that can be overridden: the global ones
+// from the chat section, and the overrides from chat.networks.<api>,
+// chat.channels.<channel> and chat.networks.<api>.channels.<channel>.
+func loadOverrides() (map[scope]Override, error) {
+	overrides := make(map[scope]Override)
+	load := func(sc scope, key string) error {
+		var o Override
+		if err := viper.UnmarshalKey(key, &o); err != nil {
+			return errors.Wrapf(fmt.Errorf("%s: %w", ErrInvalidConfig, err), "chat: invalid settings in %s", key)
+		}
+		if o.CommandRate != nil && *o.CommandRate < 0 {
+			return errors.Wrapf(ErrInvalidConfig, "chat: invalid command rate in %s: %d", key, *o.CommandRate)
+		}
+		if o.MentionLimit != nil && *o.MentionLimit < 0 {
+			return errors.Wrapf(ErrInvalidConfig, "chat: invalid mention limit in %s: %d", key, *o.MentionLimit)
+		}
+		if o.Locale != nil {
+			if err := checkLocale(" in "+key, *o.Locale, ""); err != nil {
+				return err
+			}
+		}
+		if o.TimeZone != nil {
+			if err := checkLocale(" in "+key, "", *o.TimeZone); err != nil {
+				return err
+			}
+		}
+		if err := checkVerify(key, o); err != nil {
+			return err
+		}
+		if err := checkRules(key, o); err != nil {
+			return err
+		}
+		overrides[sc] = o
+		return nil
+	}
+	// The global settings may come from flags, which UnmarshalKey doesn't see
+	rate := viper.GetInt(ConfigName + ".command-rate")
+	if rate < 0 {
+		return nil, errors.Wrapf(ErrInvalidConfig, "chat: invalid command rate: %d", rate)
+	}
+	notice := viper.GetBool(ConfigName + ".reply-notice")
+	mentions := viper.GetInt(ConfigName + ".mention-limit")
+	if mentions < 0 {
+		return nil, errors.Wrapf(ErrInvalidConfig, "chat: invalid mention limit: %d", mentions)
+	}
+	mentionBreak := viper.GetString(ConfigName + ".mention-break")
+	locale := viper.GetString(ConfigName + ".locale")
+	zone := viper.GetString(ConfigName + ".time-zone")
+	if err := checkLocale("", locale, zone); err != nil {
+		return nil, err
+	}
+	overrides[scope{}] = Override{
+		CommandRate:     &rate,
+		ReplyNotice:     &notice,
+		MentionLimit:    &mentions,
+		MentionBreak:    &mentionBreak,
+		Locale:          &locale,
+		TimeZone:        &zone,
+		DisabledModules: viper.GetStringSlice(ConfigName + ".disabled-modules"),
+		Roles:           viper.GetStringMapStringSlice(ConfigName + ".roles"),
+	}
+	for channel := range viper.GetStringMap(ConfigName + ".channels") {
+		if err := load(scope{channel: channel}, ConfigName+".channels."+channel); err != nil {
+			return nil, err
+		}
+	}
+	for network := range viper.GetStringMap(ConfigName + ".networks") {
+		key := ConfigName + ".networks." + network
+		if err := load(scope{network: network}, key); err != nil {
+			return nil, err
+		}
+		for channel := range viper.GetStringMap(key + ".channels") {
+			if err := load(scope{network, channel}, key+".channels."+channel); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return overrides, nil
+}
+
+// checkLocale checks a locale and time zone set where, either of which may be
+// empty.
+func checkLocale(where, locale, zone string) error {
+	if _, ok := LookupLocale(locale); locale != "" && !ok {
+		return errors.Wrapf(ErrInvalidConfig, "chat: unknown locale%s: %s, known are %v", where, locale, LocaleTags())
+	}
+	if _, err := time.LoadLocation(zone); err != nil {
+		return errors.Wrapf(fmt.Errorf("%s: %w", ErrInvalidConfig, err), "chat: invalid time zone%s: %s", where, zone)
+	}
+	return nil
+}
+
+// checkVerify checks the verification settings of the override in key.
+func checkVerify(key string, o Override) error {
+	if o.Verify != nil {
+		switch *o.Verify {
+		case "", VerifyByQuestion:
+		case VerifyByEmail:
+			if viper.GetString(ConfigName+".smtp-address") == "" {
+				return errors.Wrapf(ErrInvalidConfig, "chat: verify by email in %s needs smtp-address", key)
+			}
+		default:
+			return errors.Wrapf(ErrInvalidConfig, "chat: invalid verify in %s: %s, one of: %s, %s", key, *o.Verify, VerifyByQuestion, VerifyByEmail)
+		}
+	}
+	if o.VerifyTimeout != nil && *o.VerifyTimeout < 0 {
+		return errors.Wrapf(ErrInvalidConfig, "chat: invalid verify timeout in %s: %d", key, *o.VerifyTimeout)
+	}
+	return nil
+}
+
+// checkRules checks the content rules of the override in key.
+func checkRules(key string, o Override) error {
+	if o.LinksOnly != nil && o.NoLinks != nil && *o.LinksOnly && *o.NoLinks {
+		return errors.Wrapf(ErrInvalidConfig, "chat: links-only and no-links both set in %s", key)
+	}
+	if o.MaxLineLength != nil && *o.MaxLineLength < 0 {
+		return errors.Wrapf(ErrInvalidConfig, "chat: invalid max line length in %s: %d", key, *o.MaxLineLength)
+	}
+	if o.MaxToxicity != nil && (*o.MaxToxicity < 0 || *o.MaxToxicity > 1) {
+		return errors.Wrapf(ErrInvalidConfig, "chat: invalid max toxicity in %s: %g, from 0 to 1", key, *o.MaxToxicity)
+	}
+	if o.SlowMode != nil && (*o.SlowMode < 0 || *o.SlowMode > MaxSlowMode) {
+		return errors.Wrapf(ErrInvalidConfig, "chat: invalid slow mode in %s: %d, at most %d seconds", key, *o.SlowMode, MaxSlowMode)
+	}
+	if o.RuleAction != nil {
+		switch *o.RuleAction {
+		case "", RuleWarn, RuleKick, RuleEscalate:
+		default:
+			return errors.Wrapf(ErrInvalidConfig, "chat: invalid rule action in %s: %s, one of: %s, %s, %s", key, *o.RuleAction, RuleWarn, RuleKick, RuleEscalate)
+		}
+	}
+	return nil
+}
+
+// EffectiveSettings returns the settings resolved from the config for the
+// bot as a whole, keyed "global", and for every network and channel that
+// overrides them, keyed by the network, the channel, or network/channel.
+func EffectiveSettings() (map[string]Settings, error) {
+	overrides, err := loadOverrides()
+	if err != nil {
+		return nil, err
+	}
+	global := Settings{CommandPrefix: viper.GetString(ConfigName + ".command-prefix")}
+	effective := map[string]Settings{"global": resolveSettings(global, overrides, "", "")}
+	for sc := range overrides {
+		name := sc.network + sc.channel
+		if sc.network != "" && sc.channel != "" {
+			name = sc.network + "/" + sc.channel
+		}
+		if name != "" {
+			effective[name] = resolveSettings(global, overrides, sc.network, sc.channel)
+		}
+	}
+	return effective, nil
+}
+
+// actionBudget reads the action budget from the config. It is the zero
+// ActionBudget if no limit is set.
+func actionBudget() ActionBudget {
+	budget := ActionBudget{
+		WallTime: viper.GetDuration(ConfigName + ".action-wall-time"),
+		CPUTime:  viper.GetDuration(ConfigName + ".action-cpu-time"),
+		Messages: viper.GetInt(ConfigName + ".action-messages"),
+		Bytes:    viper.GetInt(ConfigName + ".action-bytes"),
+	}
+	if budget == (ActionBudget{}) {
+		return budget
+	}
+	budget.Strikes = viper.GetInt(ConfigName + ".action-strikes")
+	return budget
+}
+
+// patternLimits reads the limits on configured patterns from the config.
+func patternLimits() PatternLimits {
+	return PatternLimits{
+		MaxLength:     viper.GetInt(ConfigName + ".pattern-max-length"),
+		MaxComplexity: viper.GetInt(ConfigName + ".pattern-max-complexity"),
+		MatchTime:     viper.GetDuration(ConfigName + ".pattern-match-time"),
+	}
+}
+
+// reloadedKeys are the keys of the chat section a reload applies. The
+// others, such as command-prefix, which the commands are registered with,
+// take a restart.
+var reloadedKeys = []string{"allow", "block", "admins", "roles", "command-rate", "reply-notice", "mention-limit", "mention-break", "locale", "time-zone", "disabled-modules", "channels", "networks", "banned-patterns", "banned-action", "channel-policies"}
+
+// reloader returns a ReloadFunc reading the config file at path again, the
+// one the Handler was configured from, as bots of a Group each have their
+// own. It applies the reloadedKeys, and nothing if any of them is invalid.
+func reloader(path string) ReloadFunc {
+	return func(c context.Context, h *Handler) error {
+		configMu.Lock()
+		defer configMu.Unlock()
+		if path != "" {
+			viper.SetConfigFile(path)
+		}
+		if err := viper.ReadInConfig(); err != nil {
+			return errors.Wrap(err, "chat: failed to read config")
+		}
+		overrides, err := loadOverrides()
+		if err != nil {
+			return err
+		}
+		policies, err := contentPolicies(patternLimits())
+		if err != nil {
+			return err
+		}
+		next := &Handler{}
+		opts := []Option{policies, WithAdmins(viper.GetStringSlice(ConfigName + ".admins")...)}
+		for sc, o := range overrides {
+			opts = append(opts, WithOverride(sc.network, sc.channel, o))
+		}
+		if err := next.ApplyOptions(opts...); err != nil {
+			return err
+		}
+		allow := viper.GetStringSlice(ConfigName + ".allow")
+		block := viper.GetStringSlice(ConfigName + ".block")
+		h.SetChannelACL(allow, block)
+		h.swapSettings(next)
+		log.Info().Msgf("reloaded allowlist: %v, blocklist: %v", allow, block)
+		log.Info().Strs("keys", reloadedKeys).Msg("reloaded settings, admins and content policies, other settings take a restart")
+		if prefix := viper.GetString(ConfigName + ".command-prefix"); prefix != h.commandPrefix {
+			log.Warn().Msgf("command prefix changed to %q, restart for it to take effect", prefix)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,106 @@
+package chatlib
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// ConfigKey documents a config key, from the flag that sets it.
+type ConfigKey struct {
+	// Key is the full key, e.g. irc.nick.
+	Key string `json:"key"`
+	// Type is the flag's type, e.g. string, bool or stringSlice.
+	Type        string `json:"type"`
+	Default     string `json:"default,omitempty"`
+	Description string `json:"description"`
+}
+
+// ConfigSection documents the keys of a config section: the chat settings,
+// or those of a module.
+type ConfigSection struct {
+	Name string      `json:"name"`
+	Keys []ConfigKey `json:"keys"`
+	// Patterns are the keys of the section that aren't flags, where *
+	// matches any name, e.g. networks.*.command-prefix.
+	Patterns []string `json:"patterns,omitempty"`
+	// Open is set for modules without flags, such as plugins, which are
+	// configured from the config file alone and whose keys aren't known.
+	Open bool `json:"open,omitempty"`
+}
+
+// ConfigReference documents the config, section by section in the order of
+// prefixes, from the same schema ValidateConfig checks it against: the
+// flags, named like the keys with the section as prefix, and the ConfigKeys
+// of the modules. Keys are sorted and hidden flags left out.
+func ConfigReference(flags *pflag.FlagSet, prefixes []string) []ConfigSection {
+	sections := make([]ConfigSection, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		s := ConfigSection{Name: prefix, Keys: make([]ConfigKey, 0)}
+		if prefix == ConfigName {
+			s.Patterns = chatConfigKeys
+		}
+		for _, m := range Modules() {
+			if m.Name == prefix {
+				s.Patterns, s.Open = m.ConfigKeys, m.Flags == nil
+			}
+		}
+		flags.VisitAll(func(f *pflag.Flag) {
+			name, ok := strings.CutPrefix(f.Name, prefix+"-")
+			if !ok || f.Hidden {
+				return
+			}
+			def := f.DefValue
+			if def == "[]" {
+				def = ""
+			}
+			s.Keys = append(s.Keys, ConfigKey{Key: prefix + "." + name, Type: f.Value.Type(), Default: def, Description: f.Usage})
+		})
+		sort.Slice(s.Keys, func(i, j int) bool { return s.Keys[i].Key < s.Keys[j].Key })
+		sections = append(sections, s)
+	}
+	return sections
+}
+
+// WriteConfigMarkdown writes sections as a markdown reference, a table of
+// keys for each section.
+func WriteConfigMarkdown(w io.Writer, sections []ConfigSection) error {
+	var sb strings.Builder
+	sb.WriteString("# Configuration reference\n")
+	for _, s := range sections {
+		fmt.Fprintf(&sb, "\n## %s\n\n", s.Name)
+		if s.Open {
+			sb.WriteString("Configured from the config file alone, its keys aren't checked.\n")
+			continue
+		}
+		if len(s.Keys) > 0 {
+			sb.WriteString("| Key | Value | Default | Description |\n|---|---|---|---|\n")
+			for _, k := range s.Keys {
+				def := ""
+				if k.Default != "" {
+					def = "`" + k.Default + "`"
+				}
+				fmt.Fprintf(&sb, "| `%s` | %s | %s | %s |\n", k.Key, strings.TrimPrefix(typeName(k.Type), "a "), def, markdownCell(k.Description))
+			}
+		}
+		if len(s.Patterns) > 0 {
+			if len(s.Keys) > 0 {
+				sb.WriteString("\n")
+			}
+			sb.WriteString("Other keys, where * is any name:\n\n")
+			for _, p := range s.Patterns {
+				fmt.Fprintf(&sb, "- `%s.%s`\n", s.Name, p)
+			}
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// markdownCell escapes text for a markdown table cell.
+func markdownCell(text string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(text)
+}
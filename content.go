@@ -0,0 +1,112 @@
+package chatlib
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Content policy actions decide what happens to outgoing text that matches a
+// banned pattern.
+const (
+	// PolicyMask replaces the matched text with asterisks.
+	PolicyMask = iota
+	// PolicyBlock drops the whole message.
+	PolicyBlock
+)
+
+// ContentPolicy is a set of banned patterns applied to outgoing messages.
+type ContentPolicy struct {
+	patterns []*regexp.Regexp
+	action   int
+}
+
+// NewContentPolicy compiles the banned patterns if they are within limits,
+// those of the Handler the policy is for. Patterns are matched case
+// insensitively.
+func NewContentPolicy(action int, limits PatternLimits, patterns ...string) (*ContentPolicy, error) {
+	p := &ContentPolicy{action: action}
+	for _, pattern := range patterns {
+		re, err := CompilePattern("(?i)"+pattern, limits)
+		if err != nil {
+			return nil, errors.WithMessage(err, "invalid banned pattern")
+		}
+		p.patterns = append(p.patterns, re)
+	}
+	return p, nil
+}
+
+// Apply returns text with banned content masked, or false if the message must
+// not be sent at all.
+func (p *ContentPolicy) Apply(text string) (string, bool) {
+	for _, re := range p.patterns {
+		if !re.MatchString(text) {
+			continue
+		}
+		if p.action == PolicyBlock {
+			return "", false
+		}
+		text = re.ReplaceAllStringFunc(text, func(m string) string {
+			return strings.Repeat("*", len([]rune(m)))
+		})
+	}
+	return text, true
+}
+
+// OutboundFilter is applied to the messages an API sends. It returns the
+// message to send in place of msg, or an error if it must not be sent.
+type OutboundFilter func(c context.Context, msg *Message) (*Message, error)
+
+// FilterUser is implemented by APIs that send messages of their own, e.g. the
+// replies of their actions. The Handler hands them its content policy so
+// those are held to it like the messages it sends.
+type FilterUser interface {
+	UseOutboundFilter(f OutboundFilter)
+}
+
+// WithContentPolicy applies p to outgoing messages sent to channel, through
+// the Handler or by an API that is a FilterUser. An empty channel sets the
+// default policy for targets that don't have their own.
+func WithContentPolicy(channel string, p *ContentPolicy) Option {
+	return func(h *Handler) error {
+		if h.policies == nil {
+			h.policies = make(map[string]*ContentPolicy)
+		}
+		h.policies[strings.ToLower(channel)] = p
+		return nil
+	}
+}
+
+// filterContent applies the content policy of msg's target. The Handler
+// runs it after guarding mentions, so it sees the text that is sent, and
+// FilterUser APIs run it again on everything they send, which leaves text
+// already filtered unchanged.
+func (h *Handler) filterContent(c context.Context, msg *Message) (*Message, error) {
+	if msg.Command != CommandMessage && msg.Command != CommandNotice && msg.Command != CommandAction {
+		return msg, nil
+	}
+	h.mu.RLock()
+	p, ok := h.policies[strings.ToLower(msg.Receiver)]
+	if !ok {
+		p, ok = h.policies[""]
+	}
+	h.mu.RUnlock()
+	if !ok {
+		return msg, nil
+	}
+	text, ok := p.Apply(msg.Text)
+	if !ok {
+		log.Warn().Str("target", msg.Receiver).Str("text", msg.Text).Msg("blocked outgoing message by content policy")
+		return nil, errors.WithMessagef(ErrBlockedContent, "message to %s", msg.Receiver)
+	}
+	if text != msg.Text {
+		log.Warn().Str("target", msg.Receiver).Msg("masked outgoing message by content policy")
+		filtered := *msg
+		filtered.Text = text
+		return &filtered, nil
+	}
+	return msg, nil
+}
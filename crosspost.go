@@ -0,0 +1,149 @@
+package chatlib
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultCrosspostWindow is how long a message counts towards a crosspost
+// by default.
+const DefaultCrosspostWindow = 10 * time.Minute
+
+// crosspostMinLength is the length in characters below which messages such
+// as greetings aren't taken for crossposts.
+const crosspostMinLength = 12
+
+// maxCrosspostEntries is how many messages are kept before those older than
+// the window are forgotten.
+const maxCrosspostEntries = 4096
+
+// AnnotationCrosspost holds the channels a user posted the same message in
+// within the crosspost window, including the message's own, when they are
+// enough to be a crosspost. See WithCrosspostDetection.
+var AnnotationCrosspost = NewAnnotationKey[[]string]("crosspost")
+
+// crosspostKey is a message of a user, by the hash of its text.
+type crosspostKey struct {
+	api  string
+	nick string
+	hash uint64
+}
+
+// crosspostSeen is a channel a message was posted in and when it last was.
+type crosspostSeen struct {
+	channel string
+	at      time.Time
+}
+
+// crossposts are the messages users posted within the window, by the hash
+// of their text, rolling over as it passes.
+type crossposts struct {
+	mu       sync.Mutex
+	channels int
+	window   time.Duration
+	seen     map[crosspostKey][]crosspostSeen
+}
+
+// WithCrosspostDetection notices users posting the same message to at least
+// channels channels within window, a common pattern of spam. Their messages
+// are annotated with AnnotationCrosspost, and the admins are told. In
+// channels with NoCrosspost set, they are dealt with by RuleAction, see
+// WithModeration.
+func WithCrosspostDetection(channels int, window time.Duration) Option {
+	return func(h *Handler) error {
+		if channels < 2 {
+			return errors.Wrapf(ErrInvalidConfig, "crossposts are at least 2 channels, got %d", channels)
+		}
+		if window <= 0 {
+			return errors.Wrapf(ErrInvalidConfig, "invalid crosspost window: %v", window)
+		}
+		h.crossposts.channels, h.crossposts.window = channels, window
+		return h.ApplyOptions(
+			WithMiddleware(h.crosspostMiddleware),
+			RegisterAction(CommandMessage, "", "", "", h.actionCrosspost),
+			RegisterAction(CommandAction, "", "", "", h.actionCrosspost),
+		)
+	}
+}
+
+// crosspostHash hashes text so messages differing only in case and spacing
+// are the same.
+func crosspostHash(text string) (uint64, bool) {
+	normal := strings.ToLower(strings.Join(strings.Fields(text), " "))
+	if utf8.RuneCountInString(normal) < crosspostMinLength {
+		return 0, false
+	}
+	f := fnv.New64a()
+	f.Write([]byte(normal))
+	return f.Sum64(), true
+}
+
+// post records the message k in channel at now, and returns the channels it
+// was posted in within the window.
+func (p *crossposts) post(k crosspostKey, channel string, now time.Time) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.seen == nil {
+		p.seen = make(map[crosspostKey][]crosspostSeen)
+	}
+	if len(p.seen) >= maxCrosspostEntries {
+		for key, seen := range p.seen {
+			if now.Sub(seen[len(seen)-1].at) > p.window {
+				delete(p.seen, key)
+			}
+		}
+	}
+	seen := slices.DeleteFunc(p.seen[k], func(s crosspostSeen) bool {
+		return now.Sub(s.at) > p.window || strings.EqualFold(s.channel, channel)
+	})
+	seen = append(seen, crosspostSeen{channel, now})
+	p.seen[k] = seen
+	channels := make([]string, len(seen))
+	for i, s := range seen {
+		channels[i] = s.channel
+	}
+	return channels
+}
+
+// crosspostMiddleware annotates the messages users posted in enough
+// channels with AnnotationCrosspost.
+func (h *Handler) crosspostMiddleware(c context.Context, msg *Message) error {
+	if msg.Command != CommandMessage && msg.Command != CommandAction || msg.Private || msg.Nick == "" || msg.Replayed {
+		return nil
+	}
+	hash, ok := crosspostHash(msg.Text)
+	if !ok {
+		return nil
+	}
+	channels := h.crossposts.post(crosspostKey{strings.ToLower(msg.API), strings.ToLower(msg.Nick), hash}, msg.Channel(), time.Now())
+	if len(channels) >= h.crossposts.channels {
+		AnnotationCrosspost.Set(msg, channels)
+	}
+	return nil
+}
+
+// actionCrosspost tells the admins about a crosspost once, when it reaches
+// enough channels.
+func (h *Handler) actionCrosspost(c context.Context, re *regexp.Regexp, msg *Message) error {
+	channels, ok := AnnotationCrosspost.Get(msg)
+	if !ok || len(channels) != h.crossposts.channels {
+		return nil
+	}
+	log.Warn().Str("api", msg.API).Str("nick", msg.Nick).Strs("channels", channels).Msg("user crossposted a message")
+	text := msg.Text
+	if utf8.RuneCountInString(text) > 100 {
+		text = string([]rune(text)[:100]) + "…"
+	}
+	h.NotifyAdmins(c, msg.API, fmt.Sprintf("%s posted the same message in %s within %s: %s", msg.Nick, strings.Join(channels, ", "), h.crossposts.window, text))
+	return nil
+}
@@ -0,0 +1,61 @@
+package chatlib
+
+import (
+	"context"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DryRunner is implemented by APIs that can run without saying anything,
+// withholding what they would send while still sending what they need to
+// stay connected, such as PONG. record is called for every message withheld.
+type DryRunner interface {
+	SetDryRun(record func(c context.Context, msg *Message))
+}
+
+// WithDryRun makes the Handler log and journal what it would send instead of
+// sending it, so new plugins can be tried against live traffic. APIs that
+// implement DryRunner are put in dry run mode too, which also covers what
+// they send themselves.
+func WithDryRun() Option {
+	return func(h *Handler) error {
+		h.dryRun = true
+		return nil
+	}
+}
+
+// DryRun reports whether the Handler is in dry run mode.
+func (h *Handler) DryRun() bool {
+	return h.dryRun
+}
+
+// startDryRun puts the APIs that support it in dry run mode.
+func (h *Handler) startDryRun() {
+	if !h.dryRun {
+		return
+	}
+	log.Warn().Msg("dry run: messages are logged instead of sent")
+	for _, na := range h.apis {
+		if dr, ok := na.api.(DryRunner); ok {
+			dr.SetDryRun(h.recordDryRun)
+		}
+	}
+}
+
+// withheld reports whether msg is withheld by the Handler rather than by its
+// API, recording it if so.
+func (h *Handler) withheld(c context.Context, api API, msg *Message) bool {
+	if !h.dryRun {
+		return false
+	}
+	if _, ok := api.(DryRunner); ok {
+		return false
+	}
+	h.recordDryRun(c, msg)
+	return true
+}
+
+func (h *Handler) recordDryRun(c context.Context, msg *Message) {
+	log.Info().Str("api", msg.API).Str("command", msg.Command).Str("receiver", msg.Receiver).Msgf("dry run: %s", msg.Text)
+	h.record(c, EventDryRun, msg.API, "would send %s to %s: %s", msg.Command, msg.Receiver, msg.Text)
+}
@@ -7,6 +7,11 @@ func (e Error) Error() string {
 }
 
 const (
-	ErrInvalidConfig Error = "invalidConfig"
-	ErrTimeout       Error = "timeout"
+	ErrInvalidConfig  Error = "invalidConfig"
+	ErrTimeout        Error = "timeout"
+	ErrNotFound       Error = "notFound"
+	ErrBlockedContent Error = "blockedContent"
+	ErrInvalidPattern Error = "invalidPattern"
+
+	ErrIncompatiblePlugin Error = "incompatiblePlugin"
 )
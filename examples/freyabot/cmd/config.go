@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/gregseb/chatlib"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// secretKey matches the config keys whose values are left out of dumps.
+var secretKey = regexp.MustCompile(`(?i)password|passphrase|secret|token`)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration",
+}
+
+var configDumpCmd = &cobra.Command{
+	Use:   "dump",
+	Short: "Print the configuration as JSON",
+	Long: `Print the configuration as JSON, from the config file, environment and
+defaults. Passwords, secrets and tokens are redacted.
+
+With --effective, print the chat settings that can be overridden per network
+and channel, as resolved for the bot as a whole and for every network and
+channel that overrides them. Settings are resolved from the chat section, then
+chat.networks.<network>, then chat.channels.<channel>, then
+chat.networks.<network>.channels.<channel>.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var out any = redactSecrets(viper.AllSettings())
+		if effective, _ := cmd.Flags().GetBool("effective"); effective {
+			settings, err := chatlib.EffectiveSettings()
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to resolve settings")
+			}
+			out = settings
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(out); err != nil {
+			log.Fatal().Err(err).Msg("failed to print config")
+		}
+	},
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the configuration for unknown keys and values of the wrong type",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := loadPlugins(); err != nil {
+			log.Fatal().Err(err).Msg("failed to load plugins")
+		}
+		if err := chatlib.ValidateConfig(configFlags(), configPrefixes); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("config is valid")
+	},
+}
+
+// configFlags returns the flags the config is checked against: those of
+// start and the global ones.
+func configFlags() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("config", pflag.ContinueOnError)
+	flags.AddFlagSet(startCmd.Flags())
+	flags.AddFlagSet(rootCmd.PersistentFlags())
+	return flags
+}
+
+func redactSecrets(settings map[string]any) map[string]any {
+	for k, v := range settings {
+		switch v := v.(type) {
+		case map[string]any:
+			settings[k] = redactSecrets(v)
+		default:
+			if secretKey.MatchString(k) && v != "" {
+				settings[k] = "<redacted>"
+			}
+		}
+	}
+	return settings
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configDumpCmd)
+	configCmd.AddCommand(configValidateCmd)
+	// Effective
+	configDumpCmd.Flags().Bool("effective", false, "Print the chat settings resolved per network and channel")
+}
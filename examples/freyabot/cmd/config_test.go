@@ -0,0 +1,21 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/gregseb/chatlib"
+	"github.com/spf13/viper"
+)
+
+// TestExampleConfig checks the shipped example config against the flags of
+// every module built in.
+func TestExampleConfig(t *testing.T) {
+	defer viper.Reset()
+	viper.SetConfigFile("../example.config.yaml")
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := chatlib.ValidateConfig(configFlags(), configPrefixes); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/gregseb/chatlib"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var docsCmd = &cobra.Command{
+	Use:   "docs",
+	Short: "Generate documentation",
+}
+
+var docsConfigCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Print a reference of every config key",
+	Long: `Print a reference of every config key of the chat settings and of the
+modules compiled in, or loaded as plugins, with its type, default and
+description. It is generated from the flags the config is read from, so it
+is always up to date.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := loadPlugins(); err != nil {
+			log.Fatal().Err(err).Msg("failed to load plugins")
+		}
+		// Modules of plugins register after the flags are set up
+		prefixes := append([]string{}, configPrefixes...)
+		for _, m := range chatlib.Modules() {
+			if !slices.Contains(prefixes, m.Name) {
+				prefixes = append(prefixes, m.Name)
+			}
+		}
+		sections := chatlib.ConfigReference(configFlags(), prefixes)
+		switch format, _ := cmd.Flags().GetString("format"); format {
+		case "markdown":
+			if err := chatlib.WriteConfigMarkdown(os.Stdout, sections); err != nil {
+				log.Fatal().Err(err).Msg("failed to print config reference")
+			}
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.SetEscapeHTML(false)
+			if err := enc.Encode(sections); err != nil {
+				log.Fatal().Err(err).Msg("failed to print config reference")
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "unknown format %s, expected markdown or json\n", format)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(docsCmd)
+	docsCmd.AddCommand(docsConfigCmd)
+	// Format
+	docsConfigCmd.Flags().String("format", "markdown", "Format of the reference, one of: markdown, json")
+}
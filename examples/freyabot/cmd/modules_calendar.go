@@ -0,0 +1,5 @@
+//go:build !no_calendar
+
+package cmd
+
+import _ "github.com/gregseb/chatlib/calendar"
@@ -0,0 +1,5 @@
+//go:build !no_history
+
+package cmd
+
+import _ "github.com/gregseb/chatlib/history"
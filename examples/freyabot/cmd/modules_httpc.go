@@ -0,0 +1,5 @@
+//go:build !no_httpc
+
+package cmd
+
+import _ "github.com/gregseb/chatlib/httpc"
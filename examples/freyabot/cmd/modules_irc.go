@@ -0,0 +1,7 @@
+//go:build !no_irc
+
+package cmd
+
+// Modules are compiled in with blank imports so they can register themselves
+// with chatlib. Build with -tags no_irc to leave IRC out.
+import _ "github.com/gregseb/chatlib/irc"
@@ -0,0 +1,5 @@
+//go:build !no_karma
+
+package cmd
+
+import _ "github.com/gregseb/chatlib/karma"
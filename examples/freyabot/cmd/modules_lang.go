@@ -0,0 +1,5 @@
+//go:build !no_lang
+
+package cmd
+
+import _ "github.com/gregseb/chatlib/lang"
@@ -0,0 +1,5 @@
+//go:build !no_postgres
+
+package cmd
+
+import _ "github.com/gregseb/chatlib/pgstore"
@@ -0,0 +1,5 @@
+//go:build !no_remind
+
+package cmd
+
+import _ "github.com/gregseb/chatlib/remind"
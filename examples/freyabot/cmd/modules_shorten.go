@@ -0,0 +1,5 @@
+//go:build !no_shorten
+
+package cmd
+
+import _ "github.com/gregseb/chatlib/shorten"
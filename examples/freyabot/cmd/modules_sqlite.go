@@ -0,0 +1,5 @@
+//go:build !no_sqlite
+
+package cmd
+
+import _ "github.com/gregseb/chatlib/sqlstore"
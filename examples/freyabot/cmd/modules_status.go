@@ -0,0 +1,5 @@
+//go:build !no_status
+
+package cmd
+
+import _ "github.com/gregseb/chatlib/status"
@@ -0,0 +1,5 @@
+//go:build !no_toxicity
+
+package cmd
+
+import _ "github.com/gregseb/chatlib/toxicity"
@@ -0,0 +1,5 @@
+//go:build !no_webhook
+
+package cmd
+
+import _ "github.com/gregseb/chatlib/webhook"
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gregseb/chatlib"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// multiCmd runs several bots in one process
+var multiCmd = &cobra.Command{
+	Use:   "multi [name=]config.yaml...",
+	Short: "Run several bots, each with its own config, in one process",
+	Long: `Run several independent bots in one process, each configured from its own
+config file like start would be, e.g. for different networks. Profiles are
+named after their config file, or the name given before "=".
+
+A profile that restarts is rebuilt from its config file while the others keep
+running. With --control-socket, one socket runs the lifecycle commands of
+every profile:
+
+  status                   list the profiles and their state
+  <profile> start          start a stopped profile
+  <profile> restart        restart a profile
+  <profile> shutdown       stop a profile
+  <profile> events [1h]    show a profile's recent events
+
+Flags of start don't apply; set everything in the config files. Settings of
+modules shared by the whole process, such as http, are those of the last
+profile built. Log mirrors aren't supported.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		socket, _ := cmd.Flags().GetString("control-socket")
+		opts := make([]chatlib.GroupOption, 0)
+		if socket != "" {
+			opts = append(opts, chatlib.WithGroupControlSocket(socket))
+		}
+		group, err := chatlib.NewGroup(opts...)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create group")
+		}
+		for _, arg := range args {
+			name, path, ok := strings.Cut(arg, "=")
+			if !ok {
+				path = arg
+				name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+			}
+			if err := group.Add(name, buildProfile(name, path)); err != nil {
+				log.Fatal().Err(err).Msgf("failed to add profile %s", name)
+			}
+		}
+		if err := group.Start(context.Background()); err != nil {
+			log.Fatal().Err(err).Msg("failed to start profiles")
+		}
+		os.Exit(chatlib.ExitCodeShutdown)
+	},
+}
+
+// buildProfile returns a chatlib.ProfileFunc building a bot from the config
+// file at path, as start does.
+func buildProfile(name, path string) chatlib.ProfileFunc {
+	return func() (*chatlib.Handler, error) {
+		viper.SetConfigFile(path)
+		if err := viper.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("failed to read config %s: %w", path, err)
+		}
+		if err := loadPlugins(); err != nil {
+			return nil, err
+		}
+		if err := chatlib.ValidateConfig(configFlags(), configPrefixes); err != nil {
+			return nil, err
+		}
+		if len(viper.GetStringSlice(chatlib.ConfigName+".log-mirror-targets")) > 0 {
+			log.Warn().Str("profile", name).Msg("log mirrors aren't supported by multi, ignoring log-mirror-targets")
+		}
+		chatOpts, err := chatOptions()
+		if err != nil {
+			return nil, err
+		}
+		log.Info().Str("profile", name).Msgf("built profile from %s", path)
+		return chatlib.New(chatOpts...)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(multiCmd)
+	// ControlSocket
+	multiCmd.Flags().String("control-socket", "", "Path to a unix socket accepting the lifecycle commands of every profile. Disabled if empty")
+}
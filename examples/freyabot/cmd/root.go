@@ -5,6 +5,7 @@ package cmd
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"regexp"
 	"strings"
@@ -20,6 +21,14 @@ const cmdName = "freyabot"
 
 var cfgFile string
 
+// configPrefixes are the config sections set by flags, checked by
+// chatlib.ValidateConfig.
+var configPrefixes = []string{"log"}
+
+// logOutput is where logs are written, kept so other writers can be added
+// to the logger later.
+var logOutput io.Writer = os.Stderr
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "freyabot",
@@ -105,7 +114,8 @@ func initLogging() {
 	}
 	// Check if we should pretty print logs
 	if viper.GetBool("log.pretty") {
-		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+		logOutput = zerolog.ConsoleWriter{Out: os.Stderr}
+		log.Logger = log.Output(logOutput)
 	}
 	log.Info().Msg("Log level set to " + strings.ToUpper(viper.GetString("log.level")))
 	if viper.GetBool("log.pretty") {
@@ -5,9 +5,11 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+	"os"
 
 	"github.com/gregseb/chatlib"
-	"github.com/gregseb/chatlib/irc"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -25,25 +27,84 @@ This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		c := context.Background()
-		chatOpts := make([]chatlib.Option, 0)
-		if co, err := irc.Init(); err != nil {
-			log.Fatal().Err(err).Msg("failed to initialize IRC")
-		} else if co != nil {
-			chatOpts = append(chatOpts, *co)
+		if err := loadPlugins(); err != nil {
+			log.Fatal().Err(err).Msg("failed to load plugins")
+		}
+		if err := chatlib.ValidateConfig(cmd.Flags(), configPrefixes); err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		chatOpts, err := chatOptions()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to initialize chat")
+		}
+		if mirror, err := chatlib.InitLogMirror(); err != nil {
+			log.Fatal().Err(err).Msg("failed to initialize log mirror")
+		} else if mirror != nil {
+			log.Logger = log.Output(zerolog.MultiLevelWriter(logOutput, mirror))
+			chatOpts = append(chatOpts, chatlib.WithLogMirror(mirror))
 		}
 		chat, err := chatlib.New(chatOpts...)
 		if err != nil {
 			log.Fatal().Err(err).Msg("failed to initialize chat")
 		}
 
-		chat.Start(c)
+		if err := chat.Start(c); err != nil {
+			log.Fatal().Err(err).Msg("failed to start chat")
+		}
+		os.Exit(chat.ExitCode())
 	},
 }
 
+// loadedPlugins are the plugins loaded so far, by path.
+var loadedPlugins = make(map[string]bool)
+
+// loadPlugins loads the plugins in the config that aren't loaded yet.
+func loadPlugins() error {
+	for _, path := range viper.GetStringSlice(chatlib.ConfigName + ".plugins") {
+		if loadedPlugins[path] {
+			continue
+		}
+		if _, err := chatlib.LoadPlugin(path); err != nil {
+			return fmt.Errorf("plugin %s: %w", path, err)
+		}
+		loadedPlugins[path] = true
+	}
+	return nil
+}
+
+// chatOptions initializes chat and the modules from the config.
+func chatOptions() ([]chatlib.Option, error) {
+	chatOpts := make([]chatlib.Option, 0)
+	if co, err := chatlib.Init(); err != nil {
+		return nil, err
+	} else if co != nil {
+		chatOpts = append(chatOpts, *co)
+	}
+	for _, m := range chatlib.Modules() {
+		if co, err := m.Init(); err != nil {
+			return nil, fmt.Errorf("failed to initialize %s: %w", m.Name, err)
+		} else if co != nil {
+			chatOpts = append(chatOpts, chatlib.WithModule(m.Name, *co))
+		}
+	}
+	return chatOpts, nil
+}
+
 func init() {
 	rootCmd.AddCommand(startCmd)
-	irc.Flags(startCmd)
-	bindAllFlags(startCmd, false, []string{irc.ApiName})
+	chatlib.Flags(startCmd)
+	// DryRun
+	startCmd.Flags().Bool("dry-run", false, "Log and journal what the bot would say instead of saying it, to try plugins against live traffic")
+	viper.BindPFlag(chatlib.ConfigName+".dry-run", startCmd.Flags().Lookup("dry-run"))
+	prefixes := []string{chatlib.ConfigName}
+	for _, m := range chatlib.Modules() {
+		if m.Flags != nil {
+			m.Flags(startCmd)
+		}
+		prefixes = append(prefixes, m.Name)
+	}
+	bindAllFlags(startCmd, false, prefixes)
+	configPrefixes = append(configPrefixes, prefixes...)
 	viper.SetEnvPrefix(cmdName)
 	viper.AutomaticEnv()
 }
@@ -0,0 +1,161 @@
+package chatlib
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultFloorHold is how long a game may hold a channel's floor if it
+// doesn't say.
+const DefaultFloorHold = 15 * time.Minute
+
+// floorClaim is a game's claim on a channel's floor, waiting or holding it.
+type floorClaim struct {
+	game   string
+	hold   time.Duration
+	start  func(c context.Context)
+	parent context.Context
+	// cancel ends the game, it is set once the claim holds the floor
+	cancel context.CancelFunc
+}
+
+// floors arbitrates between the games of a Handler. Each channel has a queue
+// of claims, the first of which holds the floor once started.
+type floors struct {
+	mu     sync.Mutex
+	queues map[scope][]*floorClaim
+}
+
+// ClaimFloor claims the floor of a channel on the API named api for game,
+// so only one game runs in a channel at a time. If the floor is free, start
+// is called at once, otherwise the claim waits its turn and start is called
+// when the games before it are done. start runs in the background with a
+// context that is cancelled once the claim is released, which happens when
+// start returns, when release is called, when the claim has held the floor
+// for hold, or when an admin releases it with !floor release. Games should
+// stop when it is. ClaimFloor returns how many claims are before this one,
+// 0 if it started.
+func (h *Handler) ClaimFloor(c context.Context, api, channel, game string, hold time.Duration, start func(c context.Context)) (position int, release func()) {
+	if hold <= 0 {
+		hold = DefaultFloorHold
+	}
+	s := scope{strings.ToLower(api), strings.ToLower(channel)}
+	claim := &floorClaim{game: game, hold: hold, start: start, parent: c}
+	h.floors.mu.Lock()
+	if h.floors.queues == nil {
+		h.floors.queues = make(map[scope][]*floorClaim)
+	}
+	h.floors.queues[s] = append(h.floors.queues[s], claim)
+	position = len(h.floors.queues[s]) - 1
+	if position == 0 {
+		h.startFloor(s, claim)
+	} else {
+		log.Debug().Str("api", api).Str("channel", channel).Str("game", game).Msgf("waiting for the floor, %d before", position)
+	}
+	h.floors.mu.Unlock()
+	return position, func() { h.releaseFloor(s, claim) }
+}
+
+// FloorHolder returns the game holding the floor of a channel on the API
+// named api, if any, and the games waiting for it in turn.
+func (h *Handler) FloorHolder(api, channel string) (holder string, waiting []string) {
+	s := scope{strings.ToLower(api), strings.ToLower(channel)}
+	h.floors.mu.Lock()
+	defer h.floors.mu.Unlock()
+	q := h.floors.queues[s]
+	if len(q) == 0 {
+		return "", nil
+	}
+	waiting = make([]string, 0, len(q)-1)
+	for _, claim := range q[1:] {
+		waiting = append(waiting, claim.game)
+	}
+	return q[0].game, waiting
+}
+
+// startFloor gives the floor to claim, releasing it when the game is done or
+// its hold runs out. floors.mu must be held.
+func (h *Handler) startFloor(s scope, claim *floorClaim) {
+	c, cancel := context.WithTimeout(claim.parent, claim.hold)
+	claim.cancel = cancel
+	context.AfterFunc(c, func() { h.releaseFloor(s, claim) })
+	log.Debug().Str("api", s.network).Str("channel", s.channel).Str("game", claim.game).Msg("game has the floor")
+	go func() {
+		defer cancel()
+		claim.start(c)
+	}()
+}
+
+// releaseFloor ends or withdraws claim, and gives the floor to the next
+// claim waiting if claim held it.
+func (h *Handler) releaseFloor(s scope, claim *floorClaim) {
+	h.floors.mu.Lock()
+	defer h.floors.mu.Unlock()
+	q := h.floors.queues[s]
+	i := 0
+	for i < len(q) && q[i] != claim {
+		i++
+	}
+	if i == len(q) {
+		return
+	}
+	q = append(q[:i], q[i+1:]...)
+	if len(q) == 0 {
+		delete(h.floors.queues, s)
+	} else {
+		h.floors.queues[s] = q
+	}
+	if i > 0 {
+		return
+	}
+	claim.cancel()
+	log.Debug().Str("api", s.network).Str("channel", s.channel).Str("game", claim.game).Msg("game released the floor")
+	if len(q) > 0 {
+		h.startFloor(s, q[0])
+	}
+}
+
+// WithFloorActions adds the !floor action, which tells which game holds the
+// floor of the channel and which are waiting, and !floor release, with which
+// admins end the game holding it.
+func WithFloorActions() Option {
+	return func(h *Handler) error {
+		return h.ApplyOptions(
+			RegisterCommand("floor", "", "!floor", "tell which game is running in the channel", h.actionFloor),
+			RegisterCommand("floor", "release", "!floor release", "end the game running in the channel", h.actionFloorRelease, RoleAdmin),
+		)
+	}
+}
+
+func (h *Handler) actionFloor(c context.Context, re *regexp.Regexp, msg *Message) error {
+	holder, waiting := h.FloorHolder(msg.API, msg.Channel())
+	if holder == "" {
+		return h.Reply(c, msg, "no game is running")
+	}
+	text := holder + " is running"
+	if len(waiting) > 0 {
+		text += ", then " + strings.Join(waiting, ", ")
+	}
+	return h.Reply(c, msg, text)
+}
+
+func (h *Handler) actionFloorRelease(c context.Context, re *regexp.Regexp, msg *Message) error {
+	s := scope{strings.ToLower(msg.API), strings.ToLower(msg.Channel())}
+	h.floors.mu.Lock()
+	var holder *floorClaim
+	if q := h.floors.queues[s]; len(q) > 0 {
+		holder = q[0]
+	}
+	h.floors.mu.Unlock()
+	if holder == nil {
+		return h.Reply(c, msg, "no game is running")
+	}
+	log.Info().Str("api", msg.API).Str("channel", msg.Channel()).Str("game", holder.game).Str("nick", msg.Nick).Msg("floor released by admin")
+	h.releaseFloor(s, holder)
+	return h.Reply(c, msg, "ended "+holder.game)
+}
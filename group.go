@@ -0,0 +1,283 @@
+package chatlib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Profile states reported by Group.Status.
+const (
+	ProfileStarting = "starting"
+	ProfileRunning  = "running"
+	ProfileStopped  = "stopped"
+	ProfileFailed   = "failed"
+)
+
+// configMu serializes reading the global viper config, which bots of a
+// Group load their own config files into in turn.
+var configMu sync.Mutex
+
+// ProfileFunc builds the Handler of a profile, e.g. from its config file. It
+// is called again each time the profile restarts. Calls are serialized with
+// each other and with config reloads, so the function may load the
+// profile's config into the global viper config and initialize modules from
+// it.
+type ProfileFunc func() (*Handler, error)
+
+// ProfileStatus describes a profile of a Group.
+type ProfileStatus struct {
+	Name     string
+	State    string
+	Since    time.Time
+	Restarts int
+	// Err is why the profile failed.
+	Err error
+}
+
+type profile struct {
+	name     string
+	build    ProfileFunc
+	h        *Handler
+	state    string
+	since    time.Time
+	restarts int
+	err      error
+}
+
+// Group runs several independent bots, each with its own Handler, in one
+// process. A bot that restarts is rebuilt in place, and the others keep
+// running. A single control socket can run the lifecycle commands of each.
+type Group struct {
+	mu            sync.Mutex
+	profiles      []*profile
+	controlSocket string
+	wg            sync.WaitGroup
+	c             context.Context
+}
+
+// GroupOption configures a Group.
+type GroupOption func(*Group) error
+
+// WithGroupControlSocket listens on a unix socket at path for the commands
+// "status", listing the profiles, and "<profile> <command>", where command
+// is "start" for a stopped profile or one of the commands of a Handler's
+// own control socket, e.g. "freya restart".
+func WithGroupControlSocket(path string) GroupOption {
+	return func(g *Group) error {
+		g.controlSocket = path
+		return nil
+	}
+}
+
+func NewGroup(opts ...GroupOption) (*Group, error) {
+	g := &Group{}
+	for _, opt := range opts {
+		if err := opt(g); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// Add adds a profile named name, built by build when the Group starts.
+func (g *Group) Add(name string, build ProfileFunc) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if name == "" || name == "status" || strings.ContainsAny(name, " \t\n") {
+		return errors.Wrapf(ErrInvalidConfig, "invalid profile name %q", name)
+	}
+	for _, p := range g.profiles {
+		if p.name == name {
+			return errors.Wrapf(ErrInvalidConfig, "profile added twice: %s", name)
+		}
+	}
+	g.profiles = append(g.profiles, &profile{name: name, build: build, state: ProfileStopped, since: time.Now()})
+	return nil
+}
+
+// Start builds every profile, failing if any can't be built, then runs them
+// until each has shut down or the context is cancelled.
+func (g *Group) Start(c context.Context) error {
+	if len(g.profiles) == 0 {
+		return errors.WithMessage(ErrInvalidConfig, "no profile configured")
+	}
+	g.c = c
+	handlers := make([]*Handler, len(g.profiles))
+	for i, p := range g.profiles {
+		h, err := g.build(p)
+		if err != nil {
+			return errors.WithMessagef(err, "profile %s", p.name)
+		}
+		handlers[i] = h
+	}
+	if g.controlSocket != "" {
+		if err := serveControl(c, g.controlSocket, g.handleControl); err != nil {
+			return err
+		}
+	}
+	for i, p := range g.profiles {
+		g.run(p, handlers[i])
+	}
+	g.wg.Wait()
+	return nil
+}
+
+// build builds p's Handler with the config locked.
+func (g *Group) build(p *profile) (*Handler, error) {
+	g.setState(p, ProfileStarting, nil)
+	configMu.Lock()
+	h, err := p.build()
+	configMu.Unlock()
+	if err != nil {
+		g.setState(p, ProfileFailed, err)
+		return nil, err
+	}
+	return h, nil
+}
+
+// run runs p in the background, starting with h, and rebuilds it each time
+// it shuts down to restart.
+func (g *Group) run(p *profile, h *Handler) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		for {
+			g.mu.Lock()
+			p.h = h
+			g.mu.Unlock()
+			g.setState(p, ProfileRunning, nil)
+			if err := h.Start(g.c); err != nil {
+				log.Error().Str("profile", p.name).Err(err).Msg("profile failed")
+				g.setState(p, ProfileFailed, err)
+				return
+			}
+			if h.ExitCode() != ExitCodeRestart || g.c.Err() != nil {
+				log.Info().Str("profile", p.name).Msg("profile stopped")
+				g.setState(p, ProfileStopped, nil)
+				return
+			}
+			log.Info().Str("profile", p.name).Msg("restarting profile")
+			g.mu.Lock()
+			p.restarts++
+			g.mu.Unlock()
+			var err error
+			if h, err = g.build(p); err != nil {
+				log.Error().Str("profile", p.name).Err(err).Msg("failed to rebuild profile")
+				return
+			}
+		}
+	}()
+}
+
+func (g *Group) setState(p *profile, state string, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	p.state, p.since, p.err = state, time.Now(), err
+}
+
+// Status returns the state of every profile, in the order they were added.
+func (g *Group) Status() []ProfileStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	status := make([]ProfileStatus, 0, len(g.profiles))
+	for _, p := range g.profiles {
+		status = append(status, ProfileStatus{Name: p.name, State: p.state, Since: p.since, Restarts: p.restarts, Err: p.err})
+	}
+	return status
+}
+
+// Handler returns the current Handler of the named profile, or nil if there
+// is no such profile or it hasn't been built.
+func (g *Group) Handler(name string) *Handler {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if p := g.profile(name); p != nil {
+		return p.h
+	}
+	return nil
+}
+
+func (g *Group) profile(name string) *profile {
+	for _, p := range g.profiles {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Shutdown shuts down every running profile. Start returns once they have.
+func (g *Group) Shutdown(c context.Context, code int) error {
+	var err error
+	for _, s := range g.Status() {
+		if h := g.Handler(s.Name); h != nil && s.State == ProfileRunning {
+			if e := h.Shutdown(c, code); e != nil && err == nil {
+				err = errors.WithMessagef(e, "profile %s", s.Name)
+			}
+		}
+	}
+	return err
+}
+
+func (g *Group) handleControl(c context.Context, conn net.Conn) {
+	defer conn.Close()
+	if fields := readControl(conn); len(fields) > 0 {
+		g.control(c, conn, fields)
+	}
+}
+
+// control runs a group command, writing its output to w.
+func (g *Group) control(c context.Context, w io.Writer, fields []string) {
+	if fields[0] == "status" {
+		for _, s := range g.Status() {
+			line := fmt.Sprintf("%s %s since %s, %d restarts", s.Name, s.State, s.Since.Format(time.RFC3339), s.Restarts)
+			if s.Err != nil {
+				line += ": " + s.Err.Error()
+			}
+			fmt.Fprintln(w, line)
+		}
+		return
+	}
+	g.mu.Lock()
+	p := g.profile(fields[0])
+	var state string
+	var h *Handler
+	if p != nil {
+		state, h = p.state, p.h
+		// Claim the profile so it isn't started twice
+		if len(fields) > 1 && fields[1] == "start" && (state == ProfileStopped || state == ProfileFailed) {
+			p.state = ProfileStarting
+		}
+	}
+	g.mu.Unlock()
+	switch {
+	case p == nil:
+		fmt.Fprintf(w, "error: unknown profile: %s\n", fields[0])
+	case len(fields) < 2:
+		fmt.Fprintf(w, "error: no command for profile %s\n", p.name)
+	case fields[1] == "start":
+		if state != ProfileStopped && state != ProfileFailed {
+			fmt.Fprintf(w, "error: profile %s is %s\n", p.name, state)
+			return
+		}
+		h, err := g.build(p)
+		if err != nil {
+			fmt.Fprintf(w, "error: %s\n", err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+		g.run(p, h)
+	case state != ProfileRunning:
+		fmt.Fprintf(w, "error: profile %s is %s\n", p.name, state)
+	default:
+		h.control(c, w, fields[1:])
+	}
+}
@@ -0,0 +1,70 @@
+package chatlib
+
+import (
+	"slices"
+	"time"
+)
+
+// Readier is implemented by APIs that know whether they are connected and
+// ready for messages, e.g. registered and in their channels.
+type Readier interface {
+	Ready() bool
+}
+
+// Status is a snapshot of how the Handler is doing, for status pages and
+// health checks.
+type Status struct {
+	// Started is when the Handler started, zero until it did.
+	Started time.Time `json:"started"`
+	// Uptime is how many seconds the Handler has been running.
+	Uptime   int64           `json:"uptime"`
+	Networks []NetworkStatus `json:"networks"`
+	Modules  []ModuleStatus  `json:"modules"`
+}
+
+// NetworkStatus is how the connection to a network is doing. APIs that
+// aren't Readiers are ready once started.
+type NetworkStatus struct {
+	Name  string `json:"name"`
+	Ready bool   `json:"ready"`
+}
+
+// ModuleStatus is how a module is doing. Modules are healthy unless some of
+// their actions were disabled for going over budget.
+type ModuleStatus struct {
+	Name            string   `json:"name"`
+	Healthy         bool     `json:"healthy"`
+	DisabledActions []string `json:"disabled-actions,omitempty"`
+}
+
+// Status returns how the Handler, its networks and its modules are doing.
+func (h *Handler) Status() Status {
+	h.mu.RLock()
+	started := h.started
+	h.mu.RUnlock()
+	s := Status{Started: started, Networks: make([]NetworkStatus, 0, len(h.apis)), Modules: make([]ModuleStatus, 0, len(h.moduleNames))}
+	if !started.IsZero() {
+		s.Uptime = int64(time.Since(started) / time.Second)
+	}
+	for _, na := range h.apis {
+		ready := !started.IsZero()
+		if r, ok := na.api.(Readier); ok {
+			ready = r.Ready()
+		}
+		s.Networks = append(s.Networks, NetworkStatus{Name: na.name, Ready: ready})
+	}
+	disabled := make(map[string][]string)
+	if h.budgets != nil {
+		h.budgets.mu.Lock()
+		for action := range h.budgets.disabled {
+			disabled[action.module] = append(disabled[action.module], actionName(action))
+		}
+		h.budgets.mu.Unlock()
+	}
+	for _, name := range h.moduleNames {
+		actions := disabled[name]
+		slices.Sort(actions)
+		s.Modules = append(s.Modules, ModuleStatus{Name: name, Healthy: len(actions) == 0, DisabledActions: actions})
+	}
+	return s
+}
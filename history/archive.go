@@ -0,0 +1,112 @@
+package history
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const DefaultArchiveInterval = time.Hour
+
+// Uploader stores an object. meta is stored alongside it, for example as
+// lifecycle tags that storage rules can act on.
+type Uploader interface {
+	Upload(c context.Context, key string, body []byte, meta map[string]string) error
+}
+
+// Archiver ships the rotated files of a Log to an Uploader, compressed, and
+// removes them locally once they are stored.
+type Archiver struct {
+	log      *Log
+	uploader Uploader
+	prefix   string
+	interval time.Duration
+	meta     map[string]string
+}
+
+// NewArchiver returns an Archiver uploading to keys under prefix every
+// interval. meta is added to every archive's metadata.
+func NewArchiver(l *Log, u Uploader, prefix string, interval time.Duration, meta map[string]string) *Archiver {
+	return &Archiver{
+		log:      l,
+		uploader: u,
+		prefix:   prefix,
+		interval: interval,
+		meta:     meta,
+	}
+}
+
+// Run archives on startup and then every interval until the context is
+// cancelled. Failed archives are kept and retried next time.
+func (a *Archiver) Run(c context.Context) error {
+	t := time.NewTicker(a.interval)
+	defer t.Stop()
+	for {
+		if err := a.Archive(c); err != nil {
+			log.Error().Str("module", ModuleName).Err(err).Msg("error archiving history")
+		}
+		select {
+		case <-c.Done():
+			return c.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Archive uploads every rotated file, stopping at the first failure.
+func (a *Archiver) Archive(c context.Context) error {
+	paths, err := a.log.Rotated()
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := a.archiveFile(c, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Archiver) archiveFile(c context.Context, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return errors.Wrapf(err, "history: failed to open %s", p)
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Name = filepath.Base(p)
+	n, err := io.Copy(gz, f)
+	if err != nil {
+		return errors.Wrapf(err, "history: failed to compress %s", p)
+	}
+	if err := gz.Close(); err != nil {
+		return errors.Wrapf(err, "history: failed to compress %s", p)
+	}
+	day := strings.TrimSuffix(filepath.Base(p), fileExt)
+	meta := map[string]string{
+		"chatlib-day":        day,
+		"chatlib-size":       strconv.FormatInt(n, 10),
+		"chatlib-archivedat": time.Now().UTC().Format(time.RFC3339),
+	}
+	for k, v := range a.meta {
+		meta[k] = v
+	}
+	key := path.Join(a.prefix, day[:4], day+fileExt+".gz")
+	if err := a.uploader.Upload(c, key, buf.Bytes(), meta); err != nil {
+		return errors.Wrapf(err, "history: failed to upload %s", key)
+	}
+	log.Info().Str("module", ModuleName).Msgf("archived %s to %s", p, key)
+	f.Close()
+	return os.Remove(p)
+}
@@ -0,0 +1,103 @@
+package history
+
+import (
+	"strings"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const ModuleName = "history"
+
+func init() {
+	chatlib.RegisterModule(chatlib.Module{
+		Name:  ModuleName,
+		Flags: Flags,
+		Init:  Init,
+	})
+}
+
+func Init() (*chatlib.Option, error) {
+	dir := viper.GetString(ModuleName + ".dir")
+	if dir == "" {
+		log.Info().Msg("history disabled")
+		return nil, nil
+	}
+	l, err := NewLog(dir)
+	if err != nil {
+		return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "%s", err)
+	}
+	log.Info().Str("module", ModuleName).Msgf("logging history to: %s", dir)
+	opt := chatlib.WithMiddleware(l.Middleware)
+	if bucket := viper.GetString(ModuleName + ".s3-bucket"); bucket != "" {
+		tags, err := parseTags(viper.GetStringSlice(ModuleName + ".s3-tags"))
+		if err != nil {
+			return nil, err
+		}
+		u := &S3Uploader{
+			Endpoint:     viper.GetString(ModuleName + ".s3-endpoint"),
+			Region:       viper.GetString(ModuleName + ".s3-region"),
+			Bucket:       bucket,
+			AccessKey:    viper.GetString(ModuleName + ".s3-access-key"),
+			SecretKey:    viper.GetString(ModuleName + ".s3-secret-key"),
+			PathStyle:    viper.GetBool(ModuleName + ".s3-path-style"),
+			StorageClass: viper.GetString(ModuleName + ".s3-storage-class"),
+			Tags:         tags,
+		}
+		if u.AccessKey == "" || u.SecretKey == "" {
+			return nil, errors.WithMessage(chatlib.ErrInvalidConfig, "history: s3 archival requires s3-access-key and s3-secret-key")
+		}
+		if _, err := u.objectURL(""); err != nil {
+			return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "%s", err)
+		}
+		interval := viper.GetDuration(ModuleName + ".archive-interval")
+		if interval <= 0 {
+			return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "history: invalid archive interval: %s", interval)
+		}
+		a := NewArchiver(l, u, viper.GetString(ModuleName+".s3-prefix"), interval, nil)
+		log.Info().Str("module", ModuleName).Msgf("archiving history to s3 bucket %s every %s", bucket, interval)
+		opt = chatlib.CombineOptions(opt, chatlib.WithTask("history-archive", a.Run))
+	}
+	return &opt, nil
+}
+
+// parseTags parses key=value pairs.
+func parseTags(pairs []string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, pair := range pairs {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "history: invalid s3 tag, expected key=value: %s", pair)
+		}
+		tags[k] = v
+	}
+	return tags, nil
+}
+
+func Flags(cmd *cobra.Command) {
+	// Dir
+	cmd.Flags().String(ModuleName+"-dir", "", "Directory to log messages to, one file a day. History is disabled if empty")
+	// ArchiveInterval
+	cmd.Flags().Duration(ModuleName+"-archive-interval", DefaultArchiveInterval, "How often finished days are archived to S3")
+	// S3Endpoint
+	cmd.Flags().String(ModuleName+"-s3-endpoint", "https://s3.amazonaws.com", "S3 or S3 compatible endpoint to archive history to")
+	// S3Region
+	cmd.Flags().String(ModuleName+"-s3-region", "us-east-1", "S3 region")
+	// S3Bucket
+	cmd.Flags().String(ModuleName+"-s3-bucket", "", "S3 bucket to archive history to. Archival is disabled if empty")
+	// S3Prefix
+	cmd.Flags().String(ModuleName+"-s3-prefix", "history", "Key prefix for archives. Archives are stored as <prefix>/<year>/<day>.jsonl.gz")
+	// S3AccessKey
+	cmd.Flags().String(ModuleName+"-s3-access-key", "", "S3 access key")
+	// S3SecretKey
+	cmd.Flags().String(ModuleName+"-s3-secret-key", "", "S3 secret key")
+	// S3PathStyle
+	cmd.Flags().Bool(ModuleName+"-s3-path-style", false, "Put the bucket in the URL path rather than the host name, as most S3 compatible services need")
+	// S3StorageClass
+	cmd.Flags().String(ModuleName+"-s3-storage-class", "", "Storage class for archives, e.g. STANDARD_IA. Defaults to the bucket's")
+	// S3Tags
+	cmd.Flags().StringSlice(ModuleName+"-s3-tags", []string{}, "key=value tags set on archives for bucket lifecycle rules")
+}
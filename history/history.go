@@ -0,0 +1,149 @@
+// Package history keeps a log of the messages the bot sees, one file of JSON
+// lines a day, and archives old days to object storage.
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+)
+
+// DayFormat names the daily files, e.g. 2023-11-05.jsonl.
+const DayFormat = "2006-01-02"
+
+const fileExt = ".jsonl"
+
+// Record is one logged message.
+type Record struct {
+	Time     time.Time `json:"time"`
+	API      string    `json:"api,omitempty"`
+	Command  string    `json:"command"`
+	Sender   string    `json:"sender"`
+	Nick     string    `json:"nick,omitempty"`
+	Receiver string    `json:"receiver"`
+	Text     string    `json:"text"`
+	// Self is set for the bot's own messages, as the server delivered them.
+	Self bool `json:"self,omitempty"`
+}
+
+// Log appends records to a file per day in a directory. Days are in UTC so
+// files rotate at the same time wherever the bot runs.
+type Log struct {
+	dir string
+	now func() time.Time
+
+	mu   sync.Mutex
+	day  string
+	file *os.File
+}
+
+// NewLog returns a Log writing to dir, which is created if needed.
+func NewLog(dir string) (*Log, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, errors.Wrapf(err, "history: failed to create directory: %s", dir)
+	}
+	return &Log{dir: dir, now: time.Now}, nil
+}
+
+// Append writes r to the file for the current day, rotating to a new file if
+// the day has changed.
+func (l *Log) Append(r Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	day := l.now().UTC().Format(DayFormat)
+	if day != l.day {
+		if err := l.closeFile(); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(filepath.Join(l.dir, day+fileExt), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+		if err != nil {
+			return errors.Wrap(err, "history: failed to open log")
+		}
+		l.file, l.day = f, day
+	}
+	_, err = l.file.Write(append(b, '\n'))
+	return err
+}
+
+// Middleware records messages sent by users.
+func (l *Log) Middleware(c context.Context, msg *chatlib.Message) error {
+	r, ok := NewRecord(msg, l.now())
+	if !ok {
+		return nil
+	}
+	return l.Append(r)
+}
+
+// NewRecord returns the record for msg and whether it belongs in the
+// history, which only keeps messages, notices and actions sent by users. now
+// is used if the server didn't say when the message was sent.
+func NewRecord(msg *chatlib.Message, now time.Time) (Record, bool) {
+	if msg.Nick == "" || (msg.Command != chatlib.CommandMessage && msg.Command != chatlib.CommandNotice && msg.Command != chatlib.CommandAction) {
+		return Record{}, false
+	}
+	t := msg.Time
+	if t.IsZero() {
+		t = now
+	}
+	return Record{
+		Time:     t.UTC(),
+		API:      msg.API,
+		Command:  msg.Command,
+		Sender:   msg.Sender,
+		Nick:     msg.Nick,
+		Receiver: msg.Receiver,
+		Text:     msg.Text,
+		Self:     msg.Self,
+	}, true
+}
+
+// Rotated returns the paths of the files for days before the current one,
+// oldest first. They are no longer written to.
+func (l *Log) Rotated() ([]string, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "history: failed to list logs")
+	}
+	today := l.now().UTC().Format(DayFormat)
+	paths := make([]string, 0)
+	for _, e := range entries {
+		day, ok := strings.CutSuffix(e.Name(), fileExt)
+		if !ok || e.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(DayFormat, day); err != nil || day >= today {
+			continue
+		}
+		paths = append(paths, filepath.Join(l.dir, e.Name()))
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Close closes the current file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closeFile()
+}
+
+func (l *Log) closeFile() error {
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file, l.day = nil, ""
+	return err
+}
@@ -0,0 +1,153 @@
+package history
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gregseb/chatlib/httpc"
+	"github.com/pkg/errors"
+)
+
+// S3Uploader uploads objects to S3 or a compatible service such as MinIO,
+// signing requests with AWS Signature Version 4.
+type S3Uploader struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle puts the bucket in the path rather than the host name. Most
+	// S3 compatible services need it.
+	PathStyle bool
+	// StorageClass, e.g. STANDARD_IA or GLACIER, is left to the bucket's
+	// default if empty.
+	StorageClass string
+	// Tags are set on every object so bucket lifecycle rules can expire or
+	// transition archives.
+	Tags map[string]string
+
+	client *http.Client
+	now    func() time.Time
+}
+
+var _ Uploader = (*S3Uploader)(nil)
+
+// Upload PUTs the object, with meta as x-amz-meta- headers.
+func (s *S3Uploader) Upload(c context.Context, key string, body []byte, meta map[string]string) error {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(c, http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	for k, v := range meta {
+		req.Header.Set("X-Amz-Meta-"+k, v)
+	}
+	if s.StorageClass != "" {
+		req.Header.Set("X-Amz-Storage-Class", s.StorageClass)
+	}
+	if len(s.Tags) > 0 {
+		tags := url.Values{}
+		for k, v := range s.Tags {
+			tags.Set(k, v)
+		}
+		req.Header.Set("X-Amz-Tagging", tags.Encode())
+	}
+	sum := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(sum[:]))
+	client := s.client
+	if client == nil {
+		client = httpc.Default()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("history: s3 upload failed: %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+func (s *S3Uploader) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "history: invalid s3 endpoint: %s", s.Endpoint)
+	}
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket + "/" + key
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	return u, nil
+}
+
+// sign adds the Signature Version 4 headers to req. Every header already set
+// on req is signed, along with the host.
+func (s *S3Uploader) sign(req *http.Request, payloadHash string) {
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	t := now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	crh := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crh[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
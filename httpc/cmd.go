@@ -0,0 +1,48 @@
+package httpc
+
+import (
+	"github.com/gregseb/chatlib"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const ModuleName = "http"
+
+func init() {
+	chatlib.RegisterModule(chatlib.Module{
+		Name:  ModuleName,
+		Flags: Flags,
+		Init:  Init,
+	})
+}
+
+// Init configures the Default client. It doesn't add anything to the Handler.
+func Init() (*chatlib.Option, error) {
+	opts := []Option{
+		WithTimeout(viper.GetFloat64(ModuleName + ".timeout")),
+		WithMaxConnsPerHost(viper.GetInt(ModuleName + ".max-conns-per-host")),
+		WithUserAgent(viper.GetString(ModuleName + ".user-agent")),
+	}
+	if viper.IsSet(ModuleName + ".proxy") {
+		opts = append(opts, WithProxy(viper.GetString(ModuleName+".proxy")))
+	}
+	// Validate the options now rather than on first use
+	if _, err := New(opts...); err != nil {
+		return nil, err
+	}
+	SetDefaultOptions(opts...)
+	log.Info().Str("module", ModuleName).Msgf("user agent: %s", viper.GetString(ModuleName+".user-agent"))
+	return nil, nil
+}
+
+func Flags(cmd *cobra.Command) {
+	// Timeout
+	cmd.Flags().Int(ModuleName+"-timeout", DefaultTimeoutSeconds, "Timeout in seconds for HTTP requests made by modules")
+	// Proxy
+	cmd.Flags().String(ModuleName+"-proxy", "", "Proxy URL for HTTP requests made by modules. Defaults to the HTTP_PROXY and HTTPS_PROXY environment variables")
+	// MaxConnsPerHost
+	cmd.Flags().Int(ModuleName+"-max-conns-per-host", DefaultMaxConnsPerHost, "Maximum concurrent HTTP connections to a single host")
+	// UserAgent
+	cmd.Flags().String(ModuleName+"-user-agent", DefaultUserAgent, "User agent for HTTP requests made by modules")
+}
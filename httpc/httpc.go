@@ -0,0 +1,266 @@
+// Package httpc builds http.Clients with the defaults integration modules
+// should share: timeouts, proxy support, per-host connection limits, a
+// user agent, optional address filtering and request metrics.
+package httpc
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultTimeoutSeconds  = 10
+	DefaultMaxConnsPerHost = 4
+	DefaultUserAgent       = "freyabot (+https://github.com/gregseb/chatlib)"
+)
+
+// AddressFilter decides whether a connection to ip may be made. It is checked
+// against the address actually dialed, after DNS resolution, so a hostname
+// can't be pointed somewhere else between the check and the connection.
+type AddressFilter func(ip net.IP) error
+
+type Option func(*config) error
+
+type config struct {
+	timeoutSeconds  float64
+	proxy           func(*http.Request) (*url.URL, error)
+	maxConnsPerHost int
+	userAgent       string
+	filter          AddressFilter
+	metrics         *Metrics
+}
+
+func WithTimeout(seconds float64) Option {
+	return func(cfg *config) error {
+		cfg.timeoutSeconds = seconds
+		return nil
+	}
+}
+
+// WithProxy sends requests through the proxy at rawURL. An empty URL disables
+// proxying. Without this option the proxy is taken from the environment.
+func WithProxy(rawURL string) Option {
+	return func(cfg *config) error {
+		if rawURL == "" {
+			cfg.proxy = nil
+			return nil
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return errors.Wrapf(err, "httpc: invalid proxy url: %s", rawURL)
+		}
+		cfg.proxy = http.ProxyURL(u)
+		return nil
+	}
+}
+
+func WithMaxConnsPerHost(n int) Option {
+	return func(cfg *config) error {
+		cfg.maxConnsPerHost = n
+		return nil
+	}
+}
+
+func WithUserAgent(ua string) Option {
+	return func(cfg *config) error {
+		cfg.userAgent = ua
+		return nil
+	}
+}
+
+// WithAddressFilter refuses connections to addresses rejected by filter.
+func WithAddressFilter(filter AddressFilter) Option {
+	return func(cfg *config) error {
+		cfg.filter = filter
+		return nil
+	}
+}
+
+// WithMetrics records requests made with the client in m.
+func WithMetrics(m *Metrics) Option {
+	return func(cfg *config) error {
+		cfg.metrics = m
+		return nil
+	}
+}
+
+// New returns an http.Client configured with the defaults and opts.
+func New(opts ...Option) (*http.Client, error) {
+	cfg := &config{
+		timeoutSeconds:  DefaultTimeoutSeconds,
+		proxy:           http.ProxyFromEnvironment,
+		maxConnsPerHost: DefaultMaxConnsPerHost,
+		userAgent:       DefaultUserAgent,
+	}
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+	timeout := time.Duration(float64(time.Second) * cfg.timeoutSeconds)
+	dialer := &net.Dialer{
+		Timeout: timeout,
+	}
+	if cfg.filter != nil {
+		filter := cfg.filter
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return errors.Errorf("httpc: dialing unresolved address: %s", address)
+			}
+			return filter(ip)
+		}
+	}
+	transport := &http.Transport{
+		Proxy:                 cfg.proxy,
+		DialContext:           dialer.DialContext,
+		MaxConnsPerHost:       cfg.maxConnsPerHost,
+		MaxIdleConnsPerHost:   cfg.maxConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &roundTripper{
+			next:      transport,
+			userAgent: cfg.userAgent,
+			metrics:   cfg.metrics,
+		},
+	}, nil
+}
+
+// roundTripper sets the user agent and records metrics.
+type roundTripper struct {
+	next      http.RoundTripper
+	userAgent string
+	metrics   *Metrics
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" && rt.userAgent != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", rt.userAgent)
+	}
+	start := time.Now()
+	resp, err := rt.next.RoundTrip(req)
+	elapsed := time.Since(start)
+	if rt.metrics != nil {
+		rt.metrics.record(req.URL.Host, elapsed, err)
+	}
+	ev := log.Debug()
+	if err != nil {
+		ev = ev.Err(err)
+	} else {
+		ev = ev.Int("status", resp.StatusCode)
+	}
+	ev.Str("method", req.Method).Str("url", req.URL.Redacted()).Dur("elapsed", elapsed).Msg("http request")
+	return resp, err
+}
+
+// Metrics counts requests made by clients created with WithMetrics.
+type Metrics struct {
+	mu    sync.Mutex
+	hosts map[string]*HostMetrics
+}
+
+// HostMetrics are the counters for a single host.
+type HostMetrics struct {
+	Requests int64
+	Errors   int64
+	// Duration is the total time spent on requests.
+	Duration time.Duration
+}
+
+func (m *Metrics) record(host string, elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.hosts == nil {
+		m.hosts = make(map[string]*HostMetrics)
+	}
+	hm, ok := m.hosts[host]
+	if !ok {
+		hm = &HostMetrics{}
+		m.hosts[host] = hm
+	}
+	hm.Requests++
+	hm.Duration += elapsed
+	if err != nil {
+		hm.Errors++
+	}
+}
+
+// Snapshot returns a copy of the counters per host.
+func (m *Metrics) Snapshot() map[string]HostMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]HostMetrics, len(m.hosts))
+	for k, v := range m.hosts {
+		out[k] = *v
+	}
+	return out
+}
+
+var (
+	defaultMu      sync.Mutex
+	defaultOpts    []Option
+	defaultClient  atomic.Pointer[http.Client]
+	defaultMetrics = &Metrics{}
+)
+
+// SetDefaultOptions changes the options used by Default. It is called by Init
+// with the configured values.
+func SetDefaultOptions(opts ...Option) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultOpts = opts
+	defaultClient.Store(nil)
+}
+
+// Default returns a shared client built from the default options. Modules
+// should use it unless they need different settings.
+func Default() *http.Client {
+	if cl := defaultClient.Load(); cl != nil {
+		return cl
+	}
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if cl := defaultClient.Load(); cl != nil {
+		return cl
+	}
+	cl, err := New(append([]Option{WithMetrics(defaultMetrics)}, defaultOpts...)...)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid default http client options, using defaults")
+		cl, _ = New(WithMetrics(defaultMetrics))
+	}
+	defaultClient.Store(cl)
+	return cl
+}
+
+// DefaultMetrics returns the metrics recorded by the Default client.
+func DefaultMetrics() *Metrics {
+	return defaultMetrics
+}
+
+// Get is a convenience for a GET request with the Default client that
+// respects the context.
+func Get(c context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(c, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return Default().Do(req)
+}
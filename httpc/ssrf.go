@@ -0,0 +1,172 @@
+package httpc
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const ErrUnsafeURL chatlib.Error = "unsafeURL"
+
+// MaxRedirects is how many redirects the Safe client follows.
+const MaxRedirects = 5
+
+// blockedNets are ranges that aren't covered by the net.IP predicates used in
+// PublicOnly but are still not on the public internet.
+var blockedNets = mustParseCIDRs(
+	"0.0.0.0/8",     // "this" network
+	"100.64.0.0/10", // carrier grade NAT
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // benchmarking
+	"240.0.0.0/4",   // reserved
+	"64:ff9b::/96",  // NAT64, may map to internal IPv4 addresses
+	"2001:db8::/32", // documentation
+)
+
+// blockedHosts are hostnames of cloud metadata services and local names that
+// must never be fetched, whatever they resolve to.
+var blockedHosts = []string{
+	"localhost",
+	"metadata",
+	"metadata.google.internal",
+	"metadata.goog",
+	"instance-data",
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// PublicOnly is an AddressFilter that rejects loopback, private, link-local
+// (which includes the 169.254.169.254 metadata endpoint), multicast and other
+// non-public addresses.
+func PublicOnly(ip net.IP) error {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return errors.WithMessagef(ErrUnsafeURL, "address is not public: %s", ip)
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return errors.WithMessagef(ErrUnsafeURL, "address is not public: %s", ip)
+		}
+	}
+	return nil
+}
+
+// CheckURL returns ErrUnsafeURL if rawURL should not be fetched on behalf of
+// a user: anything but http and https, blocked hostnames, and hosts that
+// resolve to a non-public address. Requests must still be made with a client
+// from NewSafe, since DNS can change between this check and the request.
+func CheckURL(c context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return errors.WithMessagef(ErrUnsafeURL, "invalid url: %s", err)
+	}
+	if err := checkScheme(u); err != nil {
+		return err
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		return PublicOnly(ip)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(c, host)
+	if err != nil {
+		return errors.WithMessagef(ErrUnsafeURL, "failed to resolve %s: %s", host, err)
+	}
+	for _, ip := range ips {
+		if err := PublicOnly(ip.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkScheme checks the parts of a URL that don't need DNS.
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.WithMessagef(ErrUnsafeURL, "scheme not allowed: %s", u.Scheme)
+	}
+	if u.User != nil {
+		return errors.WithMessage(ErrUnsafeURL, "credentials in url not allowed")
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return errors.WithMessage(ErrUnsafeURL, "no host in url")
+	}
+	for _, blocked := range blockedHosts {
+		if host == blocked || strings.HasSuffix(host, "."+blocked) {
+			return errors.WithMessagef(ErrUnsafeURL, "host not allowed: %s", host)
+		}
+	}
+	return nil
+}
+
+// NewSafe returns a client for fetching user supplied URLs. It only connects
+// to public addresses, checking the address actually dialed so DNS rebinding
+// doesn't get around it, checks every redirect and never uses a proxy, since
+// the proxy would make the connection on our behalf.
+func NewSafe(opts ...Option) (*http.Client, error) {
+	opts = append(opts, WithAddressFilter(PublicOnly), WithProxy(""))
+	cl, err := New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	cl.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= MaxRedirects {
+			return errors.Errorf("httpc: stopped after %d redirects", MaxRedirects)
+		}
+		return checkScheme(req.URL)
+	}
+	return cl, nil
+}
+
+var (
+	safeOnce   sync.Once
+	safeClient *http.Client
+)
+
+// Safe returns a shared client from NewSafe with the default options.
+func Safe() *http.Client {
+	safeOnce.Do(func() {
+		defaultMu.Lock()
+		opts := append([]Option{WithMetrics(defaultMetrics)}, defaultOpts...)
+		defaultMu.Unlock()
+		cl, err := NewSafe(opts...)
+		if err != nil {
+			log.Error().Err(err).Msg("invalid default http client options, using defaults")
+			cl, _ = NewSafe(WithMetrics(defaultMetrics))
+		}
+		safeClient = cl
+	})
+	return safeClient
+}
+
+// GetSafe checks rawURL with CheckURL and fetches it with the Safe client.
+func GetSafe(c context.Context, rawURL string) (*http.Response, error) {
+	if err := CheckURL(c, rawURL); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(c, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return Safe().Do(req)
+}
@@ -0,0 +1,74 @@
+package irc
+
+import (
+	"strings"
+
+	"github.com/gregseb/chatlib"
+)
+
+var _ chatlib.Accounter = (*API)(nil)
+
+// AccountOf returns the services account the user is logged in to, and
+// whether they are known to be logged in at all. Accounts are learnt from
+// the account-tag, extended-join and account-notify capabilities, so they
+// are only known for users the bot has seen since connecting. Unlike
+// hostmasks they can't be spoofed, which makes them the thing to check
+// before trusting a user.
+func (a *API) AccountOf(nick string) (string, bool) {
+	a.accountMu.Lock()
+	defer a.accountMu.Unlock()
+	account, ok := a.accounts[strings.ToLower(nick)]
+	return account, ok
+}
+
+// trackAccounts updates the nick to account map from msg.
+func (a *API) trackAccounts(msg *chatlib.Message) {
+	if msg.Nick == "" {
+		return
+	}
+	nick := msg.Nick
+	switch msg.Command {
+	case "QUIT":
+		a.setAccount(nick, "")
+		return
+	case "NICK":
+		account, _ := a.AccountOf(nick)
+		a.setAccount(nick, "")
+		a.setAccount(msg.Receiver, account)
+		return
+	case "ACCOUNT":
+		// account-notify, * when logging out
+		a.setAccount(nick, msg.Receiver)
+		return
+	case "JOIN":
+		// extended-join sends the account, or *, before the real name
+		if fields := strings.Fields(msg.Text); a.HasCap("extended-join") && len(fields) > 0 {
+			a.setAccount(nick, fields[0])
+			return
+		}
+	}
+	if a.HasCap("account-tag") {
+		// Messages from users who aren't logged in have no tag
+		a.setAccount(nick, msg.Tags["account"])
+	}
+}
+
+// setAccount records the user's account, forgetting it if account is empty
+// or *.
+func (a *API) setAccount(nick, account string) {
+	a.accountMu.Lock()
+	defer a.accountMu.Unlock()
+	if account == "" || account == "*" {
+		delete(a.accounts, strings.ToLower(nick))
+		return
+	}
+	a.accounts[strings.ToLower(nick)] = account
+}
+
+// resetAccounts forgets every account, what was learnt on an earlier
+// connection may be out of date.
+func (a *API) resetAccounts() {
+	a.accountMu.Lock()
+	defer a.accountMu.Unlock()
+	a.accounts = make(map[string]string)
+}
@@ -0,0 +1,39 @@
+package irc
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTrackAccounts(t *testing.T) {
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.grantedCaps = map[string]bool{"account-tag": true, "extended-join": true, "account-notify": true}
+	for _, tc := range []struct {
+		line     string
+		nick     string
+		expected string
+	}{
+		{":foo!u@h JOIN #test fooacct :Foo Bar\r\n", "foo", "fooacct"},
+		{":bar!u@h JOIN #test * :Bar\r\n", "bar", ""},
+		{"@account=baracct :bar!u@h PRIVMSG #test :hi\r\n", "BAR", "baracct"},
+		{":bar!u@h PRIVMSG #test :spoofed\r\n", "bar", ""},
+		{":foo!u@h NICK :foo2\r\n", "foo2", "fooacct"},
+		{":foo!u@h NICK :foo2\r\n", "foo", ""},
+		{":foo2!u@h ACCOUNT other\r\n", "foo2", "other"},
+		{":foo2!u@h ACCOUNT *\r\n", "foo2", ""},
+		{"@account=baracct :bar!u@h PRIVMSG #test :hi\r\n", "bar", "baracct"},
+		{":bar!u@h QUIT :bye\r\n", "bar", ""},
+	} {
+		a.rawMsgs <- []byte(tc.line)
+		if _, err := a.ReceiveMessage(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		account, ok := a.AccountOf(tc.nick)
+		if account != tc.expected || ok != (tc.expected != "") {
+			t.Errorf("%q: expected %s to have account %q, got %q", tc.line, tc.nick, tc.expected, account)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package irc
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gregseb/chatlib"
+	"github.com/rs/zerolog/log"
+)
+
+// Replies about being away.
+const (
+	rplAway    = "301"
+	rplUnaway  = "305"
+	rplNowAway = "306"
+)
+
+// DefaultAwayReason is the reason SetAway gives if it isn't given one, as
+// servers take an AWAY without one for coming back.
+const DefaultAwayReason = "away"
+
+// SetAway marks the bot as away with reason, now and on every connection
+// until SetBack is called.
+func (a *API) SetAway(c context.Context, reason string) error {
+	if reason == "" {
+		reason = DefaultAwayReason
+	}
+	a.awayMu.Lock()
+	a.awayReason = reason
+	a.awayMu.Unlock()
+	if !a.registered {
+		return nil
+	}
+	return a.SendMessage(c, &chatlib.Message{Command: "AWAY", Text: reason})
+}
+
+// SetBack marks the bot as no longer away.
+func (a *API) SetBack(c context.Context) error {
+	a.awayMu.Lock()
+	a.awayReason = ""
+	a.awayMu.Unlock()
+	if !a.registered {
+		return nil
+	}
+	return a.SendMessage(c, &chatlib.Message{Command: "AWAY"})
+}
+
+// Away returns the reason the bot is away for, and whether it is.
+func (a *API) Away() (string, bool) {
+	a.awayMu.Lock()
+	defer a.awayMu.Unlock()
+	return a.awayReason, a.awayReason != ""
+}
+
+// IsAway returns the away message of a user in one of the bot's channels,
+// and whether they are away. With away-notify the server tells as soon as
+// users go away or come back, otherwise it is learnt from WHO and replies
+// to messages sent to them.
+func (a *API) IsAway(nick string) (string, bool) {
+	fold := a.folder()
+	a.memberMu.Lock()
+	defer a.memberMu.Unlock()
+	for _, ch := range a.chans {
+		if m, ok := ch.members[fold(nick)]; ok && m.Away {
+			return m.AwayMessage, true
+		}
+	}
+	return "", false
+}
+
+// handleAway keeps track of who is away, and marks the bot away again once
+// registered if it was.
+func (a *API) handleAway(c context.Context, msg *chatlib.Message) {
+	switch msg.Command {
+	case rplEndOfMotd, errNoMotd:
+		if reason, away := a.Away(); away {
+			if err := a.SendMessage(c, &chatlib.Message{Command: "AWAY", Text: reason}); err != nil {
+				log.Error().Str("api", ApiName).Err(err).Msg("error marking the bot away")
+			}
+		}
+	case "AWAY":
+		// away-notify, without a message when coming back
+		if msg.Nick == "" {
+			return
+		}
+		message := ""
+		if len(msg.Params) > 0 {
+			message = strings.TrimSpace(msg.Params[0])
+		}
+		a.setAway(msg.Nick, message)
+	case rplAway:
+		// <bot> <nick> :<away message>
+		if len(msg.Params) > 2 {
+			a.setAway(msg.Params[1], msg.Params[2])
+		}
+	case rplNowAway:
+		log.Info().Str("api", ApiName).Msg("marked away")
+	case rplUnaway:
+		log.Info().Str("api", ApiName).Msg("no longer marked away")
+	}
+}
+
+// setAway records the away message of a member in every channel, an empty
+// one meaning they are back.
+func (a *API) setAway(nick, message string) {
+	fold := a.folder()
+	a.memberMu.Lock()
+	defer a.memberMu.Unlock()
+	for _, ch := range a.chans {
+		if m, ok := ch.members[fold(nick)]; ok {
+			m.Away, m.AwayMessage = message != "", message
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package irc
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAway(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	receive := func(line string) {
+		t.Helper()
+		a.rawMsgs <- []byte(line)
+		if _, err := a.ReceiveMessage(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Before registration it is only remembered
+	if err := a.SetAway(c, ""); err != nil {
+		t.Fatal(err)
+	}
+	if reason, away := a.Away(); !away || reason != DefaultAwayReason {
+		t.Errorf("expected to be away, got %q %v", reason, away)
+	}
+	receive(":irc.example.net 001 bot :Welcome\r\n")
+	receive(":irc.example.net 422 bot :MOTD File is missing\r\n")
+	if line := conn.next(); line != "AWAY :away\n" {
+		t.Errorf("expected to be marked away once registered, got %q", line)
+	}
+	if err := a.SetBack(c); err != nil {
+		t.Fatal(err)
+	}
+	if line := conn.next(); line != "AWAY\n" {
+		t.Errorf("expected to come back, got %q", line)
+	}
+	if _, away := a.Away(); away {
+		t.Error("expected not to be away")
+	}
+
+	a.whoOnJoin = false
+	receive(":bot!u@h JOIN #test\r\n")
+	receive(":irc.example.net 353 bot = #test :bot alice bob carol\r\n")
+	receive(":alice!u@h AWAY :gone fishing\r\n")
+	receive(":irc.example.net 301 bot bob :lunch\r\n")
+	receive(":irc.example.net 352 bot #test c c.example.com irc.example.net carol G :0 Carol\r\n")
+	for nick, expected := range map[string]string{"alice": "gone fishing", "bob": "lunch", "carol": ""} {
+		if message, away := a.IsAway(nick); !away || message != expected {
+			t.Errorf("expected %s to be away with %q, got %q %v", nick, expected, message, away)
+		}
+	}
+	receive(":alice!u@h AWAY\r\n")
+	if _, away := a.IsAway("alice"); away {
+		t.Error("expected alice to be back")
+	}
+	if m, _ := a.Channel("#test").Member("bob"); !m.Away || m.AwayMessage != "lunch" {
+		t.Errorf("expected the member to be away, got %+v", m)
+	}
+}
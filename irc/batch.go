@@ -0,0 +1,140 @@
+package irc
+
+import (
+	"strings"
+
+	"github.com/gregseb/chatlib"
+)
+
+// CommandBatch is given to the message a batch is grouped into, see
+// WithBatches. Its Text is the batch type, its Receiver the first parameter
+// of the batch, such as the target of chathistory, and its messages are in
+// AnnotationBatch.
+const CommandBatch = "BATCHED"
+
+// DefaultBatchTypes are the batches grouped by default: the QUITs of a
+// netsplit, the JOINs of the netjoin that follows, and history played back
+// with chathistory.
+var DefaultBatchTypes = []string{"netsplit", "netjoin", "chathistory"}
+
+// Batch is a group of messages the server sent as one.
+type Batch struct {
+	Type string
+	// Params are the parameters of the batch after its type, e.g. the two
+	// servers of a netsplit.
+	Params   []string
+	Messages []*chatlib.Message
+}
+
+// AnnotationBatch holds the batch a CommandBatch message stands for.
+var AnnotationBatch = chatlib.NewAnnotationKey[*Batch]("irc.batch")
+
+// WithBatches sets the types of IRCv3 batches that are delivered as a single
+// CommandBatch message once they end, rather than line by line. The lines are
+// still used to keep track of channels and users. Without any, batches are
+// delivered line by line.
+func WithBatches(types ...string) Option {
+	return func(a *API) error {
+		a.batchTypes = nil
+		for _, t := range types {
+			if t = strings.TrimSpace(t); t != "" {
+				a.batchTypes = append(a.batchTypes, strings.ToLower(t))
+			}
+		}
+		return nil
+	}
+}
+
+// groupedBatch is a batch being received.
+type groupedBatch struct {
+	start *chatlib.Message
+	batch *Batch
+}
+
+func (a *API) groups(kind string) bool {
+	for _, t := range a.batchTypes {
+		if strings.EqualFold(t, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleBatch collects the lines of the batches that are grouped. It returns
+// true for the lines that are part of one, which aren't passed on, along
+// with the CommandBatch message once the batch ends. Batches within a
+// grouped batch are added to it whole.
+func (a *API) handleBatch(msg *chatlib.Message) (*chatlib.Message, bool) {
+	if len(a.batchTypes) == 0 {
+		return nil, false
+	}
+	if msg.Command == "BATCH" {
+		ref := msg.Receiver
+		switch {
+		case strings.HasPrefix(ref, "+") && len(msg.Params) > 1 && a.groups(msg.Params[1]):
+			a.grouped[ref[1:]] = &groupedBatch{start: msg, batch: &Batch{Type: msg.Params[1], Params: msg.Params[2:]}}
+			return nil, true
+		case strings.HasPrefix(ref, "-"):
+			g, ok := a.grouped[ref[1:]]
+			if !ok {
+				break
+			}
+			delete(a.grouped, ref[1:])
+			if grouped := g.message(); !a.addToBatch(grouped) {
+				return grouped, true
+			}
+			return nil, true
+		}
+	}
+	return nil, a.addToBatch(msg)
+}
+
+// addToBatch adds msg to the grouped batch it is tagged with, and reports
+// whether there is one.
+func (a *API) addToBatch(msg *chatlib.Message) bool {
+	ref := msg.Tags["batch"]
+	if ref == "" {
+		return false
+	}
+	g, ok := a.grouped[ref]
+	if !ok {
+		return false
+	}
+	g.batch.Messages = append(g.batch.Messages, msg)
+	return true
+}
+
+// message returns the CommandBatch message the batch is grouped into. It is
+// replayed if its start or all of its messages were.
+func (g *groupedBatch) message() *chatlib.Message {
+	b := g.batch
+	msg := &chatlib.Message{
+		Command: CommandBatch,
+		Sender:  g.start.Sender,
+		Nick:    g.start.Nick,
+		Text:    b.Type,
+		Params:  append([]string{b.Type}, b.Params...),
+		Tags:    g.start.Tags,
+		Time:    g.start.Time,
+		Raw:     g.start.Raw,
+	}
+	if len(b.Params) > 0 {
+		msg.Receiver = b.Params[0]
+	}
+	replayed := len(b.Messages) > 0
+	for _, m := range b.Messages {
+		if msg.Time.IsZero() {
+			msg.Time = m.Time
+		}
+		replayed = replayed && m.Replayed
+	}
+	msg.Replayed = g.start.Replayed || replayed
+	AnnotationBatch.Set(msg, b)
+	return msg
+}
+
+// resetBatches forgets the batches of an earlier connection.
+func (a *API) resetBatches() {
+	a.batches = make(map[string]*multilineMessage)
+	a.grouped = make(map[string]*groupedBatch)
+}
@@ -0,0 +1,80 @@
+package irc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestBatches(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"), WithWhoOnJoin(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.wants("batch") {
+		t.Fatalf("expected batch to be requested, got %v", a.wantCaps)
+	}
+	a.grantedCaps = map[string]bool{"batch": true, multilineCap: true}
+	a.conn = &bufConn{}
+	a.connectTime = time.Now()
+	receive := func(line string) *chatlib.Message {
+		t.Helper()
+		a.rawMsgs <- []byte(line)
+		msg, err := a.ReceiveMessage(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	receive(":bot!u@h JOIN #chan\r\n")
+	receive(":irc.example.net 353 bot = #chan :bot alice bob carol\r\n")
+
+	// A netsplit is one message, but its QUITs still count
+	for _, line := range []string{
+		":irc.example.net BATCH +ns netsplit hub.example.net leaf.example.net\r\n",
+		"@batch=ns :alice!u@h QUIT :hub.example.net leaf.example.net\r\n",
+		"@batch=ns :bob!u@h QUIT :hub.example.net leaf.example.net\r\n",
+	} {
+		if msg := receive(line); msg != nil {
+			t.Fatalf("expected %q to be held, got %+v", line, msg)
+		}
+	}
+	if msg := receive(":carol!u@h PRIVMSG #chan :outside\r\n"); msg == nil || msg.Text != "outside" {
+		t.Fatalf("expected lines outside the batch to be passed on, got %+v", msg)
+	}
+	msg := receive(":irc.example.net BATCH -ns\r\n")
+	b, ok := AnnotationBatch.Get(msg)
+	if msg.Command != CommandBatch || msg.Text != "netsplit" || msg.Receiver != "hub.example.net" || !ok || len(b.Messages) != 2 || msg.Replayed {
+		t.Fatalf("expected the netsplit as one message, got %+v, %+v", msg, b)
+	}
+	if nicks := a.MemberNicks("#chan"); len(nicks) != 2 {
+		t.Errorf("expected alice and bob to have quit, got %v", nicks)
+	}
+
+	// History is replayed, multiline messages within it included
+	for _, line := range []string{
+		":irc.example.net BATCH +ch chathistory #chan\r\n",
+		"@batch=ch;time=2000-01-01T00:00:00.000Z :carol!u@h PRIVMSG #chan :first\r\n",
+		"@batch=ch;time=2000-01-01T00:01:00.000Z :carol!u@h BATCH +ml draft/multiline #chan\r\n",
+		"@batch=ml :carol!u@h PRIVMSG #chan :two\r\n",
+		"@batch=ml :carol!u@h PRIVMSG #chan :lines\r\n",
+		":carol!u@h BATCH -ml\r\n",
+	} {
+		if msg := receive(line); msg != nil {
+			t.Fatalf("expected %q to be held, got %+v", line, msg)
+		}
+	}
+	msg = receive(":irc.example.net BATCH -ch\r\n")
+	b, _ = AnnotationBatch.Get(msg)
+	if msg.Text != "chathistory" || msg.Receiver != "#chan" || !msg.Replayed || b == nil || len(b.Messages) != 2 || b.Messages[1].Text != "two\nlines" {
+		t.Fatalf("expected the history as one replayed message, got %+v, %+v", msg, b)
+	}
+
+	// Other batches are passed on line by line
+	if msg := receive("@batch=other :carol!u@h PRIVMSG #chan :hi\r\n"); msg == nil {
+		t.Error("expected lines of other batches to be passed on")
+	}
+}
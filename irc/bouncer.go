@@ -0,0 +1,217 @@
+package irc
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Bouncers the API knows how to talk to.
+const (
+	BouncerNone = "none"
+	BouncerZNC  = "znc"
+)
+
+// CommandBouncer is given to messages from the bouncer itself, such as
+// ZNC's *status, so they don't run actions meant for users. Actions can be
+// registered for it to follow what the bouncer says.
+const CommandBouncer = "BOUNCER"
+
+// ZNC's capabilities, its host in the prefix of the messages of its modules,
+// and the lines around a buffer it plays back to clients without batches.
+const (
+	capZNCPlayback      = "znc.in/playback"
+	capZNCSelfMessage   = "znc.in/self-message"
+	zncHost             = "znc.in"
+	zncPlaybackStart    = "Buffer Playback..."
+	zncPlaybackComplete = "Playback Complete."
+)
+
+// playbackBatches are the types of batches whose messages are played back
+// history.
+var playbackBatches = []string{"znc.in/playback", "chathistory"}
+
+// bouncerSaveInterval is how often the time of the last message seen is
+// saved while messages come in.
+const bouncerSaveInterval = time.Minute
+
+// bouncerState follows the history a bouncer plays back.
+type bouncerState struct {
+	kind string
+	// batches are the playback batches open, by reference, and buffers the
+	// receivers of buffers being played back without batches.
+	batches map[string]bool
+	buffers map[string]bool
+
+	mu sync.Mutex
+	// lastSeen is the time of the last message seen, from which playback
+	// is asked for on the next connection.
+	lastSeen  time.Time
+	lastSaved time.Time
+}
+
+// WithBouncer tells the API it connects through a bouncer, one of
+// BouncerNone or BouncerZNC. History the bouncer plays back is marked
+// Replayed so the Handler's replay policy applies to it, and messages from
+// the bouncer's own modules get CommandBouncer. With ZNC's *playback
+// module, only what was missed since the last message seen is played back.
+func WithBouncer(kind string) Option {
+	return func(a *API) error {
+		switch kind {
+		case "", BouncerNone:
+			a.bouncer.kind = ""
+		case BouncerZNC:
+			a.bouncer.kind = kind
+			a.bouncer.batches, a.bouncer.buffers = make(map[string]bool), make(map[string]bool)
+			a.wantCap("batch")
+			a.wantCap(capZNCPlayback)
+			a.wantCap(capZNCSelfMessage)
+		default:
+			return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: invalid bouncer %q, expected one of: %s, %s", kind, BouncerNone, BouncerZNC)
+		}
+		return nil
+	}
+}
+
+// BouncerCommand sends text to a module of the bouncer, e.g. "status" for
+// ZNC's *status.
+func (a *API) BouncerCommand(c context.Context, module, text string) error {
+	if a.bouncer.kind == "" {
+		return errors.New("irc: not connected through a bouncer")
+	}
+	return a.SendMessage(c, &chatlib.Message{Command: "PRIVMSG", Receiver: "*" + strings.TrimPrefix(module, "*"), Text: text})
+}
+
+func (a *API) playbackKey() string {
+	return ApiName + "/" + a.primaryHost() + "/playback"
+}
+
+// handleBouncer marks the history played back by the bouncer as Replayed,
+// gives messages from its modules CommandBouncer, and asks for what was
+// missed once registered.
+func (a *API) handleBouncer(c context.Context, msg *chatlib.Message) error {
+	b := &a.bouncer
+	if b.kind == "" {
+		return nil
+	}
+	switch msg.Command {
+	case rplWelcome:
+		b.batches, b.buffers = make(map[string]bool), make(map[string]bool)
+		return nil
+	case rplEndOfMotd, errNoMotd:
+		return a.requestPlayback(c)
+	case "BATCH":
+		ref := msg.Receiver
+		if strings.HasPrefix(ref, "+") && len(msg.Params) > 1 && isPlaybackBatch(msg.Params[1]) {
+			b.batches[ref[1:]] = true
+		} else if strings.HasPrefix(ref, "-") {
+			delete(b.batches, ref[1:])
+		}
+	}
+	if ref := msg.Tags["batch"]; ref != "" && b.batches[ref] {
+		msg.Replayed = true
+	}
+	if _, host := userHostFromPrefix(msg.Sender); strings.HasPrefix(msg.Nick, "*") && host == zncHost {
+		receiver := strings.ToLower(msg.Receiver)
+		switch msg.Text {
+		case zncPlaybackStart:
+			b.buffers[receiver] = true
+		case zncPlaybackComplete:
+			delete(b.buffers, receiver)
+		default:
+			log.Info().Str("api", ApiName).Str("bouncer", msg.Nick).Msg(msg.Text)
+		}
+		msg.Command = CommandBouncer
+		return nil
+	}
+	if msg.Command != "PRIVMSG" && msg.Command != "NOTICE" {
+		return nil
+	}
+	if b.buffers[strings.ToLower(msg.Receiver)] {
+		msg.Replayed = true
+	}
+	return a.seen(c, msg)
+}
+
+func isPlaybackBatch(kind string) bool {
+	for _, k := range playbackBatches {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// seen records the time of a message, saving it every so often.
+func (a *API) seen(c context.Context, msg *chatlib.Message) error {
+	t := msg.Time
+	if t.IsZero() {
+		if msg.Replayed {
+			return nil
+		}
+		t = time.Now()
+	}
+	b := &a.bouncer
+	b.mu.Lock()
+	if !t.After(b.lastSeen) {
+		b.mu.Unlock()
+		return nil
+	}
+	b.lastSeen = t
+	save := t.Sub(b.lastSaved) >= bouncerSaveInterval
+	b.mu.Unlock()
+	if !save {
+		return nil
+	}
+	return a.saveLastSeen(c)
+}
+
+// saveLastSeen saves the time of the last message seen.
+func (a *API) saveLastSeen(c context.Context) error {
+	b := &a.bouncer
+	b.mu.Lock()
+	t := b.lastSeen
+	b.lastSaved = t
+	b.mu.Unlock()
+	if a.store == nil || t.IsZero() {
+		return nil
+	}
+	return errors.WithMessage(a.store.Set(c, a.playbackKey(), []byte(t.UTC().Format(time.RFC3339Nano))), "irc: error saving last message time")
+}
+
+// requestPlayback asks ZNC's *playback module for the messages since the
+// last one seen, by this connection or an earlier run. Nothing is asked for
+// when none was ever seen.
+func (a *API) requestPlayback(c context.Context) error {
+	if !a.HasCap(capZNCPlayback) {
+		return nil
+	}
+	b := &a.bouncer
+	b.mu.Lock()
+	since := b.lastSeen
+	b.mu.Unlock()
+	if since.IsZero() && a.store != nil {
+		bts, err := a.store.Get(c, a.playbackKey())
+		if err != nil && !errors.Is(err, chatlib.ErrNotFound) {
+			return errors.WithMessage(err, "irc: error loading last message time")
+		} else if err == nil {
+			if since, err = time.Parse(time.RFC3339Nano, string(bts)); err != nil {
+				return errors.Wrap(err, "irc: invalid last message time in store")
+			}
+			b.mu.Lock()
+			b.lastSeen, b.lastSaved = since, since
+			b.mu.Unlock()
+		}
+	}
+	if since.IsZero() {
+		return nil
+	}
+	log.Info().Str("api", ApiName).Time("since", since).Msg("asking the bouncer for missed messages")
+	return a.BouncerCommand(c, "playback", "PLAY * "+strconv.FormatFloat(float64(since.UnixMilli())/1000, 'f', 3, 64))
+}
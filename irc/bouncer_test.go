@@ -0,0 +1,87 @@
+package irc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestBouncer(t *testing.T) {
+	c := context.Background()
+	if _, err := New(WithBouncer("bnc")); !errors.Is(err, chatlib.ErrInvalidConfig) {
+		t.Fatalf("expected an unknown bouncer to be refused, got %v", err)
+	}
+	store := chatlib.NewMemoryStore()
+	seen := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store.Set(c, ApiName+"/znc.example.net/playback", []byte(seen.Format(time.RFC3339Nano)))
+	a, err := New(WithNick("bot"), WithNetwork("znc.example.net", 6697), WithBouncer(BouncerZNC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.UseStore(store)
+	conn := &bufConn{}
+	a.conn = conn
+	a.connectTime = time.Now()
+	a.grantedCaps = map[string]bool{capZNCPlayback: true, "batch": true}
+	receive := func(line string) *chatlib.Message {
+		t.Helper()
+		a.rawMsgs <- []byte(line)
+		msg, err := a.ReceiveMessage(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	for _, cap := range []string{"batch", capZNCPlayback, capZNCSelfMessage} {
+		if !a.wants(cap) {
+			t.Errorf("expected %s to be requested", cap)
+		}
+	}
+
+	// Once registered, what was missed since the last message seen is asked for
+	receive(":znc.example.net 001 bot :Welcome\r\n")
+	receive(":znc.example.net 376 bot :End of MOTD\r\n")
+	if line := conn.next(); line != "PRIVMSG *playback :PLAY * 1714564800.000\n" {
+		t.Errorf("expected playback to be asked for, got %q", line)
+	}
+
+	for _, tc := range []struct {
+		line     string
+		command  string
+		replayed bool
+	}{
+		{":znc.example.net BATCH +p1 znc.in/playback #test\r\n", "BATCH", false},
+		{"@batch=p1 :alice!u@h PRIVMSG #test :!deploy\r\n", "PRIVMSG", true},
+		{":znc.example.net BATCH -p1\r\n", "BATCH", false},
+		{":***!znc@znc.in PRIVMSG #old :Buffer Playback...\r\n", CommandBouncer, false},
+		{":alice!u@h PRIVMSG #old :[12:00:01] !deploy\r\n", "PRIVMSG", true},
+		{":bob!u@h PRIVMSG #other :!deploy\r\n", "PRIVMSG", false},
+		{":***!znc@znc.in PRIVMSG #old :Playback Complete.\r\n", CommandBouncer, false},
+		{":alice!u@h PRIVMSG #old :!deploy\r\n", "PRIVMSG", false},
+		{":*status!znc@znc.in PRIVMSG bot :!Disconnected from IRC. Reconnecting...\r\n", CommandBouncer, false},
+		{":*status!status@example.com PRIVMSG bot :!deploy\r\n", "PRIVMSG", false},
+	} {
+		msg := receive(tc.line)
+		if msg.Command != tc.command || msg.Replayed != tc.replayed {
+			t.Errorf("%q: expected %s replayed %v, got %s replayed %v", tc.line, tc.command, tc.replayed, msg.Command, msg.Replayed)
+		}
+	}
+
+	// The time of the last message is kept for the next run
+	if err := a.saveLastSeen(c); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := store.Get(c, ApiName+"/znc.example.net/playback")
+	if last, err := time.Parse(time.RFC3339Nano, string(b)); err != nil || time.Since(last) > time.Minute {
+		t.Errorf("expected the time of the last message to be saved, got %s", b)
+	}
+	if err := a.BouncerCommand(c, "*status", "ClearAllBuffers"); err != nil {
+		t.Fatal(err)
+	}
+	if line := conn.next(); line != "PRIVMSG *status :ClearAllBuffers\n" {
+		t.Errorf("expected a command to *status, got %q", line)
+	}
+}
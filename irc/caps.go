@@ -0,0 +1,213 @@
+package irc
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/gregseb/chatlib"
+	"github.com/rs/zerolog/log"
+)
+
+// CapVersion is the CAP LS version sent to servers, which makes them send
+// capability values and cap-notify.
+const CapVersion = "302"
+
+// defaultCaps are requested from every server that offers them because the
+// API always understands them.
+var defaultCaps = []string{"server-time", "cap-notify", "message-tags", "account-tag", "extended-join", "account-notify", "away-notify", "chghost", "draft/multiline"}
+
+// WithCaps requests IRCv3 capabilities from the server in addition to those
+// the API requests for its own features. Capabilities the server doesn't
+// offer are skipped; check which were granted with HasCap.
+func WithCaps(caps ...string) Option {
+	return func(a *API) error {
+		a.wantCaps = append(a.wantCaps, caps...)
+		return nil
+	}
+}
+
+// HasCap reports whether the server granted the capability.
+func (a *API) HasCap(name string) bool {
+	a.capMu.Lock()
+	defer a.capMu.Unlock()
+	return a.grantedCaps[name]
+}
+
+// CapValue returns the value the server advertised for the capability, e.g.
+// the mechanisms for sasl, and whether it was advertised at all.
+func (a *API) CapValue(name string) (string, bool) {
+	a.capMu.Lock()
+	defer a.capMu.Unlock()
+	v, ok := a.availableCaps[name]
+	return v, ok
+}
+
+// Caps returns the granted capabilities, sorted.
+func (a *API) Caps() []string {
+	a.capMu.Lock()
+	defer a.capMu.Unlock()
+	caps := make([]string, 0, len(a.grantedCaps))
+	for name := range a.grantedCaps {
+		caps = append(caps, name)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+// wantCap adds a capability needed by one of the API's features.
+func (a *API) wantCap(name string) {
+	for _, c := range a.wantCaps {
+		if c == name {
+			return
+		}
+	}
+	a.wantCaps = append(a.wantCaps, name)
+}
+
+// startCaps resets the capability state for a new connection and asks the
+// server what it supports. Registration is held by the server until CAP END.
+func (a *API) startCaps(c context.Context) error {
+	a.capMu.Lock()
+	a.availableCaps = make(map[string]string)
+	a.grantedCaps = make(map[string]bool)
+	a.capPending = 0
+	a.capEnded = false
+	a.capMu.Unlock()
+	return a.SendMessage(c, &chatlib.Message{Command: "CAP LS " + CapVersion})
+}
+
+// handleCap handles the server's CAP replies.
+func (a *API) handleCap(c context.Context, msg *chatlib.Message) error {
+	if msg.Command != "CAP" {
+		return nil
+	}
+	sub, rest, _ := strings.Cut(msg.Text, " ")
+	more := false
+	if r, ok := strings.CutPrefix(rest, "* "); ok {
+		// Multiline reply, more lines follow
+		more, rest = true, r
+	}
+	caps := strings.Fields(strings.TrimPrefix(rest, ":"))
+	switch strings.ToUpper(sub) {
+	case "LS":
+		a.capMu.Lock()
+		for _, item := range caps {
+			name, value, _ := strings.Cut(item, "=")
+			a.availableCaps[name] = value
+		}
+		a.capMu.Unlock()
+		if more {
+			return nil
+		}
+		if a.handleSTS(c) {
+			return nil
+		}
+		if _, ok := a.CapValue("sasl"); a.wants("sasl") && !ok {
+			log.Error().Str("api", ApiName).Msg("server does not support sasl")
+		}
+		return a.requestCaps(c, append(append([]string{}, defaultCaps...), a.wantCaps...))
+	case "NEW":
+		a.capMu.Lock()
+		for _, item := range caps {
+			name, value, _ := strings.Cut(item, "=")
+			a.availableCaps[name] = value
+		}
+		a.capMu.Unlock()
+		if contains(capNames(caps), "sts") && a.handleSTS(c) {
+			return nil
+		}
+		return a.requestCaps(c, capNames(caps))
+	case "DEL":
+		a.capMu.Lock()
+		for _, name := range caps {
+			delete(a.availableCaps, name)
+			delete(a.grantedCaps, name)
+		}
+		a.capMu.Unlock()
+		log.Info().Str("api", ApiName).Msgf("server removed capabilities: %v", caps)
+	case "ACK":
+		a.capMu.Lock()
+		for _, name := range caps {
+			if n, ok := strings.CutPrefix(name, "-"); ok {
+				delete(a.grantedCaps, n)
+				continue
+			}
+			a.grantedCaps[name] = true
+		}
+		a.capPending--
+		a.capMu.Unlock()
+		log.Info().Str("api", ApiName).Msgf("server granted capabilities: %v", caps)
+		if contains(caps, "sasl") {
+			if err := a.startSASL(c); err != nil {
+				// Carry on registering without it
+				a.maybeEndCaps(c)
+				return err
+			}
+		}
+		return a.maybeEndCaps(c)
+	case "NAK":
+		a.capMu.Lock()
+		a.capPending--
+		a.capMu.Unlock()
+		log.Warn().Str("api", ApiName).Msgf("server refused capabilities: %v", caps)
+		return a.maybeEndCaps(c)
+	}
+	return nil
+}
+
+// requestCaps requests the capabilities in names that are wanted and offered.
+func (a *API) requestCaps(c context.Context, names []string) error {
+	want := make([]string, 0)
+	a.capMu.Lock()
+	for _, name := range names {
+		if _, ok := a.availableCaps[name]; ok && a.wants(name) && !a.grantedCaps[name] && !contains(want, name) {
+			want = append(want, name)
+		}
+	}
+	if len(want) > 0 {
+		a.capPending++
+	}
+	a.capMu.Unlock()
+	if len(want) == 0 {
+		return a.maybeEndCaps(c)
+	}
+	return a.SendMessage(c, &chatlib.Message{Command: "CAP REQ", Text: strings.Join(want, " ")})
+}
+
+// maybeEndCaps ends negotiation once every request has been answered and
+// SASL is done.
+func (a *API) maybeEndCaps(c context.Context) error {
+	a.capMu.Lock()
+	done := !a.capEnded && a.capPending <= 0 && a.sasl == nil
+	if done {
+		a.capEnded = true
+	}
+	a.capMu.Unlock()
+	if !done {
+		return nil
+	}
+	return a.SendMessage(c, &chatlib.Message{Command: "CAP END"})
+}
+
+func (a *API) wants(name string) bool {
+	return contains(a.wantCaps, name) || contains(defaultCaps, name)
+}
+
+// capNames strips the values from a list of capabilities.
+func capNames(caps []string) []string {
+	names := make([]string, len(caps))
+	for i, item := range caps {
+		names[i], _, _ = strings.Cut(item, "=")
+	}
+	return names
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
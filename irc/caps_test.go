@@ -0,0 +1,61 @@
+package irc
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/gregseb/chatlib"
+)
+
+// bufConn records what the API writes.
+type bufConn struct {
+	bytes.Buffer
+}
+
+func (b *bufConn) Close() error { return nil }
+
+func (b *bufConn) next() string {
+	line, _ := b.ReadString('\n')
+	return line
+}
+
+func TestCapNegotiation(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithAuthMethod(AuthMethodSASL), WithPassword("hunter2"), WithCaps("message-tags"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	if err := a.startCaps(c); err != nil {
+		t.Fatal(err)
+	}
+	if line := conn.next(); line != "CAP LS 302\n" {
+		t.Fatalf("expected CAP LS, got %q", line)
+	}
+	for _, text := range []string{"LS * :multi-prefix sasl=PLAIN,EXTERNAL", "LS :server-time message-tags"} {
+		if err := a.handleCap(c, &chatlib.Message{Command: "CAP", Receiver: "*", Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if line := conn.next(); line != "CAP REQ :server-time message-tags sasl\n" {
+		t.Fatalf("expected CAP REQ, got %q", line)
+	}
+	if err := a.handleCap(c, &chatlib.Message{Command: "CAP", Receiver: "freyabot", Text: "ACK :server-time message-tags sasl"}); err != nil {
+		t.Fatal(err)
+	}
+	if !a.HasCap("message-tags") || a.HasCap("multi-prefix") {
+		t.Fatalf("unexpected caps granted: %v", a.Caps())
+	}
+	// Negotiation doesn't end until SASL is done
+	if line := conn.next(); line != "AUTHENTICATE PLAIN\n" {
+		t.Fatalf("expected AUTHENTICATE, got %q", line)
+	}
+	if err := a.handleSASL(c, &chatlib.Message{Command: "903", Text: "freyabot :SASL authentication successful"}); err != nil {
+		t.Fatal(err)
+	}
+	if line := conn.next(); line != "CAP END\n" {
+		t.Fatalf("expected CAP END, got %q", line)
+	}
+}
@@ -0,0 +1,85 @@
+package irc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrCertNotRecognized is returned when the network did not log the bot in
+// with its client certificate.
+const ErrCertNotRecognized chatlib.Error = "certNotRecognized"
+
+// WHOIS numerics
+const (
+	rplWhoisAccount = "330"
+	rplEndOfWhois   = "318"
+)
+
+// CertFingerprint returns the SHA-256 fingerprint of the TLS client
+// certificate as services expect it to be registered, e.g. with
+// "/msg NickServ CERT ADD <fingerprint>". It is empty if there is no client
+// certificate.
+func (a *API) CertFingerprint() string {
+	if a.tls == nil || len(a.tls.Certificates) == 0 || len(a.tls.Certificates[0].Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(a.tls.Certificates[0].Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyCertFP checks the network logged the bot in with its client
+// certificate. Networks that send RPL_LOGGEDIN on connect have already said
+// so, otherwise the bot's own WHOIS must show an account.
+func (a *API) verifyCertFP(c context.Context) error {
+	if a.CertFingerprint() == "" {
+		return errors.WithMessage(chatlib.ErrInvalidConfig, "irc: certfp auth requires a tls client certificate")
+	}
+	if err := a.SendMessage(c, &chatlib.Message{Command: "WHOIS " + a.nick}); err != nil {
+		return err
+	}
+	select {
+	case <-c.Done():
+		return c.Err()
+	case err := <-a.authResult:
+		if err == nil {
+			log.Info().Str("api", ApiName).Msg("logged in with client certificate")
+		}
+		return err
+	case <-time.After(time.Duration(float64(time.Second) * a.dialTimeoutSeconds)):
+		return errors.WithMessage(chatlib.ErrTimeout, "irc: timed out waiting for whois")
+	}
+}
+
+// handleCertFP passes the outcome of certificate authentication to
+// verifyCertFP.
+func (a *API) handleCertFP(msg *chatlib.Message) {
+	if a.authMethod != AuthMethodCertFP {
+		return
+	}
+	var result error
+	fields := strings.Fields(msg.Text)
+	switch {
+	case msg.Command == rplLoggedIn:
+		a.certLoggedIn = true
+	case msg.Command == rplWhoisAccount && len(fields) > 0 && strings.EqualFold(fields[0], a.nick):
+		a.certLoggedIn = true
+	case msg.Command == rplEndOfWhois && len(fields) > 0 && strings.EqualFold(fields[0], a.nick):
+		if a.certLoggedIn {
+			return
+		}
+		result = errors.WithMessagef(ErrCertNotRecognized, "irc: the network did not log in %s with the client certificate %s, make sure it is registered with services", a.nick, a.CertFingerprint())
+	default:
+		return
+	}
+	select {
+	case a.authResult <- result:
+	default:
+	}
+}
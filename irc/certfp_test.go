@@ -0,0 +1,40 @@
+package irc
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestHandleCertFP(t *testing.T) {
+	a, err := New(WithAuthMethod(AuthMethodCertFP), WithNick("freyabot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.handleCertFP(&chatlib.Message{Command: "311", Text: "freyabot ~freya example.com * :FreyaBot"})
+	select {
+	case err := <-a.authResult:
+		t.Fatalf("unexpected result %v", err)
+	default:
+	}
+	a.handleCertFP(&chatlib.Message{Command: "330", Text: "freyabot freya :is logged in as"})
+	if err := <-a.authResult; err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	a.handleCertFP(&chatlib.Message{Command: "318", Text: "freyabot :End of /WHOIS list."})
+	select {
+	case err := <-a.authResult:
+		t.Fatalf("unexpected result after the account was seen %v", err)
+	default:
+	}
+
+	a, err = New(WithAuthMethod(AuthMethodCertFP), WithNick("freyabot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.handleCertFP(&chatlib.Message{Command: "318", Text: "freyabot :End of /WHOIS list."})
+	if err := <-a.authResult; !errors.Is(err, ErrCertNotRecognized) {
+		t.Fatalf("expected ErrCertNotRecognized, got %v", err)
+	}
+}
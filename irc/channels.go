@@ -0,0 +1,394 @@
+package irc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Channel join states
+const (
+	joinNone = iota
+	joinPending
+	joinDone
+)
+
+// errBadChannelKey is the reply to joining a +k channel with the wrong key.
+const errBadChannelKey = "475"
+
+// Ready reports whether the API has registered and joined all critical
+// channels.
+func (a *API) Ready() bool {
+	return a.ready
+}
+
+func (a *API) joinChannels(c context.Context, channels []string) error {
+	for _, channel := range channels {
+		if err := a.joinChannel(c, channel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *API) joinChannel(c context.Context, channel string) error {
+	a.setJoinState(channel, joinPending)
+	command := "JOIN " + channel
+	if key := a.channelKey(channel); key != "" {
+		command += " " + key
+	}
+	if err := a.SendMessage(c, &chatlib.Message{
+		Command: command,
+	}); err != nil {
+		a.setJoinState(channel, joinNone)
+		return err
+	}
+	return nil
+}
+
+func (a *API) leaveChannel(c context.Context, channel string) error {
+	if err := a.SendMessage(c, &chatlib.Message{
+		Command: "PART " + channel,
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// joinAndWait joins the given channels and waits until the server has
+// confirmed all of them, or the dial timeout has passed.
+func (a *API) joinAndWait(c context.Context, channels []string) error {
+	if err := a.joinChannels(c, channels); err != nil {
+		return err
+	}
+	start := time.Now()
+	for _, channel := range channels {
+		for a.joinState(channel) != joinDone {
+			if time.Since(start) > time.Duration(float64(time.Second)*a.dialTimeoutSeconds) {
+				log.Error().Str("api", ApiName).Msgf("timed out waiting to join %s", channel)
+				return chatlib.ErrTimeout
+			}
+			select {
+			case <-c.Done():
+				return c.Err()
+			case <-time.After(time.Duration(float64(time.Second) * 0.1)):
+			}
+		}
+	}
+	return nil
+}
+
+// joinIfLazy joins the target if it is a lazy channel that hasn't been joined
+// yet.
+func (a *API) joinIfLazy(c context.Context, target string) error {
+	if a.joinState(target) != joinNone {
+		return nil
+	}
+	for _, channel := range a.lazyChannels {
+		if strings.EqualFold(channel, target) {
+			log.Debug().Str("api", ApiName).Msgf("joining lazy channel on first use: %s", channel)
+			return a.joinChannel(c, channel)
+		}
+	}
+	return nil
+}
+
+// startupJoin joins critical channels and marks the API ready, then joins the
+// remaining channels. Lazy channels are joined after the lazy join delay.
+// Channels parted at runtime or for being idle are skipped and channels joined
+// at runtime are joined along with the configured ones.
+func (a *API) startupJoin(c context.Context) {
+	// Channels may require an identified nick, so identify before joining.
+	switch a.authMethod {
+	case AuthMethodNickServ:
+		if err := a.identify(c); err != nil {
+			log.Error().Str("api", ApiName).Err(err).Msg("error identifying with nickserv, joining channels anyway")
+		}
+	case AuthMethodCertFP:
+		if err := a.verifyCertFP(c); err != nil {
+			log.Error().Str("api", ApiName).Err(err).Msg("error logging in with client certificate, joining channels anyway")
+		}
+	}
+	state, err := a.loadChannelState(c)
+	if err != nil {
+		log.Error().Str("api", ApiName).Err(err).Msg("error loading channel state")
+		state = &channelState{}
+	}
+	for channel, key := range state.Keys {
+		if a.channelKey(channel) == "" {
+			a.setChannelKey(channel, key)
+		}
+	}
+	a.setIdleParted(state.Idle)
+	skipped := append(append([]string{}, state.Parted...), state.Idle...)
+	critical := withoutChannels(a.criticalChannels, state.Parted)
+	channels := append(withoutChannels(a.channels, skipped), withoutChannels(state.Joined, state.Idle)...)
+	lazy := withoutChannels(a.lazyChannels, skipped)
+	if err := a.joinAndWait(c, critical); err != nil {
+		log.Error().Str("api", ApiName).Err(err).Msg("error joining critical channels")
+	}
+	a.ready = true
+	log.Info().Str("api", ApiName).Msg("ready")
+	if err := a.joinChannels(c, channels); err != nil {
+		log.Error().Str("api", ApiName).Err(err).Msg("error joining channels")
+	}
+	if len(lazy) == 0 {
+		return
+	}
+	select {
+	case <-c.Done():
+		return
+	case <-time.After(time.Duration(float64(time.Second) * a.lazyJoinDelaySeconds)):
+	}
+	for _, channel := range lazy {
+		if err := a.joinIfLazy(c, channel); err != nil {
+			log.Error().Str("api", ApiName).Err(err).Msgf("error joining lazy channel %s", channel)
+		}
+	}
+}
+
+// WithChannelKey sets the key to join a channel with, for channels that are
+// +k. Keys can also be given with the channel, as #channel:key.
+func WithChannelKey(channel, key string) Option {
+	return func(a *API) error {
+		a.setChannelKey(channel, key)
+		return nil
+	}
+}
+
+// splitKeys strips the keys from channels given as #channel:key and
+// remembers them.
+func (a *API) splitKeys(channels []string) []string {
+	out := make([]string, 0, len(channels))
+	for _, ch := range channels {
+		name, key, ok := strings.Cut(ch, ":")
+		if ok {
+			a.setChannelKey(name, key)
+		}
+		out = append(out, name)
+	}
+	return out
+}
+
+func (a *API) channelKey(channel string) string {
+	a.joinMu.Lock()
+	defer a.joinMu.Unlock()
+	return a.channelKeys[strings.ToLower(channel)]
+}
+
+func (a *API) setChannelKey(channel, key string) {
+	a.joinMu.Lock()
+	defer a.joinMu.Unlock()
+	if key == "" {
+		delete(a.channelKeys, strings.ToLower(channel))
+		return
+	}
+	a.channelKeys[strings.ToLower(channel)] = key
+}
+
+// trackMembership updates the join state of channels when the server tells us
+// we have joined or left them.
+func (a *API) trackMembership(msg *chatlib.Message) {
+	if msg.Command == errBadChannelKey && len(msg.Params) > 1 {
+		log.Error().Str("api", ApiName).Msgf("wrong key for %s", msg.Params[1])
+		a.setJoinState(msg.Params[1], joinNone)
+		return
+	}
+	if msg.Command == "KICK" && len(msg.Params) > 1 && strings.EqualFold(msg.Params[1], a.nick) {
+		a.setJoinState(msg.Receiver, joinNone)
+		return
+	}
+	if !strings.EqualFold(msg.Nick, a.nick) {
+		return
+	}
+	switch msg.Command {
+	case "JOIN":
+		a.setJoinState(msg.Receiver, joinDone)
+	case "PART":
+		a.setJoinState(msg.Receiver, joinNone)
+	}
+}
+
+func (a *API) joinState(channel string) int {
+	a.joinMu.Lock()
+	defer a.joinMu.Unlock()
+	return a.joins[strings.ToLower(channel)]
+}
+
+func (a *API) setJoinState(channel string, state int) {
+	a.joinMu.Lock()
+	defer a.joinMu.Unlock()
+	if state == joinNone {
+		delete(a.joins, strings.ToLower(channel))
+		return
+	}
+	a.joins[strings.ToLower(channel)] = state
+}
+
+func (a *API) actionOnReady(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+	// Servers may send several 005 lines, only join once.
+	if a.joining {
+		return nil
+	}
+	a.joining = true
+	go a.startupJoin(c)
+	return nil
+}
+
+// channelState is the record of channels joined and parted at runtime that is
+// kept in the Store so it survives restarts.
+type channelState struct {
+	Joined []string `json:"joined"`
+	Parted []string `json:"parted"`
+	// Idle are the channels parted for being idle, see WithIdlePart.
+	Idle []string `json:"idle,omitempty"`
+	// Keys are the keys of channels in Joined that need one.
+	Keys map[string]string `json:"keys,omitempty"`
+}
+
+// UseStore implements chatlib.StoreUser.
+func (a *API) UseStore(s chatlib.Store) {
+	a.store = s
+}
+
+func (a *API) channelStateKey() string {
+	return ApiName + "/" + a.primaryHost() + "/channels"
+}
+
+func (a *API) loadChannelState(c context.Context) (*channelState, error) {
+	state := &channelState{}
+	if a.store == nil {
+		return state, nil
+	}
+	bts, err := a.store.Get(c, a.channelStateKey())
+	if errors.Is(err, chatlib.ErrNotFound) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bts, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (a *API) saveChannelState(c context.Context, state *channelState) error {
+	if a.store == nil {
+		return nil
+	}
+	bts, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return a.store.Set(c, a.channelStateKey(), bts)
+}
+
+// rememberJoin records a channel joined at runtime.
+func (a *API) rememberJoin(c context.Context, channel string) error {
+	state, err := a.loadChannelState(c)
+	if err != nil {
+		return err
+	}
+	state.Parted = withoutChannels(state.Parted, []string{channel})
+	state.Idle = withoutChannels(state.Idle, []string{channel})
+	if a.channelOrigin(channel) == "" && !containsChannel(state.Joined, channel) {
+		state.Joined = append(state.Joined, channel)
+	}
+	if key := a.channelKey(channel); key != "" && a.channelOrigin(channel) == "" {
+		if state.Keys == nil {
+			state.Keys = make(map[string]string)
+		}
+		state.Keys[strings.ToLower(channel)] = key
+	}
+	return a.saveChannelState(c, state)
+}
+
+// rememberPart records a channel parted at runtime.
+func (a *API) rememberPart(c context.Context, channel string) error {
+	state, err := a.loadChannelState(c)
+	if err != nil {
+		return err
+	}
+	state.Joined = withoutChannels(state.Joined, []string{channel})
+	state.Idle = withoutChannels(state.Idle, []string{channel})
+	delete(state.Keys, strings.ToLower(channel))
+	if a.channelOrigin(channel) != "" && !containsChannel(state.Parted, channel) {
+		state.Parted = append(state.Parted, channel)
+	}
+	return a.saveChannelState(c, state)
+}
+
+// channelOrigin returns which part of the static configuration a channel came
+// from, or an empty string if it isn't configured.
+func (a *API) channelOrigin(channel string) string {
+	switch {
+	case containsChannel(a.criticalChannels, channel):
+		return "critical"
+	case containsChannel(a.channels, channel):
+		return "config"
+	case containsChannel(a.lazyChannels, channel):
+		return "lazy"
+	}
+	return ""
+}
+
+func (a *API) actionListChannels(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+	state, err := a.loadChannelState(c)
+	if err != nil {
+		return err
+	}
+	all := append(append(append([]string{}, a.criticalChannels...), a.channels...), a.lazyChannels...)
+	all = append(all, state.Joined...)
+	entries := make([]string, 0, len(all))
+	for _, channel := range all {
+		origin := a.channelOrigin(channel)
+		if origin == "" {
+			origin = "runtime"
+		}
+		status := "joined"
+		if containsChannel(state.Parted, channel) {
+			status = "parted"
+		} else if containsChannel(state.Idle, channel) {
+			status = "parted for being idle"
+		} else if a.joinState(channel) != joinDone {
+			status = "not joined"
+		}
+		entries = append(entries, fmt.Sprintf("%s (%s, %s)", channel, origin, status))
+	}
+	text := "no channels"
+	if len(entries) > 0 {
+		text = strings.Join(entries, ", ")
+	}
+	return a.SendMessage(c, &chatlib.Message{
+		Command:  "PRIVMSG",
+		Receiver: msg.ReplyTarget(),
+		Text:     text,
+	})
+}
+
+func containsChannel(channels []string, channel string) bool {
+	for _, ch := range channels {
+		if strings.EqualFold(ch, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutChannels returns channels with every entry in exclude removed.
+func withoutChannels(channels, exclude []string) []string {
+	out := make([]string, 0, len(channels))
+	for _, ch := range channels {
+		if !containsChannel(exclude, ch) {
+			out = append(out, ch)
+		}
+	}
+	return out
+}
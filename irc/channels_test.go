@@ -0,0 +1,60 @@
+package irc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestChannelKeys(t *testing.T) {
+	c := context.Background()
+	a, err := New(
+		WithNick("bot"),
+		WithChannels([]string{"#open", "#secret:hunter2"}),
+		WithChannelKey("#other", "swordfish"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.channelOrigin("#secret") != "config" {
+		t.Fatalf("expected the key to be stripped from the channel, got %v", a.channels)
+	}
+	a.UseStore(chatlib.NewMemoryStore())
+	conn := &bufConn{}
+	a.conn = conn
+	for channel, expected := range map[string]string{
+		"#open":   "JOIN #open\n",
+		"#SECRET": "JOIN #SECRET hunter2\n",
+		"#other":  "JOIN #other swordfish\n",
+	} {
+		if err := a.joinChannel(c, channel); err != nil {
+			t.Fatal(err)
+		}
+		if line := conn.next(); line != expected {
+			t.Errorf("expected %q, got %q", expected, line)
+		}
+	}
+	if got := redact("JOIN #secret hunter2"); got != "JOIN #secret <redacted>" {
+		t.Errorf("expected the key to be redacted, got %q", got)
+	}
+
+	// Keys given to !join are remembered for the next connection
+	a.setChannelKey("#runtime", "opensesame")
+	if err := a.rememberJoin(c, "#runtime"); err != nil {
+		t.Fatal(err)
+	}
+	state, err := a.loadChannelState(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Keys["#runtime"] != "opensesame" {
+		t.Errorf("expected the key to be remembered, got %v", state.Keys)
+	}
+	if err := a.rememberPart(c, "#runtime"); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := a.loadChannelState(c); len(state.Keys) != 0 {
+		t.Errorf("expected the key to be forgotten, got %v", state.Keys)
+	}
+}
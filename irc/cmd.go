@@ -1,10 +1,12 @@
 package irc
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/gregseb/chatlib"
 	"github.com/pkg/errors"
@@ -13,6 +15,14 @@ import (
 	"github.com/spf13/viper"
 )
 
+func init() {
+	chatlib.RegisterModule(chatlib.Module{
+		Name:  ApiName,
+		Flags: Flags,
+		Init:  Init,
+	})
+}
+
 func Init() (*chatlib.Option, error) {
 	if !viper.GetBool(ApiName + ".enable") {
 		log.Info().Msg("IRC disabled")
@@ -60,8 +70,12 @@ func Init() (*chatlib.Option, error) {
 		authMethod = AuthMethodNone
 	case "nickserv":
 		authMethod = AuthMethodNickServ
-	case "sasl":
+	case "sasl", "sasl-plain":
 		authMethod = AuthMethodSASL
+	case "sasl-external":
+		authMethod = AuthMethodSASLExternal
+	case "sasl-scram-sha-256":
+		authMethod = AuthMethodSASLScramSHA256
 	case "certfp":
 		authMethod = AuthMethodCertFP
 	default:
@@ -70,14 +84,73 @@ func Init() (*chatlib.Option, error) {
 	log.Info().Str("api", ApiName).Msgf("auth method: %s", viper.GetString(ApiName+".auth-method"))
 
 	a, err := New(
-		WithNetwork(viper.GetString(ApiName+".server"), viper.GetInt(ApiName+".port")),
+		WithName(viper.GetString(ApiName+".name")),
+		WithNetwork(viper.GetString(ApiName+".server"), viper.GetInt(ApiName+".port"), viper.GetStringSlice(ApiName+".servers")...),
+		WithReconnect(viper.GetFloat64(ApiName+".reconnect-delay"), viper.GetFloat64(ApiName+".max-reconnect-delay")),
 		WithNick(viper.GetString(ApiName+".nick")),
+		WithAltNicks(viper.GetStringSlice(ApiName+".alt-nicks")),
+		WithRegainNick(viper.GetFloat64(ApiName+".regain-nick-interval")),
+		WithGhost(viper.GetBool(ApiName+".nickserv-ghost")),
+		WithIdentityRotation(viper.GetString(ApiName+".identity-rotation"), viper.GetStringSlice(ApiName+".identity-nicks"), viper.GetStringSlice(ApiName+".identity-usernames"), viper.GetStringSlice(ApiName+".identity-realnames")),
 		WithAuthMethod(authMethod),
+		WithOper(viper.GetString(ApiName+".oper-name"), viper.GetString(ApiName+".oper-password")),
+		WithCTCPVersion(viper.GetString(ApiName+".ctcp-version")),
+		WithCTCPIgnore(viper.GetStringSlice(ApiName+".ctcp-ignore")...),
+		WithAccount(viper.GetString(ApiName+".auth-account")),
 		WithPassword(viper.GetString(ApiName+".auth-password")),
+		WithCaps(viper.GetStringSlice(ApiName+".caps")...),
+		WithNickServ(viper.GetString(ApiName+".nickserv")),
+		WithNickServTimeout(viper.GetFloat64(ApiName+".nickserv-timeout")),
+		WithChanServ(viper.GetString(ApiName+".chanserv")),
+		WithInviteRequest(viper.GetString(ApiName+".invite-request")),
+		WithInviteRetries(viper.GetInt(ApiName+".invite-retries"), viper.GetFloat64(ApiName+".invite-retry-interval")),
+		WithInvitePolicy(viper.GetString(ApiName+".invite-policy"), viper.GetBool(ApiName+".invite-persist")),
+		WithAutoRejoin(viper.GetFloat64(ApiName+".rejoin-delay"), viper.GetInt(ApiName+".rejoin-attempts")),
+		WithListTimeout(viper.GetFloat64(ApiName+".list-timeout")),
+		WithListInterval(viper.GetFloat64(ApiName+".list-interval")),
+		WithListLimit(viper.GetInt(ApiName+".list-limit")),
+		WithWhowasTimeout(viper.GetFloat64(ApiName+".whowas-timeout")),
+		WithDCCAddress(viper.GetString(ApiName+".dcc-address")),
+		WithDCCPorts(viper.GetInt(ApiName+".dcc-first-port"), viper.GetInt(ApiName+".dcc-last-port")),
+		WithDCCPassive(viper.GetBool(ApiName+".dcc-passive")),
+		WithDCCTimeout(viper.GetFloat64(ApiName+".dcc-timeout")),
+		WithDCCMaxSize(viper.GetInt64(ApiName+".dcc-max-size")),
+		WithDCCAcceptChat(viper.GetBool(ApiName+".dcc-accept-chat")),
 		WithChannels(viper.GetStringSlice(ApiName+".channels")),
+		WithCriticalChannels(viper.GetStringSlice(ApiName+".critical-channels")),
+		WithLazyChannels(viper.GetStringSlice(ApiName+".lazy-channels")),
+		WithLazyJoinDelay(viper.GetFloat64(ApiName+".lazy-join-delay")),
+		WithIdlePart(viper.GetFloat64(ApiName+".idle-part")),
+		WithIdleExempt(viper.GetStringSlice(ApiName+".idle-exempt")),
 		WithDialTimeout(viper.GetFloat64(ApiName+".dial-timeout")),
+		WithProxy(viper.GetString(ApiName+".proxy")),
+		WithBouncer(viper.GetString(ApiName+".bouncer")),
+		WithSTS(viper.GetBool(ApiName+".sts")),
+		WithEchoMessage(viper.GetBool(ApiName+".echo-message")),
+		WithBatches(viper.GetStringSlice(ApiName+".batches")...),
+		WithPGP(viper.GetString(ApiName+".pgp")),
+		WithPGPAdminPolicy(viper.GetString(ApiName+".pgp-admins")),
+		WithPGPPeers(viper.GetStringSlice(ApiName+".pgp-peers")),
+		WithPGPKey(viper.GetString(ApiName+".pgp-key")),
+		WithPGPPassphrase(viper.GetString(ApiName+".pgp-passphrase")),
+		WithPGPFingerprints(viper.GetStringSlice(ApiName+".pgp-fingerprints")),
+		WithFiSHKeys(viper.GetStringSlice(ApiName+".fish-keys")),
 		WithKeepAlive(viper.GetFloat64(ApiName+".keepalive")),
+		WithPingInterval(viper.GetFloat64(ApiName+".ping-interval")),
+		WithPingTimeout(viper.GetFloat64(ApiName+".ping-timeout")),
+		WithAdaptivePing(viper.GetBool(ApiName+".adaptive-ping")),
+		WithWhoTimeout(viper.GetFloat64(ApiName+".who-timeout")),
+		WithWhoOnJoin(viper.GetBool(ApiName+".who-on-join")),
+		WithWatch(viper.GetStringSlice(ApiName+".watch")...),
+		WithIsonInterval(viper.GetFloat64(ApiName+".ison-interval")),
+		WithMaxPingInterval(viper.GetFloat64(ApiName+".max-ping-interval")),
 		WithMessageBufferSize(viper.GetInt(ApiName+".msg-buffer-size")),
+		WithFloodProfile(viper.GetString(ApiName+".flood-profile")),
+		WithSendRate(viper.GetFloat64(ApiName+".send-rate"), viper.GetInt(ApiName+".send-burst")),
+		WithCMessages(viper.GetBool(ApiName+".cmessages")),
+		WithStripFormatting(viper.GetBool(ApiName+".strip-formatting")),
+		WithEncoding(viper.GetString(ApiName+".encoding")),
+		WithFallbackEncoding(viper.GetString(ApiName+".fallback-encoding")),
 		WithTLS(t),
 	)
 	if err != nil {
@@ -88,26 +161,63 @@ func Init() (*chatlib.Option, error) {
 		return nil, errors.WithMessage(chatlib.ErrInvalidConfig, "irc: no server specified")
 	}
 	log.Info().Str("api", ApiName).Msgf("server: %s", a.networkHost)
+	if servers := viper.GetStringSlice(ApiName + ".servers"); len(servers) > 0 {
+		log.Info().Str("api", ApiName).Msgf("fallback servers: %v", servers)
+	}
 	if a.networkPort == 0 {
 		if a.tls != nil {
 			log.Info().Str("api", ApiName).Msgf("no port specified and tls is enabled, using default TLS port: %d", DefaultTlsPort)
-			a.networkPort = DefaultTlsPort
+			a.setDefaultPort(DefaultTlsPort)
 		} else {
 			log.Info().Str("api", ApiName).Msgf("no port specified and tls is disabled, using default plain port: %d", DefaultPlainPort)
-			a.networkPort = DefaultPlainPort
+			a.setDefaultPort(DefaultPlainPort)
 		}
 	} else {
 		log.Info().Str("api", ApiName).Msgf("port: %d", a.networkPort)
 	}
-	log.Info().Str("api", ApiName).Msgf("nick: %s", a.nick)
+	if authMethod == AuthMethodCertFP || authMethod == AuthMethodSASLExternal {
+		if a.CertFingerprint() == "" {
+			return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "irc: auth method %s requires tls and a client certificate", viper.GetString(ApiName+".auth-method"))
+		}
+		log.Info().Str("api", ApiName).Msgf("client certificate fingerprint: %s", a.CertFingerprint())
+	}
+	if a.rotatesIdentity() {
+		log.Info().Str("api", ApiName).Msgf("identity rotation: %s, nicks: %v", a.identityMode, a.identities.nicks)
+	} else {
+		log.Info().Str("api", ApiName).Msgf("nick: %s", a.nick)
+	}
+	if len(a.altNicks) > 0 && !a.rotatesIdentity() {
+		log.Info().Str("api", ApiName).Msgf("alternate nicks: %v", a.altNicks)
+	}
+	if p := a.throttle.profile; p.Rate > 0 {
+		log.Info().Str("api", ApiName).Msgf("send rate: %.2f lines a second, bursts of %d", p.Rate, p.Burst)
+	} else {
+		log.Info().Str("api", ApiName).Msg("send rate: unlimited")
+	}
+	if len(a.wantCaps) > 0 {
+		log.Info().Str("api", ApiName).Msgf("requesting capabilities: %v", a.wantCaps)
+	}
 	log.Info().Str("api", ApiName).Msgf("channels: %v", a.channels)
+	log.Info().Str("api", ApiName).Msgf("critical channels: %v", a.criticalChannels)
+	log.Info().Str("api", ApiName).Msgf("lazy channels: %v", a.lazyChannels)
 
-	chatOpt := chatlib.CombineOptions(
-		chatlib.WithAPI(a),
+	chatOpt := chatlib.WithAPI(a,
+		func(h *chatlib.Handler) error {
+			return a.ApplyOptions(
+				WithAdminNotifier(func(c context.Context, text string) {
+					h.NotifyAdmins(c, a.name, text)
+				}),
+				WithAdminCheck(h.IsAdmin),
+			)
+		},
 		chatlib.RegisterAction("005", "", "", "", a.actionOnReady),
-		chatlib.RegisterAction("PRIVMSG", "!join (.*)", "!join #channel", "Join the specified channel", a.actionJoinChannel, chatlib.RoleAdmin),
+		chatlib.RegisterAction("PRIVMSG", "!join (.*)", "!join #channel [key]", "Join the specified channel", a.actionJoinChannel, chatlib.RoleAdmin),
 		chatlib.RegisterAction("PRIVMSG", "!(part|leave)( (.*))?", "!part #channel", "leave the specified channel", a.actionLeaveChannel, chatlib.RoleAdmin),
+		chatlib.RegisterAction("PRIVMSG", "^!channels$", "!channels", "list channels and where they were configured", a.actionListChannels, chatlib.RoleAdmin),
 		chatlib.RegisterAction("PRIVMSG", "!ping", "!ping", "ping the server and ask for a pong", a.actionPing),
+		chatlib.RegisterAction("PRIVMSG", "^!lag$", "!lag", "measure the round trip time to the server", a.actionLag),
+		chatlib.RegisterAction("PRIVMSG", `^!pgp (\w+)(.*)$`, "!pgp fingerprint|key|status|trust nick fingerprint|distrust nick|start nick", "manage the OpenPGP encryption of private messages", a.actionPGP, chatlib.RoleAdmin),
+		chatlib.RegisterAction("PRIVMSG", `^!seen (\S+)$`, "!seen nick", "tell whether a user is online, or when they were last seen", a.actionSeen),
 	)
 
 	return &chatOpt, nil
@@ -116,22 +226,148 @@ func Init() (*chatlib.Option, error) {
 func Flags(cmd *cobra.Command) {
 	// Enable
 	cmd.Flags().Bool(ApiName+"-enable", true, "Enable IRC")
+	// Name
+	cmd.Flags().String(ApiName+"-name", ApiName, "Name the bot knows this IRC network by. Messages and replies are routed by it")
 	// Server
 	cmd.Flags().String(ApiName+"-server", "", "IRC server to connect to. Required")
 	// Port
 	cmd.Flags().Int(ApiName+"-port", 0, "IRC server port to connect to. If not specified, defaults to 6697 if TLS is enabled, otherwise 6667")
+	// Servers
+	cmd.Flags().StringSlice(ApiName+"-servers", []string{}, "Other servers of the IRC network, as host:port or host for the default port, to fail over to in turn")
+	// ReconnectDelaySeconds
+	cmd.Flags().Float64(ApiName+"-reconnect-delay", DefaultReconnectDelaySeconds, "Seconds to wait before reconnecting after the connection to the IRC server is lost, doubled each time every server failed. 0 doesn't reconnect")
+	// MaxReconnectDelaySeconds
+	cmd.Flags().Float64(ApiName+"-max-reconnect-delay", DefaultMaxReconnectDelaySeconds, "Longest wait in seconds between attempts to reconnect")
 	// Nick
 	cmd.Flags().String(ApiName+"-nick", "freyabot", "IRC nick to use")
+	// AltNicks
+	cmd.Flags().StringSlice(ApiName+"-alt-nicks", []string{}, "IRC nicks to fall back to, in order, if the nick is in use. Underscores are appended to the nick once they are used up")
+	// IdentityRotation
+	cmd.Flags().String(ApiName+"-identity-rotation", IdentityFixed, "How to choose the nick, username and realname on each connection, one of: fixed, rotate, random. rotate and random use the identity pools and can't be combined with authentication")
+	// IdentityNicks
+	cmd.Flags().StringSlice(ApiName+"-identity-nicks", []string{}, "Nicks to choose from when rotating identities")
+	// IdentityUsernames
+	cmd.Flags().StringSlice(ApiName+"-identity-usernames", []string{}, "Usernames to choose from when rotating identities. The nick is used if empty")
+	// IdentityRealnames
+	cmd.Flags().StringSlice(ApiName+"-identity-realnames", []string{}, "Realnames to choose from when rotating identities. The nick is used if empty")
+	// RegainNickSeconds
+	cmd.Flags().Float64(ApiName+"-regain-nick-interval", DefaultRegainNickSeconds, "Seconds between attempts to get the nick back while using an alternate one. 0 only tries when its holder leaves")
+	// NickServGhost
+	cmd.Flags().Bool(ApiName+"-nickserv-ghost", false, "Ask NickServ to disconnect whoever is using the nick before trying to get it back. Requires auth-method nickserv")
 	// AuthMethod
-	cmd.Flags().String(ApiName+"-auth-method", "none", "IRC authentication method, one of: none, sasl, nickserv, certfp.")
+	cmd.Flags().String(ApiName+"-auth-method", "none", "IRC authentication method, one of: none, nickserv, certfp, sasl-plain, sasl-external, sasl-scram-sha-256. sasl is an alias for sasl-plain")
+	// AuthAccount
+	cmd.Flags().String(ApiName+"-auth-account", "", "IRC account name for SASL and NickServ authentication. Defaults to the nick")
 	// AuthPassword
-	cmd.Flags().String(ApiName+"-auth-password", "", "IRC authentication password. Required if auth-method is nickserv or sasl")
+	cmd.Flags().String(ApiName+"-auth-password", "", "IRC authentication password. Required if auth-method is nickserv, sasl-plain or sasl-scram-sha-256")
+	// Caps
+	cmd.Flags().StringSlice(ApiName+"-caps", []string{}, "Extra IRCv3 capabilities to request from the server, for plugins that use them")
+	// OperName
+	cmd.Flags().String(ApiName+"-oper-name", "", "Name to log in as an IRC operator with after registering. Disabled if empty")
+	// OperPassword
+	cmd.Flags().String(ApiName+"-oper-password", "", "Password to log in as an IRC operator with")
+	// CTCPVersion
+	cmd.Flags().String(ApiName+"-ctcp-version", DefaultCTCPVersion, "Reply to CTCP VERSION. VERSION is not answered if empty")
+	// CTCPIgnore
+	cmd.Flags().StringSlice(ApiName+"-ctcp-ignore", []string{}, "CTCP requests not to answer, e.g. TIME")
+	// NickServ
+	cmd.Flags().String(ApiName+"-nickserv", DefaultNickServ, "Name of the NickServ service used when auth-method is nickserv")
+	// NickServTimeoutSeconds
+	cmd.Flags().Int(ApiName+"-nickserv-timeout", DefaultNickServTimeoutSeconds, "Seconds to wait for NickServ to accept the password before joining channels anyway")
+	// ChanServ
+	cmd.Flags().String(ApiName+"-chanserv", DefaultChanServ, "Name of the ChanServ service asked for invites")
+	// InviteRequest
+	cmd.Flags().String(ApiName+"-invite-request", DefaultInviteRequest, "How to ask for an invite to configured channels that are invite only, one of: auto, knock, chanserv, none. auto knocks if the server supports it")
+	// InviteRetries
+	cmd.Flags().Int(ApiName+"-invite-retries", DefaultInviteRetries, "Times to ask for an invite to a channel before giving up and telling the admins")
+	// InviteRetrySeconds
+	cmd.Flags().Float64(ApiName+"-invite-retry-interval", DefaultInviteRetrySeconds, "Seconds to wait for an invite before asking again")
+	// RejoinDelaySeconds
+	cmd.Flags().Float64(ApiName+"-rejoin-delay", DefaultRejoinDelaySeconds, "Seconds to wait before rejoining a configured channel after being kicked")
+	// RejoinAttempts
+	cmd.Flags().Int(ApiName+"-rejoin-attempts", 0, "Kicks in a row from a channel after which the bot stays out and tells the admins. 0 disables rejoining")
+	// InvitePolicy
+	cmd.Flags().String(ApiName+"-invite-policy", DefaultInvitePolicy, "What to do when invited to a channel, one of: ignore, admin, any. admin joins if the invite is from one of the admins")
+	// InvitePersist
+	cmd.Flags().Bool(ApiName+"-invite-persist", false, "Remember channels joined by invite and rejoin them on reconnect")
+	// ListTimeoutSeconds
+	cmd.Flags().Float64(ApiName+"-list-timeout", DefaultListTimeoutSeconds, "Seconds to wait for the server to finish listing its channels")
+	// ListIntervalSeconds
+	cmd.Flags().Float64(ApiName+"-list-interval", DefaultListIntervalSeconds, "Least seconds between two requests for the server's channel list")
+	// ListLimit
+	cmd.Flags().Int(ApiName+"-list-limit", DefaultListLimit, "Most channels a channel search returns, the busiest ones. 0 is unlimited")
+	// WhowasTimeout
+	cmd.Flags().Float64(ApiName+"-whowas-timeout", DefaultWhowasTimeoutSeconds, "Seconds to wait for the server to answer WHOWAS, used by !seen")
+	// DCCAddress
+	cmd.Flags().String(ApiName+"-dcc-address", "", "IP address given to users for DCC, e.g. the public address of a bot behind NAT. The address of the connection to the server if empty")
+	// DCCFirstPort
+	cmd.Flags().Int(ApiName+"-dcc-first-port", 0, "First port listened on for DCC. 0 uses any free port")
+	// DCCLastPort
+	cmd.Flags().Int(ApiName+"-dcc-last-port", 0, "Last port listened on for DCC")
+	// DCCPassive
+	cmd.Flags().Bool(ApiName+"-dcc-passive", false, "Send files with passive DCC, connecting to the receiver, for bots that can't be connected to")
+	// DCCTimeout
+	cmd.Flags().Float64(ApiName+"-dcc-timeout", DefaultDCCTimeoutSeconds, "Seconds to wait for the other side of a DCC to connect, and for a stalled transfer")
+	// DCCMaxSize
+	cmd.Flags().Int64(ApiName+"-dcc-max-size", DefaultDCCMaxSize, "Largest file received with DCC, in bytes. 0 is unlimited")
+	// DCCAcceptChat
+	cmd.Flags().Bool(ApiName+"-dcc-accept-chat", false, "Accept DCC CHATs offered to the bot, private conversations that don't go through the server")
 	// Channels
 	cmd.Flags().StringSlice(ApiName+"-channels", []string{}, "IRC channels to join")
+	// CriticalChannels
+	cmd.Flags().StringSlice(ApiName+"-critical-channels", []string{}, "IRC channels to join before any others. The bot is not ready until these are joined")
+	// LazyChannels
+	cmd.Flags().StringSlice(ApiName+"-lazy-channels", []string{}, "IRC channels to join after the lazy join delay, or when first sent a message")
+	// LazyJoinDelaySeconds
+	cmd.Flags().Int(ApiName+"-lazy-join-delay", DefaultLazyJoinDelaySeconds, "Seconds to wait after startup before joining lazy IRC channels")
+	// IdlePartHours
+	cmd.Flags().Float64(ApiName+"-idle-part", 0, "Hours without anything said in an IRC channel before parting it, telling the admins. It is rejoined with !join or when the bot has something to say there. 0 disables it")
+	// IdleExempt
+	cmd.Flags().StringSlice(ApiName+"-idle-exempt", []string{}, "IRC channels never parted for being idle, in addition to the critical channels")
 	// DialTimeoutSeconds
 	cmd.Flags().Int(ApiName+"-dial-timeout", 10, "IRC dial timeout in seconds")
+	// Proxy
+	cmd.Flags().String(ApiName+"-proxy", "", "Proxy to connect to the IRC server through, e.g. socks5://127.0.0.1:9050 for Tor or http://host:3128")
+	// Bouncer
+	cmd.Flags().String(ApiName+"-bouncer", BouncerNone, "Bouncer the bot connects through, whose played back history is marked as replayed, one of: none, znc")
+	// STS
+	cmd.Flags().Bool(ApiName+"-sts", true, "Honor the strict transport security policies of IRC servers, upgrading to TLS and refusing plaintext while they last")
+	// Batches
+	cmd.Flags().StringSlice(ApiName+"-batches", DefaultBatchTypes, "IRCv3 batch types delivered as a single BATCHED message once they end, rather than line by line")
+	// PGP
+	cmd.Flags().String(ApiName+"-pgp", PGPOff, "OpenPGP encryption of IRC private messages, one of: off, opportunistic, required. opportunistic encrypts to nicks that sent their public key, required refuses plaintext and messages not signed with a trusted key")
+	// PGPAdmins
+	cmd.Flags().String(ApiName+"-pgp-admins", "", "PGP policy of the admins, e.g. required so admin commands are only taken encrypted. The pgp policy applies if empty")
+	// PGPPeers
+	cmd.Flags().StringSlice(ApiName+"-pgp-peers", []string{}, "PGP policies of IRC nicks, as nick=policy")
+	// PGPKey
+	cmd.Flags().String(ApiName+"-pgp-key", "", "Armored OpenPGP private key file to use for PGP. A key is generated and kept in the store, encrypted with pgp-passphrase, if empty")
+	// PGPPassphrase
+	cmd.Flags().String(ApiName+"-pgp-passphrase", "", "Passphrase the PGP key is encrypted with, needed to keep a generated key in the store")
+	// PGPFingerprints
+	cmd.Flags().StringSlice(ApiName+"-pgp-fingerprints", []string{}, "PGP key fingerprints to trust, as nick=fingerprint. More are trusted with !pgp trust")
+	// FiSHKeys
+	cmd.Flags().StringSlice(ApiName+"-fish-keys", []string{}, "FiSH (mircryption) Blowfish keys of IRC channels or nicks whose messages are encrypted, as target=key, or target=cbc:key for the CBC mode of FiSH 10")
+	// EchoMessage
+	cmd.Flags().Bool(ApiName+"-echo-message", true, "Have IRC servers with echo-message send the bot's messages back as delivered, for modules logging or bridging what the bot says")
 	// KeepAliveSeconds
 	cmd.Flags().Int(ApiName+"-keepalive", 60, "IRC keepalive interval in seconds")
+	// PingIntervalSeconds
+	cmd.Flags().Float64(ApiName+"-ping-interval", DefaultPingIntervalSeconds, "Seconds without receiving anything from the IRC server before PINGing it to measure the lag and check the connection. 0 disables the checks")
+	// WhoTimeoutSeconds
+	cmd.Flags().Float64(ApiName+"-who-timeout", DefaultWhoTimeoutSeconds, "Seconds to wait for the IRC server to answer WHO")
+	// WhoOnJoin
+	cmd.Flags().Bool(ApiName+"-who-on-join", true, "Send a WHO for every IRC channel joined, learning the users, hosts and, where WHOX is supported, accounts of its members at once")
+	// Watch
+	cmd.Flags().StringSlice(ApiName+"-watch", []string{}, "IRC nicks to watch, receiving PRESENCE messages when they come online or go offline")
+	// IsonIntervalSeconds
+	cmd.Flags().Float64(ApiName+"-ison-interval", DefaultIsonIntervalSeconds, "Seconds between asking for watched nicks with ISON, on IRC servers without MONITOR. 0 disables it")
+	// AdaptivePing
+	cmd.Flags().Bool(ApiName+"-adaptive-ping", true, "Learn how often the IRC server PINGs the bot and only PING it when the server's PING is overdue, in place of the ping interval")
+	// MaxPingIntervalSeconds
+	cmd.Flags().Float64(ApiName+"-max-ping-interval", DefaultMaxPingIntervalSeconds, "Longest ping interval in seconds adaptive pings may learn")
+	// PingTimeoutSeconds
+	cmd.Flags().Float64(ApiName+"-ping-timeout", DefaultPingTimeoutSeconds, "Seconds the IRC server has to answer a PING, plus four times the average lag, before the connection is reported dead")
 	// TLS
 	cmd.Flags().Bool(ApiName+"-no-tls", false, "Disable TLS for IRC. Take note of the port you are connecting to and be sure to read the server's documentation")
 	// TLSCaCert
@@ -144,4 +380,18 @@ func Flags(cmd *cobra.Command) {
 	cmd.Flags().Bool(ApiName+"-tls-insecure-skip-verify", false, "IRC TLS insecure skip verify")
 	// MsgBufferSize
 	cmd.Flags().Int(ApiName+"-msg-buffer-size", 100, "IRC message buffer size")
+	// FloodProfile
+	cmd.Flags().String(ApiName+"-flood-profile", DefaultFloodProfile, "IRC send rate preset for the network: "+strings.Join(FloodProfileNames(), ", "))
+	// SendRate
+	cmd.Flags().Float64(ApiName+"-send-rate", 0, "IRC lines a second to send at most, on average. Overrides the flood profile if set")
+	// SendBurst
+	cmd.Flags().Int(ApiName+"-send-burst", 5, "IRC lines that may be sent at once before send-rate applies")
+	// CMessages
+	cmd.Flags().Bool(ApiName+"-cmessages", true, "IRC send private messages with CPRIVMSG and CNOTICE where the server supports them and the bot has voice or ops in a shared channel")
+	// StripFormatting
+	cmd.Flags().Bool(ApiName+"-strip-formatting", false, "IRC strip colors, bold and other formatting from received messages before matching them against actions")
+	// Encoding
+	cmd.Flags().String(ApiName+"-encoding", EncodingUTF8, "IRC encoding to send text in, one of: "+strings.Join(EncodingNames(), ", "))
+	// FallbackEncoding
+	cmd.Flags().String(ApiName+"-fallback-encoding", DefaultFallbackEncoding, "IRC encoding to read received text in where it isn't valid UTF-8, one of: "+strings.Join(EncodingNames(), ", ")+". With utf-8, invalid bytes are replaced")
 }
@@ -0,0 +1,53 @@
+package irc
+
+import (
+	"github.com/gregseb/chatlib"
+)
+
+// WithCMessages sets whether private messages and notices are sent with
+// CPRIVMSG and CNOTICE when the server supports them. They let a user with
+// ops or voice in a channel message its members without being held back by
+// the server's target change limits, which matters to modules notifying many
+// users. On by default.
+func WithCMessages(enable bool) Option {
+	return func(a *API) error {
+		a.cmessages = enable
+		return nil
+	}
+}
+
+// cmessage rewrites a private PRIVMSG or NOTICE to msg's target as CPRIVMSG
+// or CNOTICE if the server supports it and the bot has a membership prefix,
+// voice or better, in a channel the target is in. Other messages are
+// returned as they are.
+func (a *API) cmessage(msg *chatlib.Message) *chatlib.Message {
+	if !a.cmessages || (msg.Command != "PRIVMSG" && msg.Command != "NOTICE") || a.isChannel(msg.Receiver) {
+		return msg
+	}
+	if _, ok := a.isupport("C" + msg.Command); !ok {
+		return msg
+	}
+	channel := a.sharedChannel(msg.Receiver)
+	if channel == "" {
+		return msg
+	}
+	cmsg := *msg
+	cmsg.Command = "C" + msg.Command
+	cmsg.Receiver = msg.Receiver + " " + channel
+	return &cmsg
+}
+
+// sharedChannel returns a channel that nick is in and the bot has voice or
+// better in, or an empty string if there is none.
+func (a *API) sharedChannel(nick string) string {
+	fold := a.folder()
+	a.memberMu.Lock()
+	defer a.memberMu.Unlock()
+	me, them := fold(a.nick), fold(nick)
+	for _, ch := range a.chans {
+		if _, ok := ch.members[them]; ok && ch.members[me] != nil && ch.members[me].Prefixes != "" {
+			return ch.name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,70 @@
+package irc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestCMessages(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	receive := func(line string) {
+		t.Helper()
+		a.rawMsgs <- []byte(line)
+		if _, err := a.ReceiveMessage(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send := func(command, receiver, expected string) {
+		t.Helper()
+		if err := a.SendMessage(c, &chatlib.Message{Command: command, Receiver: receiver, Text: "hi"}); err != nil {
+			t.Fatal(err)
+		}
+		if line := conn.next(); line != expected {
+			t.Errorf("expected %q, got %q", expected, line)
+		}
+	}
+
+	receive(":irc.example.net 005 bot PREFIX=(qov)~@+ CHANMODES=b,k,l,imnt :are supported by this server\r\n")
+	receive(":bot!u@h JOIN #test\r\n")
+	if line := conn.next(); line != "MODE #test\n" {
+		t.Fatalf("expected the channel modes to be asked for, got %q", line)
+	}
+	if line := conn.next(); line != "WHO #test\n" {
+		t.Fatalf("expected the channel's members to be asked for, got %q", line)
+	}
+	receive(":irc.example.net 353 bot = #test :bot @op foo +bar\r\n")
+	// Not advertised yet
+	send("PRIVMSG", "foo", "PRIVMSG foo :hi\n")
+
+	receive(":irc.example.net 005 bot CPRIVMSG CNOTICE :are supported by this server\r\n")
+	// No voice yet
+	send("PRIVMSG", "foo", "PRIVMSG foo :hi\n")
+
+	receive(":op!u@h MODE #test +kv key bot\r\n")
+	send("PRIVMSG", "foo", "CPRIVMSG foo #test :hi\n")
+	send("NOTICE", "bar", "CNOTICE bar #test :hi\n")
+	send("PRIVMSG", "#test", "PRIVMSG #test :hi\n")
+	send("PRIVMSG", "stranger", "PRIVMSG stranger :hi\n")
+
+	receive(":foo!u@h NICK :foo2\r\n")
+	send("PRIVMSG", "foo2", "CPRIVMSG foo2 #test :hi\n")
+	receive(":foo2!u@h PART #test\r\n")
+	send("PRIVMSG", "foo2", "PRIVMSG foo2 :hi\n")
+
+	receive(":op!u@h MODE #test -v bot\r\n")
+	send("NOTICE", "bar", "NOTICE bar :hi\n")
+
+	if err := WithCMessages(false)(a); err != nil {
+		t.Fatal(err)
+	}
+	receive(":op!u@h MODE #test +o bot\r\n")
+	send("NOTICE", "bar", "NOTICE bar :hi\n")
+}
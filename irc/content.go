@@ -0,0 +1,13 @@
+package irc
+
+import (
+	"github.com/gregseb/chatlib"
+)
+
+var _ chatlib.FilterUser = (*API)(nil)
+
+// UseOutboundFilter applies f to every message sent, those of the API's own
+// actions, such as !pgp and CTCP replies, included.
+func (a *API) UseOutboundFilter(f chatlib.OutboundFilter) {
+	a.filter = f
+}
@@ -0,0 +1,58 @@
+package irc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestOutboundFilter(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mask, err := chatlib.NewContentPolicy(chatlib.PolicyMask, chatlib.DefaultPatternLimits, "bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := chatlib.NewContentPolicy(chatlib.PolicyBlock, chatlib.DefaultPatternLimits, "bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chatlib.New(chatlib.WithAPI(a), chatlib.WithContentPolicy("", mask), chatlib.WithContentPolicy("#kids", block)); err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+
+	// What the API sends of its own is filtered like the Handler's messages
+	if err := a.SendMessage(c, &chatlib.Message{Command: "PRIVMSG", Receiver: "#test", Text: "a bad word"}); err != nil {
+		t.Fatal(err)
+	}
+	if line := conn.next(); line != "PRIVMSG #test :a *** word\n" {
+		t.Errorf("expected the message masked, got %q", line)
+	}
+	if err := a.SendAction(c, "#test", "does something bad"); err != nil {
+		t.Fatal(err)
+	}
+	if line := conn.next(); line != "PRIVMSG #test :\x01ACTION does something ***\x01\n" {
+		t.Errorf("expected the action masked, got %q", line)
+	}
+	if err := a.SendMessage(c, &chatlib.Message{Command: "NOTICE", Receiver: "#kids", Text: "bad"}); !errors.Is(err, chatlib.ErrBlockedContent) {
+		t.Errorf("expected the notice blocked, got %v", err)
+	}
+	if line := conn.next(); line != "" {
+		t.Errorf("expected nothing sent, got %q", line)
+	}
+
+	// Services are told exactly what the bot says, passwords included
+	if err := a.SendMessage(c, &chatlib.Message{Command: "PRIVMSG", Receiver: "nickserv", Text: "IDENTIFY bot badpassword"}); err != nil {
+		t.Fatal(err)
+	}
+	if line := conn.next(); line != "PRIVMSG nickserv :IDENTIFY bot badpassword\n" {
+		t.Errorf("expected the message to NickServ unfiltered, got %q", line)
+	}
+}
@@ -0,0 +1,202 @@
+package irc
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/rs/zerolog/log"
+)
+
+// Commands given to CTCP messages, so actions can be registered for them.
+// The text is the CTCP verb followed by its arguments, without the \x01
+// delimiters.
+const (
+	CommandCTCP      = "CTCP"
+	CommandCTCPReply = "CTCPREPLY"
+)
+
+const (
+	DefaultCTCPVersion = "chatlib IRC bot"
+	// ctcpDelimiter wraps CTCP messages.
+	ctcpDelimiter = "\x01"
+	// ctcpInterval is the least time between two automatic CTCP replies, so
+	// CTCP floods can't fill the send queue.
+	ctcpInterval = time.Second
+)
+
+// AnnotationCTCP holds the decoded verb and arguments of CTCP and CTCPREPLY
+// messages.
+var AnnotationCTCP = chatlib.NewAnnotationKey[*CTCP]("irc.ctcp")
+
+// CTCP is a decoded CTCP request or reply.
+type CTCP struct {
+	// Verb is the CTCP command in upper case, e.g. VERSION.
+	Verb string
+	Args string
+}
+
+// CTCPFunc answers a CTCP request with the arguments of the reply. An empty
+// reply sends nothing.
+type CTCPFunc func(c context.Context, msg *chatlib.Message, args string) (string, error)
+
+// WithCTCPVersion sets the reply to CTCP VERSION. An empty version doesn't
+// answer VERSION at all.
+func WithCTCPVersion(version string) Option {
+	if version == "" {
+		return WithCTCPHandler("VERSION", nil)
+	}
+	return WithCTCPHandler("VERSION", func(c context.Context, msg *chatlib.Message, args string) (string, error) {
+		return version, nil
+	})
+}
+
+// WithCTCPHandler answers CTCP requests for verb with fn, replacing the
+// built in VERSION, PING, TIME and CLIENTINFO replies. A nil fn leaves verb
+// unanswered.
+func WithCTCPHandler(verb string, fn CTCPFunc) Option {
+	return func(a *API) error {
+		verb = strings.ToUpper(verb)
+		if fn == nil {
+			delete(a.ctcpHandlers, verb)
+		} else {
+			a.ctcpHandlers[verb] = fn
+		}
+		return nil
+	}
+}
+
+// WithCTCPIgnore leaves CTCP requests for verbs unanswered, e.g. TIME to not
+// give away the bot's time zone.
+func WithCTCPIgnore(verbs ...string) Option {
+	return func(a *API) error {
+		for _, verb := range verbs {
+			if err := WithCTCPHandler(verb, nil)(a); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// defaultCTCPHandlers returns the built in CTCP replies.
+func (a *API) defaultCTCPHandlers() map[string]CTCPFunc {
+	return map[string]CTCPFunc{
+		"VERSION": func(c context.Context, msg *chatlib.Message, args string) (string, error) {
+			return DefaultCTCPVersion, nil
+		},
+		"PING": func(c context.Context, msg *chatlib.Message, args string) (string, error) {
+			return args, nil
+		},
+		"TIME": func(c context.Context, msg *chatlib.Message, args string) (string, error) {
+			return time.Now().Format(time.RFC1123Z), nil
+		},
+		"CLIENTINFO": func(c context.Context, msg *chatlib.Message, args string) (string, error) {
+			verbs := make([]string, 0, len(a.ctcpHandlers))
+			for verb := range a.ctcpHandlers {
+				verbs = append(verbs, verb)
+			}
+			sort.Strings(verbs)
+			return strings.Join(verbs, " "), nil
+		},
+	}
+}
+
+// SendAction sends text to target as an action, like /me does.
+func (a *API) SendAction(c context.Context, target, text string) error {
+	return a.SendMessage(c, &chatlib.Message{Command: chatlib.CommandAction, Receiver: target, Text: text})
+}
+
+// sendAction sends an ACTION message as CTCP ACTION PRIVMSGs, one per line of
+// its text, splitting lines too long for the server.
+func (a *API) sendAction(c context.Context, msg *chatlib.Message) error {
+	limit := maxLineBytes - len("\r\n") - len("PRIVMSG "+msg.Receiver+" :") - len(a.nick) - maxSourceBytes - len(encodeCTCP("ACTION", " "))
+	if key := a.fishKeyFor(msg.Receiver); key != nil {
+		limit = key.plainLimit(limit)
+	}
+	for _, l := range a.fitText(c, msg.Text, limit) {
+		text := strings.TrimRight(l.text, " ")
+		if text == "" {
+			continue
+		}
+		m := *msg
+		m.Command, m.Text = "PRIVMSG", encodeCTCP("ACTION", text)
+		if err := a.SendMessage(c, &m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendCTCP sends a CTCP request for verb to target.
+func (a *API) SendCTCP(c context.Context, target, verb, args string) error {
+	return a.SendMessage(c, &chatlib.Message{Command: "PRIVMSG", Receiver: target, Text: encodeCTCP(verb, args)})
+}
+
+// decodeCTCP splits text wrapped in \x01 into its verb and arguments. The
+// closing \x01 is optional, as some clients leave it out.
+func decodeCTCP(text string) (string, string, bool) {
+	inner, ok := strings.CutPrefix(text, ctcpDelimiter)
+	if !ok {
+		return "", "", false
+	}
+	inner = strings.TrimSuffix(inner, ctcpDelimiter)
+	verb, args, _ := strings.Cut(inner, " ")
+	if verb == "" {
+		return "", "", false
+	}
+	return strings.ToUpper(verb), args, true
+}
+
+func encodeCTCP(verb, args string) string {
+	if args == "" {
+		return ctcpDelimiter + verb + ctcpDelimiter
+	}
+	return ctcpDelimiter + verb + " " + args + ctcpDelimiter
+}
+
+// handleCTCP decodes CTCP requests and replies and answers the requests the
+// bot has a handler for. Actions become messages of their own, with the
+// emote as their text.
+func (a *API) handleCTCP(c context.Context, msg *chatlib.Message) {
+	if msg.Command != "PRIVMSG" && msg.Command != "NOTICE" {
+		return
+	}
+	verb, args, ok := decodeCTCP(msg.Text)
+	if !ok {
+		return
+	}
+	if verb == "ACTION" && msg.Command == "PRIVMSG" {
+		msg.Command, msg.Text = chatlib.CommandAction, args
+		return
+	}
+	AnnotationCTCP.Set(msg, &CTCP{Verb: verb, Args: args})
+	msg.Text = strings.TrimSpace(verb + " " + args)
+	if msg.Command == "NOTICE" {
+		msg.Command = CommandCTCPReply
+		return
+	}
+	msg.Command = CommandCTCP
+	fn, ok := a.ctcpHandlers[verb]
+	if !ok || msg.Nick == "" || msg.Replayed || strings.EqualFold(msg.Nick, a.nick) {
+		return
+	}
+	if time.Since(a.lastCTCPReply) < ctcpInterval {
+		log.Debug().Str("api", ApiName).Str("nick", msg.Nick).Msgf("not answering CTCP %s, replied too recently", verb)
+		return
+	}
+	reply, err := fn(c, msg, args)
+	if err != nil {
+		log.Error().Str("api", ApiName).Str("nick", msg.Nick).Err(err).Msgf("error answering CTCP %s", verb)
+		return
+	}
+	if reply == "" {
+		return
+	}
+	a.lastCTCPReply = time.Now()
+	if err := a.SendMessage(c, &chatlib.Message{Command: "NOTICE", Receiver: msg.Nick, Text: encodeCTCP(verb, reply)}); err != nil {
+		log.Error().Str("api", ApiName).Str("nick", msg.Nick).Err(err).Msgf("error sending CTCP %s reply", verb)
+	}
+}
@@ -0,0 +1,98 @@
+package irc
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestCTCP(t *testing.T) {
+	c := context.Background()
+	a, err := New(
+		WithNick("bot"),
+		WithCTCPVersion("freyabot 1.0"),
+		WithCTCPIgnore("time"),
+		WithCTCPHandler("SOURCE", func(c context.Context, msg *chatlib.Message, args string) (string, error) {
+			return "https://github.com/gregseb/chatlib", nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	for _, tc := range []struct {
+		line     string
+		command  string
+		text     string
+		expected string
+	}{
+		{":alice!a@host PRIVMSG bot :\x01VERSION\x01\r\n", CommandCTCP, "VERSION", "NOTICE alice :\x01VERSION freyabot 1.0\x01\n"},
+		{":alice!a@host PRIVMSG bot :\x01PING 12345\x01\r\n", CommandCTCP, "PING 12345", "NOTICE alice :\x01PING 12345\x01\n"},
+		{":alice!a@host PRIVMSG bot :\x01TIME\x01\r\n", CommandCTCP, "TIME", ""},
+		{":bob!b@host PRIVMSG #chan :\x01clientinfo\r\n", CommandCTCP, "CLIENTINFO", "NOTICE bob :\x01CLIENTINFO CLIENTINFO PING SOURCE VERSION\x01\n"},
+		{":bob!b@host NOTICE bot :\x01VERSION irssi\x01\r\n", CommandCTCPReply, "VERSION irssi", ""},
+		{":bob!b@host PRIVMSG #chan :hello\r\n", "PRIVMSG", "hello", ""},
+		{":bob!b@host PRIVMSG #chan :\x01ACTION waves\x01\r\n", chatlib.CommandAction, "waves", ""},
+	} {
+		a.lastCTCPReply = a.lastCTCPReply.Add(-ctcpInterval)
+		a.rawMsgs <- []byte(tc.line)
+		msg, err := a.ReceiveMessage(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Command != tc.command || msg.Text != tc.text {
+			t.Errorf("%q: expected %s %q, got %s %q", tc.line, tc.command, tc.text, msg.Command, msg.Text)
+		}
+		if line := conn.next(); line != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.line, tc.expected, line)
+		}
+	}
+	// Replies are limited to one a second
+	for i := 0; i < 2; i++ {
+		a.rawMsgs <- []byte(":alice!a@host PRIVMSG bot :\x01PING 1\x01\r\n")
+		if _, err := a.ReceiveMessage(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := strings.Count(conn.String(), "\n"); n != 1 {
+		t.Errorf("expected 1 reply to a CTCP flood, got %d", n)
+	}
+	conn.Reset()
+	if err := a.SendAction(c, "#chan", "waves\nand leaves"); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"PRIVMSG #chan :\x01ACTION waves\x01\n", "PRIVMSG #chan :\x01ACTION and leaves\x01\n"} {
+		if line := conn.next(); line != expected {
+			t.Errorf("expected %q, got %q", expected, line)
+		}
+	}
+}
+
+func TestStripFormatting(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"), WithStripFormatting(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.conn = &bufConn{}
+	for _, tc := range []struct{ line, command, text string }{
+		{":bob!b@host PRIVMSG #chan :\x0304!ping\x03\r\n", "PRIVMSG", "!ping"},
+		{":bob!b@host PRIVMSG #chan :\x01ACTION \x02waves\x02\x01\r\n", chatlib.CommandAction, "waves"},
+		{":bob!b@host NOTICE #chan :plain\r\n", "NOTICE", "plain"},
+	} {
+		a.rawMsgs <- []byte(tc.line)
+		msg, err := a.ReceiveMessage(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Command != tc.command || msg.Text != tc.text {
+			t.Errorf("%q: expected %s %q, got %s %q", tc.line, tc.command, tc.text, msg.Command, msg.Text)
+		}
+		if formatted, ok := AnnotationFormattedText.Get(msg); ok == (tc.text == "plain") {
+			t.Errorf("%q: unexpected formatted text %q", tc.line, formatted)
+		}
+	}
+}
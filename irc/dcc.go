@@ -0,0 +1,487 @@
+package irc
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultDCCTimeoutSeconds = 120
+	DefaultDCCMaxSize        = 100 << 20
+	// dccBufferSize is how much of a file is read or written at once.
+	dccBufferSize = 32 << 10
+)
+
+// The kinds of DCC offers.
+const (
+	dccSend = "SEND"
+	dccChat = "CHAT"
+)
+
+// CommandDCCSend is given to files offered to the bot with DCC SEND, and
+// CommandDCCChat to chats offered with DCC CHAT, so actions can be
+// registered for them. AnnotationDCCOffer holds the offer, which AcceptDCC
+// or AcceptChat receives.
+const (
+	CommandDCCSend = "DCCSEND"
+	CommandDCCChat = "DCCCHAT"
+)
+
+// AnnotationDCCOffer holds the offer of a DCCSEND or DCCCHAT message.
+var AnnotationDCCOffer = chatlib.NewAnnotationKey[*DCCOffer]("irc.dcc")
+
+// DCCOffer is a file offered with DCC SEND, or a chat offered with DCC CHAT.
+type DCCOffer struct {
+	Nick string
+	// Filename is the name of the file, or the protocol of a chat, chat.
+	Filename string
+	// IP and Port are where the file is received from. Port is 0 for
+	// passive offers, where the receiver listens and the sender connects.
+	IP   net.IP
+	Port int
+	// Size is the size of the file in bytes, 0 if the sender didn't say.
+	Size int64
+	// Token pairs a passive offer with the receiver's reply.
+	Token string
+}
+
+// Passive reports whether the sender of the offer asks the receiver to
+// listen, for senders that can't be connected to.
+func (o *DCCOffer) Passive() bool {
+	return o.Port == 0
+}
+
+// DCCProgress is told how many bytes of a DCC transfer have been sent or
+// received so far, out of size, 0 if unknown.
+type DCCProgress func(transferred, size int64)
+
+// WithDCCAddress sets the IP address given to the users files are sent to,
+// e.g. the bot's public address when it is behind NAT. It is the local
+// address of the connection to the server if not set.
+func WithDCCAddress(ip string) Option {
+	return func(a *API) error {
+		if ip != "" && net.ParseIP(ip) == nil {
+			return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: invalid DCC address: %s", ip)
+		}
+		a.dccAddress = ip
+		return nil
+	}
+}
+
+// WithDCCPorts sets the range of ports the bot listens on for DCC, e.g. the
+// ones forwarded to it. 0 for both uses any free port, and 0 for last only
+// first.
+func WithDCCPorts(first, last int) Option {
+	return func(a *API) error {
+		if last == 0 {
+			last = first
+		}
+		if first < 0 || last < first || last > 65535 {
+			return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: invalid DCC ports: %d-%d", first, last)
+		}
+		a.dccPortFirst, a.dccPortLast = first, last
+		return nil
+	}
+}
+
+// WithDCCPassive sends files with passive DCC, where the receiver listens
+// and the bot connects to them, for bots that can't be connected to.
+func WithDCCPassive(enabled bool) Option {
+	return func(a *API) error {
+		a.dccPassive = enabled
+		return nil
+	}
+}
+
+// WithDCCTimeout sets how long to wait for the other side of a DCC to
+// connect or answer, and how long a transfer may stall.
+func WithDCCTimeout(seconds float64) Option {
+	return func(a *API) error {
+		a.dccTimeoutSeconds = seconds
+		return nil
+	}
+}
+
+// WithDCCMaxSize sets the largest file AcceptDCC receives, in bytes. 0 is
+// unlimited.
+func WithDCCMaxSize(bytes int64) Option {
+	return func(a *API) error {
+		a.dccMaxSize = bytes
+		return nil
+	}
+}
+
+func (a *API) dccTimeout() time.Duration {
+	return time.Duration(float64(time.Second) * a.dccTimeoutSeconds)
+}
+
+// SendFile offers nick the file read from r, named filename and size bytes
+// long, with DCC SEND, and sends it once they accept. It returns once they
+// have received it, refused it by not answering for the DCC timeout, or c is
+// done. progress, which may be nil, is told how much has been sent.
+func (a *API) SendFile(c context.Context, nick, filename string, r io.Reader, size int64, progress DCCProgress) error {
+	offer := &DCCOffer{Nick: nick, Filename: path.Base(filename), Size: size}
+	conn, err := a.dccOffer(c, dccSend, offer)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Info().Str("api", ApiName).Str("nick", nick).Msgf("sending %s, %d bytes", offer.Filename, size)
+	return a.sendDCC(c, conn, r, size, progress)
+}
+
+// AcceptDCC receives the file of offer into w, connecting to the sender, or
+// for passive offers listening for them. progress, which may be nil, is told
+// how much has been received. Offers larger than the DCC max size are
+// refused.
+func (a *API) AcceptDCC(c context.Context, offer *DCCOffer, w io.Writer, progress DCCProgress) error {
+	if a.dccMaxSize > 0 && offer.Size > a.dccMaxSize {
+		return errors.Errorf("irc: %s is %d bytes, more than the %d accepted", offer.Filename, offer.Size, a.dccMaxSize)
+	}
+	conn, err := a.dccAnswer(c, dccSend, offer)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Info().Str("api", ApiName).Str("nick", offer.Nick).Msgf("receiving %s, %d bytes", offer.Filename, offer.Size)
+	return a.receiveDCC(c, conn, w, offer.Size, progress)
+}
+
+// dccOffer makes offer to its nick with DCC kind and returns the connection
+// once they accept. The bot listens for them, or with passive DCC connects
+// to where they answer they listen.
+func (a *API) dccOffer(c context.Context, kind string, offer *DCCOffer) (net.Conn, error) {
+	wait, cancel := context.WithTimeout(c, a.dccTimeout())
+	defer cancel()
+	offer.IP = a.dccIP()
+	if a.dccPassive {
+		offer.Port, offer.Token = 0, strconv.Itoa(rand.Intn(1<<30))
+		replies := make(chan *DCCOffer, 1)
+		a.dccMu.Lock()
+		a.dccPending[offer.Token] = replies
+		a.dccMu.Unlock()
+		defer func() {
+			a.dccMu.Lock()
+			delete(a.dccPending, offer.Token)
+			a.dccMu.Unlock()
+		}()
+		if err := a.SendCTCP(c, offer.Nick, "DCC", formatDCC(kind, offer)); err != nil {
+			return nil, err
+		}
+		var reply *DCCOffer
+		select {
+		case <-wait.Done():
+			return nil, errors.Wrapf(chatlib.ErrTimeout, "irc: %s didn't accept DCC %s %s", offer.Nick, kind, offer.Filename)
+		case reply = <-replies:
+		}
+		conn, err := (&net.Dialer{}).DialContext(wait, "tcp", net.JoinHostPort(reply.IP.String(), strconv.Itoa(reply.Port)))
+		if err != nil {
+			return nil, errors.Wrapf(err, "irc: error connecting to %s for DCC", offer.Nick)
+		}
+		return conn, nil
+	}
+	if offer.IP == nil {
+		return nil, errors.Wrap(chatlib.ErrInvalidConfig, "irc: the bot's address for DCC isn't known, set it or use passive DCC")
+	}
+	ln, err := a.dccListen()
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	offer.Port = ln.Addr().(*net.TCPAddr).Port
+	if err := a.SendCTCP(c, offer.Nick, "DCC", formatDCC(kind, offer)); err != nil {
+		return nil, err
+	}
+	conn, err := acceptContext(wait, ln)
+	if err != nil {
+		return nil, errors.Wrapf(err, "irc: %s didn't accept DCC %s %s", offer.Nick, kind, offer.Filename)
+	}
+	return conn, nil
+}
+
+// dccAnswer accepts offer, made with DCC kind, and returns the connection to
+// its sender. The bot connects to them, or for passive offers listens and
+// tells them where.
+func (a *API) dccAnswer(c context.Context, kind string, offer *DCCOffer) (net.Conn, error) {
+	wait, cancel := context.WithTimeout(c, a.dccTimeout())
+	defer cancel()
+	if !offer.Passive() {
+		conn, err := (&net.Dialer{}).DialContext(wait, "tcp", net.JoinHostPort(offer.IP.String(), strconv.Itoa(offer.Port)))
+		if err != nil {
+			return nil, errors.Wrapf(err, "irc: error connecting to %s for DCC", offer.Nick)
+		}
+		return conn, nil
+	}
+	ip := a.dccIP()
+	if ip == nil {
+		return nil, errors.Wrap(chatlib.ErrInvalidConfig, "irc: the bot's address for DCC isn't known")
+	}
+	ln, err := a.dccListen()
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	reply := *offer
+	reply.IP, reply.Port = ip, ln.Addr().(*net.TCPAddr).Port
+	if err := a.SendCTCP(c, offer.Nick, "DCC", formatDCC(kind, &reply)); err != nil {
+		return nil, err
+	}
+	conn, err := acceptContext(wait, ln)
+	if err != nil {
+		return nil, errors.Wrapf(err, "irc: %s didn't connect for DCC %s %s", offer.Nick, kind, offer.Filename)
+	}
+	return conn, nil
+}
+
+// sendDCC writes size bytes from r to conn, then waits for the receiver to
+// acknowledge them all. The acknowledgements are read as they come, so a
+// receiver blocked on sending them doesn't stall the transfer.
+func (a *API) sendDCC(c context.Context, conn net.Conn, r io.Reader, size int64, progress DCCProgress) error {
+	acked := make(chan struct{})
+	go func() {
+		defer close(acked)
+		var ack [4]byte
+		for {
+			if _, err := io.ReadFull(conn, ack[:]); err != nil {
+				return
+			}
+			// Acknowledgements are the bytes received, modulo 2^32
+			if binary.BigEndian.Uint32(ack[:]) == uint32(size) {
+				return
+			}
+		}
+	}()
+	stop := context.AfterFunc(c, func() { conn.Close() })
+	defer stop()
+	buf := make([]byte, dccBufferSize)
+	var sent int64
+	for sent < size {
+		n, err := r.Read(buf[:min(int64(len(buf)), size-sent)])
+		if n > 0 {
+			conn.SetWriteDeadline(time.Now().Add(a.dccTimeout()))
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return errors.Wrapf(err, "irc: DCC send failed after %d of %d bytes", sent, size)
+			}
+			sent += int64(n)
+			if progress != nil {
+				progress(sent, size)
+			}
+		}
+		if err == io.EOF {
+			return errors.Errorf("irc: file ended after %d of %d bytes", sent, size)
+		} else if err != nil {
+			return err
+		}
+	}
+	select {
+	case <-acked:
+	case <-time.After(a.dccTimeout()):
+		log.Warn().Str("api", ApiName).Msg("DCC receiver didn't acknowledge the whole file")
+	}
+	return c.Err()
+}
+
+// receiveDCC reads the file from conn into w, acknowledging what it has
+// received, until size bytes have come or, if size isn't known, the sender
+// closes the connection.
+func (a *API) receiveDCC(c context.Context, conn net.Conn, w io.Writer, size int64, progress DCCProgress) error {
+	stop := context.AfterFunc(c, func() { conn.Close() })
+	defer stop()
+	buf := make([]byte, dccBufferSize)
+	var received int64
+	for size == 0 || received < size {
+		conn.SetReadDeadline(time.Now().Add(a.dccTimeout()))
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if a.dccMaxSize > 0 && received+int64(n) > a.dccMaxSize {
+				return errors.Errorf("irc: DCC file is more than the %d bytes accepted", a.dccMaxSize)
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			received += int64(n)
+			var ack [4]byte
+			binary.BigEndian.PutUint32(ack[:], uint32(received))
+			if _, err := conn.Write(ack[:]); err != nil && size > 0 && received < size {
+				return errors.Wrap(err, "irc: error acknowledging DCC")
+			}
+			if progress != nil {
+				progress(received, size)
+			}
+		}
+		if err == io.EOF && size == 0 {
+			return nil
+		} else if err != nil {
+			if c.Err() != nil {
+				return c.Err()
+			}
+			return errors.Wrapf(err, "irc: DCC receive failed after %d of %d bytes", received, size)
+		}
+	}
+	return nil
+}
+
+// dccIP returns the address given for the bot in DCC offers, or nil if it
+// isn't known.
+func (a *API) dccIP() net.IP {
+	if a.dccAddress != "" {
+		return net.ParseIP(a.dccAddress)
+	}
+	if nc, ok := a.conn.(net.Conn); ok {
+		if addr, ok := nc.LocalAddr().(*net.TCPAddr); ok && !addr.IP.IsUnspecified() {
+			return addr.IP
+		}
+	}
+	return nil
+}
+
+// dccListen listens on the first free port of the DCC port range.
+func (a *API) dccListen() (net.Listener, error) {
+	if a.dccPortFirst == 0 {
+		return net.Listen("tcp", ":0")
+	}
+	var err error
+	for port := a.dccPortFirst; port <= a.dccPortLast; port++ {
+		var ln net.Listener
+		if ln, err = net.Listen("tcp", ":"+strconv.Itoa(port)); err == nil {
+			return ln, nil
+		}
+	}
+	return nil, errors.Wrapf(err, "irc: no free DCC port in %d-%d", a.dccPortFirst, a.dccPortLast)
+}
+
+// acceptContext accepts one connection on ln, or fails once c is done.
+func acceptContext(c context.Context, ln net.Listener) (net.Conn, error) {
+	stop := context.AfterFunc(c, func() { ln.Close() })
+	defer stop()
+	conn, err := ln.Accept()
+	if err != nil && c.Err() != nil {
+		return nil, c.Err()
+	}
+	return conn, err
+}
+
+// handleDCC turns DCC SEND and CHAT offers into DCCSEND and DCCCHAT
+// messages, accepting chats if the bot does, and passes the replies to the
+// bot's passive offers on.
+func (a *API) handleDCC(c context.Context, msg *chatlib.Message) {
+	ctcp, ok := AnnotationCTCP.Get(msg)
+	if msg.Command != CommandCTCP || !ok || ctcp.Verb != "DCC" || msg.Replayed || strings.EqualFold(msg.Nick, a.nick) {
+		return
+	}
+	kind, args, _ := strings.Cut(ctcp.Args, " ")
+	kind = strings.ToUpper(kind)
+	if kind != dccSend && kind != dccChat {
+		return
+	}
+	offer, err := parseDCC(kind, msg.Nick, args)
+	if err != nil {
+		log.Debug().Str("api", ApiName).Str("nick", msg.Nick).Err(err).Msgf("ignoring DCC %s", kind)
+		return
+	}
+	if offer.Token != "" && !offer.Passive() {
+		a.dccMu.Lock()
+		replies, ok := a.dccPending[offer.Token]
+		a.dccMu.Unlock()
+		if ok {
+			select {
+			case replies <- offer:
+			default:
+			}
+		}
+		return
+	}
+	AnnotationDCCOffer.Set(msg, offer)
+	if kind == dccSend {
+		msg.Command = CommandDCCSend
+		return
+	}
+	msg.Command = CommandDCCChat
+	if a.dccAcceptChat {
+		go func() {
+			if err := a.AcceptChat(c, offer); err != nil {
+				log.Error().Str("api", ApiName).Str("nick", offer.Nick).Err(err).Msg("error accepting DCC CHAT")
+			}
+		}()
+	}
+}
+
+// parseDCC parses the arguments of DCC kind. For SEND these are the file
+// name, quoted if it has spaces, the address as a 32 bit number for IPv4 or
+// text for IPv6, the port, the size, and for passive DCC the token. CHAT has
+// the protocol, chat, in place of the file name and no size.
+func parseDCC(kind, nick, args string) (*DCCOffer, error) {
+	args = strings.TrimSpace(args)
+	var name string
+	if rest, ok := strings.CutPrefix(args, `"`); ok {
+		var found bool
+		if name, args, found = strings.Cut(rest, `"`); !found {
+			return nil, errors.Errorf("unterminated file name in %q", args)
+		}
+	} else {
+		name, args, _ = strings.Cut(args, " ")
+	}
+	fields := strings.Fields(args)
+	if name == "" || len(fields) < 2 {
+		return nil, errors.Errorf("too few arguments in %q", args)
+	}
+	offer := &DCCOffer{Nick: nick, Filename: path.Base(strings.ReplaceAll(name, `\`, "/"))}
+	if n, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+		offer.IP = net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	} else if offer.IP = net.ParseIP(fields[0]); offer.IP == nil {
+		return nil, errors.Errorf("invalid address %q", fields[0])
+	}
+	port, err := strconv.Atoi(fields[1])
+	if err != nil || port < 0 || port > 65535 {
+		return nil, errors.Errorf("invalid port %q", fields[1])
+	}
+	offer.Port = port
+	fields = fields[2:]
+	if kind == dccSend && len(fields) > 0 {
+		if offer.Size, err = strconv.ParseInt(fields[0], 10, 64); err != nil || offer.Size < 0 {
+			return nil, errors.Errorf("invalid size %q", fields[0])
+		}
+		fields = fields[1:]
+	}
+	if len(fields) > 0 {
+		offer.Token = fields[0]
+	}
+	if offer.Passive() && offer.Token == "" {
+		return nil, errors.New("passive offer without a token")
+	}
+	return offer, nil
+}
+
+// formatDCC writes the arguments of DCC kind for offer.
+func formatDCC(kind string, offer *DCCOffer) string {
+	name := offer.Filename
+	if strings.Contains(name, " ") {
+		name = `"` + name + `"`
+	}
+	ip := "0"
+	if v4 := offer.IP.To4(); v4 != nil {
+		ip = strconv.FormatUint(uint64(binary.BigEndian.Uint32(v4)), 10)
+	} else if offer.IP != nil {
+		ip = offer.IP.String()
+	}
+	s := fmt.Sprintf("%s %s %s %d", kind, name, ip, offer.Port)
+	if kind == dccSend {
+		s += " " + strconv.FormatInt(offer.Size, 10)
+	}
+	if offer.Token != "" {
+		s += " " + offer.Token
+	}
+	return s
+}
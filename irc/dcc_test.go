@@ -0,0 +1,236 @@
+package irc
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gregseb/chatlib"
+)
+
+// lineConn passes the lines written to it on a channel, so tests can wait
+// for what is sent from other goroutines.
+type lineConn struct {
+	lines chan string
+}
+
+func (l *lineConn) Read(p []byte) (int, error) { select {} }
+
+func (l *lineConn) Write(p []byte) (int, error) {
+	l.lines <- strings.TrimSpace(string(p))
+	return len(p), nil
+}
+
+func (l *lineConn) Close() error { return nil }
+
+func (l *lineConn) next(t *testing.T) string {
+	select {
+	case line := <-l.lines:
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a line")
+		return ""
+	}
+}
+
+func TestParseDCC(t *testing.T) {
+	for _, tc := range []struct {
+		args     string
+		expected *DCCOffer
+	}{
+		{"notes.txt 2130706433 5000 1024", &DCCOffer{Nick: "alice", Filename: "notes.txt", IP: net.IPv4(127, 0, 0, 1), Port: 5000, Size: 1024}},
+		{`"my notes.txt" 3232235777 5001 12`, &DCCOffer{Nick: "alice", Filename: "my notes.txt", IP: net.IPv4(192, 168, 1, 1), Port: 5001, Size: 12}},
+		{"../../etc/passwd ::1 5002 3 7", &DCCOffer{Nick: "alice", Filename: "passwd", IP: net.ParseIP("::1"), Port: 5002, Size: 3, Token: "7"}},
+		{"notes.txt 2130706433 0 1024 42", &DCCOffer{Nick: "alice", Filename: "notes.txt", IP: net.IPv4(127, 0, 0, 1), Size: 1024, Token: "42"}},
+		{"notes.txt 2130706433 0 1024", nil},
+		{"notes.txt nowhere 5000", nil},
+		{`"notes.txt 2130706433 5000`, nil},
+		{"notes.txt", nil},
+	} {
+		offer, err := parseDCC(dccSend, "alice", tc.args)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v", tc.args, offer)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.args, err)
+			continue
+		}
+		if offer.Filename != tc.expected.Filename || !offer.IP.Equal(tc.expected.IP) || offer.Port != tc.expected.Port ||
+			offer.Size != tc.expected.Size || offer.Token != tc.expected.Token {
+			t.Errorf("%q: expected %+v, got %+v", tc.args, tc.expected, offer)
+		}
+		if back, err := parseDCC(dccSend, "alice", strings.TrimPrefix(formatDCC(dccSend, offer), "SEND ")); err != nil || back.Filename != offer.Filename || back.Port != offer.Port {
+			t.Errorf("%q: formatted as %q, which doesn't parse back", tc.args, formatDCC(dccSend, offer))
+		}
+	}
+	// Chats have no size, so the token follows the port
+	offer, err := parseDCC(dccChat, "alice", "chat 0 0 42")
+	if err != nil || offer.Filename != "chat" || !offer.Passive() || offer.Token != "42" {
+		t.Errorf("expected a passive chat offer, got %+v, %v", offer, err)
+	}
+	offer.IP, offer.Port = net.IPv4(127, 0, 0, 1), 5000
+	if s := formatDCC(dccChat, offer); s != "CHAT chat 2130706433 5000 42" {
+		t.Errorf("unexpected chat offer %q", s)
+	}
+}
+
+func TestDCCSend(t *testing.T) {
+	c := context.Background()
+	file := bytes.Repeat([]byte("0123456789"), 10000)
+	for _, passive := range []bool{false, true} {
+		sender, err := New(WithNick("bot"), WithDCCAddress("127.0.0.1"), WithDCCPassive(passive), WithDCCTimeout(5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		receiver, err := New(WithNick("alice"), WithDCCAddress("127.0.0.1"), WithDCCTimeout(5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		senderConn, receiverConn := &lineConn{lines: make(chan string, 4)}, &lineConn{lines: make(chan string, 4)}
+		sender.conn, receiver.conn = senderConn, receiverConn
+
+		var sent int64
+		sendErr := make(chan error, 1)
+		go func() {
+			sendErr <- sender.SendFile(c, "alice", "/tmp/numbers.txt", bytes.NewReader(file), int64(len(file)), func(n, size int64) { sent = n })
+		}()
+		receiver.rawMsgs <- []byte(":bot!b@host " + senderConn.next(t) + "\r\n")
+		msg, err := receiver.ReceiveMessage(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offer, ok := AnnotationDCCOffer.Get(msg)
+		if msg.Command != CommandDCCSend || !ok {
+			t.Fatalf("passive %v: expected a DCC offer, got %s %q", passive, msg.Command, msg.Text)
+		}
+		if offer.Nick != "bot" || offer.Filename != "numbers.txt" || offer.Size != int64(len(file)) || offer.Passive() != passive {
+			t.Errorf("passive %v: unexpected offer %+v", passive, offer)
+		}
+
+		var buf bytes.Buffer
+		var received int64
+		acceptErr := make(chan error, 1)
+		go func() {
+			acceptErr <- receiver.AcceptDCC(c, offer, &buf, func(n, size int64) { received = n })
+		}()
+		if passive {
+			// The receiver answers where to connect, which goes to SendFile
+			// rather than to actions
+			sender.rawMsgs <- []byte(":alice!a@host " + receiverConn.next(t) + "\r\n")
+			msg, err := sender.ReceiveMessage(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Command != CommandCTCP {
+				t.Errorf("expected the passive reply to stay a CTCP, got %s", msg.Command)
+			}
+		}
+		if err := <-acceptErr; err != nil {
+			t.Fatalf("passive %v: %v", passive, err)
+		}
+		if err := <-sendErr; err != nil {
+			t.Fatalf("passive %v: %v", passive, err)
+		}
+		if !bytes.Equal(buf.Bytes(), file) {
+			t.Errorf("passive %v: received %d bytes, which aren't the file", passive, buf.Len())
+		}
+		if sent != int64(len(file)) || received != int64(len(file)) {
+			t.Errorf("passive %v: expected progress to reach %d, got %d sent and %d received", passive, len(file), sent, received)
+		}
+	}
+
+	// Files larger than the max size are refused
+	receiver, err := New(WithNick("alice"), WithDCCMaxSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := receiver.AcceptDCC(c, &DCCOffer{Nick: "bot", Filename: "big", IP: net.IPv4(127, 0, 0, 1), Port: 1, Size: 11}, &bytes.Buffer{}, nil); err == nil {
+		t.Error("expected a file larger than the max size to be refused")
+	}
+}
+
+func TestDCCChat(t *testing.T) {
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, passive := range []bool{false, true} {
+		bot, err := New(WithNick("bot"), WithDCCAddress("127.0.0.1"), WithDCCPassive(passive), WithDCCTimeout(5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice, err := New(WithNick("alice"), WithDCCAddress("127.0.0.1"), WithDCCTimeout(5), WithDCCAcceptChat(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		botConn, aliceConn := &lineConn{lines: make(chan string, 4)}, &lineConn{lines: make(chan string, 4)}
+		bot.conn, alice.conn = botConn, aliceConn
+
+		offerErr := make(chan error, 1)
+		go func() { offerErr <- bot.OfferChat(c, "alice") }()
+		// alice accepts chats as they are offered
+		alice.rawMsgs <- []byte(":bot!b@host " + botConn.next(t) + "\r\n")
+		msg, err := alice.ReceiveMessage(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offer, ok := AnnotationDCCOffer.Get(msg); msg.Command != CommandDCCChat || !ok || offer.Passive() != passive {
+			t.Fatalf("passive %v: expected a DCC CHAT offer, got %s %q", passive, msg.Command, msg.Text)
+		}
+		if passive {
+			bot.rawMsgs <- []byte(":alice!a@host " + aliceConn.next(t) + "\r\n")
+			if _, err := bot.ReceiveMessage(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := <-offerErr; err != nil {
+			t.Fatalf("passive %v: %v", passive, err)
+		}
+		for i := 0; !alice.Chatting("bot"); i++ {
+			if i == 100 {
+				t.Fatalf("passive %v: expected alice to be chatting with the bot", passive)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// Private messages go over the chat and come out as messages
+		if err := alice.SendMessage(c, &chatlib.Message{Command: "PRIVMSG", Receiver: "Bot", Text: "!help\nplease"}); err != nil {
+			t.Fatal(err)
+		}
+		for _, expected := range []string{"!help", "please"} {
+			msg, err := bot.ReceiveMessage(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dcc, _ := AnnotationDCCChat.Get(msg); !dcc || !msg.Private || msg.Nick != "alice" || msg.Text != expected || msg.ReplyTarget() != "alice" {
+				t.Errorf("passive %v: expected %q from alice over DCC, got %+v", passive, expected, msg)
+			}
+		}
+		if err := bot.SendMessage(c, &chatlib.Message{Command: chatlib.CommandAction, Receiver: "alice", Text: "waves"}); err != nil {
+			t.Fatal(err)
+		}
+		if msg, err := alice.ReceiveMessage(c); err != nil || msg.Command != chatlib.CommandAction || msg.Text != "waves" {
+			t.Errorf("passive %v: expected an action over DCC, got %+v, %v", passive, msg, err)
+		}
+		// Channels still go through the server
+		if err := bot.SendMessage(c, &chatlib.Message{Command: "PRIVMSG", Receiver: "#chan", Text: "hi"}); err != nil {
+			t.Fatal(err)
+		}
+		if line := botConn.next(t); line != "PRIVMSG #chan :hi" {
+			t.Errorf("expected the channel message sent to the server, got %q", line)
+		}
+
+		// Closing the chat closes it on both sides
+		bot.CloseChat("alice")
+		for i := 0; alice.Chatting("bot") || bot.Chatting("alice"); i++ {
+			if i == 100 {
+				t.Fatalf("passive %v: expected the chat to be closed", passive)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package irc
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// maxDCCChatLine is the longest line read from a DCC CHAT. Chats don't go
+// through the server, so its line limit doesn't apply.
+const maxDCCChatLine = 8 << 10
+
+// AnnotationDCCChat is set on the messages received over a DCC CHAT rather
+// than through the server.
+var AnnotationDCCChat = chatlib.NewAnnotationKey[bool]("irc.dcc-chat")
+
+// dccChatSession is an open DCC CHAT.
+type dccChatSession struct {
+	nick string
+	conn net.Conn
+	// mu keeps the lines written to conn whole.
+	mu     sync.Mutex
+	done   chan struct{}
+	closed sync.Once
+}
+
+func (s *dccChatSession) close() {
+	s.closed.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+// WithDCCAcceptChat accepts the DCC CHATs offered to the bot, which are
+// otherwise only received as DCCCHAT messages for actions to accept with
+// AcceptChat.
+func WithDCCAcceptChat(enabled bool) Option {
+	return func(a *API) error {
+		a.dccAcceptChat = enabled
+		return nil
+	}
+}
+
+// OfferChat offers nick a DCC CHAT, a conversation that doesn't go through
+// the server, and returns once they accept it or the DCC timeout passes.
+// While the chat is open, the lines nick sends over it are received like
+// private messages from them, with AnnotationDCCChat set, and the messages
+// and notices sent to nick go over it. It stays open until either side
+// closes it, c is done or CloseChat is called.
+func (a *API) OfferChat(c context.Context, nick string) error {
+	conn, err := a.dccOffer(c, dccChat, &DCCOffer{Nick: nick, Filename: "chat"})
+	if err != nil {
+		return err
+	}
+	a.startChat(c, nick, conn)
+	return nil
+}
+
+// AcceptChat accepts the DCC CHAT of offer, connecting to the sender, or for
+// passive offers listening for them. The chat works like those OfferChat
+// opens.
+func (a *API) AcceptChat(c context.Context, offer *DCCOffer) error {
+	conn, err := a.dccAnswer(c, dccChat, offer)
+	if err != nil {
+		return err
+	}
+	a.startChat(c, offer.Nick, conn)
+	return nil
+}
+
+// Chatting reports whether a DCC CHAT with nick is open.
+func (a *API) Chatting(nick string) bool {
+	return a.chatWith(nick) != nil
+}
+
+// CloseChat closes the DCC CHAT with nick, if one is open.
+func (a *API) CloseChat(nick string) {
+	if s := a.chatWith(nick); s != nil {
+		s.close()
+	}
+}
+
+// closeChats closes every open DCC CHAT.
+func (a *API) closeChats() {
+	a.dccMu.Lock()
+	sessions := make([]*dccChatSession, 0, len(a.dccChats))
+	for _, s := range a.dccChats {
+		sessions = append(sessions, s)
+	}
+	a.dccMu.Unlock()
+	for _, s := range sessions {
+		s.close()
+	}
+}
+
+func (a *API) chatWith(nick string) *dccChatSession {
+	a.dccMu.Lock()
+	defer a.dccMu.Unlock()
+	return a.dccChats[a.folder()(nick)]
+}
+
+// startChat opens a DCC CHAT with nick over conn, replacing any open one.
+func (a *API) startChat(c context.Context, nick string, conn net.Conn) {
+	s := &dccChatSession{nick: nick, conn: conn, done: make(chan struct{})}
+	key := a.folder()(nick)
+	a.dccMu.Lock()
+	old := a.dccChats[key]
+	a.dccChats[key] = s
+	a.dccMu.Unlock()
+	if old != nil {
+		old.close()
+	}
+	log.Info().Str("api", ApiName).Str("nick", nick).Msg("DCC CHAT open")
+	go a.readChat(c, s)
+}
+
+// readChat passes the lines read from the chat s to ReceiveMessage until
+// the chat is closed.
+func (a *API) readChat(c context.Context, s *dccChatSession) {
+	stop := context.AfterFunc(c, s.close)
+	defer stop()
+	defer func() {
+		s.close()
+		a.dccMu.Lock()
+		if key := a.folder()(s.nick); a.dccChats[key] == s {
+			delete(a.dccChats, key)
+		}
+		a.dccMu.Unlock()
+		log.Info().Str("api", ApiName).Str("nick", s.nick).Msg("DCC CHAT closed")
+	}()
+	scanner := bufio.NewScanner(s.conn)
+	scanner.Buffer(make([]byte, 0, 512), maxDCCChatLine)
+	for scanner.Scan() {
+		text := strings.TrimRight(a.fallback.Decode(scanner.Bytes()), "\r")
+		if text == "" {
+			continue
+		}
+		msg := &chatlib.Message{
+			Raw:      text,
+			Command:  "PRIVMSG",
+			Sender:   s.nick,
+			Nick:     s.nick,
+			Receiver: a.nick,
+			Params:   []string{a.nick, text},
+			Text:     text,
+			Private:  true,
+			Time:     time.Now(),
+		}
+		if verb, args, ok := decodeCTCP(text); ok && verb == "ACTION" {
+			msg.Command, msg.Text = chatlib.CommandAction, args
+		}
+		AnnotationDCCChat.Set(msg, true)
+		select {
+		case a.dccMsgs <- msg:
+		case <-s.done:
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Debug().Str("api", ApiName).Str("nick", s.nick).Err(err).Msg("error reading DCC CHAT")
+	}
+}
+
+// sendChat sends the text of msg over the chat s, a line at a time.
+func (a *API) sendChat(s *dccChatSession, msg *chatlib.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, line := range strings.Split(msg.Text, "\n") {
+		line = strings.TrimRight(line, "\r ")
+		if line == "" {
+			continue
+		}
+		if msg.Command == chatlib.CommandAction {
+			line = encodeCTCP("ACTION", line)
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(a.dccTimeout()))
+		if _, err := s.conn.Write(a.encoding.Encode(line + "\n")); err != nil {
+			return errors.Wrapf(err, "irc: error sending to %s over DCC CHAT", s.nick)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package irc
+
+import (
+	"context"
+	"net"
+)
+
+// DialFunc connects to addr on the named network, like net.Dialer's
+// DialContext.
+type DialFunc func(c context.Context, network, addr string) (net.Conn, error)
+
+// DialContext calls d.
+func (d DialFunc) DialContext(c context.Context, network, addr string) (net.Conn, error) {
+	return d(c, network, addr)
+}
+
+// Dial calls d without a deadline, for dialers such as proxies wanting a
+// Dial method.
+func (d DialFunc) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+// WithDialer connects to the server with dial rather than over TCP, e.g. to
+// go through a unix socket, a custom proxy or, in tests, an in-memory pipe.
+// It is called with the network "tcp" and the server's host:port. TLS and
+// the proxy set with WithProxy are used over the connections it returns,
+// the proxy being dialed with it. The dial timeout and keepalive are up to
+// dial, though dialing is given up on after the dial timeout.
+func WithDialer(dial DialFunc) Option {
+	return func(a *API) error {
+		a.dial = dial
+		return nil
+	}
+}
@@ -0,0 +1,53 @@
+package irc
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gregseb/chatlib"
+)
+
+var _ chatlib.DryRunner = (*API)(nil)
+
+// SetDryRun implements chatlib.DryRunner. Anything other users would see is
+// withheld and passed to record. Registration, keepalives, joins, queries and
+// messages to services are still sent so the bot stays connected and in its
+// channels.
+func (a *API) SetDryRun(record func(c context.Context, msg *chatlib.Message)) {
+	a.dryRun = record
+}
+
+// withheld reports whether msg is withheld in dry run mode, recording it if
+// so.
+func (a *API) withheld(c context.Context, msg *chatlib.Message) bool {
+	if a.dryRun == nil || !visible(msg, a.nickServ, a.chanServ) {
+		return false
+	}
+	m := *msg
+	m.API = a.name
+	a.dryRun(c, &m)
+	return true
+}
+
+// visible reports whether other users would see msg.
+func visible(msg *chatlib.Message, services ...string) bool {
+	fields := strings.Fields(msg.Command)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "PRIVMSG", "NOTICE", "CPRIVMSG", "CNOTICE", "TAGMSG", chatlib.CommandAction:
+		for _, s := range services {
+			if strings.EqualFold(msg.Receiver, s) {
+				return false
+			}
+		}
+		return true
+	case "KICK", "TOPIC", "INVITE", "KNOCK", "AWAY", "WALLOPS":
+		return true
+	case "MODE":
+		// Asking for the modes is fine, changing them isn't
+		return len(fields) > 2 || msg.Text != ""
+	}
+	return false
+}
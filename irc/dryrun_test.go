@@ -0,0 +1,44 @@
+package irc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestDryRun(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var withheld []string
+	a.SetDryRun(func(c context.Context, msg *chatlib.Message) {
+		withheld = append(withheld, msg.Command+" "+msg.Receiver)
+	})
+	conn := &bufConn{}
+	a.conn = conn
+	for _, tc := range []struct {
+		msg      *chatlib.Message
+		expected string
+	}{
+		{&chatlib.Message{Command: "PRIVMSG", Receiver: "#test", Text: "hello"}, ""},
+		{&chatlib.Message{Command: "PRIVMSG", Receiver: "NickServ", Text: "IDENTIFY hunter2"}, "PRIVMSG NickServ :IDENTIFY hunter2\n"},
+		{&chatlib.Message{Command: "MODE #test"}, "MODE #test\n"},
+		{&chatlib.Message{Command: "MODE #test +o someone"}, ""},
+		{&chatlib.Message{Command: "KICK #test someone", Text: "bye"}, ""},
+		{&chatlib.Message{Command: "JOIN #test"}, "JOIN #test\n"},
+		{&chatlib.Message{Command: "PONG", Text: "irc.example.net"}, "PONG :irc.example.net\n"},
+	} {
+		if err := a.SendMessage(c, tc.msg); err != nil {
+			t.Fatal(err)
+		}
+		if line := conn.next(); line != tc.expected {
+			t.Errorf("%+v: expected %q, got %q", tc.msg, tc.expected, line)
+		}
+	}
+	if len(withheld) != 3 {
+		t.Errorf("expected 3 messages withheld, got %v", withheld)
+	}
+}
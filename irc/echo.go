@@ -0,0 +1,120 @@
+package irc
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gregseb/chatlib"
+)
+
+const capEchoMessage = "echo-message"
+
+// echoTimeout is how long a message sent waits for its echo before it is
+// taken to be lost, and maxPendingEchoes how many wait per target.
+const (
+	echoTimeout      = time.Minute
+	maxPendingEchoes = 64
+)
+
+// Echo tells how the server delivered a message the bot sent.
+type Echo struct {
+	// Sent is the text of the line as the bot sent it.
+	Sent string
+	// Truncated is set when the server delivered less than was sent, e.g.
+	// because the line was too long once relayed.
+	Truncated bool
+}
+
+// AnnotationEcho holds how the server delivered the message, on the echoes of
+// the bot's own messages that were matched to the line sent.
+var AnnotationEcho = chatlib.NewAnnotationKey[Echo]("irc.echo")
+
+// sentText is a line sent that waits for its echo.
+type sentText struct {
+	text string
+	at   time.Time
+}
+
+// echoState matches the echoes of the bot's messages to the lines sent.
+type echoState struct {
+	mu      sync.Mutex
+	pending map[string][]sentText
+}
+
+// WithEchoMessage asks servers with the echo-message capability to send the
+// bot's messages back to it as they were delivered. The echoes are received
+// with Self set, for the actions registered with chatlib.WithSelfMessages,
+// and matched to the line sent, see AnnotationEcho.
+func WithEchoMessage(enabled bool) Option {
+	return func(a *API) error {
+		if enabled {
+			a.wantCap(capEchoMessage)
+		}
+		return nil
+	}
+}
+
+// expectEcho records text sent to target, to be matched with its echo.
+func (a *API) expectEcho(target, text string) {
+	if !a.HasCap(capEchoMessage) {
+		return
+	}
+	// CPRIVMSG and CNOTICE are echoed to the nick alone
+	target, _, _ = strings.Cut(strings.ToLower(target), " ")
+	e := &a.echo
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pending == nil {
+		e.pending = make(map[string][]sentText)
+	}
+	pending := append(e.pending[target], sentText{text, time.Now()})
+	if len(pending) > maxPendingEchoes {
+		pending = pending[len(pending)-maxPendingEchoes:]
+	}
+	e.pending[target] = pending
+}
+
+// handleEcho marks the echoes of the bot's own messages as Self, and
+// annotates them with the line they were sent as.
+func (a *API) handleEcho(msg *chatlib.Message) {
+	if (msg.Command != "PRIVMSG" && msg.Command != "NOTICE") || !strings.EqualFold(msg.Nick, a.nick) || !a.HasCap(capEchoMessage) {
+		return
+	}
+	msg.Self = true
+	if msg.Replayed {
+		return
+	}
+	if sent, ok := a.matchEcho(msg.Receiver, msg.Text, time.Now()); ok {
+		AnnotationEcho.Set(msg, Echo{Sent: sent, Truncated: len(msg.Text) < len(sent) && strings.HasPrefix(sent, msg.Text)})
+	}
+}
+
+// matchEcho returns the line sent to target that text is the echo of, the
+// oldest it is or starts, forgetting it and those sent before it, whose
+// echoes were lost.
+func (a *API) matchEcho(target, text string, now time.Time) (string, bool) {
+	target = strings.ToLower(target)
+	e := &a.echo
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	pending := e.pending[target]
+	for len(pending) > 0 && now.Sub(pending[0].at) > echoTimeout {
+		pending = pending[1:]
+	}
+	for i, p := range pending {
+		if text != "" && strings.HasPrefix(p.text, text) {
+			e.pending[target] = pending[i+1:]
+			return p.text, true
+		}
+	}
+	e.pending[target] = pending
+	return "", false
+}
+
+// resetEchoes forgets the lines sent on an earlier connection.
+func (a *API) resetEchoes() {
+	a.echo.mu.Lock()
+	defer a.echo.mu.Unlock()
+	a.echo.pending = nil
+}
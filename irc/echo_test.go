@@ -0,0 +1,50 @@
+package irc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestEchoMessage(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"), WithEchoMessage(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.wants(capEchoMessage) {
+		t.Fatalf("expected echo-message to be requested, got %v", a.wantCaps)
+	}
+	a.grantedCaps = map[string]bool{capEchoMessage: true}
+	conn := &bufConn{}
+	a.conn = conn
+	receive := func(line string) *chatlib.Message {
+		t.Helper()
+		a.rawMsgs <- []byte(line)
+		msg, err := a.ReceiveMessage(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	for _, text := range []string{"lost", "hello world"} {
+		if err := a.SendMessage(c, &chatlib.Message{Command: "PRIVMSG", Receiver: "#chan", Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Echoes are matched to what was sent, skipping those that never came
+	msg := receive(":bot!u@h PRIVMSG #chan :hello\r\n")
+	echo, ok := AnnotationEcho.Get(msg)
+	if !msg.Self || !ok || echo.Sent != "hello world" || !echo.Truncated {
+		t.Errorf("expected a truncated echo of hello world, got self %v, %+v", msg.Self, echo)
+	}
+	msg = receive(":bot!u@h PRIVMSG #chan :lost\r\n")
+	if _, ok := AnnotationEcho.Get(msg); !msg.Self || ok {
+		t.Errorf("expected an echo that matches nothing sent, got self %v", msg.Self)
+	}
+	if msg := receive(":alice!u@h PRIVMSG #chan :hello world\r\n"); msg.Self {
+		t.Error("expected messages from others not to be self")
+	}
+}
@@ -0,0 +1,160 @@
+package irc
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+)
+
+const (
+	// EncodingUTF8 is the encoding of most networks, and of text in chatlib.
+	EncodingUTF8 = "utf-8"
+	// DefaultFallbackEncoding is what bytes that aren't UTF-8 are read as.
+	// Text from clients that don't send UTF-8 is most often CP1252, which is
+	// latin-1 with printable characters in place of its control codes.
+	DefaultFallbackEncoding = "cp1252"
+)
+
+// Encoding is a single byte character set, matching ASCII below 0x80.
+type Encoding struct {
+	// high are the characters of the bytes 0x80 to 0xff.
+	high    [128]rune
+	reverse map[rune]byte
+}
+
+// newEncoding returns the encoding of latin-1 with the characters of some
+// bytes replaced.
+func newEncoding(replaced map[byte]rune) *Encoding {
+	e := &Encoding{reverse: make(map[rune]byte, 128)}
+	for i := range e.high {
+		b := byte(0x80 + i)
+		r, ok := replaced[b]
+		if !ok {
+			r = rune(b)
+		}
+		e.high[i] = r
+		e.reverse[r] = b
+	}
+	return e
+}
+
+var (
+	latin1 = newEncoding(nil)
+	// cp1252 leaves 0x81, 0x8d, 0x8f, 0x90 and 0x9d undefined. They are read
+	// as the latin-1 control codes, like browsers do.
+	cp1252 = newEncoding(map[byte]rune{
+		0x80: '€', 0x82: '‚', 0x83: 'ƒ', 0x84: '„', 0x85: '…', 0x86: '†', 0x87: '‡',
+		0x88: 'ˆ', 0x89: '‰', 0x8a: 'Š', 0x8b: '‹', 0x8c: 'Œ', 0x8e: 'Ž',
+		0x91: '‘', 0x92: '’', 0x93: '“', 0x94: '”', 0x95: '•', 0x96: '–', 0x97: '—',
+		0x98: '˜', 0x99: '™', 0x9a: 'š', 0x9b: '›', 0x9c: 'œ', 0x9e: 'ž', 0x9f: 'Ÿ',
+	})
+	latin9 = newEncoding(map[byte]rune{
+		0xa4: '€', 0xa6: 'Š', 0xa8: 'š', 0xb4: 'Ž', 0xb8: 'ž', 0xbc: 'Œ', 0xbd: 'œ', 0xbe: 'Ÿ',
+	})
+)
+
+// Encodings are the encodings text can be sent in or read as when it isn't
+// UTF-8, by name. UTF-8 itself is EncodingUTF8.
+var Encodings = map[string]*Encoding{
+	"latin1":       latin1,
+	"iso-8859-1":   latin1,
+	"cp1252":       cp1252,
+	"windows-1252": cp1252,
+	"latin9":       latin9,
+	"iso-8859-15":  latin9,
+}
+
+// EncodingNames returns the names of the encodings, including EncodingUTF8,
+// sorted.
+func EncodingNames() []string {
+	names := []string{EncodingUTF8}
+	for name := range Encodings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupEncoding returns the named encoding, which is nil for UTF-8.
+func lookupEncoding(name string) (*Encoding, error) {
+	name = strings.ToLower(name)
+	if name == EncodingUTF8 || name == "utf8" {
+		return nil, nil
+	}
+	e, ok := Encodings[name]
+	if !ok {
+		return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "irc: unknown encoding %s, expected one of: %s", name, strings.Join(EncodingNames(), ", "))
+	}
+	return e, nil
+}
+
+// WithEncoding sets the encoding lines are sent in. Networks that aren't
+// UTF-8 usually announce their encoding in the MOTD. Characters the encoding
+// doesn't have are sent as "?". UTF-8 by default.
+func WithEncoding(name string) Option {
+	return func(a *API) error {
+		e, err := lookupEncoding(name)
+		if err != nil {
+			return err
+		}
+		a.encoding = e
+		return nil
+	}
+}
+
+// WithFallbackEncoding sets what bytes of received lines that aren't valid
+// UTF-8 are read as, so text from clients using a legacy encoding is still
+// readable. With UTF-8, they are replaced with U+FFFD. Message.Text is always
+// valid UTF-8 either way.
+func WithFallbackEncoding(name string) Option {
+	return func(a *API) error {
+		e, err := lookupEncoding(name)
+		if err != nil {
+			return err
+		}
+		a.fallback = e
+		return nil
+	}
+}
+
+// Decode returns b as UTF-8, reading the bytes that aren't valid UTF-8 with
+// e, or as U+FFFD if e is nil.
+func (e *Encoding) Decode(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	var sb strings.Builder
+	sb.Grow(len(b) + len(b)/2)
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		// Invalid bytes are never ASCII
+		if r == utf8.RuneError && size == 1 && e != nil {
+			r = e.high[b[0]-0x80]
+		}
+		sb.WriteRune(r)
+		b = b[size:]
+	}
+	return sb.String()
+}
+
+// Encode returns s in e, with "?" for the characters e doesn't have. A nil e
+// returns s as it is, in UTF-8.
+func (e *Encoding) Encode(s string) []byte {
+	if e == nil {
+		return []byte(s)
+	}
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r < utf8.RuneSelf {
+			b = append(b, byte(r))
+		} else if c, ok := e.reverse[r]; ok {
+			b = append(b, c)
+		} else {
+			b = append(b, '?')
+		}
+	}
+	return b
+}
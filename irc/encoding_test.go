@@ -0,0 +1,56 @@
+package irc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		encoding string
+		in       []byte
+		expected string
+	}{
+		{EncodingUTF8, []byte("caf\xc3\xa9 \xe2\x82\xac"), "café €"},
+		{EncodingUTF8, []byte("caf\xe9"), "caf�"},
+		{"cp1252", []byte("caf\xe9 \x80 \x93"), "café € “"},
+		{"cp1252", []byte("caf\xc3\xa9 and caf\xe9"), "café and café"},
+		{"latin1", []byte("\x80"), "\u0080"},
+		{"latin9", []byte("\xa4"), "€"},
+	} {
+		e, err := lookupEncoding(tc.encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := e.Decode(tc.in); s != tc.expected {
+			t.Errorf("%s %q: expected %q, got %q", tc.encoding, tc.in, tc.expected, s)
+		}
+	}
+	if _, err := New(WithEncoding("ebcdic")); err == nil {
+		t.Error("expected an error for an unknown encoding")
+	}
+
+	c := context.Background()
+	a, err := New(WithNick("bot"), WithEncoding("cp1252"), WithFallbackEncoding("latin1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	a.rawMsgs <- []byte(":bob!b@host PRIVMSG #chan :\xe0 bient\xf4t\r\n")
+	msg, err := a.ReceiveMessage(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Text != "à bientôt" {
+		t.Errorf("expected the text decoded, got %q", msg.Text)
+	}
+	if err := a.SendMessage(c, &chatlib.Message{Command: "PRIVMSG", Receiver: "#chan", Text: "€5 ✓"}); err != nil {
+		t.Fatal(err)
+	}
+	if line := conn.next(); line != "PRIVMSG #chan :\x805 ?\n" {
+		t.Errorf("expected the text encoded, got %q", line)
+	}
+}
@@ -0,0 +1,244 @@
+package irc
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/blowfish"
+)
+
+// fishAlphabet is the base64 alphabet of FiSH, in the order it uses.
+const fishAlphabet = "./0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// FiSH message prefixes. mcps is mircryption's.
+const (
+	fishPrefix = "+OK "
+	mcpsPrefix = "mcps "
+)
+
+// AnnotationFiSH is set on the messages received encrypted with FiSH and
+// decrypted with the target's key.
+var AnnotationFiSH = chatlib.NewAnnotationKey[bool]("irc.fish")
+
+// fishKey is the FiSH key of a channel or nick.
+type fishKey struct {
+	block cipher.Block
+	// cbc encrypts in CBC mode, as FiSH 10 does for keys given as cbc:key,
+	// rather than the ECB mode of mircryption.
+	cbc bool
+}
+
+// WithFiSHKeys sets the keys of channels, or nicks, whose messages are
+// encrypted with FiSH, the Blowfish encryption of mircryption and the FiSH
+// plugins of mIRC, irssi and others. Keys are given as target=key, with
+// key prefixed by cbc: for the CBC mode of FiSH 10 or ecb: for the default
+// ECB mode. Messages sent to the target are encrypted, and those received
+// in either mode are decrypted, see AnnotationFiSH.
+func WithFiSHKeys(keys []string) Option {
+	return func(a *API) error {
+		for _, k := range keys {
+			target, secret, ok := strings.Cut(k, "=")
+			if !ok || target == "" {
+				return errors.WithMessage(chatlib.ErrInvalidConfig, "irc: invalid fish key, expected target=key")
+			}
+			key, err := newFiSHKey(secret)
+			if err != nil {
+				return errors.Wrapf(fmt.Errorf("%s: %w", chatlib.ErrInvalidConfig, err), "irc: invalid fish key for %s", target)
+			}
+			if a.fishKeys == nil {
+				a.fishKeys = make(map[string]*fishKey)
+			}
+			a.fishKeys[strings.ToLower(target)] = key
+		}
+		return nil
+	}
+}
+
+func newFiSHKey(secret string) (*fishKey, error) {
+	key := &fishKey{}
+	if s, ok := strings.CutPrefix(secret, "cbc:"); ok {
+		secret, key.cbc = s, true
+	} else {
+		secret = strings.TrimPrefix(secret, "ecb:")
+	}
+	block, err := blowfish.NewCipher([]byte(secret))
+	if err != nil {
+		return nil, err
+	}
+	key.block = block
+	return key, nil
+}
+
+// fishKeyFor returns the key of target, nil if it has none. CPRIVMSG and
+// CNOTICE targets are the nick.
+func (a *API) fishKeyFor(target string) *fishKey {
+	if len(a.fishKeys) == 0 {
+		return nil
+	}
+	target, _, _ = strings.Cut(target, " ")
+	return a.fishKeys[strings.ToLower(target)]
+}
+
+// encrypt returns text encrypted as a FiSH message.
+func (k *fishKey) encrypt(text []byte) string {
+	size := blowfish.BlockSize
+	padded := make([]byte, (len(text)+size-1)/size*size)
+	copy(padded, text)
+	if k.cbc {
+		out := make([]byte, size+len(padded))
+		iv := out[:size]
+		if _, err := rand.Read(iv); err != nil {
+			panic(err)
+		}
+		cipher.NewCBCEncrypter(k.block, iv).CryptBlocks(out[size:], padded)
+		return fishPrefix + "*" + base64.StdEncoding.EncodeToString(out)
+	}
+	out := make([]byte, len(padded))
+	for i := 0; i < len(padded); i += size {
+		k.block.Encrypt(out[i:i+size], padded[i:i+size])
+	}
+	return fishPrefix + fishEncode(out)
+}
+
+// decrypt returns the text of a FiSH message, in either mode whatever the
+// key's, and whether it was one.
+func (k *fishKey) decrypt(msg string) ([]byte, bool, error) {
+	data, ok := strings.CutPrefix(msg, fishPrefix)
+	if !ok {
+		if data, ok = strings.CutPrefix(msg, mcpsPrefix); !ok {
+			return nil, false, nil
+		}
+	}
+	size := blowfish.BlockSize
+	var out []byte
+	if cbc, ok := strings.CutPrefix(data, "*"); ok {
+		in, err := base64.StdEncoding.DecodeString(cbc)
+		if err != nil || len(in) < 2*size || len(in)%size != 0 {
+			return nil, true, errors.New("irc: invalid fish cbc message")
+		}
+		out = make([]byte, len(in)-size)
+		cipher.NewCBCDecrypter(k.block, in[:size]).CryptBlocks(out, in[size:])
+	} else {
+		in, err := fishDecode(data)
+		if err != nil {
+			return nil, true, err
+		}
+		out = make([]byte, len(in))
+		for i := 0; i < len(in); i += size {
+			k.block.Decrypt(out[i:i+size], in[i:i+size])
+		}
+	}
+	return bytes.TrimRight(out, "\x00"), true, nil
+}
+
+// encryptedLen returns the length of the FiSH message of n bytes of text.
+func (k *fishKey) encryptedLen(n int) int {
+	blocks := (n + blowfish.BlockSize - 1) / blowfish.BlockSize
+	if k.cbc {
+		return len(fishPrefix+"*") + base64.StdEncoding.EncodedLen((blocks+1)*blowfish.BlockSize)
+	}
+	return len(fishPrefix) + blocks*12
+}
+
+// plainLimit returns the most bytes of text whose FiSH message fits in limit
+// bytes.
+func (k *fishKey) plainLimit(limit int) int {
+	n := limit / blowfish.BlockSize * blowfish.BlockSize
+	for n > 0 && k.encryptedLen(n) > limit {
+		n -= blowfish.BlockSize
+	}
+	return n
+}
+
+// fishEncode encodes blocks of 8 bytes in the base64 of FiSH: 12 characters
+// a block, the low bits of the right half first, then of the left.
+func fishEncode(in []byte) string {
+	var sb strings.Builder
+	for i := 0; i+8 <= len(in); i += 8 {
+		left := binary.BigEndian.Uint32(in[i:])
+		right := binary.BigEndian.Uint32(in[i+4:])
+		for _, half := range []uint32{right, left} {
+			for j := 0; j < 6; j++ {
+				sb.WriteByte(fishAlphabet[half&0x3f])
+				half >>= 6
+			}
+		}
+	}
+	return sb.String()
+}
+
+// fishDecode decodes the base64 of FiSH, ignoring an incomplete block at the
+// end as FiSH does.
+func fishDecode(in string) ([]byte, error) {
+	out := make([]byte, 0, len(in)/12*8)
+	for i := 0; i+12 <= len(in); i += 12 {
+		var halves [2]uint32
+		for h := 0; h < 2; h++ {
+			for j := 0; j < 6; j++ {
+				v := strings.IndexByte(fishAlphabet, in[i+h*6+j])
+				if v < 0 {
+					return nil, errors.New("irc: invalid fish message")
+				}
+				halves[h] |= uint32(v) << (j * 6)
+			}
+		}
+		out = binary.BigEndian.AppendUint32(out, halves[1])
+		out = binary.BigEndian.AppendUint32(out, halves[0])
+	}
+	if len(out) == 0 {
+		return nil, errors.New("irc: empty fish message")
+	}
+	return out, nil
+}
+
+// handleFiSH decrypts the FiSH messages sent to a channel with a key, or
+// privately by a nick with one. Actions are decrypted inside the CTCP.
+func (a *API) handleFiSH(msg *chatlib.Message) {
+	if (msg.Command != "PRIVMSG" && msg.Command != "NOTICE") || len(a.fishKeys) == 0 {
+		return
+	}
+	target := msg.Receiver
+	if msg.Private {
+		target = msg.Nick
+	}
+	key := a.fishKeyFor(target)
+	if key == nil {
+		return
+	}
+	text, action := msg.Text, false
+	if verb, args, ok := decodeCTCP(text); ok && verb == "ACTION" {
+		text, action = args, true
+	}
+	plain, ok, err := key.decrypt(text)
+	if !ok {
+		return
+	} else if err != nil {
+		log.Warn().Str("api", ApiName).Str("target", target).Err(err).Msg("error decrypting fish message")
+		return
+	}
+	msg.Text = a.fallback.Decode(plain)
+	if action {
+		msg.Text = encodeCTCP("ACTION", msg.Text)
+	}
+	AnnotationFiSH.Set(msg, true)
+}
+
+// encryptFiSH returns text encrypted with key for sending. Actions are
+// encrypted inside the CTCP.
+func (a *API) encryptFiSH(key *fishKey, text string) string {
+	if verb, args, ok := decodeCTCP(text); ok {
+		if verb != "ACTION" {
+			return text
+		}
+		return encodeCTCP(verb, key.encrypt(a.encoding.Encode(args)))
+	}
+	return key.encrypt(a.encoding.Encode(text))
+}
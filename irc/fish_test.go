@@ -0,0 +1,74 @@
+package irc
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestFiSH(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"), WithFiSHKeys([]string{"#ecb=hunter2", "#cbc=cbc:hunter2"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	long := strings.Repeat("the quick brown fox jumps over the lazy dog ", 20)
+	for _, channel := range []string{"#ecb", "#cbc", "#plain"} {
+		for _, msg := range []*chatlib.Message{
+			{Command: "PRIVMSG", Receiver: channel, Text: "héllo"},
+			{Command: chatlib.CommandAction, Receiver: channel, Text: "waves"},
+			{Command: "PRIVMSG", Receiver: channel, Text: long},
+		} {
+			if err := a.SendMessage(c, msg); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for line := conn.next(); line != ""; line = conn.next() {
+				line = strings.TrimSuffix(line, "\n")
+				if len(line)+len("\r\n")+len(a.nick)+maxSourceBytes > maxLineBytes {
+					t.Errorf("expected lines to fit once encrypted, got %d bytes", len(line))
+				}
+				_, text, _ := strings.Cut(line, " :")
+				encrypted := strings.Contains(text, fishPrefix)
+				if encrypted != (channel != "#plain") {
+					t.Errorf("expected %s to be encrypted: %v, got %q", channel, channel != "#plain", text)
+				}
+				// The bot reads what it sent like anyone else in the channel
+				a.rawMsgs <- []byte(":alice!u@h PRIVMSG " + channel + " :" + text + "\r\n")
+				received, err := a.ReceiveMessage(c)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok, _ := AnnotationFiSH.Get(received); ok != encrypted {
+					t.Errorf("expected the fish annotation to be %v", encrypted)
+				}
+				got = append(got, received.Text)
+			}
+			if text := strings.Join(got, " "); text != strings.TrimSpace(msg.Text) {
+				t.Errorf("expected %q back from %s, got %q", msg.Text, channel, text)
+			}
+		}
+	}
+
+	// Messages from mircryption and FiSH 10 users decrypt whatever the mode
+	key, err := newFiSHKey("cbc:hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.rawMsgs <- []byte(":alice!u@h PRIVMSG #ecb :" + key.encrypt([]byte("cbc in ecb")) + "\r\n")
+	if msg, err := a.ReceiveMessage(c); err != nil || msg.Text != "cbc in ecb" {
+		t.Errorf("expected a cbc message to decrypt, got %v", err)
+	}
+	a.rawMsgs <- []byte(":alice!u@h PRIVMSG #ecb :+OK not*fish!\r\n")
+	if msg, err := a.ReceiveMessage(c); err != nil || msg.Text != "+OK not*fish!" {
+		t.Errorf("expected an invalid message to be left alone, got %v", err)
+	}
+
+	if _, err := New(WithFiSHKeys([]string{"#chan"})); err == nil {
+		t.Error("expected a key without a target to be refused")
+	}
+}
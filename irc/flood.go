@@ -0,0 +1,215 @@
+package irc
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultFloodProfile = "none"
+	// floodRecoverAfter is how long the server must go without complaining
+	// before a slowed down rate is raised again.
+	floodRecoverAfter = 10 * time.Minute
+	// minFloodRate is the slowest auto-tuning will go, in lines a second.
+	minFloodRate = 0.1
+)
+
+// Numerics servers send when the bot talks too fast or to too many targets.
+const (
+	errTooManyTargets = "407"
+	errTargetTooFast  = "439"
+)
+
+// FloodProfile is how fast lines may be sent to a network: Rate lines a
+// second on average, with bursts of up to Burst lines. A zero Rate doesn't
+// limit anything.
+type FloodProfile struct {
+	Rate  float64
+	Burst int
+}
+
+// FloodProfiles are presets for networks with well known throttles. "safe"
+// suits most networks that aren't listed.
+var FloodProfiles = map[string]FloodProfile{
+	"none":   {},
+	"safe":   {Rate: 0.5, Burst: 3},
+	"libera": {Rate: 0.5, Burst: 5},
+	"oftc":   {Rate: 0.5, Burst: 4},
+	"rizon":  {Rate: 1, Burst: 5},
+	// 20 messages every 30 seconds for accounts without moderator status
+	"twitch": {Rate: 20.0 / 30.0, Burst: 20},
+}
+
+// FloodProfileNames returns the names of the presets, sorted.
+func FloodProfileNames() []string {
+	names := make([]string, 0, len(FloodProfiles))
+	for name := range FloodProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithFloodProfile limits how fast lines are sent using one of
+// FloodProfiles. The rate is lowered if the server complains anyway.
+func WithFloodProfile(name string) Option {
+	return func(a *API) error {
+		p, ok := FloodProfiles[name]
+		if !ok {
+			return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: unknown flood profile %s, expected one of: %s", name, strings.Join(FloodProfileNames(), ", "))
+		}
+		a.throttle = newThrottle(p)
+		return nil
+	}
+}
+
+// WithSendRate limits sending to rate lines a second on average, with bursts
+// of up to burst lines, overriding the flood profile. A rate of 0 keeps the
+// profile's.
+func WithSendRate(rate float64, burst int) Option {
+	return func(a *API) error {
+		if rate < 0 || burst < 0 {
+			return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: send rate and burst must not be negative: %v, %d", rate, burst)
+		}
+		if rate == 0 {
+			return nil
+		}
+		a.throttle = newThrottle(FloodProfile{Rate: rate, Burst: max(1, burst)})
+		return nil
+	}
+}
+
+// unthrottled are commands that are never held back. A late PONG gets the
+// bot disconnected, and there is no point delaying a QUIT.
+var unthrottled = map[string]bool{
+	"PONG": true,
+	"QUIT": true,
+}
+
+// throttle is a token bucket limiting how fast lines are sent. Its rate is
+// lowered when the server complains and raised back to the profile's once it
+// has been quiet for a while.
+type throttle struct {
+	profile FloodProfile
+	now     func() time.Time
+
+	// queued counts the lines waiting to be sent.
+	queued atomic.Int32
+
+	mu         sync.Mutex
+	rate       float64
+	burst      float64
+	tokens     float64
+	last       time.Time
+	complained time.Time
+}
+
+func newThrottle(p FloodProfile) *throttle {
+	return &throttle{
+		profile: p,
+		now:     time.Now,
+		rate:    p.Rate,
+		burst:   float64(p.Burst),
+		tokens:  float64(p.Burst),
+	}
+}
+
+// wait blocks until a line may be sent.
+func (t *throttle) wait(c context.Context) error {
+	queued := false
+	defer func() {
+		if queued {
+			t.queued.Add(-1)
+		}
+	}()
+	for {
+		delay := t.take()
+		if delay == 0 {
+			return nil
+		}
+		if !queued {
+			queued = true
+			t.queued.Add(1)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-c.Done():
+			timer.Stop()
+			return c.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// take uses a token if there is one and otherwise returns how long until
+// there will be.
+func (t *throttle) take() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.rate <= 0 {
+		return 0
+	}
+	now := t.now()
+	if t.rate < t.profile.Rate && now.Sub(t.complained) > floodRecoverAfter {
+		t.rate = min(t.profile.Rate, t.rate*1.5)
+		t.burst = min(float64(t.profile.Burst), t.burst+1)
+		t.complained = now
+		log.Info().Str("api", ApiName).Msgf("raising send rate to %.2f lines a second", t.rate)
+	}
+	if !t.last.IsZero() {
+		t.tokens = min(t.burst, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	}
+	t.last = now
+	if t.tokens >= 1 {
+		t.tokens--
+		return 0
+	}
+	return time.Duration((1 - t.tokens) / t.rate * float64(time.Second))
+}
+
+// slowDown halves the rate after the server complained, starting from the
+// safe profile if there was no limit.
+func (t *throttle) slowDown(reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.rate <= 0 {
+		safe := FloodProfiles["safe"]
+		t.profile, t.rate, t.burst = safe, safe.Rate, float64(safe.Burst)
+	} else {
+		t.rate = max(minFloodRate, t.rate/2)
+		t.burst = max(1, t.burst/2)
+	}
+	t.tokens = 0
+	t.complained = t.now()
+	log.Warn().Str("api", ApiName).Msgf("%s, lowering send rate to %.2f lines a second", reason, t.rate)
+}
+
+// Queued implements chatlib.Queuer. Incoming are the lines received and not
+// handled yet, outgoing those held back by the send rate.
+func (a *API) Queued() (incoming, outgoing int) {
+	return len(a.rawMsgs), int(a.throttle.queued.Load())
+}
+
+// handleFlood slows sending down when the server says the bot is sending
+// too fast.
+func (a *API) handleFlood(msg *chatlib.Message) {
+	switch msg.Command {
+	case errTooManyTargets, errTargetTooFast:
+		a.throttle.slowDown("server refused message: " + msg.Text)
+	}
+}
+
+// isExcessFlood reports whether an ERROR line is the server disconnecting
+// the bot for flooding.
+func isExcessFlood(text string) bool {
+	text = strings.ToLower(text)
+	return strings.Contains(text, "excess flood") || strings.Contains(text, "max sendq exceeded")
+}
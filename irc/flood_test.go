@@ -0,0 +1,143 @@
+package irc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestThrottle(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	th := newThrottle(FloodProfile{Rate: 1, Burst: 2})
+	th.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		if d := th.take(); d != 0 {
+			t.Fatalf("expected burst line %d to be sent at once, got delay %s", i, d)
+		}
+	}
+	if d := th.take(); d != time.Second {
+		t.Errorf("expected a one second delay after the burst, got %s", d)
+	}
+	now = now.Add(time.Second)
+	if d := th.take(); d != 0 {
+		t.Errorf("expected a token after a second, got delay %s", d)
+	}
+
+	th.slowDown("test")
+	if th.rate != 0.5 || th.burst != 1 {
+		t.Errorf("expected rate 0.5 and burst 1 after slowing down, got %v and %v", th.rate, th.burst)
+	}
+	if d := th.take(); d != 2*time.Second {
+		t.Errorf("expected a two second delay after slowing down, got %s", d)
+	}
+	now = now.Add(floodRecoverAfter + time.Second)
+	th.take()
+	if th.rate != 0.75 || th.burst != 2 {
+		t.Errorf("expected rate 0.75 and burst 2 after recovering, got %v and %v", th.rate, th.burst)
+	}
+}
+
+func TestFloodAutoTune(t *testing.T) {
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := a.throttle.take(); d != 0 {
+		t.Fatalf("expected no limit by default, got delay %s", d)
+	}
+	a.rawMsgs <- []byte(":irc.example.net 439 bot #test :Target change too fast\r\n")
+	if _, err := a.ReceiveMessage(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if a.throttle.rate != FloodProfiles["safe"].Rate {
+		t.Errorf("expected the safe rate after 439, got %v", a.throttle.rate)
+	}
+	a.rawMsgs <- []byte("ERROR :Closing Link: bot (Excess Flood)\r\n")
+	if _, err := a.ReceiveMessage(context.Background()); err == nil {
+		t.Error("expected an error for ERROR")
+	}
+	if a.throttle.rate != FloodProfiles["safe"].Rate/2 {
+		t.Errorf("expected the rate to be halved after excess flood, got %v", a.throttle.rate)
+	}
+
+	if err := WithFloodProfile("nope")(a); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
+
+func TestSendRate(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithFloodProfile("libera"), WithSendRate(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := a.throttle.profile; p.Rate != 1 || p.Burst != 1 {
+		t.Fatalf("expected the send rate to override the profile, got %+v", p)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	now := time.Now()
+	a.throttle.now = func() time.Time { return now }
+	if err := a.SendMessage(c, &chatlib.Message{Command: "PRIVMSG", Receiver: "#test", Text: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	// The bucket is empty but PONG and QUIT don't wait
+	for _, cmd := range []string{"PONG", "QUIT"} {
+		if err := a.SendMessage(c, &chatlib.Message{Command: cmd, Text: "x"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancelled, cancel := context.WithCancel(c)
+	cancel()
+	if err := a.SendMessage(cancelled, &chatlib.Message{Command: "PRIVMSG", Receiver: "#test", Text: "two"}); err == nil {
+		t.Error("expected sending to wait for the rate limit")
+	}
+	for _, expected := range []string{"PRIVMSG #test :one\n", "PONG :x\n", "QUIT :x\n", ""} {
+		if line := conn.next(); line != expected {
+			t.Errorf("expected %q, got %q", expected, line)
+		}
+	}
+
+	if _, err := New(WithSendRate(-1, 1)); err == nil {
+		t.Error("expected an error for a negative rate")
+	}
+}
+
+func TestQueued(t *testing.T) {
+	a, err := New(WithSendRate(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.conn = &bufConn{}
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a.rawMsgs <- []byte(":alice!u@h PRIVMSG #test :hi\r\n")
+	if err := a.sendLine(c, "PRIVMSG", "PRIVMSG #test :first"); err != nil {
+		t.Fatal(err)
+	}
+	// The next lines wait for the send rate
+	for i := 0; i < 2; i++ {
+		go a.sendLine(c, "PRIVMSG", "PRIVMSG #test :later")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		incoming, outgoing := a.Queued()
+		if incoming == 1 && outgoing == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 1 line in and 2 out, got %d and %d", incoming, outgoing)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	deadline = time.Now().Add(time.Second)
+	for _, outgoing := a.Queued(); outgoing != 0; _, outgoing = a.Queued() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected nothing waiting once cancelled, got %d", outgoing)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
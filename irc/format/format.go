@@ -0,0 +1,216 @@
+// Package format composes and strips the mIRC formatting codes IRC clients
+// use for bold, italics, underline and colors.
+package format
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Formatting codes. Each toggles its style, apart from Reset, which turns
+// every style and color off, and ColorCode, which is followed by the colors.
+const (
+	BoldCode          = '\x02'
+	ColorCode         = '\x03'
+	HexColorCode      = '\x04'
+	ResetCode         = '\x0f'
+	MonospaceCode     = '\x11'
+	ReverseCode       = '\x16'
+	ItalicCode        = '\x1d'
+	StrikethroughCode = '\x1e'
+	UnderlineCode     = '\x1f'
+)
+
+// Color is one of the 16 standard mIRC colors. Clients show 16 to 98 too,
+// but not all of them agree on what they look like.
+type Color int
+
+const (
+	// None leaves the color as it is, e.g. to only set the background.
+	None Color = iota - 1
+	White
+	Black
+	Blue
+	Green
+	Red
+	Brown
+	Magenta
+	Orange
+	Yellow
+	LightGreen
+	Cyan
+	LightCyan
+	LightBlue
+	Pink
+	Grey
+	LightGrey
+)
+
+// Bold returns s in bold.
+func Bold(s string) string {
+	return wrap(BoldCode, s)
+}
+
+// Italic returns s in italics.
+func Italic(s string) string {
+	return wrap(ItalicCode, s)
+}
+
+// Underline returns s underlined.
+func Underline(s string) string {
+	return wrap(UnderlineCode, s)
+}
+
+// Strikethrough returns s struck through.
+func Strikethrough(s string) string {
+	return wrap(StrikethroughCode, s)
+}
+
+// Monospace returns s in a monospace font.
+func Monospace(s string) string {
+	return wrap(MonospaceCode, s)
+}
+
+// Colored returns s in the foreground color fg on the background color bg.
+// Either can be None.
+func Colored(s string, fg, bg Color) string {
+	return colorCode(fg, bg, s) + s + string(ColorCode)
+}
+
+func wrap(code rune, s string) string {
+	return string(code) + s + string(code)
+}
+
+// colorCode returns the code setting fg and bg for text s. Colors are always
+// written with two digits, so text starting with a digit isn't read as part
+// of the color.
+func colorCode(fg, bg Color, s string) string {
+	var code string
+	switch {
+	case fg == None && bg == None:
+		return ""
+	case bg == None:
+		code = fmt.Sprintf("%c%02d", ColorCode, fg)
+	case fg == None:
+		// The foreground can't be left out, so the default one is used
+		code = fmt.Sprintf("%c99,%02d", ColorCode, bg)
+	default:
+		code = fmt.Sprintf("%c%02d,%02d", ColorCode, fg, bg)
+	}
+	if bg == None && strings.HasPrefix(s, ",") {
+		// A comma right after the color would start a background color, so
+		// it is separated by an empty bold toggle
+		code += string(BoldCode) + string(BoldCode)
+	}
+	return code
+}
+
+// Builder composes formatted text. The zero value is ready to use.
+//
+//	var b format.Builder
+//	b.Bold("warning:").Text(" disk ").Colored("full", format.Red, format.None)
+//	msg.Text = b.String()
+type Builder struct {
+	sb strings.Builder
+}
+
+// Text adds s as it is.
+func (b *Builder) Text(s string) *Builder {
+	b.sb.WriteString(s)
+	return b
+}
+
+func (b *Builder) Bold(s string) *Builder {
+	return b.Text(Bold(s))
+}
+
+func (b *Builder) Italic(s string) *Builder {
+	return b.Text(Italic(s))
+}
+
+func (b *Builder) Underline(s string) *Builder {
+	return b.Text(Underline(s))
+}
+
+func (b *Builder) Strikethrough(s string) *Builder {
+	return b.Text(Strikethrough(s))
+}
+
+func (b *Builder) Monospace(s string) *Builder {
+	return b.Text(Monospace(s))
+}
+
+func (b *Builder) Colored(s string, fg, bg Color) *Builder {
+	return b.Text(Colored(s, fg, bg))
+}
+
+// Reset turns every style and color off.
+func (b *Builder) Reset() *Builder {
+	b.sb.WriteRune(ResetCode)
+	return b
+}
+
+func (b *Builder) String() string {
+	return b.sb.String()
+}
+
+// StripFormatting removes formatting codes from s, including the colors
+// following color codes, leaving the text as it reads.
+func StripFormatting(s string) string {
+	if strings.IndexFunc(s, isCode) < 0 {
+		return s
+	}
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case BoldCode, ResetCode, MonospaceCode, ReverseCode, ItalicCode, StrikethroughCode, UnderlineCode:
+		case ColorCode:
+			i += colorLength(s[i+1:], 2, isDigit)
+		case HexColorCode:
+			i += colorLength(s[i+1:], 6, isHexDigit)
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String()
+}
+
+func isCode(r rune) bool {
+	switch r {
+	case BoldCode, ColorCode, HexColorCode, ResetCode, MonospaceCode, ReverseCode, ItalicCode, StrikethroughCode, UnderlineCode:
+		return true
+	}
+	return false
+}
+
+// colorLength returns the length of the colors at the start of s: a
+// foreground of up to n digits, optionally followed by a comma and a
+// background. The comma is only part of the colors if a digit follows it.
+func colorLength(s string, n int, digit func(byte) bool) int {
+	fg := digits(s, n, digit)
+	if fg == 0 || fg >= len(s) || s[fg] != ',' {
+		return fg
+	}
+	if bg := digits(s[fg+1:], n, digit); bg > 0 {
+		return fg + 1 + bg
+	}
+	return fg
+}
+
+// digits returns how many of the first n bytes of s are digits.
+func digits(s string, n int, digit func(byte) bool) int {
+	i := 0
+	for i < n && i < len(s) && digit(s[i]) {
+		i++
+	}
+	return i
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+func isHexDigit(b byte) bool {
+	return isDigit(b) || b >= 'a' && b <= 'f' || b >= 'A' && b <= 'F'
+}
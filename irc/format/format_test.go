@@ -0,0 +1,33 @@
+package format
+
+import "testing"
+
+func TestBuilder(t *testing.T) {
+	var b Builder
+	b.Bold("warning:").Text(" disk ").Colored("5", Red, None).Colored(",ok", Blue, None).Colored("low", None, Yellow).Reset()
+	expected := "\x02warning:\x02 disk \x03045\x03\x0302\x02\x02,ok\x03\x0399,08low\x03\x0f"
+	if s := b.String(); s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+	if s := StripFormatting(b.String()); s != "warning: disk 5,oklow" {
+		t.Errorf("expected the text back, got %q", s)
+	}
+}
+
+func TestStripFormatting(t *testing.T) {
+	for _, tc := range []struct{ text, expected string }{
+		{"!ping", "!ping"},
+		{"\x0304!ping", "!ping"},
+		{"\x034,12!ping\x03", "!ping"},
+		{"\x03!ping", "!ping"},
+		{"\x031,2,3", ",3"},
+		{"\x035,text", ",text"},
+		{"\x03123", "3"},
+		{"\x04ff0000,00FF00red\x04", "red"},
+		{"\x1d\x1fitalic underline\x0f \x16reverse\x16 \x1estruck\x1e \x11mono\x11", "italic underline reverse struck mono"},
+	} {
+		if s := StripFormatting(tc.text); s != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.text, tc.expected, s)
+		}
+	}
+}
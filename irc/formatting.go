@@ -0,0 +1,37 @@
+package irc
+
+import (
+	"github.com/gregseb/chatlib"
+	"github.com/gregseb/chatlib/irc/format"
+)
+
+// AnnotationFormattedText holds the text of a message as it was sent, with
+// its formatting codes, when they were stripped.
+var AnnotationFormattedText = chatlib.NewAnnotationKey[string]("irc.formatted-text")
+
+// WithStripFormatting sets whether formatting codes, such as colors and bold,
+// are stripped from the text of messages, notices and actions received, so
+// that a command with a stray color code still matches. The text as sent is
+// kept in AnnotationFormattedText.
+func WithStripFormatting(enable bool) Option {
+	return func(a *API) error {
+		a.stripFormat = enable
+		return nil
+	}
+}
+
+// handleFormatting strips formatting codes from msg's text if enabled.
+func (a *API) handleFormatting(msg *chatlib.Message) {
+	if !a.stripFormat {
+		return
+	}
+	switch msg.Command {
+	case "PRIVMSG", "NOTICE", chatlib.CommandAction:
+	default:
+		return
+	}
+	if text := format.StripFormatting(msg.Text); text != msg.Text {
+		AnnotationFormattedText.Set(msg, msg.Text)
+		msg.Text = text
+	}
+}
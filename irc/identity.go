@@ -0,0 +1,98 @@
+package irc
+
+import (
+	"math/rand"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// How the bot's identity is chosen for each connection.
+const (
+	// IdentityFixed uses the configured nick on every connection.
+	IdentityFixed = "fixed"
+	// IdentityRotate takes the next nick, username and realname from the
+	// pools on each connection.
+	IdentityRotate = "rotate"
+	// IdentityRandom picks each of them from the pools at random.
+	IdentityRandom = "random"
+)
+
+// identityPools are what rotated identities are made of.
+type identityPools struct {
+	nicks     []string
+	usernames []string
+	realnames []string
+}
+
+// WithIdentityRotation changes the bot's nick, username and realname on every
+// connection, taken from the pools as set by mode, one of the Identity
+// constants. The username and realname default to the nick if their pool is
+// empty. The other nicks in the pool are the alternates if the chosen one is
+// in use. Rotation can't be combined with authentication, which would tie the
+// identities together.
+func WithIdentityRotation(mode string, nicks, usernames, realnames []string) Option {
+	return func(a *API) error {
+		switch mode {
+		case IdentityFixed:
+			a.identityMode = mode
+			return nil
+		case IdentityRotate, IdentityRandom:
+		default:
+			return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: invalid identity rotation: %s", mode)
+		}
+		if len(nicks) == 0 {
+			return errors.WithMessage(chatlib.ErrInvalidConfig, "irc: identity rotation requires a pool of nicks")
+		}
+		a.identityMode = mode
+		a.identities = identityPools{nicks, usernames, realnames}
+		return nil
+	}
+}
+
+// rotatesIdentity reports whether the identity changes between connections.
+func (a *API) rotatesIdentity() bool {
+	return a.identityMode == IdentityRotate || a.identityMode == IdentityRandom
+}
+
+// nextIdentity picks the nick, username and realname for a new connection.
+// The nick becomes the primary nick, with the rest of the pool as alternates.
+func (a *API) nextIdentity() (username, realname string) {
+	if !a.rotatesIdentity() {
+		realname = "FreyaBot"
+		if a.primaryNick != DefaultNick {
+			realname = realname + " (" + a.primaryNick + ")"
+		}
+		return a.primaryNick, realname
+	}
+	seq := a.identitySeq
+	a.identitySeq++
+	pick := func(pool []string) string {
+		if len(pool) == 0 {
+			return ""
+		}
+		if a.identityMode == IdentityRandom {
+			return pool[rand.Intn(len(pool))]
+		}
+		return pool[seq%len(pool)]
+	}
+	nicks := a.identities.nicks
+	nick := pick(nicks)
+	a.primaryNick = nick
+	a.altNicks = make([]string, 0, len(nicks)-1)
+	for i := range nicks {
+		if alt := nicks[(seq+1+i)%len(nicks)]; alt != nick {
+			a.altNicks = append(a.altNicks, alt)
+		}
+	}
+	username, realname = pick(a.identities.usernames), pick(a.identities.realnames)
+	if username == "" {
+		username = nick
+	}
+	if realname == "" {
+		realname = nick
+	}
+	log.Info().Str("api", ApiName).Msgf("using identity %s (%s, %s)", nick, username, realname)
+	return username, realname
+}
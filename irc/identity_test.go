@@ -0,0 +1,51 @@
+package irc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+)
+
+func TestIdentityRotation(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"), WithIdentityRotation(IdentityRotate, []string{"amber", "basil", "cedar"}, []string{"u1", "u2"}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []struct {
+		nick, user, alt string
+	}{
+		{"amber", "USER u1 0 * :amber\n", "basil"},
+		{"basil", "USER u2 0 * :basil\n", "cedar"},
+		{"cedar", "USER u1 0 * :cedar\n", "amber"},
+	} {
+		conn := &bufConn{}
+		a.conn = conn
+		if err := a.login(c); err != nil {
+			t.Fatal(err)
+		}
+		if a.Nick() != expected.nick {
+			t.Errorf("expected nick %s, got %s", expected.nick, a.Nick())
+		}
+		// CAP LS, NICK, then USER
+		conn.next()
+		if line := conn.next(); line != "NICK "+expected.nick+"\n" {
+			t.Errorf("expected NICK %s, got %q", expected.nick, line)
+		}
+		if line := conn.next(); line != expected.user {
+			t.Errorf("expected %q, got %q", expected.user, line)
+		}
+		if nick, _ := a.nextNick(); nick != expected.alt {
+			t.Errorf("expected alternate %s, got %s", expected.alt, nick)
+		}
+	}
+
+	if _, err := New(WithIdentityRotation(IdentityRandom, []string{"amber"}, nil, nil), WithAuthMethod(AuthMethodNickServ)); !errors.Is(err, chatlib.ErrInvalidConfig) {
+		t.Errorf("expected rotation with authentication to be refused, got %v", err)
+	}
+	if _, err := New(WithIdentityRotation(IdentityRandom, nil, nil, nil)); !errors.Is(err, chatlib.ErrInvalidConfig) {
+		t.Errorf("expected rotation without nicks to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package irc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// idleCheckInterval is how often channels are checked for idleness.
+const idleCheckInterval = time.Minute
+
+// idleState follows the activity of the bot's channels.
+type idleState struct {
+	after  time.Duration
+	exempt []string
+
+	mu sync.Mutex
+	// active is when something was last said in each channel, and parted
+	// the channels parted for being idle, by lowercased name.
+	active map[string]time.Time
+	parted map[string]bool
+}
+
+// WithIdlePart parts channels nothing was said in for hours, keeping bots on
+// large networks under their channel limits. Critical channels and those
+// given to WithIdleExempt are never parted. The admins are told, and the
+// channel is rejoined when an admin asks with !join or the bot has something
+// to say there. 0 disables it.
+func WithIdlePart(hours float64) Option {
+	return func(a *API) error {
+		if hours < 0 {
+			return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: invalid idle part delay %v", hours)
+		}
+		a.idle.after = time.Duration(hours * float64(time.Hour))
+		return nil
+	}
+}
+
+// WithIdleExempt adds channels that are never parted for being idle.
+func WithIdleExempt(channels []string) Option {
+	return func(a *API) error {
+		a.idle.exempt = append(a.idle.exempt, channels...)
+		return nil
+	}
+}
+
+// trackIdle records activity in channels: messages said in them, and the
+// bot joining them. Idle channels are checked for once registered.
+func (a *API) trackIdle(c context.Context, msg *chatlib.Message) {
+	if a.idle.after == 0 || msg.Replayed {
+		return
+	}
+	switch msg.Command {
+	case rplWelcome:
+		go a.watchIdle(c)
+		return
+	case "PRIVMSG", "NOTICE", "TAGMSG":
+	case "JOIN":
+		if !strings.EqualFold(msg.Nick, a.nick) {
+			return
+		}
+	default:
+		return
+	}
+	if !a.isChannel(msg.Receiver) {
+		return
+	}
+	a.touchChannel(msg.Receiver, time.Now())
+}
+
+func (a *API) touchChannel(channel string, now time.Time) {
+	a.idle.mu.Lock()
+	defer a.idle.mu.Unlock()
+	if a.idle.active == nil {
+		a.idle.active = make(map[string]time.Time)
+	}
+	a.idle.active[strings.ToLower(channel)] = now
+}
+
+// watchIdle parts idle channels every so often, until the connection is
+// replaced.
+func (a *API) watchIdle(c context.Context) {
+	conn := a.conn
+	t := time.NewTicker(idleCheckInterval)
+	defer t.Stop()
+	for a.open && a.conn == conn {
+		select {
+		case <-c.Done():
+			return
+		case <-t.C:
+		}
+		if err := a.partIdle(c, time.Now()); err != nil {
+			log.Error().Str("api", ApiName).Err(err).Msg("error parting idle channels")
+		}
+	}
+}
+
+// partIdle parts the channels joined that were idle for too long at now.
+func (a *API) partIdle(c context.Context, now time.Time) error {
+	for _, channel := range a.idleChannels(now) {
+		idle := now.Sub(a.lastActive(channel)).Round(time.Minute)
+		log.Info().Str("api", ApiName).Msgf("parting %s, idle for %s", channel, idle)
+		if err := a.leaveChannel(c, channel); err != nil {
+			return err
+		}
+		a.idle.mu.Lock()
+		if a.idle.parted == nil {
+			a.idle.parted = make(map[string]bool)
+		}
+		a.idle.parted[strings.ToLower(channel)] = true
+		a.idle.mu.Unlock()
+		if err := a.rememberIdle(c, channel); err != nil {
+			log.Error().Str("api", ApiName).Err(err).Msg("error saving channel state")
+		}
+		if a.notifyAdmins != nil {
+			a.notifyAdmins(c, fmt.Sprintf("parted %s, idle for %s; !join %s to rejoin", channel, idle, channel))
+		}
+	}
+	return nil
+}
+
+// idleChannels returns the channels joined that can be parted and were idle
+// for too long at now, in order.
+func (a *API) idleChannels(now time.Time) []string {
+	a.joinMu.Lock()
+	joined := make([]string, 0, len(a.joins))
+	for channel, state := range a.joins {
+		if state == joinDone {
+			joined = append(joined, channel)
+		}
+	}
+	a.joinMu.Unlock()
+	sort.Strings(joined)
+	idle := make([]string, 0)
+	for _, channel := range joined {
+		if containsChannel(a.criticalChannels, channel) || containsChannel(a.idle.exempt, channel) {
+			continue
+		}
+		if now.Sub(a.lastActive(channel)) >= a.idle.after {
+			idle = append(idle, channel)
+		}
+	}
+	return idle
+}
+
+// lastActive returns when something was last said in channel, or now if it
+// was never seen, so it is only parted after being seen idle for long
+// enough.
+func (a *API) lastActive(channel string) time.Time {
+	a.idle.mu.Lock()
+	defer a.idle.mu.Unlock()
+	if a.idle.active == nil {
+		a.idle.active = make(map[string]time.Time)
+	}
+	t, ok := a.idle.active[strings.ToLower(channel)]
+	if !ok {
+		t = time.Now()
+		a.idle.active[strings.ToLower(channel)] = t
+	}
+	return t
+}
+
+// idleParted reports whether channel was parted for being idle.
+func (a *API) idleParted(channel string) bool {
+	a.idle.mu.Lock()
+	defer a.idle.mu.Unlock()
+	return a.idle.parted[strings.ToLower(channel)]
+}
+
+// setIdleParted sets the channels parted for being idle, as loaded from the
+// channel state.
+func (a *API) setIdleParted(channels []string) {
+	a.idle.mu.Lock()
+	defer a.idle.mu.Unlock()
+	a.idle.parted = make(map[string]bool, len(channels))
+	for _, channel := range channels {
+		a.idle.parted[strings.ToLower(channel)] = true
+	}
+}
+
+// unidle forgets that channel was parted for being idle, as it is being
+// joined again.
+func (a *API) unidle(channel string) {
+	a.idle.mu.Lock()
+	defer a.idle.mu.Unlock()
+	delete(a.idle.parted, strings.ToLower(channel))
+}
+
+// rememberIdle records a channel parted for being idle, so it stays parted
+// across restarts until it is rejoined.
+func (a *API) rememberIdle(c context.Context, channel string) error {
+	state, err := a.loadChannelState(c)
+	if err != nil {
+		return err
+	}
+	if !containsChannel(state.Idle, channel) {
+		state.Idle = append(state.Idle, channel)
+	}
+	return a.saveChannelState(c, state)
+}
+
+// rejoinIdle rejoins a channel parted for being idle, when the bot has
+// something to say there, and counts what it says as activity.
+func (a *API) rejoinIdle(c context.Context, channel string) error {
+	if a.idle.after == 0 || !a.isChannel(channel) {
+		return nil
+	}
+	a.touchChannel(channel, time.Now())
+	if !a.idleParted(channel) {
+		return nil
+	}
+	log.Info().Str("api", ApiName).Msgf("rejoining idle channel %s to send to it", channel)
+	if err := a.joinChannel(c, channel); err != nil {
+		return err
+	}
+	a.unidle(channel)
+	return a.forgetIdle(c, channel)
+}
+
+// forgetIdle removes channel from the channels parted for being idle in the
+// channel state.
+func (a *API) forgetIdle(c context.Context, channel string) error {
+	state, err := a.loadChannelState(c)
+	if err != nil {
+		return err
+	}
+	if !containsChannel(state.Idle, channel) {
+		return nil
+	}
+	state.Idle = withoutChannels(state.Idle, []string{channel})
+	return a.saveChannelState(c, state)
+}
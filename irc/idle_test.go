@@ -0,0 +1,87 @@
+package irc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestIdlePart(t *testing.T) {
+	c := context.Background()
+	var notified []string
+	a, err := New(
+		WithNick("bot"),
+		WithChannels([]string{"#busy", "#quiet", "#kept"}),
+		WithCriticalChannels([]string{"#ops"}),
+		WithIdlePart(1),
+		WithIdleExempt([]string{"#kept"}),
+		WithWhoOnJoin(false),
+		WithAdminNotifier(func(c context.Context, text string) { notified = append(notified, text) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.UseStore(chatlib.NewMemoryStore())
+	conn := &bufConn{}
+	a.conn = conn
+	a.connectTime = time.Now()
+	receive := func(line string) {
+		t.Helper()
+		a.rawMsgs <- []byte(line)
+		if _, err := a.ReceiveMessage(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, channel := range []string{"#busy", "#quiet", "#kept", "#ops"} {
+		receive(":bot!u@h JOIN " + channel + "\r\n")
+	}
+	receive(":alice!u@h PRIVMSG #busy :hello\r\n")
+	sent := func() string {
+		s := conn.String()
+		conn.Reset()
+		return s
+	}
+	sent()
+
+	now := time.Now()
+	if err := a.partIdle(c, now.Add(59*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if lines := sent(); lines != "" {
+		t.Errorf("expected no channel to be idle yet, sent %q", lines)
+	}
+	// Replayed history isn't activity
+	receive("@time=2000-01-01T00:00:00.000Z :alice!u@h PRIVMSG #quiet :old news\r\n")
+	a.touchChannel("#busy", now.Add(30*time.Minute))
+	if err := a.partIdle(c, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if lines := sent(); lines != "PART #quiet\n" {
+		t.Errorf("expected only #quiet to be parted, sent %q", lines)
+	}
+	if len(notified) != 1 || !strings.HasPrefix(notified[0], "parted #quiet, idle for 1h") {
+		t.Errorf("expected the admins to be told, got %v", notified)
+	}
+	receive(":bot!u@h PART #quiet\r\n")
+	state, err := a.loadChannelState(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Idle) != 1 || state.Idle[0] != "#quiet" || len(state.Parted) != 0 {
+		t.Errorf("expected #quiet to be remembered as idle, got %+v", state)
+	}
+
+	// Having something to say there rejoins it
+	if err := a.SendMessage(c, &chatlib.Message{Command: "PRIVMSG", Receiver: "#quiet", Text: "news"}); err != nil {
+		t.Fatal(err)
+	}
+	if lines := sent(); lines != "JOIN #quiet\nPRIVMSG #quiet :news\n" {
+		t.Errorf("expected #quiet to be rejoined, sent %q", lines)
+	}
+	if state, _ := a.loadChannelState(c); len(state.Idle) != 0 || a.idleParted("#quiet") {
+		t.Errorf("expected #quiet to be forgotten as idle, got %+v", state)
+	}
+}
@@ -0,0 +1,71 @@
+package irc
+
+import (
+	"context"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// What to do when invited to a channel the bot didn't ask to join.
+const (
+	InvitePolicyIgnore = "ignore"
+	// InvitePolicyAdmin joins if the invite is from one of the admins.
+	InvitePolicyAdmin = "admin"
+	InvitePolicyAny   = "any"
+)
+
+const DefaultInvitePolicy = InvitePolicyIgnore
+
+// WithInvitePolicy sets what to do with invites the bot didn't ask for, one
+// of the InvitePolicy constants. If persist is set, channels joined by invite
+// are remembered like those joined with !join and rejoined on reconnect.
+func WithInvitePolicy(policy string, persist bool) Option {
+	return func(a *API) error {
+		switch policy {
+		case InvitePolicyIgnore, InvitePolicyAdmin, InvitePolicyAny:
+			a.invitePolicy = policy
+			a.invitePersist = persist
+			return nil
+		}
+		return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: invalid invite policy: %s", policy)
+	}
+}
+
+// WithAdminCheck sets the function used to tell whether a nick is one of the
+// bot's admins.
+func WithAdminCheck(isAdmin func(nick string) bool) Option {
+	return func(a *API) error {
+		a.isAdmin = isAdmin
+		return nil
+	}
+}
+
+// handleInvite joins a channel the bot was invited to if the invite policy
+// allows it.
+func (a *API) handleInvite(c context.Context, msg *chatlib.Message) error {
+	channel := msg.Text
+	if !a.isChannel(channel) || a.joinState(channel) != joinNone {
+		return nil
+	}
+	switch a.invitePolicy {
+	case InvitePolicyAny:
+	case InvitePolicyAdmin:
+		if a.isAdmin == nil || !a.isAdmin(msg.Nick) {
+			log.Info().Str("api", ApiName).Msgf("ignoring invite to %s from %s, who is not an admin", channel, msg.Nick)
+			return nil
+		}
+	default:
+		log.Info().Str("api", ApiName).Msgf("ignoring invite to %s from %s", channel, msg.Nick)
+		return nil
+	}
+	log.Info().Str("api", ApiName).Msgf("invited to %s by %s, joining", channel, msg.Nick)
+	if err := a.joinChannel(c, channel); err != nil {
+		return err
+	}
+	if !a.invitePersist {
+		return nil
+	}
+	return a.rememberJoin(c, channel)
+}
@@ -0,0 +1,51 @@
+package irc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestInvitePolicy(t *testing.T) {
+	c := context.Background()
+	for _, tc := range []struct {
+		policy   string
+		line     string
+		expected string
+	}{
+		{InvitePolicyIgnore, ":admin!u@h INVITE bot :#new\r\n", ""},
+		{InvitePolicyAdmin, ":someone!u@h INVITE bot :#new\r\n", ""},
+		{InvitePolicyAdmin, ":Admin!u@h INVITE bot :#new\r\n", "JOIN #new\n"},
+		{InvitePolicyAny, ":someone!u@h INVITE bot :#new\r\n", "JOIN #new\n"},
+		// Not for the bot
+		{InvitePolicyAny, ":someone!u@h INVITE other :#new\r\n", ""},
+	} {
+		store := chatlib.NewMemoryStore()
+		a, err := New(
+			WithNick("bot"),
+			WithInvitePolicy(tc.policy, true),
+			WithAdminCheck(func(nick string) bool { return nick == "Admin" }),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.UseStore(store)
+		conn := &bufConn{}
+		a.conn = conn
+		a.rawMsgs <- []byte(tc.line)
+		if _, err := a.ReceiveMessage(c); err != nil {
+			t.Fatal(err)
+		}
+		if line := conn.next(); line != tc.expected {
+			t.Errorf("%s %q: expected %q, got %q", tc.policy, tc.line, tc.expected, line)
+		}
+		state, err := a.loadChannelState(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if joined := containsChannel(state.Joined, "#new"); joined != (tc.expected != "") {
+			t.Errorf("%s %q: expected the channel to be remembered only if joined, got %v", tc.policy, tc.line, state.Joined)
+		}
+	}
+}
@@ -7,28 +7,36 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gregseb/chatlib"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/net/proxy"
 )
 
 const ApiName = "irc"
 
 const (
-	DefaultNick                    = "freyabot"
-	DefaultLoginDelaySeconds       = 5
-	DefaultDialTimeoutSeconds      = 10
-	DefaultKeepAliveSeconds        = 60
-	DefaultMsgBufferSize           = 100
-	DefaultTlsPort                 = 6697
-	DefaultPlainPort               = 6667
-	ReadDelimiter             byte = '\n'
+	DefaultNick                      = "freyabot"
+	DefaultLoginDelaySeconds         = 5
+	DefaultDialTimeoutSeconds        = 10
+	DefaultKeepAliveSeconds          = 60
+	DefaultMsgBufferSize             = 100
+	DefaultLazyJoinDelaySeconds      = 30
+	DefaultTlsPort                   = 6697
+	DefaultPlainPort                 = 6667
+	ReadDelimiter               byte = '\n'
+	// MaxLineBytes is the longest line read from the server: 8191 bytes of
+	// IRCv3 message tags and 512 for the message itself. Longer lines are
+	// dropped.
+	MaxLineBytes = 8191 + 512
 )
 
 const (
@@ -36,16 +44,31 @@ const (
 	AuthMethodNickServ
 	AuthMethodSASL
 	AuthMethodCertFP
+	AuthMethodSASLExternal
+	AuthMethodSASLScramSHA256
 )
 
-const linePattern = `^:(?P<sender>\S+) (?P<command>\S+) (?P<recipient>\S+) :?(.*)\r\n$`
-const pingPattern = `^PING :(?P<arg>.*)\r\n$`
-const errPattern = `^ERROR :(?P<msg>.*)\r\n$`
+// WithNetwork sets the server to connect to, and the other servers of the
+// network, as host:port or host for the default port, to fail over to when
+// it can't be reached or the connection is lost. Servers are tried in turn,
+// round-robin.
+func WithNetwork(host string, port int, servers ...string) Option {
+	return func(a *API) error {
+		others, err := parseServers(servers)
+		if err != nil {
+			return err
+		}
+		a.servers = append([]server{{host, port}}, others...)
+		a.useServer(0)
+		return nil
+	}
+}
 
-func WithNetwork(host string, port int) Option {
+// WithName sets the name the Handler knows the API by. It defaults to
+// ApiName and must be set when a Handler connects to several IRC networks.
+func WithName(name string) Option {
 	return func(a *API) error {
-		a.networkHost = host
-		a.networkPort = port
+		a.name = name
 		return nil
 	}
 }
@@ -53,6 +76,7 @@ func WithNetwork(host string, port int) Option {
 func WithNick(nick string) Option {
 	return func(a *API) error {
 		a.nick = nick
+		a.primaryNick = nick
 		return nil
 	}
 }
@@ -64,6 +88,15 @@ func WithPassword(password string) Option {
 	}
 }
 
+// WithAccount sets the account name used for SASL authentication. It defaults
+// to the nick.
+func WithAccount(account string) Option {
+	return func(a *API) error {
+		a.account = account
+		return nil
+	}
+}
+
 func WithAuthMethod(method int) Option {
 	return func(a *API) error {
 		a.authMethod = method
@@ -71,12 +104,14 @@ func WithAuthMethod(method int) Option {
 	}
 }
 
+// WithChannel adds a channel to join, optionally with its key as
+// #channel:key.
 func WithChannel(channel string) Option {
 	return func(a *API) error {
 		if a.channels == nil {
 			a.channels = make([]string, 0)
 		}
-		a.channels = append(a.channels, channel)
+		a.channels = append(a.channels, a.splitKeys([]string{channel})...)
 		return nil
 	}
 }
@@ -86,7 +121,32 @@ func WithChannels(channels []string) Option {
 		if a.channels == nil {
 			a.channels = make([]string, 0)
 		}
-		a.channels = append(a.channels, channels...)
+		a.channels = append(a.channels, a.splitKeys(channels)...)
+		return nil
+	}
+}
+
+// WithCriticalChannels adds channels that are joined before any others. The
+// API is not marked ready until all critical channels have been joined.
+func WithCriticalChannels(channels []string) Option {
+	return func(a *API) error {
+		a.criticalChannels = append(a.criticalChannels, a.splitKeys(channels)...)
+		return nil
+	}
+}
+
+// WithLazyChannels adds channels that are joined after the lazy join delay,
+// or as soon as a message is sent to them, whichever comes first.
+func WithLazyChannels(channels []string) Option {
+	return func(a *API) error {
+		a.lazyChannels = append(a.lazyChannels, a.splitKeys(channels)...)
+		return nil
+	}
+}
+
+func WithLazyJoinDelay(seconds float64) Option {
+	return func(a *API) error {
+		a.lazyJoinDelaySeconds = seconds
 		return nil
 	}
 }
@@ -128,27 +188,145 @@ func CombineOptions(opts ...Option) Option {
 type Option func(*API) error
 
 type API struct {
-	nick               string
-	authMethod         int
-	password           string
-	networkHost        string
-	networkPort        int
-	channels           []string
-	tls                *tls.Config
-	loginDelaySeconds  float64
-	dialTimeoutSeconds float64
-	keepAliveSeconds   float64
-
-	ready       bool
-	open        bool
-	conn        io.ReadWriteCloser
-	lnRe        *regexp.Regexp
-	pingRe      *regexp.Regexp
-	errRe       *regexp.Regexp
-	msgBufSize  int
-	rawMsgs     chan []byte
-	lastMsgTime time.Time
-	reader      *bufio.Reader
+	name                     string
+	nick                     string
+	primaryNick              string
+	altNicks                 []string
+	regainNickSeconds        float64
+	ghost                    bool
+	chanServ                 string
+	inviteRequest            string
+	inviteRetries            int
+	inviteRetrySeconds       float64
+	notifyAdmins             func(c context.Context, text string)
+	isAdmin                  func(nick string) bool
+	invitePolicy             string
+	invitePersist            bool
+	dryRun                   func(c context.Context, msg *chatlib.Message)
+	operName                 string
+	operPassword             string
+	rejoinSeconds            float64
+	rejoinAttempts           int
+	rejoinHook               RejoinFunc
+	identityMode             string
+	identities               identityPools
+	listTimeoutSeconds       float64
+	listIntervalSeconds      float64
+	listLimit                int
+	whowasTimeoutSeconds     float64
+	authMethod               int
+	account                  string
+	password                 string
+	networkHost              string
+	networkPort              int
+	servers                  []server
+	serverIndex              int
+	reconnectDelaySeconds    float64
+	maxReconnectDelaySeconds float64
+	channels                 []string
+	criticalChannels         []string
+	lazyChannels             []string
+	tls                      *tls.Config
+	loginDelaySeconds        float64
+	dialTimeoutSeconds       float64
+	keepAliveSeconds         float64
+	pingIntervalSeconds      float64
+	pingTimeoutSeconds       float64
+	whoTimeoutSeconds        float64
+	whoOnJoin                bool
+	isonIntervalSeconds      float64
+	maxPingIntervalSeconds   float64
+	adaptivePing             bool
+	lazyJoinDelaySeconds     float64
+	nickServ                 string
+	nickServTimeoutSeconds   float64
+	dccAddress               string
+	dccPortFirst             int
+	dccPortLast              int
+	dccPassive               bool
+	dccTimeoutSeconds        float64
+	dccMaxSize               int64
+	dccAcceptChat            bool
+	proxy                    *url.URL
+	dial                     DialFunc
+
+	registered    bool
+	nickAttempts  int
+	ready         bool
+	joining       bool
+	joinMu        sync.Mutex
+	joins         map[string]int
+	invites       map[string]int
+	kicks         map[string]*kickCount
+	channelKeys   map[string]string
+	identitySeq   int
+	listSem       chan struct{}
+	listMu        sync.Mutex
+	listing       *listRequest
+	whowasSem     chan struct{}
+	whowasMu      sync.Mutex
+	whowasReq     *whowasRequest
+	whoSem        chan struct{}
+	whoMu         sync.Mutex
+	whoReq        *whoRequest
+	awayMu        sync.Mutex
+	awayReason    string
+	watchMu       sync.Mutex
+	watched       []*watchedNick
+	monitoring    bool
+	isonQueue     [][]string
+	batches       map[string]*multilineMessage
+	batchSeq      atomic.Uint64
+	lastList      time.Time
+	accountMu     sync.Mutex
+	accounts      map[string]string
+	memberMu      sync.Mutex
+	supported     map[string]string
+	chans         map[string]*channelInfo
+	cmessages     bool
+	stripFormat   bool
+	encoding      *Encoding
+	fallback      *Encoding
+	store         chatlib.Store
+	shortener     chatlib.URLShortener
+	filter        chatlib.OutboundFilter
+	open          bool
+	conn          io.ReadWriteCloser
+	sasl          saslMechanism
+	saslBuf       string
+	authResult    chan error
+	certLoggedIn  bool
+	wantCaps      []string
+	capMu         sync.Mutex
+	availableCaps map[string]string
+	grantedCaps   map[string]bool
+	capPending    int
+	capEnded      bool
+	oper          atomic.Bool
+	ctcpHandlers  map[string]CTCPFunc
+	lastCTCPReply time.Time
+	dccMu         sync.Mutex
+	dccPending    map[string]chan *DCCOffer
+	dccChats      map[string]*dccChatSession
+	dccMsgs       chan *chatlib.Message
+	msgBufSize    int
+	rawMsgs       chan []byte
+	lastMsgTime   time.Time
+	lag           lagState
+	errs          chan error
+	connectTime   time.Time
+	reader        *bufio.Reader
+	throttle      *throttle
+	partial       []byte
+	dropping      int
+	bouncer       bouncerState
+	sts           stsState
+	idle          idleState
+	echo          echoState
+	batchTypes    []string
+	grouped       map[string]*groupedBatch
+	pgp           pgpState
+	fishKeys      map[string]*fishKey
 }
 
 var _ chatlib.API = (*API)(nil)
@@ -164,40 +342,130 @@ func (a *API) ApplyOptions(opts ...Option) error {
 
 func New(opts ...Option) (*API, error) {
 	a := &API{
-		nick:               DefaultNick,
-		loginDelaySeconds:  DefaultLoginDelaySeconds,
-		dialTimeoutSeconds: DefaultDialTimeoutSeconds,
-		keepAliveSeconds:   DefaultKeepAliveSeconds,
-		msgBufSize:         DefaultMsgBufferSize,
-		open:               true,
-	}
+		name:                     ApiName,
+		nick:                     DefaultNick,
+		primaryNick:              DefaultNick,
+		regainNickSeconds:        DefaultRegainNickSeconds,
+		loginDelaySeconds:        DefaultLoginDelaySeconds,
+		dialTimeoutSeconds:       DefaultDialTimeoutSeconds,
+		keepAliveSeconds:         DefaultKeepAliveSeconds,
+		pingIntervalSeconds:      DefaultPingIntervalSeconds,
+		pingTimeoutSeconds:       DefaultPingTimeoutSeconds,
+		whoTimeoutSeconds:        DefaultWhoTimeoutSeconds,
+		whoOnJoin:                true,
+		isonIntervalSeconds:      DefaultIsonIntervalSeconds,
+		maxPingIntervalSeconds:   DefaultMaxPingIntervalSeconds,
+		adaptivePing:             true,
+		errs:                     make(chan error, 1),
+		lazyJoinDelaySeconds:     DefaultLazyJoinDelaySeconds,
+		nickServ:                 DefaultNickServ,
+		nickServTimeoutSeconds:   DefaultNickServTimeoutSeconds,
+		authResult:               make(chan error, 1),
+		msgBufSize:               DefaultMsgBufferSize,
+		joins:                    make(map[string]int),
+		invites:                  make(map[string]int),
+		kicks:                    make(map[string]*kickCount),
+		channelKeys:              make(map[string]string),
+		rejoinSeconds:            DefaultRejoinDelaySeconds,
+		identityMode:             IdentityFixed,
+		chanServ:                 DefaultChanServ,
+		inviteRequest:            DefaultInviteRequest,
+		inviteRetries:            DefaultInviteRetries,
+		inviteRetrySeconds:       DefaultInviteRetrySeconds,
+		invitePolicy:             DefaultInvitePolicy,
+		listTimeoutSeconds:       DefaultListTimeoutSeconds,
+		listIntervalSeconds:      DefaultListIntervalSeconds,
+		listLimit:                DefaultListLimit,
+		dccTimeoutSeconds:        DefaultDCCTimeoutSeconds,
+		dccMaxSize:               DefaultDCCMaxSize,
+		dccPending:               make(map[string]chan *DCCOffer),
+		dccChats:                 make(map[string]*dccChatSession),
+		listSem:                  make(chan struct{}, 1),
+		whowasTimeoutSeconds:     DefaultWhowasTimeoutSeconds,
+		whowasSem:                make(chan struct{}, 1),
+		whoSem:                   make(chan struct{}, 1),
+		batches:                  make(map[string]*multilineMessage),
+		batchTypes:               append([]string{}, DefaultBatchTypes...),
+		grouped:                  make(map[string]*groupedBatch),
+		accounts:                 make(map[string]string),
+		supported:                make(map[string]string),
+		chans:                    make(map[string]*channelInfo),
+		cmessages:                true,
+		fallback:                 Encodings[DefaultFallbackEncoding],
+		throttle:                 newThrottle(FloodProfiles[DefaultFloodProfile]),
+		open:                     true,
+		reconnectDelaySeconds:    DefaultReconnectDelaySeconds,
+		maxReconnectDelaySeconds: DefaultMaxReconnectDelaySeconds,
+	}
+	a.ctcpHandlers = a.defaultCTCPHandlers()
 	if err := a.ApplyOptions(opts...); err != nil {
 		return nil, err
 	}
+	if a.rotatesIdentity() && a.authMethod != AuthMethodNone {
+		return nil, errors.WithMessage(chatlib.ErrInvalidConfig, "irc: identity rotation can't be used with authentication")
+	}
 
-	if re, err := regexp.Compile(linePattern); err != nil {
-		return nil, err
-	} else {
-		a.lnRe = re
+	if a.pgpEnabled() && a.pgp.keyFile == "" && a.pgp.passphrase == "" {
+		return nil, errors.WithMessage(chatlib.ErrInvalidConfig, "irc: pgp needs a passphrase to keep its key in the store, or a key file")
 	}
-	if re, err := regexp.Compile(pingPattern); err != nil {
-		return nil, err
-	} else {
-		a.pingRe = re
+
+	if a.usesSASL() {
+		a.wantCap("sasl")
 	}
-	if re, err := regexp.Compile(errPattern); err != nil {
-		return nil, err
-	} else {
-		a.errRe = re
+	if len(a.batchTypes) > 0 {
+		a.wantCap("batch")
 	}
-
 	a.rawMsgs = make(chan []byte, a.msgBufSize)
+	a.dccMsgs = make(chan *chatlib.Message, a.msgBufSize)
 
 	return a, nil
 }
 
-// TODO Handle long messages
+// isService reports whether nick is NickServ or ChanServ.
+func (a *API) isService(nick string) bool {
+	return strings.EqualFold(nick, a.nickServ) || strings.EqualFold(nick, a.chanServ)
+}
+
+// SendMessage sends msg to the server. The text of messages and notices is
+// split into lines that fit, sent as one multiline batch where the server
+// supports it. Messages and notices to a nick the bot has a DCC CHAT with go
+// over the chat instead. Messages to services aren't held to the content
+// policy, which could otherwise mangle a password sent to NickServ.
 func (a *API) SendMessage(c context.Context, msg *chatlib.Message) error {
+	if a.filter != nil && !a.isService(msg.Receiver) {
+		var err error
+		if msg, err = a.filter(c, msg); err != nil {
+			return err
+		}
+	}
+	if a.withheld(c, msg) {
+		return nil
+	}
+	if msg.Command == "PRIVMSG" || msg.Command == "NOTICE" || msg.Command == chatlib.CommandAction {
+		if s := a.chatWith(msg.Receiver); s != nil {
+			return a.sendChat(s, msg)
+		}
+	}
+	if msg.Command == "PRIVMSG" || msg.Command == "NOTICE" || msg.Command == chatlib.CommandAction {
+		if sent, err := a.sendPGP(c, msg); sent || err != nil {
+			return err
+		}
+	}
+	if msg.Command == chatlib.CommandAction {
+		return a.sendAction(c, msg)
+	}
+	if msg.Command == "PRIVMSG" || msg.Command == "NOTICE" {
+		if err := a.joinIfLazy(c, msg.Receiver); err != nil {
+			return err
+		}
+		if err := a.rejoinIdle(c, msg.Receiver); err != nil {
+			return err
+		}
+	}
+	msg = a.cmessage(msg)
+	if isTextCommand(msg.Command) && msg.Receiver != "" {
+		return a.sendText(c, msg)
+	}
 	parts := []string{msg.Command}
 	if msg.Receiver != "" {
 		parts = append(parts, msg.Receiver)
@@ -205,54 +473,181 @@ func (a *API) SendMessage(c context.Context, msg *chatlib.Message) error {
 	if msg.Text != "" {
 		parts = append(parts, ":"+msg.Text)
 	}
-	str := strings.Join(parts, " ")
-	bts := []byte(str + "\n")
+	return a.sendLine(c, msg.Command, strings.Join(parts, " "))
+}
+
+// sendLine writes a line to the server once the send rate allows, unless the
+// command is never held back.
+func (a *API) sendLine(c context.Context, command, str string) error {
+	if !unthrottled[command] {
+		if err := a.throttle.wait(c); err != nil {
+			return err
+		}
+	}
+	bts := a.encoding.Encode(str + "\n")
 	_, err := a.conn.Write(bts)
 	if err != nil {
 		return err
 	}
-	log.Debug().Str("api", ApiName).Str("irc", str).Msg("sent message")
+	log.Debug().Str("api", ApiName).Str("irc", redact(str)).Msg("sent message")
 	return nil
 }
 
-// TODO Handle long messages
+// readMessage reads a line from the server and queues it for parsing. A line
+// cut short by a read error is kept and completed by the next read, and a
+// line longer than MaxLineBytes is dropped whole so its tail isn't parsed as
+// a line of its own.
 func (a *API) readMessage(c context.Context) error {
-	// Setup bufio reader
-	bts, err := a.reader.ReadBytes(ReadDelimiter)
-	if err != nil {
+	bts, err := a.reader.ReadSlice(ReadDelimiter)
+	switch {
+	case a.dropping > 0:
+		a.dropping += len(bts)
+	case errors.Is(err, bufio.ErrBufferFull) || len(a.partial)+len(bts) > MaxLineBytes:
+		a.dropping, a.partial = len(a.partial)+len(bts), nil
+	case err != nil:
+		a.partial = append(a.partial, bts...)
+		return err
+	default:
+		line := append(a.partial, bts...)
+		a.partial = nil
+		if line = normalizeLine(line); line != nil {
+			a.rawMsgs <- line
+		}
+		return nil
+	}
+	if errors.Is(err, bufio.ErrBufferFull) {
+		// The rest of the line is dropped by the next reads
+		return nil
+	} else if err != nil {
 		return err
 	}
-	a.rawMsgs <- bts
+	log.Warn().Str("api", ApiName).Msgf("dropped line of %d bytes, longer than %d", a.dropping, MaxLineBytes)
+	a.dropping = 0
 	return nil
 }
 
+// normalizeLine returns a copy of line ending in CRLF, which the patterns
+// expect, as some servers end lines with a bare LF. It returns nil for empty
+// lines.
+func normalizeLine(line []byte) []byte {
+	text := strings.TrimRight(string(line), "\r\n")
+	if text == "" {
+		return nil
+	}
+	return []byte(text + "\r\n")
+}
+
 func (a *API) ReceiveMessage(c context.Context) (*chatlib.Message, error) {
 	if ct := len(a.rawMsgs); ct == a.msgBufSize {
 		log.Warn().Str("api", ApiName).Msgf("message buffer full (%d messages)", ct)
 	}
-	bts := <-a.rawMsgs
-	line := string(bts)
+	var bts []byte
+	select {
+	case bts = <-a.rawMsgs:
+	case err := <-a.errs:
+		return nil, err
+	case msg := <-a.dccMsgs:
+		return msg, nil
+	}
+	a.lag.received(time.Now())
+	line := a.fallback.Decode(bts)
 	log.Debug().Str("api", ApiName).Str("irc", line).Msg("received message")
 	msg := &chatlib.Message{
 		Raw: line,
 	}
-	if a.lnRe.MatchString(line) {
-		parts := a.lnRe.FindStringSubmatch(line)
-		msg.Sender = parts[1]
-		msg.Command = parts[2]
-		msg.Receiver = parts[3]
-		msg.Text = parts[4]
-	} else if a.pingRe.MatchString(line) {
-		parts := a.pingRe.FindStringSubmatch(line)
-		msg.Command = "PING"
-		msg.Text = parts[1]
-		return msg, a.pong(c, parts[1])
-	} else if a.errRe.MatchString(line) {
-		parts := a.errRe.FindStringSubmatch(line)
-		return nil, errors.Errorf("irc: error: %s", parts[1])
-	} else {
-		// TODO return custom error
-		return nil, errors.Errorf("irc: line does not match pattern: %s", line)
+	l, err := parseLine(line)
+	if err != nil {
+		return nil, err
+	}
+	if l.tags != nil {
+		msg.Tags = l.tags
+		msg.Time = serverTime(msg.Tags)
+		msg.Replayed = !msg.Time.IsZero() && msg.Time.Before(a.connectTime)
+	}
+	msg.Sender = l.prefix
+	msg.Command = l.command
+	msg.Params = l.params
+	msg.Receiver = l.param(0)
+	msg.Text = l.rest
+	msg.Nick = nickFromPrefix(msg.Sender)
+	switch msg.Command {
+	case "PING":
+		msg.Receiver, msg.Text = "", l.param(0)
+		a.learnPingInterval(time.Now())
+		return msg, a.pong(c, msg.Text)
+	case "ERROR":
+		if isExcessFlood(l.param(0)) {
+			a.throttle.slowDown("disconnected for flooding")
+		}
+		return nil, errors.Errorf("irc: error: %s", l.param(0))
+	case "AUTHENTICATE":
+		msg.Receiver, msg.Text = "", l.param(0)
+		if err := a.handleSASL(c, msg); err != nil {
+			return msg, err
+		}
+	default:
+		msg.Private = msg.Nick != "" && strings.EqualFold(msg.Receiver, a.nick)
+		if err := a.handleBouncer(c, msg); err != nil {
+			return msg, err
+		}
+		if ok, err := a.handlePGP(c, msg); !ok {
+			a.lastMsgTime = time.Now()
+			return nil, err
+		}
+		a.handleFiSH(msg)
+		if ml, ok := a.handleMultiline(msg); ok {
+			if ml != nil {
+				a.handleEcho(ml)
+				if grouped, ok := a.handleBatch(ml); ok {
+					ml = grouped
+				}
+			}
+			a.lastMsgTime = time.Now()
+			return ml, nil
+		}
+		a.handleEcho(msg)
+		a.trackMembership(msg)
+		a.trackIdle(c, msg)
+		a.trackAccounts(msg)
+		a.handleISupport(msg)
+		if err := a.trackChannels(c, msg); err != nil {
+			return msg, err
+		}
+		if err := a.handleNick(c, msg); err != nil {
+			return msg, err
+		}
+		if err := a.handleInviteOnly(c, msg); err != nil {
+			return msg, err
+		}
+		if err := a.handleKick(c, msg); err != nil {
+			return msg, err
+		}
+		if err := a.handleOper(c, msg); err != nil {
+			return msg, err
+		}
+		a.handleFlood(msg)
+		if err := a.handleCap(c, msg); err != nil {
+			return msg, err
+		}
+		a.handleNickServ(msg)
+		a.handleCertFP(msg)
+		if err := a.handleSASL(c, msg); err != nil {
+			return msg, err
+		}
+		a.handleServerNotice(msg)
+		a.handleList(msg)
+		a.handleWhowas(msg)
+		a.handleWho(msg)
+		a.handleModes(msg)
+		a.handleLag(c, msg)
+		a.handlePresence(c, msg)
+		a.handleAway(c, msg)
+		a.handleCTCP(c, msg)
+		a.handleDCC(c, msg)
+		a.handleFormatting(msg)
+		if grouped, ok := a.handleBatch(msg); ok {
+			msg = grouped
+		}
 	}
 	a.lastMsgTime = time.Now()
 	return msg, nil
@@ -284,11 +679,12 @@ func (a *API) Start(c context.Context) error {
 		// Wait for login delay
 		time.Sleep(time.Duration(float64(time.Second) * a.loginDelaySeconds))
 		// Attempt to login
-		if e := a.login(c); err != nil {
+		if e := a.login(c); e != nil {
 			// TODO If we fail to log in we should try again after a delay and fail if we can't
 			// log in after a certain number of attempts.
-			log.Error().Str("api", ApiName).Err(err).Msg("error logging in")
+			log.Error().Str("api", ApiName).Err(e).Msg("error logging in")
 			err = e
+			wg.Done()
 			return
 		}
 		wg.Done()
@@ -299,6 +695,12 @@ func (a *API) Start(c context.Context) error {
 
 func (a *API) Stop(c context.Context) error {
 	a.open = false
+	a.closeChats()
+	if a.bouncer.kind != "" {
+		if err := a.saveLastSeen(c); err != nil {
+			log.Error().Str("api", ApiName).Err(err).Msg("error saving last message time")
+		}
+	}
 	a.SendMessage(c, &chatlib.Message{
 		Command: "QUIT",
 		Text:    "I must go! My people need me.",
@@ -309,8 +711,18 @@ func (a *API) Stop(c context.Context) error {
 	return nil
 }
 
+// Name implements chatlib.Namer.
+func (a *API) Name() string {
+	return a.name
+}
+
+// Nick returns the nick the bot is using. It implements chatlib.Nicker.
+func (a *API) Nick() string {
+	return a.nick
+}
+
 func (a *API) Ping() error {
-	bts := []byte(fmt.Sprintf("PING %s\n", a.networkHost))
+	bts := a.encoding.Encode(fmt.Sprintf("PING %s\n", a.networkHost))
 	_, err := a.conn.Write(bts)
 	if err != nil {
 		return err
@@ -319,23 +731,39 @@ func (a *API) Ping() error {
 	return nil
 }
 
+// connect connects to the current server of the network, or failing that
+// the next ones in turn, until one accepts or all failed.
 func (a *API) connect(c context.Context) error {
 	var conn io.ReadWriteCloser
-	if a.tls != nil {
-		cn, err := a.connectTLS(c)
-		if err != nil {
-			return err
+	var err error
+	for tries := 0; tries < max(len(a.servers), 1); tries++ {
+		if tries > 0 {
+			log.Warn().Str("api", ApiName).Str("server", a.serverPort()).Err(err).Msg("error connecting, trying the next server")
+			a.nextServer()
 		}
-		conn = cn
-	} else {
-		cn, err := a.connectPlain(c)
-		if err != nil {
-			return err
+		secure := a.tls != nil
+		if p, ok := a.stsPolicyFor(c, a.networkHost); ok && !secure {
+			// Plaintext is refused while the policy lasts
+			log.Info().Str("api", ApiName).Str("host", a.networkHost).Int("port", p.Port).Msg("sts policy in force, connecting with tls")
+			a.networkPort, secure = p.Port, true
+		}
+		if secure {
+			conn, err = a.connectTLS(c)
+		} else {
+			conn, err = a.connectPlain(c)
+		}
+		a.sts.secure = secure
+		if err == nil || c.Err() != nil {
+			break
 		}
-		conn = cn
+	}
+	if err != nil {
+		return err
 	}
 	a.conn = conn
-	a.reader = bufio.NewReader(a.conn)
+	a.connectTime = time.Now()
+	a.reader = bufio.NewReaderSize(a.conn, MaxLineBytes)
+	a.partial, a.dropping = nil, 0
 
 	return nil
 }
@@ -348,8 +776,20 @@ func (a *API) connect(c context.Context) error {
 func (a *API) pollConn(c context.Context) {
 	for a.open {
 		err := a.readMessage(c)
-		if err != nil {
-			log.Error().Str("api", ApiName).Err(err).Msg("error reading message")
+		if err == nil || !a.open {
+			continue
+		}
+		if a.upgradeSTS(c) {
+			continue
+		}
+		log.Error().Str("api", ApiName).Err(err).Msg("error reading message")
+		if c.Err() != nil || !a.reconnect(c, err) {
+			// The connection is gone for good
+			select {
+			case a.errs <- err:
+			default:
+			}
+			return
 		}
 	}
 }
@@ -359,45 +799,28 @@ func (a *API) disconnect() error {
 }
 
 func (a *API) login(c context.Context) error {
-	if err := a.SendMessage(c, &chatlib.Message{
-		Command: "NICK" + " " + a.nick,
-	}); err != nil {
+	a.resetAccounts()
+	a.resetChannels()
+	a.resetInvites()
+	a.resetKicks()
+	a.resetEchoes()
+	a.oper.Store(false)
+	a.lag.reset()
+	a.resetWatching()
+	a.resetBatches()
+	username, realname := a.nextIdentity()
+	a.nick, a.nickAttempts, a.registered = a.primaryNick, 0, false
+	if err := a.startCaps(c); err != nil {
 		return err
 	}
-	realname := "FreyaBot"
-	if a.nick != DefaultNick {
-		realname = realname + " (" + a.nick + ")"
-	}
 	if err := a.SendMessage(c, &chatlib.Message{
-		Command: "USER " + a.nick + " 0 *",
-		Text:    realname,
-	}); err != nil {
-		return err
-	}
-	return nil
-}
-
-func (a *API) joinChannels(c context.Context) error {
-	for _, channel := range a.channels {
-		if err := a.joinChannel(c, channel); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (a *API) joinChannel(c context.Context, channel string) error {
-	if err := a.SendMessage(c, &chatlib.Message{
-		Command: "JOIN " + channel,
+		Command: "NICK" + " " + a.nick,
 	}); err != nil {
 		return err
 	}
-	return nil
-}
-
-func (a *API) leaveChannel(c context.Context, channel string) error {
 	if err := a.SendMessage(c, &chatlib.Message{
-		Command: "PART " + channel,
+		Command: "USER " + username + " 0 *",
+		Text:    realname,
 	}); err != nil {
 		return err
 	}
@@ -415,32 +838,32 @@ func (a *API) pong(c context.Context, arg string) error {
 	return nil
 }
 
-func (a *API) actionOnReady(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
-	a.ready = true
-	if err := a.joinChannels(c); err != nil {
-		return err
-	}
-	return nil
-}
-
 func (a *API) actionJoinChannel(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
-	if err := a.joinChannel(c, re.FindStringSubmatch(msg.Text)[1]); err != nil {
+	channel, key, _ := strings.Cut(strings.TrimSpace(re.FindStringSubmatch(msg.Text)[1]), " ")
+	if key = strings.TrimSpace(key); key != "" {
+		a.setChannelKey(channel, key)
+	}
+	if err := a.joinChannel(c, channel); err != nil {
 		return err
 	}
-	return nil
+	a.unidle(channel)
+	return a.rememberJoin(c, channel)
 }
 
 func (a *API) actionLeaveChannel(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
 	var channel string
 	if parts := re.FindStringSubmatch(msg.Text); parts[3] == "" {
-		channel = msg.Receiver
+		channel = msg.Channel()
 	} else {
 		channel = parts[3]
 	}
+	if channel == "" {
+		return errors.New("irc: no channel to leave")
+	}
 	if err := a.leaveChannel(c, channel); err != nil {
 		return err
 	}
-	return nil
+	return a.rememberPart(c, channel)
 }
 
 func (a *API) actionPing(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
@@ -448,21 +871,36 @@ func (a *API) actionPing(c context.Context, re *regexp.Regexp, msg *chatlib.Mess
 	return err
 }
 
-func (a *API) getDialer() (*net.Dialer, error) {
-	d := &net.Dialer{
+// getDialer returns the dialer connecting to the server, directly or through
+// the proxy, with the DialFunc given to WithDialer if any.
+func (a *API) getDialer() (proxy.ContextDialer, error) {
+	var d proxy.ContextDialer = &net.Dialer{
 		Timeout:   time.Duration(float64(time.Second) * a.dialTimeoutSeconds),
 		KeepAlive: time.Duration(float64(time.Second) * a.keepAliveSeconds),
 	}
+	if a.dial != nil {
+		d = a.dial
+	}
+	if a.proxy != nil {
+		return a.proxyDialer(d)
+	}
 	return d, nil
 }
 
 func (a *API) connectPlain(c context.Context) (net.Conn, error) {
-	var dialer *net.Dialer
+	var dialer proxy.ContextDialer
 	if d, err := a.getDialer(); err != nil {
 		return nil, err
 	} else {
 		dialer = d
 	}
+	if (a.proxy != nil || a.dial != nil) && a.dialTimeoutSeconds > 0 {
+		// Talking to the proxy counts towards the dial timeout, and custom
+		// dialers may not have one of their own
+		var cancel context.CancelFunc
+		c, cancel = context.WithTimeout(c, time.Duration(float64(time.Second)*a.dialTimeoutSeconds))
+		defer cancel()
+	}
 	conn, err := dialer.DialContext(c, "tcp", a.serverPort())
 	if err != nil {
 		return nil, err
@@ -470,21 +908,73 @@ func (a *API) connectPlain(c context.Context) (net.Conn, error) {
 	return conn, nil
 }
 
+// connectTLS dials the server and handshakes over the connection, which
+// may go through a proxy the tls package doesn't know about.
 func (a *API) connectTLS(c context.Context) (net.Conn, error) {
-	var dialer *tls.Dialer
-	if d, err := a.getDialer(); err != nil {
-		return nil, err
-	} else {
-		dialer = &tls.Dialer{
-			NetDialer: d,
-			Config:    a.tls,
-		}
+	if a.dialTimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		c, cancel = context.WithTimeout(c, time.Duration(float64(time.Second)*a.dialTimeoutSeconds))
+		defer cancel()
 	}
-	conn, err := dialer.DialContext(c, "tcp", a.serverPort())
+	conn, err := a.connectPlain(c)
 	if err != nil {
 		return nil, err
 	}
-	return conn, nil
+	cfg := a.tls
+	if cfg == nil {
+		// Upgraded by an STS policy
+		cfg = a.sts.tls
+	}
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" {
+		cfg = cfg.Clone()
+		cfg.ServerName = a.networkHost
+	}
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(c); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// redact hides credentials in a line before it is logged.
+func redact(line string) string {
+	if strings.HasPrefix(line, "AUTHENTICATE ") && line != "AUTHENTICATE *" {
+		return "AUTHENTICATE <redacted>"
+	}
+	if cmd, rest, ok := strings.Cut(line, " :"); ok && strings.HasPrefix(strings.ToUpper(rest), "IDENTIFY ") {
+		return cmd + " :IDENTIFY <redacted>"
+	} else if ok && strings.HasPrefix(strings.ToUpper(rest), "GHOST ") {
+		nick, _, _ := strings.Cut(rest[len("GHOST "):], " ")
+		return cmd + " :GHOST " + nick + " <redacted>"
+	}
+	if fields := strings.Fields(line); len(fields) > 2 && (fields[0] == "JOIN" || fields[0] == "OPER") {
+		return fields[0] + " " + fields[1] + " <redacted>"
+	}
+	return line
+}
+
+// nickFromPrefix returns the nick portion of a nick!user@host message prefix.
+// Server prefixes have no nick and return an empty string.
+func nickFromPrefix(prefix string) string {
+	if i := strings.IndexAny(prefix, "!@"); i >= 0 {
+		return prefix[:i]
+	}
+	return ""
+}
+
+// userHostFromPrefix returns the user and host portions of a nick!user@host
+// message prefix, empty if the prefix doesn't have them.
+func userHostFromPrefix(prefix string) (user, host string) {
+	_, userHost, ok := strings.Cut(prefix, "!")
+	if !ok {
+		return "", ""
+	}
+	user, host, _ = strings.Cut(userHost, "@")
+	return user, host
 }
 
 func (a *API) serverPort() string {
@@ -157,16 +157,16 @@ func TestLoginAndJoin(t *testing.T) {
 	msgChain = ""
 	r := bufio.NewReader(conn)
 	// Check for login messages on server
-	for i := 0; i < 2; i++ {
+	for i := 0; i < 3; i++ {
 		msg, err := r.ReadString('\n')
 		if err != nil {
 			t.Fatal(err)
 		}
 		msgChain += msg
 	}
-	exp := msgNick + msgUser
+	exp := msgCapLS + msgNick + msgUser
 	if msgChain != exp {
-		t.Fatalf("expected nick and user messages, got %s", msgChain)
+		t.Fatalf("expected cap, nick and user messages, got %s", msgChain)
 	}
 	// Send accept messages from server to client
 	_, err = conn.Write([]byte(msgAccept))
@@ -235,7 +235,8 @@ func TestPing(t *testing.T) {
 		}
 	}
 	r := bufio.NewReader(conn)
-	// Read and throw away NICK and USER commands on server
+	// Read and throw away CAP, NICK and USER commands on server
+	r.ReadString('\n')
 	r.ReadString('\n')
 	r.ReadString('\n')
 	// Send ping message from server to client
@@ -270,7 +271,8 @@ const (
 
 // Test IRC Client Messages
 const (
-	msgNick = "NICK freyabot\n"
-	msgUser = "USER freyabot 0 * :FreyaBot\n"
-	msgPong = "PONG :irc.test.foo\n"
+	msgCapLS = "CAP LS 302\n"
+	msgNick  = "NICK freyabot\n"
+	msgUser  = "USER freyabot 0 * :FreyaBot\n"
+	msgPong  = "PONG :irc.test.foo\n"
 )
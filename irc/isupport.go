@@ -0,0 +1,214 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gregseb/chatlib"
+)
+
+// RPL_ISUPPORT tells clients what the server supports and its limits.
+const rplISupport = "005"
+
+// Defaults for ISUPPORT tokens, from RFC 1459, for servers that don't
+// advertise them.
+const (
+	defaultPrefix      = "(ov)@+"
+	defaultChanModes   = "beI,k,l,imnpst"
+	defaultChanTypes   = "#&"
+	defaultCaseMapping = "rfc1459"
+)
+
+// ServerInfo is what the server advertised about itself in RPL_ISUPPORT.
+// Fields the server didn't advertise have their RFC 1459 defaults, or zero
+// for limits, which means there is none or it isn't known.
+type ServerInfo struct {
+	// Network is the name of the network, e.g. Libera.Chat.
+	Network string
+	// CaseMapping is how the server compares nicks and channel names, one
+	// of ascii, rfc1459 or rfc1459-strict. Use Fold to apply it.
+	CaseMapping string
+	// ChanTypes are the characters channel names start with.
+	ChanTypes string
+	// PrefixModes are the channel membership modes, highest first, and
+	// PrefixSymbols the prefixes shown for them, e.g. ov and @+.
+	PrefixModes   string
+	PrefixSymbols string
+	// ChanModes are the channel modes by type: lists such as bans, modes
+	// that always take a parameter, modes that take one when set and modes
+	// that never do.
+	ChanModes [4]string
+	// StatusMsg are the prefixes that may be put before a channel to message
+	// only its members with that prefix, e.g. @#channel.
+	StatusMsg string
+	// Limits on lengths, in bytes.
+	NickLen    int
+	ChannelLen int
+	TopicLen   int
+	KickLen    int
+	AwayLen    int
+	// Modes is how many modes with a parameter one MODE command may set.
+	Modes int
+	// Monitor is how many nicks the MONITOR list may hold, 0 if MONITOR
+	// isn't supported.
+	Monitor int
+	// MaxTargets is how many targets each command accepts, from TARGMAX.
+	// Commands without a limit aren't listed.
+	MaxTargets map[string]int
+	// ChanLimit is how many channels with each prefix may be joined.
+	ChanLimit map[string]int
+	// Tokens are every token as advertised, with values unescaped.
+	Tokens map[string]string
+}
+
+// ServerInfo returns what the server advertised about itself. It is only
+// complete once the bot has registered.
+func (a *API) ServerInfo() ServerInfo {
+	a.memberMu.Lock()
+	tokens := make(map[string]string, len(a.supported))
+	for k, v := range a.supported {
+		tokens[k] = v
+	}
+	a.memberMu.Unlock()
+	value := func(token, def string) string {
+		if v := tokens[token]; v != "" {
+			return v
+		}
+		return def
+	}
+	number := func(token string) int {
+		n, _ := strconv.Atoi(tokens[token])
+		return n
+	}
+	info := ServerInfo{
+		Network:     tokens["NETWORK"],
+		CaseMapping: strings.ToLower(value("CASEMAPPING", defaultCaseMapping)),
+		ChanTypes:   value("CHANTYPES", defaultChanTypes),
+		StatusMsg:   tokens["STATUSMSG"],
+		NickLen:     number("NICKLEN"),
+		ChannelLen:  number("CHANNELLEN"),
+		TopicLen:    number("TOPICLEN"),
+		KickLen:     number("KICKLEN"),
+		AwayLen:     number("AWAYLEN"),
+		Modes:       number("MODES"),
+		Monitor:     number("MONITOR"),
+		MaxTargets:  parseLimits(tokens["TARGMAX"]),
+		ChanLimit:   parseLimits(tokens["CHANLIMIT"]),
+		Tokens:      tokens,
+	}
+	if _, ok := tokens["MONITOR"]; ok && info.Monitor == 0 {
+		// MONITOR without a value has no limit
+		info.Monitor = -1
+	}
+	info.PrefixModes, info.PrefixSymbols = a.prefixes()
+	copy(info.ChanModes[:], strings.SplitN(value("CHANMODES", defaultChanModes), ",", 4))
+	return info
+}
+
+// Fold returns s in lower case by the server's case mapping, so nicks and
+// channel names the server considers equal fold to the same string.
+func (i ServerInfo) Fold(s string) string {
+	s = strings.ToLower(s)
+	switch i.CaseMapping {
+	case "ascii":
+		return s
+	case "rfc1459-strict":
+		return strings.NewReplacer("[", "{", "]", "}", `\`, "|").Replace(s)
+	}
+	return strings.NewReplacer("[", "{", "]", "}", `\`, "|", "~", "^").Replace(s)
+}
+
+// isChannel reports whether target names a channel rather than a user.
+func (a *API) isChannel(target string) bool {
+	return target != "" && strings.ContainsRune(a.isupportOr("CHANTYPES", defaultChanTypes), rune(target[0]))
+}
+
+// prefixes returns the channel membership modes and the prefixes shown for
+// them, highest first, e.g. "ov" and "@+".
+func (a *API) prefixes() (modes, symbols string) {
+	modes, symbols, ok := strings.Cut(strings.TrimPrefix(a.isupportOr("PREFIX", defaultPrefix), "("), ")")
+	if !ok || len(modes) != len(symbols) {
+		modes, symbols, _ = strings.Cut(defaultPrefix[1:], ")")
+	}
+	return modes, symbols
+}
+
+// folder returns a function folding names by the server's case mapping.
+func (a *API) folder() func(string) string {
+	return ServerInfo{CaseMapping: strings.ToLower(a.isupportOr("CASEMAPPING", defaultCaseMapping))}.Fold
+}
+
+// isupport returns the value of an ISUPPORT token and whether the server
+// advertised it.
+func (a *API) isupport(token string) (string, bool) {
+	a.memberMu.Lock()
+	defer a.memberMu.Unlock()
+	v, ok := a.supported[token]
+	return v, ok
+}
+
+// isupportOr returns the value of an ISUPPORT token, or def if the server
+// didn't advertise one.
+func (a *API) isupportOr(token, def string) string {
+	if v, ok := a.isupport(token); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// handleISupport records the tokens of an RPL_ISUPPORT line. A token with a
+// leading - withdraws one advertised earlier.
+func (a *API) handleISupport(msg *chatlib.Message) {
+	if msg.Command != rplISupport || len(msg.Params) < 2 {
+		return
+	}
+	// <bot> <tokens...> :are supported by this server
+	tokens := msg.Params[1:]
+	if last := tokens[len(tokens)-1]; strings.Contains(last, " ") {
+		tokens = tokens[:len(tokens)-1]
+	}
+	a.memberMu.Lock()
+	defer a.memberMu.Unlock()
+	for _, token := range tokens {
+		if name, ok := strings.CutPrefix(token, "-"); ok {
+			delete(a.supported, name)
+			continue
+		}
+		name, value, _ := strings.Cut(token, "=")
+		a.supported[name] = unescapeISupport(value)
+	}
+}
+
+// unescapeISupport decodes the \xHH escapes ISUPPORT values use for spaces,
+// equals signs and backslashes.
+func unescapeISupport(v string) string {
+	if !strings.Contains(v, `\x`) {
+		return v
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] == '\\' && i+3 < len(v) && v[i+1] == 'x' {
+			if n, err := strconv.ParseUint(v[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+// parseLimits parses a list of limits such as TARGMAX=PRIVMSG:4,NOTICE:4,JOIN:
+// or CHANLIMIT=#&:20. Entries without a number have no limit and are left
+// out.
+func parseLimits(v string) map[string]int {
+	limits := make(map[string]int)
+	for _, entry := range strings.Split(v, ",") {
+		name, limit, ok := strings.Cut(entry, ":")
+		if n, err := strconv.Atoi(limit); ok && err == nil {
+			limits[name] = n
+		}
+	}
+	return limits
+}
@@ -0,0 +1,58 @@
+package irc
+
+import (
+	"context"
+	"testing"
+)
+
+func TestServerInfo(t *testing.T) {
+	a, err := New(WithNick("bot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := a.ServerInfo()
+	if info.CaseMapping != "rfc1459" || info.ChanTypes != "#&" || info.PrefixSymbols != "@+" || info.ChanModes[3] != "imnpst" || info.NickLen != 0 {
+		t.Errorf("unexpected defaults: %+v", info)
+	}
+	for _, line := range []string{
+		":irc.example.net 005 bot CASEMAPPING=ascii CHANTYPES=# NICKLEN=16 PREFIX=(qaohv)~&@%+ TARGMAX=PRIVMSG:4,NOTICE:4,JOIN: :are supported by this server\r\n",
+		":irc.example.net 005 bot NETWORK=Example\\x20Net CHANMODES=beI,k,l,BCMNORScimnpstz MONITOR CHANLIMIT=#:250 EXCEPTS :are supported by this server\r\n",
+		":irc.example.net 005 bot -EXCEPTS :are no longer supported\r\n",
+	} {
+		a.rawMsgs <- []byte(line)
+		if _, err := a.ReceiveMessage(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info = a.ServerInfo()
+	if info.Network != "Example Net" || info.CaseMapping != "ascii" || info.ChanTypes != "#" || info.NickLen != 16 {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	if info.PrefixModes != "qaohv" || info.PrefixSymbols != "~&@%+" {
+		t.Errorf("unexpected prefixes: %s %s", info.PrefixModes, info.PrefixSymbols)
+	}
+	if info.ChanModes != [4]string{"beI", "k", "l", "BCMNORScimnpstz"} {
+		t.Errorf("unexpected channel modes: %v", info.ChanModes)
+	}
+	if info.MaxTargets["PRIVMSG"] != 4 || len(info.MaxTargets) != 2 || info.ChanLimit["#"] != 250 || info.Monitor != -1 {
+		t.Errorf("unexpected limits: %v %v %d", info.MaxTargets, info.ChanLimit, info.Monitor)
+	}
+	if _, ok := info.Tokens["EXCEPTS"]; ok {
+		t.Error("expected EXCEPTS to be withdrawn")
+	}
+	if a.isChannel("&local") || !a.isChannel("#test") {
+		t.Error("expected CHANTYPES to decide what is a channel")
+	}
+
+	for _, tc := range []struct {
+		mapping, in, expected string
+	}{
+		{"ascii", "Foo[]^", "foo[]^"},
+		{"rfc1459", "Foo[]\\~", "foo{}|^"},
+		{"rfc1459-strict", "Foo[]\\~", "foo{}|~"},
+	} {
+		if got := (ServerInfo{CaseMapping: tc.mapping}).Fold(tc.in); got != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.mapping, tc.expected, got)
+		}
+	}
+}
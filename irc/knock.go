@@ -0,0 +1,176 @@
+package irc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultChanServ           = "ChanServ"
+	DefaultInviteRequest      = InviteRequestAuto
+	DefaultInviteRetries      = 3
+	DefaultInviteRetrySeconds = 60
+)
+
+// Ways of asking to be let into an invite only channel.
+const (
+	// InviteRequestAuto knocks if the server supports KNOCK and asks ChanServ
+	// otherwise.
+	InviteRequestAuto     = "auto"
+	InviteRequestKnock    = "knock"
+	InviteRequestChanServ = "chanserv"
+	InviteRequestNone     = "none"
+)
+
+// Replies to joining an invite only channel and to KNOCK.
+const (
+	errInviteOnlyChan = "473"
+	rplKnockDlvr      = "711"
+	errTooManyKnock   = "712"
+	errChanOpen       = "713"
+)
+
+// WithInviteRequest sets how to ask for an invite when a configured channel
+// is invite only, one of the InviteRequest constants.
+func WithInviteRequest(method string) Option {
+	return func(a *API) error {
+		switch method {
+		case InviteRequestAuto, InviteRequestKnock, InviteRequestChanServ, InviteRequestNone:
+			a.inviteRequest = method
+			return nil
+		}
+		return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: invalid invite request method: %s", method)
+	}
+}
+
+// WithInviteRetries sets how many times to ask for an invite to a channel,
+// waiting seconds between attempts, before giving up and telling the admins.
+func WithInviteRetries(retries int, seconds float64) Option {
+	return func(a *API) error {
+		a.inviteRetries = retries
+		a.inviteRetrySeconds = seconds
+		return nil
+	}
+}
+
+// WithChanServ sets the name of the ChanServ service, for networks that call
+// it something else.
+func WithChanServ(name string) Option {
+	return func(a *API) error {
+		a.chanServ = name
+		return nil
+	}
+}
+
+// WithAdminNotifier sets the function used to tell the bot's admins about
+// problems that need them, such as giving up on joining a channel.
+func WithAdminNotifier(notify func(c context.Context, text string)) Option {
+	return func(a *API) error {
+		a.notifyAdmins = notify
+		return nil
+	}
+}
+
+// handleInviteOnly asks to be invited to configured channels that turn out to
+// be invite only, and joins them once invited.
+func (a *API) handleInviteOnly(c context.Context, msg *chatlib.Message) error {
+	channel, reason, _ := strings.Cut(msg.Text, " :")
+	switch msg.Command {
+	case errInviteOnlyChan:
+		if a.inviteRequest == InviteRequestNone || a.channelOrigin(channel) == "" {
+			return nil
+		}
+		a.setJoinState(channel, joinNone)
+		return a.requestInvite(c, channel, reason)
+	case "INVITE":
+		if !strings.EqualFold(msg.Receiver, a.nick) {
+			return nil
+		}
+		if !a.invitePending(msg.Text) {
+			return a.handleInvite(c, msg)
+		}
+		log.Info().Str("api", ApiName).Msgf("invited to %s by %s", msg.Text, msg.Nick)
+		return a.joinChannel(c, msg.Text)
+	case errChanOpen:
+		// Not invite only any more
+		if a.invitePending(channel) {
+			return a.joinChannel(c, channel)
+		}
+	case rplKnockDlvr:
+		log.Info().Str("api", ApiName).Msgf("knocked on %s", channel)
+	case errTooManyKnock:
+		log.Warn().Str("api", ApiName).Msgf("knocking on %s refused: %s", channel, reason)
+	case "JOIN":
+		if strings.EqualFold(msg.Nick, a.nick) {
+			a.joinMu.Lock()
+			delete(a.invites, strings.ToLower(msg.Receiver))
+			a.joinMu.Unlock()
+		}
+	}
+	return nil
+}
+
+// requestInvite asks for an invite to channel and tries joining again later
+// in case the invite never comes, up to the retry limit.
+func (a *API) requestInvite(c context.Context, channel, reason string) error {
+	a.joinMu.Lock()
+	attempts := a.invites[strings.ToLower(channel)] + 1
+	a.invites[strings.ToLower(channel)] = attempts
+	a.joinMu.Unlock()
+	if attempts > a.inviteRetries {
+		if attempts == a.inviteRetries+1 {
+			text := fmt.Sprintf("gave up joining %s after %d invite requests: %s", channel, a.inviteRetries, reason)
+			log.Error().Str("api", ApiName).Msg(text)
+			if a.notifyAdmins != nil {
+				a.notifyAdmins(c, text)
+			}
+		}
+		return nil
+	}
+	method := a.inviteRequest
+	if method == InviteRequestAuto {
+		method = InviteRequestChanServ
+		if _, ok := a.isupport("KNOCK"); ok {
+			method = InviteRequestKnock
+		}
+	}
+	log.Info().Str("api", ApiName).Msgf("%s is invite only, asking for an invite with %s (attempt %d of %d)", channel, method, attempts, a.inviteRetries)
+	conn := a.conn
+	time.AfterFunc(time.Duration(float64(time.Second)*a.inviteRetrySeconds), func() {
+		if !a.open || a.conn != conn || !a.invitePending(channel) || a.joinState(channel) != joinNone {
+			return
+		}
+		if err := a.joinChannel(c, channel); err != nil {
+			log.Error().Str("api", ApiName).Err(err).Msgf("error joining %s", channel)
+		}
+	})
+	if method == InviteRequestKnock {
+		return a.SendMessage(c, &chatlib.Message{Command: "KNOCK " + channel, Text: "requesting an invite"})
+	}
+	return a.SendMessage(c, &chatlib.Message{
+		Command:  "PRIVMSG",
+		Receiver: a.chanServ,
+		Text:     "INVITE " + channel,
+	})
+}
+
+// invitePending reports whether an invite to channel has been asked for.
+func (a *API) invitePending(channel string) bool {
+	a.joinMu.Lock()
+	defer a.joinMu.Unlock()
+	attempts, ok := a.invites[strings.ToLower(channel)]
+	return ok && attempts <= a.inviteRetries
+}
+
+// resetInvites forgets invite requests made on an earlier connection.
+func (a *API) resetInvites() {
+	a.joinMu.Lock()
+	defer a.joinMu.Unlock()
+	a.invites = make(map[string]int)
+}
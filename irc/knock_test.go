@@ -0,0 +1,57 @@
+package irc
+
+import (
+	"context"
+	"testing"
+)
+
+func TestInviteRequest(t *testing.T) {
+	c := context.Background()
+	var notified []string
+	a, err := New(
+		WithNick("bot"),
+		WithChannels([]string{"#secret"}),
+		WithInviteRetries(2, 3600),
+		WithAdminNotifier(func(c context.Context, text string) { notified = append(notified, text) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	for _, tc := range []struct {
+		line     string
+		expected string
+	}{
+		// Not configured
+		{":irc.example.net 473 bot #other :Cannot join channel (+i)\r\n", ""},
+		{":irc.example.net 473 bot #secret :Cannot join channel (+i)\r\n", "PRIVMSG ChanServ :INVITE #secret\n"},
+		{":irc.example.net 005 bot KNOCK :are supported by this server\r\n", ""},
+		{":irc.example.net 473 bot #secret :Cannot join channel (+i)\r\n", "KNOCK #secret :requesting an invite\n"},
+		{":op!u@h INVITE bot :#other\r\n", ""},
+		{":op!u@h INVITE bot :#secret\r\n", "JOIN #secret\n"},
+		// Out of retries
+		{":irc.example.net 473 bot #secret :Cannot join channel (+i)\r\n", ""},
+		{":irc.example.net 473 bot #secret :Cannot join channel (+i)\r\n", ""},
+		{":op!u@h INVITE bot :#secret\r\n", ""},
+	} {
+		a.rawMsgs <- []byte(tc.line)
+		if _, err := a.ReceiveMessage(c); err != nil {
+			t.Fatal(err)
+		}
+		if line := conn.next(); line != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.line, tc.expected, line)
+		}
+	}
+	if len(notified) != 1 {
+		t.Errorf("expected the admins to be told once, got %v", notified)
+	}
+
+	a.rawMsgs <- []byte(":bot!u@h JOIN #secret\r\n")
+	if _, err := a.ReceiveMessage(c); err != nil {
+		t.Fatal(err)
+	}
+	if a.invitePending("#secret") {
+		t.Error("expected joining to clear the invite request")
+	}
+}
@@ -0,0 +1,305 @@
+package irc
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultPingIntervalSeconds    = 60
+	DefaultPingTimeoutSeconds     = 30
+	DefaultMaxPingIntervalSeconds = 300
+	// minPingInterval is the least idle time before a PING when the interval
+	// is learned from a server that PINGs often.
+	minPingInterval = 15 * time.Second
+	// serverPingSlack is how much longer than the server's own PING interval
+	// the bot waits before PINGing, so it only does when the server's PING is
+	// overdue.
+	serverPingSlack = 1.5
+	// lagTokenPrefix starts the token of the bot's own PINGs, followed by
+	// the time they were sent, so the PONG says how long it took.
+	lagTokenPrefix = "chatlib-"
+	// lagAllowance is how many times the average lag is added to the ping
+	// timeout, so slow links aren't taken for dead ones.
+	lagAllowance = 4
+	// lagWeight is the weight of a new measurement in the average.
+	lagWeight = 0.2
+)
+
+// Lag is the round trip time to the server, measured with the bot's own
+// PINGs.
+type Lag struct {
+	// Current is the last measurement.
+	Current time.Duration
+	// Average is a moving average of the measurements.
+	Average time.Duration
+	// Measured is when Current was measured. It is zero until the first
+	// PONG.
+	Measured time.Time
+}
+
+// lagState tracks the bot's PINGs and the lag they measured.
+type lagState struct {
+	mu       sync.Mutex
+	lag      Lag
+	lastRecv time.Time
+	// sent is when the oldest unanswered PING was sent, zero if there is none
+	sent    time.Time
+	dead    bool
+	waiters []chan Lag
+	// serverPing is when the server last PINGed the bot, and serverInterval
+	// the average time between its PINGs, zero until two were received.
+	serverPing     time.Time
+	serverInterval time.Duration
+}
+
+func (l *lagState) received(now time.Time) {
+	l.mu.Lock()
+	l.lastRecv = now
+	l.mu.Unlock()
+}
+
+// reset forgets the PING waiting for its PONG, which won't come on a new
+// connection. The measurements are kept.
+func (l *lagState) reset() {
+	l.mu.Lock()
+	l.sent, l.dead, l.serverPing = time.Time{}, false, time.Time{}
+	l.mu.Unlock()
+}
+
+// WithPingInterval sets how long the connection may go without receiving
+// anything before the bot PINGs the server, measuring the lag and checking
+// that the connection is alive. 0 disables the checks.
+func WithPingInterval(seconds float64) Option {
+	return func(a *API) error {
+		a.pingIntervalSeconds = seconds
+		return nil
+	}
+}
+
+// WithAdaptivePing learns how often the server PINGs the bot and uses it in
+// place of the ping interval once known, between 15 seconds and the max ping
+// interval. The bot then only PINGs when the server's own PING is overdue,
+// and notices dead connections sooner on servers that PING often.
+func WithAdaptivePing(enabled bool) Option {
+	return func(a *API) error {
+		a.adaptivePing = enabled
+		return nil
+	}
+}
+
+// WithMaxPingInterval sets the longest ping interval adaptive pings may
+// learn.
+func WithMaxPingInterval(seconds float64) Option {
+	return func(a *API) error {
+		a.maxPingIntervalSeconds = seconds
+		return nil
+	}
+}
+
+// WithPingTimeout sets how long the server has to answer a PING before the
+// connection is reported dead. Four times the average lag is added to it.
+func WithPingTimeout(seconds float64) Option {
+	return func(a *API) error {
+		a.pingTimeoutSeconds = seconds
+		return nil
+	}
+}
+
+// Lag returns the lag measured so far.
+func (a *API) Lag() Lag {
+	a.lag.mu.Lock()
+	defer a.lag.mu.Unlock()
+	return a.lag.lag
+}
+
+// PingInterval returns how long the connection may go without receiving
+// anything before the bot PINGs the server.
+func (a *API) PingInterval() time.Duration {
+	interval := time.Duration(float64(time.Second) * a.pingIntervalSeconds)
+	if !a.adaptivePing {
+		return interval
+	}
+	a.lag.mu.Lock()
+	server := a.lag.serverInterval
+	a.lag.mu.Unlock()
+	if server == 0 {
+		return interval
+	}
+	learned := time.Duration(serverPingSlack * float64(server))
+	return min(max(learned, minPingInterval), time.Duration(float64(time.Second)*a.maxPingIntervalSeconds))
+}
+
+// learnPingInterval averages the time between the server's PINGs. PINGs
+// before registration are cookies rather than keepalives, and are skipped.
+func (a *API) learnPingInterval(now time.Time) {
+	if !a.registered {
+		return
+	}
+	a.lag.mu.Lock()
+	defer a.lag.mu.Unlock()
+	if last := a.lag.serverPing; !last.IsZero() {
+		gap := now.Sub(last)
+		if a.lag.serverInterval == 0 {
+			a.lag.serverInterval = gap
+		} else {
+			a.lag.serverInterval = time.Duration(lagWeight*float64(gap) + (1-lagWeight)*float64(a.lag.serverInterval))
+		}
+		log.Debug().Str("api", ApiName).Msgf("server PINGs about every %s", a.lag.serverInterval.Round(time.Second))
+	}
+	a.lag.serverPing = now
+}
+
+// pingTimeout returns how long a PING may go unanswered, allowing for the
+// average lag.
+func (a *API) pingTimeout() time.Duration {
+	a.lag.mu.Lock()
+	defer a.lag.mu.Unlock()
+	return time.Duration(float64(time.Second)*a.pingTimeoutSeconds) + lagAllowance*a.lag.lag.Average
+}
+
+// sendLagPing PINGs the server with the time as token, unless a PING is
+// already waiting for its PONG.
+func (a *API) sendLagPing(c context.Context) error {
+	now := time.Now()
+	a.lag.mu.Lock()
+	if !a.lag.sent.IsZero() {
+		a.lag.mu.Unlock()
+		return nil
+	}
+	a.lag.sent = now
+	a.lag.mu.Unlock()
+	return a.SendMessage(c, &chatlib.Message{Command: "PING", Text: lagTokenPrefix + strconv.FormatInt(now.UnixNano(), 10)})
+}
+
+// handleLag measures the lag from PONGs to the bot's own PINGs, and starts
+// checking the connection once registered.
+func (a *API) handleLag(c context.Context, msg *chatlib.Message) {
+	switch msg.Command {
+	case rplWelcome:
+		go a.watchLag(c)
+	case "PONG":
+		if len(msg.Params) == 0 {
+			return
+		}
+		token, ok := strings.CutPrefix(msg.Params[len(msg.Params)-1], lagTokenPrefix)
+		if !ok {
+			return
+		}
+		sent, err := strconv.ParseInt(token, 10, 64)
+		if err != nil {
+			return
+		}
+		a.recordLag(time.Since(time.Unix(0, sent)))
+	}
+}
+
+func (a *API) recordLag(rtt time.Duration) {
+	a.lag.mu.Lock()
+	defer a.lag.mu.Unlock()
+	l := &a.lag.lag
+	if l.Measured.IsZero() {
+		l.Average = rtt
+	} else {
+		l.Average = time.Duration(lagWeight*float64(rtt) + (1-lagWeight)*float64(l.Average))
+	}
+	l.Current, l.Measured = rtt, time.Now()
+	if a.lag.dead {
+		log.Info().Str("api", ApiName).Msgf("server answered after %s", rtt.Round(time.Millisecond))
+	}
+	a.lag.sent, a.lag.dead = time.Time{}, false
+	for _, w := range a.lag.waiters {
+		w <- *l
+	}
+	a.lag.waiters = nil
+}
+
+// watchLag PINGs the server whenever the connection has been idle for the
+// ping interval, and reports it dead when a PING goes unanswered for longer
+// than the ping timeout, closing it if the API reconnects, until the
+// connection is replaced.
+func (a *API) watchLag(c context.Context) {
+	if a.pingIntervalSeconds <= 0 {
+		return
+	}
+	conn := a.conn
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for a.open && a.conn == conn {
+		select {
+		case <-c.Done():
+			return
+		case <-t.C:
+		}
+		if err := a.checkLag(c, time.Now(), a.PingInterval()); err != nil {
+			log.Error().Str("api", ApiName).Err(err).Msg("connection looks dead")
+			if a.notifyAdmins != nil {
+				a.notifyAdmins(c, fmt.Sprintf("connection to %s looks dead: %s", a.networkHost, err))
+			}
+			select {
+			case a.errs <- err:
+			default:
+			}
+			if a.reconnectDelaySeconds > 0 {
+				// Reading from it fails, and the API reconnects
+				conn.Close()
+			}
+		}
+	}
+}
+
+// checkLag sends a PING if the connection has been idle for interval, and
+// returns an error the first time an unanswered PING is older than the ping
+// timeout.
+func (a *API) checkLag(c context.Context, now time.Time, interval time.Duration) error {
+	timeout := a.pingTimeout()
+	a.lag.mu.Lock()
+	sent, idle := a.lag.sent, now.Sub(a.lag.lastRecv)
+	expired := !sent.IsZero() && now.Sub(sent) > timeout && !a.lag.dead
+	if expired {
+		a.lag.dead = true
+	}
+	a.lag.mu.Unlock()
+	if expired {
+		return errors.Errorf("irc: no answer to PING in %s", now.Sub(sent).Round(time.Second))
+	}
+	if sent.IsZero() && idle >= interval {
+		return a.sendLagPing(c)
+	}
+	return nil
+}
+
+// actionLag measures the lag and replies with it. The PONG is waited for in
+// the background, as it can't be received while an action runs.
+func (a *API) actionLag(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+	w := make(chan Lag, 1)
+	a.lag.mu.Lock()
+	a.lag.waiters = append(a.lag.waiters, w)
+	a.lag.mu.Unlock()
+	if err := a.sendLagPing(c); err != nil {
+		return err
+	}
+	go func() {
+		text := "no answer from the server yet"
+		select {
+		case <-c.Done():
+			return
+		case l := <-w:
+			text = fmt.Sprintf("lag: %s, average %s", l.Current.Round(time.Millisecond), l.Average.Round(time.Millisecond))
+		case <-time.After(a.pingTimeout()):
+		}
+		if err := a.SendMessage(c, &chatlib.Message{Command: "PRIVMSG", Receiver: msg.ReplyTarget(), Text: text}); err != nil {
+			log.Error().Str("api", ApiName).Err(err).Msg("error sending reply")
+		}
+	}()
+	return nil
+}
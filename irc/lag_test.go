@@ -0,0 +1,140 @@
+package irc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLag(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"), WithPingTimeout(30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+
+	start := time.Now().Add(-2 * time.Minute)
+	a.lag.received(start)
+	if err := a.checkLag(c, start.Add(time.Second), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if conn.next() != "" {
+		t.Error("expected no PING before the interval")
+	}
+	if err := a.checkLag(c, time.Now(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	line := conn.next()
+	token, ok := strings.CutPrefix(strings.TrimSpace(line), "PING :"+lagTokenPrefix)
+	if !ok {
+		t.Fatalf("expected a lag PING, got %q", line)
+	}
+	if err := a.checkLag(c, time.Now(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if conn.next() != "" {
+		t.Error("expected no second PING while one is unanswered")
+	}
+
+	a.rawMsgs <- []byte(":irc.example.net PONG irc.example.net :" + lagTokenPrefix + token + "\r\n")
+	if _, err := a.ReceiveMessage(c); err != nil {
+		t.Fatal(err)
+	}
+	lag := a.Lag()
+	if lag.Measured.IsZero() || lag.Current <= 0 || lag.Average != lag.Current {
+		t.Errorf("expected a lag measurement, got %+v", lag)
+	}
+	a.recordLag(2 * lag.Current)
+	if want := time.Duration(1.2 * float64(lag.Current)); a.Lag().Average != want {
+		t.Errorf("expected average %s, got %s", want, a.Lag().Average)
+	}
+
+	// PONGs to other PINGs aren't measured
+	a.rawMsgs <- []byte(":irc.example.net PONG irc.example.net :freya\r\n")
+	if _, err := a.ReceiveMessage(c); err != nil {
+		t.Fatal(err)
+	}
+	if a.Lag().Current != 2*lag.Current {
+		t.Error("expected a PONG to another PING to be ignored")
+	}
+}
+
+func TestLagDead(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"), WithPingTimeout(30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.conn = &bufConn{}
+	a.recordLag(5 * time.Second)
+
+	now := time.Now()
+	a.lag.received(now.Add(-time.Minute))
+	if err := a.checkLag(c, now, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// The timeout allows for four times the average lag
+	if err := a.checkLag(c, now.Add(45*time.Second), time.Minute); err != nil {
+		t.Errorf("expected a slow link not to be reported dead, got %s", err)
+	}
+	err = a.checkLag(c, now.Add(51*time.Second), time.Minute)
+	if err == nil {
+		t.Fatal("expected the connection to be reported dead")
+	}
+	if err := a.checkLag(c, now.Add(time.Minute), time.Minute); err != nil {
+		t.Error("expected a dead connection to be reported once")
+	}
+
+	a.errs <- err
+	if _, got := a.ReceiveMessage(c); got != err {
+		t.Errorf("expected ReceiveMessage to return %v, got %v", err, got)
+	}
+}
+
+func TestAdaptivePing(t *testing.T) {
+	a, err := New(WithNick("bot"), WithPingInterval(60), WithMaxPingInterval(120))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	a.learnPingInterval(now)
+	if a.PingInterval() != time.Minute {
+		t.Error("expected PINGs before registration to be skipped")
+	}
+	a.registered = true
+	a.learnPingInterval(now)
+	if a.PingInterval() != time.Minute {
+		t.Error("expected the ping interval until the server's is known")
+	}
+	a.learnPingInterval(now.Add(40 * time.Second))
+	if got := a.PingInterval(); got != time.Minute {
+		t.Errorf("expected 1.5 times the server's interval, got %s", got)
+	}
+	a.learnPingInterval(now.Add(45 * time.Second))
+	if got := a.PingInterval(); got != time.Duration(1.5*float64(33*time.Second)) {
+		t.Errorf("expected the server's interval to be averaged, got %s", got)
+	}
+
+	a.lag.serverInterval = 5 * time.Second
+	if got := a.PingInterval(); got != minPingInterval {
+		t.Errorf("expected at least %s, got %s", minPingInterval, got)
+	}
+
+	a.lag.serverInterval = 10 * time.Minute
+	if got := a.PingInterval(); got != 2*time.Minute {
+		t.Errorf("expected at most the max ping interval, got %s", got)
+	}
+	a.lag.reset()
+	if a.lag.serverInterval == 0 || !a.lag.serverPing.IsZero() {
+		t.Error("expected a new connection to keep the learned interval only")
+	}
+	if err := a.ApplyOptions(WithAdaptivePing(false)); err != nil {
+		t.Fatal(err)
+	}
+	if a.PingInterval() != time.Minute {
+		t.Error("expected the ping interval without adaptive pings")
+	}
+}
@@ -0,0 +1,273 @@
+package irc
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultListTimeoutSeconds  = 120
+	DefaultListIntervalSeconds = 60
+	DefaultListLimit           = 500
+)
+
+// Replies to LIST.
+const (
+	rplTryAgain  = "263"
+	rplListStart = "321"
+	rplList      = "322"
+	rplListEnd   = "323"
+)
+
+// ChannelListing is a channel as LIST describes it.
+type ChannelListing struct {
+	Name  string
+	Users int
+	Topic string
+}
+
+// ListFilter narrows the channels SearchChannels returns. The server is
+// asked to filter where it advertises the ELIST extensions for it.
+type ListFilter struct {
+	// Pattern is a mask the channel names must match, which may use * and ?.
+	// Empty matches every channel.
+	Pattern string
+	// MinUsers and MaxUsers bound the number of users in the channels, 0
+	// for no bound.
+	MinUsers int
+	MaxUsers int
+}
+
+// match reports whether the listing passes the filter's user bounds.
+func (f ListFilter) match(l ChannelListing) bool {
+	return (f.MinUsers <= 0 || l.Users >= f.MinUsers) && (f.MaxUsers <= 0 || l.Users <= f.MaxUsers)
+}
+
+// WithListTimeout sets how long ListChannels waits for the server to finish
+// the list.
+func WithListTimeout(seconds float64) Option {
+	return func(a *API) error {
+		a.listTimeoutSeconds = seconds
+		return nil
+	}
+}
+
+// WithListInterval sets the least time between two LIST commands. Listing
+// every channel is expensive for the server, and some disconnect clients
+// that do it too often.
+func WithListInterval(seconds float64) Option {
+	return func(a *API) error {
+		a.listIntervalSeconds = seconds
+		return nil
+	}
+}
+
+// WithListLimit sets the most channels SearchChannels returns, so a search
+// on a huge network doesn't keep every channel. 0 is unlimited.
+func WithListLimit(limit int) Option {
+	return func(a *API) error {
+		a.listLimit = limit
+		return nil
+	}
+}
+
+// listRequest collects the replies to a LIST as they arrive so the receive
+// loop is never held up by a slow consumer, which would get the bot
+// disconnected for not answering PINGs on a large network.
+type listRequest struct {
+	mu     sync.Mutex
+	items  []ChannelListing
+	done   bool
+	err    error
+	notify chan struct{}
+}
+
+func (r *listRequest) add(item ChannelListing) {
+	r.mu.Lock()
+	r.items = append(r.items, item)
+	r.mu.Unlock()
+	r.signal()
+}
+
+func (r *listRequest) finish(err error) {
+	r.mu.Lock()
+	r.done, r.err = true, err
+	r.mu.Unlock()
+	r.signal()
+}
+
+func (r *listRequest) signal() {
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the replies received since it was last called and whether
+// the list is finished.
+func (r *listRequest) take() ([]ChannelListing, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	items := r.items
+	r.items = nil
+	return items, r.done, r.err
+}
+
+// ListChannels asks the server for its channels and calls fn for each one
+// whose name matches pattern, a mask that may use * and ?. An empty pattern
+// matches every channel. The pattern is sent to the server when it can
+// filter, and applied locally otherwise. Only one list runs at a time and
+// lists are spaced by the list interval. If fn returns an error no more
+// channels are passed to it and the error is returned once the server has
+// finished the list.
+func (a *API) ListChannels(c context.Context, pattern string, fn func(ChannelListing) error) error {
+	return a.listChannels(c, ListFilter{Pattern: pattern}, fn)
+}
+
+// SearchChannels returns the channels passing f, busiest first. Only the
+// busiest are kept if there are more than the list limit. See ListChannels.
+func (a *API) SearchChannels(c context.Context, f ListFilter) ([]ChannelListing, error) {
+	found := make([]ChannelListing, 0)
+	err := a.listChannels(c, f, func(l ChannelListing) error {
+		i := sort.Search(len(found), func(i int) bool { return found[i].Users < l.Users })
+		if a.listLimit > 0 && i >= a.listLimit {
+			return nil
+		}
+		found = append(found[:i], append([]ChannelListing{l}, found[i:]...)...)
+		if a.listLimit > 0 && len(found) > a.listLimit {
+			found = found[:a.listLimit]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// listChannels lists the channels passing f, see ListChannels.
+func (a *API) listChannels(c context.Context, f ListFilter, fn func(ChannelListing) error) error {
+	select {
+	case a.listSem <- struct{}{}:
+	case <-c.Done():
+		return c.Err()
+	}
+	defer func() { <-a.listSem }()
+	interval := time.Duration(float64(time.Second) * a.listIntervalSeconds)
+	if wait := time.Until(a.lastList.Add(interval)); wait > 0 {
+		select {
+		case <-c.Done():
+			return c.Err()
+		case <-time.After(wait):
+		}
+	}
+	c, cancel := context.WithTimeout(c, time.Duration(float64(time.Second)*a.listTimeoutSeconds))
+	defer cancel()
+
+	req := &listRequest{notify: make(chan struct{}, 1)}
+	a.listMu.Lock()
+	a.listing = req
+	a.listMu.Unlock()
+	defer func() {
+		a.listMu.Lock()
+		a.listing = nil
+		a.listMu.Unlock()
+	}()
+	a.lastList = time.Now()
+	if err := a.SendMessage(c, &chatlib.Message{Command: a.listCommand(f)}); err != nil {
+		return err
+	}
+
+	match := maskRegexp(f.Pattern)
+	var fnErr error
+	for {
+		items, done, err := req.take()
+		for _, item := range items {
+			if fnErr == nil && match.MatchString(item.Name) && f.match(item) {
+				fnErr = fn(item)
+			}
+		}
+		if done {
+			if fnErr != nil {
+				return fnErr
+			}
+			return err
+		}
+		select {
+		case <-c.Done():
+			return errors.Wrap(chatlib.ErrTimeout, "irc: timed out waiting for the channel list")
+		case <-req.notify:
+		}
+	}
+}
+
+// listCommand returns the LIST asking for the channels passing f, leaving
+// the server what it can filter. Conditions are given along with the mask,
+// separated by commas, as servers with ELIST take them.
+func (a *API) listCommand(f ListFilter) string {
+	elist := strings.ToUpper(a.isupportOr("ELIST", ""))
+	params := make([]string, 0, 3)
+	if f.Pattern != "" && (!strings.ContainsAny(f.Pattern, "*?") || strings.Contains(elist, "M")) {
+		params = append(params, f.Pattern)
+	}
+	if strings.Contains(elist, "U") {
+		// The bounds are exclusive
+		if f.MinUsers > 0 {
+			params = append(params, ">"+strconv.Itoa(f.MinUsers-1))
+		}
+		if f.MaxUsers > 0 {
+			params = append(params, "<"+strconv.Itoa(f.MaxUsers+1))
+		}
+	}
+	if len(params) == 0 {
+		return "LIST"
+	}
+	return "LIST " + strings.Join(params, ",")
+}
+
+// handleList passes replies to LIST to the running ListChannels.
+func (a *API) handleList(msg *chatlib.Message) {
+	a.listMu.Lock()
+	req := a.listing
+	a.listMu.Unlock()
+	if req == nil {
+		return
+	}
+	switch msg.Command {
+	case rplList:
+		// <bot> <channel> <users> :<topic>
+		if len(msg.Params) < 3 {
+			return
+		}
+		users, _ := strconv.Atoi(msg.Params[2])
+		topic := ""
+		if len(msg.Params) > 3 {
+			topic = msg.Params[3]
+		}
+		req.add(ChannelListing{Name: msg.Params[1], Users: users, Topic: topic})
+	case rplListEnd:
+		req.finish(nil)
+	case rplTryAgain:
+		req.finish(errors.Errorf("irc: server refused to list channels: %s", msg.Text))
+	}
+}
+
+// maskRegexp compiles an IRC mask using * and ? into a case insensitive
+// regexp. An empty mask matches everything.
+func maskRegexp(mask string) *regexp.Regexp {
+	if mask == "" {
+		mask = "*"
+	}
+	pattern := regexp.QuoteMeta(mask)
+	pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+	pattern = strings.ReplaceAll(pattern, `\?`, ".")
+	return regexp.MustCompile("(?i)^" + pattern + "$")
+}
@@ -0,0 +1,169 @@
+package irc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListChannels(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"), WithListInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	receive := func(line string) {
+		t.Helper()
+		a.rawMsgs <- []byte(line)
+		if _, err := a.ReceiveMessage(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := func(pattern string, fn func(ChannelListing) error, replies ...string) error {
+		t.Helper()
+		result := make(chan error, 1)
+		go func() { result <- a.ListChannels(c, pattern, fn) }()
+		for start := time.Now(); ; time.Sleep(time.Millisecond) {
+			a.listMu.Lock()
+			listing := a.listing
+			a.listMu.Unlock()
+			if listing != nil {
+				break
+			} else if time.Since(start) > time.Second {
+				t.Fatal("list not started")
+			}
+		}
+		for _, line := range replies {
+			receive(line)
+		}
+		return <-result
+	}
+
+	var got []ChannelListing
+	collect := func(l ChannelListing) error {
+		got = append(got, l)
+		return nil
+	}
+	err = list("#GO*", collect,
+		":irc.example.net 321 bot Channel :Users  Name\r\n",
+		":irc.example.net 322 bot #go-nuts 250 :[+nt] Go programming\r\n",
+		":irc.example.net 322 bot #rust 100 :Rust\r\n",
+		":irc.example.net 322 bot #golang 12\r\n",
+		":irc.example.net 323 bot :End of /LIST\r\n",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ChannelListing{{"#go-nuts", 250, "[+nt] Go programming"}, {"#golang", 12, ""}}
+	if len(got) != len(expected) || got[0] != expected[0] || got[1] != expected[1] {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	// The server can't filter with masks
+	if line := conn.next(); line != "LIST\n" {
+		t.Errorf("expected a plain LIST, got %q", line)
+	}
+
+	a.rawMsgs <- []byte(":irc.example.net 005 bot ELIST=CMNTU :are supported by this server\r\n")
+	if _, err := a.ReceiveMessage(c); err != nil {
+		t.Fatal(err)
+	}
+	stop := errors.New("stop")
+	calls := 0
+	err = list("#go*", func(ChannelListing) error { calls++; return stop },
+		":irc.example.net 322 bot #go-nuts 250 :Go\r\n",
+		":irc.example.net 322 bot #golang 12 :Go\r\n",
+		":irc.example.net 323 bot :End of /LIST\r\n",
+	)
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("expected to stop after the first channel, got %v after %d calls", err, calls)
+	}
+	if line := conn.next(); line != "LIST #go*\n" {
+		t.Errorf("expected the mask to be sent, got %q", line)
+	}
+
+	err = list("", collect, ":irc.example.net 263 bot LIST :Server load is temporarily too heavy\r\n")
+	if err == nil {
+		t.Error("expected an error when the server refuses to list")
+	}
+}
+
+func TestSearchChannels(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"), WithListInterval(0), WithListLimit(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	search := func(f ListFilter, replies ...string) ([]ChannelListing, error) {
+		t.Helper()
+		type result struct {
+			found []ChannelListing
+			err   error
+		}
+		done := make(chan result, 1)
+		go func() {
+			found, err := a.SearchChannels(c, f)
+			done <- result{found, err}
+		}()
+		for start := time.Now(); ; time.Sleep(time.Millisecond) {
+			a.listMu.Lock()
+			listing := a.listing
+			a.listMu.Unlock()
+			if listing != nil {
+				break
+			} else if time.Since(start) > time.Second {
+				t.Fatal("list not started")
+			}
+		}
+		for _, line := range replies {
+			a.rawMsgs <- []byte(line)
+			if _, err := a.ReceiveMessage(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r := <-done
+		return r.found, r.err
+	}
+	replies := []string{
+		":irc.example.net 322 bot #go-nuts 250 :Go\r\n",
+		":irc.example.net 322 bot #golang 12 :Go\r\n",
+		":irc.example.net 322 bot #go 3 :Go\r\n",
+		":irc.example.net 322 bot #go-dev 40 :Go\r\n",
+		":irc.example.net 322 bot #gopher 40 :Go\r\n",
+		":irc.example.net 323 bot :End of /LIST\r\n",
+	}
+
+	// Without ELIST the filter is applied locally
+	found, err := search(ListFilter{Pattern: "#go*", MinUsers: 5, MaxUsers: 100}, replies...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ChannelListing{{"#go-dev", 40, "Go"}, {"#gopher", 40, "Go"}}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected %v, got %v", expected, found)
+	}
+	if line := conn.next(); line != "LIST\n" {
+		t.Errorf("expected a plain LIST, got %q", line)
+	}
+
+	a.rawMsgs <- []byte(":irc.example.net 005 bot ELIST=MU :are supported by this server\r\n")
+	if _, err := a.ReceiveMessage(c); err != nil {
+		t.Fatal(err)
+	}
+	found, err = search(ListFilter{Pattern: "#go*", MinUsers: 5}, replies...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []ChannelListing{{"#go-nuts", 250, "Go"}, {"#go-dev", 40, "Go"}}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected %v, got %v", expected, found)
+	}
+	if line := conn.next(); line != "LIST #go*,>4\n" {
+		t.Errorf("expected the server to filter, got %q", line)
+	}
+}
@@ -0,0 +1,187 @@
+package irc
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+)
+
+// defaultModesPerLine is how many modes with a parameter one MODE may set on
+// servers that don't advertise MODES, as RFC 2812 allows.
+const defaultModesPerLine = 3
+
+var _ chatlib.Kicker = (*API)(nil)
+
+// AnnotationModes holds the changes a channel MODE message makes, so actions
+// registered for MODE needn't parse them.
+var AnnotationModes = chatlib.NewAnnotationKey[[]ModeChange]("irc.modes")
+
+// ModeChange is one mode set or unset by a MODE command.
+type ModeChange struct {
+	// Add is set for modes set with + and unset for those removed with -.
+	Add  bool
+	Mode rune
+	// Param is the mode's parameter if it takes one, e.g. the nick for o,
+	// the mask for b or the key for k.
+	Param string
+}
+
+// String returns the change as written in a MODE, e.g. +o alice.
+func (m ModeChange) String() string {
+	s := "-"
+	if m.Add {
+		s = "+"
+	}
+	s += string(m.Mode)
+	if m.Param != "" {
+		s += " " + m.Param
+	}
+	return s
+}
+
+// Mode changes the modes of channel, e.g. Mode(c, "#chan", "+o", "alice") or
+// Mode(c, "#chan", "-v+b", "bob", "*!*@spam.example.com"). A single mode is
+// set for each of several parameters, e.g. Mode(c, "#chan", "+v", "alice",
+// "bob"). The changes are sent in as many MODE commands as the server's
+// MODES limit needs.
+func (a *API) Mode(c context.Context, channel, modes string, params ...string) error {
+	if !a.isChannel(channel) {
+		return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: not a channel: %s", channel)
+	}
+	if len(modes) == 2 && (modes[0] == '+' || modes[0] == '-') && len(params) > 1 {
+		modes = modes[:1] + strings.Repeat(modes[1:], len(params))
+	}
+	info := a.ServerInfo()
+	known := info.PrefixModes + strings.Join(info.ChanModes[:], "")
+	add, count, needed := true, 0, 0
+	for _, m := range modes {
+		switch {
+		case m == '+' || m == '-':
+			add = m == '+'
+		case !strings.ContainsRune(known, m):
+			return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: unknown channel mode %c", m)
+		case takesParam(info, m, add):
+			needed++
+			fallthrough
+		default:
+			count++
+		}
+	}
+	if count == 0 || needed != len(params) {
+		return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: modes %s don't take %d parameters", modes, len(params))
+	}
+	return a.sendModes(c, channel, info, parseModes(info, modes, params))
+}
+
+// Op gives nicks operator status in channel.
+func (a *API) Op(c context.Context, channel string, nicks ...string) error {
+	return a.Mode(c, channel, "+o", nicks...)
+}
+
+// Deop takes operator status in channel from nicks.
+func (a *API) Deop(c context.Context, channel string, nicks ...string) error {
+	return a.Mode(c, channel, "-o", nicks...)
+}
+
+// Voice gives nicks voice in channel.
+func (a *API) Voice(c context.Context, channel string, nicks ...string) error {
+	return a.Mode(c, channel, "+v", nicks...)
+}
+
+// Devoice takes voice in channel from nicks.
+func (a *API) Devoice(c context.Context, channel string, nicks ...string) error {
+	return a.Mode(c, channel, "-v", nicks...)
+}
+
+// Ban bans masks, such as those BanMask returns, from channel.
+func (a *API) Ban(c context.Context, channel string, masks ...string) error {
+	return a.Mode(c, channel, "+b", masks...)
+}
+
+// Unban lifts the bans of masks from channel.
+func (a *API) Unban(c context.Context, channel string, masks ...string) error {
+	return a.Mode(c, channel, "-b", masks...)
+}
+
+// Kick removes nick from channel, giving reason.
+func (a *API) Kick(c context.Context, channel, nick, reason string) error {
+	if !a.isChannel(channel) {
+		return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: not a channel: %s", channel)
+	}
+	return a.SendMessage(c, &chatlib.Message{Command: "KICK " + channel + " " + nick, Text: reason})
+}
+
+// BanMask returns a mask banning nick by host, *!*@host, if the host is known
+// from a channel the bot shares with them, or nick!*@* otherwise.
+func (a *API) BanMask(nick string) string {
+	fold := a.folder()
+	a.memberMu.Lock()
+	defer a.memberMu.Unlock()
+	for _, ch := range a.chans {
+		if m, ok := ch.members[fold(nick)]; ok && m.Host != "" {
+			return "*!*@" + m.Host
+		}
+	}
+	return nick + "!*@*"
+}
+
+// sendModes sends changes to channel, no more modes with a parameter in each
+// MODE than the server allows.
+func (a *API) sendModes(c context.Context, channel string, info ServerInfo, changes []ModeChange) error {
+	limit := info.Modes
+	if v, ok := info.Tokens["MODES"]; ok && v == "" {
+		// MODES without a value has no limit
+		limit = len(changes)
+	} else if limit <= 0 {
+		limit = defaultModesPerLine
+	}
+	for len(changes) > 0 {
+		n, withParam := 0, 0
+		for ; n < len(changes); n++ {
+			if changes[n].Param != "" {
+				if withParam == limit {
+					break
+				}
+				withParam++
+			}
+		}
+		if err := a.SendMessage(c, &chatlib.Message{Command: "MODE " + channel + " " + formatModes(changes[:n])}); err != nil {
+			return err
+		}
+		changes = changes[n:]
+	}
+	return nil
+}
+
+// formatModes writes changes as the mode string and parameters of a MODE,
+// e.g. +ov-b alice alice *!*@spam.
+func formatModes(changes []ModeChange) string {
+	var b strings.Builder
+	params := make([]string, 0, len(changes))
+	sign := ' '
+	for _, change := range changes {
+		s := '-'
+		if change.Add {
+			s = '+'
+		}
+		if s != sign {
+			b.WriteRune(s)
+			sign = s
+		}
+		b.WriteRune(change.Mode)
+		if change.Param != "" {
+			params = append(params, change.Param)
+		}
+	}
+	return strings.Join(append([]string{b.String()}, params...), " ")
+}
+
+// handleModes annotates channel MODE messages with the changes they make.
+func (a *API) handleModes(msg *chatlib.Message) {
+	if msg.Command != "MODE" || len(msg.Params) < 2 || !a.isChannel(msg.Receiver) {
+		return
+	}
+	AnnotationModes.Set(msg, parseModes(a.ServerInfo(), msg.Params[1], msg.Params[2:]))
+}
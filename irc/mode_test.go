@@ -0,0 +1,83 @@
+package irc
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestMode(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	receive := func(line string) {
+		t.Helper()
+		a.rawMsgs <- []byte(line)
+		if _, err := a.ReceiveMessage(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive(":irc.example.net 005 bot PREFIX=(qov)~@+ CHANMODES=beI,k,l,imnpst MODES=2 :are supported by this server\r\n")
+	receive(":bot!u@h JOIN #test\r\n")
+	receive(":irc.example.net 353 bot = #test :@bot alice bob!b@bob.example.com\r\n")
+	conn.Reset()
+
+	for _, tc := range []struct {
+		call     func() error
+		expected []string
+	}{
+		{func() error { return a.Op(c, "#test", "alice") }, []string{"MODE #test +o alice\n"}},
+		{func() error { return a.Voice(c, "#test", "alice", "bob", "carol") }, []string{"MODE #test +vv alice bob\n", "MODE #test +v carol\n"}},
+		{func() error { return a.Mode(c, "#test", "-o+b-k+m", "alice", "*!*@spam", "key") }, []string{"MODE #test -o+b alice *!*@spam\n", "MODE #test -k+m key\n"}},
+		{func() error { return a.Ban(c, "#test", a.BanMask("Bob"), a.BanMask("alice")) }, []string{"MODE #test +bb *!*@bob.example.com alice!*@*\n"}},
+		{func() error { return a.Kick(c, "#test", "bob", "not verified in time") }, []string{"KICK #test bob :not verified in time\n"}},
+	} {
+		if err := tc.call(); err != nil {
+			t.Fatal(err)
+		}
+		for _, expected := range tc.expected {
+			if line := conn.next(); line != expected {
+				t.Errorf("expected %q, got %q", expected, line)
+			}
+		}
+	}
+	for _, tc := range []struct {
+		channel string
+		modes   string
+		params  []string
+	}{
+		{"alice", "+o", []string{"bob"}},
+		{"#test", "+x", nil},
+		{"#test", "+o", nil},
+		{"#test", "+m", []string{"alice"}},
+		{"#test", "+ov", []string{"alice"}},
+	} {
+		if err := a.Mode(c, tc.channel, tc.modes, tc.params...); err == nil {
+			t.Errorf("%s %s %v: expected an error", tc.channel, tc.modes, tc.params)
+		}
+	}
+	if line := conn.next(); line != "" {
+		t.Errorf("expected nothing sent for invalid modes, got %q", line)
+	}
+
+	a.rawMsgs <- []byte(":alice!a@h MODE #test +ol-b bob 10 *!*@spam\r\n")
+	msg, err := a.ReceiveMessage(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, _ := AnnotationModes.Get(msg)
+	expected := []ModeChange{{Add: true, Mode: 'o', Param: "bob"}, {Add: true, Mode: 'l', Param: "10"}, {Mode: 'b', Param: "*!*@spam"}}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %+v, got %+v", expected, changes)
+	}
+	if s := changes[2].String(); s != "-b *!*@spam" {
+		t.Errorf("unexpected change %q", s)
+	}
+	if m, _ := a.Channel("#test").Member("bob"); m.Prefixes != "@" {
+		t.Errorf("expected bob to be op, got %+v", m)
+	}
+}
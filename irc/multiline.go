@@ -0,0 +1,240 @@
+package irc
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gregseb/chatlib"
+)
+
+const (
+	multilineCap    = "draft/multiline"
+	multilineBatch  = "draft/multiline"
+	multilineConcat = "draft/multiline-concat"
+	// maxLineBytes is the longest line the server relays, without tags.
+	maxLineBytes = 512
+	// maxSourceBytes is room for the :nick!user@host source the server puts
+	// in front of the bot's messages when relaying them, with a 10 byte user
+	// and 63 byte host, besides the nick.
+	maxSourceBytes = len(":!@ ") + 10 + 63
+)
+
+// multilineMessage collects the lines of an incoming multiline batch.
+type multilineMessage struct {
+	msg   *chatlib.Message
+	text  strings.Builder
+	lines int
+}
+
+// isTextCommand reports whether command carries text for people to read,
+// which is split to fit.
+func isTextCommand(command string) bool {
+	switch command {
+	case "PRIVMSG", "NOTICE", "CPRIVMSG", "CNOTICE":
+		return true
+	}
+	return false
+}
+
+// sendText sends the text of msg in as many lines as it takes. Lines of text
+// are kept apart, and lines too long for the server are split between words,
+// after shortening their URLs if there is a URLShortener.
+// On servers with draft/multiline the lines are sent as a batch the server
+// and clients treat as a single message. Lines to a target with a FiSH key
+// are encrypted one by one.
+func (a *API) sendText(c context.Context, msg *chatlib.Message) error {
+	cmd := msg.Command + " " + msg.Receiver + " :"
+	limit := maxLineBytes - len("\r\n") - len(cmd) - len(a.nick) - maxSourceBytes
+	key := a.fishKeyFor(msg.Receiver)
+	if key != nil && !strings.HasPrefix(msg.Text, ctcpDelimiter) {
+		// Actions were fitted by sendAction
+		limit = key.plainLimit(limit)
+	}
+	lines := a.fitText(c, msg.Text, limit)
+	if len(lines) > 1 && key == nil && a.HasCap(multilineCap) && (msg.Command == "PRIVMSG" || msg.Command == "NOTICE") {
+		return a.sendMultiline(c, msg, lines)
+	}
+	for _, l := range lines {
+		if text := strings.TrimRight(l.text, " "); text != "" {
+			a.expectEcho(msg.Receiver, text)
+			if key != nil {
+				text = a.encryptFiSH(key, text)
+			}
+			if err := a.sendLine(c, msg.Command, cmd+text); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sendMultiline sends lines in multiline batches, as many as the server's
+// limits require.
+func (a *API) sendMultiline(c context.Context, msg *chatlib.Message, lines []textLine) error {
+	value, _ := a.CapValue(multilineCap)
+	maxBytes, maxLines := multilineLimits(value)
+	for len(lines) > 0 {
+		n, size := 0, 0
+		for n < len(lines) && (maxLines <= 0 || n < maxLines) {
+			// The first line of a batch can't continue the previous one
+			lineSize := len(lines[n].text)
+			if n > 0 && !lines[n].concat {
+				lineSize++
+			}
+			if maxBytes > 0 && n > 0 && size+lineSize > maxBytes {
+				break
+			}
+			size += lineSize
+			n++
+		}
+		if err := a.sendBatch(c, msg, lines[:n]); err != nil {
+			return err
+		}
+		lines = lines[n:]
+		if len(lines) > 0 {
+			lines[0].concat = false
+		}
+	}
+	return nil
+}
+
+func (a *API) sendBatch(c context.Context, msg *chatlib.Message, lines []textLine) error {
+	ref := "ml" + strconv.FormatUint(a.batchSeq.Add(1), 36)
+	var sent strings.Builder
+	for i, l := range lines {
+		if i > 0 && !l.concat {
+			sent.WriteByte('\n')
+		}
+		if l.text == "" {
+			sent.WriteByte(' ')
+		}
+		sent.WriteString(l.text)
+	}
+	a.expectEcho(msg.Receiver, sent.String())
+	if err := a.sendLine(c, "BATCH", "BATCH +"+ref+" "+multilineBatch+" "+msg.Receiver); err != nil {
+		return err
+	}
+	for i, l := range lines {
+		tags := "@batch=" + ref
+		if l.concat && i > 0 {
+			tags += ";" + multilineConcat
+		}
+		text := l.text
+		if text == "" {
+			// Blank lines can't be sent empty
+			text = " "
+		}
+		if err := a.sendLine(c, msg.Command, tags+" "+msg.Command+" "+msg.Receiver+" :"+text); err != nil {
+			return err
+		}
+	}
+	return a.sendLine(c, "BATCH", "BATCH -"+ref)
+}
+
+// multilineLimits parses the draft/multiline capability value, e.g.
+// max-bytes=4096,max-lines=24. Limits that aren't given are 0.
+func multilineLimits(value string) (maxBytes, maxLines int) {
+	for _, item := range strings.Split(value, ",") {
+		k, v, _ := strings.Cut(item, "=")
+		n, _ := strconv.Atoi(v)
+		switch k {
+		case "max-bytes":
+			maxBytes = n
+		case "max-lines":
+			maxLines = n
+		}
+	}
+	return maxBytes, maxLines
+}
+
+// textLine is a line to send. concat is set when it continues the line
+// before it rather than starting a new one.
+type textLine struct {
+	text   string
+	concat bool
+}
+
+// wrapText splits text into its lines and lines longer than limit bytes
+// between words, or anywhere if a word is too long. The space a line is
+// split at is kept at the end of the first part so the parts join up again.
+func wrapText(text string, limit int) []textLine {
+	limit = max(limit, utf8.UTFMax)
+	lines := make([]textLine, 0)
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		concat := false
+		for len(line) > limit {
+			cut := strings.LastIndexByte(line[:limit], ' ') + 1
+			if cut <= 0 {
+				cut = limit
+				for cut > 0 && !utf8.RuneStart(line[cut]) {
+					cut--
+				}
+			}
+			lines = append(lines, textLine{line[:cut], concat})
+			line, concat = line[cut:], true
+		}
+		lines = append(lines, textLine{line, concat})
+	}
+	// Drop blank lines at the end, left by a trailing newline
+	for len(lines) > 1 && lines[len(lines)-1].text == "" && !lines[len(lines)-1].concat {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// handleMultiline collects the lines of incoming multiline batches. It
+// returns true for lines that are part of a batch, which aren't passed on,
+// along with the whole message once the batch ends.
+func (a *API) handleMultiline(msg *chatlib.Message) (*chatlib.Message, bool) {
+	if msg.Command == "BATCH" {
+		ref := msg.Receiver
+		switch {
+		case strings.HasPrefix(ref, "+") && len(msg.Params) > 2 && msg.Params[1] == multilineBatch:
+			a.batches[ref[1:]] = &multilineMessage{msg: msg}
+			return nil, true
+		case strings.HasPrefix(ref, "-"):
+			ml, ok := a.batches[ref[1:]]
+			if !ok {
+				return nil, false
+			}
+			delete(a.batches, ref[1:])
+			return ml.message(), true
+		}
+		return nil, false
+	}
+	ml, ok := a.batches[msg.Tags["batch"]]
+	if !ok || msg.Tags["batch"] == "" {
+		return nil, false
+	}
+	if ml.lines == 0 {
+		// The first line stands for the whole message, with the tags of
+		// the batch, such as its msgid and time
+		first := *msg
+		first.Tags = ml.msg.Tags
+		if !ml.msg.Time.IsZero() {
+			first.Time, first.Replayed = ml.msg.Time, ml.msg.Replayed
+		}
+		ml.msg = &first
+	} else if _, concat := msg.Tags[multilineConcat]; !concat {
+		ml.text.WriteByte('\n')
+	}
+	ml.text.WriteString(msg.Text)
+	ml.lines++
+	return nil, true
+}
+
+// message returns the reassembled message, which has the tags of the
+// opening BATCH, such as its msgid, and the text of every line.
+func (ml *multilineMessage) message() *chatlib.Message {
+	if ml.lines == 0 {
+		return nil
+	}
+	msg := ml.msg
+	msg.Text = ml.text.String()
+	if len(msg.Params) > 0 {
+		msg.Params = append(append([]string{}, msg.Params[:len(msg.Params)-1]...), msg.Text)
+	}
+	return msg
+}
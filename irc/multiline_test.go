@@ -0,0 +1,117 @@
+package irc
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestWrapText(t *testing.T) {
+	for _, tc := range []struct {
+		text     string
+		limit    int
+		expected []textLine
+	}{
+		{"short", 10, []textLine{{"short", false}}},
+		{"one\ntwo\r\n", 10, []textLine{{"one", false}, {"two", false}}},
+		{"hello there world", 12, []textLine{{"hello there ", false}, {"world", true}}},
+		{"abcdefghij", 4, []textLine{{"abcd", false}, {"efgh", true}, {"ij", true}}},
+		// Runes aren't split
+		{"ééé", 5, []textLine{{"éé", false}, {"é", true}}},
+	} {
+		got := wrapText(tc.text, tc.limit)
+		if len(got) != len(tc.expected) {
+			t.Errorf("%q: expected %v, got %v", tc.text, tc.expected, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.expected[i] {
+				t.Errorf("%q: expected %v, got %v", tc.text, tc.expected, got)
+				break
+			}
+		}
+	}
+}
+
+func TestSendMultiline(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	long := strings.Repeat("word ", 100)
+	send := func() {
+		t.Helper()
+		if err := a.SendMessage(c, &chatlib.Message{Command: "PRIVMSG", Receiver: "#test", Text: "one\n" + long}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Split without multiline
+	send()
+	for _, line := range []string{"PRIVMSG #test :one\n", "PRIVMSG #test :word", "PRIVMSG #test :word"} {
+		if got := conn.next(); !strings.HasPrefix(got, line) || len(got) > maxLineBytes {
+			t.Errorf("expected %q, got %q", line, got)
+		}
+	}
+	if got := conn.next(); got != "" {
+		t.Errorf("unexpected line %q", got)
+	}
+
+	a.availableCaps = map[string]string{multilineCap: "max-bytes=4096,max-lines=2"}
+	a.grantedCaps = map[string]bool{multilineCap: true}
+	send()
+	expected := []string{
+		"BATCH +ml1 draft/multiline #test\n",
+		"@batch=ml1 PRIVMSG #test :one\n",
+		"@batch=ml1 PRIVMSG #test :word",
+		"BATCH -ml1\n",
+		"BATCH +ml2 draft/multiline #test\n",
+		"@batch=ml2 PRIVMSG #test :word",
+		"BATCH -ml2\n",
+	}
+	for _, line := range expected {
+		if got := conn.next(); !strings.HasPrefix(got, line) {
+			t.Errorf("expected %q, got %q", line, got)
+		}
+	}
+}
+
+func TestReceiveMultiline(t *testing.T) {
+	a, err := New(WithNick("bot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []*chatlib.Message
+	for _, line := range []string{
+		"@msgid=abc;time=2023-11-05T12:00:00.000Z :foo!u@h BATCH +x draft/multiline #test\r\n",
+		"@batch=x :foo!u@h PRIVMSG #test :hello\r\n",
+		"@batch=x;draft/multiline-concat :foo!u@h PRIVMSG #test : world\r\n",
+		"@batch=x :foo!u@h PRIVMSG #test :second line\r\n",
+		":bar!u@h PRIVMSG #test :interleaved\r\n",
+		":foo!u@h BATCH -x\r\n",
+	} {
+		a.rawMsgs <- []byte(line)
+		msg, err := a.ReceiveMessage(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != nil {
+			got = append(got, msg)
+		}
+	}
+	if len(got) != 2 || got[0].Text != "interleaved" {
+		t.Fatalf("expected the interleaved message and the batch, got %v", got)
+	}
+	msg := got[1]
+	if msg.Command != "PRIVMSG" || msg.Nick != "foo" || msg.Receiver != "#test" || msg.Text != "hello world\nsecond line" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+	if msg.Tags["msgid"] != "abc" || msg.Time.IsZero() || msg.Params[1] != msg.Text {
+		t.Errorf("expected the batch's tags, got %v", msg.Tags)
+	}
+}
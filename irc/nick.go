@@ -0,0 +1,155 @@
+package irc
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultRegainNickSeconds = 60
+	// maxNickSuffix is how many underscores are tried after the primary nick
+	// once the alternate nicks are used up.
+	maxNickSuffix = 3
+)
+
+// Numerics refusing a nick.
+const (
+	rplWelcome          = "001"
+	errErroneusNickname = "432"
+	errNicknameInUse    = "433"
+	errUnavailResource  = "437"
+)
+
+// WithAltNicks sets nicks to fall back to, in order, if the nick is in use
+// when connecting. Once they are used up the nick is tried with underscores
+// appended.
+func WithAltNicks(nicks []string) Option {
+	return func(a *API) error {
+		a.altNicks = nicks
+		return nil
+	}
+}
+
+// WithRegainNick sets how often to try to get the nick back while using an
+// alternate one. 0 only tries when its holder is seen leaving.
+func WithRegainNick(seconds float64) Option {
+	return func(a *API) error {
+		a.regainNickSeconds = seconds
+		return nil
+	}
+}
+
+// WithGhost asks NickServ to disconnect whoever is using the nick before
+// trying to get it back, which needs the nick's password. Only used with
+// NickServ authentication.
+func WithGhost(enable bool) Option {
+	return func(a *API) error {
+		a.ghost = enable
+		return nil
+	}
+}
+
+// PrimaryNick returns the configured nick, which may differ from Nick while
+// it is in use by someone else.
+func (a *API) PrimaryNick() string {
+	return a.primaryNick
+}
+
+// handleNick follows changes to the bot's nick and picks another when the
+// server refuses one during registration.
+func (a *API) handleNick(c context.Context, msg *chatlib.Message) error {
+	switch msg.Command {
+	case rplWelcome:
+		// The server says which nick we registered with
+		a.nick = msg.Receiver
+		a.registered = true
+		if !strings.EqualFold(a.nick, a.primaryNick) {
+			log.Warn().Str("api", ApiName).Msgf("registered as %s, %s is in use", a.nick, a.primaryNick)
+			go a.regainNick(c)
+		}
+	case "NICK":
+		if strings.EqualFold(msg.Nick, a.nick) {
+			log.Info().Str("api", ApiName).Msgf("nick changed from %s to %s", a.nick, msg.Receiver)
+			a.nick = msg.Receiver
+			return nil
+		}
+		if strings.EqualFold(msg.Nick, a.primaryNick) {
+			return a.tryPrimaryNick(c)
+		}
+	case "QUIT":
+		if strings.EqualFold(msg.Nick, a.primaryNick) {
+			return a.tryPrimaryNick(c)
+		}
+	case errErroneusNickname, errNicknameInUse, errUnavailResource:
+		if a.registered {
+			// A failed attempt to get the primary nick back
+			log.Debug().Str("api", ApiName).Msgf("nick not available: %s", msg.Text)
+			return nil
+		}
+		nick, ok := a.nextNick()
+		if !ok {
+			log.Error().Str("api", ApiName).Msgf("no nicks left to try, %s", msg.Text)
+			return nil
+		}
+		log.Warn().Str("api", ApiName).Msgf("nick %s not available, trying %s", a.nick, nick)
+		a.nick = nick
+		return a.SendMessage(c, &chatlib.Message{Command: "NICK " + nick})
+	}
+	return nil
+}
+
+// nextNick returns the nick to try after the current one was refused.
+func (a *API) nextNick() (string, bool) {
+	a.nickAttempts++
+	if a.nickAttempts <= len(a.altNicks) {
+		return a.altNicks[a.nickAttempts-1], true
+	}
+	suffix := a.nickAttempts - len(a.altNicks)
+	if suffix > maxNickSuffix {
+		return "", false
+	}
+	return a.primaryNick + strings.Repeat("_", suffix), true
+}
+
+// tryPrimaryNick asks for the primary nick if the bot isn't using it.
+func (a *API) tryPrimaryNick(c context.Context) error {
+	if !a.registered || strings.EqualFold(a.nick, a.primaryNick) {
+		return nil
+	}
+	log.Info().Str("api", ApiName).Msgf("trying to regain nick %s", a.primaryNick)
+	return a.SendMessage(c, &chatlib.Message{Command: "NICK " + a.primaryNick})
+}
+
+// regainNick periodically tries to get the primary nick back until it has it
+// or the connection is replaced.
+func (a *API) regainNick(c context.Context) {
+	if a.regainNickSeconds <= 0 {
+		return
+	}
+	conn := a.conn
+	t := time.NewTicker(time.Duration(float64(time.Second) * a.regainNickSeconds))
+	defer t.Stop()
+	for a.open && a.conn == conn && !strings.EqualFold(a.nick, a.primaryNick) {
+		select {
+		case <-c.Done():
+			return
+		case <-t.C:
+		}
+		if a.ghost && a.authMethod == AuthMethodNickServ && a.password != "" {
+			if err := a.SendMessage(c, &chatlib.Message{
+				Command:  "PRIVMSG",
+				Receiver: a.nickServ,
+				Text:     "GHOST " + a.primaryNick + " " + a.password,
+			}); err != nil {
+				log.Error().Str("api", ApiName).Err(err).Msg("error sending ghost to nickserv")
+			}
+		}
+		if err := a.tryPrimaryNick(c); err != nil {
+			log.Error().Str("api", ApiName).Err(err).Msg("error regaining nick")
+		}
+	}
+}
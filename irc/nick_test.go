@@ -0,0 +1,53 @@
+package irc
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAltNicks(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"), WithAltNicks([]string{"bot2"}), WithRegainNick(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	receive := func(line string) {
+		t.Helper()
+		a.rawMsgs <- []byte(line)
+		if _, err := a.ReceiveMessage(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		line     string
+		expected string
+	}{
+		{":irc.example.net 433 * bot :Nickname is already in use\r\n", "NICK bot2\n"},
+		{":irc.example.net 433 * bot2 :Nickname is already in use\r\n", "NICK bot_\n"},
+		{":irc.example.net 432 * bot_ :Erroneous nickname\r\n", "NICK bot__\n"},
+		{":irc.example.net 433 * bot__ :Nickname is already in use\r\n", "NICK bot___\n"},
+		// Out of nicks
+		{":irc.example.net 433 * bot___ :Nickname is already in use\r\n", ""},
+		{":irc.example.net 001 bot__ :Welcome\r\n", ""},
+		// The holder of the primary nick leaves
+		{":bot!u@h QUIT :bye\r\n", "NICK bot\n"},
+		// Someone else got it first, which is ignored once registered
+		{":irc.example.net 433 bot__ bot :Nickname is already in use\r\n", ""},
+		{":bot!u@h NICK :other\r\n", "NICK bot\n"},
+		{":bot__!u@h NICK :bot\r\n", ""},
+		{":someone!u@h QUIT :bye\r\n", ""},
+	} {
+		receive(tc.line)
+		if line := conn.next(); line != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.line, tc.expected, line)
+		}
+	}
+	if a.Nick() != "bot" || a.PrimaryNick() != "bot" {
+		t.Errorf("expected to have the primary nick back, got %s", a.Nick())
+	}
+	if got := redact("PRIVMSG NickServ :GHOST bot hunter2"); got != "PRIVMSG NickServ :GHOST bot <redacted>" {
+		t.Errorf("password not redacted: %s", got)
+	}
+}
@@ -0,0 +1,127 @@
+package irc
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultNickServ               = "NickServ"
+	DefaultNickServTimeoutSeconds = 10
+)
+
+// RPL_LOGGEDIN is sent by servers that tell clients about account changes.
+const rplLoggedIn = "900"
+
+// Notices NickServ implementations send in reply to IDENTIFY. They differ
+// between services packages so only the common substrings are matched.
+var (
+	nickServSuccess = []string{
+		"you are now identified",
+		"password accepted",
+		"you are already identified",
+		"you are already logged in",
+	}
+	nickServFailure = []string{
+		"invalid password",
+		"password incorrect",
+		"is not a registered nickname",
+		"isn't registered",
+		"is not registered",
+	}
+)
+
+// WithNickServ sets the name of the NickServ service, for networks that call
+// it something else.
+func WithNickServ(name string) Option {
+	return func(a *API) error {
+		a.nickServ = name
+		return nil
+	}
+}
+
+// WithNickServTimeout sets how long to wait for NickServ to confirm the
+// IDENTIFY before joining channels anyway.
+func WithNickServTimeout(seconds float64) Option {
+	return func(a *API) error {
+		a.nickServTimeoutSeconds = seconds
+		return nil
+	}
+}
+
+// identify sends IDENTIFY to NickServ and waits for it to be accepted.
+func (a *API) identify(c context.Context) error {
+	if a.password == "" {
+		return errors.WithMessage(chatlib.ErrInvalidConfig, "irc: nickserv auth requires a password")
+	}
+	text := "IDENTIFY " + a.password
+	if a.account != "" {
+		text = "IDENTIFY " + a.account + " " + a.password
+	} else if !strings.EqualFold(a.nick, a.primaryNick) {
+		// Using an alternate nick, identify to the primary one's account
+		text = "IDENTIFY " + a.primaryNick + " " + a.password
+	}
+	// Drop any result left over from an earlier attempt
+	select {
+	case <-a.authResult:
+	default:
+	}
+	if err := a.SendMessage(c, &chatlib.Message{
+		Command:  "PRIVMSG",
+		Receiver: a.nickServ,
+		Text:     text,
+	}); err != nil {
+		return err
+	}
+	select {
+	case <-c.Done():
+		return c.Err()
+	case err := <-a.authResult:
+		if err == nil {
+			log.Info().Str("api", ApiName).Msg("identified with nickserv")
+		}
+		return err
+	case <-time.After(time.Duration(float64(time.Second) * a.nickServTimeoutSeconds)):
+		return errors.WithMessage(chatlib.ErrTimeout, "irc: timed out waiting for nickserv")
+	}
+}
+
+// handleNickServ passes the outcome of an IDENTIFY to identify when msg is a
+// reply from NickServ.
+func (a *API) handleNickServ(msg *chatlib.Message) {
+	if a.authMethod != AuthMethodNickServ {
+		return
+	}
+	var result error
+	switch {
+	case msg.Command == rplLoggedIn:
+		result = nil
+	case msg.Command == "NOTICE" && strings.EqualFold(msg.Nick, a.nickServ):
+		text := strings.ToLower(msg.Text)
+		if containsAny(text, nickServFailure) {
+			result = errors.Errorf("irc: nickserv refused identify: %s", msg.Text)
+		} else if !containsAny(text, nickServSuccess) {
+			return
+		}
+	default:
+		return
+	}
+	select {
+	case a.authResult <- result:
+	default:
+	}
+}
+
+func containsAny(s string, substrs []string) bool {
+	for _, sub := range substrs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
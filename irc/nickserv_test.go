@@ -0,0 +1,43 @@
+package irc
+
+import (
+	"testing"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestHandleNickServ(t *testing.T) {
+	a, err := New(WithAuthMethod(AuthMethodNickServ))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		msg     *chatlib.Message
+		result  bool
+		success bool
+	}{
+		{&chatlib.Message{Command: "NOTICE", Nick: "NickServ", Text: "This nickname is registered."}, false, false},
+		{&chatlib.Message{Command: "NOTICE", Nick: "someone", Text: "Password accepted"}, false, false},
+		{&chatlib.Message{Command: "NOTICE", Nick: "NickServ", Text: "Password accepted - you are now recognized."}, true, true},
+		{&chatlib.Message{Command: "NOTICE", Nick: "nickserv", Text: "Invalid password for freyabot."}, true, false},
+		{&chatlib.Message{Command: "900", Text: "You are now logged in as freyabot"}, true, true},
+	} {
+		a.handleNickServ(tc.msg)
+		select {
+		case err := <-a.authResult:
+			if !tc.result {
+				t.Fatalf("unexpected result %v for %q", err, tc.msg.Text)
+			}
+			if (err == nil) != tc.success {
+				t.Fatalf("expected success %t for %q, got %v", tc.success, tc.msg.Text, err)
+			}
+		default:
+			if tc.result {
+				t.Fatalf("expected a result for %q", tc.msg.Text)
+			}
+		}
+	}
+	if got := redact("PRIVMSG NickServ :IDENTIFY freyabot hunter2"); got != "PRIVMSG NickServ :IDENTIFY <redacted>" {
+		t.Fatalf("password not redacted: %s", got)
+	}
+}
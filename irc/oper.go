@@ -0,0 +1,73 @@
+package irc
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gregseb/chatlib"
+	"github.com/rs/zerolog/log"
+)
+
+// Replies to OPER.
+const (
+	rplYoureOper      = "381"
+	errNeedMoreParams = "461"
+	errPasswdMismatch = "464"
+	errNoOperHost     = "491"
+)
+
+// WithOper logs in as an IRC operator with name and password once registered,
+// for bots that do network operator tasks.
+func WithOper(name, password string) Option {
+	return func(a *API) error {
+		a.operName = name
+		a.operPassword = password
+		return nil
+	}
+}
+
+// IsOper reports whether the bot is an IRC operator.
+func (a *API) IsOper() bool {
+	return a.oper.Load()
+}
+
+// handleOper sends OPER once registered and follows whether it worked.
+func (a *API) handleOper(c context.Context, msg *chatlib.Message) error {
+	if a.operName == "" {
+		return nil
+	}
+	switch msg.Command {
+	case rplWelcome:
+		return a.SendMessage(c, &chatlib.Message{Command: "OPER " + a.operName + " " + a.operPassword})
+	case rplYoureOper:
+		a.oper.Store(true)
+		log.Info().Str("api", ApiName).Msgf("logged in as IRC operator %s", a.operName)
+	case errPasswdMismatch, errNoOperHost:
+		a.operFailed(c, msg)
+	case errNeedMoreParams:
+		if len(msg.Params) > 1 && strings.EqualFold(msg.Params[1], "OPER") {
+			a.operFailed(c, msg)
+		}
+	case "MODE":
+		// Losing the operator mode, e.g. by a -o from services
+		if len(msg.Params) > 1 && strings.EqualFold(msg.Receiver, a.nick) && strings.Contains(msg.Params[1], "-o") {
+			a.oper.Store(false)
+			log.Warn().Str("api", ApiName).Msg("no longer an IRC operator")
+		}
+	}
+	return nil
+}
+
+// operFailed tells the admins why OPER was refused.
+func (a *API) operFailed(c context.Context, msg *chatlib.Message) {
+	a.oper.Store(false)
+	reason := msg.Command
+	if len(msg.Params) > 0 {
+		reason = msg.Params[len(msg.Params)-1]
+	}
+	text := "failed to become an IRC operator: " + reason
+	log.Error().Str("api", ApiName).Msg(text)
+	if a.notifyAdmins != nil {
+		a.notifyAdmins(c, text)
+	}
+}
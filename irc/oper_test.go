@@ -0,0 +1,48 @@
+package irc
+
+import (
+	"context"
+	"testing"
+)
+
+func TestOper(t *testing.T) {
+	c := context.Background()
+	var notified []string
+	a, err := New(
+		WithNick("bot"),
+		WithOper("bot", "secret"),
+		WithAdminNotifier(func(c context.Context, text string) { notified = append(notified, text) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	for _, tc := range []struct {
+		line     string
+		expected string
+		oper     bool
+	}{
+		{":irc.example.net 001 bot :Welcome\r\n", "OPER bot secret\n", false},
+		{":irc.example.net 381 bot :You are now an IRC operator\r\n", "", true},
+		{":bot MODE bot :-o\r\n", "", false},
+		{":irc.example.net 491 bot :No O-lines for your host\r\n", "", false},
+	} {
+		a.rawMsgs <- []byte(tc.line)
+		if _, err := a.ReceiveMessage(c); err != nil {
+			t.Fatal(err)
+		}
+		if line := conn.next(); line != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.line, tc.expected, line)
+		}
+		if a.IsOper() != tc.oper {
+			t.Errorf("%q: expected oper %v", tc.line, tc.oper)
+		}
+	}
+	if len(notified) != 1 || notified[0] != "failed to become an IRC operator: No O-lines for your host" {
+		t.Errorf("expected the admins to be told, got %v", notified)
+	}
+	if got := redact("OPER bot secret"); got != "OPER bot <redacted>" {
+		t.Errorf("expected the password to be redacted, got %q", got)
+	}
+}
@@ -0,0 +1,77 @@
+package irc
+
+import (
+	"strings"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+)
+
+// maxMiddleParams is how many parameters may come before the trailing one.
+// RFC 1459 treats the rest of a line with 14 parameters as the 15th, even
+// without a colon.
+const maxMiddleParams = 14
+
+// ErrInvalidLine is returned for lines from the server that aren't IRC
+// messages.
+const ErrInvalidLine chatlib.Error = "invalidLine"
+
+// line is a message from the server split into its parts as RFC 1459 and
+// 2812 describe, with IRCv3 tags.
+type line struct {
+	tags    map[string]string
+	prefix  string
+	command string
+	params  []string
+	// rest is everything after the first parameter as it was sent, with the
+	// colon of a trailing parameter removed, which is what Message.Text has
+	// always held.
+	rest string
+}
+
+// parseLine splits a line from the server, with or without its line ending,
+// into its parts.
+func parseLine(raw string) (*line, error) {
+	s := strings.TrimRight(raw, "\r\n")
+	l := &line{}
+	if strings.HasPrefix(s, "@") {
+		var tags string
+		tags, s, _ = strings.Cut(s[1:], " ")
+		l.tags = parseTags(tags)
+	}
+	s = strings.TrimLeft(s, " ")
+	if strings.HasPrefix(s, ":") {
+		l.prefix, s, _ = strings.Cut(s[1:], " ")
+	}
+	s = strings.TrimLeft(s, " ")
+	l.command, s, _ = strings.Cut(s, " ")
+	if l.command == "" {
+		return nil, errors.Wrapf(ErrInvalidLine, "irc: line has no command: %q", raw)
+	}
+	l.command = strings.ToUpper(l.command)
+	for {
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			break
+		}
+		if len(l.params) == 1 {
+			l.rest = strings.TrimPrefix(s, ":")
+		}
+		if s[0] == ':' || len(l.params) == maxMiddleParams {
+			l.params = append(l.params, strings.TrimPrefix(s, ":"))
+			break
+		}
+		var param string
+		param, s, _ = strings.Cut(s, " ")
+		l.params = append(l.params, param)
+	}
+	return l, nil
+}
+
+// param returns the i'th parameter, or an empty string if there are fewer.
+func (l *line) param(i int) string {
+	if i < len(l.params) {
+		return l.params[i]
+	}
+	return ""
+}
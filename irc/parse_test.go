@@ -0,0 +1,66 @@
+package irc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	for _, tc := range []struct {
+		raw      string
+		prefix   string
+		command  string
+		params   []string
+		rest     string
+		tagCount int
+	}{
+		{":nick!u@h PRIVMSG #chan :hello world\r\n", "nick!u@h", "PRIVMSG", []string{"#chan", "hello world"}, "hello world", 0},
+		// Numeric without a trailing parameter
+		{":irc.example.net 376 bot\r\n", "irc.example.net", "376", []string{"bot"}, "", 0},
+		{":irc.example.net 001\r\n", "irc.example.net", "001", nil, "", 0},
+		// Several middle parameters
+		{":irc.example.net 353 bot = #chan :@bot +foo\r\n", "irc.example.net", "353", []string{"bot", "=", "#chan", "@bot +foo"}, "= #chan :@bot +foo", 0},
+		{":op!u@h MODE #chan +ov foo bar\r\n", "op!u@h", "MODE", []string{"#chan", "+ov", "foo", "bar"}, "+ov foo bar", 0},
+		// Prefixless lines
+		{"PING :irc.example.net\r\n", "", "PING", []string{"irc.example.net"}, "", 0},
+		{"AUTHENTICATE +\n", "", "AUTHENTICATE", []string{"+"}, "", 0},
+		{"ERROR :Closing Link: bot (Quit)", "", "ERROR", []string{"Closing Link: bot (Quit)"}, "", 0},
+		// Extra spaces, a lower case command and an empty trailing parameter
+		{"@time=2023-11-05T12:00:00.000Z;msgid=x :n!u@h  privmsg  #chan  :\r\n", "n!u@h", "PRIVMSG", []string{"#chan", ""}, "", 2},
+		// Colons inside the trailing parameter
+		{":n!u@h PRIVMSG #chan ::) see http://example.com\r\n", "n!u@h", "PRIVMSG", []string{"#chan", ":) see http://example.com"}, ":) see http://example.com", 0},
+		// 14 middle parameters leave the rest as the trailing one
+		{"CMD 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16", "", "CMD", []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12", "13", "14", "15 16"}, "2 3 4 5 6 7 8 9 10 11 12 13 14 15 16", 0},
+	} {
+		l, err := parseLine(tc.raw)
+		if err != nil {
+			t.Errorf("%q: %v", tc.raw, err)
+			continue
+		}
+		if l.prefix != tc.prefix || l.command != tc.command || !reflect.DeepEqual(l.params, tc.params) || l.rest != tc.rest || len(l.tags) != tc.tagCount {
+			t.Errorf("%q: unexpected parse %+v", tc.raw, l)
+		}
+	}
+	for _, raw := range []string{"", "\r\n", ":irc.example.net\r\n", "@tag=1\r\n"} {
+		if _, err := parseLine(raw); !errors.Is(err, ErrInvalidLine) {
+			t.Errorf("%q: expected ErrInvalidLine, got %v", raw, err)
+		}
+	}
+}
+
+func TestReceiveParams(t *testing.T) {
+	a, err := New(WithNick("bot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.rawMsgs <- []byte(":irc.example.net 324 bot #chan +kl key 10\r\n")
+	msg, err := a.ReceiveMessage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Receiver != "bot" || msg.Text != "#chan +kl key 10" || !reflect.DeepEqual(msg.Params, []string{"bot", "#chan", "+kl", "key", "10"}) {
+		t.Errorf("unexpected message %+v", msg)
+	}
+}
@@ -0,0 +1,850 @@
+package irc
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// PGP policies, deciding how private messages with a nick are protected.
+const (
+	// PGPOff never encrypts private messages.
+	PGPOff = "off"
+	// PGPOpportunistic decrypts the encrypted messages nicks send, and
+	// encrypts to the nicks whose public key the bot has.
+	PGPOpportunistic = "opportunistic"
+	// PGPRequired refuses plaintext: private messages are only exchanged
+	// encrypted, signed with and to a trusted key.
+	PGPRequired = "required"
+)
+
+const (
+	// pgpQueryInterval is the least time between two requests to a nick to
+	// talk over OpenPGP.
+	pgpQueryInterval = time.Minute
+	// maxPGPPending is how many messages to a nick wait for a trusted key
+	// before the oldest are dropped.
+	maxPGPPending = 32
+	// maxPGPBlockLines is how many lines an armored block sent by a nick may
+	// have before it is dropped.
+	maxPGPBlockLines = 200
+	// maxPGPMessageBytes is the longest decrypted message read.
+	maxPGPMessageBytes = 16 << 10
+	// pgpMessageType is the armor type of an OpenPGP message.
+	pgpMessageType = "PGP MESSAGE"
+	pgpBegin       = "-----BEGIN "
+	pgpEnd         = "-----END "
+)
+
+// pgpConfig generates Ed25519 keys, whose armor is short enough to be sent
+// over IRC in a few lines.
+var pgpConfig = &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}
+
+// PGPSession describes how a private message received encrypted with
+// OpenPGP was signed.
+type PGPSession struct {
+	// Fingerprint is the hex fingerprint of the key the message was signed
+	// with, empty if it wasn't signed by the nick's key.
+	Fingerprint string
+	// Trusted is set when the fingerprint is one trusted for the nick.
+	Trusted bool
+}
+
+// AnnotationPGP is set on the private messages received encrypted with
+// OpenPGP.
+var AnnotationPGP = chatlib.NewAnnotationKey[PGPSession]("irc.pgp")
+
+// pgpStored is what is kept in the Store: the generated key, encrypted with
+// the passphrase, the public keys nicks sent and the fingerprints trusted
+// with !pgp trust, by lowercased nick.
+type pgpStored struct {
+	Key     string              `json:"key,omitempty"`
+	Keys    map[string]string   `json:"keys,omitempty"`
+	Trusted map[string][]string `json:"trusted,omitempty"`
+}
+
+// pgpPeer is what is being exchanged with a nick.
+type pgpPeer struct {
+	// block are the lines of the armored block being received.
+	block []string
+	// pending are the messages waiting for a trusted key, under the required
+	// policy.
+	pending []*chatlib.Message
+	queried time.Time
+}
+
+// pgpState is the OpenPGP keys and peers of the API.
+type pgpState struct {
+	policy      string
+	adminPolicy string
+	peers       map[string]string
+	keyFile     string
+	passphrase  string
+	// fingerprints are those trusted by configuration, by lowercased nick.
+	fingerprints map[string][]string
+
+	mu     sync.Mutex
+	loaded bool
+	key    *openpgp.Entity
+	stored pgpStored
+	keys   map[string]*openpgp.Entity
+	convs  map[string]*pgpPeer
+}
+
+// WithPGP encrypts private messages with OpenPGP, so what the bot and its
+// users say privately, admin commands and their answers included, isn't
+// readable by the network's operators. Messages are sent as armored blocks,
+// one line of armor per IRC message. policy applies to nicks given no
+// other: off, opportunistic or required. The key is generated on first use
+// and kept in the Store encrypted with the passphrase of WithPGPPassphrase,
+// unless given to WithPGPKey.
+func WithPGP(policy string) Option {
+	return func(a *API) error {
+		if !validPGPPolicy(policy) {
+			return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: invalid pgp policy %q", policy)
+		}
+		a.pgp.policy = policy
+		return nil
+	}
+}
+
+// WithPGPAdminPolicy sets the PGP policy of the admins, e.g. required so
+// admin commands are only taken encrypted. The default policy applies if
+// empty.
+func WithPGPAdminPolicy(policy string) Option {
+	return func(a *API) error {
+		if policy != "" && !validPGPPolicy(policy) {
+			return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: invalid pgp admin policy %q", policy)
+		}
+		a.pgp.adminPolicy = policy
+		return nil
+	}
+}
+
+// WithPGPPeers sets the PGP policy of nicks, given as nick=policy, over the
+// default and admin policies.
+func WithPGPPeers(peers []string) Option {
+	return func(a *API) error {
+		for _, p := range peers {
+			nick, policy, ok := strings.Cut(p, "=")
+			if !ok || nick == "" || !validPGPPolicy(policy) {
+				return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: invalid pgp peer %q, expected nick=policy", p)
+			}
+			if a.pgp.peers == nil {
+				a.pgp.peers = make(map[string]string)
+			}
+			a.pgp.peers[strings.ToLower(nick)] = policy
+		}
+		return nil
+	}
+}
+
+// WithPGPKey uses the armored OpenPGP private key in file rather than
+// generating one. If the key is protected, it is unlocked with the
+// passphrase of WithPGPPassphrase.
+func WithPGPKey(file string) Option {
+	return func(a *API) error {
+		a.pgp.keyFile = file
+		return nil
+	}
+}
+
+// WithPGPPassphrase sets the passphrase the key is encrypted with. It is
+// needed to keep a generated key in the Store.
+func WithPGPPassphrase(passphrase string) Option {
+	return func(a *API) error {
+		a.pgp.passphrase = passphrase
+		return nil
+	}
+}
+
+// WithPGPFingerprints trusts the key fingerprints of nicks, given as
+// nick=fingerprint. The required policy only accepts messages signed with a
+// trusted key. More can be trusted with !pgp trust.
+func WithPGPFingerprints(fingerprints []string) Option {
+	return func(a *API) error {
+		for _, f := range fingerprints {
+			nick, fp, ok := strings.Cut(f, "=")
+			if fp = normalizeFingerprint(fp); !ok || nick == "" || fp == "" {
+				return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: invalid pgp fingerprint %q, expected nick=fingerprint", f)
+			}
+			if a.pgp.fingerprints == nil {
+				a.pgp.fingerprints = make(map[string][]string)
+			}
+			nick = strings.ToLower(nick)
+			a.pgp.fingerprints[nick] = append(a.pgp.fingerprints[nick], fp)
+		}
+		return nil
+	}
+}
+
+func validPGPPolicy(policy string) bool {
+	return policy == PGPOff || policy == PGPOpportunistic || policy == PGPRequired
+}
+
+// normalizeFingerprint returns fingerprint as lowercase hex without
+// separators, as gpg shows it in groups of 4, or empty if it isn't a
+// 20 byte fingerprint.
+func normalizeFingerprint(fingerprint string) string {
+	fp := strings.ToLower(strings.NewReplacer(" ", "", ":", "").Replace(fingerprint))
+	if b, err := hex.DecodeString(fp); err != nil || len(b) != 20 {
+		return ""
+	}
+	return fp
+}
+
+// formatFingerprint returns fingerprint in groups of 4, as gpg shows it.
+func formatFingerprint(fingerprint string) string {
+	groups := make([]string, 0, 10)
+	for len(fingerprint) > 4 {
+		groups = append(groups, fingerprint[:4])
+		fingerprint = fingerprint[4:]
+	}
+	return strings.Join(append(groups, fingerprint), " ")
+}
+
+func keyFingerprint(key *openpgp.Entity) string {
+	return hex.EncodeToString(key.PrimaryKey.Fingerprint)
+}
+
+// pgpEnabled reports whether any nick may talk to the bot encrypted.
+func (a *API) pgpEnabled() bool {
+	if (a.pgp.policy != "" && a.pgp.policy != PGPOff) || (a.pgp.adminPolicy != "" && a.pgp.adminPolicy != PGPOff) {
+		return true
+	}
+	for _, p := range a.pgp.peers {
+		if p != PGPOff {
+			return true
+		}
+	}
+	return false
+}
+
+// pgpPolicy returns the PGP policy of nick. Services are always talked to
+// in plaintext.
+func (a *API) pgpPolicy(nick string) string {
+	if a.isService(nick) {
+		return PGPOff
+	}
+	if p, ok := a.pgp.peers[strings.ToLower(nick)]; ok {
+		return p
+	}
+	if a.pgp.adminPolicy != "" && a.isAdmin != nil && a.isAdmin(nick) {
+		return a.pgp.adminPolicy
+	}
+	if a.pgp.policy == "" {
+		return PGPOff
+	}
+	return a.pgp.policy
+}
+
+func (a *API) pgpStoreKey() string {
+	return ApiName + "/" + a.primaryHost() + "/pgp"
+}
+
+// readPGPKey reads an armored private key, unlocking it with passphrase if
+// it is protected.
+func readPGPKey(r io.Reader, passphrase string) (*openpgp.Entity, error) {
+	keys, err := openpgp.ReadArmoredKeyRing(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 || keys[0].PrivateKey == nil {
+		return nil, errors.New("not a private key")
+	}
+	key := keys[0]
+	if key.PrivateKey.Encrypted {
+		if passphrase == "" {
+			return nil, errors.New("the key is protected and there is no passphrase")
+		}
+		if err := key.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+			return nil, errors.Wrap(err, "wrong passphrase")
+		}
+	}
+	return key, nil
+}
+
+// generatePGPKey generates a key for nick, returning it along with its
+// armor, encrypted with passphrase.
+func generatePGPKey(nick, passphrase string) (*openpgp.Entity, string, error) {
+	key, err := openpgp.NewEntity(nick, "", "", pgpConfig)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := key.EncryptPrivateKeys([]byte(passphrase), nil); err != nil {
+		return nil, "", err
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := key.SerializePrivateWithoutSigning(w, nil); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	if err := key.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+		return nil, "", err
+	}
+	return key, buf.String(), nil
+}
+
+// armorPublicKey returns the armored public key of key.
+func armorPublicKey(key *openpgp.Entity) (string, error) {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", err
+	}
+	if err := key.Serialize(w); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// readPublicKey reads the armored public key a nick sent, which must be
+// able to encrypt.
+func readPublicKey(armored string) (*openpgp.Entity, error) {
+	keys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no key")
+	}
+	if _, ok := keys[0].EncryptionKey(time.Now()); !ok {
+		return nil, errors.New("the key can't encrypt")
+	}
+	return keys[0], nil
+}
+
+// loadPGP loads the key, the public keys of nicks and the trusted
+// fingerprints, generating a key and saving it if there is none.
+// a.pgp.mu is held.
+func (a *API) loadPGP(c context.Context) error {
+	if a.pgp.loaded {
+		return nil
+	}
+	stored := pgpStored{}
+	if a.store != nil {
+		bts, err := a.store.Get(c, a.pgpStoreKey())
+		if err != nil && !errors.Is(err, chatlib.ErrNotFound) {
+			return err
+		} else if err == nil {
+			if err := json.Unmarshal(bts, &stored); err != nil {
+				return errors.Wrap(err, "irc: invalid pgp state in store")
+			}
+		}
+	}
+	var key *openpgp.Entity
+	var err error
+	switch {
+	case a.pgp.keyFile != "":
+		var f *os.File
+		if f, err = os.Open(a.pgp.keyFile); err != nil {
+			return errors.Wrapf(err, "irc: error reading pgp key %s", a.pgp.keyFile)
+		}
+		key, err = readPGPKey(f, a.pgp.passphrase)
+		f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "irc: invalid pgp key %s", a.pgp.keyFile)
+		}
+	case stored.Key != "":
+		if key, err = readPGPKey(strings.NewReader(stored.Key), a.pgp.passphrase); err != nil {
+			return errors.Wrap(err, "irc: invalid pgp key in store")
+		}
+	default:
+		log.Info().Str("api", ApiName).Msg("generating pgp key")
+		if key, stored.Key, err = generatePGPKey(a.nick, a.pgp.passphrase); err != nil {
+			return errors.Wrap(err, "irc: error generating pgp key")
+		}
+		a.pgp.stored = stored
+		if err := a.savePGP(c); err != nil {
+			return err
+		}
+	}
+	a.pgp.keys = make(map[string]*openpgp.Entity)
+	for nick, armored := range stored.Keys {
+		k, err := readPublicKey(armored)
+		if err != nil {
+			log.Warn().Str("api", ApiName).Str("nick", nick).Err(err).Msg("ignoring invalid pgp key in store")
+			continue
+		}
+		a.pgp.keys[nick] = k
+	}
+	a.pgp.key, a.pgp.stored, a.pgp.loaded = key, stored, true
+	log.Info().Str("api", ApiName).Msgf("pgp fingerprint: %s", formatFingerprint(keyFingerprint(key)))
+	return nil
+}
+
+// savePGP saves the key, unless it is read from a file, the public keys of
+// nicks and the trusted fingerprints. a.pgp.mu is held.
+func (a *API) savePGP(c context.Context) error {
+	if a.store == nil {
+		return nil
+	}
+	bts, err := json.Marshal(a.pgp.stored)
+	if err != nil {
+		return err
+	}
+	return errors.WithMessage(a.store.Set(c, a.pgpStoreKey(), bts), "irc: error saving pgp state")
+}
+
+// pgpPeerFor returns what is being exchanged with nick. a.pgp.mu is held.
+func (a *API) pgpPeerFor(c context.Context, nick string) (*pgpPeer, error) {
+	if err := a.loadPGP(c); err != nil {
+		return nil, err
+	}
+	if a.pgp.convs == nil {
+		a.pgp.convs = make(map[string]*pgpPeer)
+	}
+	key := a.folder()(nick)
+	p, ok := a.pgp.convs[key]
+	if !ok {
+		p = &pgpPeer{}
+		a.pgp.convs[key] = p
+	}
+	return p, nil
+}
+
+// pgpTrusts reports whether fingerprint is trusted for nick. a.pgp.mu is
+// held.
+func (a *API) pgpTrusts(nick, fingerprint string) bool {
+	nick = strings.ToLower(nick)
+	for _, fp := range append(a.pgp.fingerprints[nick], a.pgp.stored.Trusted[nick]...) {
+		if fp == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// pgpKeyFor returns the public key of nick, and whether it is trusted.
+// a.pgp.mu is held.
+func (a *API) pgpKeyFor(nick string) (*openpgp.Entity, bool) {
+	key := a.pgp.keys[strings.ToLower(nick)]
+	if key == nil {
+		return nil, false
+	}
+	return key, a.pgpTrusts(nick, keyFingerprint(key))
+}
+
+// sendPGPLines sends the lines of armor to nick as they are, bypassing the
+// encryption of SendMessage. IRC can't send empty lines, so the one ending
+// the armor headers is left out and put back by joinArmor.
+func (a *API) sendPGPLines(c context.Context, command, nick, armored string) error {
+	for _, l := range strings.Split(armored, "\n") {
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		if err := a.sendLine(c, command, command+" "+nick+" :"+l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// joinArmor puts the lines of an armored block received over IRC back
+// together, dropping its headers.
+func joinArmor(lines []string) string {
+	body := make([]string, 0, len(lines)+1)
+	body = append(body, lines[0], "")
+	for _, l := range lines[1:] {
+		// Base64 never has a colon
+		if !strings.Contains(l, ":") || strings.HasPrefix(l, pgpEnd) {
+			body = append(body, l)
+		}
+	}
+	return strings.Join(body, "\n") + "\n"
+}
+
+// armorType returns the type of the armored block starting with line.
+func armorType(line string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(line, pgpBegin), "-----")
+}
+
+// encryptPGP encrypts text to key, signed with signer, as armor.
+func encryptPGP(text string, key, signer *openpgp.Entity) (string, error) {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, pgpMessageType, nil)
+	if err != nil {
+		return "", err
+	}
+	pt, err := openpgp.Encrypt(w, []*openpgp.Entity{key}, signer, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(pt, text); err != nil {
+		return "", err
+	}
+	if err := pt.Close(); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// decryptPGP decrypts an armored message with the first key of keyring,
+// returning the fingerprint of the key it was signed with if that is one of
+// the others and the signature is good.
+func decryptPGP(armored string, keyring openpgp.EntityList) (string, string, error) {
+	block, err := armor.Decode(strings.NewReader(armored))
+	if err != nil {
+		return "", "", err
+	}
+	md, err := openpgp.ReadMessage(block.Body, keyring, nil, nil)
+	if err != nil {
+		return "", "", err
+	}
+	if !md.IsEncrypted {
+		return "", "", errors.New("the message isn't encrypted")
+	}
+	// The signature is only checked once the whole body is read
+	text, err := io.ReadAll(io.LimitReader(md.UnverifiedBody, maxPGPMessageBytes+1))
+	if err != nil {
+		return "", "", err
+	}
+	if len(text) > maxPGPMessageBytes {
+		return "", "", errors.New("the message is too long")
+	}
+	var fingerprint string
+	if md.IsSigned && md.SignedBy != nil && md.SignatureError == nil && md.SignedBy.Entity != keyring[0] {
+		fingerprint = keyFingerprint(md.SignedBy.Entity)
+	}
+	return strings.TrimRight(string(text), "\r\n"), fingerprint, nil
+}
+
+// handlePGP gathers the armored blocks sent privately to the bot, decrypting
+// messages and keeping the public keys of nicks, and refuses plaintext from
+// nicks whose policy requires PGP. It reports false when msg was consumed
+// with nothing left to deliver.
+func (a *API) handlePGP(c context.Context, msg *chatlib.Message) (bool, error) {
+	if !msg.Private || msg.Self || (msg.Command != "PRIVMSG" && msg.Command != "NOTICE") || !a.pgpEnabled() {
+		return true, nil
+	}
+	policy := a.pgpPolicy(msg.Nick)
+	if policy == PGPOff {
+		return true, nil
+	}
+	line := strings.TrimSpace(msg.Text)
+	a.pgp.mu.Lock()
+	p, err := a.pgpPeerFor(c, msg.Nick)
+	if err != nil {
+		a.pgp.mu.Unlock()
+		return false, err
+	}
+	if strings.HasPrefix(line, pgpBegin) {
+		p.block = nil
+	} else if p.block == nil {
+		a.pgp.mu.Unlock()
+		// Notices are never answered, so they can't leak anything back
+		if policy != PGPRequired || msg.Command == "NOTICE" {
+			return true, nil
+		}
+		log.Info().Str("api", ApiName).Str("nick", msg.Nick).Msg("dropped plaintext message, pgp required")
+		return false, a.queryPGP(c, msg.Nick, true)
+	}
+	p.block = append(p.block, line)
+	if len(p.block) > maxPGPBlockLines {
+		p.block = nil
+		a.pgp.mu.Unlock()
+		log.Warn().Str("api", ApiName).Str("nick", msg.Nick).Msg("dropped pgp block, too long")
+		return false, nil
+	}
+	if !strings.HasPrefix(line, pgpEnd) {
+		a.pgp.mu.Unlock()
+		return false, nil
+	}
+	block := p.block
+	p.block = nil
+	a.pgp.mu.Unlock()
+	switch armorType(block[0]) {
+	case openpgp.PublicKeyType:
+		return false, a.receivePGPKey(c, msg.Nick, policy, joinArmor(block))
+	case pgpMessageType:
+		return a.receivePGPMessage(c, msg, policy, joinArmor(block))
+	}
+	log.Info().Str("api", ApiName).Str("nick", msg.Nick).Msgf("ignored %s", armorType(block[0]))
+	return false, nil
+}
+
+// receivePGPKey keeps the public key nick sent, sending what waited for it
+// if it is trusted and otherwise telling the admins about it, under the
+// required policy.
+func (a *API) receivePGPKey(c context.Context, nick, policy, armored string) error {
+	key, err := readPublicKey(armored)
+	if err != nil {
+		log.Warn().Str("api", ApiName).Str("nick", nick).Err(err).Msg("invalid pgp key")
+		return a.sendPGPLines(c, "NOTICE", nick, "your public key could not be read")
+	}
+	fingerprint := keyFingerprint(key)
+	a.pgp.mu.Lock()
+	if a.pgp.stored.Keys == nil {
+		a.pgp.stored.Keys = make(map[string]string)
+	}
+	a.pgp.keys[strings.ToLower(nick)] = key
+	a.pgp.stored.Keys[strings.ToLower(nick)] = armored
+	err = a.savePGP(c)
+	trusted := a.pgpTrusts(nick, fingerprint)
+	a.pgp.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Info().Str("api", ApiName).Str("nick", nick).Str("fingerprint", fingerprint).Bool("trusted", trusted).Msg("received pgp key")
+	if trusted || policy != PGPRequired {
+		if err := a.sendPGPLines(c, "NOTICE", nick, "got your public key "+formatFingerprint(fingerprint)); err != nil {
+			return err
+		}
+		return a.sendPGPPending(c, nick)
+	}
+	if err := a.sendPGPLines(c, "NOTICE", nick, "your public key "+formatFingerprint(fingerprint)+" isn't trusted, ask an admin to trust it"); err != nil {
+		return err
+	}
+	if a.notifyAdmins != nil {
+		a.notifyAdmins(c, fmt.Sprintf("%s sent the untrusted pgp key %s; !pgp trust %s %s to trust it", nick, formatFingerprint(fingerprint), nick, fingerprint))
+	}
+	return nil
+}
+
+// receivePGPMessage decrypts a message sent to the bot. Under the required
+// policy it must be signed with a trusted key of the nick.
+func (a *API) receivePGPMessage(c context.Context, msg *chatlib.Message, policy, armored string) (bool, error) {
+	a.pgp.mu.Lock()
+	keyring := openpgp.EntityList{a.pgp.key}
+	if key, _ := a.pgpKeyFor(msg.Nick); key != nil {
+		keyring = append(keyring, key)
+	}
+	a.pgp.mu.Unlock()
+	text, fingerprint, err := decryptPGP(armored, keyring)
+	if err != nil {
+		log.Warn().Str("api", ApiName).Str("nick", msg.Nick).Err(err).Msg("error reading pgp message")
+		return false, a.sendPGPLines(c, "NOTICE", msg.Nick, "your message could not be read")
+	}
+	a.pgp.mu.Lock()
+	trusted := fingerprint != "" && a.pgpTrusts(msg.Nick, fingerprint)
+	a.pgp.mu.Unlock()
+	if policy == PGPRequired && !trusted {
+		log.Warn().Str("api", ApiName).Str("nick", msg.Nick).Str("fingerprint", fingerprint).Msg("dropped pgp message not signed with a trusted key")
+		return false, a.sendPGPLines(c, "NOTICE", msg.Nick, "your message isn't signed with a trusted key, send your public key and ask an admin to trust it")
+	}
+	if text == "" {
+		return false, nil
+	}
+	msg.Text = text
+	AnnotationPGP.Set(msg, PGPSession{Fingerprint: fingerprint, Trusted: trusted})
+	return true, nil
+}
+
+// queryPGP asks nick to talk over OpenPGP, sending the bot's public key, at
+// most once every pgpQueryInterval unless force is set.
+func (a *API) queryPGP(c context.Context, nick string, force bool) error {
+	a.pgp.mu.Lock()
+	p, err := a.pgpPeerFor(c, nick)
+	if err != nil {
+		a.pgp.mu.Unlock()
+		return err
+	}
+	now := time.Now()
+	if !force && now.Sub(p.queried) < pgpQueryInterval {
+		a.pgp.mu.Unlock()
+		return nil
+	}
+	p.queried = now
+	key := a.pgp.key
+	a.pgp.mu.Unlock()
+	armored, err := armorPublicKey(key)
+	if err != nil {
+		return err
+	}
+	if err := a.sendPGPLines(c, "NOTICE", nick, "This bot only talks privately over OpenPGP: send your public key, then messages signed with it and encrypted to this key"); err != nil {
+		return err
+	}
+	return a.sendPGPLines(c, "NOTICE", nick, armored)
+}
+
+// sendPGP encrypts a message or notice to a nick whose public key the bot
+// has. Under the required policy the key must be trusted, and messages to a
+// nick without one wait for it while the nick is asked for it. It reports
+// whether msg was taken care of.
+func (a *API) sendPGP(c context.Context, msg *chatlib.Message) (bool, error) {
+	if !a.pgpEnabled() || msg.Receiver == "" || a.isChannel(msg.Receiver) {
+		return false, nil
+	}
+	policy := a.pgpPolicy(msg.Receiver)
+	if policy == PGPOff {
+		return false, nil
+	}
+	text := msg.Text
+	command := msg.Command
+	if command == chatlib.CommandAction {
+		command, text = "PRIVMSG", encodeCTCP("ACTION", text)
+	}
+	a.pgp.mu.Lock()
+	p, err := a.pgpPeerFor(c, msg.Receiver)
+	if err != nil {
+		a.pgp.mu.Unlock()
+		return false, err
+	}
+	if key, trusted := a.pgpKeyFor(msg.Receiver); key != nil && (trusted || policy != PGPRequired) {
+		signer := a.pgp.key
+		a.pgp.mu.Unlock()
+		armored, err := encryptPGP(text, key, signer)
+		if err != nil {
+			return false, err
+		}
+		return true, a.sendPGPLines(c, command, msg.Receiver, armored)
+	}
+	if policy != PGPRequired {
+		a.pgp.mu.Unlock()
+		return false, nil
+	}
+	m := *msg
+	p.pending = append(p.pending, &m)
+	if len(p.pending) > maxPGPPending {
+		log.Warn().Str("api", ApiName).Str("nick", msg.Receiver).Msg("dropped message waiting for pgp")
+		p.pending = p.pending[len(p.pending)-maxPGPPending:]
+	}
+	a.pgp.mu.Unlock()
+	return true, a.queryPGP(c, msg.Receiver, false)
+}
+
+// sendPGPPending sends the messages that waited for the key of nick.
+func (a *API) sendPGPPending(c context.Context, nick string) error {
+	a.pgp.mu.Lock()
+	var pending []*chatlib.Message
+	if p, ok := a.pgp.convs[a.folder()(nick)]; ok {
+		pending, p.pending = p.pending, nil
+	}
+	a.pgp.mu.Unlock()
+	for _, m := range pending {
+		if err := a.SendMessage(c, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trustPGP trusts fingerprint for nick, sending what waited for it, or with
+// an empty fingerprint stops trusting the fingerprints trusted for nick with
+// !pgp trust, and saves them.
+func (a *API) trustPGP(c context.Context, nick, fingerprint string) error {
+	a.pgp.mu.Lock()
+	if err := a.loadPGP(c); err != nil {
+		a.pgp.mu.Unlock()
+		return err
+	}
+	if a.pgp.stored.Trusted == nil {
+		a.pgp.stored.Trusted = make(map[string][]string)
+	}
+	lower := strings.ToLower(nick)
+	if fingerprint == "" {
+		delete(a.pgp.stored.Trusted, lower)
+	} else if !a.pgpTrusts(lower, fingerprint) {
+		a.pgp.stored.Trusted[lower] = append(a.pgp.stored.Trusted[lower], fingerprint)
+	}
+	err := a.savePGP(c)
+	_, trusted := a.pgpKeyFor(nick)
+	a.pgp.mu.Unlock()
+	if err != nil || !trusted {
+		return err
+	}
+	return a.sendPGPPending(c, nick)
+}
+
+// pgpStatus describes the public keys of nicks and the messages waiting
+// for one, in order of nick.
+func (a *API) pgpStatus() string {
+	a.pgp.mu.Lock()
+	defer a.pgp.mu.Unlock()
+	status := make([]string, 0, len(a.pgp.keys))
+	for nick := range a.pgp.keys {
+		_, trusted := a.pgpKeyFor(nick)
+		trust := "untrusted"
+		if trusted {
+			trust = "trusted"
+		}
+		status = append(status, fmt.Sprintf("%s: key %s", nick, trust))
+	}
+	for nick, p := range a.pgp.convs {
+		if len(p.pending) > 0 {
+			status = append(status, fmt.Sprintf("%s: %d waiting", nick, len(p.pending)))
+		}
+	}
+	if len(status) == 0 {
+		return "no pgp keys"
+	}
+	sort.Strings(status)
+	return strings.Join(status, "; ")
+}
+
+func (a *API) actionPGP(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+	parts := re.FindStringSubmatch(msg.Text)
+	args := strings.Fields(parts[2])
+	var text string
+	switch {
+	case parts[1] == "fingerprint" || parts[1] == "key":
+		a.pgp.mu.Lock()
+		err := a.loadPGP(c)
+		key := a.pgp.key
+		a.pgp.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if parts[1] == "key" {
+			armored, err := armorPublicKey(key)
+			if err != nil {
+				return err
+			}
+			return a.sendPGPLines(c, "NOTICE", msg.ReplyTarget(), armored)
+		}
+		text = "my pgp fingerprint: " + formatFingerprint(keyFingerprint(key))
+	case parts[1] == "trust" && len(args) >= 2:
+		fp := normalizeFingerprint(strings.Join(args[1:], ""))
+		if fp == "" {
+			text = "invalid fingerprint, expected 40 hex digits"
+			break
+		}
+		if err := a.trustPGP(c, args[0], fp); err != nil {
+			return err
+		}
+		text = fmt.Sprintf("trusting %s for %s", formatFingerprint(fp), args[0])
+	case parts[1] == "distrust" && len(args) == 1:
+		if err := a.trustPGP(c, args[0], ""); err != nil {
+			return err
+		}
+		text = fmt.Sprintf("no longer trusting the fingerprints trusted for %s with !pgp trust", args[0])
+	case parts[1] == "start" && len(args) == 1:
+		if err := a.queryPGP(c, args[0], true); err != nil {
+			return err
+		}
+		text = "sent " + args[0] + " my public key"
+	case parts[1] == "status":
+		text = a.pgpStatus()
+	default:
+		text = "usage: !pgp fingerprint|key|status|trust nick fingerprint|distrust nick|start nick"
+	}
+	return a.SendMessage(c, &chatlib.Message{Command: "PRIVMSG", Receiver: msg.ReplyTarget(), Text: text})
+}
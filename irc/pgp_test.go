@@ -0,0 +1,171 @@
+package irc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/gregseb/chatlib"
+)
+
+func TestPGP(t *testing.T) {
+	c := context.Background()
+	store := chatlib.NewMemoryStore()
+	var notified []string
+	newAPI := func() *API {
+		t.Helper()
+		a, err := New(WithNick("bot"), WithPGP(PGPRequired), WithPGPPassphrase("hunter2"), WithAdminNotifier(func(c context.Context, text string) {
+			notified = append(notified, text)
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.UseStore(store)
+		return a
+	}
+	a := newAPI()
+	conn := &bufConn{}
+	a.conn = conn
+	alice, err := openpgp.NewEntity("alice", "", "", pgpConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := keyFingerprint(alice)
+
+	// send passes the lines of text from alice to the bot, returning what it
+	// delivered.
+	send := func(text string) (delivered []*chatlib.Message) {
+		t.Helper()
+		for _, l := range strings.Split(text, "\n") {
+			if l == "" {
+				continue
+			}
+			a.rawMsgs <- []byte(":alice!u@h PRIVMSG bot :" + l + "\r\n")
+			msg, err := a.ReceiveMessage(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg != nil {
+				delivered = append(delivered, msg)
+			}
+		}
+		return delivered
+	}
+	// read returns what the bot sent alice, a line at a time.
+	read := func() (lines []string) {
+		for line := conn.next(); line != ""; line = conn.next() {
+			_, text, _ := strings.Cut(strings.TrimSuffix(line, "\n"), " :")
+			lines = append(lines, text)
+		}
+		return lines
+	}
+
+	// Plaintext is refused and the bot's public key sent
+	if delivered := send("hi"); len(delivered) != 0 {
+		t.Fatalf("expected plaintext to be dropped, got %q", delivered[0].Text)
+	}
+	lines := read()
+	if len(lines) < 2 {
+		t.Fatalf("expected the bot's public key, got %q", lines)
+	}
+	botKey, err := readPublicKey(joinArmor(lines[1:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An untrusted key is kept and the admins are told
+	armored, err := armorPublicKey(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(armored)
+	if len(notified) != 1 || !strings.Contains(notified[0], fingerprint) {
+		t.Fatalf("expected the admins to be told about the key, got %v", notified)
+	}
+	read()
+
+	// What the bot says waits for the key to be trusted
+	if err := a.SendMessage(c, &chatlib.Message{Command: "PRIVMSG", Receiver: "alice", Text: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if lines := read(); len(lines) != 0 {
+		t.Fatalf("expected the message to wait for a trusted key, got %q", lines)
+	}
+
+	// Trusted, what waited is sent encrypted and signed
+	if err := a.trustPGP(c, "alice", fingerprint); err != nil {
+		t.Fatal(err)
+	}
+	text, signer, err := decryptPGP(joinArmor(read()), openpgp.EntityList{alice, botKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "secret" || signer != keyFingerprint(botKey) {
+		t.Fatalf("expected the waiting message signed by the bot, got %q signed by %q", text, signer)
+	}
+
+	// What alice signs is delivered
+	armored, err = encryptPGP("!status", botKey, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered := send(armored)
+	if len(delivered) != 1 || delivered[0].Text != "!status" {
+		t.Fatalf("expected the decrypted command, got %v", delivered)
+	}
+	if s, ok := AnnotationPGP.Get(delivered[0]); !ok || !s.Trusted || s.Fingerprint != fingerprint {
+		t.Errorf("expected a trusted pgp session, got %+v", s)
+	}
+
+	// What isn't signed is refused
+	armored, err = encryptPGP("!status", botKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered := send(armored); len(delivered) != 0 {
+		t.Fatalf("expected an unsigned message to be dropped, got %q", delivered[0].Text)
+	}
+	read()
+
+	// Services are talked to in plaintext
+	if err := a.SendMessage(c, &chatlib.Message{Command: "PRIVMSG", Receiver: "NickServ", Text: "INFO"}); err != nil {
+		t.Fatal(err)
+	}
+	if line := conn.next(); line != "PRIVMSG NickServ :INFO\n" {
+		t.Errorf("expected a plaintext message to NickServ, got %q", line)
+	}
+
+	// The key is kept encrypted, along with alice's
+	bts, err := store.Get(c, a.pgpStoreKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := pgpStored{}
+	if err := json.Unmarshal(bts, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPGPKey(strings.NewReader(stored.Key), ""); err == nil {
+		t.Error("expected the stored key to need the passphrase")
+	}
+	b := newAPI()
+	b.pgp.mu.Lock()
+	err = b.loadPGP(c)
+	b.pgp.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyFingerprint(b.pgp.key) != keyFingerprint(botKey) {
+		t.Error("expected the key to be loaded from the store")
+	}
+	if _, trusted := b.pgpKeyFor("Alice"); !trusted {
+		t.Error("expected alice's key to be loaded trusted")
+	}
+
+	// Without a passphrase there is nowhere safe to keep the key
+	if _, err := New(WithPGP(PGPRequired)); !errors.Is(err, chatlib.ErrInvalidConfig) {
+		t.Errorf("expected invalid config without a passphrase, got %v", err)
+	}
+}
@@ -0,0 +1,320 @@
+package irc
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const DefaultIsonIntervalSeconds = 60
+
+// CommandPresence is given to the MONITOR and ISON replies that tell a
+// watched nick came online or went offline, so actions can be registered for
+// them. AnnotationPresence holds what changed.
+const CommandPresence = "PRESENCE"
+
+// Replies to MONITOR and ISON, and the end of registration, when the watch
+// list is sent.
+const (
+	rplIson        = "303"
+	rplEndOfMotd   = "376"
+	errNoMotd      = "422"
+	rplMonOnline   = "730"
+	rplMonOffline  = "731"
+	errMonListFull = "734"
+)
+
+// watchLineBytes bounds the nicks sent in one MONITOR or ISON so the line
+// fits.
+const watchLineBytes = 400
+
+// AnnotationPresence holds the changes a PRESENCE message tells of.
+var AnnotationPresence = chatlib.NewAnnotationKey[[]PresenceChange]("irc.presence")
+
+// PresenceChange is a watched nick coming online or going offline.
+type PresenceChange struct {
+	Nick   string
+	Online bool
+	// User and Host are those of a nick coming online, on servers with
+	// MONITOR.
+	User string
+	Host string
+}
+
+type watchedNick struct {
+	nick   string
+	online bool
+	// known is set once the server has said whether the nick is online.
+	known bool
+}
+
+// WithWatch adds nicks to the watch list. See Watch.
+func WithWatch(nicks ...string) Option {
+	return func(a *API) error {
+		for _, nick := range nicks {
+			if err := a.Watch(context.Background(), nick); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// WithIsonInterval sets how often the online state of watched nicks is asked
+// for on servers without MONITOR. 0 disables it.
+func WithIsonInterval(seconds float64) Option {
+	return func(a *API) error {
+		a.isonIntervalSeconds = seconds
+		return nil
+	}
+}
+
+// Watch adds nick to the watch list. Whenever a watched nick comes online or
+// goes offline, the server's reply is received as a PRESENCE message. The
+// server tells at once with MONITOR, otherwise it is asked with ISON every
+// ISON interval. A nick that is online when first asked about counts as
+// coming online.
+func (a *API) Watch(c context.Context, nick string) error {
+	if nick == "" || strings.ContainsAny(nick, " ,") {
+		return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: invalid nick to watch: %q", nick)
+	}
+	a.watchMu.Lock()
+	if a.findWatched(nick) != nil {
+		a.watchMu.Unlock()
+		return nil
+	}
+	a.watched = append(a.watched, &watchedNick{nick: nick})
+	monitoring := a.monitoring
+	a.watchMu.Unlock()
+	if !monitoring {
+		return nil
+	}
+	return a.SendMessage(c, &chatlib.Message{Command: "MONITOR + " + nick})
+}
+
+// Unwatch removes nick from the watch list.
+func (a *API) Unwatch(c context.Context, nick string) error {
+	a.watchMu.Lock()
+	fold := a.folder()
+	found := false
+	for i, w := range a.watched {
+		if fold(w.nick) == fold(nick) {
+			a.watched = append(a.watched[:i], a.watched[i+1:]...)
+			found = true
+			break
+		}
+	}
+	monitoring := a.monitoring
+	a.watchMu.Unlock()
+	if !found || !monitoring {
+		return nil
+	}
+	return a.SendMessage(c, &chatlib.Message{Command: "MONITOR - " + nick})
+}
+
+// Watching returns the watched nicks, sorted.
+func (a *API) Watching() []string {
+	a.watchMu.Lock()
+	defer a.watchMu.Unlock()
+	nicks := make([]string, 0, len(a.watched))
+	for _, w := range a.watched {
+		nicks = append(nicks, w.nick)
+	}
+	sort.Strings(nicks)
+	return nicks
+}
+
+// Online reports whether a watched nick is online, and whether that is known
+// at all.
+func (a *API) Online(nick string) (online, known bool) {
+	a.watchMu.Lock()
+	defer a.watchMu.Unlock()
+	if w := a.findWatched(nick); w != nil {
+		return w.online, w.known
+	}
+	return false, false
+}
+
+// findWatched returns the watched nick, or nil. watchMu must be held.
+func (a *API) findWatched(nick string) *watchedNick {
+	fold := a.folder()
+	for _, w := range a.watched {
+		if fold(w.nick) == fold(nick) {
+			return w
+		}
+	}
+	return nil
+}
+
+// handlePresence sends the watch list once registered, and turns replies
+// telling of watched nicks coming online or going offline into PRESENCE
+// messages.
+func (a *API) handlePresence(c context.Context, msg *chatlib.Message) {
+	switch msg.Command {
+	case rplEndOfMotd, errNoMotd:
+		a.startWatching(c)
+	case rplMonOnline, rplMonOffline:
+		// <bot> :<nick!user@host or nick>[,...]
+		if len(msg.Params) < 2 {
+			return
+		}
+		changes := make([]PresenceChange, 0)
+		for _, target := range strings.Split(msg.Params[len(msg.Params)-1], ",") {
+			p := PresenceChange{Nick: target, Online: msg.Command == rplMonOnline}
+			if nick := nickFromPrefix(target); nick != "" {
+				p.Nick = nick
+				p.User, p.Host = userHostFromPrefix(target)
+			}
+			changes = a.setPresence(changes, p)
+		}
+		a.emitPresence(msg, changes)
+	case errMonListFull:
+		// <bot> <limit> <nicks> :Monitor list is full
+		if len(msg.Params) > 2 {
+			log.Warn().Str("api", ApiName).Msgf("MONITOR list is full at %s nicks, not watching %s", msg.Params[1], msg.Params[2])
+		}
+	case rplIson:
+		// <bot> :<the nicks asked about that are online>
+		a.watchMu.Lock()
+		if len(a.isonQueue) == 0 {
+			a.watchMu.Unlock()
+			return
+		}
+		asked := a.isonQueue[0]
+		a.isonQueue = a.isonQueue[1:]
+		a.watchMu.Unlock()
+		fold := a.folder()
+		online := make(map[string]string)
+		if len(msg.Params) > 1 {
+			for _, nick := range strings.Fields(msg.Params[len(msg.Params)-1]) {
+				online[fold(nick)] = nick
+			}
+		}
+		changes := make([]PresenceChange, 0)
+		for _, nick := range asked {
+			p := PresenceChange{Nick: nick}
+			if n, ok := online[fold(nick)]; ok {
+				p.Nick, p.Online = n, true
+			}
+			changes = a.setPresence(changes, p)
+		}
+		a.emitPresence(msg, changes)
+	}
+}
+
+// setPresence records the online state of a watched nick, appending it to
+// changes if it changed.
+func (a *API) setPresence(changes []PresenceChange, p PresenceChange) []PresenceChange {
+	a.watchMu.Lock()
+	defer a.watchMu.Unlock()
+	w := a.findWatched(p.Nick)
+	if w == nil {
+		return changes
+	}
+	changed := w.online != p.Online || !w.known && p.Online
+	w.online, w.known = p.Online, true
+	if changed {
+		changes = append(changes, p)
+	}
+	return changes
+}
+
+func (a *API) emitPresence(msg *chatlib.Message, changes []PresenceChange) {
+	if len(changes) == 0 {
+		return
+	}
+	for _, p := range changes {
+		state := "offline"
+		if p.Online {
+			state = "online"
+		}
+		log.Info().Str("api", ApiName).Str("nick", p.Nick).Msgf("%s is %s", p.Nick, state)
+	}
+	msg.Command = CommandPresence
+	AnnotationPresence.Set(msg, changes)
+}
+
+// startWatching sends the watch list with MONITOR if the server has it, or
+// starts asking for it with ISON.
+func (a *API) startWatching(c context.Context) {
+	_, monitor := a.isupport("MONITOR")
+	a.watchMu.Lock()
+	a.monitoring, a.isonQueue = monitor, nil
+	a.watchMu.Unlock()
+	if !monitor {
+		go a.pollIson(c)
+		return
+	}
+	for _, nicks := range chunkNicks(a.Watching()) {
+		if err := a.SendMessage(c, &chatlib.Message{Command: "MONITOR + " + strings.Join(nicks, ",")}); err != nil {
+			log.Error().Str("api", ApiName).Err(err).Msg("error sending the watch list")
+			return
+		}
+	}
+}
+
+// pollIson asks for the online state of the watched nicks every ISON
+// interval, until the connection is replaced.
+func (a *API) pollIson(c context.Context) {
+	if a.isonIntervalSeconds <= 0 {
+		return
+	}
+	conn := a.conn
+	t := time.NewTicker(time.Duration(float64(time.Second) * a.isonIntervalSeconds))
+	defer t.Stop()
+	for a.open && a.conn == conn {
+		if err := a.sendIson(c); err != nil {
+			log.Error().Str("api", ApiName).Err(err).Msg("error asking for the watched nicks")
+		}
+		select {
+		case <-c.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// sendIson asks which watched nicks are online. The replies are matched to
+// the ISONs in the order they were sent.
+func (a *API) sendIson(c context.Context) error {
+	chunks := chunkNicks(a.Watching())
+	a.watchMu.Lock()
+	// Replies that never came would misplace the next ones
+	a.isonQueue = chunks
+	a.watchMu.Unlock()
+	for _, nicks := range chunks {
+		if err := a.SendMessage(c, &chatlib.Message{Command: "ISON " + strings.Join(nicks, " ")}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkNicks splits nicks into groups short enough to send in one line.
+func chunkNicks(nicks []string) [][]string {
+	chunks := make([][]string, 0)
+	size := 0
+	for _, nick := range nicks {
+		if len(chunks) == 0 || size+len(nick)+1 > watchLineBytes {
+			chunks = append(chunks, nil)
+			size = 0
+		}
+		chunks[len(chunks)-1] = append(chunks[len(chunks)-1], nick)
+		size += len(nick) + 1
+	}
+	return chunks
+}
+
+// resetWatching stops using MONITOR until the new connection has registered
+// and forgets the ISONs waiting for replies. Whether nicks are online is
+// kept, so only what changed meanwhile is told.
+func (a *API) resetWatching() {
+	a.watchMu.Lock()
+	defer a.watchMu.Unlock()
+	a.monitoring, a.isonQueue = false, nil
+}
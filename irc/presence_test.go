@@ -0,0 +1,139 @@
+package irc
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestPresenceMonitor(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"), WithWatch("Alice", "bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	receive := func(line string) *chatlib.Message {
+		t.Helper()
+		a.rawMsgs <- []byte(line)
+		msg, err := a.ReceiveMessage(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	receive(":irc.example.net 005 bot MONITOR=100 :are supported by this server\r\n")
+	receive(":irc.example.net 376 bot :End of /MOTD command.\r\n")
+	if line := conn.next(); line != "MONITOR + Alice,bob\n" {
+		t.Errorf("expected the watch list to be sent, got %q", line)
+	}
+	if err := a.Watch(c, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if line := conn.next(); line != "MONITOR + carol\n" {
+		t.Errorf("expected carol to be watched, got %q", line)
+	}
+	if err := a.Watch(c, "bad nick"); err == nil {
+		t.Error("expected an invalid nick to be refused")
+	}
+
+	msg := receive(":irc.example.net 730 bot :alice!al@alice.example.com,carol!c@c.example.com\r\n")
+	changes, _ := AnnotationPresence.Get(msg)
+	expected := []PresenceChange{
+		{Nick: "alice", Online: true, User: "al", Host: "alice.example.com"},
+		{Nick: "carol", Online: true, User: "c", Host: "c.example.com"},
+	}
+	if msg.Command != CommandPresence || !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %+v, got %s %+v", expected, msg.Command, changes)
+	}
+	// Nicks that were never online aren't told of going offline
+	if msg := receive(":irc.example.net 731 bot :bob\r\n"); msg.Command != rplMonOffline {
+		t.Errorf("expected no change, got %s", msg.Command)
+	}
+	if online, known := a.Online("BOB"); online || !known {
+		t.Error("expected bob to be known offline")
+	}
+	msg = receive(":irc.example.net 731 bot :alice\r\n")
+	changes, _ = AnnotationPresence.Get(msg)
+	if msg.Command != CommandPresence || len(changes) != 1 || changes[0].Online {
+		t.Errorf("expected alice to go offline, got %s %+v", msg.Command, changes)
+	}
+
+	if err := a.Unwatch(c, "ALICE"); err != nil {
+		t.Fatal(err)
+	}
+	if line := conn.next(); line != "MONITOR - ALICE\n" {
+		t.Errorf("expected alice to be unwatched, got %q", line)
+	}
+	if got := a.Watching(); !reflect.DeepEqual(got, []string{"bob", "carol"}) {
+		t.Errorf("unexpected watch list %v", got)
+	}
+}
+
+func TestPresenceIson(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"), WithWatch("alice", "bob"), WithIsonInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	receive := func(line string) *chatlib.Message {
+		t.Helper()
+		a.rawMsgs <- []byte(line)
+		msg, err := a.ReceiveMessage(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	receive(":irc.example.net 422 bot :MOTD File is missing\r\n")
+	if err := a.Watch(c, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if line := conn.next(); line != "" {
+		t.Errorf("expected nothing to be sent without MONITOR, got %q", line)
+	}
+	if err := a.sendIson(c); err != nil {
+		t.Fatal(err)
+	}
+	if line := conn.next(); line != "ISON alice bob carol\n" {
+		t.Errorf("expected an ISON, got %q", line)
+	}
+	msg := receive(":irc.example.net 303 bot :Alice\r\n")
+	changes, _ := AnnotationPresence.Get(msg)
+	if msg.Command != CommandPresence || !reflect.DeepEqual(changes, []PresenceChange{{Nick: "Alice", Online: true}}) {
+		t.Errorf("expected alice to come online, got %s %+v", msg.Command, changes)
+	}
+
+	if err := a.sendIson(c); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(":irc.example.net 303 bot :alice\r\n"); msg.Command != rplIson {
+		t.Errorf("expected no change, got %s", msg.Command)
+	}
+	if err := a.sendIson(c); err != nil {
+		t.Fatal(err)
+	}
+	msg = receive(":irc.example.net 303 bot :bob\r\n")
+	changes, _ = AnnotationPresence.Get(msg)
+	expected := []PresenceChange{{Nick: "alice"}, {Nick: "bob", Online: true}}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %+v, got %+v", expected, changes)
+	}
+	// A reply nothing was asked for
+	if msg := receive(":irc.example.net 303 bot :carol\r\n"); msg.Command != rplIson {
+		t.Errorf("expected an unexpected ISON reply to be ignored, got %s", msg.Command)
+	}
+
+	nicks := make([]string, 100)
+	for i := range nicks {
+		nicks[i] = "nickname"
+	}
+	if chunks := chunkNicks(nicks); len(chunks) != 3 || len(chunks[0]) != 44 {
+		t.Errorf("expected the nicks to be split in lines, got %d", len(chunks))
+	}
+}
@@ -0,0 +1,179 @@
+package irc
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/nettest"
+)
+
+const proxyGreeting = ":irc.example.net NOTICE * :hello"
+
+// fakeProxy accepts one connection on l and lets handshake read the
+// client's request. Its reply is sent along with proxyGreeting, as servers
+// speaking first would, if the request is granted. The address the client
+// asked for is passed on target.
+func fakeProxy(t *testing.T, l net.Listener, target chan<- string, handshake func(conn net.Conn, r *bufio.Reader) (addr, reply string, granted bool, err error)) {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	addr, reply, granted, err := handshake(conn, bufio.NewReader(conn))
+	target <- addr
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if granted {
+		reply += proxyGreeting + "\r\n"
+	}
+	conn.Write([]byte(reply))
+	io.Copy(io.Discard, conn)
+}
+
+func socksHandshake(conn net.Conn, r *bufio.Reader) (string, string, bool, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return "", "", false, err
+	}
+	if _, err := io.ReadFull(r, make([]byte, head[1])); err != nil {
+		return "", "", false, err
+	}
+	// Ask for a username and password
+	conn.Write([]byte{5, 2})
+	if _, err := io.ReadFull(r, head); err != nil {
+		return "", "", false, err
+	}
+	user := make([]byte, head[1])
+	io.ReadFull(r, user)
+	n, _ := r.ReadByte()
+	password := make([]byte, n)
+	io.ReadFull(r, password)
+	if string(user) != "tor" || string(password) != "secret" {
+		return "", "\x01\x01", false, nil
+	}
+	conn.Write([]byte{1, 0})
+	req := make([]byte, 5)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return "", "", false, err
+	}
+	// Names must be left for the proxy to resolve
+	if req[3] != 3 {
+		return "", "\x05\x08\x00\x01\x00\x00\x00\x00\x00\x00", false, nil
+	}
+	host := make([]byte, req[4]+2)
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", "", false, err
+	}
+	port := binary.BigEndian.Uint16(host[len(host)-2:])
+	return string(host[:len(host)-2]) + ":" + strconv.Itoa(int(port)), "\x05\x00\x00\x01\x7f\x00\x00\x01\x00\x00", true, nil
+}
+
+func httpHandshake(conn net.Conn, r *bufio.Reader) (string, string, bool, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return "", "", false, err
+	}
+	if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+		return req.Host, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n", false, nil
+	}
+	return req.Host, "HTTP/1.1 200 Connection established\r\n\r\n", true, nil
+}
+
+func TestProxy(t *testing.T) {
+	c := context.Background()
+	for _, tc := range []struct {
+		scheme    string
+		userinfo  string
+		handshake func(net.Conn, *bufio.Reader) (string, string, bool, error)
+	}{
+		{"socks5", "tor:secret@", socksHandshake},
+		{"socks5h", "tor:secret@", socksHandshake},
+		{"http", "user:pass@", httpHandshake},
+	} {
+		l, err := nettest.NewLocalListener("tcp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		target := make(chan string, 1)
+		go fakeProxy(t, l, target, tc.handshake)
+
+		a, err := New(WithNetwork("abcdefghijklmnop.onion", 6667), WithProxy(tc.scheme+"://"+tc.userinfo+l.Addr().String()), WithDialTimeout(5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.connect(c); err != nil {
+			t.Fatalf("%s: %v", tc.scheme, err)
+		}
+		if addr := <-target; addr != "abcdefghijklmnop.onion:6667" {
+			t.Errorf("%s: expected the proxy to be asked for the server by name, got %q", tc.scheme, addr)
+		}
+		line, err := a.reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%s: %v", tc.scheme, err)
+		}
+		if strings.TrimSpace(line) != proxyGreeting {
+			t.Errorf("%s: expected the server's greeting through the proxy, got %q", tc.scheme, line)
+		}
+		a.conn.Close()
+	}
+
+	// Proxies refusing to connect fail the connection
+	l, err := nettest.NewLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	target := make(chan string, 1)
+	go fakeProxy(t, l, target, httpHandshake)
+	a, err := New(WithNetwork("irc.example.net", 6667), WithProxy("http://"+l.Addr().String()), WithDialTimeout(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.connect(c); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("expected the proxy to refuse, got %v", err)
+	}
+	if addr := <-target; addr != "irc.example.net:6667" {
+		t.Errorf("expected CONNECT to ask for the server, got %q", addr)
+	}
+}
+
+func TestWithProxy(t *testing.T) {
+	for _, tc := range []struct {
+		url      string
+		expected string
+	}{
+		{"socks5://127.0.0.1:9050", "127.0.0.1:9050"},
+		{"socks5h://tor", "tor:1080"},
+		{"http://proxy.example.net", "proxy.example.net:8080"},
+		{"https://proxy.example.net", "proxy.example.net:443"},
+		{"", ""},
+		{"ftp://proxy.example.net", "error"},
+		{"socks5://", "error"},
+		{"127.0.0.1:9050", "error"},
+	} {
+		a, err := New(WithProxy(tc.url))
+		switch {
+		case tc.expected == "error":
+			if err == nil {
+				t.Errorf("%q: expected an error", tc.url)
+			}
+		case err != nil:
+			t.Errorf("%q: %v", tc.url, err)
+		case tc.expected == "" && a.proxy != nil:
+			t.Errorf("%q: expected no proxy, got %s", tc.url, a.proxy)
+		case tc.expected != "" && (a.proxy == nil || a.proxy.Host != tc.expected):
+			t.Errorf("%q: expected proxy at %s, got %v", tc.url, tc.expected, a.proxy)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package irc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// scriptedReader returns its chunks one read at a time, and errors in their
+// place.
+type scriptedReader struct {
+	chunks []any
+}
+
+func (r *scriptedReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	switch chunk := r.chunks[0].(type) {
+	case error:
+		r.chunks = r.chunks[1:]
+		return 0, chunk
+	case string:
+		n := copy(p, chunk)
+		if n < len(chunk) {
+			r.chunks[0] = chunk[n:]
+		} else {
+			r.chunks = r.chunks[1:]
+		}
+		return n, nil
+	}
+	panic("invalid chunk")
+}
+
+func TestReadMessage(t *testing.T) {
+	errSlow := errors.New("slow link")
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.reader = bufio.NewReaderSize(&scriptedReader{chunks: []any{
+		// Cut short by an error, completed by the next read
+		":foo!u@h PRIVMSG #test :hel", errSlow, "lo\r\n",
+		// Too long, then a line that must not be mistaken for its tail
+		"@" + strings.Repeat("a", MaxLineBytes*2) + " :foo!u@h PRIVMSG #test :huge\r\n",
+		// A bare LF
+		":foo!u@h PRIVMSG #test :bye\n",
+		"\r\n",
+	}}, MaxLineBytes)
+	for {
+		err := a.readMessage(context.Background())
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil && !errors.Is(err, errSlow) {
+			t.Fatal(err)
+		}
+	}
+	close(a.rawMsgs)
+	lines := make([]string, 0)
+	for line := range a.rawMsgs {
+		lines = append(lines, string(line))
+	}
+	expected := []string{":foo!u@h PRIVMSG #test :hello\r\n", ":foo!u@h PRIVMSG #test :bye\r\n"}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], lines[i])
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package irc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const DefaultRejoinDelaySeconds = 10
+
+// rejoinResetAfter is how long the bot must stay in a channel after
+// rejoining before a kick counts as the first again.
+const rejoinResetAfter = 10 * time.Minute
+
+// RejoinFunc decides whether to rejoin channel after being kicked from it by
+// nick for reason.
+type RejoinFunc func(c context.Context, channel, nick, reason string) bool
+
+// kickCount is how often the bot has been kicked from a channel lately.
+type kickCount struct {
+	kicks int
+	last  time.Time
+}
+
+// WithAutoRejoin rejoins configured channels seconds after being kicked from
+// them. After attempts kicks in a row the bot stays out and tells the admins.
+// 0 attempts disables rejoining.
+func WithAutoRejoin(seconds float64, attempts int) Option {
+	return func(a *API) error {
+		if seconds < 0 || attempts < 0 {
+			return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: invalid auto rejoin delay %v or attempts %d", seconds, attempts)
+		}
+		a.rejoinSeconds = seconds
+		a.rejoinAttempts = attempts
+		return nil
+	}
+}
+
+// WithRejoinHook sets a function asked before rejoining a channel the bot was
+// kicked from. The channel is only rejoined if it returns true.
+func WithRejoinHook(fn RejoinFunc) Option {
+	return func(a *API) error {
+		a.rejoinHook = fn
+		return nil
+	}
+}
+
+// handleKick rejoins a configured channel the bot was kicked from, unless
+// it has been kicked too often or the rejoin hook says not to.
+func (a *API) handleKick(c context.Context, msg *chatlib.Message) error {
+	if a.rejoinAttempts == 0 || msg.Command != "KICK" || len(msg.Params) < 2 || !strings.EqualFold(msg.Params[1], a.nick) {
+		return nil
+	}
+	channel := msg.Receiver
+	reason := ""
+	if len(msg.Params) > 2 {
+		reason = msg.Params[2]
+	}
+	log.Warn().Str("api", ApiName).Msgf("kicked from %s by %s: %s", channel, msg.Nick, reason)
+	if !a.configuredChannel(c, channel) {
+		return nil
+	}
+	if a.rejoinHook != nil && !a.rejoinHook(c, channel, msg.Nick, reason) {
+		log.Info().Str("api", ApiName).Msgf("not rejoining %s", channel)
+		return nil
+	}
+	a.joinMu.Lock()
+	k, ok := a.kicks[strings.ToLower(channel)]
+	if !ok || time.Since(k.last) > rejoinResetAfter {
+		k = &kickCount{}
+		a.kicks[strings.ToLower(channel)] = k
+	}
+	k.kicks++
+	k.last = time.Now()
+	kicks := k.kicks
+	a.joinMu.Unlock()
+	if kicks > a.rejoinAttempts {
+		if kicks == a.rejoinAttempts+1 {
+			text := fmt.Sprintf("gave up rejoining %s after being kicked %d times, last by %s: %s", channel, a.rejoinAttempts+1, msg.Nick, reason)
+			log.Error().Str("api", ApiName).Msg(text)
+			if a.notifyAdmins != nil {
+				a.notifyAdmins(c, text)
+			}
+		}
+		return nil
+	}
+	log.Info().Str("api", ApiName).Msgf("rejoining %s in %vs (attempt %d of %d)", channel, a.rejoinSeconds, kicks, a.rejoinAttempts)
+	conn := a.conn
+	time.AfterFunc(time.Duration(float64(time.Second)*a.rejoinSeconds), func() {
+		if !a.open || a.conn != conn || a.joinState(channel) != joinNone {
+			return
+		}
+		if err := a.joinChannel(c, channel); err != nil {
+			log.Error().Str("api", ApiName).Err(err).Msgf("error rejoining %s", channel)
+		}
+	})
+	return nil
+}
+
+// configuredChannel reports whether channel is one the bot is meant to be
+// in, from the configuration or joined at runtime and not parted since.
+func (a *API) configuredChannel(c context.Context, channel string) bool {
+	state, err := a.loadChannelState(c)
+	if err != nil {
+		log.Error().Str("api", ApiName).Err(err).Msg("error loading channel state")
+		state = &channelState{}
+	}
+	if containsChannel(state.Parted, channel) {
+		return false
+	}
+	return a.channelOrigin(channel) != "" || containsChannel(state.Joined, channel)
+}
+
+// resetKicks forgets kicks from an earlier connection.
+func (a *API) resetKicks() {
+	a.joinMu.Lock()
+	defer a.joinMu.Unlock()
+	a.kicks = make(map[string]*kickCount)
+}
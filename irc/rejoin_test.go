@@ -0,0 +1,77 @@
+package irc
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// chanConn sends every line the API writes on a channel, for tests of
+// writes made from other goroutines.
+type chanConn struct {
+	lines chan string
+}
+
+func (cc *chanConn) Read(p []byte) (int, error) { return 0, io.EOF }
+
+func (cc *chanConn) Write(p []byte) (int, error) {
+	cc.lines <- string(p)
+	return len(p), nil
+}
+
+func (cc *chanConn) Close() error { return nil }
+
+func TestAutoRejoin(t *testing.T) {
+	c := context.Background()
+	var notified []string
+	a, err := New(
+		WithNick("bot"),
+		WithChannels([]string{"#ops", "#quiet"}),
+		WithAutoRejoin(0, 2),
+		WithRejoinHook(func(c context.Context, channel, nick, reason string) bool {
+			return channel != "#quiet"
+		}),
+		WithAdminNotifier(func(c context.Context, text string) { notified = append(notified, text) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &chanConn{lines: make(chan string, 10)}
+	a.conn = conn
+	kick := func(line string) {
+		t.Helper()
+		a.rawMsgs <- []byte(line)
+		if _, err := a.ReceiveMessage(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(expected string) {
+		t.Helper()
+		select {
+		case line := <-conn.lines:
+			if line != expected {
+				t.Fatalf("expected %q, got %q", expected, line)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+	kick(":op!u@h KICK #ops bot :behave\r\n")
+	expect("JOIN #ops\n")
+	kick(":op!u@h KICK #ops someone :not the bot\r\n")
+	kick(":op!u@h KICK #other bot :not configured\r\n")
+	kick(":op!u@h KICK #quiet bot :hook says no\r\n")
+	kick(":op!u@h KICK #ops bot :behave\r\n")
+	expect("JOIN #ops\n")
+	// Out of attempts
+	kick(":op!u@h KICK #ops bot :last warning\r\n")
+	select {
+	case line := <-conn.lines:
+		t.Fatalf("unexpected line %q", line)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if len(notified) != 1 {
+		t.Errorf("expected the admins to be told once, got %v", notified)
+	}
+}
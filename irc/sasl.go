@@ -0,0 +1,296 @@
+package irc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// saslChunkSize is the largest AUTHENTICATE payload a server accepts in one
+// line.
+const saslChunkSize = 400
+
+// SASL numerics
+const (
+	rplSASLSuccess = "903"
+	errSASLFail    = "904"
+	errSASLTooLong = "905"
+	errSASLAborted = "906"
+	errSASLAlready = "907"
+)
+
+// saslMechanism is one side of a SASL exchange. next is called with each
+// decoded server challenge and returns the client response.
+type saslMechanism interface {
+	name() string
+	next(challenge []byte) ([]byte, error)
+}
+
+// usesSASL reports whether the auth method needs SASL negotiation.
+func (a *API) usesSASL() bool {
+	switch a.authMethod {
+	case AuthMethodSASL, AuthMethodSASLExternal, AuthMethodSASLScramSHA256:
+		return true
+	}
+	return false
+}
+
+func (a *API) saslMechanism() (saslMechanism, error) {
+	user := a.account
+	if user == "" {
+		user = a.primaryNick
+	}
+	switch a.authMethod {
+	case AuthMethodSASL:
+		return &saslPlain{user: user, password: a.password}, nil
+	case AuthMethodSASLExternal:
+		if a.tls == nil || len(a.tls.Certificates) == 0 {
+			return nil, errors.WithMessage(chatlib.ErrInvalidConfig, "irc: sasl external requires a tls client certificate")
+		}
+		return &saslExternal{}, nil
+	case AuthMethodSASLScramSHA256:
+		return newSCRAM(sha256.New, user, a.password)
+	}
+	return nil, errors.Errorf("irc: auth method %d does not use sasl", a.authMethod)
+}
+
+// startSASL starts the SASL exchange once the server has granted the sasl
+// capability.
+func (a *API) startSASL(c context.Context) error {
+	if !a.usesSASL() {
+		return nil
+	}
+	mech, err := a.saslMechanism()
+	if err != nil {
+		return err
+	}
+	if mechs, _ := a.CapValue("sasl"); mechs != "" && !contains(strings.Split(mechs, ","), mech.name()) {
+		log.Warn().Str("api", ApiName).Msgf("server only advertises sasl mechanisms %s, trying %s anyway", mechs, mech.name())
+	}
+	a.sasl = mech
+	return a.SendMessage(c, &chatlib.Message{Command: "AUTHENTICATE " + mech.name()})
+}
+
+// handleSASL drives the SASL exchange from the server's AUTHENTICATE and SASL
+// numeric replies.
+func (a *API) handleSASL(c context.Context, msg *chatlib.Message) error {
+	if !a.usesSASL() {
+		return nil
+	}
+	switch msg.Command {
+	case "AUTHENTICATE":
+		if a.sasl == nil {
+			return nil
+		}
+		var challenge []byte
+		if msg.Text != "+" {
+			a.saslBuf += msg.Text
+			if len(msg.Text) == saslChunkSize {
+				// More to come
+				return nil
+			}
+			bts, err := base64.StdEncoding.DecodeString(a.saslBuf)
+			a.saslBuf = ""
+			if err != nil {
+				return a.abortSASL(c, errors.Wrap(err, "irc: invalid sasl challenge"))
+			}
+			challenge = bts
+		}
+		resp, err := a.sasl.next(challenge)
+		if err != nil {
+			return a.abortSASL(c, err)
+		}
+		return a.sendAuthenticate(c, resp)
+	case rplSASLSuccess:
+		log.Info().Str("api", ApiName).Msg("sasl authentication succeeded")
+		a.sasl = nil
+		return a.maybeEndCaps(c)
+	case errSASLFail, errSASLTooLong, errSASLAborted, errSASLAlready:
+		log.Error().Str("api", ApiName).Msgf("sasl authentication failed: %s", msg.Text)
+		a.sasl = nil
+		return a.maybeEndCaps(c)
+	}
+	return nil
+}
+
+// sendAuthenticate sends a response in chunks of saslChunkSize, ending with
+// "+" if the last chunk was full or the response is empty.
+func (a *API) sendAuthenticate(c context.Context, resp []byte) error {
+	enc := base64.StdEncoding.EncodeToString(resp)
+	for len(enc) >= saslChunkSize {
+		if err := a.SendMessage(c, &chatlib.Message{Command: "AUTHENTICATE " + enc[:saslChunkSize]}); err != nil {
+			return err
+		}
+		enc = enc[saslChunkSize:]
+	}
+	if enc == "" {
+		enc = "+"
+	}
+	return a.SendMessage(c, &chatlib.Message{Command: "AUTHENTICATE " + enc})
+}
+
+// abortSASL aborts the exchange. The server answers with ERR_SASLABORTED,
+// which ends capability negotiation.
+func (a *API) abortSASL(c context.Context, err error) error {
+	a.sasl = nil
+	a.SendMessage(c, &chatlib.Message{Command: "AUTHENTICATE *"})
+	return err
+}
+
+type saslPlain struct {
+	user     string
+	password string
+}
+
+func (m *saslPlain) name() string { return "PLAIN" }
+
+func (m *saslPlain) next(challenge []byte) ([]byte, error) {
+	return []byte(m.user + "\x00" + m.user + "\x00" + m.password), nil
+}
+
+// saslExternal authenticates with the TLS client certificate.
+type saslExternal struct{}
+
+func (m *saslExternal) name() string { return "EXTERNAL" }
+
+func (m *saslExternal) next(challenge []byte) ([]byte, error) {
+	return nil, nil
+}
+
+// scram implements the client side of SCRAM (RFC 5802) without channel
+// binding.
+type scram struct {
+	hash     func() hash.Hash
+	user     string
+	password string
+	nonce    string
+	step     int
+
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+}
+
+func newSCRAM(h func() hash.Hash, user, password string) (*scram, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &scram{
+		hash:     h,
+		user:     user,
+		password: password,
+		nonce:    base64.RawStdEncoding.EncodeToString(nonce),
+	}, nil
+}
+
+func (m *scram) name() string { return "SCRAM-SHA-256" }
+
+func (m *scram) next(challenge []byte) ([]byte, error) {
+	m.step++
+	switch m.step {
+	case 1:
+		user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(m.user)
+		m.clientFirstBare = "n=" + user + ",r=" + m.nonce
+		return []byte("n,," + m.clientFirstBare), nil
+	case 2:
+		return m.clientFinal(string(challenge))
+	case 3:
+		return nil, m.verifyServer(string(challenge))
+	}
+	return nil, errors.New("irc: unexpected scram challenge")
+}
+
+// maxScramIterations is the most PBKDF2 iterations a server may ask for, so
+// that it can't keep the bot hashing for minutes.
+const maxScramIterations = 1 << 20
+
+func (m *scram) clientFinal(serverFirst string) ([]byte, error) {
+	attrs := scramAttrs(serverFirst)
+	nonce, salt64, iter := attrs["r"], attrs["s"], attrs["i"]
+	if !strings.HasPrefix(nonce, m.nonce) || len(nonce) == len(m.nonce) {
+		return nil, errors.New("irc: scram server nonce does not extend client nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return nil, errors.Wrap(err, "irc: invalid scram salt")
+	}
+	iterations, err := strconv.Atoi(iter)
+	if err != nil || iterations < 1 || iterations > maxScramIterations {
+		return nil, errors.Errorf("irc: invalid scram iteration count: %s, at most %d", iter, maxScramIterations)
+	}
+	m.saltedPassword = pbkdf2(m.hash, []byte(m.password), salt, iterations)
+	clientKey := m.hmac(m.saltedPassword, "Client Key")
+	h := m.hash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+	withoutProof := "c=biws,r=" + nonce
+	m.authMessage = m.clientFirstBare + "," + serverFirst + "," + withoutProof
+	signature := m.hmac(storedKey, m.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func (m *scram) verifyServer(serverFinal string) error {
+	attrs := scramAttrs(serverFinal)
+	if e, ok := attrs["e"]; ok {
+		return errors.Errorf("irc: scram server error: %s", e)
+	}
+	got, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil {
+		return errors.Wrap(err, "irc: invalid scram server signature")
+	}
+	exp := m.hmac(m.hmac(m.saltedPassword, "Server Key"), m.authMessage)
+	if subtle.ConstantTimeCompare(got, exp) != 1 {
+		return errors.New("irc: scram server signature does not match")
+	}
+	return nil
+}
+
+func (m *scram) hmac(key []byte, data string) []byte {
+	mac := hmac.New(m.hash, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func scramAttrs(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+// pbkdf2 derives a key the length of one hash block (RFC 8018), which is all
+// SCRAM needs.
+func pbkdf2(h func() hash.Hash, password, salt []byte, iterations int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	out := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
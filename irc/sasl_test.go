@@ -0,0 +1,45 @@
+package irc
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+// TestSCRAM checks the exchange against the example in RFC 7677.
+func TestSCRAM(t *testing.T) {
+	m := &scram{
+		hash:     sha256.New,
+		user:     "user",
+		password: "pencil",
+		nonce:    "rOprNGfwEbeRWgbNEkqO",
+	}
+	first, err := m.next(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first) != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Fatalf("unexpected client first message: %s", first)
+	}
+	final, err := m.next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="; string(final) != exp {
+		t.Fatalf("unexpected client final message: %s", final)
+	}
+	if _, err := m.next([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSCRAMIterations(t *testing.T) {
+	for _, iter := range []string{"0", "-1", "1048577", "99999999999", "lots"} {
+		m := &scram{hash: sha256.New, user: "user", password: "pencil", nonce: "abc"}
+		if _, err := m.next(nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.next([]byte("r=abcdef,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=" + iter)); err == nil {
+			t.Errorf("expected %s iterations to be refused", iter)
+		}
+	}
+}
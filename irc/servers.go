@@ -0,0 +1,150 @@
+package irc
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Defaults for reconnecting after the connection to the server is lost.
+const (
+	DefaultReconnectDelaySeconds    = 5
+	DefaultMaxReconnectDelaySeconds = 300
+)
+
+// server is a server of the network. port is 0 until the default port is
+// known.
+type server struct {
+	host string
+	port int
+}
+
+// parseServers parses servers given as host:port, or host for the default
+// port.
+func parseServers(addrs []string) ([]server, error) {
+	servers := make([]server, 0, len(addrs))
+	for _, addr := range addrs {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			// No port
+			servers = append(servers, server{host: addr})
+			continue
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 || port > 65535 || host == "" {
+			return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "irc: invalid server %q, expected host:port", addr)
+		}
+		servers = append(servers, server{host, port})
+	}
+	return servers, nil
+}
+
+// WithReconnect reconnects to the network after the connection is lost,
+// going to the next of its servers, first after delay seconds, then waiting
+// twice as long after each time every server failed, up to maxDelay
+// seconds. A delay of 0 doesn't reconnect.
+func WithReconnect(delay, maxDelay float64) Option {
+	return func(a *API) error {
+		if delay < 0 || maxDelay < delay && delay > 0 {
+			return errors.Wrapf(chatlib.ErrInvalidConfig, "irc: invalid reconnect delays %v and %v", delay, maxDelay)
+		}
+		a.reconnectDelaySeconds, a.maxReconnectDelaySeconds = delay, maxDelay
+		return nil
+	}
+}
+
+// Server returns the host:port of the server the API connects to.
+func (a *API) Server() string {
+	return a.serverPort()
+}
+
+// setDefaultPort gives the servers without a port port.
+func (a *API) setDefaultPort(port int) {
+	for i := range a.servers {
+		if a.servers[i].port == 0 {
+			a.servers[i].port = port
+		}
+	}
+	a.useServer(a.serverIndex)
+}
+
+// useServer makes the ith server of the network the one connected to.
+func (a *API) useServer(i int) {
+	if len(a.servers) == 0 {
+		return
+	}
+	a.serverIndex = i % len(a.servers)
+	a.networkHost, a.networkPort = a.servers[a.serverIndex].host, a.servers[a.serverIndex].port
+}
+
+// nextServer moves on to the next server of the network, round-robin.
+func (a *API) nextServer() {
+	a.useServer(a.serverIndex + 1)
+}
+
+// primaryHost is the host of the first server of the network, which names
+// it in the store whichever server is connected to.
+func (a *API) primaryHost() string {
+	if len(a.servers) == 0 {
+		return a.networkHost
+	}
+	return a.servers[0].host
+}
+
+// reconnect replaces the lost connection with one to the next server that
+// accepts it, backing off after every server failed, and logs in again. It
+// reports whether it did, which it doesn't once the API is stopped.
+func (a *API) reconnect(c context.Context, cause error) bool {
+	if a.reconnectDelaySeconds <= 0 {
+		return false
+	}
+	a.conn.Close()
+	lost := a.serverPort()
+	log.Warn().Str("api", ApiName).Str("server", lost).Err(cause).Msg("connection lost, reconnecting")
+	if a.notifyAdmins != nil {
+		a.notifyAdmins(c, "connection to "+lost+" lost: "+cause.Error())
+	}
+	a.nextServer()
+	delay := time.Duration(float64(time.Second) * a.reconnectDelaySeconds)
+	maxDelay := time.Duration(float64(time.Second) * a.maxReconnectDelaySeconds)
+	for a.open {
+		t := time.NewTimer(delay)
+		select {
+		case <-c.Done():
+			t.Stop()
+			return false
+		case <-t.C:
+		}
+		if !a.open {
+			return false
+		}
+		err := a.connect(c)
+		if err == nil {
+			break
+		}
+		log.Error().Str("api", ApiName).Err(err).Dur("retry", min(delay*2, maxDelay)).Msg("error reconnecting")
+		delay = min(delay*2, maxDelay)
+	}
+	if !a.open {
+		a.conn.Close()
+		return false
+	}
+	log.Info().Str("api", ApiName).Str("server", a.serverPort()).Msg("reconnected")
+	a.loginAgain(c)
+	return true
+}
+
+// loginAgain logs in on a new connection after the login delay.
+func (a *API) loginAgain(c context.Context) {
+	go func() {
+		time.Sleep(time.Duration(float64(time.Second) * a.loginDelaySeconds))
+		if err := a.login(c); err != nil {
+			log.Error().Str("api", ApiName).Err(err).Msg("error logging in after reconnecting")
+		}
+	}()
+}
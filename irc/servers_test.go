@@ -0,0 +1,122 @@
+package irc
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/nettest"
+)
+
+// deadServer returns the address of a server that refuses connections.
+func deadServer(t *testing.T) string {
+	l, err := nettest.NewLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestServerFailover(t *testing.T) {
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first, second := deadServer(t), make([]net.Listener, 2)
+	for i := range second {
+		l, err := nettest.NewLocalListener("tcp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		second[i] = l
+	}
+	host, port, _ := net.SplitHostPort(first)
+	p, _ := strconv.Atoi(port)
+	a, err := New(WithNick("bot"), WithNetwork(host, p, second[0].Addr().String(), second[1].Addr().String()), WithReconnect(0.01, 0.05))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.loginDelaySeconds = 0
+
+	// The first server is down, so the next one is connected to
+	if err := a.connect(c); err != nil {
+		t.Fatal(err)
+	}
+	if a.Server() != second[0].Addr().String() {
+		t.Fatalf("expected to fail over to %s, got %s", second[0].Addr(), a.Server())
+	}
+	conn, err := second[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.pollConn(c)
+
+	// Losing the connection goes on to the next server and logs in again
+	conn.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := second[1].Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn
+	}()
+	select {
+	case conn = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected to reconnect to the next server")
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected to log in again, got %v", err)
+		}
+		if strings.HasPrefix(line, "USER ") {
+			break
+		}
+	}
+	if err := a.Stop(c); err != nil {
+		t.Fatal(err)
+	}
+	// The store keeps naming the network by its first server
+	if a.channelStateKey() != "irc/"+host+"/channels" {
+		t.Errorf("unexpected channel state key %s", a.channelStateKey())
+	}
+}
+
+func TestWithNetwork(t *testing.T) {
+	a, err := New(WithNetwork("irc.example.net", 0, "irc2.example.net:7000", "irc3.example.net", "[::1]:6697"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.setDefaultPort(DefaultTlsPort)
+	var servers []string
+	for range a.servers {
+		servers = append(servers, a.serverPort())
+		a.nextServer()
+	}
+	expected := "irc.example.net:6697 irc2.example.net:7000 irc3.example.net:6697 ::1:6697"
+	if strings.Join(servers, " ") != expected {
+		t.Errorf("expected servers %s, got %v", expected, servers)
+	}
+	if a.serverPort() != "irc.example.net:6697" {
+		t.Errorf("expected to go round to the first server, got %s", a.serverPort())
+	}
+	for _, bad := range []string{"irc2.example.net:port", ":6697", "irc2.example.net:0"} {
+		if _, err := New(WithNetwork("irc.example.net", 6697, bad)); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+	if _, err := New(WithReconnect(10, 5)); err == nil {
+		t.Error("expected the max reconnect delay to be at least the delay")
+	}
+}
@@ -0,0 +1,55 @@
+package irc
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gregseb/chatlib"
+	"github.com/rs/zerolog/log"
+)
+
+var _ chatlib.ShortenerUser = (*API)(nil)
+
+// UseURLShortener shortens the URLs of messages that would otherwise be
+// split across lines.
+func (a *API) UseURLShortener(s chatlib.URLShortener) {
+	a.shortener = s
+}
+
+// fitText splits text into lines of at most limit bytes like wrapText. If a
+// line would be split, the URLs in the text are shortened first, and the
+// shortened text is used if it takes fewer lines.
+func (a *API) fitText(c context.Context, text string, limit int) []textLine {
+	lines := wrapText(text, limit)
+	if a.shortener == nil || !isSplit(lines) {
+		return lines
+	}
+	short := text
+	seen := make(map[string]bool)
+	for _, u := range chatlib.FindURLs(text) {
+		if seen[u] {
+			continue
+		}
+		seen[u] = true
+		s, err := a.shortener.Shorten(c, u)
+		if err != nil {
+			log.Warn().Str("api", ApiName).Err(err).Msgf("error shortening %s", u)
+			continue
+		}
+		short = strings.ReplaceAll(short, u, s)
+	}
+	if shortLines := wrapText(short, limit); len(shortLines) < len(lines) {
+		return shortLines
+	}
+	return lines
+}
+
+// isSplit reports whether a line of text was too long and split.
+func isSplit(lines []textLine) bool {
+	for _, l := range lines {
+		if l.concat {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package irc
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+type fakeShortener map[string]string
+
+func (f fakeShortener) Shorten(c context.Context, url string) (string, error) {
+	if short, ok := f[url]; ok {
+		return short, nil
+	}
+	return url, nil
+}
+
+func TestShortenURLs(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := "https://example.com/" + strings.Repeat("a", 60)
+	a.UseURLShortener(fakeShortener{long: "https://sho.rt/1"})
+
+	if lines := a.fitText(c, "see "+long, 100); len(lines) != 1 || lines[0].text != "see "+long {
+		t.Errorf("expected a message that fits to be kept, got %+v", lines)
+	}
+	text := strings.Repeat("word ", 10) + long + " and " + long
+	lines := a.fitText(c, text, 100)
+	if len(lines) != 1 || lines[0].text != strings.Repeat("word ", 10)+"https://sho.rt/1 and https://sho.rt/1" {
+		t.Errorf("expected the URLs to be shortened, got %+v", lines)
+	}
+	// Shortening can't save a line here
+	text = strings.Repeat("word ", 40) + "https://example.com/other"
+	if lines := a.fitText(c, text, 100); len(lines) != len(wrapText(text, 100)) || !strings.Contains(lines[len(lines)-1].text, "example.com") {
+		t.Errorf("expected the text to be kept, got %+v", lines)
+	}
+
+	conn := &bufConn{}
+	a.conn = conn
+	if err := a.SendAction(c, "#test", strings.Repeat("waves ", 60)+long); err != nil {
+		t.Fatal(err)
+	}
+	if line := conn.next(); !strings.Contains(line, "https://sho.rt/1") || conn.next() != "" {
+		t.Errorf("expected actions to be shortened, got %q", line)
+	}
+}
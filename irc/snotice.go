@@ -0,0 +1,163 @@
+package irc
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gregseb/chatlib"
+)
+
+// Commands given to messages for opers, so actions can be registered for
+// them. Server notices arrive as NOTICE and GLOBOPS as server notices or
+// WALLOPS depending on the server software.
+const (
+	CommandServerNotice = "SNOTICE"
+	CommandWallops      = "WALLOPS"
+	CommandGlobops      = "GLOBOPS"
+)
+
+// Kinds of server notice that are parsed into their fields.
+const (
+	NoticeConnect = "connect"
+	NoticeExit    = "exit"
+	NoticeNick    = "nick"
+	NoticeKline   = "kline"
+	NoticeUnkline = "unkline"
+)
+
+// AnnotationServerNotice holds the parsed fields of SNOTICE, WALLOPS and
+// GLOBOPS messages.
+var AnnotationServerNotice = chatlib.NewAnnotationKey[*ServerNotice]("irc.snotice")
+
+// ServerNotice is a server notice or oper broadcast split into its fields.
+// Only the fields that the kind of notice has are set.
+type ServerNotice struct {
+	// Kind is one of the Notice constants, or empty for notices that aren't
+	// recognised.
+	Kind string
+	// Server is the server that sent the notice, or the user for WALLOPS.
+	Server string
+	// Text is the notice without the *** and category decoration.
+	Text string
+	// The client that connected, exited or changed nick. Nick is the new
+	// nick and OldNick the previous one for nick changes.
+	Nick     string
+	OldNick  string
+	User     string
+	Host     string
+	IP       string
+	Class    string
+	Realname string
+	// Reason is the quit message of an exit or the reason of a K-line.
+	Reason string
+	// Mask is the user@host mask of a K-line.
+	Mask string
+	// By is the oper who set or removed a K-line, or sent a WALLOPS or
+	// GLOBOPS.
+	By string
+	// Duration is how long a K-line lasts, 0 for a permanent one.
+	Duration time.Duration
+}
+
+// snoticePatterns match the notices of the common server software: ratbox
+// derived servers like charybdis and solanum, hybrid, UnrealIRCd and
+// InspIRCd. They are matched against the text with the decoration removed.
+var snoticePatterns = []struct {
+	kind string
+	re   *regexp.Regexp
+}{
+	// charybdis, hybrid, unreal: Client connecting: nick (user@host) [ip] {class} [realname]
+	{NoticeConnect, regexp.MustCompile(`^Client connecting(?: on port \d+)?: (?P<nick>\S+) \((?P<user>[^@\s]+)@(?P<host>[^)\s]+)\)(?: \[(?P<ip>[^\]]*)\])?(?: \{(?P<class>[^}]*)\})?(?: \[(?P<realname>.*?)\])?`)},
+	// inspircd: Client connecting on port 6697 (class main): nick!user@host (ip) [realname]
+	{NoticeConnect, regexp.MustCompile(`^Client connecting on port \d+ \(class (?P<class>[^)]*)\): (?P<nick>[^!\s]+)!(?P<user>[^@\s]+)@(?P<host>\S+) \((?P<ip>[^)]*)\)(?: \[(?P<realname>.*)\])?`)},
+	// charybdis: Client exiting: nick (user@host) [reason] [ip]
+	{NoticeExit, regexp.MustCompile(`^Client exiting: (?P<nick>\S+) \((?P<user>[^@\s]+)@(?P<host>[^)\s]+)\)(?: \[(?P<reason>.*?)\])?(?: \[(?P<ip>[^\]]*)\])?$`)},
+	// inspircd: Client exiting: nick!user@host (ip) [reason]
+	{NoticeExit, regexp.MustCompile(`^Client exiting: (?P<nick>[^!\s]+)!(?P<user>[^@\s]+)@(?P<host>\S+) \((?P<ip>[^)]*)\)(?: \[(?P<reason>.*)\])?`)},
+	// Nick change: From old to new [user@host]
+	{NoticeNick, regexp.MustCompile(`^Nick change: From (?P<oldnick>\S+) to (?P<nick>\S+) \[(?P<user>[^@\s]+)@(?P<host>[^\]\s]+)\]`)},
+	// charybdis, hybrid: oper!u@h{server} added temporary 60 min. K-Line for [*@host] [reason]
+	{NoticeKline, regexp.MustCompile(`^(?P<by>\S+?)(?:\{[^}]*\})? added (?:(?:temporary|global|local) )*(?:(?P<minutes>\d+) min\. )?K-Line for \[(?P<mask>[^\]]+)\](?: \[(?P<reason>.*)\])?`)},
+	// unreal: Permanent K-Line added for *@host on Mon Jan 1 00:00:00 2024 GMT by oper [reason]
+	{NoticeKline, regexp.MustCompile(`^(?:Permanent|Temporary|Global) [KG]-Line added (?:for|on) (?P<mask>\S+) .* by (?P<by>\S+)(?: \[(?P<reason>.*)\])?`)},
+	// charybdis, hybrid: oper has removed the K-Line for: [*@host]
+	{NoticeUnkline, regexp.MustCompile(`^(?P<by>\S+?)(?:\{[^}]*\})? has removed the (?:temporary |global )*K-Line for:? \[(?P<mask>[^\]]+)\]`)},
+}
+
+// globopsPattern matches GLOBOPS sent as server notices.
+var globopsPattern = regexp.MustCompile(`(?i)^(?:Global|GLOBOPS)(?: --|:) from (\S+?):\s*(.*)$`)
+
+// handleServerNotice gives server notices, WALLOPS and GLOBOPS their own
+// commands and annotates them with their fields.
+func (a *API) handleServerNotice(msg *chatlib.Message) {
+	switch {
+	case msg.Command == "WALLOPS":
+		by := msg.Nick
+		if by == "" {
+			by = msg.Sender
+		}
+		// The text is the only parameter
+		msg.Receiver, msg.Text = "", msg.Receiver
+		AnnotationServerNotice.Set(msg, &ServerNotice{Server: msg.Sender, By: by, Text: msg.Text})
+	case msg.Command == "NOTICE" && msg.Nick == "" && msg.Sender != "" && strings.HasPrefix(msg.Text, "*** "):
+		sn := parseServerNotice(msg.Text)
+		sn.Server = msg.Sender
+		msg.Command = CommandServerNotice
+		if m := globopsPattern.FindStringSubmatch(strings.TrimPrefix(msg.Text, "*** ")); m != nil {
+			msg.Command = CommandGlobops
+			sn.By, sn.Text = m[1], m[2]
+		}
+		AnnotationServerNotice.Set(msg, sn)
+	}
+}
+
+// parseServerNotice parses the text of a server notice.
+func parseServerNotice(text string) *ServerNotice {
+	text = strings.TrimPrefix(text, "*** ")
+	// charybdis prefixes a category: Notice -- ..., inspircd CONNECT: ...
+	if category, rest, ok := strings.Cut(text, " -- "); ok && !strings.Contains(category, " ") {
+		text = rest
+	} else if category, rest, ok := strings.Cut(text, ": "); ok && category == strings.ToUpper(category) {
+		text = rest
+	}
+	sn := &ServerNotice{Text: text}
+	for _, p := range snoticePatterns {
+		m := p.re.FindStringSubmatch(text)
+		if m == nil {
+			continue
+		}
+		sn.Kind = p.kind
+		for i, name := range p.re.SubexpNames() {
+			switch name {
+			case "nick":
+				sn.Nick = m[i]
+			case "oldnick":
+				sn.OldNick = m[i]
+			case "user":
+				sn.User = m[i]
+			case "host":
+				sn.Host = m[i]
+			case "ip":
+				sn.IP = m[i]
+			case "class":
+				sn.Class = m[i]
+			case "realname":
+				sn.Realname = m[i]
+			case "reason":
+				sn.Reason = m[i]
+			case "mask":
+				sn.Mask = m[i]
+			case "by":
+				sn.By = m[i]
+			case "minutes":
+				if n, err := strconv.Atoi(m[i]); err == nil {
+					sn.Duration = time.Duration(n) * time.Minute
+				}
+			}
+		}
+		break
+	}
+	return sn
+}
@@ -0,0 +1,93 @@
+package irc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestServerNotices(t *testing.T) {
+	a, err := New(WithNick("bot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		line     string
+		command  string
+		expected ServerNotice
+	}{
+		{
+			":irc.example.net NOTICE bot :*** Notice -- Client connecting: foo (~foo@host.example) [192.0.2.1] {users} [Foo Bar]\r\n",
+			CommandServerNotice,
+			ServerNotice{Kind: NoticeConnect, Nick: "foo", User: "~foo", Host: "host.example", IP: "192.0.2.1", Class: "users", Realname: "Foo Bar"},
+		},
+		{
+			":irc.example.net NOTICE bot :*** CONNECT: Client connecting on port 6697 (class main): foo!foo@host.example (192.0.2.1) [Foo Bar]\r\n",
+			CommandServerNotice,
+			ServerNotice{Kind: NoticeConnect, Nick: "foo", User: "foo", Host: "host.example", IP: "192.0.2.1", Class: "main", Realname: "Foo Bar"},
+		},
+		{
+			":irc.example.net NOTICE bot :*** Notice -- Client exiting: foo (~foo@host.example) [Quit: bye [now]] [192.0.2.1]\r\n",
+			CommandServerNotice,
+			ServerNotice{Kind: NoticeExit, Nick: "foo", User: "~foo", Host: "host.example", IP: "192.0.2.1", Reason: "Quit: bye [now]"},
+		},
+		{
+			":irc.example.net NOTICE bot :*** Notice -- Nick change: From foo to bar [~foo@host.example]\r\n",
+			CommandServerNotice,
+			ServerNotice{Kind: NoticeNick, OldNick: "foo", Nick: "bar", User: "~foo", Host: "host.example"},
+		},
+		{
+			":irc.example.net NOTICE bot :*** Notice -- oper!o@staff{oper} added global 1440 min. K-Line for [*@192.0.2.1] [spam]\r\n",
+			CommandServerNotice,
+			ServerNotice{Kind: NoticeKline, By: "oper!o@staff", Mask: "*@192.0.2.1", Reason: "spam", Duration: 24 * time.Hour},
+		},
+		{
+			":irc.example.net NOTICE bot :*** Permanent K-Line added for *@192.0.2.1 on Mon Jan 1 00:00:00 2024 GMT by oper [spam]\r\n",
+			CommandServerNotice,
+			ServerNotice{Kind: NoticeKline, By: "oper", Mask: "*@192.0.2.1", Reason: "spam"},
+		},
+		{
+			":irc.example.net NOTICE bot :*** Notice -- oper has removed the temporary K-Line for: [*@192.0.2.1]\r\n",
+			CommandServerNotice,
+			ServerNotice{Kind: NoticeUnkline, By: "oper", Mask: "*@192.0.2.1"},
+		},
+		{
+			":irc.example.net NOTICE bot :*** Global -- from oper: maintenance at noon\r\n",
+			CommandGlobops,
+			ServerNotice{By: "oper", Text: "maintenance at noon"},
+		},
+		{
+			":oper!o@staff WALLOPS :maintenance at noon\r\n",
+			CommandWallops,
+			ServerNotice{By: "oper", Text: "maintenance at noon"},
+		},
+	} {
+		a.rawMsgs <- []byte(tc.line)
+		msg, err := a.ReceiveMessage(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sn, ok := AnnotationServerNotice.Get(msg)
+		if msg.Command != tc.command || !ok {
+			t.Errorf("%q: expected command %s with a notice, got %s", tc.line, tc.command, msg.Command)
+			continue
+		}
+		if tc.expected.Text == "" {
+			tc.expected.Text = sn.Text
+		}
+		tc.expected.Server = sn.Server
+		if *sn != tc.expected {
+			t.Errorf("%q: expected %+v, got %+v", tc.line, tc.expected, *sn)
+		}
+	}
+
+	// Notices from users and services are left alone
+	a.rawMsgs <- []byte(":NickServ!s@services NOTICE bot :*** This nick is registered\r\n")
+	msg, err := a.ReceiveMessage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := AnnotationServerNotice.Get(msg); ok || msg.Command != "NOTICE" {
+		t.Errorf("expected a plain notice, got %s", msg.Command)
+	}
+}
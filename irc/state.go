@@ -0,0 +1,429 @@
+package irc
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/rs/zerolog/log"
+)
+
+// Replies describing channels.
+const (
+	rplChannelModeIs = "324"
+	rplNoTopic       = "331"
+	rplTopic         = "332"
+	rplTopicWhoTime  = "333"
+	rplNamReply      = "353"
+)
+
+// Member is a user in a channel.
+type Member struct {
+	Nick string
+	// User and Host are the member's user@host, once the bot has seen them
+	// join or a WHO has told. They follow changes on servers with chghost.
+	User string
+	Host string
+	// Account is the services account the member is logged in to, and
+	// Realname their real name, as extended-join, account-notify or a WHOX
+	// told.
+	Account  string
+	Realname string
+	// Away is set when the member is known to be away, with their away
+	// message if the server said.
+	Away        bool
+	AwayMessage string
+	// Prefixes are the symbols of the user's membership modes, highest
+	// first, e.g. @+ for an op with voice.
+	Prefixes string
+}
+
+// Mask returns the member's nick!user@host, with * for what isn't known.
+func (m Member) Mask() string {
+	user, host := m.User, m.Host
+	if user == "" {
+		user = "*"
+	}
+	if host == "" {
+		host = "*"
+	}
+	return m.Nick + "!" + user + "@" + host
+}
+
+// Topic is a channel's topic and who set it when, if the server said.
+type Topic struct {
+	Text  string
+	SetBy string
+	SetAt time.Time
+}
+
+// Channel is the state of a channel the bot is in, as it was when Channel
+// was called.
+type Channel struct {
+	Name    string
+	members []Member
+	topic   Topic
+	modes   map[rune]string
+	fold    func(string) string
+}
+
+// Members returns the channel's members, sorted by nick.
+func (ch *Channel) Members() []Member {
+	if ch == nil {
+		return nil
+	}
+	return append([]Member{}, ch.members...)
+}
+
+// Member returns the member with the nick, and whether there is one.
+func (ch *Channel) Member(nick string) (Member, bool) {
+	if ch == nil {
+		return Member{}, false
+	}
+	for _, m := range ch.members {
+		if ch.fold(m.Nick) == ch.fold(nick) {
+			return m, true
+		}
+	}
+	return Member{}, false
+}
+
+// Topic returns the channel's topic.
+func (ch *Channel) Topic() Topic {
+	if ch == nil {
+		return Topic{}
+	}
+	return ch.topic
+}
+
+// Modes returns the channel's modes and their parameters, e.g. n with no
+// parameter and k with the key. List modes such as bans aren't included.
+func (ch *Channel) Modes() map[rune]string {
+	modes := make(map[rune]string)
+	if ch == nil {
+		return modes
+	}
+	for m, param := range ch.modes {
+		modes[m] = param
+	}
+	return modes
+}
+
+// Channel returns the state of the channel, or nil if the bot isn't in it.
+func (a *API) Channel(name string) *Channel {
+	fold := a.folder()
+	a.memberMu.Lock()
+	defer a.memberMu.Unlock()
+	info, ok := a.chans[fold(name)]
+	if !ok {
+		return nil
+	}
+	ch := &Channel{
+		Name:    info.name,
+		members: make([]Member, 0, len(info.members)),
+		topic:   info.topic,
+		modes:   make(map[rune]string, len(info.modes)),
+		fold:    fold,
+	}
+	for _, m := range info.members {
+		ch.members = append(ch.members, *m)
+	}
+	sort.Slice(ch.members, func(i, j int) bool { return fold(ch.members[i].Nick) < fold(ch.members[j].Nick) })
+	for m, param := range info.modes {
+		ch.modes[m] = param
+	}
+	return ch
+}
+
+var _ chatlib.MemberLister = (*API)(nil)
+
+// MemberNicks returns the nicks of the members of channel, or none if the
+// bot isn't in it.
+func (a *API) MemberNicks(channel string) []string {
+	nicks := make([]string, 0)
+	for _, m := range a.Channel(channel).Members() {
+		nicks = append(nicks, m.Nick)
+	}
+	return nicks
+}
+
+// channelInfo is the live state of a channel the bot is in. Members are
+// keyed by their folded nick.
+type channelInfo struct {
+	name    string
+	members map[string]*Member
+	topic   Topic
+	modes   map[rune]string
+}
+
+// trackChannels keeps the state of the bot's channels up to date. The
+// channel's modes, and with WithWhoOnJoin its members, are asked for when
+// the bot joins it.
+func (a *API) trackChannels(c context.Context, msg *chatlib.Message) error {
+	switch msg.Command {
+	case rplNamReply, "JOIN", "PART", "KICK", "QUIT", "NICK", "CHGHOST", "ACCOUNT", "TOPIC", rplNoTopic, rplTopic, rplTopicWhoTime, rplChannelModeIs, "MODE":
+	default:
+		return nil
+	}
+	info := a.ServerInfo()
+	fold := info.Fold
+	var changes []ModeChange
+	switch {
+	case msg.Command == "MODE" && len(msg.Params) > 1 && a.isChannel(msg.Receiver):
+		changes = parseModes(info, msg.Params[1], msg.Params[2:])
+	case msg.Command == rplChannelModeIs && len(msg.Params) > 2:
+		changes = parseModes(info, msg.Params[2], msg.Params[3:])
+	}
+	self := fold(msg.Nick) == fold(a.nick)
+	extendedJoin := a.HasCap("extended-join")
+
+	a.memberMu.Lock()
+	switch msg.Command {
+	case rplNamReply:
+		// <bot> <type> <channel> :<names>
+		if len(msg.Params) < 4 {
+			break
+		}
+		ch := a.channelInfo(fold, msg.Params[2])
+		for _, name := range strings.Fields(msg.Params[3]) {
+			nick := strings.TrimLeft(name, info.PrefixSymbols)
+			m := &Member{Nick: nick, Prefixes: name[:len(name)-len(nick)]}
+			// userhost-in-names sends nick!user@host
+			if n := nickFromPrefix(nick); n != "" {
+				m.Nick = n
+				m.User, m.Host = userHostFromPrefix(nick)
+			}
+			// Keep what a WHO or the join told if NAMES doesn't say
+			if old, ok := ch.members[fold(m.Nick)]; ok {
+				if m.Host == "" {
+					m.User, m.Host = old.User, old.Host
+				}
+				m.Account, m.Realname = old.Account, old.Realname
+			}
+			ch.members[fold(m.Nick)] = m
+		}
+	case "JOIN":
+		if self {
+			// The NAMES reply that follows lists everyone
+			delete(a.chans, fold(msg.Receiver))
+		}
+		m := &Member{Nick: msg.Nick}
+		m.User, m.Host = userHostFromPrefix(msg.Sender)
+		if extendedJoin && len(msg.Params) > 2 {
+			// <channel> <account or *> :<realname>
+			m.Account, m.Realname = msg.Params[1], msg.Params[2]
+		} else {
+			m.Account = msg.Tags["account"]
+		}
+		if m.Account == "*" {
+			m.Account = ""
+		}
+		a.channelInfo(fold, msg.Receiver).members[fold(msg.Nick)] = m
+	case "PART":
+		a.removeMember(fold, msg.Receiver, msg.Nick, self)
+	case "KICK":
+		victim := ""
+		if len(msg.Params) > 1 {
+			victim = msg.Params[1]
+		}
+		a.removeMember(fold, msg.Receiver, victim, fold(victim) == fold(a.nick))
+	case "QUIT":
+		for _, ch := range a.chans {
+			delete(ch.members, fold(msg.Nick))
+		}
+	case "NICK":
+		for _, ch := range a.chans {
+			if m, ok := ch.members[fold(msg.Nick)]; ok {
+				delete(ch.members, fold(msg.Nick))
+				m.Nick = msg.Receiver
+				ch.members[fold(msg.Receiver)] = m
+			}
+		}
+	case "CHGHOST":
+		// <new user> <new host>
+		if len(msg.Params) < 2 {
+			break
+		}
+		for _, ch := range a.chans {
+			if m, ok := ch.members[fold(msg.Nick)]; ok {
+				m.User, m.Host = msg.Params[0], msg.Params[1]
+			}
+		}
+	case "ACCOUNT":
+		// account-notify: <account or *>
+		account := msg.Receiver
+		if account == "*" {
+			account = ""
+		}
+		for _, ch := range a.chans {
+			if m, ok := ch.members[fold(msg.Nick)]; ok {
+				m.Account = account
+			}
+		}
+	case "TOPIC":
+		if ch, ok := a.chans[fold(msg.Receiver)]; ok && len(msg.Params) > 1 {
+			at := msg.Time
+			if at.IsZero() {
+				at = time.Now()
+			}
+			ch.topic = Topic{Text: msg.Params[1], SetBy: msg.Sender, SetAt: at}
+		}
+	case rplNoTopic:
+		if len(msg.Params) < 2 {
+			break
+		}
+		if ch, ok := a.chans[fold(msg.Params[1])]; ok {
+			ch.topic = Topic{}
+		}
+	case rplTopic:
+		// <bot> <channel> :<topic>
+		if len(msg.Params) > 2 {
+			if ch, ok := a.chans[fold(msg.Params[1])]; ok {
+				ch.topic.Text = msg.Params[2]
+			}
+		}
+	case rplTopicWhoTime:
+		// <bot> <channel> <setter> <unix time>
+		if len(msg.Params) > 3 {
+			if ch, ok := a.chans[fold(msg.Params[1])]; ok {
+				ch.topic.SetBy = msg.Params[2]
+				if ts, err := strconv.ParseInt(msg.Params[3], 10, 64); err == nil {
+					ch.topic.SetAt = time.Unix(ts, 0)
+				}
+			}
+		}
+	case rplChannelModeIs:
+		// <bot> <channel> <modes> <params...>
+		if len(msg.Params) < 3 {
+			break
+		}
+		if ch, ok := a.chans[fold(msg.Params[1])]; ok {
+			ch.modes = make(map[rune]string)
+			ch.applyModes(fold, info, changes)
+		}
+	case "MODE":
+		if ch, ok := a.chans[fold(msg.Receiver)]; ok {
+			ch.applyModes(fold, info, changes)
+		}
+	}
+	a.memberMu.Unlock()
+
+	if msg.Command == "JOIN" && self {
+		if err := a.SendMessage(c, &chatlib.Message{Command: "MODE " + msg.Receiver}); err != nil {
+			log.Error().Str("api", ApiName).Err(err).Msgf("error asking for the modes of %s", msg.Receiver)
+		}
+		if a.whoOnJoin {
+			if err := a.sendWho(c, msg.Receiver, whoxJoinToken); err != nil {
+				log.Error().Str("api", ApiName).Err(err).Msgf("error asking who is in %s", msg.Receiver)
+			}
+		}
+	}
+	return nil
+}
+
+// applyModes applies mode changes to the channel. List modes, such as bans,
+// aren't kept.
+func (ch *channelInfo) applyModes(fold func(string) string, info ServerInfo, changes []ModeChange) {
+	for _, change := range changes {
+		if i := strings.IndexRune(info.PrefixModes, change.Mode); i >= 0 {
+			m, ok := ch.members[fold(change.Param)]
+			if !ok {
+				continue
+			}
+			symbol := string(info.PrefixSymbols[i])
+			m.Prefixes = strings.ReplaceAll(m.Prefixes, symbol, "")
+			if change.Add {
+				m.Prefixes += symbol
+			}
+			// Keep the highest prefix first, as servers do
+			m.Prefixes = sortPrefix(m.Prefixes, info.PrefixSymbols)
+			continue
+		}
+		if strings.ContainsRune(info.ChanModes[0], change.Mode) {
+			continue
+		}
+		if change.Add {
+			ch.modes[change.Mode] = change.Param
+		} else {
+			delete(ch.modes, change.Mode)
+		}
+	}
+}
+
+// parseModes parses a mode string and its parameters. Which modes take a
+// parameter is given by the server's PREFIX and CHANMODES.
+func parseModes(info ServerInfo, modes string, params []string) []ModeChange {
+	changes := make([]ModeChange, 0)
+	add := true
+	for _, m := range modes {
+		if m == '+' || m == '-' {
+			add = m == '+'
+			continue
+		}
+		change := ModeChange{Add: add, Mode: m}
+		if takesParam(info, m, add) {
+			if len(params) == 0 {
+				// A list mode without a mask asks for the list
+				continue
+			}
+			change.Param, params = params[0], params[1:]
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// takesParam reports whether mode takes a parameter when set, or unset if
+// not add.
+func takesParam(info ServerInfo, mode rune, add bool) bool {
+	return strings.ContainsRune(info.PrefixModes, mode) ||
+		strings.ContainsRune(info.ChanModes[0], mode) ||
+		strings.ContainsRune(info.ChanModes[1], mode) ||
+		(add && strings.ContainsRune(info.ChanModes[2], mode))
+}
+
+// channelInfo returns the state of channel, adding it if it isn't tracked
+// yet. memberMu must be held.
+func (a *API) channelInfo(fold func(string) string, channel string) *channelInfo {
+	ch, ok := a.chans[fold(channel)]
+	if !ok {
+		ch = &channelInfo{name: channel, members: make(map[string]*Member), modes: make(map[rune]string)}
+		a.chans[fold(channel)] = ch
+	}
+	return ch
+}
+
+// removeMember removes nick from channel, or forgets the channel if it was
+// the bot that left. memberMu must be held.
+func (a *API) removeMember(fold func(string) string, channel, nick string, self bool) {
+	if self {
+		delete(a.chans, fold(channel))
+		return
+	}
+	if ch, ok := a.chans[fold(channel)]; ok {
+		delete(ch.members, fold(nick))
+	}
+}
+
+// resetChannels forgets the server's ISUPPORT tokens and the state of every
+// channel, they are sent again on every connection.
+func (a *API) resetChannels() {
+	a.memberMu.Lock()
+	defer a.memberMu.Unlock()
+	a.supported = make(map[string]string)
+	a.chans = make(map[string]*channelInfo)
+}
+
+// sortPrefix orders the symbols in prefix as they are in symbols.
+func sortPrefix(prefix, symbols string) string {
+	var b strings.Builder
+	for _, s := range symbols {
+		if strings.ContainsRune(prefix, s) {
+			b.WriteRune(s)
+		}
+	}
+	return b.String()
+}
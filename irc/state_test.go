@@ -0,0 +1,110 @@
+package irc
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChannelState(t *testing.T) {
+	a, err := New(WithNick("bot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.conn = &bufConn{}
+	for _, line := range []string{
+		":irc.example.net 005 bot PREFIX=(ohv)@%+ CHANMODES=beI,k,l,imnpst :are supported by this server\r\n",
+		":bot!u@h JOIN #Test\r\n",
+		":irc.example.net 332 bot #test :Welcome\r\n",
+		":irc.example.net 333 bot #test op!u@h 1700000000\r\n",
+		":irc.example.net 353 bot = #test :bot @op %half +voice plain\r\n",
+		":irc.example.net 324 bot #test +ntk secret\r\n",
+		":op!u@h MODE #test +bl-k *!*@spam 50 secret\r\n",
+		":op!u@h MODE #test +o-v voice voice\r\n",
+		":plain!u@h NICK :renamed\r\n",
+		":half!u@h PART #test :bye\r\n",
+		":op!u@h KICK #test renamed :out\r\n",
+		":new!u@h JOIN #test\r\n",
+		"@time=2023-11-05T12:00:00.000Z :op!u@h TOPIC #test :New topic\r\n",
+	} {
+		a.rawMsgs <- []byte(line)
+		if _, err := a.ReceiveMessage(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ch := a.Channel("#TEST")
+	if ch == nil || ch.Name != "#Test" {
+		t.Fatalf("expected to be in #Test, got %+v", ch)
+	}
+	expected := []Member{
+		{Nick: "bot", User: "u", Host: "h"},
+		{Nick: "new", User: "u", Host: "h"},
+		{Nick: "op", Prefixes: "@"},
+		{Nick: "voice", Prefixes: "@"},
+	}
+	if got := ch.Members(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected members %v, got %v", expected, got)
+	}
+	if nicks := a.MemberNicks("#test"); !reflect.DeepEqual(nicks, []string{"bot", "new", "op", "voice"}) {
+		t.Errorf("unexpected member nicks %v", nicks)
+	}
+	if m, ok := ch.Member("OP"); !ok || m.Prefixes != "@" {
+		t.Errorf("expected op to be an op, got %v", m)
+	}
+	if got := ch.Modes(); !reflect.DeepEqual(got, map[rune]string{'n': "", 't': "", 'l': "50"}) {
+		t.Errorf("unexpected modes %v", got)
+	}
+	topic := ch.Topic()
+	if topic.Text != "New topic" || topic.SetBy != "op!u@h" || !topic.SetAt.Equal(time.Date(2023, 11, 5, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected topic %+v", topic)
+	}
+
+	a.rawMsgs <- []byte(":op!u@h KICK #test bot :bye\r\n")
+	if _, err := a.ReceiveMessage(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ch := a.Channel("#test"); ch != nil || ch.Members() != nil {
+		t.Errorf("expected to have left the channel, got %+v", ch)
+	}
+}
+
+func TestMemberHostAndAccount(t *testing.T) {
+	a, err := New(WithNick("bot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.conn = &bufConn{}
+	a.grantedCaps = map[string]bool{"extended-join": true, "chghost": true, "account-notify": true}
+	for _, line := range []string{
+		":bot!u@h JOIN #test * :Bot\r\n",
+		":irc.example.net 353 bot = #test :bot alice\r\n",
+		":alice!a@old.example.net JOIN #other alice :Alice Liddell\r\n",
+		":bob!b@h JOIN #test * :Bob\r\n",
+		":alice!a@old.example.net JOIN #test alice :Alice Liddell\r\n",
+		":alice!a@old.example.net CHGHOST al cloaked/alice\r\n",
+		":bob!b@h ACCOUNT bob\r\n",
+	} {
+		a.rawMsgs <- []byte(line)
+		if _, err := a.ReceiveMessage(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []Member{
+		{Nick: "alice", User: "al", Host: "cloaked/alice", Account: "alice", Realname: "Alice Liddell"},
+		{Nick: "bob", User: "b", Host: "h", Account: "bob", Realname: "Bob"},
+		{Nick: "bot", User: "u", Host: "h", Realname: "Bot"},
+	}
+	if got := a.Channel("#test").Members(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected members %v, got %v", expected, got)
+	}
+	if m, _ := a.Channel("#other").Member("alice"); m.Mask() != "alice!al@cloaked/alice" {
+		t.Errorf("expected the host change in every channel, got %s", m.Mask())
+	}
+	if mask := a.BanMask("alice"); mask != "*!*@cloaked/alice" {
+		t.Errorf("expected a ban on the new host, got %s", mask)
+	}
+	if account, ok := a.AccountOf("alice"); !ok || account != "alice" {
+		t.Errorf("expected alice's account from the join, got %q", account)
+	}
+}
@@ -0,0 +1,218 @@
+package irc
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// stsKey returns where the STS policy of host is kept in the Store, shared
+// by every network. Each host has a key of its own so that APIs connected to
+// different hosts don't overwrite each other's policies.
+func stsKey(host string) string {
+	return ApiName + "/sts/" + strings.ToLower(host)
+}
+
+// maxSTSDuration is the longest a policy is kept, however long the server
+// asks for.
+const maxSTSDuration = 365 * 24 * time.Hour
+
+// stsPolicy is an IRCv3 strict transport security policy of a host: it must
+// be connected to with TLS on Port until Expires. Policies learnt over
+// plaintext only upgrade the connection, they have no expiry and aren't
+// kept across restarts.
+type stsPolicy struct {
+	Port    int       `json:"port"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (p stsPolicy) active(now time.Time) bool {
+	return p.Expires.IsZero() || now.Before(p.Expires)
+}
+
+// stsState is the STS policies known to the API.
+type stsState struct {
+	disabled bool
+	// secure tells whether the current connection uses TLS.
+	secure bool
+
+	mu sync.Mutex
+	// loaded holds the hosts whose policy was looked up in the Store.
+	loaded   map[string]bool
+	policies map[string]stsPolicy
+	// upgrading is set when the connection was closed to reconnect with TLS.
+	upgrading bool
+	// tls configures connections upgraded by a policy, the defaults if nil.
+	tls *tls.Config
+}
+
+// WithSTS honors the STS policies servers advertise, as IRCv3 requires: the
+// bot reconnects with TLS on the port a server advertises over plaintext,
+// and keeps connecting with TLS for as long as the policy lasts, refusing
+// plaintext. Policies are kept in the Store. Enabled by default.
+func WithSTS(enabled bool) Option {
+	return func(a *API) error {
+		a.sts.disabled = !enabled
+		return nil
+	}
+}
+
+// parseSTS parses the value of the sts capability, e.g.
+// port=6697,duration=300.
+func parseSTS(value string) map[string]string {
+	keys := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		k, v, _ := strings.Cut(item, "=")
+		keys[strings.ToLower(k)] = v
+	}
+	return keys
+}
+
+// stsPolicyFor returns the active policy of host, loading it from the Store
+// the first time.
+func (a *API) stsPolicyFor(c context.Context, host string) (stsPolicy, bool) {
+	if a.sts.disabled {
+		return stsPolicy{}, false
+	}
+	host = strings.ToLower(host)
+	s := &a.sts
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := a.loadSTS(c, host); err != nil {
+		log.Error().Str("api", ApiName).Str("host", host).Err(err).Msg("error loading sts policy")
+	}
+	p, ok := s.policies[host]
+	if !ok || !p.active(time.Now()) {
+		return stsPolicy{}, false
+	}
+	return p, true
+}
+
+// loadSTS adds the policy of host kept in the Store, unless it was already
+// looked up. a.sts.mu is held.
+func (a *API) loadSTS(c context.Context, host string) error {
+	s := &a.sts
+	if s.policies == nil {
+		s.policies = make(map[string]stsPolicy)
+		s.loaded = make(map[string]bool)
+	}
+	if a.store == nil || s.loaded[host] {
+		return nil
+	}
+	s.loaded[host] = true
+	bts, err := a.store.Get(c, stsKey(host))
+	if errors.Is(err, chatlib.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var p stsPolicy
+	if err := json.Unmarshal(bts, &p); err != nil {
+		return errors.Wrap(err, "irc: invalid sts policy in store")
+	}
+	if _, ok := s.policies[host]; !ok {
+		s.policies[host] = p
+	}
+	return nil
+}
+
+// setSTSPolicy sets or, with a zero port, removes the policy of host. Only
+// policies that expire are saved.
+func (a *API) setSTSPolicy(c context.Context, host string, p stsPolicy) error {
+	host = strings.ToLower(host)
+	s := &a.sts
+	s.mu.Lock()
+	if err := a.loadSTS(c, host); err != nil {
+		log.Error().Str("api", ApiName).Str("host", host).Err(err).Msg("error loading sts policy")
+	}
+	if p.Port == 0 {
+		delete(s.policies, host)
+	} else {
+		s.policies[host] = p
+	}
+	s.mu.Unlock()
+	if a.store == nil {
+		return nil
+	}
+	if p.Port == 0 || p.Expires.IsZero() {
+		if err := a.store.Delete(c, stsKey(host)); err != nil && !errors.Is(err, chatlib.ErrNotFound) {
+			return errors.WithMessage(err, "irc: error removing sts policy")
+		}
+		return nil
+	}
+	bts, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return errors.WithMessage(a.store.Set(c, stsKey(host), bts), "irc: error saving sts policy")
+}
+
+// handleSTS applies the sts capability the server advertised. Over TLS the
+// policy is kept, or removed for a duration of 0. Over plaintext the
+// connection is closed to reconnect with TLS on the advertised port, and it
+// reports true.
+func (a *API) handleSTS(c context.Context) bool {
+	value, ok := a.CapValue("sts")
+	if !ok || a.sts.disabled {
+		return false
+	}
+	keys := parseSTS(value)
+	if !a.sts.secure {
+		port, err := strconv.Atoi(keys["port"])
+		if err != nil || port <= 0 || port > 65535 {
+			log.Warn().Str("api", ApiName).Msgf("ignoring sts policy without a valid port: %s", value)
+			return false
+		}
+		log.Info().Str("api", ApiName).Str("server", a.serverPort()).Int("port", port).Msg("server requires tls, reconnecting")
+		a.setSTSPolicy(c, a.networkHost, stsPolicy{Port: port})
+		a.sts.mu.Lock()
+		a.sts.upgrading = true
+		a.sts.mu.Unlock()
+		a.conn.Close()
+		return true
+	}
+	duration, err := strconv.ParseInt(keys["duration"], 10, 64)
+	if err != nil || duration < 0 {
+		log.Warn().Str("api", ApiName).Msgf("ignoring sts policy without a valid duration: %s", value)
+		return false
+	}
+	// Anything longer would overflow a time.Duration
+	duration = min(duration, int64(maxSTSDuration/time.Second))
+	p := stsPolicy{}
+	if duration > 0 {
+		p = stsPolicy{Port: a.networkPort, Expires: time.Now().Add(time.Duration(duration) * time.Second)}
+		log.Debug().Str("api", ApiName).Str("host", a.networkHost).Time("expires", p.Expires).Msg("sts policy")
+	} else {
+		log.Info().Str("api", ApiName).Str("host", a.networkHost).Msg("sts policy removed")
+	}
+	if err := a.setSTSPolicy(c, a.networkHost, p); err != nil {
+		log.Error().Str("api", ApiName).Err(err).Msg("error saving sts policy")
+	}
+	return false
+}
+
+// upgradeSTS reconnects with TLS after handleSTS closed the plaintext
+// connection, and reports whether it did.
+func (a *API) upgradeSTS(c context.Context) bool {
+	a.sts.mu.Lock()
+	upgrading := a.sts.upgrading
+	a.sts.upgrading = false
+	a.sts.mu.Unlock()
+	if !upgrading {
+		return false
+	}
+	if err := a.connect(c); err != nil {
+		log.Error().Str("api", ApiName).Err(err).Msg("error reconnecting with tls")
+		return false
+	}
+	a.loginAgain(c)
+	return true
+}
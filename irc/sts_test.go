@@ -0,0 +1,201 @@
+package irc
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"golang.org/x/net/nettest"
+)
+
+// testCert returns a certificate for 127.0.0.1 and a pool trusting it.
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// readUntil reads lines from r until one starts with prefix.
+func readUntil(t *testing.T, conn net.Conn, r *bufio.Reader, prefix string) {
+	t.Helper()
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected %s, got %v", prefix, err)
+		}
+		if strings.HasPrefix(line, prefix) {
+			return
+		}
+	}
+}
+
+// storedSTS returns the policy of host kept in store, if any.
+func storedSTS(t *testing.T, c context.Context, store chatlib.Store, host string) (stsPolicy, bool) {
+	t.Helper()
+	var policy stsPolicy
+	bts, err := store.Get(c, stsKey(host))
+	if errors.Is(err, chatlib.ErrNotFound) {
+		return policy, false
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(bts, &policy); err != nil {
+		t.Fatal(err)
+	}
+	return policy, true
+}
+
+func TestSTS(t *testing.T) {
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cert, pool := testCert(t)
+	plain, err := nettest.NewLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	l, err := nettest.NewLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secure := tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer secure.Close()
+	host, port, _ := net.SplitHostPort(plain.Addr().String())
+	p, _ := strconv.Atoi(port)
+	_, securePort, _ := net.SplitHostPort(secure.Addr().String())
+
+	store := chatlib.NewMemoryStore()
+	a, err := New(WithNick("bot"), WithNetwork(host, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.UseStore(store)
+	a.loginDelaySeconds = 0
+	a.sts.tls = &tls.Config{RootCAs: pool}
+	go func() {
+		for c.Err() == nil {
+			a.ReceiveMessage(c)
+		}
+	}()
+	if err := a.connect(c); err != nil {
+		t.Fatal(err)
+	}
+	go a.pollConn(c)
+	if err := a.login(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Over plaintext, the policy only makes the bot reconnect with TLS
+	conn, err := plain.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	readUntil(t, conn, r, "CAP LS")
+	conn.Write([]byte(":irc.example.net CAP * LS :sts=port=" + securePort + ",duration=300 server-time\r\n"))
+	tc, err := secure.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	r = bufio.NewReader(tc)
+	readUntil(t, tc, r, "CAP LS")
+	if policy, ok := storedSTS(t, c, store, host); ok {
+		t.Errorf("expected a policy learnt over plaintext not to be kept, got %+v", policy)
+	}
+
+	// Over TLS, it is kept for its duration
+	tc.Write([]byte(":irc.example.net CAP * LS :sts=port=" + securePort + ",duration=300 server-time\r\n"))
+	readUntil(t, tc, r, "CAP REQ")
+	if policy, _ := storedSTS(t, c, store, host); strconv.Itoa(policy.Port) != securePort || time.Until(policy.Expires) < 299*time.Second {
+		t.Errorf("unexpected policy %+v", policy)
+	}
+	// Policies of other hosts are kept apart
+	other := stsPolicy{Port: 6697, Expires: time.Now().Add(time.Hour)}
+	if err := a.setSTSPolicy(c, "irc.example.org", other); err != nil {
+		t.Fatal(err)
+	}
+	if policy, ok := storedSTS(t, c, store, host); !ok || strconv.Itoa(policy.Port) != securePort {
+		t.Errorf("expected the policy of %s to be kept, got %+v", host, policy)
+	}
+
+	// A later run connects with TLS straight away, refusing plaintext
+	b, err := New(WithNick("bot"), WithNetwork(host, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.UseStore(store)
+	b.sts.tls = &tls.Config{RootCAs: pool}
+	go func() {
+		if conn, err := secure.Accept(); err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	if err := b.connect(c); err != nil {
+		t.Fatal(err)
+	}
+	b.conn.Close()
+	if b.Server() != secure.Addr().String() || !b.sts.secure {
+		t.Errorf("expected to connect to %s with tls, got %s", secure.Addr(), b.Server())
+	}
+
+	// Durations too long for a time.Duration are capped
+	a.capMu.Lock()
+	a.availableCaps["sts"] = "port=" + securePort + ",duration=9223372036854775807"
+	a.capMu.Unlock()
+	a.handleSTS(c)
+	if policy, _ := storedSTS(t, c, store, host); policy.Expires.Before(time.Now().Add(maxSTSDuration-time.Hour)) || policy.Expires.After(time.Now().Add(maxSTSDuration)) {
+		t.Errorf("expected the policy to last %s, got %+v", maxSTSDuration, policy)
+	}
+
+	// A duration of 0 removes the policy
+	a.capMu.Lock()
+	a.availableCaps["sts"] = "port=" + securePort + ",duration=0"
+	a.capMu.Unlock()
+	a.handleSTS(c)
+	if policy, ok := storedSTS(t, c, store, host); ok {
+		t.Errorf("expected the policy to be removed, got %+v", policy)
+	}
+	if _, ok := storedSTS(t, c, store, "irc.example.org"); !ok {
+		t.Error("expected the policy of another host to be kept")
+	}
+	if err := a.Stop(c); err != nil {
+		t.Fatal(err)
+	}
+}
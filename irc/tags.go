@@ -0,0 +1,70 @@
+package irc
+
+import (
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// parseTags parses the IRCv3 message tags at the start of a line, without
+// the leading @. Client-only tags keep their + prefix and vendor tags their
+// vendor/ prefix. Tags without a value map to the empty string.
+func parseTags(raw string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(tag, "=")
+		tags[k] = unescapeTag(v)
+	}
+	return tags
+}
+
+// unescapeTag decodes a tag value escaped as the message-tags spec requires.
+// Unknown escapes drop the backslash, as does one at the end of the value.
+func unescapeTag(v string) string {
+	if !strings.Contains(v, `\`) {
+		return v
+	}
+	var sb strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' {
+			sb.WriteByte(v[i])
+			continue
+		}
+		i++
+		if i == len(v) {
+			break
+		}
+		switch v[i] {
+		case ':':
+			sb.WriteByte(';')
+		case 's':
+			sb.WriteByte(' ')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'n':
+			sb.WriteByte('\n')
+		default:
+			sb.WriteByte(v[i])
+		}
+	}
+	return sb.String()
+}
+
+// serverTime returns the value of the IRCv3 server-time tag, or the zero time
+// if it isn't present or can't be parsed.
+func serverTime(tags map[string]string) time.Time {
+	v, ok := tags["time"]
+	if !ok {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		log.Warn().Str("api", ApiName).Err(err).Msgf("invalid server-time tag: %s", v)
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,48 @@
+package irc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseTags(t *testing.T) {
+	tags := parseTags(`msgid=abc;account=foo;+draft/reply=123;vendor.example/flag;display-name=Foo\sBar\:\\x\;time=2023-11-05T12:00:00.000Z`)
+	expected := map[string]string{
+		"msgid":               "abc",
+		"account":             "foo",
+		"+draft/reply":        "123",
+		"vendor.example/flag": "",
+		"display-name":        `Foo Bar;\x`,
+		"time":                "2023-11-05T12:00:00.000Z",
+	}
+	if len(tags) != len(expected) {
+		t.Fatalf("expected %d tags, got %v", len(expected), tags)
+	}
+	for k, v := range expected {
+		if tags[k] != v {
+			t.Errorf("tag %s: expected %q, got %q", k, v, tags[k])
+		}
+	}
+	if ts := serverTime(tags); !ts.Equal(time.Date(2023, 11, 5, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected server time: %s", ts)
+	}
+}
+
+func TestReceiveTaggedMessage(t *testing.T) {
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.rawMsgs <- []byte("@account=foo;msgid=abc :foo!bar@baz PRIVMSG #test :hello\r\n")
+	msg, err := a.ReceiveMessage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Command != "PRIVMSG" || msg.Nick != "foo" || msg.Text != "hello" {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+	if msg.Tags["account"] != "foo" || msg.Tags["msgid"] != "abc" {
+		t.Errorf("unexpected tags: %v", msg.Tags)
+	}
+}
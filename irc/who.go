@@ -0,0 +1,228 @@
+package irc
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+)
+
+const DefaultWhoTimeoutSeconds = 10
+
+// Replies to WHO.
+const (
+	rplEndOfWho  = "315"
+	rplWhoReply  = "352"
+	rplWhoxReply = "354"
+)
+
+// WHOX tokens, telling the replies to Who apart from those to the WHO sent
+// on joining a channel.
+const (
+	whoxQueryToken = "151"
+	whoxJoinToken  = "152"
+)
+
+// whoxFields asks WHOX for the token, channel, user, host, server, nick,
+// flags, account and realname, which it replies with in that order.
+const whoxFields = "%tcuhsnfar"
+
+// WhoEntry is a user matching a WHO.
+type WhoEntry struct {
+	// Channel is a channel the user is in, or * if the server didn't say.
+	Channel  string
+	Nick     string
+	User     string
+	Host     string
+	Server   string
+	Realname string
+	// Account is the account the user is logged in to. It is only known on
+	// servers supporting WHOX.
+	Account string
+	// Away reports whether the user is marked as away.
+	Away bool
+	// Oper reports whether the user is an IRC operator.
+	Oper bool
+	// Prefixes are the symbols of the user's membership modes in Channel.
+	Prefixes string
+}
+
+// Mask returns the entry's nick!user@host.
+func (e WhoEntry) Mask() string {
+	return e.Nick + "!" + e.User + "@" + e.Host
+}
+
+// WithWhoTimeout sets how long Who waits for the server to answer.
+func WithWhoTimeout(seconds float64) Option {
+	return func(a *API) error {
+		a.whoTimeoutSeconds = seconds
+		return nil
+	}
+}
+
+// WithWhoOnJoin sends a WHO for every channel the bot joins, so the users,
+// hosts and, with WHOX, accounts of its members are known at once rather
+// than as each of them speaks or joins.
+func WithWhoOnJoin(enabled bool) Option {
+	return func(a *API) error {
+		a.whoOnJoin = enabled
+		return nil
+	}
+}
+
+// whoRequest collects the replies to a WHO.
+type whoRequest struct {
+	mask    string
+	entries []WhoEntry
+	done    chan struct{}
+}
+
+// Who asks the server for the users matching mask, e.g. everyone in a
+// channel, in one round trip. It uses WHOX where the server supports it,
+// which also tells the users' accounts. The replies update the state of
+// the bot's channels and the known accounts. Only one Who runs at a time.
+func (a *API) Who(c context.Context, mask string) ([]WhoEntry, error) {
+	select {
+	case a.whoSem <- struct{}{}:
+	case <-c.Done():
+		return nil, c.Err()
+	}
+	defer func() { <-a.whoSem }()
+	c, cancel := context.WithTimeout(c, time.Duration(float64(time.Second)*a.whoTimeoutSeconds))
+	defer cancel()
+
+	req := &whoRequest{mask: a.folder()(mask), done: make(chan struct{})}
+	a.whoMu.Lock()
+	a.whoReq = req
+	a.whoMu.Unlock()
+	defer func() {
+		a.whoMu.Lock()
+		a.whoReq = nil
+		a.whoMu.Unlock()
+	}()
+	if err := a.sendWho(c, mask, whoxQueryToken); err != nil {
+		return nil, err
+	}
+	select {
+	case <-c.Done():
+		return nil, errors.Wrapf(chatlib.ErrTimeout, "irc: timed out waiting for WHO %s", mask)
+	case <-req.done:
+	}
+	a.whoMu.Lock()
+	defer a.whoMu.Unlock()
+	return req.entries, nil
+}
+
+// sendWho sends a WHO for mask, as WHOX with token if the server supports
+// it.
+func (a *API) sendWho(c context.Context, mask, token string) error {
+	command := "WHO " + mask
+	if _, ok := a.isupport("WHOX"); ok {
+		command += " " + whoxFields + "," + token
+	}
+	return a.SendMessage(c, &chatlib.Message{Command: command})
+}
+
+// handleWho feeds the replies to WHO into the state of the bot's channels
+// and the known accounts, and passes them to the running Who.
+func (a *API) handleWho(msg *chatlib.Message) {
+	var e WhoEntry
+	token := whoxQueryToken
+	switch msg.Command {
+	case rplWhoReply:
+		// <bot> <channel> <user> <host> <server> <nick> <flags> :<hops> <realname>
+		if len(msg.Params) < 7 {
+			return
+		}
+		e = WhoEntry{Channel: msg.Params[1], User: msg.Params[2], Host: msg.Params[3], Server: msg.Params[4], Nick: msg.Params[5]}
+		a.parseWhoFlags(&e, msg.Params[6])
+		if len(msg.Params) > 7 {
+			_, e.Realname, _ = strings.Cut(msg.Params[7], " ")
+		}
+	case rplWhoxReply:
+		// <bot> <token> <channel> <user> <host> <server> <nick> <flags> <account> :<realname>
+		if len(msg.Params) < 10 || msg.Params[1] != whoxQueryToken && msg.Params[1] != whoxJoinToken {
+			return
+		}
+		token = msg.Params[1]
+		e = WhoEntry{Channel: msg.Params[2], User: msg.Params[3], Host: msg.Params[4], Server: msg.Params[5], Nick: msg.Params[6], Realname: msg.Params[9]}
+		a.parseWhoFlags(&e, msg.Params[7])
+		// 0 means not logged in
+		if account := msg.Params[8]; account != "0" {
+			e.Account = account
+		}
+		a.setAccount(e.Nick, e.Account)
+	case rplEndOfWho:
+		// <bot> <mask> :End of WHO list
+		a.whoMu.Lock()
+		defer a.whoMu.Unlock()
+		if req := a.whoReq; req != nil && len(msg.Params) > 1 && a.folder()(msg.Params[1]) == req.mask {
+			select {
+			case <-req.done:
+			default:
+				close(req.done)
+			}
+		}
+		return
+	default:
+		return
+	}
+	a.updateMember(e, msg.Command == rplWhoxReply)
+
+	a.whoMu.Lock()
+	defer a.whoMu.Unlock()
+	req := a.whoReq
+	if req == nil || token != whoxQueryToken {
+		return
+	}
+	// Plain WHO replies can't be told apart from those to the WHO sent on
+	// joining, but a channel's members can
+	fold := a.folder()
+	if a.isChannel(req.mask) && fold(e.Channel) != req.mask {
+		return
+	}
+	req.entries = append(req.entries, e)
+}
+
+// parseWhoFlags sets what the flags of a WHO reply say: H or G for here or
+// gone, * for operators and the membership prefixes.
+func (a *API) parseWhoFlags(e *WhoEntry, flags string) {
+	_, symbols := a.prefixes()
+	for _, f := range flags {
+		switch {
+		case f == 'G':
+			e.Away = true
+		case f == '*':
+			e.Oper = true
+		case strings.ContainsRune(symbols, f):
+			e.Prefixes += string(f)
+		}
+	}
+}
+
+// updateMember records the user, host, realname, account and whether a
+// member of one of the bot's channels is away from a WHO reply, adding the
+// member if it wasn't known. Accounts are only known from WHOX replies.
+func (a *API) updateMember(e WhoEntry, whox bool) {
+	fold := a.folder()
+	a.memberMu.Lock()
+	defer a.memberMu.Unlock()
+	ch, ok := a.chans[fold(e.Channel)]
+	if !ok {
+		return
+	}
+	m, ok := ch.members[fold(e.Nick)]
+	if !ok {
+		m = &Member{Nick: e.Nick, Prefixes: e.Prefixes}
+		ch.members[fold(e.Nick)] = m
+	}
+	m.User, m.Host, m.Realname = e.User, e.Host, e.Realname
+	if whox {
+		m.Account = e.Account
+	}
+	if m.Away != e.Away {
+		m.Away, m.AwayMessage = e.Away, ""
+	}
+}
@@ -0,0 +1,126 @@
+package irc
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWho(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	receive := func(line string) {
+		t.Helper()
+		a.rawMsgs <- []byte(line)
+		if _, err := a.ReceiveMessage(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive(":irc.example.net 005 bot PREFIX=(ov)@+ WHOX :are supported by this server\r\n")
+	receive(":bot!u@h JOIN #test\r\n")
+	receive(":irc.example.net 353 bot = #test :bot @alice bob\r\n")
+	conn.Reset()
+
+	type result struct {
+		entries []WhoEntry
+		err     error
+	}
+	done := make(chan result)
+	go func() {
+		entries, err := a.Who(c, "#Test")
+		done <- result{entries, err}
+	}()
+	for i := 0; ; i++ {
+		a.whoMu.Lock()
+		started := a.whoReq != nil
+		a.whoMu.Unlock()
+		if started {
+			break
+		}
+		if i == 100 {
+			t.Fatal("timed out waiting for WHO")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, line := range []string{
+		":irc.example.net 354 bot 151 #test al alice.example.com irc.example.net alice H@ alice_account :Alice A\r\n",
+		":irc.example.net 354 bot 151 #test bob bob.example.com irc.example.net bob G* 0 :Bob\r\n",
+		// The WHO sent on joining another channel
+		":irc.example.net 354 bot 152 #other c c.example.com irc.example.net carol H carol :Carol\r\n",
+		":irc.example.net 354 bot 151 #test d dave.example.com irc.example.net dave H+ 0 :Dave\r\n",
+		":irc.example.net 315 bot #test :End of WHO list\r\n",
+	} {
+		receive(line)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if line := conn.next(); line != "WHO #Test %tcuhsnfar,151\n" {
+		t.Errorf("expected a WHOX, got %q", line)
+	}
+	expected := []WhoEntry{
+		{Channel: "#test", Nick: "alice", User: "al", Host: "alice.example.com", Server: "irc.example.net", Realname: "Alice A", Account: "alice_account", Prefixes: "@"},
+		{Channel: "#test", Nick: "bob", User: "bob", Host: "bob.example.com", Server: "irc.example.net", Realname: "Bob", Away: true, Oper: true},
+		{Channel: "#test", Nick: "dave", User: "d", Host: "dave.example.com", Server: "irc.example.net", Realname: "Dave", Prefixes: "+"},
+	}
+	if !reflect.DeepEqual(r.entries, expected) {
+		t.Errorf("expected %+v, got %+v", expected, r.entries)
+	}
+	if expected[0].Mask() != "alice!al@alice.example.com" {
+		t.Errorf("unexpected mask %s", expected[0].Mask())
+	}
+
+	// The replies update the channel and the accounts
+	ch := a.Channel("#test")
+	if m, _ := ch.Member("alice"); m.User != "al" || m.Host != "alice.example.com" || m.Prefixes != "@" {
+		t.Errorf("expected alice's user and host to be known, got %+v", m)
+	}
+	if m, ok := ch.Member("dave"); !ok || m.Prefixes != "+" {
+		t.Errorf("expected dave to be added, got %+v", m)
+	}
+	if account, ok := a.AccountOf("alice"); !ok || account != "alice_account" {
+		t.Errorf("expected alice's account, got %q", account)
+	}
+	if _, ok := a.AccountOf("bob"); ok {
+		t.Error("expected bob not to be logged in")
+	}
+	if account, _ := a.AccountOf("carol"); account != "carol" {
+		t.Error("expected the join WHO to update accounts")
+	}
+}
+
+func TestWhoPlain(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"), WithWhoTimeout(0.1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	for _, line := range []string{
+		":bot!u@h JOIN #test\r\n",
+		":irc.example.net 352 bot #test al alice.example.com irc.example.net alice H@ :0 Alice A\r\n",
+	} {
+		a.rawMsgs <- []byte(line)
+		if _, err := a.ReceiveMessage(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.next()
+	if line := conn.next(); line != "WHO #test\n" {
+		t.Errorf("expected a plain WHO on joining, got %q", line)
+	}
+	if m, ok := a.Channel("#test").Member("alice"); !ok || m.Host != "alice.example.com" {
+		t.Errorf("expected alice to be added from WHO, got %+v", m)
+	}
+	if _, err := a.Who(c, "alice"); err == nil {
+		t.Error("expected Who to time out")
+	}
+}
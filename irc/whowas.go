@@ -0,0 +1,226 @@
+package irc
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const DefaultWhowasTimeoutSeconds = 10
+
+// Replies to WHOWAS, along with rplWhoisAccount. Nicks nobody used get 406
+// ERR_WASNOSUCHNICK before the end.
+const (
+	rplWhoisServer = "312"
+	rplWhowasUser  = "314"
+	rplEndOfWhowas = "369"
+)
+
+// signoffLayouts are the formats servers give the signoff time in, in place
+// of the server's description.
+var signoffLayouts = []string{time.ANSIC, time.UnixDate, time.RFC1123, time.RFC1123Z}
+
+// WhowasEntry is what the server remembers of a user who used a nick,
+// after they quit or changed nicks.
+type WhowasEntry struct {
+	Nick     string
+	User     string
+	Host     string
+	Realname string
+	// Server is the server the user was connected to.
+	Server string
+	// Signoff is when the user left, if the server said.
+	Signoff time.Time
+	// Account is the account the user was logged in to, on servers that say.
+	Account string
+}
+
+// Mask returns the entry's nick!user@host.
+func (e WhowasEntry) Mask() string {
+	return e.Nick + "!" + e.User + "@" + e.Host
+}
+
+// WithWhowasTimeout sets how long Whowas waits for the server to answer.
+func WithWhowasTimeout(seconds float64) Option {
+	return func(a *API) error {
+		a.whowasTimeoutSeconds = seconds
+		return nil
+	}
+}
+
+// whowasRequest collects the replies to a WHOWAS.
+type whowasRequest struct {
+	nick    string
+	entries []WhowasEntry
+	done    chan struct{}
+}
+
+// Whowas asks the server what it remembers of the users who used nick, most
+// recent first. It returns no entries and no error if the server remembers
+// nobody. Only one WHOWAS runs at a time.
+func (a *API) Whowas(c context.Context, nick string) ([]WhowasEntry, error) {
+	select {
+	case a.whowasSem <- struct{}{}:
+	case <-c.Done():
+		return nil, c.Err()
+	}
+	defer func() { <-a.whowasSem }()
+	c, cancel := context.WithTimeout(c, time.Duration(float64(time.Second)*a.whowasTimeoutSeconds))
+	defer cancel()
+
+	req := &whowasRequest{nick: a.folder()(nick), done: make(chan struct{})}
+	a.whowasMu.Lock()
+	a.whowasReq = req
+	a.whowasMu.Unlock()
+	defer func() {
+		a.whowasMu.Lock()
+		a.whowasReq = nil
+		a.whowasMu.Unlock()
+	}()
+	if err := a.SendMessage(c, &chatlib.Message{Command: "WHOWAS " + nick}); err != nil {
+		return nil, err
+	}
+	select {
+	case <-c.Done():
+		return nil, errors.Wrapf(chatlib.ErrTimeout, "irc: timed out waiting for WHOWAS %s", nick)
+	case <-req.done:
+	}
+	a.whowasMu.Lock()
+	defer a.whowasMu.Unlock()
+	return req.entries, nil
+}
+
+// handleWhowas passes replies to WHOWAS to the running Whowas. Each entry
+// starts with a 314 and the 312 and 330 following it belong to it.
+func (a *API) handleWhowas(msg *chatlib.Message) {
+	a.whowasMu.Lock()
+	defer a.whowasMu.Unlock()
+	req := a.whowasReq
+	if req == nil || len(msg.Params) < 2 || a.folder()(msg.Params[1]) != req.nick {
+		return
+	}
+	last := len(req.entries) - 1
+	switch msg.Command {
+	case rplWhowasUser:
+		// <bot> <nick> <user> <host> * :<realname>
+		if len(msg.Params) < 4 {
+			return
+		}
+		e := WhowasEntry{Nick: msg.Params[1], User: msg.Params[2], Host: msg.Params[3]}
+		if len(msg.Params) > 5 {
+			e.Realname = msg.Params[5]
+		}
+		req.entries = append(req.entries, e)
+	case rplWhoisServer:
+		// <bot> <nick> <server> :<signoff time>
+		if last < 0 || len(msg.Params) < 3 {
+			return
+		}
+		req.entries[last].Server = msg.Params[2]
+		if len(msg.Params) > 3 {
+			req.entries[last].Signoff = parseSignoff(msg.Params[3])
+		}
+	case rplWhoisAccount:
+		// <bot> <nick> <account> :was logged in as
+		if last >= 0 && len(msg.Params) > 2 {
+			req.entries[last].Account = msg.Params[2]
+		}
+	case rplEndOfWhowas:
+		select {
+		case <-req.done:
+		default:
+			close(req.done)
+		}
+	}
+}
+
+func parseSignoff(s string) time.Time {
+	for _, layout := range signoffLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// channelsOf returns the channels the bot shares with nick.
+func (a *API) channelsOf(nick string) []string {
+	fold := a.folder()
+	a.memberMu.Lock()
+	defer a.memberMu.Unlock()
+	channels := make([]string, 0)
+	for _, ch := range a.chans {
+		if _, ok := ch.members[fold(nick)]; ok {
+			channels = append(channels, ch.name)
+		}
+	}
+	return channels
+}
+
+// actionSeen tells whether a nick is online, or when it was last seen
+// according to WHOWAS if it isn't. The WHOWAS is waited for in the
+// background, as its replies can't be received while an action runs.
+func (a *API) actionSeen(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+	nick := re.FindStringSubmatch(msg.Text)[1]
+	reply := func(text string) error {
+		return a.SendMessage(c, &chatlib.Message{
+			Command:  "PRIVMSG",
+			Receiver: msg.ReplyTarget(),
+			Text:     text,
+		})
+	}
+	if text, ok := a.online(nick, msg.Channel()); ok {
+		return reply(text)
+	}
+	go func() {
+		entries, err := a.Whowas(c, nick)
+		if err != nil {
+			log.Error().Str("api", ApiName).Str("nick", nick).Err(err).Msg("error looking up nick")
+			return
+		}
+		if err := reply(lastSeen(nick, entries)); err != nil {
+			log.Error().Str("api", ApiName).Err(err).Msg("error sending reply")
+		}
+	}()
+	return nil
+}
+
+// online describes where nick is if the bot shares a channel with them.
+func (a *API) online(nick, channel string) (string, bool) {
+	fold := a.folder()
+	if fold(nick) == fold(a.nick) {
+		return "that's me", true
+	}
+	channels := a.channelsOf(nick)
+	for _, ch := range channels {
+		if fold(ch) == fold(channel) {
+			return nick + " is here", true
+		}
+	}
+	if len(channels) > 0 {
+		// The channels aren't named, as some may be secret
+		return nick + " is online", true
+	}
+	return "", false
+}
+
+// lastSeen describes the most recent WHOWAS entry for nick.
+func lastSeen(nick string, entries []WhowasEntry) string {
+	if len(entries) == 0 {
+		return "I haven't seen " + nick
+	}
+	e := entries[0]
+	text := fmt.Sprintf("%s was last seen as %s", nick, e.Mask())
+	if !e.Signoff.IsZero() {
+		text += fmt.Sprintf(", leaving %s ago (%s)", time.Since(e.Signoff).Round(time.Minute), e.Signoff.Format(time.RFC1123))
+	}
+	if e.Server != "" {
+		text += " on " + e.Server
+	}
+	return text
+}
@@ -0,0 +1,84 @@
+package irc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWhowas(t *testing.T) {
+	c := context.Background()
+	a, err := New(WithNick("bot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{}
+	a.conn = conn
+	type result struct {
+		entries []WhowasEntry
+		err     error
+	}
+	done := make(chan result)
+	go func() {
+		entries, err := a.Whowas(c, "Alice")
+		done <- result{entries, err}
+	}()
+	for i := 0; ; i++ {
+		a.whowasMu.Lock()
+		started := a.whowasReq != nil
+		a.whowasMu.Unlock()
+		if started {
+			break
+		}
+		if i == 100 {
+			t.Fatal("timed out waiting for WHOWAS")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, line := range []string{
+		":irc.example.net 314 bot alice al old.example.com * :Alice A\r\n",
+		":irc.example.net 312 bot alice irc.example.net :Mon Oct 12 19:36:30 2026\r\n",
+		":irc.example.net 330 bot alice alice_account :was logged in as\r\n",
+		":irc.example.net 314 bot alice bob other.example.com * :Not Alice\r\n",
+		":irc.example.net 312 bot someone irc.example.net :unrelated\r\n",
+		":irc.example.net 369 bot alice :End of WHOWAS\r\n",
+	} {
+		a.rawMsgs <- []byte(line)
+		if _, err := a.ReceiveMessage(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if conn.next() != "WHOWAS Alice\n" {
+		t.Error("expected WHOWAS to be sent")
+	}
+	if len(r.entries) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", r.entries)
+	}
+	e := r.entries[0]
+	signoff := time.Date(2026, time.October, 12, 19, 36, 30, 0, time.UTC)
+	if e.Mask() != "alice!al@old.example.com" || e.Realname != "Alice A" || e.Server != "irc.example.net" || !e.Signoff.Equal(signoff) || e.Account != "alice_account" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if r.entries[1].Server != "" {
+		t.Errorf("unexpected server for the second entry %+v", r.entries[1])
+	}
+	if text := lastSeen("alice", r.entries); !strings.HasPrefix(text, "alice was last seen as alice!al@old.example.com, leaving ") || !strings.HasSuffix(text, " on irc.example.net") {
+		t.Errorf("unexpected !seen reply %q", text)
+	}
+	if text := lastSeen("carol", nil); text != "I haven't seen carol" {
+		t.Errorf("unexpected !seen reply %q", text)
+	}
+
+	a.rawMsgs <- []byte(":alice2!a@host JOIN #chan\r\n")
+	if _, err := a.ReceiveMessage(c); err != nil {
+		t.Fatal(err)
+	}
+	if text, ok := a.online("ALICE2", "#other"); !ok || text != "ALICE2 is online" {
+		t.Errorf("expected alice2 to be online, got %q", text)
+	}
+}
@@ -0,0 +1,194 @@
+package chatlib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const DefaultJournalSize = 500
+
+// Kinds of events recorded in the journal.
+const (
+	EventConnect       = "connect"
+	EventError         = "error"
+	EventActionFailure = "action-failure"
+	EventReload        = "reload"
+	EventShutdown      = "shutdown"
+	EventBudget        = "budget"
+	EventDelivery      = "delivery"
+	EventDryRun        = "dry-run"
+)
+
+const journalKey = "journal"
+
+// Event is a significant thing that happened to the bot, kept so operators
+// can ask what happened from chat without reading the logs.
+type Event struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	API  string    `json:"api,omitempty"`
+	Text string    `json:"text"`
+}
+
+func (e Event) String() string {
+	s := e.Time.Format(time.DateTime) + " " + e.Kind
+	if e.API != "" {
+		s += " [" + e.API + "]"
+	}
+	return s + ": " + e.Text
+}
+
+// Journal keeps the most recent events in memory and in the Store so they
+// survive restarts.
+type Journal struct {
+	mu     sync.Mutex
+	size   int
+	events []Event
+	store  Store
+}
+
+// NewJournal returns a journal of at most size events persisted in store. The
+// events already in store are loaded.
+func NewJournal(c context.Context, size int, store Store) (*Journal, error) {
+	j := &Journal{size: size, store: store}
+	b, err := store.Get(c, journalKey)
+	if errors.Is(err, ErrNotFound) {
+		return j, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &j.events); err != nil {
+		return nil, errors.Wrap(err, "chat: failed to decode journal")
+	}
+	j.trim()
+	return j, nil
+}
+
+// WithJournalSize sets how many events the journal keeps.
+func WithJournalSize(size int) Option {
+	return func(h *Handler) error {
+		if size <= 0 {
+			return errors.WithMessagef(ErrInvalidConfig, "journal size must be positive, got %d", size)
+		}
+		h.journalSize = size
+		return nil
+	}
+}
+
+// Record adds an event to the journal and persists it.
+func (j *Journal) Record(c context.Context, kind, api, text string) {
+	j.mu.Lock()
+	j.events = append(j.events, Event{time.Now(), kind, api, text})
+	j.trim()
+	b, err := json.Marshal(j.events)
+	j.mu.Unlock()
+	if err != nil {
+		log.Error().Err(err).Msg("error encoding journal")
+		return
+	}
+	if err := j.store.Set(c, journalKey, b); err != nil {
+		log.Error().Err(err).Msg("error saving journal")
+	}
+}
+
+// Since returns the events recorded after t, oldest first.
+func (j *Journal) Since(t time.Time) []Event {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	events := make([]Event, 0)
+	for _, e := range j.events {
+		if e.Time.After(t) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func (j *Journal) trim() {
+	if len(j.events) > j.size {
+		j.events = append([]Event(nil), j.events[len(j.events)-j.size:]...)
+	}
+}
+
+// Journal returns the Handler's event journal.
+func (h *Handler) Journal() *Journal {
+	return h.journal
+}
+
+// EventHook is called with every event recorded in the journal.
+type EventHook func(c context.Context, e Event)
+
+// WithEventHook calls fn with every event recorded in the journal, e.g. to
+// tell other systems when the bot connects.
+func WithEventHook(fn EventHook) Option {
+	return func(h *Handler) error {
+		h.eventHooks = append(h.eventHooks, fn)
+		return nil
+	}
+}
+
+// record adds an event to the journal, formatted like fmt.Sprintf.
+func (h *Handler) record(c context.Context, kind, api, format string, args ...any) {
+	if h.journal == nil {
+		return
+	}
+	text := fmt.Sprintf(format, args...)
+	h.journal.Record(c, kind, api, text)
+	for _, fn := range h.eventHooks {
+		fn(c, Event{Time: time.Now(), Kind: kind, API: api, Text: text})
+	}
+}
+
+// WithEventsAction registers the !events admin action, which lists the events
+// of the last hour, or of the period given as e.g. "!events last 1d".
+func WithEventsAction() Option {
+	return func(h *Handler) error {
+		return RegisterAction(CommandMessage, `^`+regexp.QuoteMeta(h.commandPrefix)+`events(?:\s+last\s+(\S+))?$`, "!events last 1h", "list recent bot events", h.actionEvents, RoleAdmin)(h)
+	}
+}
+
+func (h *Handler) actionEvents(c context.Context, re *regexp.Regexp, msg *Message) error {
+	period := time.Hour
+	if arg := re.FindStringSubmatch(msg.Text)[1]; arg != "" {
+		d, err := parsePeriod(arg)
+		if err != nil {
+			return h.Reply(c, msg, err.Error())
+		}
+		period = d
+	}
+	lines := h.eventLines(period)
+	if len(lines) == 0 {
+		return h.Reply(c, msg, "no events in the last "+period.String())
+	}
+	return h.ReplyLines(c, msg, lines)
+}
+
+func (h *Handler) eventLines(period time.Duration) []string {
+	events := h.journal.Since(time.Now().Add(-period))
+	lines := make([]string, 0, len(events))
+	for _, e := range events {
+		lines = append(lines, e.String())
+	}
+	return lines
+}
+
+// parsePeriod parses a duration, also accepting a number of days such as
+// "2d" which time.ParseDuration does not.
+func parsePeriod(s string) (time.Duration, error) {
+	var days int
+	if _, err := fmt.Sscanf(s, "%dd", &days); err == nil && fmt.Sprintf("%dd", days) == s {
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errors.Errorf("invalid period %q, try e.g. 30m, 6h or 2d", s)
+	}
+	return d, nil
+}
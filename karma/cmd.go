@@ -0,0 +1,81 @@
+package karma
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	ModuleName             = "karma"
+	DefaultLeaderboardTime = "12:00"
+)
+
+func init() {
+	chatlib.RegisterModule(chatlib.Module{
+		Name:  ModuleName,
+		Flags: Flags,
+		Init:  Init,
+	})
+}
+
+func Init() (*chatlib.Option, error) {
+	if !viper.GetBool(ModuleName + ".enable") {
+		log.Info().Msg("karma disabled")
+		return nil, nil
+	}
+	halfLife := viper.GetDuration(ModuleName + ".half-life")
+	if halfLife < 0 {
+		return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "karma: invalid half life: %s", halfLife)
+	}
+	leaderboard, err := weekly(viper.GetString(ModuleName+".leaderboard-day"), viper.GetString(ModuleName+".leaderboard-time"), viper.GetString(chatlib.ConfigName+".time-zone"))
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Str("module", ModuleName).Dur("half-life", halfLife).Bool("leaderboard", leaderboard != nil).Msg("karma enabled")
+	opt := WithKarma(halfLife, leaderboard)
+	return &opt, nil
+}
+
+// weekly reads when to post the leaderboards, nil if day is empty.
+func weekly(day, at, zone string) (*Weekly, error) {
+	if day == "" {
+		return nil, nil
+	}
+	w := &Weekly{Day: -1, Zone: time.UTC}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(day, d.String()) || strings.EqualFold(day, d.String()[:3]) {
+			w.Day = d
+		}
+	}
+	if w.Day < 0 {
+		return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "karma: invalid leaderboard day: %s", day)
+	}
+	t, err := time.Parse("15:04", at)
+	if err != nil {
+		return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "karma: invalid leaderboard time: %s", at)
+	}
+	w.Hour, w.Minute = t.Hour(), t.Minute()
+	if zone != "" {
+		if w.Zone, err = time.LoadLocation(zone); err != nil {
+			return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "karma: invalid time zone: %s", zone)
+		}
+	}
+	return w, nil
+}
+
+func Flags(cmd *cobra.Command) {
+	// Enable
+	cmd.Flags().Bool(ModuleName+"-enable", true, "Let users give each other karma with nick++ and nick--")
+	// HalfLife
+	cmd.Flags().Duration(ModuleName+"-half-life", 0, "How long karma takes to lose half its value, e.g. 720h, never if 0")
+	// LeaderboardDay
+	cmd.Flags().String(ModuleName+"-leaderboard-day", "", "Day of the week each channel's karma leaderboard is posted on, e.g. monday, never if empty")
+	// LeaderboardTime
+	cmd.Flags().String(ModuleName+"-leaderboard-time", DefaultLeaderboardTime, "Time of day the karma leaderboards are posted at, e.g. 09:30, in the chat time zone or UTC")
+}
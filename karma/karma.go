@@ -0,0 +1,499 @@
+// Package karma keeps score of the thanks users give each other in a channel
+// with nick++, and of the blame with nick--. Scores can decay, so recent
+// karma counts for more than old, and each channel's leaderboard can be
+// posted weekly. Channels opt out with !karma off.
+package karma
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// indexKey is where the list of boards is kept in the Store, each board
+// being kept under a key of its own so a vote only rewrites its channel's.
+const indexKey = "karma/index"
+
+// storeKey returns where the board with key is kept in the Store.
+func storeKey(key string) string {
+	return "karma/boards/" + key
+}
+
+// DefaultTop is how many users a leaderboard shows.
+const DefaultTop = 5
+
+// Score is a user's karma in a channel.
+type Score struct {
+	// Nick is written as the user's nick was when last given karma.
+	Nick   string  `json:"nick"`
+	Points float64 `json:"points"`
+	// Updated is when Points were last changed, what they decay from.
+	Updated time.Time `json:"updated"`
+}
+
+// board is the karma of a channel, by lowercased nick.
+type board struct {
+	API     string            `json:"api"`
+	Channel string            `json:"channel"`
+	OptOut  bool              `json:"optOut,omitempty"`
+	Scores  map[string]*Score `json:"scores,omitempty"`
+}
+
+// Karma keeps the karma of every channel in a Store.
+type Karma struct {
+	store    chatlib.Store
+	halfLife time.Duration
+	now      func() time.Time
+
+	mu     sync.Mutex
+	loaded bool
+	boards map[string]*board
+	// indexed holds the keys of the boards in the stored index.
+	indexed map[string]bool
+}
+
+// NewKarma returns a Karma keeping scores in store. Points lose half their
+// value every halfLife, never if it is 0.
+func NewKarma(store chatlib.Store, halfLife time.Duration) *Karma {
+	return &Karma{
+		store:    store,
+		halfLife: halfLife,
+		now:      time.Now,
+		boards:   make(map[string]*board),
+		indexed:  make(map[string]bool),
+	}
+}
+
+func boardKey(api, channel string) string {
+	return api + "/" + strings.ToLower(channel)
+}
+
+// load reads the boards from the Store the first time it is called. The
+// caller must hold mu.
+func (k *Karma) load(c context.Context) error {
+	if k.loaded {
+		return nil
+	}
+	bts, err := k.store.Get(c, indexKey)
+	if errors.Is(err, chatlib.ErrNotFound) {
+		k.loaded = true
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "karma: failed to load scores")
+	}
+	var keys []string
+	if err := json.Unmarshal(bts, &keys); err != nil {
+		return errors.Wrap(err, "karma: failed to parse the boards")
+	}
+	boards := make(map[string]*board, len(keys))
+	for _, key := range keys {
+		bts, err := k.store.Get(c, storeKey(key))
+		if errors.Is(err, chatlib.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return errors.Wrap(err, "karma: failed to load scores")
+		}
+		var b board
+		if err := json.Unmarshal(bts, &b); err != nil {
+			return errors.Wrapf(err, "karma: failed to parse scores of %s", key)
+		}
+		boards[key] = &b
+	}
+	for key, b := range boards {
+		k.boards[key] = b
+		k.indexed[key] = true
+	}
+	k.loaded = true
+	return nil
+}
+
+// save writes the board with key to the Store, and the index if the board is
+// new. The caller must hold mu.
+func (k *Karma) save(c context.Context, key string) error {
+	bts, err := json.Marshal(k.boards[key])
+	if err != nil {
+		return err
+	}
+	if err := k.store.Set(c, storeKey(key), bts); err != nil {
+		return errors.Wrap(err, "karma: failed to save scores")
+	}
+	if k.indexed[key] {
+		return nil
+	}
+	keys := make([]string, 0, len(k.boards))
+	for key := range k.boards {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if bts, err = json.Marshal(keys); err != nil {
+		return err
+	}
+	if err := k.store.Set(c, indexKey, bts); err != nil {
+		return errors.Wrap(err, "karma: failed to save the boards")
+	}
+	k.indexed[key] = true
+	return nil
+}
+
+// board returns the board of channel, created if create is set and nil
+// otherwise. The caller must hold mu.
+func (k *Karma) board(api, channel string, create bool) *board {
+	key := boardKey(api, channel)
+	b, ok := k.boards[key]
+	if !ok && create {
+		b = &board{API: api, Channel: channel}
+		k.boards[key] = b
+	}
+	return b
+}
+
+// points returns the points of s decayed until now.
+func (k *Karma) points(s *Score, now time.Time) float64 {
+	if k.halfLife <= 0 {
+		return s.Points
+	}
+	return s.Points * math.Pow(0.5, float64(now.Sub(s.Updated))/float64(k.halfLife))
+}
+
+// Add gives nick delta points of karma in channel and returns their score.
+func (k *Karma) Add(c context.Context, api, channel, nick string, delta float64) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.load(c); err != nil {
+		return 0, err
+	}
+	b := k.board(api, channel, true)
+	if b.Scores == nil {
+		b.Scores = make(map[string]*Score)
+	}
+	now := k.now()
+	s, ok := b.Scores[strings.ToLower(nick)]
+	if !ok {
+		s = &Score{}
+		b.Scores[strings.ToLower(nick)] = s
+	}
+	s.Nick, s.Points, s.Updated = nick, k.points(s, now)+delta, now.UTC()
+	return int(math.Round(s.Points)), k.save(c, boardKey(api, channel))
+}
+
+// Get returns nick's score in channel.
+func (k *Karma) Get(c context.Context, api, channel, nick string) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.load(c); err != nil {
+		return 0, err
+	}
+	b := k.board(api, channel, false)
+	if b == nil || b.Scores[strings.ToLower(nick)] == nil {
+		return 0, nil
+	}
+	return int(math.Round(k.points(b.Scores[strings.ToLower(nick)], k.now()))), nil
+}
+
+// Top returns the n best scores in channel, with their points decayed until
+// now, leaving out those down to 0 or less.
+func (k *Karma) Top(c context.Context, api, channel string, n int) ([]Score, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.load(c); err != nil {
+		return nil, err
+	}
+	top := make([]Score, 0)
+	b := k.board(api, channel, false)
+	if b == nil {
+		return top, nil
+	}
+	now := k.now()
+	for _, s := range b.Scores {
+		if p := math.Round(k.points(s, now)); p > 0 {
+			top = append(top, Score{Nick: s.Nick, Points: p, Updated: s.Updated})
+		}
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Points != top[j].Points {
+			return top[i].Points > top[j].Points
+		}
+		return strings.ToLower(top[i].Nick) < strings.ToLower(top[j].Nick)
+	})
+	return top[:min(n, len(top))], nil
+}
+
+// SetOptOut opts channel out of karma, or back in.
+func (k *Karma) SetOptOut(c context.Context, api, channel string, optOut bool) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.load(c); err != nil {
+		return err
+	}
+	k.board(api, channel, true).OptOut = optOut
+	return k.save(c, boardKey(api, channel))
+}
+
+// OptedOut reports whether channel opted out of karma.
+func (k *Karma) OptedOut(c context.Context, api, channel string) (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.load(c); err != nil {
+		return false, err
+	}
+	b := k.board(api, channel, false)
+	return b != nil && b.OptOut, nil
+}
+
+// channels returns the API and channel of each board not opted out.
+func (k *Karma) channels(c context.Context) ([][2]string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.load(c); err != nil {
+		return nil, err
+	}
+	channels := make([][2]string, 0, len(k.boards))
+	for _, b := range k.boards {
+		if !b.OptOut {
+			channels = append(channels, [2]string{b.API, b.Channel})
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i][0]+channels[i][1] < channels[j][0]+channels[j][1]
+	})
+	return channels, nil
+}
+
+// Weekly is a time of the week, such as Monday 9:00 in a time zone.
+type Weekly struct {
+	Day    time.Weekday
+	Hour   int
+	Minute int
+	Zone   *time.Location
+}
+
+// Next returns the first time of the week after t.
+func (w Weekly) Next(t time.Time) time.Time {
+	local := t.In(w.Zone)
+	next := time.Date(local.Year(), local.Month(), local.Day(), w.Hour, w.Minute, 0, 0, w.Zone)
+	next = next.AddDate(0, 0, (int(w.Day)-int(local.Weekday())+7)%7)
+	if !next.After(t) {
+		next = next.AddDate(0, 0, 7)
+	}
+	return next
+}
+
+// voteRe matches the nick++ and nick-- in a message, on their own or among
+// other words.
+var voteRe = regexp.MustCompile("(?:^|\\s)([\\w\\[\\]\\\\`^{|}-]+?)(\\+\\+|--)(?:[\\s,.!?:;]|$)")
+
+// module holds the state of the karma actions for a Handler.
+type module struct {
+	h           *chatlib.Handler
+	halfLife    time.Duration
+	leaderboard *Weekly
+
+	once  sync.Once
+	karma *Karma
+}
+
+// WithKarma adds the nick++ and nick-- actions, and !karma to show scores
+// and the channel's leaderboard or, for staff, to opt the channel out of
+// karma. Points lose half their value every halfLife, never if it is 0. If
+// leaderboard is set, each channel's leaderboard is posted to it weekly at
+// that time.
+func WithKarma(halfLife time.Duration, leaderboard *Weekly) chatlib.Option {
+	return func(h *chatlib.Handler) error {
+		m := &module{h: h, halfLife: halfLife, leaderboard: leaderboard}
+		opts := []chatlib.Option{
+			chatlib.RegisterAction(chatlib.CommandMessage, voteRe.String(), "alice++", "give someone karma, or take it with alice--", m.actionVote),
+			chatlib.RegisterCommand("karma", "", "!karma", "show your karma", m.actionKarma),
+			chatlib.RegisterCommand("karma", `(\S+)`, "!karma alice", "show someone's karma", m.actionKarma),
+			chatlib.RegisterCommand("karma", "top", "!karma top", "show the channel's karma leaderboard", m.actionTop),
+			chatlib.RegisterCommand("karma", "(on|off)", "!karma off", "turn karma on or off in the channel", m.actionOptOut, chatlib.RoleStaff),
+		}
+		if leaderboard != nil {
+			opts = append(opts, chatlib.WithTask("karma-leaderboard", m.runLeaderboard))
+		}
+		return h.ApplyOptions(opts...)
+	}
+}
+
+// karmaFor returns the Karma, created on first use so it uses the Store the
+// Handler ends up with once every option is applied.
+func (m *module) karmaFor() *Karma {
+	m.once.Do(func() {
+		m.karma = NewKarma(m.h.Store(), m.halfLife)
+	})
+	return m.karma
+}
+
+// optedOut reports whether the channel of msg opted out, telling whoever
+// asked for karma there if so.
+func (m *module) optedOut(c context.Context, msg *chatlib.Message, tell bool) (bool, error) {
+	out, err := m.karmaFor().OptedOut(c, msg.API, msg.Channel())
+	if err != nil || !out {
+		return false, err
+	}
+	if tell {
+		return true, m.h.Reply(c, msg, "karma is off in this channel")
+	}
+	return true, nil
+}
+
+func (m *module) actionVote(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+	if msg.Private || msg.Replayed || msg.Nick == "" {
+		return nil
+	}
+	if out, err := m.optedOut(c, msg, false); out || err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	scores := make([]string, 0)
+	for _, vote := range re.FindAllStringSubmatch(msg.Text, -1) {
+		nick := vote[1]
+		if seen[strings.ToLower(nick)] {
+			continue
+		}
+		seen[strings.ToLower(nick)] = true
+		if strings.EqualFold(nick, msg.Nick) {
+			if vote[2] == "++" {
+				scores = append(scores, "you can't give yourself karma")
+			}
+			continue
+		}
+		delta := 1.0
+		if vote[2] == "--" {
+			delta = -1
+		}
+		score, err := m.karmaFor().Add(c, msg.API, msg.Channel(), nick, delta)
+		if err != nil {
+			return err
+		}
+		scores = append(scores, nick+" has "+strconv.Itoa(score)+" karma")
+	}
+	if len(scores) == 0 {
+		return nil
+	}
+	return m.h.Reply(c, msg, strings.Join(scores, ", "))
+}
+
+func (m *module) actionKarma(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+	nick := msg.Nick
+	if parts := re.FindStringSubmatch(msg.Text); len(parts) > 1 {
+		nick = parts[1]
+		// Answered by their own actions
+		if nick == "top" || nick == "on" || nick == "off" {
+			return nil
+		}
+	}
+	if msg.Private {
+		return m.h.Reply(c, msg, "karma is kept per channel, ask in one")
+	}
+	if out, err := m.optedOut(c, msg, true); out || err != nil {
+		return err
+	}
+	score, err := m.karmaFor().Get(c, msg.API, msg.Channel(), nick)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(nick, msg.Nick) {
+		return m.h.Reply(c, msg, "you have "+strconv.Itoa(score)+" karma")
+	}
+	return m.h.Reply(c, msg, nick+" has "+strconv.Itoa(score)+" karma")
+}
+
+func (m *module) actionTop(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+	if msg.Private {
+		return m.h.Reply(c, msg, "karma is kept per channel, ask in one")
+	}
+	if out, err := m.optedOut(c, msg, true); out || err != nil {
+		return err
+	}
+	top, err := m.karmaFor().Top(c, msg.API, msg.Channel(), DefaultTop)
+	if err != nil {
+		return err
+	}
+	if len(top) == 0 {
+		return m.h.Reply(c, msg, "nobody has any karma here yet")
+	}
+	return m.h.Reply(c, msg, "karma leaderboard: "+formatTop(top))
+}
+
+func (m *module) actionOptOut(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+	if msg.Private {
+		return m.h.Reply(c, msg, "karma is turned on or off in a channel")
+	}
+	off := re.FindStringSubmatch(msg.Text)[1] == "off"
+	if err := m.karmaFor().SetOptOut(c, msg.API, msg.Channel(), off); err != nil {
+		return err
+	}
+	if off {
+		return m.h.Reply(c, msg, "ok, karma is off in this channel")
+	}
+	return m.h.Reply(c, msg, "ok, karma is on in this channel")
+}
+
+// formatTop writes a leaderboard on one line, e.g. "1. alice 12, 2. bob 7".
+func formatTop(top []Score) string {
+	entries := make([]string, len(top))
+	for i, s := range top {
+		entries[i] = strconv.Itoa(i+1) + ". " + s.Nick + " " + strconv.Itoa(int(s.Points))
+	}
+	return strings.Join(entries, ", ")
+}
+
+// runLeaderboard posts the leaderboards every week until the context is
+// cancelled.
+func (m *module) runLeaderboard(c context.Context) error {
+	for {
+		next := m.leaderboard.Next(m.karmaFor().now())
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-c.Done():
+			t.Stop()
+			return c.Err()
+		case <-t.C:
+		}
+		if err := m.postLeaderboards(c); err != nil {
+			log.Error().Str("module", ModuleName).Err(err).Msg("error posting karma leaderboards")
+		}
+	}
+}
+
+// postLeaderboards posts the leaderboard of each channel that has one, has
+// not opted out and hasn't the module disabled.
+func (m *module) postLeaderboards(c context.Context) error {
+	channels, err := m.karmaFor().channels(c)
+	if err != nil {
+		return err
+	}
+	for _, ch := range channels {
+		api, channel := ch[0], ch[1]
+		if slices.ContainsFunc(m.h.Settings(api, channel).DisabledModules, func(name string) bool { return strings.EqualFold(name, ModuleName) }) {
+			continue
+		}
+		top, err := m.karmaFor().Top(c, api, channel, DefaultTop)
+		if err != nil {
+			return err
+		}
+		if len(top) == 0 {
+			continue
+		}
+		if err := m.h.Send(c, &chatlib.Message{
+			Command:  chatlib.CommandMessage,
+			Receiver: channel,
+			Text:     "this week's karma leaderboard: " + formatTop(top),
+			API:      api,
+		}); err != nil {
+			log.Error().Str("module", ModuleName).Str("channel", channel).Err(err).Msg("error posting karma leaderboard")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package karma
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestKarma(t *testing.T) {
+	c := context.Background()
+	store := chatlib.NewMemoryStore()
+	now := time.Date(2023, 11, 2, 15, 0, 0, 0, time.UTC)
+	k := NewKarma(store, 24*time.Hour)
+	k.now = func() time.Time { return now }
+	for _, nick := range []string{"alice", "Alice", "alice", "alice", "bob", "bob"} {
+		if _, err := k.Add(c, "irc", "#foo", nick, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := k.Add(c, "irc", "#foo", "carol", -1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Scores survive a restart and decay by half every half life
+	k = NewKarma(store, 24*time.Hour)
+	now = now.Add(24 * time.Hour)
+	k.now = func() time.Time { return now }
+	if score, _ := k.Get(c, "irc", "#FOO", "ALICE"); score != 2 {
+		t.Errorf("expected alice to have 2 karma, got %d", score)
+	}
+	if score, _ := k.Get(c, "irc", "#bar", "alice"); score != 0 {
+		t.Errorf("expected karma to be kept per channel, got %d", score)
+	}
+	top, err := k.Top(c, "irc", "#foo", DefaultTop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := formatTop(top); s != "1. alice 2, 2. bob 1" {
+		t.Errorf("expected alice and bob only, got %q", s)
+	}
+
+	if err := k.SetOptOut(c, "irc", "#foo", true); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := k.OptedOut(c, "irc", "#Foo"); !out {
+		t.Error("expected #foo to have opted out")
+	}
+	if channels, _ := k.channels(c); len(channels) != 0 {
+		t.Errorf("expected no leaderboards to post, got %v", channels)
+	}
+
+	// Each board is kept under a key of its own, so a vote in one channel
+	// leaves the others alone
+	foo, err := store.Get(c, storeKey(boardKey("irc", "#foo")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Add(c, "irc", "#bar", "alice", 1); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := store.Get(c, storeKey(boardKey("irc", "#foo"))); string(again) != string(foo) {
+		t.Error("expected the board of #foo not to be rewritten by a vote in #bar")
+	}
+	k = NewKarma(store, 24*time.Hour)
+	if channels, _ := k.channels(c); len(channels) != 1 || channels[0] != [2]string{"irc", "#bar"} {
+		t.Errorf("expected the leaderboard of #bar to post after a restart, got %v", channels)
+	}
+}
+
+func TestVote(t *testing.T) {
+	for text, expected := range map[string][]string{
+		"alice++":                  {"alice++"},
+		"thanks alice++ and bob--": {"alice++", "bob--"},
+		"[m]++, great":             {"[m]++"},
+		"c++ is hard":              {"c++"},
+		"a -- b":                   nil,
+		"x+++":                     nil,
+		"http://example.com/a++b":  nil,
+	} {
+		var votes []string
+		for _, vote := range voteRe.FindAllStringSubmatch(text, -1) {
+			votes = append(votes, vote[1]+vote[2])
+		}
+		if len(votes) != len(expected) {
+			t.Errorf("%q: expected %v, got %v", text, expected, votes)
+			continue
+		}
+		for i := range votes {
+			if votes[i] != expected[i] {
+				t.Errorf("%q: expected %v, got %v", text, expected, votes)
+			}
+		}
+	}
+}
+
+func TestWeekly(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := Weekly{Day: time.Monday, Hour: 9, Zone: berlin}
+	// Thursday
+	now := time.Date(2023, 11, 2, 15, 0, 0, 0, berlin)
+	next := w.Next(now)
+	if expected := time.Date(2023, 11, 6, 9, 0, 0, 0, berlin); !next.Equal(expected) {
+		t.Errorf("expected %s, got %s", expected, next)
+	}
+	if expected := time.Date(2023, 11, 13, 9, 0, 0, 0, berlin); !w.Next(next).Equal(expected) {
+		t.Errorf("expected %s, got %s", expected, w.Next(next))
+	}
+	if _, err := weekly("someday", DefaultLeaderboardTime, ""); err == nil {
+		t.Error("expected an error for an invalid day")
+	}
+	if w, err := weekly("", DefaultLeaderboardTime, ""); w != nil || err != nil {
+		t.Errorf("expected no leaderboard, got %v %v", w, err)
+	}
+}
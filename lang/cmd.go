@@ -0,0 +1,33 @@
+package lang
+
+import (
+	"github.com/gregseb/chatlib"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const ModuleName = "lang"
+
+func init() {
+	chatlib.RegisterModule(chatlib.Module{
+		Name:  ModuleName,
+		Flags: Flags,
+		Init:  Init,
+	})
+}
+
+func Init() (*chatlib.Option, error) {
+	if !viper.GetBool(ModuleName + ".enable") {
+		log.Info().Msg("language detection disabled")
+		return nil, nil
+	}
+	log.Info().Msg("language detection enabled")
+	opt := chatlib.WithMiddleware(Middleware)
+	return &opt, nil
+}
+
+func Flags(cmd *cobra.Command) {
+	// Enable
+	cmd.Flags().Bool(ModuleName+"-enable", true, "Annotate messages with their detected language")
+}
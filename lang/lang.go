@@ -0,0 +1,149 @@
+// Package lang provides lightweight language detection for chat messages.
+//
+// Detection is based on writing system and common function words. It is
+// meant for short chat lines where heavier statistical models are overkill,
+// and it only claims a language when the evidence is clear.
+package lang
+
+import (
+	"context"
+	"strings"
+	"unicode"
+
+	"github.com/gregseb/chatlib"
+)
+
+// Undetermined is returned when the language can't be told, following ISO 639-2.
+const Undetermined = "und"
+
+// MinConfidence is the confidence below which the middleware doesn't annotate.
+const MinConfidence = 0.5
+
+// Annotation holds the ISO 639-1 code of the detected language of a message.
+var Annotation = chatlib.NewAnnotationKey[string]("language")
+
+// scripts maps unicode scripts that are mostly used by a single language.
+var scripts = []struct {
+	table *unicode.RangeTable
+	lang  string
+}{
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Hangul, "ko"},
+	{unicode.Han, "zh"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Greek, "el"},
+	{unicode.Thai, "th"},
+	{unicode.Devanagari, "hi"},
+}
+
+// stopwords are frequent function words that identify languages written in
+// the Latin and Cyrillic scripts.
+var stopwords = map[string][]string{
+	"en": {"the", "and", "is", "are", "you", "that", "this", "with", "for", "not", "have", "what", "it's", "was", "of", "to"},
+	"es": {"el", "la", "los", "las", "que", "es", "y", "por", "con", "para", "una", "pero", "como", "está", "del"},
+	"fr": {"le", "la", "les", "et", "est", "que", "pour", "pas", "une", "des", "avec", "dans", "c'est", "je", "vous"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ich", "ein", "eine", "mit", "auf", "für", "sie", "auch", "wie"},
+	"it": {"il", "la", "che", "di", "è", "non", "per", "una", "con", "sono", "gli", "della", "anche", "come", "ma"},
+	"pt": {"o", "a", "que", "não", "é", "para", "com", "uma", "os", "do", "da", "em", "mas", "você", "está"},
+	"nl": {"de", "het", "een", "en", "is", "niet", "dat", "van", "ik", "je", "met", "voor", "maar", "ook", "zijn"},
+	"ru": {"и", "в", "не", "на", "что", "я", "с", "это", "как", "он", "но", "так", "все", "она", "вы"},
+	"uk": {"і", "в", "не", "на", "що", "я", "з", "це", "як", "він", "але", "так", "все", "вона", "ви"},
+}
+
+// Detect returns the ISO 639-1 code of the language of text and a confidence
+// between 0 and 1. It returns Undetermined with zero confidence if there is
+// not enough evidence.
+func Detect(text string) (string, float64) {
+	letters := 0
+	counts := make(map[string]int)
+	latinOrCyrillic := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if unicode.In(r, unicode.Latin, unicode.Cyrillic) {
+			latinOrCyrillic++
+			continue
+		}
+		for _, s := range scripts {
+			if unicode.Is(s.table, r) {
+				counts[s.lang]++
+				break
+			}
+		}
+	}
+	if letters == 0 {
+		return Undetermined, 0
+	}
+	// Japanese mixes kana with Han, so any kana means Japanese
+	if counts["ja"] > 0 {
+		counts["ja"] += counts["zh"]
+		delete(counts, "zh")
+	}
+	if best, n := top(counts); n*2 > letters {
+		return best, float64(n) / float64(letters)
+	}
+	if latinOrCyrillic*2 <= letters {
+		return Undetermined, 0
+	}
+	return detectWords(text)
+}
+
+func detectWords(text string) (string, float64) {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+	if len(words) < 3 {
+		return Undetermined, 0
+	}
+	counts := make(map[string]int)
+	total := 0
+	for _, w := range words {
+		matched := false
+		for lang, list := range stopwords {
+			for _, sw := range list {
+				if w == sw {
+					counts[lang]++
+					matched = true
+					break
+				}
+			}
+		}
+		if matched {
+			total++
+		}
+	}
+	best, n := top(counts)
+	if n == 0 {
+		return Undetermined, 0
+	}
+	// Confidence is how many stopwords agree with the winner, scaled by how
+	// much of the text is stopwords at all.
+	agreement := float64(n) / float64(total)
+	coverage := float64(total) / float64(len(words))
+	return best, agreement * min(1, coverage*3)
+}
+
+// top returns the key with the highest count, breaking ties alphabetically so
+// results are stable.
+func top(counts map[string]int) (string, int) {
+	best, n := "", 0
+	for k, v := range counts {
+		if v > n || (v == n && k < best) {
+			best, n = k, v
+		}
+	}
+	return best, n
+}
+
+// Middleware annotates messages with their detected language when the
+// detector is confident enough.
+func Middleware(c context.Context, msg *chatlib.Message) error {
+	if lang, conf := Detect(msg.Text); lang != Undetermined && conf >= MinConfidence {
+		Annotation.Set(msg, lang)
+	}
+	return nil
+}
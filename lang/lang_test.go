@@ -0,0 +1,28 @@
+package lang_test
+
+import (
+	"testing"
+
+	"github.com/gregseb/chatlib/lang"
+)
+
+func TestDetect(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		exp  string
+	}{
+		{"is the bot working for you and the others", "en"},
+		{"el bot no está funcionando para mí pero es raro", "es"},
+		{"je pense que le bot est pas content avec vous", "fr"},
+		{"ich glaube der Bot ist nicht mit dir einverstanden", "de"},
+		{"это не так, и я не знаю что он делает", "ru"},
+		{"ボットは動いていますか", "ja"},
+		{"봇이 작동하나요", "ko"},
+		{"!ping", lang.Undetermined},
+		{"lol", lang.Undetermined},
+	} {
+		if got, _ := lang.Detect(tc.text); got != tc.exp {
+			t.Errorf("%q: expected %s, got %s", tc.text, tc.exp, got)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package chatlib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// CommandMessage is the command APIs use for ordinary chat messages, so that
+// actions and replies work the same way regardless of the backend.
+const CommandMessage = "PRIVMSG"
+
+// CommandNotice is the command for notices, messages that must not be
+// automatically replied to.
+const CommandNotice = "NOTICE"
+
+// CommandAction is the command for emotes, such as IRC's /me, whose text is
+// what the sender does, e.g. "waves".
+const CommandAction = "ACTION"
+
+// Exit codes returned by Handler.ExitCode so supervisors can tell intentional
+// exits from crashes.
+const (
+	ExitCodeShutdown = 0
+	ExitCodeRestart  = 75
+)
+
+const (
+	DefaultConfirmSeconds = 30
+	DefaultDrainSeconds   = 10
+)
+
+// ReloadFunc reloads configuration into a running Handler.
+type ReloadFunc func(c context.Context, h *Handler) error
+
+// Flusher is implemented by APIs that queue outgoing messages and need to be
+// told to send them before stopping.
+type Flusher interface {
+	Flush(c context.Context) error
+}
+
+// Snapshotter is implemented by Stores that buffer writes and need to be told
+// to persist them before the process exits.
+type Snapshotter interface {
+	Snapshot(c context.Context) error
+}
+
+// WithLifecycleActions registers the !shutdown and !restart admin actions.
+// Both must be confirmed by repeating the command with "confirm" within the
+// confirmation window, and are refused to anyone but the admins.
+func WithLifecycleActions() Option {
+	return func(h *Handler) error {
+		return h.ApplyOptions(
+			RegisterAction(CommandMessage, `^`+regexp.QuoteMeta(h.commandPrefix)+`(shutdown|restart)( confirm)?$`, "!shutdown confirm", "shut down or restart the bot", h.actionLifecycle, RoleAdmin),
+		)
+	}
+}
+
+// WithControlSocket listens on a unix socket at path for lifecycle commands.
+// Each connection sends a single line, one of "shutdown [code]", "restart" or
+// "events [period]". events writes the journal entries of the period, an hour
+// by default, and leaves the bot running.
+func WithControlSocket(path string) Option {
+	return func(h *Handler) error {
+		h.controlSocket = path
+		return nil
+	}
+}
+
+// WithReloader adds a function called when the Handler is asked to reload
+// its configuration, e.g. on SIGHUP.
+func WithReloader(fn ReloadFunc) Option {
+	return func(h *Handler) error {
+		h.reloaders = append(h.reloaders, fn)
+		return nil
+	}
+}
+
+// Task is work a module does in the background for as long as the Handler
+// runs, e.g. periodic cleanup.
+type Task func(c context.Context) error
+
+type namedTask struct {
+	name string
+	fn   Task
+}
+
+// WithTask runs fn in its own goroutine once the APIs have started. An error
+// returned by fn is logged and recorded in the journal.
+func WithTask(name string, fn Task) Option {
+	return func(h *Handler) error {
+		h.tasks = append(h.tasks, namedTask{name, fn})
+		return nil
+	}
+}
+
+// runTask runs a task until it returns or the context is cancelled.
+func (h *Handler) runTask(c context.Context, t namedTask) {
+	if err := t.fn(c); err != nil && c.Err() == nil {
+		log.Error().Str("task", t.name).Err(err).Msg("task failed")
+		h.record(c, EventError, "", "task %s failed: %s", t.name, err)
+	}
+}
+
+// WithDrainPeriod sets how long Drain waits for in-flight actions to finish.
+func WithDrainPeriod(seconds float64) Option {
+	return func(h *Handler) error {
+		h.drainSeconds = seconds
+		return nil
+	}
+}
+
+// Reply sends text to wherever a reply to msg belongs, as a notice if the
+// ReplyNotice setting is set for msg's network and channel.
+func (h *Handler) Reply(c context.Context, msg *Message, text string) error {
+	command := CommandMessage
+	if h.Settings(msg.API, msg.Channel()).ReplyNotice {
+		command = CommandNotice
+	}
+	return h.reply(c, msg, command, text)
+}
+
+// ReplyNotice sends text as a notice to wherever a reply to msg belongs,
+// whatever the settings.
+func (h *Handler) ReplyNotice(c context.Context, msg *Message, text string) error {
+	return h.reply(c, msg, CommandNotice, text)
+}
+
+func (h *Handler) reply(c context.Context, msg *Message, command, text string) error {
+	return h.Send(c, &Message{
+		Command:  command,
+		Receiver: msg.ReplyTarget(),
+		Text:     text,
+		API:      msg.API,
+	})
+}
+
+// Shutdown stops the API, snapshots the Store and stops the Handler. Start
+// returns once it is done and ExitCode returns code.
+func (h *Handler) Shutdown(c context.Context, code int) error {
+	var err error
+	h.shutdownOnce.Do(func() {
+		log.Info().Int("code", code).Msg("shutting down")
+		h.record(c, EventShutdown, "", "shutting down with exit code %d", code)
+		h.exitCode = code
+		for _, na := range h.apis {
+			if e := na.api.Stop(c); e != nil && err == nil {
+				err = errors.Wrapf(e, "error stopping %s", na.name)
+			}
+		}
+		if h.analytics != nil {
+			if e := h.analytics.flush(c, h.store, time.Now()); e != nil && err == nil {
+				err = errors.WithMessage(e, "error saving usage")
+			}
+		}
+		if s, ok := h.store.(Snapshotter); ok {
+			if e := s.Snapshot(c); e != nil && err == nil {
+				err = errors.Wrap(e, "error snapshotting store")
+			}
+		}
+		if h.cancel != nil {
+			h.cancel()
+		}
+	})
+	return err
+}
+
+// Drain stops executing new actions, waits up to the drain period for
+// in-flight actions to finish, then flushes the API and shuts down.
+func (h *Handler) Drain(c context.Context, code int) error {
+	h.drainMu.Lock()
+	h.draining = true
+	h.drainMu.Unlock()
+	log.Info().Float64("seconds", h.drainSeconds).Msg("draining")
+	done := make(chan struct{})
+	go func() {
+		h.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Duration(float64(time.Second) * h.drainSeconds)):
+		log.Warn().Msg("drain period expired with actions still running")
+	}
+	for _, na := range h.apis {
+		if f, ok := na.api.(Flusher); ok {
+			if err := f.Flush(c); err != nil {
+				log.Error().Str("api", na.name).Err(err).Msg("error flushing api")
+			}
+		}
+	}
+	return h.Shutdown(c, code)
+}
+
+// Reload calls every reloader in turn, stopping at the first error.
+func (h *Handler) Reload(c context.Context) error {
+	log.Info().Msg("reloading configuration")
+	for _, fn := range h.reloaders {
+		if err := fn(c, h); err != nil {
+			h.record(c, EventReload, "", "reload failed: %s", err)
+			return err
+		}
+	}
+	h.record(c, EventReload, "", "configuration reloaded")
+	return nil
+}
+
+// handleSignals shuts down immediately on SIGINT, drains and shuts down on
+// SIGTERM and reloads configuration on SIGHUP.
+func (h *Handler) handleSignals(c context.Context) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-c.Done():
+			return
+		case sig := <-sigs:
+			var err error
+			switch sig {
+			case os.Interrupt:
+				err = h.Shutdown(c, ExitCodeShutdown)
+			case syscall.SIGTERM:
+				err = h.Drain(c, ExitCodeShutdown)
+			case syscall.SIGHUP:
+				if err := h.Reload(c); err != nil {
+					log.Error().Err(err).Msg("error reloading configuration")
+				}
+				continue
+			}
+			if err != nil {
+				log.Error().Err(err).Msg("error shutting down")
+			}
+			return
+		}
+	}
+}
+
+// ExitCode returns the exit code chosen by the last call to Shutdown.
+func (h *Handler) ExitCode() int {
+	return h.exitCode
+}
+
+func (h *Handler) actionLifecycle(c context.Context, re *regexp.Regexp, msg *Message) error {
+	parts := re.FindStringSubmatch(msg.Text)
+	if !h.isAdminSender(msg) {
+		log.Warn().Str("sender", msg.Sender).Msgf("%s refused to non-admin", parts[1])
+		return nil
+	}
+	code := ExitCodeShutdown
+	if parts[1] == "restart" {
+		code = ExitCodeRestart
+	}
+	key := parts[1] + " " + strings.ToLower(msg.Nick)
+	h.confirmMu.Lock()
+	if h.confirms == nil {
+		h.confirms = make(map[string]time.Time)
+	}
+	requested, ok := h.confirms[key]
+	confirmed := parts[2] != "" && ok && time.Since(requested) < DefaultConfirmSeconds*time.Second
+	if confirmed {
+		delete(h.confirms, key)
+	} else {
+		h.confirms[key] = time.Now()
+	}
+	h.confirmMu.Unlock()
+
+	if !confirmed {
+		return h.Reply(c, msg, fmt.Sprintf("send %s%s confirm within %d seconds to %s", h.commandPrefix, parts[1], DefaultConfirmSeconds, parts[1]))
+	}
+	log.Warn().Str("sender", msg.Sender).Msgf("%s requested", parts[1])
+	return h.Shutdown(c, code)
+}
+
+// serveControlSocket accepts lifecycle commands on the control socket until
+// the context is cancelled.
+func (h *Handler) serveControlSocket(c context.Context) error {
+	return serveControl(c, h.controlSocket, h.handleControl)
+}
+
+// serveControl accepts connections on a unix socket at path until the
+// context is cancelled, handing each to handle. Only the bot's own user may
+// connect.
+func serveControl(c context.Context, path string, handle func(c context.Context, conn net.Conn)) error {
+	// Remove a socket left behind by an unclean exit, but nothing else
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return errors.Wrapf(ErrInvalidConfig, "control socket path exists and isn't a socket: %s", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on control socket: %s", path)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return errors.Wrapf(err, "failed to restrict control socket: %s", path)
+	}
+	log.Info().Msgf("listening on control socket: %s", path)
+	go func() {
+		<-c.Done()
+		ln.Close()
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if c.Err() == nil {
+					log.Error().Err(err).Msg("error accepting control connection")
+				}
+				return
+			}
+			go handle(c, conn)
+		}
+	}()
+	return nil
+}
+
+// readControl reads the command sent on a control connection, split into
+// fields. It writes an error and returns nil if there is none.
+func readControl(conn net.Conn) []string {
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return nil
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		fmt.Fprintln(conn, "error: empty command")
+	}
+	return fields
+}
+
+func (h *Handler) handleControl(c context.Context, conn net.Conn) {
+	defer conn.Close()
+	if fields := readControl(conn); len(fields) > 0 {
+		h.control(c, conn, fields)
+	}
+}
+
+// control runs a lifecycle command, writing its output to w.
+func (h *Handler) control(c context.Context, w io.Writer, fields []string) {
+	var err error
+	code := ExitCodeShutdown
+	switch fields[0] {
+	case "events":
+		period := time.Hour
+		if len(fields) > 1 {
+			if period, err = parsePeriod(fields[1]); err != nil {
+				fmt.Fprintf(w, "error: %s\n", err)
+				return
+			}
+		}
+		for _, line := range h.eventLines(period) {
+			fmt.Fprintln(w, line)
+		}
+		return
+	case "shutdown":
+		if len(fields) > 1 {
+			if code, err = strconv.Atoi(fields[1]); err != nil {
+				fmt.Fprintf(w, "error: invalid exit code: %s\n", fields[1])
+				return
+			}
+		}
+	case "restart":
+		code = ExitCodeRestart
+	default:
+		fmt.Fprintf(w, "error: unknown command: %s\n", fields[0])
+		return
+	}
+	fmt.Fprintln(w, "ok")
+	if err := h.Shutdown(c, code); err != nil {
+		log.Error().Err(err).Msg("error shutting down")
+	}
+}
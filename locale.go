@@ -0,0 +1,293 @@
+package chatlib
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultLocale is the locale of users and channels that haven't chosen one.
+const DefaultLocale = "en"
+
+// Names of the user preferences the Handler keeps, see PrefKey.
+const (
+	PrefLocale   = "locale"
+	PrefTimeZone = "timezone"
+)
+
+// Locale is how times, numbers and durations are written in a language.
+type Locale struct {
+	// Tag names the locale, e.g. de or en-us.
+	Tag string
+	// Decimal separates the fraction of numbers, and Group every three
+	// digits of the integer part.
+	Decimal string
+	Group   string
+	// DateTime, Date and Clock are time layouts for a time, a day and a time
+	// of day. The English day and month names they give are replaced with
+	// Days and Months.
+	DateTime string
+	Date     string
+	Clock    string
+	// Days are the abbreviated names of the days of the week, from Sunday.
+	Days [7]string
+	// Months are the abbreviated names of the months, from January.
+	Months [12]string
+	// Units are the singular and plural of days, hours, minutes and seconds.
+	Units [4][2]string
+	// And joins the units of a duration.
+	And string
+}
+
+var englishDays = [7]string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+var englishMonths = [12]string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"}
+
+var englishUnits = [4][2]string{{"day", "days"}, {"hour", "hours"}, {"minute", "minutes"}, {"second", "seconds"}}
+
+// locales are the locales that can be chosen, by tag.
+var locales = map[string]Locale{
+	"en": {
+		Tag: "en", Decimal: ".", Group: ",",
+		DateTime: "Mon 2 Jan 15:04 MST", Date: "Mon 2 Jan", Clock: "15:04",
+		Days: englishDays, Months: englishMonths, Units: englishUnits, And: "and",
+	},
+	"en-us": {
+		Tag: "en-us", Decimal: ".", Group: ",",
+		DateTime: "Mon Jan 2 3:04 PM MST", Date: "Mon Jan 2", Clock: "3:04 PM",
+		Days: englishDays, Months: englishMonths, Units: englishUnits, And: "and",
+	},
+	"de": {
+		Tag: "de", Decimal: ",", Group: ".",
+		DateTime: "Mon 2. Jan 15:04 MST", Date: "Mon 2. Jan", Clock: "15:04",
+		Days:   [7]string{"So", "Mo", "Di", "Mi", "Do", "Fr", "Sa"},
+		Months: [12]string{"Jan", "Feb", "Mär", "Apr", "Mai", "Jun", "Jul", "Aug", "Sep", "Okt", "Nov", "Dez"},
+		Units:  [4][2]string{{"Tag", "Tage"}, {"Stunde", "Stunden"}, {"Minute", "Minuten"}, {"Sekunde", "Sekunden"}},
+		And:    "und",
+	},
+	"es": {
+		Tag: "es", Decimal: ",", Group: ".",
+		DateTime: "Mon 2 Jan 15:04 MST", Date: "Mon 2 Jan", Clock: "15:04",
+		Days:   [7]string{"dom", "lun", "mar", "mié", "jue", "vie", "sáb"},
+		Months: [12]string{"ene", "feb", "mar", "abr", "may", "jun", "jul", "ago", "sept", "oct", "nov", "dic"},
+		Units:  [4][2]string{{"día", "días"}, {"hora", "horas"}, {"minuto", "minutos"}, {"segundo", "segundos"}},
+		And:    "y",
+	},
+	"fr": {
+		Tag: "fr", Decimal: ",", Group: "\u202f",
+		DateTime: "Mon 2 Jan 15:04 MST", Date: "Mon 2 Jan", Clock: "15:04",
+		Days:   [7]string{"dim.", "lun.", "mar.", "mer.", "jeu.", "ven.", "sam."},
+		Months: [12]string{"janv.", "févr.", "mars", "avr.", "mai", "juin", "juil.", "août", "sept.", "oct.", "nov.", "déc."},
+		Units:  [4][2]string{{"jour", "jours"}, {"heure", "heures"}, {"minute", "minutes"}, {"seconde", "secondes"}},
+		And:    "et",
+	},
+	"nl": {
+		Tag: "nl", Decimal: ",", Group: ".",
+		DateTime: "Mon 2 Jan 15:04 MST", Date: "Mon 2 Jan", Clock: "15:04",
+		Days:   [7]string{"zo", "ma", "di", "wo", "do", "vr", "za"},
+		Months: [12]string{"jan", "feb", "mrt", "apr", "mei", "jun", "jul", "aug", "sep", "okt", "nov", "dec"},
+		Units:  [4][2]string{{"dag", "dagen"}, {"uur", "uur"}, {"minuut", "minuten"}, {"seconde", "seconden"}},
+		And:    "en",
+	},
+}
+
+// LookupLocale returns the locale named by tag, e.g. de, en_US or pt-BR,
+// falling back to its language, e.g. de for de-AT.
+func LookupLocale(tag string) (Locale, bool) {
+	tag = strings.ToLower(strings.ReplaceAll(tag, "_", "-"))
+	if l, ok := locales[tag]; ok {
+		return l, true
+	}
+	lang, _, _ := strings.Cut(tag, "-")
+	l, ok := locales[lang]
+	return l, ok
+}
+
+// LocaleTags returns the tags of the locales that can be chosen.
+func LocaleTags() []string {
+	tags := make([]string, 0, len(locales))
+	for tag := range locales {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// Formatter writes times, numbers and durations for a user or channel, in
+// their locale and time zone.
+type Formatter struct {
+	Locale Locale
+	Zone   *time.Location
+}
+
+// In returns a copy of f showing times in loc.
+func (f Formatter) In(loc *time.Location) Formatter {
+	f.Zone = loc
+	return f
+}
+
+// FormatTime writes t with its day and time of day, e.g. "Tue 14 Nov 09:00
+// CET".
+func (f Formatter) FormatTime(t time.Time) string {
+	return f.format(t, f.Locale.DateTime)
+}
+
+// FormatDate writes the day of t, e.g. "Tue 14 Nov".
+func (f Formatter) FormatDate(t time.Time) string {
+	return f.format(t, f.Locale.Date)
+}
+
+// FormatClock writes the time of day of t, e.g. "09:00".
+func (f Formatter) FormatClock(t time.Time) string {
+	return f.format(t, f.Locale.Clock)
+}
+
+func (f Formatter) format(t time.Time, layout string) string {
+	if f.Zone != nil {
+		t = t.In(f.Zone)
+	}
+	s := t.Format(layout)
+	// The names are replaced in one pass, so a name isn't replaced twice
+	// when a day is named like a month
+	var names []string
+	if strings.Contains(layout, "Mon") {
+		names = append(names, englishDays[t.Weekday()], f.Locale.Days[t.Weekday()])
+	}
+	if strings.Contains(layout, "Jan") {
+		names = append(names, englishMonths[t.Month()-1], f.Locale.Months[t.Month()-1])
+	}
+	if len(names) == 0 {
+		return s
+	}
+	return strings.NewReplacer(names...).Replace(s)
+}
+
+// FormatNumber writes n with decimals digits after the separator, grouping
+// the digits of the integer part, e.g. "1,234.5".
+func (f Formatter) FormatNumber(n float64, decimals int) string {
+	s := strconv.FormatFloat(n, 'f', max(decimals, 0), 64)
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	var b strings.Builder
+	b.WriteString(sign)
+	for i, d := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteString(f.Locale.Group)
+		}
+		b.WriteRune(d)
+	}
+	if frac != "" {
+		b.WriteString(f.Locale.Decimal + frac)
+	}
+	return b.String()
+}
+
+// FormatDuration writes d in its two largest units, to the second, e.g. "2
+// hours and 30 minutes". The sign of d is ignored.
+func (f Formatter) FormatDuration(d time.Duration) string {
+	if d < 0 {
+		d = -d
+	}
+	d = d.Round(time.Second)
+	counts := [4]int64{
+		int64(d / (24 * time.Hour)),
+		int64(d % (24 * time.Hour) / time.Hour),
+		int64(d % time.Hour / time.Minute),
+		int64(d % time.Minute / time.Second),
+	}
+	unit := func(i int) string {
+		name := f.Locale.Units[i][1]
+		if counts[i] == 1 {
+			name = f.Locale.Units[i][0]
+		}
+		return f.FormatNumber(float64(counts[i]), 0) + " " + name
+	}
+	for i, n := range counts {
+		if n == 0 {
+			continue
+		}
+		if i < 3 && counts[i+1] != 0 {
+			return unit(i) + " " + f.Locale.And + " " + unit(i+1)
+		}
+		return unit(i)
+	}
+	return unit(3)
+}
+
+// PrefKey is where a user's preference, e.g. PrefLocale, is kept in the
+// Store. Nicks are case insensitive on most networks.
+func PrefKey(api, nick, name string) string {
+	return "prefs/" + api + "/" + strings.ToLower(nick) + "/" + name
+}
+
+// Locale returns the locale of the sender of msg: the one they have chosen,
+// or else the Locale setting of its channel.
+func (h *Handler) Locale(c context.Context, msg *Message) Locale {
+	if b, err := h.store.Get(c, PrefKey(msg.API, msg.Nick, PrefLocale)); err == nil {
+		if l, ok := LookupLocale(string(b)); ok {
+			return l
+		}
+	}
+	if l, ok := LookupLocale(h.Settings(msg.API, msg.Channel()).Locale); ok {
+		return l
+	}
+	return locales[DefaultLocale]
+}
+
+// Zone returns the time zone of the sender of msg: the one they have chosen,
+// or else the TimeZone setting of its channel, or else fallback.
+func (h *Handler) Zone(c context.Context, msg *Message, fallback *time.Location) *time.Location {
+	if b, err := h.store.Get(c, PrefKey(msg.API, msg.Nick, PrefTimeZone)); err == nil {
+		if loc, err := time.LoadLocation(string(b)); err == nil {
+			return loc
+		}
+	}
+	if name := h.Settings(msg.API, msg.Channel()).TimeZone; name != "" {
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+	}
+	return fallback
+}
+
+// Formatter returns a Formatter for the sender of msg, in their locale and
+// time zone, or the system's time zone if neither they nor the channel chose
+// one.
+func (h *Handler) Formatter(c context.Context, msg *Message) Formatter {
+	return Formatter{Locale: h.Locale(c, msg), Zone: h.Zone(c, msg, time.Local)}
+}
+
+// WithLocaleAction adds the !locale action, which shows or sets the locale
+// of the user's times and numbers.
+func WithLocaleAction() Option {
+	return func(h *Handler) error {
+		return h.ApplyOptions(
+			RegisterCommand("locale", "", "!locale", "show your locale", h.actionLocale),
+			RegisterCommand("locale", `(\S+)`, "!locale de", "set the locale of your times and numbers", h.actionLocale),
+		)
+	}
+}
+
+func (h *Handler) actionLocale(c context.Context, re *regexp.Regexp, msg *Message) error {
+	if parts := re.FindStringSubmatch(msg.Text); len(parts) > 1 {
+		l, ok := LookupLocale(parts[1])
+		if !ok {
+			return h.Reply(c, msg, "unknown locale "+parts[1]+", try one of "+strings.Join(LocaleTags(), ", "))
+		}
+		if err := h.store.Set(c, PrefKey(msg.API, msg.Nick, PrefLocale), []byte(l.Tag)); err != nil {
+			return errors.WithMessage(err, "error saving locale")
+		}
+		log.Debug().Str("nick", msg.Nick).Str("locale", l.Tag).Msg("locale set")
+	}
+	f := h.Formatter(c, msg)
+	return h.Reply(c, msg, "your locale is "+f.Locale.Tag+": "+f.FormatTime(time.Now())+", "+f.FormatNumber(1234.5, 1))
+}
@@ -0,0 +1,168 @@
+package chatlib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultLogMirrorPerMinute = 5
+	DefaultLogMirrorDedupe    = 10 * time.Minute
+	logMirrorQueueSize        = 32
+)
+
+// LogMirror is a zerolog writer that forwards log events at or above a level
+// to chat, so operators notice trouble without tailing the logs. Repeats of
+// the same event are held back for the dedupe window and at most perMinute
+// events are forwarded a minute. Add it to the logger's writers with
+// zerolog.MultiLevelWriter and to the Handler with WithLogMirror.
+type LogMirror struct {
+	level     zerolog.Level
+	api       string
+	targets   []string
+	perMinute int
+	dedupe    time.Duration
+
+	mu          sync.Mutex
+	seen        map[string]time.Time
+	repeats     map[string]int
+	windowStart time.Time
+	sent        int
+	dropped     int
+	queue       chan string
+}
+
+var _ zerolog.LevelWriter = (*LogMirror)(nil)
+
+// NewLogMirror returns a LogMirror sending events at or above level to the
+// targets on the named API. api may be empty if the Handler has one API.
+func NewLogMirror(level zerolog.Level, api string, targets []string, perMinute int, dedupe time.Duration) (*LogMirror, error) {
+	if len(targets) == 0 {
+		return nil, errors.WithMessage(ErrInvalidConfig, "log mirror needs at least one target")
+	}
+	if perMinute <= 0 {
+		return nil, errors.WithMessagef(ErrInvalidConfig, "log mirror rate must be positive, got %d", perMinute)
+	}
+	return &LogMirror{
+		level:     level,
+		api:       api,
+		targets:   targets,
+		perMinute: perMinute,
+		dedupe:    dedupe,
+		seen:      make(map[string]time.Time),
+		repeats:   make(map[string]int),
+		queue:     make(chan string, logMirrorQueueSize),
+	}, nil
+}
+
+// WithLogMirror sends the events collected by m to chat while the Handler is
+// running.
+func WithLogMirror(m *LogMirror) Option {
+	return func(h *Handler) error {
+		h.logMirror = m
+		return nil
+	}
+}
+
+// Write implements io.Writer. Events without a level are not mirrored.
+func (m *LogMirror) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// WriteLevel implements zerolog.LevelWriter. It never fails so that logging
+// is not disturbed by chat trouble.
+func (m *LogMirror) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	if level < m.level || level >= zerolog.NoLevel {
+		return len(p), nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(p, &fields); err != nil {
+		return len(p), nil
+	}
+	text := fmt.Sprint(fields[zerolog.MessageFieldName])
+	if err, ok := fields[zerolog.ErrorFieldName]; ok {
+		text += ": " + fmt.Sprint(err)
+	}
+	if api, ok := fields["api"]; ok {
+		text = fmt.Sprint(api) + ": " + text
+	}
+	text = "[" + level.String() + "] " + strings.TrimSpace(text)
+	if text, ok := m.admit(text, time.Now()); ok {
+		select {
+		case m.queue <- text:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// admit applies deduplication and the rate limit to text and returns the
+// text to send, annotated with the number of repeats held back.
+func (m *LogMirror) admit(text string, now time.Time) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if last, ok := m.seen[text]; ok && now.Sub(last) < m.dedupe {
+		m.repeats[text]++
+		return "", false
+	}
+	if now.Sub(m.windowStart) >= time.Minute {
+		m.windowStart = now
+		m.sent = 0
+	}
+	if m.sent >= m.perMinute {
+		m.dropped++
+		return "", false
+	}
+	m.sent++
+	m.seen[text] = now
+	out := text
+	if n := m.repeats[text]; n > 0 {
+		out += fmt.Sprintf(" (repeated %d times)", n)
+		delete(m.repeats, text)
+	}
+	if m.dropped > 0 {
+		out += fmt.Sprintf(" (%d other events dropped)", m.dropped)
+		m.dropped = 0
+	}
+	// Forget old events so the maps don't grow forever, along with how often
+	// they were repeated
+	for k, t := range m.seen {
+		if now.Sub(t) >= m.dedupe {
+			delete(m.seen, k)
+			delete(m.repeats, k)
+		}
+	}
+	return out, true
+}
+
+// mirrorLogs sends mirrored events until the context is cancelled. Send
+// failures are only logged at debug level so they can't feed back into the
+// mirror.
+func (h *Handler) mirrorLogs(c context.Context) {
+	m := h.logMirror
+	for {
+		select {
+		case <-c.Done():
+			return
+		case text := <-m.queue:
+			for _, target := range m.targets {
+				if err := h.Send(c, &Message{
+					Command:  CommandNotice,
+					Receiver: target,
+					Text:     text,
+					API:      m.api,
+				}); err != nil {
+					log.Debug().Err(err).Str("target", target).Msg("error mirroring log event")
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package chatlib
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Mailer sends email, e.g. the codes users verify their address with.
+type Mailer interface {
+	SendMail(c context.Context, to, subject, body string) error
+}
+
+// WithMailer sets the Mailer the Handler sends email with.
+func WithMailer(m Mailer) Option {
+	return func(h *Handler) error {
+		h.mailer = m
+		return nil
+	}
+}
+
+// SMTPMailer sends email through an SMTP server, upgrading to TLS if the
+// server offers it.
+type SMTPMailer struct {
+	// Address is the host:port of the server, e.g. smtp.example.com:587.
+	Address string
+	// From is the address mail is sent from.
+	From string
+	// Username and Password log in with PLAIN if Username is set, which
+	// needs TLS unless the server is on localhost.
+	Username string
+	Password string
+}
+
+// SendMail sends body to the address to. net/smtp doesn't take a context,
+// so the mail is given up on if c is done first but may still be sent.
+func (m *SMTPMailer) SendMail(c context.Context, to, subject, body string) error {
+	host, _, err := net.SplitHostPort(m.Address)
+	if err != nil {
+		return errors.WithMessagef(ErrInvalidConfig, "invalid smtp address %s: %s", m.Address, err)
+	}
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return errors.Errorf("invalid mail header: %q", to)
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	text := "From: " + m.From + "\r\nTo: " + to + "\r\nSubject: " + subject +
+		"\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n" + strings.ReplaceAll(body, "\n", "\r\n") + "\r\n"
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.Address, auth, m.From, []string{to}, []byte(text))
+	}()
+	select {
+	case <-c.Done():
+		return errors.Wrap(ErrTimeout, "sending mail")
+	case err := <-done:
+		return errors.Wrapf(err, "error sending mail to %s", to)
+	}
+}
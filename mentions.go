@@ -0,0 +1,89 @@
+package chatlib
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultMentionBreak is put after the first character of each nick in a
+// message that would highlight too many users: a zero width space, which
+// clients don't show but which stops the nick from matching.
+const DefaultMentionBreak = "\u200b"
+
+// MemberLister is implemented by APIs that know who is in a channel.
+type MemberLister interface {
+	// MemberNicks returns the nicks of the channel's members, or none if the
+	// bot isn't in it.
+	MemberNicks(channel string) []string
+}
+
+// guardMentions breaks up the nicks in msg if it names more members of its
+// channel than the MentionLimit setting allows, e.g. when repeating a list of
+// nicks, so the bot doesn't highlight everyone in the channel.
+func (h *Handler) guardMentions(api API, msg *Message) *Message {
+	if msg.Command != CommandMessage && msg.Command != CommandNotice && msg.Command != CommandAction {
+		return msg
+	}
+	ml, ok := api.(MemberLister)
+	if !ok {
+		return msg
+	}
+	s := h.Settings(msg.API, msg.Receiver)
+	if s.MentionLimit <= 0 {
+		return msg
+	}
+	members := make(map[string]bool)
+	for _, nick := range ml.MemberNicks(msg.Receiver) {
+		members[strings.ToLower(nick)] = true
+	}
+	mentioned := make(map[string]bool)
+	for _, word := range nickWords(msg.Text) {
+		if members[strings.ToLower(word)] {
+			mentioned[strings.ToLower(word)] = true
+		}
+	}
+	if len(mentioned) <= s.MentionLimit {
+		return msg
+	}
+	brk := s.MentionBreak
+	if brk == "" {
+		brk = DefaultMentionBreak
+	}
+	var b strings.Builder
+	text := msg.Text
+	for len(text) > 0 {
+		end := strings.IndexFunc(text, func(r rune) bool { return !isNickRune(r) })
+		if end < 0 {
+			end = len(text)
+		}
+		word := text[:end]
+		if _, size := utf8.DecodeRuneInString(word); mentioned[strings.ToLower(word)] && size < len(word) {
+			word = word[:size] + brk + word[size:]
+		}
+		b.WriteString(word)
+		if end == len(text) {
+			break
+		}
+		_, size := utf8.DecodeRuneInString(text[end:])
+		b.WriteString(text[end : end+size])
+		text = text[end+size:]
+	}
+	log.Debug().Str("receiver", msg.Receiver).Msgf("broke up %d nicks to avoid highlighting them", len(mentioned))
+	m := *msg
+	m.Text = b.String()
+	return &m
+}
+
+// nickWords returns the runs of characters nicks can be made of in text.
+func nickWords(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool { return !isNickRune(r) })
+}
+
+// isNickRune reports whether r can be part of a nick, which besides letters
+// and digits may have the characters IRC allows.
+func isNickRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("[]\\`_^{|}-", r)
+}
@@ -0,0 +1,189 @@
+package chatlib
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+)
+
+// What is done to users breaking the content rules of a channel, see
+// Settings.RuleAction.
+const (
+	// RuleWarn tells users privately which rule they broke.
+	RuleWarn = "warn"
+	// RuleKick removes users from the channel on APIs that can, and warns
+	// them on those that can't.
+	RuleKick = "kick"
+	// RuleEscalate warns users, and removes them once they break the rules
+	// RuleStrikes times within ruleStrikeWindow.
+	RuleEscalate = "escalate"
+)
+
+// RuleStrikes is how many times users may break the rules of a channel
+// with RuleEscalate within ruleStrikeWindow before they are removed.
+const RuleStrikes = 3
+
+// ruleStrikeWindow is how long a broken rule counts against a user.
+const ruleStrikeWindow = time.Hour
+
+// mediaExtensions are the extensions of the files links are taken for media
+// by.
+var mediaExtensions = []string{
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".bmp", ".svg", ".heic",
+	".mp4", ".webm", ".mov", ".mkv", ".avi",
+	".mp3", ".ogg", ".opus", ".wav", ".flac", ".m4a",
+}
+
+// mediaHosts are the hosts whose links are taken for media whatever their
+// path.
+var mediaHosts = []string{
+	"youtube.com", "youtu.be", "vimeo.com", "twitch.tv", "soundcloud.com",
+	"imgur.com", "giphy.com", "tenor.com", "gfycat.com", "streamable.com",
+}
+
+// ruleStrikes are the times users broke the rules of the channels they are
+// in, within ruleStrikeWindow.
+type ruleStrikes struct {
+	mu      sync.Mutex
+	strikes map[memberKey][]time.Time
+}
+
+// strike records a broken rule at now and returns how many count against
+// the user.
+func (r *ruleStrikes) strike(k memberKey, now time.Time) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.strikes == nil {
+		r.strikes = make(map[memberKey][]time.Time)
+	}
+	kept := slices.DeleteFunc(r.strikes[k], func(t time.Time) bool { return now.Sub(t) > ruleStrikeWindow })
+	r.strikes[k] = append(kept, now)
+	return len(r.strikes[k])
+}
+
+func (r *ruleStrikes) forgive(k memberKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.strikes, k)
+}
+
+// ContentRule returns the content rule of s msg breaks, as told to the user
+// breaking it, or an empty string. Rules read the annotations of msg, which
+// lets packages the Handler doesn't know of add their own.
+type ContentRule func(s Settings, msg *Message) string
+
+// WithContentRule adds rule to those enforced by WithModeration.
+func WithContentRule(rule ContentRule) Option {
+	return func(h *Handler) error {
+		h.contentRules = append(h.contentRules, rule)
+		return nil
+	}
+}
+
+// WithModeration enforces the content rules of channels, set with
+// LinksOnly, NoLinks, NoMedia, MaxLineLength, SlowMode and NoCrosspost, and
+// those added with WithContentRule, on the messages of their users. Users breaking them are dealt with by RuleAction, unless
+// they have one of the RuleExempt roles or are admins. It adds !slowmode,
+// which tells whether the channel is in slow mode, and with which admins
+// turn it on, off or set its interval in seconds, for networks without a
+// mode of their own for it.
+func WithModeration() Option {
+	return func(h *Handler) error {
+		return h.ApplyOptions(
+			RegisterAction(CommandMessage, "", "", "", h.actionModerate),
+			RegisterAction(CommandAction, "", "", "", h.actionModerate),
+			RegisterCommand("slowmode", "", "!slowmode", "tell whether the channel is in slow mode", h.actionSlowMode),
+			RegisterCommand("slowmode", `(on|off|\d+)`, "!slowmode 30", "turn slow mode on or off, or set its interval in seconds", h.actionSlowMode, RoleAdmin),
+		)
+	}
+}
+
+// BrokenRule returns the content rule of s text breaks, as told to the user
+// breaking it, or an empty string.
+func BrokenRule(s Settings, text string) string {
+	urls := FindURLs(text)
+	switch {
+	case s.MaxLineLength > 0 && utf8.RuneCountInString(text) > s.MaxLineLength:
+		return fmt.Sprintf("lines are at most %d characters long", s.MaxLineLength)
+	case s.LinksOnly && len(urls) == 0:
+		return "only links may be posted"
+	case s.NoLinks && len(urls) > 0:
+		return "links may not be posted"
+	case s.NoMedia && slices.ContainsFunc(urls, isMedia):
+		return "images, videos and audio may not be posted"
+	}
+	return ""
+}
+
+// isMedia reports whether the link is to an image, video or audio.
+func isMedia(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	if slices.Contains(mediaExtensions, strings.ToLower(path.Ext(u.Path))) {
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	return slices.ContainsFunc(mediaHosts, func(h string) bool { return host == h || strings.HasSuffix(host, "."+h) })
+}
+
+func (h *Handler) actionModerate(c context.Context, re *regexp.Regexp, msg *Message) error {
+	if msg.Private || msg.Nick == "" || msg.Replayed {
+		return nil
+	}
+	s := h.Settings(msg.API, msg.Channel())
+	if h.isAdminSender(msg) || slices.ContainsFunc(s.RuleExempt, func(role string) bool { return h.hasRole(msg, role, s) }) {
+		return nil
+	}
+	k := memberKey{scope{strings.ToLower(msg.API), strings.ToLower(msg.Channel())}, strings.ToLower(msg.Nick)}
+	rule := BrokenRule(s, msg.Text)
+	if _, crosspost := AnnotationCrosspost.Get(msg); rule == "" && crosspost && s.NoCrosspost {
+		rule = "the same message may not be posted in several channels"
+	}
+	for _, r := range h.contentRules {
+		if rule != "" {
+			break
+		}
+		rule = r(s, msg)
+	}
+	if rule == "" {
+		interval, err := h.SlowMode(c, msg.API, msg.Channel())
+		if err != nil {
+			return err
+		}
+		if wait := h.slowModes.talk(k, interval, time.Now()); wait > 0 {
+			f := h.Formatter(c, msg)
+			rule = "the channel is in slow mode, one message every " + f.FormatDuration(interval) + ", wait " + f.FormatDuration(wait.Round(time.Second))
+		}
+	}
+	if rule == "" {
+		return nil
+	}
+	strikes := h.ruleStrikes.strike(k, time.Now())
+	logger := log.With().Str("api", msg.API).Str("channel", msg.Channel()).Str("nick", msg.Nick).Str("rule", rule).Int("strikes", strikes).Logger()
+	kick := s.RuleAction == RuleKick || s.RuleAction == RuleEscalate && strikes >= RuleStrikes
+	if kicker, ok := h.API(msg.API).(Kicker); kick && ok {
+		logger.Info().Msg("removing user for breaking a channel rule")
+		h.ruleStrikes.forgive(k)
+		return kicker.Kick(c, msg.Channel(), msg.Nick, "in "+msg.Channel()+", "+rule)
+	} else if kick {
+		logger.Warn().Msg("user broke a channel rule, the api can't remove them")
+	} else {
+		logger.Debug().Msg("warning user for breaking a channel rule")
+	}
+	text := "In " + msg.Channel() + ", " + rule
+	if s.RuleAction == RuleEscalate && strikes < RuleStrikes {
+		text += fmt.Sprintf(" (warning %d of %d)", strikes, RuleStrikes-1)
+	}
+	return h.Send(c, &Message{Command: CommandNotice, Receiver: msg.Nick, Text: text, API: msg.API})
+}
@@ -0,0 +1,412 @@
+package chatlib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultOutboxRetry       = time.Minute
+	DefaultOutboxAckTimeout  = 5 * time.Minute
+	DefaultOutboxMaxAttempts = 10
+)
+
+// Delivery states of an outbox entry, in the order they progress. A state
+// never goes back to an earlier one.
+const (
+	DeliveryPending   = "pending"
+	DeliverySent      = "sent"
+	DeliveryDelivered = "delivered"
+	DeliveryRead      = "read"
+	DeliveryFailed    = "failed"
+)
+
+const outboxKey = "outbox"
+
+// outboxKeep is how long finished entries are kept so their status can still
+// be looked up.
+const outboxKeep = 24 * time.Hour
+
+// DeliveryReceipt reports that a message sent with SendTracked reached its
+// recipient, State being DeliveryDelivered, or was read, DeliveryRead.
+type DeliveryReceipt struct {
+	ID    string
+	State string
+	Time  time.Time
+}
+
+// DeliveryReceipter is implemented by APIs whose backend confirms delivery or
+// read status, such as Matrix read receipts. Messages sent through the outbox
+// are resent until a receipt arrives. Through other APIs a message counts as
+// delivered once it is sent.
+type DeliveryReceipter interface {
+	// SendTracked sends msg and returns the ID its receipts will carry.
+	SendTracked(c context.Context, msg *Message) (string, error)
+	// Receipts returns the channel receipts are sent on. It is read for as
+	// long as the Handler runs.
+	Receipts() <-chan DeliveryReceipt
+}
+
+// OutboxEntry is a message in the outbox and how far its delivery has got.
+type OutboxEntry struct {
+	ID          string    `json:"id"`
+	API         string    `json:"api"`
+	Command     string    `json:"command"`
+	Receiver    string    `json:"receiver"`
+	Text        string    `json:"text"`
+	State       string    `json:"state"`
+	Attempts    int       `json:"attempts"`
+	ReceiptIDs  []string  `json:"receiptIds,omitempty"`
+	NextAttempt time.Time `json:"nextAttempt,omitempty"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Done reports whether the outbox has stopped trying to deliver the entry.
+func (e *OutboxEntry) Done() bool {
+	return e.State == DeliveryDelivered || e.State == DeliveryRead || e.State == DeliveryFailed
+}
+
+// Outbox delivers messages at least once. Entries are kept in the Store so
+// messages not yet delivered are retried after a restart.
+type Outbox struct {
+	h           *Handler
+	retry       time.Duration
+	ackTimeout  time.Duration
+	maxAttempts int
+	wake        chan struct{}
+
+	mu      sync.Mutex
+	loaded  bool
+	entries []*OutboxEntry
+}
+
+// WithOutbox enables SendReliable. Messages that fail to send are retried
+// every retry, and messages sent through a DeliveryReceipter are resent if no
+// receipt arrives within ackTimeout. After maxAttempts sends the message is
+// given up on and the admins are told.
+func WithOutbox(retry, ackTimeout time.Duration, maxAttempts int) Option {
+	return func(h *Handler) error {
+		if retry <= 0 || ackTimeout <= 0 {
+			return errors.WithMessage(ErrInvalidConfig, "outbox retry and ack timeout must be positive")
+		}
+		if maxAttempts <= 0 {
+			return errors.WithMessagef(ErrInvalidConfig, "outbox attempts must be positive, got %d", maxAttempts)
+		}
+		h.outbox = &Outbox{
+			h:           h,
+			retry:       retry,
+			ackTimeout:  ackTimeout,
+			maxAttempts: maxAttempts,
+			wake:        make(chan struct{}, 1),
+		}
+		return WithTask("outbox", h.outbox.run)(h)
+	}
+}
+
+// Outbox returns the Handler's outbox, or nil if it has none.
+func (h *Handler) Outbox() *Outbox {
+	return h.outbox
+}
+
+// SendReliable queues msg in the outbox and returns the ID to look its
+// delivery up by with Outbox.Status. Use it for messages that must not be
+// lost, such as critical alerts.
+func (h *Handler) SendReliable(c context.Context, msg *Message) (string, error) {
+	if h.outbox == nil {
+		return "", errors.WithMessage(ErrInvalidConfig, "no outbox configured")
+	}
+	name := msg.API
+	if name == "" {
+		if len(h.apis) != 1 {
+			return "", errors.New("message has no api and the handler has several")
+		}
+		name = h.apis[0].name
+	} else if h.API(name) == nil {
+		return "", errors.Errorf("unknown api: %s", name)
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	e := &OutboxEntry{
+		ID:          hex.EncodeToString(b),
+		API:         name,
+		Command:     msg.Command,
+		Receiver:    msg.Receiver,
+		Text:        msg.Text,
+		State:       DeliveryPending,
+		NextAttempt: now,
+		Created:     now,
+		Updated:     now,
+	}
+	if err := h.outbox.add(c, e); err != nil {
+		return "", err
+	}
+	return e.ID, nil
+}
+
+// Status returns a copy of the entry with the given ID.
+func (o *Outbox) Status(id string) (OutboxEntry, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, e := range o.entries {
+		if e.ID == id {
+			return *e, true
+		}
+	}
+	return OutboxEntry{}, false
+}
+
+func (o *Outbox) add(c context.Context, e *OutboxEntry) error {
+	o.mu.Lock()
+	if err := o.load(c); err != nil {
+		o.mu.Unlock()
+		return err
+	}
+	o.entries = append(o.entries, e)
+	err := o.save(c)
+	o.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// load reads the entries from the Store the first time it is called. The
+// Store isn't known until the Handler is built, so it can't be done earlier.
+func (o *Outbox) load(c context.Context) error {
+	if o.loaded {
+		return nil
+	}
+	b, err := o.h.store.Get(c, outboxKey)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &o.entries); err != nil {
+			return errors.Wrap(err, "chat: failed to decode outbox")
+		}
+	}
+	o.loaded = true
+	return nil
+}
+
+// save drops entries finished long enough ago and persists the rest.
+func (o *Outbox) save(c context.Context) error {
+	kept := o.entries[:0]
+	for _, e := range o.entries {
+		if !e.Done() || time.Since(e.Updated) < outboxKeep {
+			kept = append(kept, e)
+		}
+	}
+	o.entries = kept
+	b, err := json.Marshal(o.entries)
+	if err != nil {
+		return err
+	}
+	return o.h.store.Set(c, outboxKey, b)
+}
+
+// run sends due entries until the context is cancelled, waking up when the
+// next one is due or a new one is added.
+func (o *Outbox) run(c context.Context) error {
+	for _, na := range o.h.apis {
+		if dr, ok := na.api.(DeliveryReceipter); ok {
+			go o.receive(c, na.name, dr.Receipts())
+		}
+	}
+	t := time.NewTimer(0)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.Done():
+			return c.Err()
+		case <-o.wake:
+		case <-t.C:
+		}
+		next := o.sendDue(c)
+		t.Stop()
+		t.Reset(time.Until(next))
+	}
+}
+
+// sendDue attempts every entry that is due and returns when the next one will
+// be.
+func (o *Outbox) sendDue(c context.Context) time.Time {
+	o.mu.Lock()
+	if err := o.load(c); err != nil {
+		o.mu.Unlock()
+		log.Error().Err(err).Msg("error loading outbox")
+		return time.Now().Add(o.retry)
+	}
+	now := time.Now()
+	due := make([]*OutboxEntry, 0)
+	for _, e := range o.entries {
+		if !e.Done() && !e.NextAttempt.After(now) {
+			due = append(due, e)
+		}
+	}
+	o.mu.Unlock()
+	for _, e := range due {
+		o.attempt(c, e)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.save(c); err != nil {
+		log.Error().Err(err).Msg("error saving outbox")
+	}
+	next := time.Now().Add(o.retry)
+	for _, e := range o.entries {
+		if !e.Done() && e.NextAttempt.Before(next) {
+			next = e.NextAttempt
+		}
+	}
+	return next
+}
+
+// attempt sends an entry, or gives up on it if it has had all its attempts.
+func (o *Outbox) attempt(c context.Context, e *OutboxEntry) {
+	o.mu.Lock()
+	if e.Done() {
+		// A receipt arrived while other entries were being sent
+		o.mu.Unlock()
+		return
+	}
+	if e.Attempts >= o.maxAttempts {
+		reason := e.Error
+		if e.State == DeliverySent {
+			reason = "no delivery receipt"
+		}
+		e.State, e.Updated = DeliveryFailed, time.Now()
+		o.mu.Unlock()
+		log.Error().Str("api", e.API).Str("receiver", e.Receiver).Msgf("giving up on outbox message after %d attempts: %s", e.Attempts, reason)
+		o.h.record(c, EventDelivery, e.API, "gave up on message %s to %s after %d attempts: %s", e.ID, e.Receiver, e.Attempts, reason)
+		o.h.NotifyAdmins(c, e.API, "failed to deliver a message to "+e.Receiver+" after "+strconv.Itoa(e.Attempts)+" attempts: "+reason)
+		return
+	}
+	msg := &Message{API: e.API, Command: e.Command, Receiver: e.Receiver, Text: e.Text}
+	o.mu.Unlock()
+
+	receiptID, tracked, err := o.send(c, msg)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if e.Done() {
+		return
+	}
+	now := time.Now()
+	e.Attempts++
+	e.Updated = now
+	switch {
+	case errors.Is(err, ErrBlockedContent):
+		// Sending it again won't help
+		e.State, e.Error = DeliveryFailed, err.Error()
+	case err != nil:
+		e.Error = err.Error()
+		e.NextAttempt = now.Add(o.retry)
+		log.Warn().Str("api", e.API).Err(err).Msgf("error sending outbox message, attempt %d of %d", e.Attempts, o.maxAttempts)
+	case tracked:
+		e.State, e.Error = DeliverySent, ""
+		e.ReceiptIDs = append(e.ReceiptIDs, receiptID)
+		e.NextAttempt = now.Add(o.ackTimeout)
+	default:
+		// Sending is as far as the API can confirm
+		e.State, e.Error = DeliveryDelivered, ""
+	}
+}
+
+// send sends msg, tracked if the API supports receipts.
+func (o *Outbox) send(c context.Context, msg *Message) (string, bool, error) {
+	api, msg, err := o.h.prepare(c, msg)
+	if err != nil {
+		return "", false, err
+	}
+	if o.h.withheld(c, api, msg) {
+		return "", false, nil
+	}
+	if dr, ok := api.(DeliveryReceipter); ok {
+		id, err := dr.SendTracked(c, msg)
+		return id, true, err
+	}
+	return "", false, o.h.sendMessage(c, api, msg)
+}
+
+// receive applies the receipts of an API to its entries.
+func (o *Outbox) receive(c context.Context, api string, receipts <-chan DeliveryReceipt) {
+	for {
+		select {
+		case <-c.Done():
+			return
+		case r, ok := <-receipts:
+			if !ok {
+				return
+			}
+			o.applyReceipt(c, api, r)
+		}
+	}
+}
+
+func (o *Outbox) applyReceipt(c context.Context, api string, r DeliveryReceipt) {
+	if r.State != DeliveryDelivered && r.State != DeliveryRead {
+		log.Warn().Str("api", api).Msgf("ignoring receipt with state %q", r.State)
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, e := range o.entries {
+		if e.API != api || !containsString(e.ReceiptIDs, r.ID) {
+			continue
+		}
+		if deliveryRank(r.State) <= deliveryRank(e.State) {
+			return
+		}
+		e.State, e.Updated = r.State, time.Now()
+		if !r.Time.IsZero() {
+			e.Updated = r.Time
+		}
+		if err := o.save(c); err != nil {
+			log.Error().Err(err).Msg("error saving outbox")
+		}
+		return
+	}
+}
+
+// deliveryRank orders the states a receipt can move an entry through. A
+// failed entry is final.
+func deliveryRank(state string) int {
+	switch state {
+	case DeliveryPending:
+		return 0
+	case DeliverySent:
+		return 1
+	case DeliveryDelivered:
+		return 2
+	case DeliveryRead:
+		return 3
+	}
+	return 4
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package chatlib
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPageLines      = 4
+	DefaultPageTTLSeconds = 600
+)
+
+// pager holds the lines left over from long replies until they are asked for
+// with !more or expire.
+type pager struct {
+	mu    sync.Mutex
+	lines int
+	ttl   time.Duration
+	pages map[string]*page
+}
+
+type page struct {
+	lines   []string
+	expires time.Time
+}
+
+// WithPagination limits replies sent with ReplyLines to lines lines at a time
+// and registers the !more command to send the rest.
+func WithPagination(lines int) Option {
+	return func(h *Handler) error {
+		h.pager = &pager{
+			lines: lines,
+			ttl:   DefaultPageTTLSeconds * time.Second,
+			pages: make(map[string]*page),
+		}
+		return RegisterCommand("more", "", "!more", "show more of the last long reply", h.actionMore)(h)
+	}
+}
+
+// ReplyLines replies with each line as a separate message. If pagination is
+// enabled only the first page is sent and the rest is kept for !more, per
+// sender and channel.
+func (h *Handler) ReplyLines(c context.Context, msg *Message, lines []string) error {
+	if h.pager == nil {
+		return h.sendLines(c, msg, lines)
+	}
+	h.pager.mu.Lock()
+	delete(h.pager.pages, pageKey(msg))
+	h.pager.mu.Unlock()
+	return h.sendPage(c, msg, lines)
+}
+
+func (h *Handler) sendPage(c context.Context, msg *Message, lines []string) error {
+	if len(lines) <= h.pager.lines {
+		return h.sendLines(c, msg, lines)
+	}
+	rest := lines[h.pager.lines:]
+	h.pager.mu.Lock()
+	h.pager.pages[pageKey(msg)] = &page{
+		lines:   rest,
+		expires: time.Now().Add(h.pager.ttl),
+	}
+	h.pager.mu.Unlock()
+	if err := h.sendLines(c, msg, lines[:h.pager.lines]); err != nil {
+		return err
+	}
+	return h.Reply(c, msg, fmt.Sprintf("(%d more lines, say %smore)", len(rest), h.commandPrefix))
+}
+
+func (h *Handler) sendLines(c context.Context, msg *Message, lines []string) error {
+	for _, line := range lines {
+		if err := h.Reply(c, msg, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) actionMore(c context.Context, re *regexp.Regexp, msg *Message) error {
+	key := pageKey(msg)
+	h.pager.mu.Lock()
+	p, ok := h.pager.pages[key]
+	delete(h.pager.pages, key)
+	// Drop anything else that has expired while we hold the lock
+	for k, v := range h.pager.pages {
+		if time.Now().After(v.expires) {
+			delete(h.pager.pages, k)
+		}
+	}
+	h.pager.mu.Unlock()
+	if !ok || time.Now().After(p.expires) {
+		return h.Reply(c, msg, "nothing more to show")
+	}
+	return h.sendPage(c, msg, p.lines)
+}
+
+func pageKey(msg *Message) string {
+	return strings.ToLower(msg.ReplyTarget()) + " " + strings.ToLower(msg.Nick)
+}
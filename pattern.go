@@ -0,0 +1,187 @@
+package chatlib
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultPatternMaxLength     = 1024
+	DefaultPatternMaxComplexity = 5000
+	DefaultPatternMatchTime     = 10 * time.Millisecond
+	// patternProbeLength is the length of the text patterns are tried on
+	// when compiled, longer than any IRC line.
+	patternProbeLength = 1024
+	// patternTries is how many times a match is timed, keeping the fastest.
+	patternTries = 3
+)
+
+// PatternLimits guard against patterns, such as those in configuration, that
+// are too expensive to match. Go's regexps run in linear time, but a large
+// enough pattern, e.g. from nested repetition counts, can still take long on
+// every message. A zero limit is not enforced.
+type PatternLimits struct {
+	// MaxLength is the longest pattern accepted, in bytes.
+	MaxLength int
+	// MaxComplexity is the most instructions the pattern may compile to.
+	MaxComplexity int
+	// MatchTime is the longest a pattern may take to match a message. It is
+	// checked when the pattern is compiled, on text longer than any message,
+	// and on every message an action's pattern is matched against, allowing
+	// proportionally more for messages longer than that text. A match going
+	// over it is timed again, so that a pause such as garbage collection
+	// isn't held against the pattern, and actions still over it get a strike
+	// of the action budget, if there is one.
+	MatchTime time.Duration
+}
+
+var DefaultPatternLimits = PatternLimits{
+	MaxLength:     DefaultPatternMaxLength,
+	MaxComplexity: DefaultPatternMaxComplexity,
+	MatchTime:     DefaultPatternMatchTime,
+}
+
+// WithPatternLimits checks the patterns of every action against limits when
+// the Handler is created, instead of DefaultPatternLimits.
+func WithPatternLimits(limits PatternLimits) Option {
+	return func(h *Handler) error {
+		h.patternLimits = limits
+		return nil
+	}
+}
+
+// CompilePattern compiles pattern if it is within limits. The errors say what
+// is wrong with the pattern and wrap ErrInvalidPattern.
+func CompilePattern(pattern string, limits PatternLimits) (*regexp.Regexp, error) {
+	re, err := compilePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if err := limits.check(re); err != nil {
+		return nil, err
+	}
+	return re, nil
+}
+
+// compilePattern compiles pattern, explaining syntax errors.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		var serr *syntax.Error
+		if errors.As(err, &serr) {
+			return nil, errors.WithMessagef(ErrInvalidPattern, "%s in %q at %q", serr.Code, pattern, serr.Expr)
+		}
+		return nil, errors.WithMessagef(ErrInvalidPattern, "%q: %s", pattern, err)
+	}
+	return re, nil
+}
+
+// check returns an error if re is over the limits.
+func (l PatternLimits) check(re *regexp.Regexp) error {
+	pattern := re.String()
+	if l.MaxLength > 0 && len(pattern) > l.MaxLength {
+		return errors.WithMessagef(ErrInvalidPattern, "%q is %d bytes long, at most %d are allowed", truncatePattern(pattern), len(pattern), l.MaxLength)
+	}
+	if l.MaxComplexity > 0 {
+		n, err := patternComplexity(pattern)
+		if err != nil {
+			return errors.WithMessagef(ErrInvalidPattern, "%q: %s", truncatePattern(pattern), err)
+		}
+		if n > l.MaxComplexity {
+			return errors.WithMessagef(ErrInvalidPattern, "%q is too complex: it compiles to %d instructions, at most %d are allowed. Large repetition counts such as {100} multiply the size of what they repeat", truncatePattern(pattern), n, l.MaxComplexity)
+		}
+	}
+	if l.MatchTime > 0 {
+		if d := probePattern(re); d > l.MatchTime {
+			return errors.WithMessagef(ErrInvalidPattern, "%q is too slow: it took %s to match %d bytes, at most %s is allowed", truncatePattern(pattern), d.Round(time.Microsecond), patternProbeLength, l.MatchTime)
+		}
+	}
+	return nil
+}
+
+// patternComplexity returns the number of instructions pattern compiles to.
+func patternComplexity(pattern string) (int, error) {
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return 0, err
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return 0, err
+	}
+	return len(prog.Inst), nil
+}
+
+// probePattern times matches of re on text that makes it do as much work as
+// it can: repeated letters, repeated words, and mixed characters that no match
+// is found in. Each is timed a few times, keeping the fastest to leave out
+// pauses that aren't the pattern's fault.
+func probePattern(re *regexp.Regexp) time.Duration {
+	probes := []string{
+		strings.Repeat("a", patternProbeLength),
+		strings.Repeat("aa ", patternProbeLength/3),
+		strings.Repeat("a1-_.!", patternProbeLength/6),
+	}
+	var slowest time.Duration
+	for _, text := range probes {
+		slowest = max(slowest, timeMatch(re, text, patternTries))
+	}
+	return slowest
+}
+
+// timeMatch returns the fastest of tries matches of re on text.
+func timeMatch(re *regexp.Regexp, text string, tries int) time.Duration {
+	fastest := time.Duration(-1)
+	for i := 0; i < tries; i++ {
+		start := time.Now()
+		re.MatchString(text)
+		if d := time.Since(start); fastest < 0 || d < fastest {
+			fastest = d
+		}
+	}
+	return fastest
+}
+
+func truncatePattern(pattern string) string {
+	if len(pattern) > 40 {
+		return pattern[:40] + "..."
+	}
+	return pattern
+}
+
+// checkPatterns checks the patterns of the registered actions.
+func (h *Handler) checkPatterns() error {
+	for _, action := range h.actions {
+		if err := h.patternLimits.check(action.re); err != nil {
+			return errors.WithMessagef(err, "action %s", actionName(action))
+		}
+	}
+	return nil
+}
+
+// matches reports whether the action's pattern matches msg, counting a
+// budget strike against the action if matching took too long.
+func (h *Handler) matches(c context.Context, action *Action, msg *Message) bool {
+	limit := h.patternLimits.MatchTime
+	if limit <= 0 {
+		return action.re.MatchString(msg.Text)
+	}
+	if len(msg.Text) > patternProbeLength {
+		limit = limit * time.Duration(len(msg.Text)) / patternProbeLength
+	}
+	start := time.Now()
+	ok := action.re.MatchString(msg.Text)
+	if d := time.Since(start); d > limit {
+		// Only the pattern's fault if it is slow again
+		if d = timeMatch(action.re, msg.Text, patternTries); d > limit {
+			h.overBudget(c, action, msg, []string{fmt.Sprintf("match time %s > %s", d.Round(time.Microsecond), limit)})
+		}
+	}
+	return ok
+}
@@ -0,0 +1,53 @@
+package pgstore
+
+import (
+	"context"
+
+	"github.com/gregseb/chatlib"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	ModuleName      = "postgres"
+	DefaultMaxConns = 4
+)
+
+func init() {
+	chatlib.RegisterModule(chatlib.Module{
+		Name:  ModuleName,
+		Flags: Flags,
+		Init:  Init,
+	})
+}
+
+func Init() (*chatlib.Option, error) {
+	url := viper.GetString(ModuleName + ".url")
+	if url == "" {
+		log.Info().Msg("postgres store disabled")
+		return nil, nil
+	}
+	s, err := Open(context.Background(), url, viper.GetInt32(ModuleName+".max-conns"))
+	if err != nil {
+		return nil, err
+	}
+	cfg := s.pool.Config().ConnConfig
+	log.Info().Str("module", ModuleName).Msgf("using postgres store: %s@%s/%s", cfg.User, cfg.Host, cfg.Database)
+	// Replaces chat.store, module options are applied after the chat ones
+	opt := chatlib.WithStore(s)
+	if viper.GetBool(ModuleName + ".history") {
+		log.Info().Str("module", ModuleName).Msg("logging history to postgres")
+		opt = chatlib.CombineOptions(opt, chatlib.WithMiddleware(s.Middleware))
+	}
+	return &opt, nil
+}
+
+func Flags(cmd *cobra.Command) {
+	// URL
+	cmd.Flags().String(ModuleName+"-url", "", "PostgreSQL connection URL to use as the store instead of chat.store. Disabled if empty")
+	// MaxConns
+	cmd.Flags().Int32(ModuleName+"-max-conns", DefaultMaxConns, "Maximum number of connections to keep open")
+	// History
+	cmd.Flags().Bool(ModuleName+"-history", false, "Also keep message history in the database")
+}
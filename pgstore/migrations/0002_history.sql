@@ -0,0 +1,12 @@
+CREATE TABLE messages (
+	id       BIGSERIAL PRIMARY KEY,
+	sent_at  TIMESTAMPTZ NOT NULL,
+	api      TEXT NOT NULL DEFAULT '',
+	command  TEXT NOT NULL,
+	sender   TEXT NOT NULL,
+	nick     TEXT NOT NULL DEFAULT '',
+	receiver TEXT NOT NULL,
+	text     TEXT NOT NULL
+);
+CREATE INDEX messages_sent_at ON messages (sent_at);
+CREATE INDEX messages_receiver ON messages (receiver, sent_at);
@@ -0,0 +1,56 @@
+package pgstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/gregseb/chatlib"
+	"github.com/gregseb/chatlib/sqlmigrate"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := sqlmigrate.LoadMigrations(migrationFS, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("expected migration %d, got %d (%s)", i+1, m.Version, m.Name)
+		}
+	}
+}
+
+// TestStore needs a database, e.g.
+// CHATLIB_TEST_POSTGRES=postgres://postgres@localhost/chatlib_test
+func TestStore(t *testing.T) {
+	url := os.Getenv("CHATLIB_TEST_POSTGRES")
+	if url == "" {
+		t.Skip("CHATLIB_TEST_POSTGRES not set")
+	}
+	c := context.Background()
+	s, err := Open(c, url, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Get(c, "test/foo"); !errors.Is(err, chatlib.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	for _, v := range []string{"bar", "baz"} {
+		if err := s.Set(c, "test/foo", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := s.Get(c, "test/foo"); err != nil || string(v) != "baz" {
+		t.Errorf("expected baz, got %q, %v", v, err)
+	}
+	if err := s.Delete(c, "test/foo"); err != nil {
+		t.Fatal(err)
+	}
+	msg := &chatlib.Message{Command: chatlib.CommandMessage, Nick: "foo", Sender: "foo!bar@baz", Receiver: "#test", Text: "hello"}
+	if err := s.Middleware(c, msg); err != nil {
+		t.Fatal(err)
+	}
+}
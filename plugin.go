@@ -0,0 +1,68 @@
+package chatlib
+
+import (
+	"plugin"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// PluginABIVersion is bumped whenever a change to Handler, Message, Option or
+// Module would break plugins built against an older chatlib. Plugins record
+// the version they were built with and loaders refuse mismatches.
+const PluginABIVersion = 1
+
+// Symbols a Go plugin must export to be loaded with LoadPlugin:
+//
+//	var ChatlibABIVersion = chatlib.PluginABIVersion
+//	var ChatlibModule = chatlib.Module{...}
+const (
+	PluginABISymbol    = "ChatlibABIVersion"
+	PluginModuleSymbol = "ChatlibModule"
+)
+
+// CheckPluginABI returns ErrIncompatiblePlugin if a plugin built with version
+// cannot be used with this chatlib. Loaders for every plugin kind, whether Go
+// plugins, WASM or gRPC, must call it before using the plugin.
+func CheckPluginABI(name string, version int) error {
+	if version != PluginABIVersion {
+		return errors.WithMessagef(ErrIncompatiblePlugin, "plugin %s was built for chatlib ABI version %d, this is version %d; rebuild the plugin against this chatlib", name, version, PluginABIVersion)
+	}
+	return nil
+}
+
+// LoadPlugin opens a Go plugin, checks its ABI version and registers the
+// module it exports.
+func LoadPlugin(path string) (*Module, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open plugin: %s", path)
+	}
+	sym, err := p.Lookup(PluginABISymbol)
+	if err != nil {
+		return nil, errors.WithMessagef(ErrIncompatiblePlugin, "plugin %s does not export %s", path, PluginABISymbol)
+	}
+	version, ok := sym.(*int)
+	if !ok {
+		return nil, errors.WithMessagef(ErrIncompatiblePlugin, "plugin %s exports %s as %T, expected int", path, PluginABISymbol, sym)
+	}
+	if err := CheckPluginABI(path, *version); err != nil {
+		return nil, err
+	}
+	sym, err = p.Lookup(PluginModuleSymbol)
+	if err != nil {
+		return nil, errors.WithMessagef(ErrIncompatiblePlugin, "plugin %s does not export %s", path, PluginModuleSymbol)
+	}
+	m, ok := sym.(*Module)
+	if !ok {
+		return nil, errors.WithMessagef(ErrIncompatiblePlugin, "plugin %s exports %s as %T, expected chatlib.Module", path, PluginModuleSymbol, sym)
+	}
+	if m.Name == "" || m.Init == nil {
+		return nil, errors.WithMessagef(ErrIncompatiblePlugin, "plugin %s exports an incomplete module", path)
+	}
+	if err := registerModule(*m); err != nil {
+		return nil, err
+	}
+	log.Info().Str("plugin", path).Str("module", m.Name).Msg("loaded plugin")
+	return m, nil
+}
@@ -0,0 +1,136 @@
+package chatlib
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Thresholds above which an API is under high pressure, see Pressure.High.
+const (
+	HighPressureQueue   = 10
+	HighPressureLatency = 2 * time.Second
+)
+
+// latencySmoothing is the weight of the latest send in the moving average of
+// send latency.
+const latencySmoothing = 0.2
+
+// Queuer is implemented by APIs that queue messages, e.g. behind a flood
+// limit, so the Handler can tell how far behind they are.
+type Queuer interface {
+	// Queued returns how many received messages wait to be handled and how
+	// many wait to be sent.
+	Queued() (incoming, outgoing int)
+}
+
+// Pressure is how loaded the pipeline of an API is. Modules sending output
+// that can wait or be dropped, such as relays and feeds, check it to slow
+// down or skip what isn't critical while the bot is busy, e.g.
+//
+//	if chatlib.PressureFrom(c, msg.API).High() {
+//		return nil
+//	}
+type Pressure struct {
+	// Incoming and Outgoing are the messages waiting to be handled and to
+	// be sent, for APIs that are Queuers.
+	Incoming int `json:"incoming"`
+	Outgoing int `json:"outgoing"`
+	// SendLatency is the moving average of how long sends take, including
+	// the time waiting in the API's queue.
+	SendLatency time.Duration `json:"send-latency"`
+}
+
+// High reports whether the pressure is high enough that output that isn't
+// critical should be held back.
+func (p Pressure) High() bool {
+	return p.Incoming >= HighPressureQueue || p.Outgoing >= HighPressureQueue || p.SendLatency >= HighPressureLatency
+}
+
+// Backlog is how long the messages waiting to be sent will take to go out,
+// judging by the send latency. Modules can wait that long between messages
+// to keep from adding to the queue.
+func (p Pressure) Backlog() time.Duration {
+	return time.Duration(p.Outgoing) * p.SendLatency
+}
+
+// sendLatency is the moving average of how long sends through an API take.
+type sendLatency struct {
+	mu  sync.Mutex
+	avg time.Duration
+}
+
+func (l *sendLatency) observe(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.avg == 0 {
+		l.avg = d
+		return
+	}
+	l.avg = time.Duration(latencySmoothing*float64(d) + (1-latencySmoothing)*float64(l.avg))
+}
+
+func (l *sendLatency) get() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.avg
+}
+
+// sendMessage sends msg through api, measuring how long it takes.
+func (h *Handler) sendMessage(c context.Context, api API, msg *Message) error {
+	start := time.Now()
+	err := api.SendMessage(c, msg)
+	if na := h.apiNamed(msg.API); na != nil {
+		na.latency.observe(time.Since(start))
+	}
+	return err
+}
+
+// apiNamed returns the API with the given name, or the only one if name is
+// empty, or nil.
+func (h *Handler) apiNamed(name string) *namedAPI {
+	if name == "" && len(h.apis) == 1 {
+		return &h.apis[0]
+	}
+	for i := range h.apis {
+		if h.apis[i].name == name {
+			return &h.apis[i]
+		}
+	}
+	return nil
+}
+
+// Pressure returns how loaded the named API is. With an empty name, the
+// highest pressure of every API is returned.
+func (h *Handler) Pressure(api string) Pressure {
+	if api != "" || len(h.apis) == 1 {
+		if na := h.apiNamed(api); na != nil {
+			return na.pressure()
+		}
+		return Pressure{}
+	}
+	var p Pressure
+	for i := range h.apis {
+		q := h.apis[i].pressure()
+		p.Incoming, p.Outgoing, p.SendLatency = max(p.Incoming, q.Incoming), max(p.Outgoing, q.Outgoing), max(p.SendLatency, q.SendLatency)
+	}
+	return p
+}
+
+func (na *namedAPI) pressure() Pressure {
+	p := Pressure{SendLatency: na.latency.get()}
+	if q, ok := na.api.(Queuer); ok {
+		p.Incoming, p.Outgoing = q.Queued()
+	}
+	return p
+}
+
+// PressureFrom returns how loaded the named API of the Handler running the
+// action or task the context was passed to is, see Handler.Pressure. It is
+// zero outside of a Handler.
+func PressureFrom(c context.Context, api string) Pressure {
+	if h := FromContext(c); h != nil {
+		return h.Pressure(api)
+	}
+	return Pressure{}
+}
@@ -0,0 +1,46 @@
+package remind
+
+import (
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	ModuleName         = "remind"
+	DefaultDefaultZone = "UTC"
+)
+
+func init() {
+	chatlib.RegisterModule(chatlib.Module{
+		Name:  ModuleName,
+		Flags: Flags,
+		Init:  Init,
+	})
+}
+
+func Init() (*chatlib.Option, error) {
+	if !viper.GetBool(ModuleName + ".enable") {
+		log.Info().Msg("reminders disabled")
+		return nil, nil
+	}
+	name := viper.GetString(ModuleName + ".default-zone")
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "remind: invalid default zone: %s", name)
+	}
+	log.Info().Str("module", ModuleName).Msgf("reminders enabled, default time zone: %s", loc)
+	opt := WithReminders(loc)
+	return &opt, nil
+}
+
+func Flags(cmd *cobra.Command) {
+	// Enable
+	cmd.Flags().Bool(ModuleName+"-enable", true, "Let users set reminders with !remind")
+	// DefaultZone
+	cmd.Flags().String(ModuleName+"-default-zone", DefaultDefaultZone, "Time zone for users who haven't set one with !timezone, where the chat time zone isn't set")
+}
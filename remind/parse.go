@@ -0,0 +1,204 @@
+package remind
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultHour is the time of day used for dates given without a time, e.g.
+// "tomorrow" or "friday".
+const DefaultHour = 9
+
+// maxWhenWords is the most words a time expression may span, e.g.
+// "next friday at 9:30 pm".
+const maxWhenWords = 6
+
+var (
+	clockPattern    = regexp.MustCompile(`^(\d{1,2})(?::(\d{2}))?(am|pm)?$`)
+	durationPattern = regexp.MustCompile(`^(\d+|an?\s)\s*([a-z]+)`)
+)
+
+var durationUnits = map[string]time.Duration{
+	"w": 7 * 24 * time.Hour, "week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+	"h": time.Hour, "hr": time.Hour, "hrs": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"m": time.Minute, "min": time.Minute, "mins": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"s": time.Second, "sec": time.Second, "secs": time.Second, "second": time.Second, "seconds": time.Second,
+}
+
+// Parse reads a time from the start of text and returns it in UTC along with
+// the rest of the text. It understands relative times such as "in 2h30m" or
+// "in 3 days", days such as "tomorrow", "friday" or "2023-11-05", and times
+// of day such as "9am", "17:30" or "noon", optionally after a day and "at".
+// Days and times are in loc. A time of day on its own is the next time the
+// clock shows it and a day on its own is at DefaultHour.
+func Parse(text string, now time.Time, loc *time.Location) (time.Time, string, error) {
+	words := strings.Fields(text)
+	now = now.In(loc)
+	for n := min(len(words), maxWhenWords); n > 0; n-- {
+		lower := make([]string, n)
+		for i, w := range words[:n] {
+			lower[i] = strings.ToLower(w)
+		}
+		if t, ok := parseWhen(lower, now); ok {
+			return t.UTC(), strings.Join(words[n:], " "), nil
+		}
+	}
+	return time.Time{}, text, errors.New(`couldn't tell when, try e.g. "in 2h30m", "tomorrow 9am" or "friday at 17:30"`)
+}
+
+func parseWhen(w []string, now time.Time) (time.Time, bool) {
+	if w[0] == "in" {
+		d, ok := parseDuration(strings.Join(w[1:], " "))
+		if !ok {
+			return time.Time{}, false
+		}
+		return now.Add(d), true
+	}
+	day, w, hasDay := parseDay(w, now)
+	if len(w) > 0 && w[0] == "at" {
+		if w = w[1:]; len(w) == 0 {
+			return time.Time{}, false
+		}
+	}
+	if len(w) == 0 {
+		return at(day, DefaultHour, 0), hasDay
+	}
+	hour, minute, ok := parseClock(w)
+	if !ok {
+		return time.Time{}, false
+	}
+	if hasDay {
+		return at(day, hour, minute), true
+	}
+	t := at(now, hour, minute)
+	if !t.After(now) {
+		t = at(now.AddDate(0, 0, 1), hour, minute)
+	}
+	return t, true
+}
+
+// parseDay parses a day at the start of w, returning it and the words after
+// it.
+func parseDay(w []string, now time.Time) (time.Time, []string, bool) {
+	switch w[0] {
+	case "today":
+		return now, w[1:], true
+	case "tomorrow":
+		return now.AddDate(0, 0, 1), w[1:], true
+	}
+	if t, err := time.ParseInLocation("2006-01-02", w[0], now.Location()); err == nil {
+		return t, w[1:], true
+	}
+	rest := w
+	if rest[0] == "next" && len(rest) > 1 {
+		rest = rest[1:]
+	}
+	if wd, ok := parseWeekday(rest[0]); ok {
+		// The next one after today, a week ahead if it is today
+		days := (int(wd)-int(now.Weekday())+6)%7 + 1
+		return now.AddDate(0, 0, days), rest[1:], true
+	}
+	return time.Time{}, w, false
+}
+
+func parseWeekday(s string) (time.Weekday, bool) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if s == name || s == name[:3] {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// parseClock parses a time of day such as "9am", "9:30 pm", "21:00" or
+// "noon". Bare numbers are not times, so "remind me 5 things" isn't one.
+func parseClock(w []string) (int, int, bool) {
+	if len(w) > 2 || (len(w) == 2 && w[1] != "am" && w[1] != "pm") {
+		return 0, 0, false
+	}
+	s := strings.Join(w, "")
+	switch s {
+	case "noon":
+		return 12, 0, true
+	case "midnight":
+		return 0, 0, true
+	}
+	m := clockPattern.FindStringSubmatch(s)
+	if m == nil || (m[2] == "" && m[3] == "") {
+		return 0, 0, false
+	}
+	hour, _ := strconv.Atoi(m[1])
+	minute := 0
+	if m[2] != "" {
+		minute, _ = strconv.Atoi(m[2])
+	}
+	switch {
+	case minute > 59:
+		return 0, 0, false
+	case m[3] == "":
+		if hour > 23 {
+			return 0, 0, false
+		}
+	case hour < 1 || hour > 12:
+		return 0, 0, false
+	case m[3] == "am":
+		hour %= 12
+	default:
+		hour = hour%12 + 12
+	}
+	return hour, minute, true
+}
+
+// parseDuration parses durations such as "2h30m", "90 minutes" or "an hour".
+func parseDuration(s string) (time.Duration, bool) {
+	var total time.Duration
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+	for s != "" {
+		m := durationPattern.FindStringSubmatch(s)
+		if m == nil {
+			return 0, false
+		}
+		unit, ok := durationUnits[m[2]]
+		if !ok {
+			return 0, false
+		}
+		n := 1
+		if num := strings.TrimSpace(m[1]); num != "a" && num != "an" {
+			n, _ = strconv.Atoi(num)
+		}
+		total += time.Duration(n) * unit
+		s = strings.TrimLeft(s[len(m[0]):], " ,")
+		s = strings.TrimPrefix(s, "and ")
+	}
+	return total, total > 0
+}
+
+// at returns the given time of day on day, in day's location. Going through
+// time.Date rather than adding hours keeps it right across DST changes.
+func at(day time.Time, hour, minute int) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, day.Location())
+}
+
+// Format renders t in loc for chat, e.g. "Tue 14 Nov 09:00 CET".
+func Format(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format("Mon 2 Jan 15:04 MST")
+}
+
+// Until renders the time left until t, to the minute, e.g. "2h30m".
+func Until(t, now time.Time) string {
+	d := t.Sub(now).Round(time.Minute)
+	if d < time.Minute {
+		return "less than a minute"
+	}
+	s := d.String()
+	return strings.TrimSuffix(s, "0s")
+}
@@ -0,0 +1,135 @@
+package remind
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MinInterval is the shortest interval a reminder may repeat at.
+const MinInterval = 5 * time.Minute
+
+// Recurrence says when a reminder repeats: every Interval, or at Hour:Minute
+// on each of Weekdays, or every day if there are none.
+type Recurrence struct {
+	Interval time.Duration  `json:"interval,omitempty"`
+	Weekdays []time.Weekday `json:"weekdays,omitempty"`
+	Hour     int            `json:"hour"`
+	Minute   int            `json:"minute"`
+}
+
+var workdays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+
+// ParseRecurrence reads a rule such as "every monday 10:00", "every weekday
+// at 9am", "every day" or "every 2h" from the start of text. It returns the
+// rule, the first time it falls due after now and the rest of the text.
+// Times of day are in loc.
+func ParseRecurrence(text string, now time.Time, loc *time.Location) (*Recurrence, time.Time, string, error) {
+	words := strings.Fields(text)
+	if len(words) < 2 || !strings.EqualFold(words[0], "every") {
+		return nil, time.Time{}, text, errors.New(`couldn't tell how often, try e.g. "every monday 10:00", "every weekday 9am" or "every 2h"`)
+	}
+	for n := min(len(words)-1, maxWhenWords); n > 0; n-- {
+		lower := make([]string, n)
+		for i, w := range words[1 : n+1] {
+			lower[i] = strings.ToLower(w)
+		}
+		rule, ok := parseRule(lower)
+		if !ok {
+			continue
+		}
+		if rule.Interval > 0 && rule.Interval < MinInterval {
+			return nil, time.Time{}, text, errors.Errorf("reminders can't repeat more often than every %s", MinInterval)
+		}
+		first := rule.Next(now, now, loc)
+		return rule, first, strings.Join(words[n+1:], " "), nil
+	}
+	return nil, time.Time{}, text, errors.New(`couldn't tell how often, try e.g. "every monday 10:00", "every weekday 9am" or "every 2h"`)
+}
+
+func parseRule(w []string) (*Recurrence, bool) {
+	if d, ok := parseDuration(strings.Join(w, " ")); ok {
+		return &Recurrence{Interval: d}, true
+	}
+	rule := &Recurrence{Hour: DefaultHour}
+	switch day := strings.TrimSuffix(w[0], "s"); day {
+	case "day":
+	case "weekday":
+		rule.Weekdays = workdays
+	default:
+		wd, ok := parseWeekday(day)
+		if !ok {
+			return nil, false
+		}
+		rule.Weekdays = []time.Weekday{wd}
+	}
+	w = w[1:]
+	if len(w) > 0 && w[0] == "at" {
+		if w = w[1:]; len(w) == 0 {
+			return nil, false
+		}
+	}
+	if len(w) > 0 {
+		hour, minute, ok := parseClock(w)
+		if !ok {
+			return nil, false
+		}
+		rule.Hour, rule.Minute = hour, minute
+	}
+	return rule, true
+}
+
+// Next returns when the rule next falls due after now, given it was last due
+// at prev. Intervals are counted from prev so they don't drift when a
+// delivery is late.
+func (r *Recurrence) Next(prev, now time.Time, loc *time.Location) time.Time {
+	if r.Interval > 0 {
+		t := prev.Add(r.Interval)
+		if !t.After(now) {
+			// Skip the ones missed while the bot was down
+			t = t.Add(now.Sub(t).Truncate(r.Interval) + r.Interval)
+		}
+		return t.UTC()
+	}
+	now = now.In(loc)
+	for i := 0; i <= 7; i++ {
+		t := at(now.AddDate(0, 0, i), r.Hour, r.Minute)
+		if t.After(now) && r.on(t.Weekday()) {
+			return t.UTC()
+		}
+	}
+	// Unreachable with a valid rule
+	return now.Add(24 * time.Hour).UTC()
+}
+
+func (r *Recurrence) on(wd time.Weekday) bool {
+	if len(r.Weekdays) == 0 {
+		return true
+	}
+	for _, d := range r.Weekdays {
+		if d == wd {
+			return true
+		}
+	}
+	return false
+}
+
+// String renders the rule for chat, e.g. "every monday at 10:00".
+func (r *Recurrence) String() string {
+	if r.Interval > 0 {
+		return "every " + strings.TrimSuffix(r.Interval.String(), "0s")
+	}
+	clock := time.Date(0, 1, 1, r.Hour, r.Minute, 0, 0, time.UTC).Format("15:04")
+	switch {
+	case len(r.Weekdays) == 0:
+		return "every day at " + clock
+	case len(r.Weekdays) == len(workdays) && r.Weekdays[0] == workdays[0]:
+		return "every weekday at " + clock
+	}
+	days := make([]string, len(r.Weekdays))
+	for i, d := range r.Weekdays {
+		days[i] = strings.ToLower(d.String())
+	}
+	return "every " + strings.Join(days, ", ") + " at " + clock
+}
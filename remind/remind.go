@@ -0,0 +1,469 @@
+// Package remind lets users set reminders, e.g. "!remind me tomorrow 9am
+// standup" or "!remind me every monday 10:00 standup". Times are read in each user's own time zone, stored in UTC and
+// shown back in the zone of whoever reads them.
+package remind
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// storeKey is where pending reminders are kept in the Store.
+const storeKey = "remind/reminders"
+
+// retryDelay is how long to wait before retrying reminders that could not be
+// delivered, e.g. while the API is reconnecting.
+const retryDelay = time.Minute
+
+// Reminder is a message to send to Nick at At.
+type Reminder struct {
+	ID int `json:"id"`
+	// API, Target and Nick say where to deliver the reminder: the channel or
+	// private conversation it was set in and who to address.
+	API    string `json:"api"`
+	Target string `json:"target"`
+	Nick   string `json:"nick"`
+	// SetBy is who set the reminder, if not Nick.
+	SetBy string    `json:"setBy,omitempty"`
+	Text  string    `json:"text"`
+	At    time.Time `json:"at"`
+	// Zone is the time zone of whoever set the reminder, for showing it back
+	// and working out when it repeats.
+	Zone    string    `json:"zone"`
+	Created time.Time `json:"created"`
+	// Every is set for reminders that repeat. They are rescheduled when
+	// delivered rather than removed.
+	Every *Recurrence `json:"every,omitempty"`
+}
+
+// Owns reports whether nick set the reminder or is reminded by it.
+func (r Reminder) Owns(api, nick string) bool {
+	return r.API == api && (strings.EqualFold(r.Nick, nick) || strings.EqualFold(r.SetBy, nick))
+}
+
+// location returns the reminder's time zone, UTC if it can't be loaded.
+func (r Reminder) location() *time.Location {
+	loc, err := time.LoadLocation(r.Zone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// Scheduler keeps pending reminders in a Store and delivers them when due.
+type Scheduler struct {
+	store chatlib.Store
+	now   func() time.Time
+	wake  chan struct{}
+
+	mu        sync.Mutex
+	loaded    bool
+	nextID    int
+	reminders []Reminder
+	// delivered is the last reminder delivered to each user, for snoozing.
+	delivered map[string]Reminder
+}
+
+func NewScheduler(store chatlib.Store) *Scheduler {
+	return &Scheduler{
+		store:     store,
+		now:       time.Now,
+		wake:      make(chan struct{}, 1),
+		delivered: make(map[string]Reminder),
+	}
+}
+
+// load reads the reminders from the Store the first time it is called. The
+// caller must hold mu.
+func (s *Scheduler) load(c context.Context) error {
+	if s.loaded {
+		return nil
+	}
+	b, err := s.store.Get(c, storeKey)
+	if errors.Is(err, chatlib.ErrNotFound) {
+		s.loaded = true
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "remind: failed to load reminders")
+	}
+	if err := json.Unmarshal(b, &s.reminders); err != nil {
+		return errors.Wrap(err, "remind: failed to parse reminders")
+	}
+	for _, r := range s.reminders {
+		s.nextID = max(s.nextID, r.ID)
+	}
+	s.loaded = true
+	return nil
+}
+
+// save writes the reminders to the Store. The caller must hold mu.
+func (s *Scheduler) save(c context.Context) error {
+	b, err := json.Marshal(s.reminders)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(s.store.Set(c, storeKey, b), "remind: failed to save reminders")
+}
+
+// Add schedules r, giving it an ID.
+func (s *Scheduler) Add(c context.Context, r Reminder) (Reminder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(c); err != nil {
+		return r, err
+	}
+	s.nextID++
+	r.ID = s.nextID
+	r.At = r.At.UTC()
+	s.reminders = append(s.reminders, r)
+	s.sort()
+	if err := s.save(c); err != nil {
+		return r, err
+	}
+	s.notify()
+	return r, nil
+}
+
+// List returns the pending reminders nick set or is reminded by, soonest
+// first.
+func (s *Scheduler) List(c context.Context, api, nick string) ([]Reminder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(c); err != nil {
+		return nil, err
+	}
+	list := make([]Reminder, 0)
+	for _, r := range s.reminders {
+		if r.Owns(api, nick) {
+			list = append(list, r)
+		}
+	}
+	return list, nil
+}
+
+// Cancel removes the reminder with the given ID if nick owns it. It returns
+// chatlib.ErrNotFound otherwise.
+func (s *Scheduler) Cancel(c context.Context, api, nick string, id int) (Reminder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(c); err != nil {
+		return Reminder{}, err
+	}
+	for i, r := range s.reminders {
+		if r.ID == id && r.Owns(api, nick) {
+			s.reminders = append(s.reminders[:i], s.reminders[i+1:]...)
+			return r, s.save(c)
+		}
+	}
+	return Reminder{}, chatlib.ErrNotFound
+}
+
+// Snooze reminds nick again of the last reminder delivered to them, after d.
+// It returns chatlib.ErrNotFound if there is nothing to snooze.
+func (s *Scheduler) Snooze(c context.Context, api, nick string, d time.Duration) (Reminder, error) {
+	s.mu.Lock()
+	key := deliveredKey(api, nick)
+	r, ok := s.delivered[key]
+	delete(s.delivered, key)
+	s.mu.Unlock()
+	if !ok {
+		return Reminder{}, chatlib.ErrNotFound
+	}
+	// A one off copy, a repeating reminder keeps its own schedule
+	r.At = s.now().Add(d)
+	r.Every = nil
+	return s.Add(c, r)
+}
+
+func deliveredKey(api, nick string) string {
+	return api + "/" + strings.ToLower(nick)
+}
+
+// sort orders the reminders soonest first. The caller must hold mu.
+func (s *Scheduler) sort() {
+	sort.SliceStable(s.reminders, func(i, j int) bool {
+		return s.reminders[i].At.Before(s.reminders[j].At)
+	})
+}
+
+// notify wakes Run to look at the reminders again.
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers reminders as they fall due until the context is cancelled.
+// Reminders that fell due while the bot was down are delivered straight
+// away. Failed deliveries are retried.
+func (s *Scheduler) Run(c context.Context, deliver func(c context.Context, r Reminder) error) error {
+	for {
+		wait, err := s.deliverDue(c, deliver)
+		if err != nil {
+			log.Error().Str("module", ModuleName).Err(err).Msg("error delivering reminders")
+			wait = retryDelay
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-c.Done():
+			t.Stop()
+			return c.Err()
+		case <-s.wake:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// deliverDue delivers the reminders that are due and returns how long to
+// wait for the next one.
+func (s *Scheduler) deliverDue(c context.Context, deliver func(c context.Context, r Reminder) error) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(c); err != nil {
+		return 0, err
+	}
+	now := s.now()
+	pending := make([]Reminder, 0, len(s.reminders))
+	changed := false
+	var failed error
+	for _, r := range s.reminders {
+		if r.At.After(now) {
+			pending = append(pending, r)
+			continue
+		}
+		if err := deliver(c, r); err != nil {
+			failed = err
+			pending = append(pending, r)
+			continue
+		}
+		s.delivered[deliveredKey(r.API, r.Nick)] = r
+		if r.Every != nil {
+			r.At = r.Every.Next(r.At, now, r.location())
+			pending = append(pending, r)
+		}
+		changed = true
+	}
+	s.reminders = pending
+	s.sort()
+	if changed {
+		if err := s.save(c); err != nil {
+			return 0, err
+		}
+	}
+	if failed != nil {
+		return 0, failed
+	}
+	if len(s.reminders) == 0 {
+		// Woken by Add
+		return 24 * time.Hour, nil
+	}
+	return s.reminders[0].At.Sub(now), nil
+}
+
+// module holds the state of the reminder actions for a Handler.
+type module struct {
+	h           *chatlib.Handler
+	defaultZone *time.Location
+
+	once      sync.Once
+	scheduler *Scheduler
+}
+
+// DefaultSnooze is how long !snooze puts a reminder off for if not told.
+const DefaultSnooze = 10 * time.Minute
+
+// WithReminders adds the !remind, !reminders, !snooze and !timezone actions.
+// Times are read in the user's time zone, or defaultZone if they haven't set
+// one.
+func WithReminders(defaultZone *time.Location) chatlib.Option {
+	return func(h *chatlib.Handler) error {
+		m := &module{h: h, defaultZone: defaultZone}
+		return h.ApplyOptions(
+			chatlib.RegisterCommand("remind", `(\S+)\s+(.+)`, "!remind me tomorrow 9am standup", "set a reminder, for you or someone else, e.g. every monday 10:00", m.actionRemind),
+			chatlib.RegisterCommand("reminders", "", "!reminders", "list your reminders", m.actionReminders),
+			chatlib.RegisterCommand("reminders", `cancel\s+#?(\d+)`, "!reminders cancel 3", "cancel one of your reminders", m.actionCancel),
+			chatlib.RegisterCommand("snooze", "", "!snooze", "remind you of the last reminder again in "+strings.TrimSuffix(DefaultSnooze.String(), "0s"), m.actionSnooze),
+			chatlib.RegisterCommand("snooze", `(.+)`, "!snooze 15m", "remind you of the last reminder again later", m.actionSnooze),
+			chatlib.RegisterCommand("timezone", "", "!timezone", "show your time zone", m.actionTimezone),
+			chatlib.RegisterCommand("timezone", `(\S+)`, "!timezone Europe/Berlin", "set your time zone", m.actionTimezone),
+			chatlib.WithTask("reminders", func(c context.Context) error {
+				return m.schedulerFor().Run(c, m.deliver)
+			}),
+		)
+	}
+}
+
+// schedulerFor returns the Scheduler, created on first use so it uses the
+// Store the Handler ends up with once every option is applied.
+func (m *module) schedulerFor() *Scheduler {
+	m.once.Do(func() {
+		m.scheduler = NewScheduler(m.h.Store())
+	})
+	return m.scheduler
+}
+
+func (m *module) zone(c context.Context, msg *chatlib.Message) *time.Location {
+	return m.h.Zone(c, msg, m.defaultZone)
+}
+
+// formatter writes times for the sender of msg, in their locale and zone.
+func (m *module) formatter(c context.Context, msg *chatlib.Message) chatlib.Formatter {
+	return m.h.Formatter(c, msg).In(m.zone(c, msg))
+}
+
+// until writes the time left until t, to the minute.
+func until(f chatlib.Formatter, t, now time.Time) string {
+	d := t.Sub(now).Round(time.Minute)
+	if d < time.Minute {
+		return "less than a minute"
+	}
+	return f.FormatDuration(d)
+}
+
+func (m *module) actionRemind(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+	parts := re.FindStringSubmatch(msg.Text)
+	who, rest := parts[1], parts[2]
+	loc := m.zone(c, msg)
+	now := time.Now()
+	var (
+		every *Recurrence
+		at    time.Time
+		text  string
+		err   error
+	)
+	if strings.HasPrefix(strings.ToLower(rest), "every ") {
+		every, at, text, err = ParseRecurrence(rest, now, loc)
+	} else {
+		at, text, err = Parse(rest, now, loc)
+	}
+	if err != nil {
+		return m.h.Reply(c, msg, err.Error())
+	}
+	text = strings.TrimPrefix(text, "to ")
+	if text == "" {
+		return m.h.Reply(c, msg, "what should I remind about?")
+	}
+	r := Reminder{
+		API:     msg.API,
+		Target:  msg.ReplyTarget(),
+		Nick:    msg.Nick,
+		Text:    text,
+		At:      at,
+		Zone:    loc.String(),
+		Created: now.UTC(),
+		Every:   every,
+	}
+	if !strings.EqualFold(who, "me") && !strings.EqualFold(who, msg.Nick) {
+		r.Nick, r.SetBy = who, msg.Nick
+	}
+	if _, err := m.schedulerFor().Add(c, r); err != nil {
+		return err
+	}
+	whom := "you"
+	if r.SetBy != "" {
+		whom = r.Nick
+	}
+	f := m.formatter(c, msg)
+	if every != nil {
+		return m.h.Reply(c, msg, "ok, I'll remind "+whom+" "+every.String()+", starting "+f.FormatTime(at))
+	}
+	return m.h.Reply(c, msg, "ok, I'll remind "+whom+" "+f.FormatTime(at)+" (in "+until(f, at, now)+")")
+}
+
+func (m *module) actionReminders(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+	list, err := m.schedulerFor().List(c, msg.API, msg.Nick)
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		return m.h.Reply(c, msg, "you have no reminders")
+	}
+	f := m.formatter(c, msg)
+	lines := make([]string, len(list))
+	for i, r := range list {
+		line := "#" + strconv.Itoa(r.ID) + " " + f.FormatTime(r.At)
+		if r.Every != nil {
+			line += " (" + r.Every.String() + ")"
+		}
+		if r.SetBy != "" {
+			line += " for " + r.Nick
+			if !strings.EqualFold(r.SetBy, msg.Nick) {
+				line += " from " + r.SetBy
+			}
+		}
+		lines[i] = line + ": " + r.Text
+	}
+	return m.h.ReplyLines(c, msg, lines)
+}
+
+func (m *module) actionCancel(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+	id, err := strconv.Atoi(re.FindStringSubmatch(msg.Text)[1])
+	if err != nil {
+		return m.h.Reply(c, msg, "no such reminder")
+	}
+	r, err := m.schedulerFor().Cancel(c, msg.API, msg.Nick, id)
+	if errors.Is(err, chatlib.ErrNotFound) {
+		return m.h.Reply(c, msg, "you have no reminder #"+strconv.Itoa(id))
+	} else if err != nil {
+		return err
+	}
+	return m.h.Reply(c, msg, "ok, cancelled #"+strconv.Itoa(r.ID)+": "+r.Text)
+}
+
+func (m *module) actionSnooze(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+	d := DefaultSnooze
+	if parts := re.FindStringSubmatch(msg.Text); len(parts) > 1 {
+		var ok bool
+		if d, ok = parseDuration(strings.ToLower(strings.TrimPrefix(parts[1], "for "))); !ok {
+			return m.h.Reply(c, msg, `couldn't tell for how long, try e.g. "15m" or "1h"`)
+		}
+	}
+	r, err := m.schedulerFor().Snooze(c, msg.API, msg.Nick, d)
+	if errors.Is(err, chatlib.ErrNotFound) {
+		return m.h.Reply(c, msg, "you have no reminder to snooze")
+	} else if err != nil {
+		return err
+	}
+	return m.h.Reply(c, msg, "ok, I'll remind you again "+m.formatter(c, msg).FormatTime(r.At)+": "+r.Text)
+}
+
+func (m *module) deliver(c context.Context, r Reminder) error {
+	text := r.Nick + ": " + r.Text
+	if r.SetBy != "" {
+		text += " (from " + r.SetBy + ")"
+	}
+	return m.h.Send(c, &chatlib.Message{
+		Command:  chatlib.CommandMessage,
+		Receiver: r.Target,
+		Text:     text,
+		API:      r.API,
+	})
+}
+
+func (m *module) actionTimezone(c context.Context, re *regexp.Regexp, msg *chatlib.Message) error {
+	name := ""
+	if parts := re.FindStringSubmatch(msg.Text); len(parts) > 1 {
+		name = parts[1]
+	}
+	if name == "" {
+		f := m.formatter(c, msg)
+		return m.h.Reply(c, msg, "your time zone is "+f.Zone.String()+", it is "+f.FormatTime(time.Now()))
+	}
+	loc, err := SetZone(c, m.h.Store(), msg.API, msg.Nick, name)
+	if err != nil {
+		return m.h.Reply(c, msg, err.Error())
+	}
+	return m.h.Reply(c, msg, "ok, your time zone is "+loc.String()+", it is "+m.formatter(c, msg).FormatTime(time.Now()))
+}
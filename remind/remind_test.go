@@ -0,0 +1,180 @@
+package remind
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestParse(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Thursday
+	now := time.Date(2023, 11, 2, 15, 0, 0, 0, berlin)
+	for _, tc := range []struct {
+		text     string
+		expected time.Time
+		rest     string
+	}{
+		{"in 2h30m stretch", now.Add(150 * time.Minute), "stretch"},
+		{"in 3 days and 2 hours to pay rent", now.Add(74 * time.Hour), "to pay rent"},
+		{"in an hour", now.Add(time.Hour), ""},
+		{"tomorrow 9am standup", time.Date(2023, 11, 3, 9, 0, 0, 0, berlin), "standup"},
+		{"tomorrow at 9:30 pm call", time.Date(2023, 11, 3, 21, 30, 0, 0, berlin), "call"},
+		{"friday lunch", time.Date(2023, 11, 3, 9, 0, 0, 0, berlin), "lunch"},
+		{"next thu 17:30 review", time.Date(2023, 11, 9, 17, 30, 0, 0, berlin), "review"},
+		{"noon eat", time.Date(2023, 11, 3, 12, 0, 0, 0, berlin), "eat"},
+		{"16:00 tea", time.Date(2023, 11, 2, 16, 0, 0, 0, berlin), "tea"},
+		{"2023-12-24 at 6pm presents", time.Date(2023, 12, 24, 18, 0, 0, 0, berlin), "presents"},
+		// Across the end of DST the wall clock time is kept
+		{"2023-10-29 9am", time.Date(2023, 10, 29, 9, 0, 0, 0, berlin), ""},
+	} {
+		at, rest, err := Parse(tc.text, now.UTC(), berlin)
+		if err != nil {
+			t.Errorf("%q: %s", tc.text, err)
+			continue
+		}
+		if !at.Equal(tc.expected) || rest != tc.rest {
+			t.Errorf("%q: expected %s %q, got %s %q", tc.text, tc.expected, tc.rest, at.In(berlin), rest)
+		}
+		if at.Location() != time.UTC {
+			t.Errorf("%q: expected UTC, got %s", tc.text, at.Location())
+		}
+	}
+	for _, text := range []string{"5 things", "in forever", "at 25:00", "13pm"} {
+		if _, _, err := Parse(text, now, berlin); err == nil {
+			t.Errorf("%q: expected an error", text)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	c := context.Background()
+	store := chatlib.NewMemoryStore()
+	now := time.Date(2023, 11, 2, 15, 0, 0, 0, time.UTC)
+	s := NewScheduler(store)
+	s.now = func() time.Time { return now }
+	for _, d := range []time.Duration{2 * time.Hour, time.Hour} {
+		if _, err := s.Add(c, Reminder{Nick: "foo", Text: d.String(), At: now.Add(d)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reminders survive a restart
+	s = NewScheduler(store)
+	now = now.Add(90 * time.Minute)
+	s.now = func() time.Time { return now }
+	delivered := make([]string, 0)
+	wait, err := s.deliverDue(c, func(c context.Context, r Reminder) error {
+		delivered = append(delivered, r.Text)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delivered) != 1 || delivered[0] != "1h0m0s" {
+		t.Errorf("expected the 1h reminder, got %v", delivered)
+	}
+	if wait != 30*time.Minute {
+		t.Errorf("expected to wait 30m, got %s", wait)
+	}
+	if r, _ := s.Add(c, Reminder{At: now}); r.ID != 3 {
+		t.Errorf("expected ID 3, got %d", r.ID)
+	}
+}
+
+func TestRecurrence(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Thursday
+	now := time.Date(2023, 11, 2, 15, 0, 0, 0, berlin)
+	for _, tc := range []struct {
+		text  string
+		rule  string
+		first time.Time
+		next  time.Time
+	}{
+		{"every monday 10:00 standup", "every monday at 10:00", time.Date(2023, 11, 6, 10, 0, 0, 0, berlin), time.Date(2023, 11, 13, 10, 0, 0, 0, berlin)},
+		{"every weekday at 9am standup", "every weekday at 09:00", time.Date(2023, 11, 3, 9, 0, 0, 0, berlin), time.Date(2023, 11, 6, 9, 0, 0, 0, berlin)},
+		{"every day standup", "every day at 09:00", time.Date(2023, 11, 3, 9, 0, 0, 0, berlin), time.Date(2023, 11, 4, 9, 0, 0, 0, berlin)},
+		{"every 2h standup", "every 2h0m", now.Add(2 * time.Hour), now.Add(4 * time.Hour)},
+	} {
+		rule, first, rest, err := ParseRecurrence(tc.text, now, berlin)
+		if err != nil {
+			t.Errorf("%q: %s", tc.text, err)
+			continue
+		}
+		if rule.String() != tc.rule || rest != "standup" {
+			t.Errorf("%q: expected %q, got %q %q", tc.text, tc.rule, rule, rest)
+		}
+		if !first.Equal(tc.first) {
+			t.Errorf("%q: expected first %s, got %s", tc.text, tc.first, first.In(berlin))
+		}
+		if next := rule.Next(first, first, berlin); !next.Equal(tc.next) {
+			t.Errorf("%q: expected next %s, got %s", tc.text, tc.next, next.In(berlin))
+		}
+	}
+	if _, _, _, err := ParseRecurrence("every 1m spam", now, berlin); err == nil {
+		t.Error("expected an error for a short interval")
+	}
+	// Intervals missed while down are skipped without drifting
+	rule := &Recurrence{Interval: time.Hour}
+	if next := rule.Next(now, now.Add(150*time.Minute), berlin); !next.Equal(now.Add(3 * time.Hour)) {
+		t.Errorf("expected %s, got %s", now.Add(3*time.Hour), next)
+	}
+}
+
+func TestSnoozeAndCancel(t *testing.T) {
+	c := context.Background()
+	now := time.Date(2023, 11, 2, 15, 0, 0, 0, time.UTC)
+	s := NewScheduler(chatlib.NewMemoryStore())
+	s.now = func() time.Time { return now }
+	weekly := &Recurrence{Weekdays: []time.Weekday{time.Thursday}, Hour: 15}
+	if _, err := s.Add(c, Reminder{API: "irc", Nick: "foo", Text: "weekly", At: now, Zone: "UTC", Every: weekly}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(c, Reminder{API: "irc", Nick: "bar", SetBy: "foo", Text: "once", At: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.deliverDue(c, func(c context.Context, r Reminder) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.List(c, "irc", "FOO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Text != "once" || !list[1].At.Equal(now.AddDate(0, 0, 7)) {
+		t.Errorf("expected the weekly reminder to be rescheduled, got %+v", list)
+	}
+	if list, _ := s.List(c, "irc", "bar"); len(list) != 1 {
+		t.Errorf("expected bar to see the reminder set for them, got %+v", list)
+	}
+
+	r, err := s.Snooze(c, "irc", "foo", 15*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Every != nil || !r.At.Equal(now.Add(15*time.Minute)) {
+		t.Errorf("expected a one off reminder in 15m, got %+v", r)
+	}
+	if _, err := s.Snooze(c, "irc", "foo", time.Minute); !errors.Is(err, chatlib.ErrNotFound) {
+		t.Errorf("expected ErrNotFound snoozing twice, got %v", err)
+	}
+
+	if _, err := s.Cancel(c, "irc", "baz", r.ID); !errors.Is(err, chatlib.ErrNotFound) {
+		t.Errorf("expected ErrNotFound cancelling someone else's reminder, got %v", err)
+	}
+	if _, err := s.Cancel(c, "irc", "foo", r.ID); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := s.List(c, "irc", "foo"); len(list) != 2 {
+		t.Errorf("expected 2 reminders left, got %+v", list)
+	}
+}
@@ -0,0 +1,41 @@
+package remind
+
+import (
+	"context"
+	"time"
+	// Time zones are looked up by name, embed the database for systems
+	// without one, e.g. scratch containers.
+	_ "time/tzdata"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+)
+
+// zoneKey is where a user's time zone preference is kept in the Store, the
+// same the Handler reads it from for its Formatter.
+func zoneKey(api, nick string) string {
+	return chatlib.PrefKey(api, nick, chatlib.PrefTimeZone)
+}
+
+// Zone returns the time zone the user has chosen, or fallback if they haven't
+// or it can't be loaded.
+func Zone(c context.Context, store chatlib.Store, api, nick string, fallback *time.Location) *time.Location {
+	b, err := store.Get(c, zoneKey(api, nick))
+	if err != nil {
+		return fallback
+	}
+	loc, err := time.LoadLocation(string(b))
+	if err != nil {
+		return fallback
+	}
+	return loc
+}
+
+// SetZone sets the user's time zone, an IANA name such as Europe/Berlin.
+func SetZone(c context.Context, store chatlib.Store, api, nick, name string) (*time.Location, error) {
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "" || name == "Local" {
+		return nil, errors.Errorf("unknown time zone %q, use a name like Europe/Berlin or America/New_York", name)
+	}
+	return loc, store.Set(c, zoneKey(api, nick), []byte(loc.String()))
+}
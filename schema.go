@@ -0,0 +1,278 @@
+package chatlib
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// overrideKeys are the settings that can be overridden per network and
+// channel.
+var overrideKeys = []string{"command-prefix", "command-rate", "reply-notice", "mention-limit", "mention-break", "locale", "time-zone", "verify", "welcome", "verify-question", "verify-answer", "verify-timeout", "links-only", "no-links", "no-media", "max-line-length", "rule-action", "slow-mode", "no-crosspost", "max-toxicity", "rule-exempt", "disabled-modules", "roles.*"}
+
+// chatConfigKeys are the keys of the chat section that aren't flags. dry-run
+// is left to the bot's start command.
+var chatConfigKeys = func() []string {
+	keys := []string{"dry-run", "channel-policies.*.banned-patterns", "channel-policies.*.banned-action", "roles.*"}
+	for _, k := range overrideKeys {
+		keys = append(keys, "channels.*."+k, "networks.*."+k, "networks.*.channels.*."+k)
+	}
+	return keys
+}()
+
+// ValidateConfig checks the config against its schema: the flags, named like
+// the keys with the section as prefix, e.g. irc-nick for irc.nick, and the
+// ConfigKeys of the modules. prefixes are the sections configured by flags.
+// Sections of modules without flags, such as plugins, aren't checked.
+//
+// It reports unknown keys, with the closest known key as a suggestion, and
+// values that don't fit the flag's type, which would otherwise be read as
+// zero values. The error wraps ErrInvalidConfig and lists every problem.
+func ValidateConfig(flags *pflag.FlagSet, prefixes []string) error {
+	schema := make(map[string]map[string]string)
+	patterns := make(map[string][]string)
+	for _, prefix := range prefixes {
+		schema[prefix] = make(map[string]string)
+	}
+	patterns[ConfigName] = chatConfigKeys
+	for _, m := range Modules() {
+		if m.Flags == nil {
+			delete(schema, m.Name)
+			continue
+		}
+		patterns[m.Name] = m.ConfigKeys
+	}
+	flags.VisitAll(func(f *pflag.Flag) {
+		for prefix, keys := range schema {
+			if name, ok := strings.CutPrefix(f.Name, prefix+"-"); ok {
+				keys[name] = f.Value.Type()
+			}
+		}
+	})
+
+	problems := make([]string, 0)
+	keys := viper.AllKeys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		section, name, _ := strings.Cut(key, ".")
+		known, ok := schema[section]
+		// A module's section with all of its keys commented out
+		if ok && name == "" && viper.Get(key) == nil {
+			continue
+		}
+		if !ok {
+			if isOpenSection(section) {
+				continue
+			}
+			problems = append(problems, unknownKey(key, suggest(section, sortedKeys(schema)), "."+name))
+			continue
+		}
+		if typ, ok := known[name]; ok {
+			if err := checkType(typ, viper.Get(key)); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", key, err))
+			}
+			continue
+		}
+		// Empty maps, such as a channel with its settings commented out,
+		// are kept as keys of their own
+		if matchesPattern(name, patterns[section], viper.Get(key) == nil) {
+			continue
+		}
+		candidates := sortedKeys(known)
+		for _, p := range patterns[section] {
+			if c := fillPattern(p, name); !strings.Contains(c, "*") {
+				candidates = append(candidates, c)
+			}
+		}
+		problems = append(problems, unknownKey(key, section+".", suggest(name, candidates)))
+	}
+	if len(problems) > 0 {
+		return errors.WithMessagef(ErrInvalidConfig, "config has %d problems:\n  %s", len(problems), strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// isOpenSection reports whether section is one that isn't checked: a module
+// without flags.
+func isOpenSection(section string) bool {
+	for _, m := range Modules() {
+		if m.Name == section && m.Flags == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownKey describes an unknown key, suggesting head + tail if the part
+// that was misspelled has a suggestion.
+func unknownKey(key, head, tail string) string {
+	if strings.HasSuffix(head, ".") && tail == "" || head == "" {
+		return "unknown key " + key
+	}
+	return "unknown key " + key + ", did you mean " + head + tail + "?"
+}
+
+// matchesPattern reports whether key matches one of the patterns, where *
+// matches any one part of the key. With partial, key may be the start of a
+// pattern.
+func matchesPattern(key string, patterns []string, partial bool) bool {
+	parts := strings.Split(key, ".")
+	for _, p := range patterns {
+		pparts := strings.Split(p, ".")
+		if len(pparts) < len(parts) || len(pparts) > len(parts) && !partial {
+			continue
+		}
+		match := true
+		for i := range parts {
+			if pparts[i] != "*" && pparts[i] != parts[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// fillPattern replaces the wildcards of pattern with the parts of key in the
+// same place, so it can be compared with key.
+func fillPattern(pattern, key string) string {
+	pparts, parts := strings.Split(pattern, "."), strings.Split(key, ".")
+	for i := range pparts {
+		if pparts[i] == "*" && i < len(parts) {
+			pparts[i] = parts[i]
+		}
+	}
+	return strings.Join(pparts, ".")
+}
+
+// suggest returns the candidate closest to name, if it is close enough to be
+// a misspelling.
+func suggest(name string, candidates []string) string {
+	best, bestDist := "", math.MaxInt
+	for _, c := range candidates {
+		if d := editDistance(name, c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	if bestDist > max(2, len(name)/3) {
+		return ""
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// checkType returns an error if v can't be read as a flag of type typ.
+func checkType(typ string, v any) error {
+	var ok bool
+	switch typ {
+	case "bool":
+		switch v := v.(type) {
+		case bool:
+			ok = true
+		case string:
+			_, err := strconv.ParseBool(v)
+			ok = err == nil
+		}
+	case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64":
+		switch v := v.(type) {
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			ok = true
+		case float64:
+			ok = v == math.Trunc(v)
+		case string:
+			_, err := strconv.ParseInt(v, 10, 64)
+			ok = err == nil
+		}
+	case "float32", "float64":
+		switch v := v.(type) {
+		case int, int64, float32, float64:
+			ok = true
+		case string:
+			_, err := strconv.ParseFloat(v, 64)
+			ok = err == nil
+		}
+	case "duration":
+		switch v := v.(type) {
+		case time.Duration:
+			ok = true
+		case string:
+			_, err := time.ParseDuration(v)
+			ok = err == nil
+		case int, int64, float64:
+			return errors.Errorf("expected a duration with a unit, e.g. %vs, got %v", v, v)
+		}
+	case "stringSlice", "stringArray", "intSlice":
+		switch v.(type) {
+		case []any, []string, []int, string:
+			ok = true
+		}
+	default:
+		switch v.(type) {
+		case map[string]any, []any:
+		default:
+			ok = true
+		}
+	}
+	if !ok {
+		return errors.Errorf("expected %s, got %v", typeName(typ), v)
+	}
+	return nil
+}
+
+func typeName(typ string) string {
+	switch typ {
+	case "stringSlice", "stringArray":
+		return "a list of strings"
+	case "intSlice":
+		return "a list of numbers"
+	case "duration":
+		return "a duration, e.g. 5s"
+	case "bool":
+		return "true or false"
+	case "float32", "float64":
+		return "a number"
+	}
+	if strings.HasPrefix(typ, "int") || strings.HasPrefix(typ, "uint") {
+		return "a whole number"
+	}
+	return "a " + typ
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,357 @@
+package chatlib
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Settings are what can differ between networks and channels. Settings are
+// resolved for a message from the Handler's own, then the overrides for its
+// network, for its channel on any network, and for its channel on its
+// network, each replacing what the ones before it set.
+type Settings struct {
+	// CommandPrefix is what commands are written with. A channel with a
+	// prefix of its own doesn't answer to the global one, e.g. to share a
+	// channel with another bot using "!".
+	CommandPrefix string `json:"command-prefix"`
+	// CommandRate is the most commands answered per minute. 0 is unlimited.
+	CommandRate int `json:"command-rate"`
+	// ReplyNotice sends replies as notices, which clients and other bots
+	// never answer automatically, as many networks expect of bots.
+	ReplyNotice bool `json:"reply-notice"`
+	// MentionLimit is the most members of a channel a message to it may name
+	// before their nicks are broken up with MentionBreak, so the bot doesn't
+	// highlight them all. 0 is unlimited.
+	MentionLimit int `json:"mention-limit"`
+	// MentionBreak is put after the first character of the nicks broken up.
+	// DefaultMentionBreak is used if it is empty.
+	MentionBreak string `json:"mention-break,omitempty"`
+	// Locale is the tag of the locale times and numbers are written in for
+	// users who haven't chosen one, e.g. de. See LookupLocale.
+	Locale string `json:"locale,omitempty"`
+	// TimeZone is the IANA name of the time zone times are shown in for
+	// users who haven't chosen one, the system's if empty.
+	TimeZone string `json:"time-zone,omitempty"`
+	// Verify is the challenge users joining the channel must pass before
+	// their commands there are answered, VerifyByQuestion or VerifyByEmail,
+	// or empty for none. See WithVerification.
+	Verify string `json:"verify,omitempty"`
+	// Welcome is sent privately to users joining the channel with their
+	// challenge.
+	Welcome string `json:"welcome,omitempty"`
+	// VerifyQuestion is asked by VerifyByQuestion, and VerifyAnswer is its
+	// answer, in any case.
+	VerifyQuestion string `json:"verify-question,omitempty"`
+	VerifyAnswer   string `json:"verify-answer,omitempty"`
+	// VerifyTimeout is how many seconds users have to pass the challenge
+	// before they are removed from the channel. 0 never removes them.
+	VerifyTimeout int `json:"verify-timeout,omitempty"`
+	// LinksOnly, NoLinks, NoMedia and MaxLineLength are the content rules of
+	// the channel: every message must have a link, none may, none may link
+	// to images, videos or audio, and none may be longer than MaxLineLength
+	// characters, unless it is 0. See WithModeration.
+	LinksOnly     bool `json:"links-only,omitempty"`
+	NoLinks       bool `json:"no-links,omitempty"`
+	NoMedia       bool `json:"no-media,omitempty"`
+	MaxLineLength int  `json:"max-line-length,omitempty"`
+	// RuleAction is what is done to users breaking the content rules,
+	// RuleWarn, RuleKick or RuleEscalate. They are warned if it is empty.
+	RuleAction string `json:"rule-action,omitempty"`
+	// SlowMode is how many seconds users must wait between messages in the
+	// channel, up to MaxSlowMode. 0 is off. !slowmode overrides it.
+	SlowMode int `json:"slow-mode,omitempty"`
+	// NoCrosspost holds users posting the same message in the channel and
+	// others to the rules. See WithCrosspostDetection.
+	NoCrosspost bool `json:"no-crosspost,omitempty"`
+	// MaxToxicity holds users posting messages scored more toxic than it, from
+	// 0 to 1, to the rules, by a ContentRule such as the toxicity module's. 0
+	// is off.
+	MaxToxicity float64 `json:"max-toxicity,omitempty"`
+	// RuleExempt are the roles whose users the content rules don't apply
+	// to.
+	RuleExempt []string `json:"rule-exempt,omitempty"`
+	// DisabledModules are the modules whose actions don't run.
+	DisabledModules []string `json:"disabled-modules,omitempty"`
+	// Roles lists the nicks, or accounts on networks that track them, given
+	// each role. Actions limited to roles only run for users with one of
+	// them, and on those networks only for users logged in. The admins have
+	// every role.
+	Roles map[string][]string `json:"roles,omitempty"`
+}
+
+// Override replaces the settings it sets for a network or channel. Unset
+// fields are nil. Roles are replaced one role at a time.
+type Override struct {
+	CommandPrefix   *string             `mapstructure:"command-prefix"`
+	CommandRate     *int                `mapstructure:"command-rate"`
+	ReplyNotice     *bool               `mapstructure:"reply-notice"`
+	MentionLimit    *int                `mapstructure:"mention-limit"`
+	MentionBreak    *string             `mapstructure:"mention-break"`
+	Locale          *string             `mapstructure:"locale"`
+	TimeZone        *string             `mapstructure:"time-zone"`
+	Verify          *string             `mapstructure:"verify"`
+	Welcome         *string             `mapstructure:"welcome"`
+	VerifyQuestion  *string             `mapstructure:"verify-question"`
+	VerifyAnswer    *string             `mapstructure:"verify-answer"`
+	VerifyTimeout   *int                `mapstructure:"verify-timeout"`
+	LinksOnly       *bool               `mapstructure:"links-only"`
+	NoLinks         *bool               `mapstructure:"no-links"`
+	NoMedia         *bool               `mapstructure:"no-media"`
+	MaxLineLength   *int                `mapstructure:"max-line-length"`
+	RuleAction      *string             `mapstructure:"rule-action"`
+	SlowMode        *int                `mapstructure:"slow-mode"`
+	NoCrosspost     *bool               `mapstructure:"no-crosspost"`
+	MaxToxicity     *float64            `mapstructure:"max-toxicity"`
+	RuleExempt      []string            `mapstructure:"rule-exempt"`
+	DisabledModules []string            `mapstructure:"disabled-modules"`
+	Roles           map[string][]string `mapstructure:"roles"`
+}
+
+// scope is where an override applies. Empty fields match anything.
+type scope struct {
+	network string
+	channel string
+}
+
+// WithOverride overrides settings for a network, named like its API, for a
+// channel, or for a channel on a network. Leave network empty for a channel
+// on any network, and channel empty for the whole network. Both empty sets
+// the Handler's own settings, apart from the prefix set with
+// WithCommandPrefix.
+func WithOverride(network, channel string, o Override) Option {
+	return func(h *Handler) error {
+		s := scope{strings.ToLower(network), strings.ToLower(channel)}
+		if s == (scope{}) && o.CommandPrefix != nil {
+			return errors.WithMessage(ErrInvalidConfig, "the global command prefix is set with WithCommandPrefix")
+		}
+		if h.overrides == nil {
+			h.overrides = make(map[scope]Override)
+		}
+		h.overrides[s] = o
+		return nil
+	}
+}
+
+// Settings returns the settings resolved for a channel on the network with
+// the named API. The channel is empty for private messages.
+func (h *Handler) Settings(api, channel string) Settings {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return resolveSettings(Settings{CommandPrefix: h.commandPrefix}, h.overrides, api, channel)
+}
+
+// swapSettings replaces the overrides, admins and content policies with those
+// of next, configured anew when the configuration is reloaded.
+func (h *Handler) swapSettings(next *Handler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.overrides, h.admins, h.policies = next.overrides, next.admins, next.policies
+}
+
+func resolveSettings(s Settings, overrides map[scope]Override, network, channel string) Settings {
+	network, channel = strings.ToLower(network), strings.ToLower(channel)
+	scopes := []scope{{}, {network: network}, {channel: channel}, {network, channel}}
+	for i, sc := range scopes {
+		if (i == 1 || i == 3) && network == "" || (i == 2 || i == 3) && channel == "" {
+			continue
+		}
+		if o, ok := overrides[sc]; ok {
+			s = s.merge(o)
+		}
+	}
+	return s
+}
+
+func (s Settings) merge(o Override) Settings {
+	if o.CommandPrefix != nil {
+		s.CommandPrefix = *o.CommandPrefix
+	}
+	if o.CommandRate != nil {
+		s.CommandRate = *o.CommandRate
+	}
+	if o.ReplyNotice != nil {
+		s.ReplyNotice = *o.ReplyNotice
+	}
+	if o.MentionLimit != nil {
+		s.MentionLimit = *o.MentionLimit
+	}
+	if o.MentionBreak != nil {
+		s.MentionBreak = *o.MentionBreak
+	}
+	if o.Locale != nil {
+		s.Locale = *o.Locale
+	}
+	if o.TimeZone != nil {
+		s.TimeZone = *o.TimeZone
+	}
+	if o.Verify != nil {
+		s.Verify = *o.Verify
+	}
+	if o.Welcome != nil {
+		s.Welcome = *o.Welcome
+	}
+	if o.VerifyQuestion != nil {
+		s.VerifyQuestion = *o.VerifyQuestion
+	}
+	if o.VerifyAnswer != nil {
+		s.VerifyAnswer = *o.VerifyAnswer
+	}
+	if o.VerifyTimeout != nil {
+		s.VerifyTimeout = *o.VerifyTimeout
+	}
+	if o.LinksOnly != nil {
+		s.LinksOnly = *o.LinksOnly
+	}
+	if o.NoLinks != nil {
+		s.NoLinks = *o.NoLinks
+	}
+	if o.NoMedia != nil {
+		s.NoMedia = *o.NoMedia
+	}
+	if o.MaxLineLength != nil {
+		s.MaxLineLength = *o.MaxLineLength
+	}
+	if o.RuleAction != nil {
+		s.RuleAction = *o.RuleAction
+	}
+	if o.SlowMode != nil {
+		s.SlowMode = *o.SlowMode
+	}
+	if o.NoCrosspost != nil {
+		s.NoCrosspost = *o.NoCrosspost
+	}
+	if o.MaxToxicity != nil {
+		s.MaxToxicity = *o.MaxToxicity
+	}
+	if o.RuleExempt != nil {
+		s.RuleExempt = o.RuleExempt
+	}
+	if o.DisabledModules != nil {
+		s.DisabledModules = o.DisabledModules
+	}
+	if len(o.Roles) > 0 {
+		roles := make(map[string][]string, len(s.Roles)+len(o.Roles))
+		for role, names := range s.Roles {
+			roles[role] = names
+		}
+		for role, names := range o.Roles {
+			roles[role] = names
+		}
+		s.Roles = roles
+	}
+	return s
+}
+
+// WithModule tags the actions registered by opts with the module's name, so
+// they can be disabled per network or channel and their health is shown in
+// the Status.
+func WithModule(name string, opts ...Option) Option {
+	return func(h *Handler) error {
+		if !slices.Contains(h.moduleNames, name) {
+			h.moduleNames = append(h.moduleNames, name)
+		}
+		first := len(h.actions)
+		if err := h.ApplyOptions(opts...); err != nil {
+			return err
+		}
+		for _, action := range h.actions[first:] {
+			if action.module == "" {
+				action.module = name
+			}
+		}
+		return nil
+	}
+}
+
+// isCommand reports whether the action is a command, written with the
+// command prefix.
+func (h *Handler) isCommand(action *Action) bool {
+	return h.commandPrefix != "" && strings.HasPrefix(action.re.String(), "^"+regexp.QuoteMeta(h.commandPrefix))
+}
+
+// allowed reports whether the action may run for msg with settings s.
+func (h *Handler) allowed(action *Action, msg *Message, s Settings) bool {
+	for _, m := range s.DisabledModules {
+		if action.module != "" && strings.EqualFold(m, action.module) {
+			return false
+		}
+	}
+	if len(action.roles) == 0 {
+		return true
+	}
+	for _, role := range action.roles {
+		if h.hasRole(msg, role, s) {
+			return true
+		}
+	}
+	log.Debug().Str("action", actionName(action)).Str("nick", msg.Nick).Strs("roles", action.roles).Msg("not running action for user without its roles")
+	return false
+}
+
+// hasRole reports whether the sender of msg has role. The admins have every
+// role.
+func (h *Handler) hasRole(msg *Message, role string, s Settings) bool {
+	if role == RoleUser || h.isAdminSender(msg) {
+		return true
+	}
+	name, ok := h.senderName(msg)
+	if !ok {
+		return false
+	}
+	for _, n := range s.Roles[role] {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// senderName returns the name the sender of msg is given roles by. On
+// networks that track accounts that is their account, and a sender who
+// isn't logged in has none, since anyone can take a nick. Elsewhere it is
+// their nick.
+func (h *Handler) senderName(msg *Message) (string, bool) {
+	if api, err := h.apiFor(msg); err == nil {
+		if a, ok := api.(Accounter); ok {
+			return a.AccountOf(msg.Nick)
+		}
+	}
+	return msg.Nick, msg.Nick != ""
+}
+
+// isAdminSender reports whether the sender of msg is one of the admins,
+// matched by account like roles, so that taking an admin's nick isn't
+// enough.
+func (h *Handler) isAdminSender(msg *Message) bool {
+	name, ok := h.senderName(msg)
+	return ok && h.IsAdmin(name)
+}
+
+// commandRates counts the commands answered per network and channel over the
+// last minute.
+type commandRates map[scope][]time.Time
+
+// allow records a command for the scope and reports whether it is within
+// rate commands a minute.
+func (r commandRates) allow(s scope, rate int, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	recent := r[s][:0]
+	for _, t := range r[s] {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= rate {
+		r[s] = recent
+		return false
+	}
+	r[s] = append(recent, now)
+	return true
+}
@@ -0,0 +1,63 @@
+package chatlib
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// shortURLKey prefixes the store keys of shortened URLs, followed by the
+// short URL.
+const shortURLKey = "short-urls/"
+
+// URLShortener shortens URLs through a self-hosted or external service. It
+// may return the URL unchanged, e.g. if it is short already.
+type URLShortener interface {
+	Shorten(c context.Context, url string) (string, error)
+}
+
+// ShortenerUser is implemented by APIs that split messages too long for the
+// backend. The Handler hands them its URLShortener, which they use to
+// shorten the URLs of messages that would otherwise be split.
+type ShortenerUser interface {
+	UseURLShortener(s URLShortener)
+}
+
+// WithURLShortener shortens URLs in outgoing messages with s where the API
+// would otherwise have to split them. The original of every URL shortened is
+// kept in the Store, see ExpandURL.
+func WithURLShortener(s URLShortener) Option {
+	return func(h *Handler) error {
+		h.shortener = s
+		return nil
+	}
+}
+
+// storedShortener keeps the original of every URL it shortens in the store,
+// so the links the bot sent can be told even if the shortener goes away.
+type storedShortener struct {
+	URLShortener
+	store Store
+}
+
+func (s storedShortener) Shorten(c context.Context, url string) (string, error) {
+	short, err := s.URLShortener.Shorten(c, url)
+	if err != nil || short == url {
+		return short, err
+	}
+	if err := s.store.Set(c, shortURLKey+short, []byte(url)); err != nil {
+		log.Error().Err(err).Msgf("error keeping the original of %s", short)
+	}
+	return short, nil
+}
+
+// ExpandURL returns the original of a URL the Handler's URLShortener
+// shortened, or ErrNotFound.
+func (h *Handler) ExpandURL(c context.Context, short string) (string, error) {
+	b, err := h.store.Get(c, shortURLKey+short)
+	if err != nil {
+		return "", errors.WithMessagef(err, "no original for %s", short)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,44 @@
+package shorten
+
+import (
+	"github.com/gregseb/chatlib"
+	"github.com/gregseb/chatlib/httpc"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const ModuleName = "shorten"
+
+const DefaultMinLength = 40
+
+func init() {
+	chatlib.RegisterModule(chatlib.Module{
+		Name:  ModuleName,
+		Flags: Flags,
+		Init:  Init,
+	})
+}
+
+func Init() (*chatlib.Option, error) {
+	template := viper.GetString(ModuleName + ".url-template")
+	if template == "" {
+		log.Info().Msg("URL shortening disabled")
+		return nil, nil
+	}
+	// The shortener is sent the URLs users post
+	s, err := NewTemplateShortener(template, viper.GetInt(ModuleName+".min-length"), httpc.Safe())
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Str("module", ModuleName).Msgf("shortening URLs of at least %d characters in messages that would be split", s.MinLength)
+	opt := chatlib.WithURLShortener(s)
+	return &opt, nil
+}
+
+func Flags(cmd *cobra.Command) {
+	// URLTemplate
+	cmd.Flags().String(ModuleName+"-url-template", "", "URL of the shortening service, with {url} in place of the URL to shorten, answering with the short URL. Must be on a public address. Disabled if empty")
+	// MinLength
+	cmd.Flags().Int(ModuleName+"-min-length", DefaultMinLength, "Length of the URLs to shorten")
+}
@@ -0,0 +1,79 @@
+// Package shorten shortens URLs through a web service, for chatlib's
+// URLShortener hook.
+package shorten
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+)
+
+// URLPlaceholder is replaced with the escaped URL to shorten in a template.
+const URLPlaceholder = "{url}"
+
+// maxResponseBytes bounds the response read from the service.
+const maxResponseBytes = 2048
+
+// TemplateShortener shortens URLs with a GET request to a URL made from a
+// template, and the short URL as response body. Most services have such an
+// endpoint, e.g. https://is.gd/create.php?format=simple&url={url} or the
+// yourls-api.php of a self-hosted YOURLS with format=simple.
+type TemplateShortener struct {
+	Template string
+	// MinLength is the length URLs need to be shortened. Shorter ones are
+	// returned unchanged.
+	MinLength int
+	Client    *http.Client
+}
+
+var _ chatlib.URLShortener = (*TemplateShortener)(nil)
+
+// NewTemplateShortener returns a TemplateShortener, checking the template
+// has the URL placeholder and is a http or https URL.
+func NewTemplateShortener(template string, minLength int, client *http.Client) (*TemplateShortener, error) {
+	if !strings.Contains(template, URLPlaceholder) {
+		return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "shorten: template has no %s: %s", URLPlaceholder, template)
+	}
+	u, err := url.Parse(strings.ReplaceAll(template, URLPlaceholder, ""))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "shorten: template isn't a http URL: %s", template)
+	}
+	return &TemplateShortener{Template: template, MinLength: minLength, Client: client}, nil
+}
+
+// Shorten returns the short URL for rawURL, or rawURL if it is shorter than
+// MinLength or than what the service returned.
+func (s *TemplateShortener) Shorten(c context.Context, rawURL string) (string, error) {
+	if len(rawURL) < s.MinLength {
+		return rawURL, nil
+	}
+	r, err := http.NewRequestWithContext(c, http.MethodGet, strings.ReplaceAll(s.Template, URLPlaceholder, url.QueryEscape(rawURL)), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.Client.Do(r)
+	if err != nil {
+		return "", errors.Wrap(err, "shorten: request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", errors.Errorf("shorten: unexpected status: %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	if err != nil {
+		return "", errors.Wrap(err, "shorten: failed to read response")
+	}
+	short := strings.TrimSpace(string(body))
+	if u, err := url.Parse(short); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.Errorf("shorten: response isn't a URL: %.100q", short)
+	}
+	if len(short) >= len(rawURL) {
+		return rawURL, nil
+	}
+	return short, nil
+}
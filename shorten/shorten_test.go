@@ -0,0 +1,54 @@
+package shorten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestTemplateShortener(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Query().Get("url") {
+		case "https://example.com/a/very/long/path/to/something?with=query&and=more":
+			fmt.Fprintln(w, "https://sho.rt/x1")
+		case "https://example.com/broken/link/that/the/service/refuses/to/shorten":
+			http.Error(w, "no", http.StatusBadRequest)
+		default:
+			fmt.Fprint(w, "not a url")
+		}
+	}))
+	defer srv.Close()
+	c := context.Background()
+
+	if _, err := NewTemplateShortener(srv.URL+"/create", 40, srv.Client()); !errors.Is(err, chatlib.ErrInvalidConfig) {
+		t.Errorf("expected a template without the placeholder to be refused, got %v", err)
+	}
+	if _, err := NewTemplateShortener("ftp://sho.rt/?url={url}", 40, srv.Client()); !errors.Is(err, chatlib.ErrInvalidConfig) {
+		t.Errorf("expected a template that isn't http to be refused, got %v", err)
+	}
+	s, err := NewTemplateShortener(srv.URL+"/create?format=simple&url={url}", 40, srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, err := s.Shorten(c, "https://example.com/a/very/long/path/to/something?with=query&and=more")
+	if err != nil || short != "https://sho.rt/x1" {
+		t.Errorf("expected the short URL, got %q %v", short, err)
+	}
+	if short, err := s.Shorten(c, "https://example.com/"); err != nil || short != "https://example.com/" || requests != 1 {
+		t.Errorf("expected a short URL to be kept without asking, got %q %v", short, err)
+	}
+	if _, err := s.Shorten(c, "https://example.com/broken/link/that/the/service/refuses/to/shorten"); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("expected the status to be reported, got %v", err)
+	}
+	if _, err := s.Shorten(c, "https://example.com/something/the/service/answers/with/garbage"); err == nil {
+		t.Error("expected a response that isn't a URL to be refused")
+	}
+}
@@ -0,0 +1,157 @@
+package chatlib
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultSlowMode is the interval in seconds !slowmode on sets in channels
+// without a SlowMode of their own.
+const DefaultSlowMode = 30
+
+// MaxSlowMode is the longest interval in seconds slow mode can be set to.
+const MaxSlowMode = 3600
+
+// maxSlowModeUsers is how many users' last messages are kept before those
+// older than MaxSlowMode are forgotten.
+const maxSlowModeUsers = 1024
+
+// slowModes are the slow mode intervals set with !slowmode and when users
+// last talked in channels in slow mode.
+type slowModes struct {
+	mu sync.Mutex
+	// intervals are the intervals set with !slowmode, or -1 for channels
+	// following their SlowMode setting.
+	intervals map[scope]int
+	last      map[memberKey]time.Time
+}
+
+// slowModeKey is where the interval set with !slowmode for a channel is kept
+// in the Store.
+func slowModeKey(api, channel string) string {
+	return "slowmode/" + api + "/" + strings.ToLower(channel)
+}
+
+// SlowMode returns the slow mode interval of a channel, the one set with
+// !slowmode if any, or the channel's SlowMode setting. 0 is off.
+func (h *Handler) SlowMode(c context.Context, api, channel string) (time.Duration, error) {
+	sc := scope{strings.ToLower(api), strings.ToLower(channel)}
+	h.slowModes.mu.Lock()
+	seconds, ok := h.slowModes.intervals[sc]
+	h.slowModes.mu.Unlock()
+	if !ok {
+		seconds = -1
+		b, err := h.store.Get(c, slowModeKey(api, channel))
+		if err != nil && errors.Cause(err) != ErrNotFound {
+			return 0, errors.WithMessage(err, "error loading slow mode")
+		} else if err == nil {
+			if seconds, err = strconv.Atoi(string(b)); err != nil {
+				return 0, errors.Wrap(err, "invalid slow mode in store")
+			}
+		}
+		h.slowModes.mu.Lock()
+		if h.slowModes.intervals == nil {
+			h.slowModes.intervals = make(map[scope]int)
+		}
+		h.slowModes.intervals[sc] = seconds
+		h.slowModes.mu.Unlock()
+	}
+	if seconds < 0 {
+		seconds = h.Settings(api, channel).SlowMode
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// SetSlowMode sets the slow mode interval of a channel, overriding its
+// SlowMode setting until set again. 0 turns slow mode off.
+func (h *Handler) SetSlowMode(c context.Context, api, channel string, interval time.Duration) error {
+	seconds := int(interval / time.Second)
+	if seconds < 0 || seconds > MaxSlowMode {
+		return errors.Wrapf(ErrInvalidConfig, "invalid slow mode interval: %v", interval)
+	}
+	if err := h.store.Set(c, slowModeKey(api, channel), []byte(strconv.Itoa(seconds))); err != nil {
+		return errors.WithMessage(err, "error saving slow mode")
+	}
+	h.slowModes.mu.Lock()
+	defer h.slowModes.mu.Unlock()
+	if h.slowModes.intervals == nil {
+		h.slowModes.intervals = make(map[scope]int)
+	}
+	h.slowModes.intervals[scope{strings.ToLower(api), strings.ToLower(channel)}] = seconds
+	return nil
+}
+
+// talk records a message from the user of k at now, and returns how long
+// they have left to wait if they talked within interval.
+func (s *slowModes) talk(k memberKey, interval time.Duration, now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == nil {
+		s.last = make(map[memberKey]time.Time)
+	}
+	if last, ok := s.last[k]; ok && now.Sub(last) < interval {
+		return interval - now.Sub(last)
+	}
+	if len(s.last) >= maxSlowModeUsers {
+		for key, last := range s.last {
+			if now.Sub(last) > MaxSlowMode*time.Second {
+				delete(s.last, key)
+			}
+		}
+	}
+	s.last[k] = now
+	return 0
+}
+
+func (h *Handler) actionSlowMode(c context.Context, re *regexp.Regexp, msg *Message) error {
+	if msg.Private {
+		return h.Reply(c, msg, "use that in a channel")
+	}
+	f := h.Formatter(c, msg)
+	current, err := h.SlowMode(c, msg.API, msg.Channel())
+	if err != nil {
+		return err
+	}
+	arg := ""
+	if m := re.FindStringSubmatch(msg.Text); len(m) > 1 {
+		arg = strings.ToLower(m[1])
+	}
+	var interval time.Duration
+	switch arg {
+	case "":
+		if current == 0 {
+			return h.Reply(c, msg, "slow mode is off")
+		}
+		return h.Reply(c, msg, "slow mode is on, one message every "+f.FormatDuration(current))
+	case "off":
+	case "on":
+		interval = current
+		if interval == 0 {
+			interval = time.Duration(h.Settings(msg.API, msg.Channel()).SlowMode) * time.Second
+		}
+		if interval == 0 {
+			interval = DefaultSlowMode * time.Second
+		}
+	default:
+		seconds, err := strconv.Atoi(arg)
+		if err != nil || seconds > MaxSlowMode {
+			return h.Reply(c, msg, "slow mode is at most "+f.FormatDuration(MaxSlowMode*time.Second))
+		}
+		interval = time.Duration(seconds) * time.Second
+	}
+	if err := h.SetSlowMode(c, msg.API, msg.Channel(), interval); err != nil {
+		return err
+	}
+	log.Info().Str("api", msg.API).Str("channel", msg.Channel()).Str("nick", msg.Nick).Dur("interval", interval).Msg("slow mode set")
+	if interval == 0 {
+		return h.Reply(c, msg, "slow mode is off")
+	}
+	return h.Reply(c, msg, "slow mode is on, one message every "+f.FormatDuration(interval))
+}
@@ -0,0 +1,139 @@
+// Package sqlmigrate applies embedded, versioned schema migrations to SQL
+// databases. The SQL backends of the store and history share it so upgrading
+// the bot never leaves a database half migrated.
+package sqlmigrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer
+// version of the bot. Running an older version against it could lose data,
+// so the store refuses to open it.
+const ErrSchemaTooNew chatlib.Error = "schemaTooNew"
+
+// Migration is one versioned change to a schema.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// LoadMigrations reads the migrations in dir of fsys. Files are named
+// <version>_<name>.sql, e.g. 0001_kv.sql, and are returned in version order.
+// Versions must be unique and must never be changed or reused once released.
+func LoadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "sqlmigrate: failed to read migrations: %s", dir)
+	}
+	migrations := make([]Migration, 0, len(entries))
+	seen := make(map[int]string)
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".sql")
+		if !ok || e.IsDir() {
+			continue
+		}
+		v, rest, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(v)
+		if err != nil || version <= 0 {
+			return nil, errors.Errorf("sqlmigrate: invalid migration name: %s", e.Name())
+		}
+		if other, ok := seen[version]; ok {
+			return nil, errors.Errorf("sqlmigrate: migrations %s and %s have the same version", other, e.Name())
+		}
+		seen[version] = e.Name()
+		b, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "sqlmigrate: failed to read migration: %s", e.Name())
+		}
+		migrations = append(migrations, Migration{Version: version, Name: rest, SQL: string(b)})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// SchemaVersion returns the version of the last migration applied to db, or 0
+// if none have been.
+func SchemaVersion(c context.Context, db *sql.DB) (int, error) {
+	if err := createMigrationsTable(c, db); err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	if err := db.QueryRowContext(c, "SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, errors.Wrap(err, "sqlmigrate: failed to read schema version")
+	}
+	return int(version.Int64), nil
+}
+
+// Migrate applies the migrations db has not had yet, in order and each in its
+// own transaction, so a failure leaves the database at the last version that
+// applied cleanly. It returns ErrSchemaTooNew if db has a version newer than
+// any in migrations.
+func Migrate(c context.Context, db *sql.DB, migrations []Migration) error {
+	current, err := SchemaVersion(c, db)
+	if err != nil {
+		return err
+	}
+	latest := 0
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].Version
+	}
+	if current > latest {
+		return errors.Wrapf(ErrSchemaTooNew, "sqlmigrate: database is at schema version %d, this version of the bot only knows up to %d", current, latest)
+	}
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		if err := apply(c, db, m); err != nil {
+			return err
+		}
+		log.Info().Msgf("migrated database to version %d: %s", m.Version, m.Name)
+	}
+	return nil
+}
+
+func createMigrationsTable(c context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(c, `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INTEGER PRIMARY KEY,
+	name       TEXT NOT NULL,
+	applied_at TEXT NOT NULL
+)`)
+	return errors.Wrap(err, "sqlmigrate: failed to create schema_migrations")
+}
+
+func apply(c context.Context, db *sql.DB, m Migration) error {
+	tx, err := db.BeginTx(c, nil)
+	if err != nil {
+		return errors.Wrapf(err, "sqlmigrate: failed to start migration %d", m.Version)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(c, m.SQL); err != nil {
+		return errors.Wrapf(err, "sqlmigrate: migration %d (%s) failed", m.Version, m.Name)
+	}
+	// The version is recorded in the same transaction so a migration is never
+	// half applied. Values are formatted in because placeholder syntax differs
+	// between databases; none of them come from outside the binary.
+	if _, err := tx.ExecContext(c, fmt.Sprintf(
+		"INSERT INTO schema_migrations (version, name, applied_at) VALUES (%d, '%s', '%s')",
+		m.Version, strings.ReplaceAll(m.Name, "'", "''"), time.Now().UTC().Format(time.RFC3339),
+	)); err != nil {
+		return errors.Wrapf(err, "sqlmigrate: failed to record migration %d", m.Version)
+	}
+	return errors.Wrapf(tx.Commit(), "sqlmigrate: failed to commit migration %d", m.Version)
+}
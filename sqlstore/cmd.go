@@ -0,0 +1,47 @@
+package sqlstore
+
+import (
+	"context"
+
+	"github.com/gregseb/chatlib"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const ModuleName = "sqlite"
+
+func init() {
+	chatlib.RegisterModule(chatlib.Module{
+		Name:  ModuleName,
+		Flags: Flags,
+		Init:  Init,
+	})
+}
+
+func Init() (*chatlib.Option, error) {
+	path := viper.GetString(ModuleName + ".path")
+	if path == "" {
+		log.Info().Msg("sqlite store disabled")
+		return nil, nil
+	}
+	s, err := Open(context.Background(), path)
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Str("module", ModuleName).Str("driver", DriverName).Msgf("using sqlite store: %s", path)
+	// Replaces chat.store, module options are applied after the chat ones
+	opt := chatlib.WithStore(s)
+	if viper.GetBool(ModuleName + ".history") {
+		log.Info().Str("module", ModuleName).Msg("logging history to sqlite")
+		opt = chatlib.CombineOptions(opt, chatlib.WithMiddleware(s.Middleware))
+	}
+	return &opt, nil
+}
+
+func Flags(cmd *cobra.Command) {
+	// Path
+	cmd.Flags().String(ModuleName+"-path", "", "SQLite database to use as the store instead of chat.store. Disabled if empty")
+	// History
+	cmd.Flags().Bool(ModuleName+"-history", false, "Also keep message history in the database")
+}
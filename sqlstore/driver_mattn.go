@@ -0,0 +1,24 @@
+//go:build !sqlite_modernc
+
+package sqlstore
+
+import (
+	"net/url"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// DriverName is the database/sql driver the package is built with. The
+// default is mattn/go-sqlite3, which needs cgo. Build with the sqlite_modernc
+// tag for the pure Go driver instead.
+const DriverName = "sqlite3"
+
+// dsn returns the data source name for the database at path, waiting for
+// locks held by other connections rather than failing straight away.
+func dsn(path string) string {
+	q := url.Values{}
+	q.Set("_busy_timeout", "5000")
+	q.Set("_journal_mode", "WAL")
+	q.Set("_foreign_keys", "on")
+	return "file:" + path + "?" + q.Encode()
+}
@@ -0,0 +1,24 @@
+//go:build sqlite_modernc
+
+package sqlstore
+
+import (
+	"net/url"
+
+	_ "modernc.org/sqlite"
+)
+
+// DriverName is the database/sql driver the package is built with. The
+// sqlite_modernc tag selects modernc.org/sqlite, which is pure Go and builds
+// without cgo.
+const DriverName = "sqlite"
+
+// dsn returns the data source name for the database at path, waiting for
+// locks held by other connections rather than failing straight away.
+func dsn(path string) string {
+	q := url.Values{}
+	q.Add("_pragma", "busy_timeout(5000)")
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Add("_pragma", "foreign_keys(1)")
+	return "file:" + path + "?" + q.Encode()
+}
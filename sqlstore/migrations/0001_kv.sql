@@ -0,0 +1,4 @@
+CREATE TABLE kv (
+	key   TEXT PRIMARY KEY,
+	value BLOB NOT NULL
+);
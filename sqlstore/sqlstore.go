@@ -0,0 +1,102 @@
+// Package sqlstore is a chatlib.Store and message history kept in SQLite.
+// The schema is versioned and migrated on open; see sqlmigrate.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/gregseb/chatlib/history"
+	"github.com/gregseb/chatlib/sqlmigrate"
+	"github.com/pkg/errors"
+)
+
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+// Store is a chatlib.Store in a SQLite database. It also keeps message
+// history when its Middleware is installed.
+type Store struct {
+	db  *sql.DB
+	now func() time.Time
+}
+
+var _ chatlib.Store = (*Store)(nil)
+
+// Open opens the database at path, creating it if needed, and migrates it to
+// the latest schema. It returns sqlmigrate.ErrSchemaTooNew if the database was
+// migrated by a newer version of the bot.
+func Open(c context.Context, path string) (*Store, error) {
+	db, err := sql.Open(DriverName, dsn(path))
+	if err != nil {
+		return nil, errors.Wrapf(err, "sqlstore: failed to open %s", path)
+	}
+	// SQLite allows one writer at a time, one connection avoids busy errors
+	// between the bot's own goroutines.
+	db.SetMaxOpenConns(1)
+	migrations, err := sqlmigrate.LoadMigrations(migrationFS, "migrations")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := sqlmigrate.Migrate(c, db, migrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db, now: time.Now}, nil
+}
+
+// DB returns the underlying database.
+func (s *Store) DB() *sql.DB {
+	return s.db
+}
+
+func (s *Store) Get(c context.Context, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRowContext(c, "SELECT value FROM kv WHERE key = ?", key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, chatlib.ErrNotFound
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "sqlstore: failed to get %s", key)
+	}
+	return value, nil
+}
+
+func (s *Store) Set(c context.Context, key string, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	_, err := s.db.ExecContext(c, "INSERT INTO kv (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value", key, value)
+	return errors.Wrapf(err, "sqlstore: failed to set %s", key)
+}
+
+func (s *Store) Delete(c context.Context, key string) error {
+	_, err := s.db.ExecContext(c, "DELETE FROM kv WHERE key = ?", key)
+	return errors.Wrapf(err, "sqlstore: failed to delete %s", key)
+}
+
+// Append adds r to the message history.
+func (s *Store) Append(c context.Context, r history.Record) error {
+	_, err := s.db.ExecContext(c,
+		"INSERT INTO messages (sent_at, api, command, sender, nick, receiver, text) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		r.Time.UTC().Format(time.RFC3339Nano), r.API, r.Command, r.Sender, r.Nick, r.Receiver, r.Text,
+	)
+	return errors.Wrap(err, "sqlstore: failed to append history")
+}
+
+// Middleware records messages sent by users in the history, like
+// history.Log.Middleware.
+func (s *Store) Middleware(c context.Context, msg *chatlib.Message) error {
+	r, ok := history.NewRecord(msg, s.now())
+	if !ok {
+		return nil
+	}
+	return s.Append(c, r)
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,89 @@
+package sqlstore
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/gregseb/chatlib"
+	"github.com/gregseb/chatlib/sqlmigrate"
+)
+
+func TestStore(t *testing.T) {
+	c := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+	s, err := Open(c, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(c, "foo"); !errors.Is(err, chatlib.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := s.Set(c, "foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(c, "foo", []byte("baz")); err != nil {
+		t.Fatal(err)
+	}
+	msg := &chatlib.Message{Command: chatlib.CommandMessage, Nick: "foo", Sender: "foo!bar@baz", Receiver: "#test", Text: "hello"}
+	if err := s.Middleware(c, msg); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Reopening must not migrate again
+	s, err = Open(c, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, err := s.Get(c, "foo"); err != nil || string(v) != "baz" {
+		t.Errorf("expected baz, got %q, %v", v, err)
+	}
+	var n int
+	if err := s.DB().QueryRowContext(c, "SELECT COUNT(*) FROM messages").Scan(&n); err != nil || n != 1 {
+		t.Errorf("expected 1 message, got %d, %v", n, err)
+	}
+	if err := s.Delete(c, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(c, "foo"); !errors.Is(err, chatlib.ErrNotFound) {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	c := context.Background()
+	s, err := Open(c, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	migrations, err := sqlmigrate.LoadMigrations(migrationFS, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := migrations[len(migrations)-1].Version
+	if v, err := sqlmigrate.SchemaVersion(c, s.DB()); err != nil || v != latest {
+		t.Errorf("expected version %d, got %d, %v", latest, v, err)
+	}
+
+	// A failed migration must be rolled back entirely
+	bad := append(migrations, sqlmigrate.Migration{Version: latest + 1, Name: "bad", SQL: "CREATE TABLE bad (id INTEGER); SELECT * FROM missing"})
+	if err := sqlmigrate.Migrate(c, s.DB(), bad); err == nil {
+		t.Error("expected failed migration to return an error")
+	}
+	if v, _ := sqlmigrate.SchemaVersion(c, s.DB()); v != latest {
+		t.Errorf("expected version %d after failed migration, got %d", latest, v)
+	}
+
+	// An older binary must refuse a newer schema
+	good := append(migrations, sqlmigrate.Migration{Version: latest + 1, Name: "good", SQL: "CREATE TABLE good (id INTEGER)"})
+	if err := sqlmigrate.Migrate(c, s.DB(), good); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlmigrate.Migrate(c, s.DB(), migrations); !errors.Is(err, sqlmigrate.ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew, got %v", err)
+	}
+}
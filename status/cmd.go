@@ -0,0 +1,99 @@
+package status
+
+import (
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const ModuleName = "status"
+
+func init() {
+	chatlib.RegisterModule(chatlib.Module{
+		Name:  ModuleName,
+		Flags: Flags,
+		Init:  Init,
+		ConfigKeys: []string{
+			"s3.bucket", "s3.region", "s3.endpoint", "s3.prefix", "s3.access-key", "s3.secret-key",
+			"github.repo", "github.branch", "github.dir", "github.token", "github.api",
+		},
+	})
+}
+
+// Init builds the generator from the listen address and the places pages
+// are published to, e.g.
+//
+//	status:
+//	  listen: ":8091"
+//	  dir: /var/www/status
+//	  s3:
+//	    bucket: status.example.com
+//	    region: eu-west-1
+//	    access-key: ...
+//	    secret-key: ...
+//	  github:
+//	    repo: example/status
+//	    branch: gh-pages
+//	    token: ...
+func Init() (*chatlib.Option, error) {
+	var publishers []Publisher
+	if dir := viper.GetString(ModuleName + ".dir"); dir != "" {
+		publishers = append(publishers, &DirPublisher{Dir: dir})
+	}
+	if bucket := viper.GetString(ModuleName + ".s3.bucket"); bucket != "" {
+		p := &S3Publisher{
+			Bucket:    bucket,
+			Region:    viper.GetString(ModuleName + ".s3.region"),
+			Endpoint:  viper.GetString(ModuleName + ".s3.endpoint"),
+			Prefix:    viper.GetString(ModuleName + ".s3.prefix"),
+			AccessKey: viper.GetString(ModuleName + ".s3.access-key"),
+			SecretKey: viper.GetString(ModuleName + ".s3.secret-key"),
+		}
+		if p.Region == "" || p.AccessKey == "" || p.SecretKey == "" {
+			return nil, errors.WithMessage(chatlib.ErrInvalidConfig, "status: s3 needs a region, access-key and secret-key")
+		}
+		publishers = append(publishers, p)
+	}
+	if repo := viper.GetString(ModuleName + ".github.repo"); repo != "" {
+		p := &GitHubPublisher{
+			Repo:   repo,
+			Branch: viper.GetString(ModuleName + ".github.branch"),
+			Dir:    viper.GetString(ModuleName + ".github.dir"),
+			Token:  viper.GetString(ModuleName + ".github.token"),
+			API:    viper.GetString(ModuleName + ".github.api"),
+		}
+		if p.Branch == "" {
+			p.Branch = "gh-pages"
+		}
+		if p.Token == "" {
+			return nil, errors.WithMessage(chatlib.ErrInvalidConfig, "status: github needs a token")
+		}
+		publishers = append(publishers, p)
+	}
+	listen := viper.GetString(ModuleName + ".listen")
+	if listen == "" && len(publishers) == 0 {
+		log.Info().Msg("status page disabled")
+		return nil, nil
+	}
+	for _, p := range publishers {
+		log.Info().Str("module", ModuleName).Msgf("publishing status page to %s every %s", p.Name(), viper.GetDuration(ModuleName+".interval"))
+	}
+	g := New(viper.GetString(ModuleName+".title"), listen, viper.GetDuration(ModuleName+".interval"), publishers...)
+	opt := WithGenerator(g.ShowUsage(viper.GetInt(ModuleName + ".usage-days")))
+	return &opt, nil
+}
+
+func Flags(cmd *cobra.Command) {
+	// Title
+	cmd.Flags().String(ModuleName+"-title", DefaultTitle, "Name of the bot shown on its status page")
+	// Listen
+	cmd.Flags().String(ModuleName+"-listen", "", "Address to serve the status page on, e.g. :8091. Not served if empty")
+	// Dir
+	cmd.Flags().String(ModuleName+"-dir", "", "Directory to publish the status page to. S3 and GitHub Pages are set in the config file")
+	// Interval
+	cmd.Flags().Duration(ModuleName+"-interval", DefaultInterval, "How often the status page is published")
+	// UsageDays
+	cmd.Flags().Int(ModuleName+"-usage-days", DefaultUsageDays, "Days of command usage shown on the status page when analytics are enabled. 0 doesn't show it")
+}
@@ -0,0 +1,302 @@
+package status
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gregseb/chatlib/httpc"
+	"github.com/pkg/errors"
+)
+
+// DefaultGitHubAPI is where GitHubPublisher reaches GitHub.
+const DefaultGitHubAPI = "https://api.github.com"
+
+// Publisher puts the files of a status page somewhere they are served.
+type Publisher interface {
+	Publish(c context.Context, files map[string][]byte) error
+	// Name tells the publisher apart in logs.
+	Name() string
+}
+
+func contentType(name string) string {
+	if strings.HasSuffix(name, ".json") {
+		return "application/json"
+	}
+	return "text/html; charset=utf-8"
+}
+
+// sortedNames returns the names of files in order, so they are published
+// the same way every time.
+func sortedNames(files map[string][]byte) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DirPublisher writes pages to a directory, e.g. one served by a web server.
+type DirPublisher struct {
+	Dir string
+}
+
+func (d *DirPublisher) Name() string {
+	return "dir " + d.Dir
+}
+
+// Publish replaces the files in the directory, so they are never seen half
+// written.
+func (d *DirPublisher) Publish(c context.Context, files map[string][]byte) error {
+	if err := os.MkdirAll(d.Dir, 0o755); err != nil {
+		return errors.Wrapf(err, "status: failed to create %s", d.Dir)
+	}
+	for _, name := range sortedNames(files) {
+		tmp, err := os.CreateTemp(d.Dir, "."+name+".*")
+		if err != nil {
+			return errors.Wrapf(err, "status: failed to write %s", name)
+		}
+		_, err = tmp.Write(files[name])
+		if e := tmp.Close(); err == nil {
+			err = e
+		}
+		if err == nil {
+			err = os.Chmod(tmp.Name(), 0o644)
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), filepath.Join(d.Dir, name))
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return errors.Wrapf(err, "status: failed to write %s", name)
+		}
+	}
+	return nil
+}
+
+// S3Publisher uploads pages to an S3 bucket, e.g. one hosting a static
+// website, signing requests with AWS Signature Version 4.
+type S3Publisher struct {
+	Bucket string
+	Region string
+	// Endpoint is the URL of an S3 compatible service, such as MinIO, which
+	// is addressed by path. AWS is used if it is empty.
+	Endpoint string
+	// Prefix is put before the names of the files, e.g. status/.
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+func (s *S3Publisher) Name() string {
+	return "s3 " + s.Bucket
+}
+
+func (s *S3Publisher) Publish(c context.Context, files map[string][]byte) error {
+	for _, name := range sortedNames(files) {
+		if err := s.put(c, path.Join(s.Prefix, name), files[name], contentType(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3Publisher) put(c context.Context, key string, body []byte, ctype string) error {
+	var u string
+	if s.Endpoint == "" {
+		u = "https://" + s.Bucket + ".s3." + s.Region + ".amazonaws.com/" + awsEscape(key)
+	} else {
+		u = strings.TrimSuffix(s.Endpoint, "/") + "/" + awsEscape(s.Bucket) + "/" + awsEscape(key)
+	}
+	req, err := http.NewRequestWithContext(c, http.MethodPut, u, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "status: invalid s3 url %s", u)
+	}
+	req.Header.Set("Content-Type", ctype)
+	req.Header.Set("Cache-Control", "no-cache")
+	s.sign(req, body, time.Now())
+	return do(s.Client, req, "s3 upload of "+key)
+}
+
+// sign signs req with AWS Signature Version 4 at now.
+func (s *S3Publisher) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate, date := now.Format("20060102T150405Z"), now.Format("20060102")
+	payload := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+
+	headers := []string{"cache-control", "content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	var canonical strings.Builder
+	canonical.WriteString(req.Method + "\n" + req.URL.EscapedPath() + "\n" + req.URL.RawQuery + "\n")
+	for _, h := range headers {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		canonical.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	signed := strings.Join(headers, ";")
+	canonical.WriteString("\n" + signed + "\n" + hex.EncodeToString(payload[:]))
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{date, s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.AccessKey, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscape escapes the segments of an S3 key the way AWS signs them.
+func awsEscape(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		ch := key[i]
+		if 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || '0' <= ch && ch <= '9' || strings.IndexByte("-._~/", ch) >= 0 {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+// GitHubPublisher commits pages to a branch of a repository served with
+// GitHub Pages, through the contents API. Files that didn't change aren't
+// committed again.
+type GitHubPublisher struct {
+	// Repo is owner/name.
+	Repo   string
+	Branch string
+	// Dir is the directory of the repository the files go in, its root if
+	// empty.
+	Dir   string
+	Token string
+	// API is the URL of the GitHub API, DefaultGitHubAPI if empty.
+	API    string
+	Client *http.Client
+}
+
+func (g *GitHubPublisher) Name() string {
+	return "github " + g.Repo
+}
+
+func (g *GitHubPublisher) Publish(c context.Context, files map[string][]byte) error {
+	for _, name := range sortedNames(files) {
+		if err := g.put(c, path.Join(g.Dir, name), files[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *GitHubPublisher) put(c context.Context, file string, content []byte) error {
+	api := g.API
+	if api == "" {
+		api = DefaultGitHubAPI
+	}
+	u := strings.TrimSuffix(api, "/") + "/repos/" + g.Repo + "/contents/" + (&url.URL{Path: file}).EscapedPath()
+	// The current file's blob sha is needed to replace it
+	req, err := http.NewRequestWithContext(c, http.MethodGet, u+"?ref="+url.QueryEscape(g.Branch), nil)
+	if err != nil {
+		return errors.Wrapf(err, "status: invalid github url %s", u)
+	}
+	g.authorize(req)
+	var current struct {
+		SHA string `json:"sha"`
+	}
+	resp, err := client(g.Client).Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "status: error getting %s from github", file)
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		err = json.NewDecoder(resp.Body).Decode(&current)
+	case resp.StatusCode != http.StatusNotFound:
+		err = errors.Errorf("github answered %s", resp.Status)
+	}
+	resp.Body.Close()
+	if err != nil {
+		return errors.Wrapf(err, "status: error getting %s from github", file)
+	}
+	if current.SHA == blobSHA(content) {
+		return nil
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"message": "Update status page",
+		"content": base64.StdEncoding.EncodeToString(content),
+		"branch":  g.Branch,
+		"sha":     current.SHA,
+	})
+	if err != nil {
+		return err
+	}
+	req, err = http.NewRequestWithContext(c, http.MethodPut, u, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "status: invalid github url %s", u)
+	}
+	g.authorize(req)
+	req.Header.Set("Content-Type", "application/json")
+	return do(g.Client, req, "github commit of "+file)
+}
+
+func (g *GitHubPublisher) authorize(req *http.Request) {
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+g.Token)
+}
+
+// blobSHA is the sha git names content by.
+func blobSHA(content []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func client(c *http.Client) *http.Client {
+	if c == nil {
+		return httpc.Default()
+	}
+	return c
+}
+
+// do sends req, failing unless it succeeds.
+func do(c *http.Client, req *http.Request, what string) error {
+	resp, err := client(c).Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "status: error in %s", what)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.Errorf("status: %s failed: %s %s", what, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+// Package status renders a static status page of the bot, showing its
+// uptime, the networks it is connected to and the health of its modules, as
+// HTML and JSON. Pages are served over HTTP and published on a schedule to a
+// directory, S3 or GitHub Pages.
+package status
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultTitle    = "freyabot"
+	DefaultInterval = 5 * time.Minute
+	// DefaultUsageDays is how many days of usage are shown when analytics
+	// are enabled.
+	DefaultUsageDays = 14
+	// HTMLFile and JSONFile are the names pages are served and published
+	// as.
+	HTMLFile = "index.html"
+	JSONFile = "status.json"
+)
+
+// Page is what a status page shows.
+type Page struct {
+	Title     string    `json:"title"`
+	Generated time.Time `json:"generated"`
+	chatlib.Status
+	// Usage is how much actions were used over the last UsageDays days, if
+	// analytics are enabled.
+	UsageDays int                  `json:"usage-days,omitempty"`
+	Usage     []chatlib.UsageTrend `json:"usage,omitempty"`
+}
+
+// UptimeText is the uptime written out for people.
+func (p Page) UptimeText() string {
+	return (time.Duration(p.Uptime) * time.Second).String()
+}
+
+// sparkBars draw the daily uses of an action, from none to the most in a day.
+var sparkBars = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline draws counts as a line of bars scaled to the largest.
+func sparkline(counts []int) string {
+	peak := 0
+	for _, n := range counts {
+		peak = max(peak, n)
+	}
+	line := make([]rune, len(counts))
+	for i, n := range counts {
+		line[i] = sparkBars[0]
+		if peak > 0 {
+			line[i] = sparkBars[n*(len(sparkBars)-1)/peak]
+		}
+	}
+	return string(line)
+}
+
+var pageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{"sparkline": sparkline}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}} status</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; color: #222; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+th, td { text-align: left; padding: .4em; border-bottom: 1px solid #ddd; }
+.ok { color: #1a7f37; } .down { color: #cf222e; }
+.spark { font-family: monospace; letter-spacing: -1px; } .num { text-align: right; }
+footer { color: #777; font-size: .9em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}} status</h1>
+{{if .Started.IsZero}}<p class="down">Not running</p>{{else}}<p>Up for {{.UptimeText}}, since {{.Started.UTC.Format "2006-01-02 15:04 MST"}}</p>{{end}}
+<h2>Networks</h2>
+<table>
+{{range .Networks}}<tr><td>{{.Name}}</td>{{if .Ready}}<td class="ok">connected</td>{{else}}<td class="down">not connected</td>{{end}}</tr>
+{{else}}<tr><td>none</td></tr>
+{{end}}</table>
+<h2>Modules</h2>
+<table>
+{{range .Modules}}<tr><td>{{.Name}}</td>{{if .Healthy}}<td class="ok">healthy</td>{{else}}<td class="down">disabled: {{range $i, $a := .DisabledActions}}{{if $i}}, {{end}}{{$a}}{{end}}</td>{{end}}</tr>
+{{else}}<tr><td>none</td></tr>
+{{end}}</table>
+{{if .Usage}}<h2>Usage over {{.UsageDays}} days</h2>
+<table>
+<tr><th>Module</th><th>Command</th><th class="num">Uses</th><th class="num">Peak daily users</th><th>Trend</th></tr>
+{{range .Usage}}<tr><td>{{or .Module "core"}}</td><td>{{.Action}}</td><td class="num">{{.Uses}}</td><td class="num">{{.PeakUsers}}</td><td class="spark">{{sparkline .Daily}}</td></tr>
+{{end}}</table>
+{{end}}<footer>Generated {{.Generated.UTC.Format "2006-01-02 15:04:05 MST"}} · <a href="` + JSONFile + `">JSON</a></footer>
+</body>
+</html>
+`))
+
+// Render renders p as the files of a status page, keyed by name.
+func Render(p Page) (map[string][]byte, error) {
+	var html bytes.Buffer
+	if err := pageTemplate.Execute(&html, p); err != nil {
+		return nil, errors.Wrap(err, "status: error rendering page")
+	}
+	js, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "status: error rendering json")
+	}
+	return map[string][]byte{HTMLFile: html.Bytes(), JSONFile: js}, nil
+}
+
+// Generator renders the status page of a Handler, serving it and publishing
+// it on a schedule.
+type Generator struct {
+	title      string
+	listen     string
+	interval   time.Duration
+	publishers []Publisher
+	usageDays  int
+	status     func() chatlib.Status
+	usage      func(c context.Context, days int) ([]chatlib.UsageTrend, error)
+}
+
+// New returns a Generator of pages titled title. Pages are served on listen
+// if it isn't empty, and published to publishers every interval.
+func New(title, listen string, interval time.Duration, publishers ...Publisher) *Generator {
+	if title == "" {
+		title = DefaultTitle
+	}
+	return &Generator{title: title, listen: listen, interval: interval, publishers: publishers}
+}
+
+// ShowUsage shows how much actions were used over the last days days, when
+// analytics are enabled, see chatlib.WithAnalytics. 0 doesn't show it.
+func (g *Generator) ShowUsage(days int) *Generator {
+	g.usageDays = days
+	return g
+}
+
+// WithGenerator serves and publishes the status page of the Handler for as
+// long as it runs.
+func WithGenerator(g *Generator) chatlib.Option {
+	return func(h *chatlib.Handler) error {
+		if g.interval <= 0 && len(g.publishers) > 0 {
+			return errors.Wrapf(chatlib.ErrInvalidConfig, "status: invalid publish interval: %s", g.interval)
+		}
+		g.status, g.usage = h.Status, h.UsageTrends
+		return chatlib.WithTask("status", g.Run)(h)
+	}
+}
+
+// Render renders the current status page. The page is rendered without
+// usage if it can't be had.
+func (g *Generator) Render(c context.Context) (map[string][]byte, error) {
+	p := Page{Title: g.title, Generated: time.Now(), Status: g.status()}
+	if g.usageDays > 0 && g.usage != nil {
+		usage, err := g.usage(c, g.usageDays)
+		if err != nil {
+			log.Error().Str("module", ModuleName).Err(err).Msg("error getting usage")
+		} else if usage != nil {
+			p.UsageDays, p.Usage = g.usageDays, usage
+		}
+	}
+	return Render(p)
+}
+
+// Run serves and publishes the page until the context is cancelled.
+func (g *Generator) Run(c context.Context) error {
+	if g.listen != "" {
+		l, err := net.Listen("tcp", g.listen)
+		if err != nil {
+			return errors.Wrapf(err, "status: failed to listen on %s", g.listen)
+		}
+		srv := &http.Server{Handler: g, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			<-c.Done()
+			srv.Close()
+		}()
+		go func() {
+			if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error().Str("module", ModuleName).Err(err).Msg("error serving status page")
+			}
+		}()
+		log.Info().Str("module", ModuleName).Msgf("serving status page on %s", l.Addr())
+	}
+	if len(g.publishers) == 0 {
+		<-c.Done()
+		return nil
+	}
+	t := time.NewTicker(g.interval)
+	defer t.Stop()
+	for {
+		g.publish(c)
+		select {
+		case <-c.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// publish publishes the current page to every publisher, logging those
+// failing.
+func (g *Generator) publish(c context.Context) {
+	files, err := g.Render(c)
+	if err != nil {
+		log.Error().Str("module", ModuleName).Err(err).Msg("error rendering status page")
+		return
+	}
+	for _, p := range g.publishers {
+		if err := p.Publish(c, files); err != nil {
+			log.Error().Str("module", ModuleName).Str("publisher", p.Name()).Err(err).Msg("error publishing status page")
+			continue
+		}
+		log.Debug().Str("module", ModuleName).Str("publisher", p.Name()).Msg("published status page")
+	}
+}
+
+func (g *Generator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Path[1:]
+	if name == "" {
+		name = HTMLFile
+	}
+	files, err := g.Render(r.Context())
+	if err != nil {
+		log.Error().Str("module", ModuleName).Err(err).Msg("error rendering status page")
+		http.Error(w, "failed to render status", http.StatusInternalServerError)
+		return
+	}
+	body, ok := files[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", contentType(name))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(body)
+}
@@ -0,0 +1,198 @@
+package status
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gregseb/chatlib"
+)
+
+func testGenerator() *Generator {
+	g := New("", "", time.Minute)
+	g.status = func() chatlib.Status {
+		return chatlib.Status{
+			Started:  time.Now().Add(-time.Hour),
+			Uptime:   3600,
+			Networks: []chatlib.NetworkStatus{{Name: "libera", Ready: true}, {Name: "oftc"}},
+			Modules:  []chatlib.ModuleStatus{{Name: "fun", Healthy: true}, {Name: "spam", DisabledActions: []string{"!spam"}}},
+		}
+	}
+	return g
+}
+
+func TestRender(t *testing.T) {
+	files, err := testGenerator().Render(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := string(files[HTMLFile])
+	for _, s := range []string{"freyabot status", "Up for 1h0m0s", "libera</td><td class=\"ok\">connected", "oftc</td><td class=\"down\">not connected", "disabled: !spam"} {
+		if !strings.Contains(html, s) {
+			t.Errorf("expected the page to contain %q:\n%s", s, html)
+		}
+	}
+	var p Page
+	if err := json.Unmarshal(files[JSONFile], &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Title != DefaultTitle || p.Uptime != 3600 || len(p.Networks) != 2 || p.Modules[1].DisabledActions[0] != "!spam" || p.Usage != nil {
+		t.Errorf("unexpected json %s", files[JSONFile])
+	}
+}
+
+func TestRenderUsage(t *testing.T) {
+	g := testGenerator().ShowUsage(4)
+	g.usage = func(c context.Context, days int) ([]chatlib.UsageTrend, error) {
+		return []chatlib.UsageTrend{
+			{Module: "fun", Action: "!joke", Daily: []int{0, 2, 4, 8}, Uses: 14, PeakUsers: 3},
+			{Action: "!help", Daily: make([]int, days)},
+		}, nil
+	}
+	files, err := g.Render(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := string(files[HTMLFile])
+	for _, s := range []string{"Usage over 4 days", "<td>fun</td><td>!joke</td><td class=\"num\">14</td><td class=\"num\">3</td><td class=\"spark\">▁▂▄█</td>", "<td>core</td><td>!help</td>"} {
+		if !strings.Contains(html, s) {
+			t.Errorf("expected the page to contain %q:\n%s", s, html)
+		}
+	}
+	var p Page
+	if err := json.Unmarshal(files[JSONFile], &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.UsageDays != 4 || len(p.Usage) != 2 || p.Usage[0].Daily[3] != 8 {
+		t.Errorf("unexpected json %s", files[JSONFile])
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	g := testGenerator()
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		ctype        string
+	}{
+		{http.MethodGet, "/", http.StatusOK, "text/html; charset=utf-8"},
+		{http.MethodGet, "/" + JSONFile, http.StatusOK, "application/json"},
+		{http.MethodGet, "/other", http.StatusNotFound, ""},
+		{http.MethodPost, "/", http.StatusMethodNotAllowed, ""},
+	} {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != tc.status {
+			t.Errorf("%s %s: expected status %d, got %d", tc.method, tc.path, tc.status, w.Code)
+		}
+		if tc.ctype != "" && w.Header().Get("Content-Type") != tc.ctype {
+			t.Errorf("%s %s: expected %s, got %s", tc.method, tc.path, tc.ctype, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestDirPublisher(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "status")
+	p := &DirPublisher{Dir: dir}
+	for _, content := range []string{"old", "new"} {
+		if err := p.Publish(context.Background(), map[string][]byte{HTMLFile: []byte(content)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := os.ReadFile(filepath.Join(dir, HTMLFile))
+	if err != nil || string(b) != "new" {
+		t.Fatalf("expected the page to be replaced, got %q, %v", b, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected no temporary files to be left, got %v", entries)
+	}
+}
+
+func TestS3Publisher(t *testing.T) {
+	var mu sync.Mutex
+	uploads := make(map[string]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if r.Method != http.MethodPut || !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/eu-west-1/s3/aws4_request, SignedHeaders=cache-control;content-type;host;x-amz-content-sha256;x-amz-date, Signature=") {
+			http.Error(w, "bad request "+auth, http.StatusForbidden)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		uploads[r.URL.Path] = r.Header.Get("Content-Type") + " " + string(body)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	p := &S3Publisher{Bucket: "bucket", Region: "eu-west-1", Endpoint: srv.URL, Prefix: "status", AccessKey: "AKID", SecretKey: "secret", Client: srv.Client()}
+	if err := p.Publish(context.Background(), map[string][]byte{HTMLFile: []byte("<p>up</p>"), JSONFile: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+	if uploads["/bucket/status/index.html"] != "text/html; charset=utf-8 <p>up</p>" || uploads["/bucket/status/status.json"] != "application/json {}" {
+		t.Errorf("unexpected uploads %v", uploads)
+	}
+	p.SecretKey = ""
+	p.AccessKey = "other"
+	if err := p.Publish(context.Background(), map[string][]byte{HTMLFile: nil}); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expected the upload to fail, got %v", err)
+	}
+}
+
+func TestGitHubPublisher(t *testing.T) {
+	var mu sync.Mutex
+	files := map[string][]byte{"docs/index.html": []byte("same")}
+	commits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		file := strings.TrimPrefix(r.URL.Path, "/repos/example/status/contents/")
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Query().Get("ref") != "gh-pages" {
+				http.Error(w, "wrong branch", http.StatusBadRequest)
+				return
+			}
+			content, ok := files[file]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"sha": blobSHA(content)})
+		case http.MethodPut:
+			var req struct{ Content, Branch, SHA string }
+			json.NewDecoder(r.Body).Decode(&req)
+			if current, ok := files[file]; ok && req.SHA != blobSHA(current) || req.Branch != "gh-pages" {
+				http.Error(w, "conflict", http.StatusConflict)
+				return
+			}
+			files[file], _ = base64.StdEncoding.DecodeString(req.Content)
+			commits++
+		}
+	}))
+	defer srv.Close()
+	p := &GitHubPublisher{Repo: "example/status", Branch: "gh-pages", Dir: "docs", Token: "token", API: srv.URL, Client: srv.Client()}
+	if err := p.Publish(context.Background(), map[string][]byte{HTMLFile: []byte("same"), JSONFile: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+	if commits != 1 || string(files["docs/status.json"]) != "{}" {
+		t.Fatalf("expected only the new file to be committed, got %d commits", commits)
+	}
+	if err := p.Publish(context.Background(), map[string][]byte{HTMLFile: []byte("changed")}); err != nil {
+		t.Fatal(err)
+	}
+	if commits != 2 || string(files["docs/index.html"]) != "changed" {
+		t.Fatalf("expected the changed file to be committed, got %d commits", commits)
+	}
+}
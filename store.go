@@ -0,0 +1,194 @@
+package chatlib
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Store is a persistent key value store shared by the Handler, APIs and
+// actions. Keys are namespaced by convention, e.g. "irc/<network>/channels".
+type Store interface {
+	// Get returns ErrNotFound if the key does not exist.
+	Get(c context.Context, key string) ([]byte, error)
+	Set(c context.Context, key string, value []byte) error
+	Delete(c context.Context, key string) error
+}
+
+// StoreUser is implemented by APIs that persist state. The Handler hands its
+// Store to the API when both are configured.
+type StoreUser interface {
+	UseStore(s Store)
+}
+
+func WithStore(s Store) Option {
+	return func(h *Handler) error {
+		h.store = s
+		return nil
+	}
+}
+
+// Store returns the Handler's Store.
+func (h *Handler) Store() Store {
+	return h.store
+}
+
+// MemoryStore is a Store that does not persist anything across restarts.
+type MemoryStore struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		data: make(map[string][]byte),
+	}
+}
+
+func (s *MemoryStore) Get(c context.Context, key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.data[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), v...), nil
+}
+
+func (s *MemoryStore) Set(c context.Context, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (s *MemoryStore) Delete(c context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, key)
+	return nil
+}
+
+// fileStoreVersion is the version of the FileStore format written.
+const fileStoreVersion = 2
+
+// fileStoreData is how a FileStore is written. Values are base64 in JSON,
+// so any bytes survive. Version 1 files were a plain object of strings,
+// which are still read.
+type fileStoreData struct {
+	Version int               `json:"version"`
+	Values  map[string][]byte `json:"values"`
+}
+
+// FileStore is a Store kept in memory and written to a JSON file on every
+// change. It is meant for small amounts of state on a single instance.
+type FileStore struct {
+	MemoryStore
+	path   string
+	saveMu sync.Mutex
+}
+
+var _ Store = (*FileStore)(nil)
+
+// NewFileStore loads the store from path, creating it on the first write if
+// it does not exist.
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		MemoryStore: MemoryStore{data: make(map[string][]byte)},
+		path:        path,
+	}
+	bts, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "store: failed to read %s", path)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(bts, &raw); err != nil {
+		return nil, errors.Wrapf(err, "store: failed to parse %s", path)
+	}
+	// Values of version 1 are all strings, so a number is a version
+	var version int
+	if json.Unmarshal(raw["version"], &version) != nil {
+		data := make(map[string]string)
+		if err := json.Unmarshal(bts, &data); err != nil {
+			return nil, errors.Wrapf(err, "store: failed to parse %s", path)
+		}
+		for k, v := range data {
+			s.data[k] = []byte(v)
+		}
+		return s, nil
+	}
+	if version > fileStoreVersion {
+		return nil, errors.Errorf("store: %s is of a newer version %d", path, version)
+	}
+	var data fileStoreData
+	if err := json.Unmarshal(bts, &data); err != nil {
+		return nil, errors.Wrapf(err, "store: failed to parse %s", path)
+	}
+	for k, v := range data.Values {
+		s.data[k] = v
+	}
+	return s, nil
+}
+
+func (s *FileStore) Set(c context.Context, key string, value []byte) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if err := s.MemoryStore.Set(c, key, value); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *FileStore) Delete(c context.Context, key string) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if err := s.MemoryStore.Delete(c, key); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// Snapshot implements Snapshotter. FileStore already writes every change, so
+// this only guards against a failed earlier write.
+func (s *FileStore) Snapshot(c context.Context) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	return s.save()
+}
+
+// save writes the store to a temporary file and renames it into place so a
+// crash never leaves a partially written file behind.
+func (s *FileStore) save() error {
+	s.mu.RLock()
+	data := fileStoreData{Version: fileStoreVersion, Values: make(map[string][]byte, len(s.data))}
+	for k, v := range s.data {
+		data.Values[k] = v
+	}
+	s.mu.RUnlock()
+	bts, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return errors.Wrapf(err, "store: failed to write %s", s.path)
+	}
+	if _, err := tmp.Write(bts); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "store: failed to write %s", s.path)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "store: failed to write %s", s.path)
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
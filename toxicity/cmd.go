@@ -0,0 +1,72 @@
+package toxicity
+
+import (
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const ModuleName = "toxicity"
+
+const DefaultRateLimit = 30
+
+// DefaultTimeoutSeconds is how long a message is given to be classified.
+const DefaultTimeoutSeconds = 2.0
+
+func init() {
+	chatlib.RegisterModule(chatlib.Module{
+		Name:  ModuleName,
+		Flags: Flags,
+		Init:  Init,
+	})
+}
+
+func Init() (*chatlib.Option, error) {
+	if !viper.GetBool(ModuleName + ".enable") {
+		log.Info().Msg("toxicity scoring disabled")
+		return nil, nil
+	}
+	var cl Classifier
+	switch viper.GetString(ModuleName + ".classifier") {
+	case "wordlist":
+		cl = NewWordlistClassifier(viper.GetStringSlice(ModuleName + ".wordlist"))
+	case "perspective":
+		key := viper.GetString(ModuleName + ".perspective-key")
+		if key == "" {
+			return nil, errors.WithMessage(chatlib.ErrInvalidConfig, "toxicity: perspective classifier requires perspective-key")
+		}
+		cl = NewPerspectiveClassifier(key)
+	default:
+		return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "toxicity: invalid classifier: %s", viper.GetString(ModuleName+".classifier"))
+	}
+	rate := viper.GetInt(ModuleName + ".rate-limit")
+	timeout := viper.GetFloat64(ModuleName + ".timeout")
+	if timeout <= 0 {
+		return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "toxicity: invalid timeout: %g", timeout)
+	}
+	log.Info().Str("classifier", cl.Name()).Msgf("toxicity scoring enabled, at most %d messages a minute", rate)
+	mw := Middleware(cl, rate, time.Duration(timeout*float64(time.Second)))
+	opt := chatlib.Option(func(h *chatlib.Handler) error {
+		return h.ApplyOptions(chatlib.WithMiddleware(mw), chatlib.WithContentRule(Rule))
+	})
+	return &opt, nil
+}
+
+func Flags(cmd *cobra.Command) {
+	// Enable
+	cmd.Flags().Bool(ModuleName+"-enable", false, "Score incoming messages for toxicity")
+	// Classifier
+	cmd.Flags().String(ModuleName+"-classifier", "wordlist", "Toxicity classifier, one of: wordlist, perspective")
+	// Wordlist
+	cmd.Flags().StringSlice(ModuleName+"-wordlist", []string{}, "Words the wordlist classifier treats as toxic")
+	// PerspectiveKey
+	cmd.Flags().String(ModuleName+"-perspective-key", "", "Perspective API key. Required if classifier is perspective")
+	// RateLimit
+	cmd.Flags().Int(ModuleName+"-rate-limit", DefaultRateLimit, "Maximum messages scored a minute. Messages over the limit are not scored")
+	// Timeout
+	cmd.Flags().Float64(ModuleName+"-timeout", DefaultTimeoutSeconds, "Seconds a message is given to be scored. Messages taking longer are not scored")
+}
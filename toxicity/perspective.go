@@ -0,0 +1,96 @@
+package toxicity
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gregseb/chatlib/httpc"
+	"github.com/pkg/errors"
+)
+
+const PerspectiveURL = "https://commentanalyzer.googleapis.com/v1alpha1/comments:analyze"
+
+// PerspectiveClassifier scores text with Google's Perspective API.
+type PerspectiveClassifier struct {
+	Key        string
+	URL        string
+	Attributes []string
+	// Client sends the requests. It defaults to httpc.Default.
+	Client *http.Client
+}
+
+var _ Classifier = (*PerspectiveClassifier)(nil)
+
+func NewPerspectiveClassifier(key string) *PerspectiveClassifier {
+	return &PerspectiveClassifier{
+		Key:        key,
+		URL:        PerspectiveURL,
+		Attributes: []string{"TOXICITY", "INSULT", "THREAT"},
+	}
+}
+
+func (p *PerspectiveClassifier) Name() string {
+	return "perspective"
+}
+
+type perspectiveRequest struct {
+	Comment struct {
+		Text string `json:"text"`
+	} `json:"comment"`
+	RequestedAttributes map[string]struct{} `json:"requestedAttributes"`
+	DoNotStore          bool                `json:"doNotStore"`
+}
+
+type perspectiveResponse struct {
+	AttributeScores map[string]struct {
+		SummaryScore struct {
+			Value float64 `json:"value"`
+		} `json:"summaryScore"`
+	} `json:"attributeScores"`
+}
+
+func (p *PerspectiveClassifier) Classify(c context.Context, text string) (*Score, error) {
+	req := perspectiveRequest{
+		RequestedAttributes: make(map[string]struct{}),
+		DoNotStore:          true,
+	}
+	req.Comment.Text = text
+	for _, attr := range p.Attributes {
+		req.RequestedAttributes[attr] = struct{}{}
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequestWithContext(c, http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	// The key goes in a header rather than the URL, which errors include
+	r.Header.Set("X-Goog-Api-Key", p.Key)
+	client := p.Client
+	if client == nil {
+		client = httpc.Default()
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "perspective: request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("perspective: unexpected status: %s", resp.Status)
+	}
+	var res perspectiveResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, errors.Wrap(err, "perspective: invalid response")
+	}
+	score := &Score{Labels: make(map[string]float64)}
+	for attr, v := range res.AttributeScores {
+		score.Labels[attr] = v.SummaryScore.Value
+	}
+	score.Toxicity = score.Labels["TOXICITY"]
+	return score, nil
+}
@@ -0,0 +1,134 @@
+// Package toxicity scores messages for toxicity with a pluggable classifier
+// and attaches the score as an annotation for moderation actions to use.
+package toxicity
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Score is the result of classifying a message. Values are between 0 and 1.
+type Score struct {
+	Toxicity float64
+	// Labels holds any finer grained scores the classifier provides, e.g.
+	// "INSULT" or "THREAT".
+	Labels map[string]float64
+	// Classifier names the classifier that produced the score.
+	Classifier string
+}
+
+// Classifier scores text. Implementations may run a local model or call out
+// to a remote service such as Perspective or an LLM.
+type Classifier interface {
+	Name() string
+	Classify(c context.Context, text string) (*Score, error)
+}
+
+// Annotation holds the Score of a message. It is absent when the message
+// was not classified, e.g. because the rate limit was reached.
+var Annotation = chatlib.NewAnnotationKey[*Score]("toxicity")
+
+// Middleware returns a chatlib.Middleware that classifies at most perMinute
+// user messages a minute. Messages over the limit are not annotated rather
+// than delayed, so a flood can't back up the Handler. Middlewares run before
+// any action sees the message, so a classifier taking longer than timeout is
+// given up on and the message is left unannotated too.
+func Middleware(cl Classifier, perMinute int, timeout time.Duration) chatlib.Middleware {
+	l := &limiter{
+		capacity: float64(perMinute),
+		tokens:   float64(perMinute),
+		rate:     float64(perMinute) / 60,
+		last:     time.Now(),
+	}
+	return func(c context.Context, msg *chatlib.Message) error {
+		if msg.Nick == "" || msg.Text == "" || msg.Self {
+			return nil
+		}
+		if !l.allow() {
+			log.Debug().Str("classifier", cl.Name()).Msg("toxicity rate limit reached, not classifying")
+			return nil
+		}
+		c, cancel := context.WithTimeout(c, timeout)
+		defer cancel()
+		score, err := cl.Classify(c, msg.Text)
+		if err != nil {
+			return errors.Wrap(err, "toxicity: classify")
+		}
+		score.Classifier = cl.Name()
+		Annotation.Set(msg, score)
+		return nil
+	}
+}
+
+// Rule is a chatlib.ContentRule holding users to the MaxToxicity of the
+// channel, for messages the Middleware scored.
+func Rule(s chatlib.Settings, msg *chatlib.Message) string {
+	score, ok := Annotation.Get(msg)
+	if !ok || s.MaxToxicity <= 0 || score.Toxicity <= s.MaxToxicity {
+		return ""
+	}
+	return "abusive messages may not be posted"
+}
+
+// limiter is a token bucket refilled continuously at rate tokens a second.
+type limiter struct {
+	mu       sync.Mutex
+	capacity float64
+	tokens   float64
+	rate     float64
+	last     time.Time
+}
+
+func (l *limiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.capacity, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// WordlistClassifier is a local classifier that scores text by the share of
+// its words found in a list. It is crude but free and needs no network.
+type WordlistClassifier struct {
+	words map[string]bool
+}
+
+var _ Classifier = (*WordlistClassifier)(nil)
+
+func NewWordlistClassifier(words []string) *WordlistClassifier {
+	w := &WordlistClassifier{words: make(map[string]bool)}
+	for _, word := range words {
+		w.words[strings.ToLower(word)] = true
+	}
+	return w
+}
+
+func (w *WordlistClassifier) Name() string {
+	return "wordlist"
+}
+
+// Classify scores each listed word as a third of the maximum, so three hits
+// in one line are fully toxic regardless of line length.
+func (w *WordlistClassifier) Classify(c context.Context, text string) (*Score, error) {
+	hits := 0
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if w.words[word] {
+			hits++
+		}
+	}
+	return &Score{Toxicity: min(1, float64(hits)/3)}, nil
+}
@@ -0,0 +1,154 @@
+package toxicity
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gregseb/chatlib"
+)
+
+func TestLimiter(t *testing.T) {
+	l := &limiter{capacity: 2, tokens: 2, rate: 1, last: time.Now()}
+	if !l.allow() || !l.allow() {
+		t.Fatal("expected the bucket to start full")
+	}
+	if l.allow() {
+		t.Fatal("expected an empty bucket to refuse")
+	}
+	// A second refills one token, and no more than the capacity
+	l.last = l.last.Add(-time.Second)
+	if !l.allow() {
+		t.Fatal("expected a token after a second")
+	}
+	if l.allow() {
+		t.Fatal("expected only one token after a second")
+	}
+	l.last = l.last.Add(-time.Hour)
+	for i := 0; i < 2; i++ {
+		if !l.allow() {
+			t.Fatal("expected the bucket to refill")
+		}
+	}
+	if l.allow() {
+		t.Fatal("expected the bucket to refill only up to its capacity")
+	}
+}
+
+func TestWordlistClassifier(t *testing.T) {
+	cl := NewWordlistClassifier([]string{"Darn", "heck"})
+	for _, tc := range []struct {
+		text string
+		exp  float64
+	}{
+		{"all good here", 0},
+		{"darn it", 1.0 / 3},
+		{"DARN, heck!", 2.0 / 3},
+		{"heck heck heck heck", 1},
+		{"darnation", 0},
+	} {
+		score, err := cl.Classify(context.Background(), tc.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if score.Toxicity != tc.exp {
+			t.Errorf("%q: expected %g, got %g", tc.text, tc.exp, score.Toxicity)
+		}
+	}
+}
+
+func TestPerspectiveClassifier(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Goog-Api-Key") != "secret" || r.URL.Query().Has("key") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var req perspectiveRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Comment.Text != "you fool" || !req.DoNotStore {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, ok := req.RequestedAttributes["INSULT"]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"attributeScores":{"TOXICITY":{"summaryScore":{"value":0.7}},"INSULT":{"summaryScore":{"value":0.9}}}}`))
+	}))
+	defer srv.Close()
+
+	cl := NewPerspectiveClassifier("secret")
+	cl.URL = srv.URL
+	score, err := cl.Classify(context.Background(), "you fool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score.Toxicity != 0.7 || score.Labels["INSULT"] != 0.9 {
+		t.Fatalf("unexpected score %+v", score)
+	}
+
+	// The key is never part of an error
+	cl.Key = "wrong"
+	if _, err := cl.Classify(context.Background(), "you fool"); err == nil || strings.Contains(err.Error(), "wrong") {
+		t.Fatalf("expected an error without the key, got %v", err)
+	}
+}
+
+// slowClassifier takes until its context is done.
+type slowClassifier struct{}
+
+func (slowClassifier) Name() string {
+	return "slow"
+}
+
+func (slowClassifier) Classify(c context.Context, text string) (*Score, error) {
+	<-c.Done()
+	return nil, c.Err()
+}
+
+func TestMiddleware(t *testing.T) {
+	mw := Middleware(NewWordlistClassifier([]string{"heck"}), 1, time.Second)
+	msg := &chatlib.Message{Nick: "alice", Text: "heck heck heck"}
+	if err := mw(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	score, ok := Annotation.Get(msg)
+	if !ok || score.Toxicity != 1 || score.Classifier != "wordlist" {
+		t.Fatalf("expected the message to be scored, got %+v", score)
+	}
+	if Rule(chatlib.Settings{MaxToxicity: 0.8}, msg) == "" {
+		t.Error("expected the message to break the rule")
+	}
+	if Rule(chatlib.Settings{}, msg) != "" {
+		t.Error("expected no rule without a max toxicity")
+	}
+
+	// Over the rate limit messages aren't scored
+	msg = &chatlib.Message{Nick: "alice", Text: "heck"}
+	if err := mw(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Annotation.Get(msg); ok {
+		t.Fatal("expected a message over the rate limit not to be scored")
+	}
+	if Rule(chatlib.Settings{MaxToxicity: 0.1}, msg) != "" {
+		t.Error("expected an unscored message not to break the rule")
+	}
+
+	// Nor are those the classifier takes too long on
+	mw = Middleware(slowClassifier{}, 10, 10*time.Millisecond)
+	msg = &chatlib.Message{Nick: "alice", Text: "hello"}
+	start := time.Now()
+	if err := mw(context.Background(), msg); err == nil {
+		t.Fatal("expected an error from a slow classifier")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("expected the classifier to be given up on")
+	}
+	if _, ok := Annotation.Get(msg); ok {
+		t.Fatal("expected a message classified too slowly not to be scored")
+	}
+}
@@ -0,0 +1,300 @@
+package chatlib
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/mail"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Challenges users joining a channel are given, see Settings.Verify.
+const (
+	// VerifyByQuestion asks users the channel's VerifyQuestion.
+	VerifyByQuestion = "question"
+	// VerifyByEmail mails users a code, which needs a Mailer.
+	VerifyByEmail = "email"
+)
+
+// maxVerifyAttempts is how many answers and mails a user gets for a
+// challenge, so codes can't be guessed and addresses spammed.
+const maxVerifyAttempts = 5
+
+// Kicker is implemented by APIs that can remove users from channels.
+type Kicker interface {
+	Kick(c context.Context, channel, nick, reason string) error
+}
+
+// pendingVerification is a user who joined a channel that verifies its users
+// and hasn't passed its challenge yet.
+type pendingVerification struct {
+	api     string
+	channel string
+	nick    string
+	// code is the code mailed to the user, empty until they give an address.
+	code     string
+	attempts int
+	timer    *time.Timer
+}
+
+// memberKey is a user in a channel on a network.
+type memberKey struct {
+	scope
+	nick string
+}
+
+// verifications are the users the Handler is waiting on to verify.
+type verifications struct {
+	mu      sync.Mutex
+	pending map[memberKey]*pendingVerification
+}
+
+func (p *pendingVerification) key() memberKey {
+	return memberKey{scope{strings.ToLower(p.api), strings.ToLower(p.channel)}, strings.ToLower(p.nick)}
+}
+
+// verifiedKey is where users who passed the challenge of a channel are
+// kept in the Store.
+func verifiedKey(api, channel, nick string) string {
+	return "verified/" + api + "/" + strings.ToLower(channel) + "/" + strings.ToLower(nick)
+}
+
+// WithVerification gates the channels whose Verify setting is set: users
+// joining them are sent a challenge privately, and their commands in the
+// channel are ignored until they answer it with !verify. If the channel's
+// VerifyTimeout passes first, they are removed from it on APIs that can.
+// Users are remembered by nick once verified.
+func WithVerification() Option {
+	return func(h *Handler) error {
+		return h.ApplyOptions(
+			RegisterAction("JOIN", "", "", "", h.actionVerifyJoin),
+			RegisterAction("PART", "", "", "", h.actionVerifyLeave),
+			RegisterAction("QUIT", "", "", "", h.actionVerifyLeave),
+			RegisterAction("NICK", "", "", "", h.actionVerifyNick),
+			RegisterCommand("verify", `(.+)`, "!verify answer", "answer the challenge of a channel you joined", h.actionVerify),
+		)
+	}
+}
+
+// Unverified reports whether the sender of msg joined its channel and hasn't
+// passed its challenge yet.
+func (h *Handler) Unverified(msg *Message) bool {
+	if msg.Nick == "" || msg.Private {
+		return false
+	}
+	h.verifying.mu.Lock()
+	defer h.verifying.mu.Unlock()
+	_, ok := h.verifying.pending[(&pendingVerification{api: msg.API, channel: msg.Channel(), nick: msg.Nick}).key()]
+	return ok
+}
+
+func (h *Handler) actionVerifyJoin(c context.Context, re *regexp.Regexp, msg *Message) error {
+	channel := msg.Receiver
+	s := h.Settings(msg.API, channel)
+	if s.Verify == "" || msg.Nick == "" || msg.Replayed {
+		return nil
+	}
+	if n, ok := h.API(msg.API).(Nicker); ok && strings.EqualFold(msg.Nick, n.Nick()) {
+		return nil
+	}
+	if _, err := h.store.Get(c, verifiedKey(msg.API, channel, msg.Nick)); err == nil {
+		return nil
+	}
+	p := &pendingVerification{api: msg.API, channel: channel, nick: msg.Nick}
+	h.verifying.mu.Lock()
+	if h.verifying.pending == nil {
+		h.verifying.pending = make(map[memberKey]*pendingVerification)
+	}
+	if old, ok := h.verifying.pending[p.key()]; ok && old.timer != nil {
+		old.timer.Stop()
+	}
+	h.verifying.pending[p.key()] = p
+	if s.VerifyTimeout > 0 {
+		// The timer outlives the action, and so must its context
+		p.timer = time.AfterFunc(time.Duration(s.VerifyTimeout)*time.Second, func() { h.verifyExpired(context.WithoutCancel(c), p) })
+	}
+	h.verifying.mu.Unlock()
+	log.Debug().Str("api", msg.API).Str("channel", channel).Str("nick", msg.Nick).Msg("waiting for user to verify")
+
+	text := s.Welcome
+	if text == "" {
+		text = "Welcome to " + channel + "!"
+	}
+	switch s.Verify {
+	case VerifyByQuestion:
+		text += " To talk there, answer with " + h.commandPrefix + "verify: " + s.VerifyQuestion
+	case VerifyByEmail:
+		text += " To talk there, send " + h.commandPrefix + "verify and your email address to be mailed a code"
+	}
+	if s.VerifyTimeout > 0 {
+		text += ", within " + h.Formatter(c, msg).FormatDuration(time.Duration(s.VerifyTimeout)*time.Second)
+	}
+	return h.Send(c, &Message{Command: CommandMessage, Receiver: msg.Nick, Text: text, API: msg.API})
+}
+
+// verifyExpired removes the user of p from its channel if they still
+// haven't verified.
+func (h *Handler) verifyExpired(c context.Context, p *pendingVerification) {
+	h.verifying.mu.Lock()
+	current, ok := h.verifying.pending[p.key()]
+	if ok && current == p {
+		delete(h.verifying.pending, p.key())
+	}
+	h.verifying.mu.Unlock()
+	if !ok || current != p {
+		return
+	}
+	k, ok := h.API(p.api).(Kicker)
+	if !ok {
+		log.Info().Str("api", p.api).Str("channel", p.channel).Str("nick", p.nick).Msg("user didn't verify in time, the api can't remove them")
+		return
+	}
+	log.Info().Str("api", p.api).Str("channel", p.channel).Str("nick", p.nick).Msg("removing user who didn't verify in time")
+	if err := k.Kick(c, p.channel, p.nick, "not verified in time"); err != nil {
+		log.Error().Str("api", p.api).Str("channel", p.channel).Str("nick", p.nick).Err(err).Msg("error removing unverified user")
+	}
+}
+
+// actionVerifyLeave forgets the challenges of users leaving the channel, or
+// every channel when they quit. They get a new one when they join again.
+func (h *Handler) actionVerifyLeave(c context.Context, re *regexp.Regexp, msg *Message) error {
+	h.verifying.mu.Lock()
+	defer h.verifying.mu.Unlock()
+	for k, p := range h.verifying.pending {
+		if p.api == msg.API && strings.EqualFold(p.nick, msg.Nick) && (msg.Command == "QUIT" || strings.EqualFold(p.channel, msg.Receiver)) {
+			if p.timer != nil {
+				p.timer.Stop()
+			}
+			delete(h.verifying.pending, k)
+		}
+	}
+	return nil
+}
+
+// actionVerifyNick follows users changing their nick, so they can't dodge
+// the challenge by doing so.
+func (h *Handler) actionVerifyNick(c context.Context, re *regexp.Regexp, msg *Message) error {
+	h.verifying.mu.Lock()
+	defer h.verifying.mu.Unlock()
+	var renamed []*pendingVerification
+	for k, p := range h.verifying.pending {
+		if p.api == msg.API && strings.EqualFold(p.nick, msg.Nick) {
+			delete(h.verifying.pending, k)
+			renamed = append(renamed, p)
+		}
+	}
+	for _, p := range renamed {
+		p.nick = msg.Receiver
+		h.verifying.pending[p.key()] = p
+	}
+	return nil
+}
+
+func (h *Handler) actionVerify(c context.Context, re *regexp.Regexp, msg *Message) error {
+	if !msg.Private {
+		return h.Reply(c, msg, "send me that privately")
+	}
+	answer := strings.TrimSpace(re.FindStringSubmatch(msg.Text)[1])
+	var pending []*pendingVerification
+	h.verifying.mu.Lock()
+	for _, p := range h.verifying.pending {
+		if p.api == msg.API && strings.EqualFold(p.nick, msg.Nick) {
+			pending = append(pending, p)
+		}
+	}
+	h.verifying.mu.Unlock()
+	if len(pending) == 0 {
+		return h.Reply(c, msg, "you have nothing to verify")
+	}
+	replies := make([]string, 0, len(pending))
+	for _, p := range pending {
+		s := h.Settings(p.api, p.channel)
+		if !h.verifying.attempt(p) {
+			replies = append(replies, "too many tries for "+p.channel)
+			continue
+		}
+		if s.Verify == VerifyByEmail && strings.Contains(answer, "@") {
+			addr, err := mail.ParseAddress(answer)
+			if err != nil {
+				replies = append(replies, answer+" isn't an email address")
+				continue
+			}
+			if err := h.mailCode(c, p, addr.Address); err != nil {
+				return err
+			}
+			replies = append(replies, "mailed a code for "+p.channel+" to "+addr.Address+", send it with "+h.commandPrefix+"verify")
+			continue
+		}
+		if !h.verifying.check(p, s, answer) {
+			replies = append(replies, "that's not the answer for "+p.channel)
+			continue
+		}
+		if err := h.store.Set(c, verifiedKey(p.api, p.channel, p.nick), []byte(time.Now().UTC().Format(time.RFC3339))); err != nil {
+			return errors.WithMessage(err, "error saving verification")
+		}
+		h.verifying.mu.Lock()
+		if h.verifying.pending[p.key()] == p {
+			delete(h.verifying.pending, p.key())
+		}
+		h.verifying.mu.Unlock()
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+		log.Info().Str("api", p.api).Str("channel", p.channel).Str("nick", p.nick).Msg("user verified")
+		replies = append(replies, "you can talk in "+p.channel+" now")
+	}
+	return h.Reply(c, msg, strings.Join(replies, ", "))
+}
+
+// attempt counts an answer or mail for p, and reports whether it may be
+// made.
+func (v *verifications) attempt(p *pendingVerification) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if p.attempts >= maxVerifyAttempts {
+		return false
+	}
+	p.attempts++
+	return true
+}
+
+// check reports whether answer passes the challenge of p.
+func (v *verifications) check(p *pendingVerification, s Settings, answer string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	switch s.Verify {
+	case VerifyByQuestion:
+		return s.VerifyAnswer != "" && strings.EqualFold(answer, strings.TrimSpace(s.VerifyAnswer))
+	case VerifyByEmail:
+		return p.code != "" && answer == p.code
+	}
+	return false
+}
+
+// mailCode mails a new code for the challenge of p to address.
+func (h *Handler) mailCode(c context.Context, p *pendingVerification, address string) error {
+	if h.mailer == nil {
+		return errors.WithMessage(ErrInvalidConfig, "no mailer to send verification codes with")
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	h.verifying.mu.Lock()
+	p.code = code
+	h.verifying.mu.Unlock()
+	body := "Your code to talk in " + p.channel + " is " + code + ".\n\nIf you didn't ask for it, ignore this mail."
+	if err := h.mailer.SendMail(c, address, "Your code for "+p.channel, body); err != nil {
+		return err
+	}
+	log.Debug().Str("api", p.api).Str("channel", p.channel).Str("nick", p.nick).Msg("verification code mailed")
+	return nil
+}
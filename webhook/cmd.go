@@ -0,0 +1,160 @@
+package webhook
+
+import (
+	"text/template"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const ModuleName = "webhook"
+
+func init() {
+	chatlib.RegisterModule(chatlib.Module{
+		Name:  ModuleName,
+		Flags: Flags,
+		Init:  Init,
+		ConfigKeys: []string{
+			"sources.*.verify", "sources.*.secret", "sources.*.channels", "sources.*.api",
+			"sources.*.templates.*", "sources.*.channel-template",
+			"hooks.*.url", "hooks.*.events", "hooks.*.pattern", "hooks.*.secret", "hooks.*.template",
+		},
+	})
+}
+
+// Init builds the server from the listen address and the sources map, and
+// the outbound hooks from the hooks map, e.g.
+//
+//	webhook:
+//	  listen: ":8090"
+//	  sources:
+//	    github:
+//	      verify: github
+//	      secret: ...
+//	      channels: ["#dev"]
+//	      templates:
+//	        push: "{{.pusher.name}} pushed to {{.repository.full_name}}"
+//	  hooks:
+//	    deploys:
+//	      url: https://ci.example.com/hooks/chat
+//	      events: [message]
+//	      pattern: "^!deploy "
+//	      secret: ...
+func Init() (*chatlib.Option, error) {
+	opts := make([]chatlib.Option, 0)
+	if addr := viper.GetString(ModuleName + ".listen"); addr != "" {
+		opt, err := initServer(addr)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+	if len(viper.GetStringMap(ModuleName+".hooks")) > 0 {
+		opt, err := initPoster()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+	if len(opts) == 0 {
+		log.Info().Msg("webhooks disabled")
+		return nil, nil
+	}
+	opt := chatlib.CombineOptions(opts...)
+	return &opt, nil
+}
+
+func initServer(addr string) (chatlib.Option, error) {
+	window := viper.GetDuration(ModuleName + ".replay-window")
+	if window <= 0 {
+		return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "webhook: invalid replay window: %s", window)
+	}
+	sources := make([]*Source, 0)
+	for name := range viper.GetStringMap(ModuleName + ".sources") {
+		key := ModuleName + ".sources." + name
+		method := viper.GetString(key + ".verify")
+		if method == "" {
+			method = VerifyNone
+		}
+		v, err := NewVerifier(method, viper.GetString(key+".secret"), window)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "webhook: source %s", name)
+		}
+		if method == VerifyNone {
+			log.Warn().Str("module", ModuleName).Msgf("webhooks from %s are not verified", name)
+		}
+		src := &Source{
+			Name:     name,
+			Verifier: v,
+			Targets:  viper.GetStringSlice(key + ".channels"),
+			API:      viper.GetString(key + ".api"),
+		}
+		if templates := viper.GetStringMapString(key + ".templates"); len(templates) > 0 {
+			t, err := NewTransform(templates, viper.GetString(key+".channel-template"))
+			if err != nil {
+				return nil, errors.WithMessagef(err, "webhook: source %s", name)
+			}
+			src.Transform = t
+		}
+		log.Info().Str("module", ModuleName).Msgf("relaying webhooks from %s at %s%s to %v", name, PathPrefix, name, src.Targets)
+		sources = append(sources, src)
+	}
+	if len(sources) == 0 {
+		return nil, errors.WithMessage(chatlib.ErrInvalidConfig, "webhook: no sources configured")
+	}
+	return WithServer(New(addr, viper.GetInt64(ModuleName+".max-body"), sources...)), nil
+}
+
+func initPoster() (chatlib.Option, error) {
+	retries := viper.GetInt(ModuleName + ".retries")
+	backoff := viper.GetDuration(ModuleName + ".backoff")
+	if retries < 0 || backoff <= 0 {
+		return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "webhook: invalid retries %d or backoff %s", retries, backoff)
+	}
+	hooks := make([]*Hook, 0)
+	for name := range viper.GetStringMap(ModuleName + ".hooks") {
+		key := ModuleName + ".hooks." + name
+		hk := &Hook{
+			Name:   name,
+			URL:    viper.GetString(key + ".url"),
+			Events: viper.GetStringSlice(key + ".events"),
+			Secret: viper.GetString(key + ".secret"),
+		}
+		if hk.URL == "" || len(hk.Events) == 0 {
+			return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "webhook: hook %s needs a url and events", name)
+		}
+		if p := viper.GetString(key + ".pattern"); p != "" {
+			re, err := chatlib.CompilePattern(p, chatlib.DefaultPatternLimits)
+			if err != nil {
+				return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "webhook: invalid pattern for hook %s: %s", name, err)
+			}
+			hk.Pattern = re
+		}
+		if t := viper.GetString(key + ".template"); t != "" {
+			tmpl, err := template.New(name).Parse(t)
+			if err != nil {
+				return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "webhook: invalid template for hook %s: %s", name, err)
+			}
+			hk.Template = tmpl
+		}
+		log.Info().Str("module", ModuleName).Msgf("posting %v events to %s", hk.Events, name)
+		hooks = append(hooks, hk)
+	}
+	return WithPoster(NewPoster(retries, backoff, hooks...)), nil
+}
+
+func Flags(cmd *cobra.Command) {
+	// Listen
+	cmd.Flags().String(ModuleName+"-listen", "", "Address to serve webhooks on, e.g. :8090. Incoming webhooks are disabled if empty. Sources and outbound hooks are set in the config file")
+	// ReplayWindow
+	cmd.Flags().Duration(ModuleName+"-replay-window", DefaultReplayWindow, "How old a signed webhook may be, and how long delivery IDs are remembered to refuse repeats")
+	// MaxBody
+	cmd.Flags().Int64(ModuleName+"-max-body", DefaultMaxBody, "Largest webhook body accepted, in bytes")
+	// Retries
+	cmd.Flags().Int(ModuleName+"-retries", DefaultRetries, "How many more times to try posting an outbound webhook that failed")
+	// Backoff
+	cmd.Flags().Duration(ModuleName+"-backoff", DefaultBackoff, "How long to wait before retrying an outbound webhook, doubled on each retry")
+}
@@ -0,0 +1,231 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/gregseb/chatlib/httpc"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultRetries = 5
+	DefaultBackoff = 5 * time.Second
+	// SignatureHeader carries the HMAC-SHA256 of the body, as sha256=<hex>,
+	// for hooks with a secret.
+	SignatureHeader = "X-Chatlib-Signature-256"
+	// outboundQueue is how many events may wait to be posted before new ones
+	// are dropped.
+	outboundQueue = 100
+)
+
+// Events hooks can be called for, besides the kinds of journal events such
+// as chatlib.EventConnect.
+const (
+	// EventMessage is a message or notice from a user matching the hook's
+	// pattern.
+	EventMessage = "message"
+	// EventJoin is a user other than the bot joining a channel.
+	EventJoin = "join"
+)
+
+// OutboundEvent is what happened, posted as JSON unless the hook has a
+// template.
+type OutboundEvent struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	API     string    `json:"api,omitempty"`
+	Channel string    `json:"channel,omitempty"`
+	Nick    string    `json:"nick,omitempty"`
+	Text    string    `json:"text,omitempty"`
+}
+
+// Hook is an external URL told about events.
+type Hook struct {
+	Name string
+	// URL must be on a public address, see httpc.NewSafe.
+	URL    string
+	Events []string
+	// Pattern, if set, is what messages must match for EventMessage.
+	Pattern *regexp.Regexp
+	// Secret, if set, signs the body in SignatureHeader.
+	Secret string
+	// Template, if set, renders the body from the OutboundEvent.
+	Template *template.Template
+}
+
+func (hk *Hook) wants(e OutboundEvent) bool {
+	for _, name := range hk.Events {
+		if name == e.Event {
+			return e.Event != EventMessage || hk.Pattern == nil || hk.Pattern.MatchString(e.Text)
+		}
+	}
+	return false
+}
+
+type delivery struct {
+	hook  *Hook
+	event OutboundEvent
+}
+
+// Poster posts events to hooks in the background, retrying failed posts with
+// exponential backoff.
+type Poster struct {
+	hooks   []*Hook
+	retries int
+	backoff time.Duration
+	client  *http.Client
+	queue   chan delivery
+}
+
+// NewPoster returns a Poster trying each post up to retries more times,
+// waiting backoff and then twice as long each time.
+func NewPoster(retries int, backoff time.Duration, hooks ...*Hook) *Poster {
+	return &Poster{
+		hooks:   hooks,
+		retries: retries,
+		backoff: backoff,
+		queue:   make(chan delivery, outboundQueue),
+	}
+}
+
+// WithPoster tells the Poster's hooks about the Handler's messages, joins and
+// journal events.
+func WithPoster(p *Poster) chatlib.Option {
+	return chatlib.CombineOptions(
+		chatlib.WithMiddleware(p.middleware),
+		chatlib.WithEventHook(p.journalEvent),
+		chatlib.WithTask("webhook-outbound", p.Run),
+	)
+}
+
+func (p *Poster) middleware(c context.Context, msg *chatlib.Message) error {
+	if msg.Nick == "" || msg.Replayed {
+		return nil
+	}
+	e := OutboundEvent{Time: msg.Time, API: msg.API, Nick: msg.Nick, Channel: msg.Channel(), Text: msg.Text}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	switch msg.Command {
+	case chatlib.CommandMessage, chatlib.CommandNotice, chatlib.CommandAction:
+		e.Event = EventMessage
+	case "JOIN":
+		if h := chatlib.FromContext(c); h != nil {
+			if n, ok := h.API(msg.API).(chatlib.Nicker); ok && strings.EqualFold(msg.Nick, n.Nick()) {
+				return nil
+			}
+		}
+		e.Event, e.Channel, e.Text = EventJoin, msg.Receiver, ""
+	default:
+		return nil
+	}
+	p.Notify(e)
+	return nil
+}
+
+func (p *Poster) journalEvent(c context.Context, ev chatlib.Event) {
+	p.Notify(OutboundEvent{Event: ev.Kind, Time: ev.Time, API: ev.API, Text: ev.Text})
+}
+
+// Notify queues e for the hooks that want it. It is dropped if the queue is
+// full.
+func (p *Poster) Notify(e OutboundEvent) {
+	for _, hk := range p.hooks {
+		if !hk.wants(e) {
+			continue
+		}
+		select {
+		case p.queue <- delivery{hk, e}:
+		default:
+			log.Warn().Str("module", ModuleName).Str("hook", hk.Name).Msgf("outbound webhook queue full, dropping %s event", e.Event)
+		}
+	}
+}
+
+// Run posts queued events until the context is cancelled.
+func (p *Poster) Run(c context.Context) error {
+	for {
+		select {
+		case <-c.Done():
+			return c.Err()
+		case d := <-p.queue:
+			if err := p.deliver(c, d); err != nil && c.Err() == nil {
+				log.Error().Str("module", ModuleName).Str("hook", d.hook.Name).Err(err).Msgf("giving up on %s event", d.event.Event)
+			}
+		}
+	}
+}
+
+// deliver posts an event, retrying with backoff.
+func (p *Poster) deliver(c context.Context, d delivery) error {
+	body, err := d.hook.body(d.event)
+	if err != nil {
+		return err
+	}
+	wait := p.backoff
+	for attempt := 0; ; attempt++ {
+		err = p.post(c, d.hook, body)
+		if err == nil || attempt >= p.retries {
+			return err
+		}
+		log.Warn().Str("module", ModuleName).Str("hook", d.hook.Name).Err(err).Msgf("error posting webhook, retrying in %s", wait)
+		select {
+		case <-c.Done():
+			return c.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+func (hk *Hook) body(e OutboundEvent) ([]byte, error) {
+	if hk.Template == nil {
+		return json.Marshal(e)
+	}
+	var buf bytes.Buffer
+	if err := hk.Template.Execute(&buf, e); err != nil {
+		return nil, errors.Wrapf(err, "webhook: failed to execute template for %s", hk.Name)
+	}
+	return buf.Bytes(), nil
+}
+
+func (p *Poster) post(c context.Context, hk *Hook, body []byte) error {
+	req, err := http.NewRequestWithContext(c, http.MethodPost, hk.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if hk.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(hk.Secret))
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	client := p.client
+	if client == nil {
+		// Bodies carry what users say, so hooks only reach public addresses
+		client = httpc.Safe()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.Errorf("webhook: %s returned %s: %s", hk.Name, resp.Status, msg)
+	}
+	return nil
+}
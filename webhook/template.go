@@ -0,0 +1,180 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+)
+
+// DefaultEvent is the template used for events that have none of their own.
+const DefaultEvent = "default"
+
+// eventHeaders are where services put the type of event, tried in order.
+var eventHeaders = []string{"X-GitHub-Event", "X-Gitlab-Event", "X-Event-Key", "X-Event-Type"}
+
+// Transform turns webhook payloads into messages with templates. Templates
+// are Go text/template executed on the decoded JSON payload, e.g.
+//
+//	{{.pusher.name}} pushed {{len .commits}} commits to {{.repository.full_name}}
+//
+// Besides the usual template functions, event returns the type of the event,
+// path looks up a dotted path such as "pull_request.head.ref", and lower,
+// upper, trimPrefix, truncate and join do what they say.
+type Transform struct {
+	// Text maps event types to the template of the text sent. Events without
+	// a template of their own use DefaultEvent, and are dropped if there is
+	// none. Lines of text are sent as separate messages and empty output
+	// drops the event.
+	Text map[string]*template.Template
+	// Targets, if set, picks the channels to send to, separated by commas or
+	// spaces. The source's targets are used if it is empty.
+	Targets *template.Template
+}
+
+// NewTransform parses the text templates, keyed by event type, and the
+// targets template, which may be empty.
+func NewTransform(text map[string]string, targets string) (*Transform, error) {
+	t := &Transform{Text: make(map[string]*template.Template)}
+	for event, src := range text {
+		tmpl, err := parseTemplate(event, src)
+		if err != nil {
+			return nil, err
+		}
+		t.Text[strings.ToLower(event)] = tmpl
+	}
+	if targets != "" {
+		tmpl, err := parseTemplate("targets", targets)
+		if err != nil {
+			return nil, err
+		}
+		t.Targets = tmpl
+	}
+	return t, nil
+}
+
+func parseTemplate(name, src string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=zero").Funcs(templateFuncs("")).Parse(src)
+	if err != nil {
+		return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "webhook: invalid template %s: %s", name, err)
+	}
+	return tmpl, nil
+}
+
+// Apply returns the lines of text and the targets for a webhook. No lines
+// means the event is dropped.
+func (t *Transform) Apply(r *http.Request, body []byte) ([]string, []string, error) {
+	event := eventType(r)
+	tmpl, ok := t.Text[strings.ToLower(event)]
+	if !ok {
+		if tmpl, ok = t.Text[DefaultEvent]; !ok {
+			return nil, nil, nil
+		}
+	}
+	var payload any
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, nil, errors.Wrap(err, "webhook: payload is not JSON")
+	}
+	text, err := execute(tmpl, event, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	lines := make([]string, 0)
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if t.Targets == nil || len(lines) == 0 {
+		return lines, nil, nil
+	}
+	targets, err := execute(t.Targets, event, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lines, strings.FieldsFunc(targets, func(r rune) bool { return r == ',' || r == ' ' }), nil
+}
+
+func execute(tmpl *template.Template, event string, payload any) (string, error) {
+	clone, err := tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := clone.Funcs(templateFuncs(event)).Execute(&buf, payload); err != nil {
+		return "", errors.Wrapf(err, "webhook: failed to execute template %s", tmpl.Name())
+	}
+	return buf.String(), nil
+}
+
+// eventType returns the type of event a webhook is for, or DefaultEvent if
+// the service doesn't say.
+func eventType(r *http.Request) string {
+	for _, h := range eventHeaders {
+		if v := r.Header.Get(h); v != "" {
+			return v
+		}
+	}
+	return DefaultEvent
+}
+
+func templateFuncs(event string) template.FuncMap {
+	return template.FuncMap{
+		"event":      func() string { return event },
+		"path":       lookupPath,
+		"lower":      strings.ToLower,
+		"upper":      strings.ToUpper,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"truncate": func(n int, s string) string {
+			if r := []rune(s); len(r) > n {
+				return string(r[:n]) + "…"
+			}
+			return s
+		},
+		"join": func(sep string, list []any) string {
+			parts := make([]string, len(list))
+			for i, v := range list {
+				parts[i] = toString(v)
+			}
+			return strings.Join(parts, sep)
+		},
+	}
+}
+
+// lookupPath follows a dotted path of object keys and array indexes, such as
+// "commits.0.message", returning nil if anything along it is missing.
+func lookupPath(path string, v any) any {
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			v = node[key]
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+func toString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
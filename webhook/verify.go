@@ -0,0 +1,167 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+)
+
+const ErrVerification chatlib.Error = "verificationFailed"
+
+// DefaultReplayWindow is how old a signed request may be, and how long
+// delivery IDs are remembered to refuse repeats.
+const DefaultReplayWindow = 5 * time.Minute
+
+// Ways of verifying that a request comes from the source it claims to.
+const (
+	VerifyNone   = "none"
+	VerifyGitHub = "github"
+	VerifySlack  = "slack"
+	VerifyBearer = "bearer"
+)
+
+// Verifier checks that a request, whose body has already been read, comes
+// from the source.
+type Verifier interface {
+	Verify(r *http.Request, body []byte) error
+}
+
+// NewVerifier returns the Verifier for method, one of the Verify constants,
+// with the source's secret. Requests older than window are refused.
+func NewVerifier(method, secret string, window time.Duration) (Verifier, error) {
+	if method != VerifyNone && secret == "" {
+		return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "webhook: %s verification requires a secret", method)
+	}
+	switch method {
+	case VerifyNone:
+		return noVerifier{}, nil
+	case VerifyGitHub:
+		return &GitHubVerifier{Secret: secret, seen: newReplayCache(window)}, nil
+	case VerifySlack:
+		return &SlackVerifier{Secret: secret, Window: window}, nil
+	case VerifyBearer:
+		return &BearerVerifier{Token: secret}, nil
+	}
+	return nil, errors.Wrapf(chatlib.ErrInvalidConfig, "webhook: invalid verification method: %s", method)
+}
+
+type noVerifier struct{}
+
+func (noVerifier) Verify(r *http.Request, body []byte) error { return nil }
+
+// GitHubVerifier checks the X-Hub-Signature-256 HMAC GitHub signs deliveries
+// with. GitHub doesn't sign a timestamp, so replays are refused by
+// remembering the X-GitHub-Delivery IDs seen recently.
+type GitHubVerifier struct {
+	Secret string
+
+	seen *replayCache
+}
+
+func (v *GitHubVerifier) Verify(r *http.Request, body []byte) error {
+	sig, ok := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	if !ok {
+		return errors.WithMessage(ErrVerification, "missing X-Hub-Signature-256")
+	}
+	if !validHMAC(v.Secret, body, sig) {
+		return errors.WithMessage(ErrVerification, "bad signature")
+	}
+	if id := r.Header.Get("X-GitHub-Delivery"); id != "" && v.seen != nil && !v.seen.add(id) {
+		return errors.WithMessagef(ErrVerification, "delivery %s replayed", id)
+	}
+	return nil
+}
+
+// SlackVerifier checks the X-Slack-Signature Slack signs requests with using
+// the app's signing secret, refusing requests older than Window.
+type SlackVerifier struct {
+	Secret string
+	Window time.Duration
+
+	now func() time.Time
+}
+
+func (v *SlackVerifier) Verify(r *http.Request, body []byte) error {
+	ts := r.Header.Get("X-Slack-Request-Timestamp")
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.WithMessage(ErrVerification, "missing X-Slack-Request-Timestamp")
+	}
+	now := time.Now
+	if v.now != nil {
+		now = v.now
+	}
+	if age := now().Sub(time.Unix(secs, 0)); age > v.Window || age < -v.Window {
+		return errors.WithMessagef(ErrVerification, "request is %s old", age.Round(time.Second))
+	}
+	sig, ok := strings.CutPrefix(r.Header.Get("X-Slack-Signature"), "v0=")
+	if !ok {
+		return errors.WithMessage(ErrVerification, "missing X-Slack-Signature")
+	}
+	if !validHMAC(v.Secret, append([]byte("v0:"+ts+":"), body...), sig) {
+		return errors.WithMessage(ErrVerification, "bad signature")
+	}
+	return nil
+}
+
+// BearerVerifier checks for a static token in the Authorization header.
+type BearerVerifier struct {
+	Token string
+}
+
+func (v *BearerVerifier) Verify(r *http.Request, body []byte) error {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(v.Token)) != 1 {
+		return errors.WithMessage(ErrVerification, "bad bearer token")
+	}
+	return nil
+}
+
+// validHMAC reports whether sig is the hex HMAC-SHA256 of data with secret,
+// in constant time.
+func validHMAC(secret string, data []byte, sig string) bool {
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(data)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// replayCache remembers IDs for a window.
+type replayCache struct {
+	window time.Duration
+	mu     sync.Mutex
+	seen   map[string]time.Time
+}
+
+func newReplayCache(window time.Duration) *replayCache {
+	return &replayCache{window: window, seen: make(map[string]time.Time)}
+}
+
+// add records id and reports whether it is new.
+func (rc *replayCache) add(id string) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	now := time.Now()
+	for k, t := range rc.seen {
+		if now.Sub(t) > rc.window {
+			delete(rc.seen, k)
+		}
+	}
+	if _, ok := rc.seen[id]; ok {
+		return false
+	}
+	rc.seen[id] = now
+	return true
+}
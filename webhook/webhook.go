@@ -0,0 +1,158 @@
+// Package webhook receives webhooks from services such as GitHub and Slack
+// and relays them to channels.
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultMaxBody = 1 << 20
+	// PathPrefix is where sources are served, e.g. /hooks/github.
+	PathPrefix = "/hooks/"
+)
+
+// Source is a service sending webhooks, served at PathPrefix + Name.
+type Source struct {
+	Name     string
+	Verifier Verifier
+	// Targets are the channels and nicks the source's events are sent to,
+	// through API if the bot has several.
+	Targets []string
+	API     string
+	// Transform, if set, makes the messages from the payload. Otherwise the
+	// payload's text field is sent, or the type of event.
+	Transform *Transform
+}
+
+// Server serves the webhook sources.
+type Server struct {
+	addr    string
+	maxBody int64
+	sources map[string]*Source
+	send    func(c context.Context, msg *chatlib.Message) error
+}
+
+// New returns a Server listening on addr. Bodies larger than maxBody bytes
+// are refused.
+func New(addr string, maxBody int64, sources ...*Source) *Server {
+	s := &Server{addr: addr, maxBody: maxBody, sources: make(map[string]*Source)}
+	for _, src := range sources {
+		s.sources[src.Name] = src
+	}
+	return s
+}
+
+// WithServer serves webhooks for as long as the Handler runs.
+func WithServer(s *Server) chatlib.Option {
+	return func(h *chatlib.Handler) error {
+		s.send = h.Send
+		return chatlib.WithTask("webhook", s.Run)(h)
+	}
+}
+
+// Run serves until the context is cancelled.
+func (s *Server) Run(c context.Context) error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return errors.Wrapf(err, "webhook: failed to listen on %s", s.addr)
+	}
+	srv := &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-c.Done()
+		srv.Close()
+	}()
+	log.Info().Str("module", ModuleName).Msgf("serving webhooks on %s", l.Addr())
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	src, ok := s.sources[strings.TrimPrefix(r.URL.Path, PathPrefix)]
+	if !ok || !strings.HasPrefix(r.URL.Path, PathPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, s.maxBody+1))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > s.maxBody {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := src.Verifier.Verify(r, body); err != nil {
+		log.Warn().Str("module", ModuleName).Str("source", src.Name).Str("remote", r.RemoteAddr).Err(err).Msg("refused webhook")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	targets := src.Targets
+	var lines []string
+	if src.Transform == nil {
+		lines = []string{s.format(src, r, body)}
+	} else {
+		var custom []string
+		lines, custom, err = src.Transform.Apply(r, body)
+		if err != nil {
+			log.Error().Str("module", ModuleName).Str("source", src.Name).Err(err).Msg("error transforming webhook")
+			http.Error(w, "failed to transform payload", http.StatusUnprocessableEntity)
+			return
+		}
+		if len(custom) > 0 {
+			targets = custom
+		}
+	}
+	for _, target := range targets {
+		for _, text := range lines {
+			if text == "" {
+				continue
+			}
+			if err := s.send(r.Context(), &chatlib.Message{
+				Command:  chatlib.CommandNotice,
+				Receiver: target,
+				Text:     text,
+				API:      src.API,
+			}); err != nil {
+				log.Error().Str("module", ModuleName).Str("source", src.Name).Err(err).Msgf("error relaying webhook to %s", target)
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// format returns the text a webhook is relayed as. Payloads with a text field,
+// like Slack's incoming webhooks, are relayed as is. Anything else is only
+// announced by its event type.
+func (s *Server) format(src *Source, r *http.Request, body []byte) string {
+	var payload struct {
+		Text string `json:"text"`
+	}
+	if json.Unmarshal(body, &payload) == nil && payload.Text != "" {
+		return "[" + src.Name + "] " + payload.Text
+	}
+	event := r.Header.Get("X-GitHub-Event")
+	if event == "" {
+		event = "event"
+	}
+	if event == "ping" {
+		return ""
+	}
+	return "[" + src.Name + "] " + event + " received"
+}
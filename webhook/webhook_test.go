@@ -0,0 +1,177 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/gregseb/chatlib"
+	"github.com/gregseb/chatlib/httpc"
+)
+
+func sign(secret, data string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerification(t *testing.T) {
+	github, _ := NewVerifier(VerifyGitHub, "gh-secret", time.Minute)
+	slack, _ := NewVerifier(VerifySlack, "slack-secret", time.Minute)
+	bearer, _ := NewVerifier(VerifyBearer, "token", time.Minute)
+	var sent []*chatlib.Message
+	s := New(":0", 64,
+		&Source{Name: "github", Verifier: github, Targets: []string{"#dev"}},
+		&Source{Name: "slack", Verifier: slack, Targets: []string{"#dev"}},
+		&Source{Name: "ci", Verifier: bearer, Targets: []string{"#dev"}},
+	)
+	s.send = func(c context.Context, msg *chatlib.Message) error {
+		sent = append(sent, msg)
+		return nil
+	}
+	body := `{"text":"build passed"}`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	for _, tc := range []struct {
+		name    string
+		path    string
+		body    string
+		headers map[string]string
+		status  int
+	}{
+		{"github", "/hooks/github", body, map[string]string{"X-Hub-Signature-256": "sha256=" + sign("gh-secret", body), "X-GitHub-Delivery": "1"}, http.StatusNoContent},
+		{"github replayed", "/hooks/github", body, map[string]string{"X-Hub-Signature-256": "sha256=" + sign("gh-secret", body), "X-GitHub-Delivery": "1"}, http.StatusUnauthorized},
+		{"github bad signature", "/hooks/github", body, map[string]string{"X-Hub-Signature-256": "sha256=" + sign("wrong", body), "X-GitHub-Delivery": "2"}, http.StatusUnauthorized},
+		{"github unsigned", "/hooks/github", body, nil, http.StatusUnauthorized},
+		{"slack", "/hooks/slack", body, map[string]string{"X-Slack-Request-Timestamp": now, "X-Slack-Signature": "v0=" + sign("slack-secret", "v0:"+now+":"+body)}, http.StatusNoContent},
+		{"slack stale", "/hooks/slack", body, map[string]string{"X-Slack-Request-Timestamp": stale, "X-Slack-Signature": "v0=" + sign("slack-secret", "v0:"+stale+":"+body)}, http.StatusUnauthorized},
+		{"bearer", "/hooks/ci", body, map[string]string{"Authorization": "Bearer token"}, http.StatusNoContent},
+		{"bearer wrong", "/hooks/ci", body, map[string]string{"Authorization": "Bearer nope"}, http.StatusUnauthorized},
+		{"unknown source", "/hooks/other", body, nil, http.StatusNotFound},
+		{"too large", "/hooks/ci", strings.Repeat("x", 65), map[string]string{"Authorization": "Bearer token"}, http.StatusRequestEntityTooLarge},
+	} {
+		r := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, w.Code)
+		}
+	}
+	if len(sent) != 3 {
+		t.Fatalf("expected 3 messages relayed, got %d", len(sent))
+	}
+	if sent[0].Receiver != "#dev" || sent[0].Text != "[github] build passed" {
+		t.Errorf("unexpected message %+v", sent[0])
+	}
+}
+
+func TestTransform(t *testing.T) {
+	tr, err := NewTransform(map[string]string{
+		"push":    `{{.pusher.name}} pushed {{len .commits}} commits to {{trimPrefix "refs/heads/" .ref}}: {{path "commits.0.message" . | truncate 10}}`,
+		"issues":  "{{if eq .action \"opened\"}}new issue: {{.issue.title}}\n{{.issue.url}}{{end}}",
+		"default": "{{event}}: {{join \", \" .labels}}",
+	}, `{{if eq .repository "infra"}}#ops,#infra{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		event   string
+		body    string
+		lines   []string
+		targets []string
+	}{
+		{"push", `{"ref":"refs/heads/main","pusher":{"name":"greg"},"commits":[{"message":"fix the thing properly"},{}]}`, []string{"greg pushed 2 commits to main: fix the th…"}, nil},
+		{"issues", `{"action":"opened","issue":{"title":"broken","url":"https://example.com/1"},"repository":"infra"}`, []string{"new issue: broken", "https://example.com/1"}, []string{"#ops", "#infra"}},
+		{"issues", `{"action":"closed","issue":{"title":"broken"}}`, []string{}, nil},
+		{"", `{"labels":["a","b"]}`, []string{"default: a, b"}, nil},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/hooks/github", nil)
+		if tc.event != "" {
+			r.Header.Set("X-GitHub-Event", tc.event)
+		}
+		lines, targets, err := tr.Apply(r, []byte(tc.body))
+		if err != nil {
+			t.Errorf("%s: %s", tc.event, err)
+			continue
+		}
+		if strings.Join(lines, "|") != strings.Join(tc.lines, "|") || strings.Join(targets, ",") != strings.Join(tc.targets, ",") {
+			t.Errorf("%s: expected %q to %v, got %q to %v", tc.event, tc.lines, tc.targets, lines, targets)
+		}
+	}
+	if _, err := NewTransform(map[string]string{"push": "{{.broken"}, ""); err == nil {
+		t.Error("expected an invalid template to be refused")
+	}
+}
+
+func TestPoster(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	fails := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if fails > 0 {
+			fails--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if got := r.Header.Get(SignatureHeader); got != "sha256="+sign("hook-secret", string(body)) {
+			t.Errorf("bad signature %q", got)
+		}
+		bodies = append(bodies, string(body))
+	}))
+	defer srv.Close()
+	tmpl := template.Must(template.New("deploys").Parse(`{"who":"{{.Nick}}","what":"{{.Text}}"}`))
+	p := NewPoster(2, time.Millisecond, &Hook{
+		Name:     "deploys",
+		URL:      srv.URL,
+		Events:   []string{EventMessage, chatlib.EventConnect},
+		Pattern:  regexp.MustCompile(`^!deploy `),
+		Secret:   "hook-secret",
+		Template: tmpl,
+	})
+	// Hooks are only posted to public addresses by default
+	if err := p.post(context.Background(), p.hooks[0], []byte("{}")); !errors.Is(err, httpc.ErrUnsafeURL) {
+		t.Fatalf("expected a hook to a loopback address to be refused, got %v", err)
+	}
+	p.client = srv.Client()
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(c)
+	p.middleware(c, &chatlib.Message{Command: chatlib.CommandMessage, Nick: "alice", Receiver: "#dev", Text: "hello"})
+	p.middleware(c, &chatlib.Message{Command: chatlib.CommandMessage, Nick: "alice", Receiver: "#dev", Text: "!deploy prod"})
+	p.middleware(c, &chatlib.Message{Command: "JOIN", Nick: "bob", Receiver: "#dev"})
+	p.journalEvent(c, chatlib.Event{Kind: chatlib.EventConnect, Text: "connected"})
+	want := []string{`{"who":"alice","what":"!deploy prod"}`, `{"who":"","what":"connected"}`}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(bodies)
+		mu.Unlock()
+		if n >= len(want) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(bodies, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got bodies %q, want %q", bodies, want)
+	}
+}